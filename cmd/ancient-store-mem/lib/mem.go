@@ -19,9 +19,15 @@ package lib
 import (
 	"errors"
 	"fmt"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/params"
 )
 
 const (
@@ -32,20 +38,63 @@ const (
 	freezerRemoteDifficultyTable = "diffs"
 )
 
+// freezerRemoteKinds are the kinds stored for every item.
+var freezerRemoteKinds = []string{
+	freezerRemoteHashTable,
+	freezerRemoteHeaderTable,
+	freezerRemoteBodiesTable,
+	freezerRemoteReceiptTable,
+	freezerRemoteDifficultyTable,
+}
+
 var (
 	errOutOfBounds = errors.New("out of bounds")
 	errOutOfOrder  = errors.New("out of order")
 )
 
+// recentAppendKeys is the number of most recent append idempotency keys remembered.
+const recentAppendKeys = 1024
+
+// compactSegmentItems is the number of items compaction merges adjacent segments into.
+const compactSegmentItems = 1024
+
+// truncateBatchSize is the number of items deleted per store lock acquisition
+// during a truncation, letting readers interleave with large truncations.
+const truncateBatchSize = 1024
+
 // MemFreezerRemoteServerAPI is a mock freezer server implementation.
+//
+// Reads only contend with writers for short critical sections: a truncation
+// first lowers the item count, immediately hiding the removed items, and then
+// deletes them in batches. Reads of items below the truncation target are
+// served while the deletion is in progress.
+//
+// Appended items are stored individually, simulating a small segment file each.
+// Compaction merges adjacent small segments into larger ones, see Compact.
 type MemFreezerRemoteServerAPI struct {
-	store map[string][]byte
-	count uint64
-	mu    sync.Mutex
+	lastWrite int64 // Unix nanoseconds of the last append or truncation (atomic)
+
+	store    map[string][]byte
+	segments []*memSegment // Compacted items, ordered by number and disjoint with store
+	count    uint64
+	mu       sync.RWMutex // Protects store, segments and count
+	write    sync.Mutex   // Serializes appends, truncations and compactions
+
+	keys     map[string]uint64 // Recent append idempotency keys and the numbers they appended, protected by write
+	keyOrder []string          // Recent append idempotency keys, oldest first
+
+	segmentSize uint64 // Target byte size of compacted segments, 0 to cut by item count, protected by write
+	capacity    uint64 // Byte size the items may fill, 0 if unlimited, protected by mu
+
+	lease       sync.Mutex // Protects the write lease
+	leaseOwner  string     // Holder of the write lease, empty if none
+	leaseExpiry time.Time  // Time the write lease lapses unless renewed
+
+	truncateHook func() // Called between truncation batches, used by tests
 }
 
 func NewMemFreezerRemoteServerAPI() *MemFreezerRemoteServerAPI {
-	return &MemFreezerRemoteServerAPI{store: make(map[string][]byte)}
+	return &MemFreezerRemoteServerAPI{store: make(map[string][]byte), keys: make(map[string]uint64)}
 }
 
 func (r *MemFreezerRemoteServerAPI) storeKey(kind string, number uint64) string {
@@ -53,25 +102,202 @@ func (r *MemFreezerRemoteServerAPI) storeKey(kind string, number uint64) string
 }
 
 func (f *MemFreezerRemoteServerAPI) Reset() {
-	f.count = 0
+	f.write.Lock()
+	defer f.write.Unlock()
 	f.mu.Lock()
+	f.count = 0
 	f.store = make(map[string][]byte)
+	f.segments = nil
 	f.mu.Unlock()
+	f.keys, f.keyOrder = make(map[string]uint64), nil
 }
 
-func (f *MemFreezerRemoteServerAPI) HasAncient(kind string, number uint64) (bool, error) {
-	// fmt.Println("mock server called", "method=HasAncient")
+// memSegment holds the items [start, end) of every kind, concatenated like in a
+// segment file of a real freezer.
+type memSegment struct {
+	start, end uint64
+	data       map[string][]byte   // Concatenated items per kind
+	offsets    map[string][]uint64 // End offsets of the items in data per kind
+}
+
+// item returns the item of the given kind and number, if the segment has it.
+func (s *memSegment) item(kind string, number uint64) ([]byte, bool) {
+	offsets, ok := s.offsets[kind]
+	if !ok || number < s.start || number >= s.end {
+		return nil, false
+	}
+	i, from := number-s.start, uint64(0)
+	if i > 0 {
+		from = offsets[i-1]
+	}
+	return s.data[kind][from:offsets[i]], true
+}
+
+// SetSegmentSize sets the target byte size, summed over all kinds, of the segments
+// created by compaction, eg. to match the preferred object size of an object store.
+// Segments are cut at the item boundary nearest to the target; an item larger than
+// the target makes up a segment of its own. Zero restores cutting segments by item
+// count. Existing segments are left as they are.
+func (f *MemFreezerRemoteServerAPI) SetSegmentSize(size uint64) {
+	f.write.Lock()
+	defer f.write.Unlock()
+	f.segmentSize = size
+}
+
+// SetCapacity sets the byte size the items may fill, summed over all kinds, which
+// the free space reported by FreeSpace is computed from. Zero, the default, reports
+// unlimited free space. Appends are not refused beyond it.
+func (f *MemFreezerRemoteServerAPI) SetCapacity(capacity uint64) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	_, ok := f.store[f.storeKey(kind, number)]
+	f.capacity = capacity
+}
+
+// FreeSpace returns the space available for further items, in bytes: the capacity
+// left, or the maximum uint64 if the capacity is unlimited, see SetCapacity.
+func (f *MemFreezerRemoteServerAPI) FreeSpace() (uint64, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.capacity == 0 {
+		return math.MaxUint64, nil
+	}
+	if used := f.spanSize(0, f.count); used < f.capacity {
+		return f.capacity - used, nil
+	}
+	return 0, nil
+}
+
+// SegmentInfo describes a compacted segment.
+type SegmentInfo struct {
+	Start uint64 `json:"start"` // Number of the first item
+	End   uint64 `json:"end"`   // Number of the item after the last one
+	Size  uint64 `json:"size"`  // Byte size of the items, summed over all kinds
+}
+
+// Layout returns the compacted segments, ordered by number. Items not covered by
+// any segment are stored individually.
+func (f *MemFreezerRemoteServerAPI) Layout() ([]SegmentInfo, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	layout := make([]SegmentInfo, len(f.segments))
+	for i, s := range f.segments {
+		layout[i] = SegmentInfo{Start: s.start, End: s.end, Size: f.spanSize(s.start, s.end)}
+	}
+	return layout, nil
+}
+
+// spanSize returns the byte size of the items [start, end), summed over all kinds.
+// The caller must hold mu or write.
+func (f *MemFreezerRemoteServerAPI) spanSize(start, end uint64) uint64 {
+	size := uint64(0)
+	for _, kind := range freezerRemoteKinds {
+		for number := start; number < end; number++ {
+			v, _ := f.lookup(kind, number)
+			size += uint64(len(v))
+		}
+	}
+	return size
+}
+
+// segment returns the compacted segment containing number, or nil. The caller
+// must hold mu or write.
+func (f *MemFreezerRemoteServerAPI) segment(number uint64) *memSegment {
+	i := sort.Search(len(f.segments), func(i int) bool { return f.segments[i].end > number })
+	if i < len(f.segments) && f.segments[i].start <= number {
+		return f.segments[i]
+	}
+	return nil
+}
+
+// lookup returns an item, wherever it is stored. The caller must hold mu or write.
+func (f *MemFreezerRemoteServerAPI) lookup(kind string, number uint64) ([]byte, bool) {
+	if v, ok := f.store[f.storeKey(kind, number)]; ok {
+		return v, true
+	}
+	if s := f.segment(number); s != nil {
+		return s.item(kind, number)
+	}
+	return nil, false
+}
+
+// FreezerInfo describes the mock server, it mirrors rawdb.FreezerRemoteInfo.
+type FreezerInfo struct {
+	Version  string          `json:"version"`
+	Commit   string          `json:"commit"`
+	Features FreezerFeatures `json:"features"`
+}
+
+// FreezerFeatures are the optional capabilities of the mock server.
+type FreezerFeatures struct {
+	Compression bool `json:"compression"`
+	Batch       bool `json:"batch"`
+	Namespaces  bool `json:"namespaces"`
+
+	IdempotentAppend bool `json:"idempotentAppend"`
+	Lease            bool `json:"lease"`
+
+	Serializers []string `json:"serializers,omitempty"`
+}
+
+// Info returns stub server info. Batch requests are handled by the RPC server.
+func (f *MemFreezerRemoteServerAPI) Info() (*FreezerInfo, error) {
+	// fmt.Println("mock server called", "method=Info")
+	return &FreezerInfo{
+		Version:  "ancient-store-mem/" + params.VersionWithMeta,
+		Features: FreezerFeatures{Batch: true, IdempotentAppend: true, Lease: true, Serializers: []string{"framed"}},
+	}, nil
+}
+
+// AcquireLease grants owner the exclusive write lease for ttl seconds, or renews it
+// if owner already holds it. It returns false if another owner holds a lease which
+// has not lapsed yet.
+//
+// The lease is advisory: clients refused it are expected to limit themselves to reads.
+func (f *MemFreezerRemoteServerAPI) AcquireLease(owner string, ttl uint64) (bool, error) {
+	if owner == "" {
+		return false, errors.New("empty lease owner")
+	}
+	f.lease.Lock()
+	defer f.lease.Unlock()
+
+	now := time.Now()
+	if f.leaseOwner != "" && f.leaseOwner != owner && now.Before(f.leaseExpiry) {
+		return false, nil
+	}
+	f.leaseOwner, f.leaseExpiry = owner, now.Add(time.Duration(ttl)*time.Second)
+	return true, nil
+}
+
+// ReleaseLease gives up the write lease, if owner holds it.
+func (f *MemFreezerRemoteServerAPI) ReleaseLease(owner string) error {
+	f.lease.Lock()
+	defer f.lease.Unlock()
+
+	if f.leaseOwner == owner {
+		f.leaseOwner, f.leaseExpiry = "", time.Time{}
+	}
+	return nil
+}
+
+func (f *MemFreezerRemoteServerAPI) HasAncient(kind string, number uint64) (bool, error) {
+	// fmt.Println("mock server called", "method=HasAncient")
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if number >= f.count {
+		return false, nil
+	}
+	_, ok := f.lookup(kind, number)
 	return ok, nil
 }
 
 func (f *MemFreezerRemoteServerAPI) Ancient(kind string, number uint64) ([]byte, error) {
 	// fmt.Println("mock server called", "method=Ancient")
-	f.mu.Lock()
-	defer f.mu.Unlock()
-	v, ok := f.store[f.storeKey(kind, number)]
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if number >= f.count {
+		return nil, errOutOfBounds
+	}
+	v, ok := f.lookup(kind, number)
 	if !ok {
 		return nil, errOutOfBounds
 	}
@@ -80,58 +306,268 @@ func (f *MemFreezerRemoteServerAPI) Ancient(kind string, number uint64) ([]byte,
 
 func (f *MemFreezerRemoteServerAPI) Ancients() (uint64, error) {
 	// fmt.Println("mock server called", "method=Ancients")
+	f.mu.RLock()
+	defer f.mu.RUnlock()
 	return f.count, nil
 }
 
 func (f *MemFreezerRemoteServerAPI) AncientSize(kind string) (uint64, error) {
 	// fmt.Println("mock server called", "method=AncientSize")
+	f.mu.RLock()
+	defer f.mu.RUnlock()
 	sum := uint64(0)
-	for k, v := range f.store {
-		if strings.HasPrefix(k, kind) {
-			sum += uint64(len(v))
-		}
+	for number := uint64(0); number < f.count; number++ {
+		v, _ := f.lookup(kind, number)
+		sum += uint64(len(v))
 	}
 	return sum, nil
 }
 
-func (f *MemFreezerRemoteServerAPI) AppendAncient(number uint64, hash, header, body, receipt, td []byte) error {
-	// fmt.Println("mock server called", "method=AppendAncient", "number=", number, "header", fmt.Sprintf("%x", header))
-	fieldNames := []string{
-		freezerRemoteHashTable,
-		freezerRemoteHeaderTable,
-		freezerRemoteBodiesTable,
-		freezerRemoteReceiptTable,
-		freezerRemoteDifficultyTable,
+func (f *MemFreezerRemoteServerAPI) AncientKinds() (map[string]uint64, error) {
+	// fmt.Println("mock server called", "method=AncientKinds")
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.kinds(), nil
+}
+
+// kinds returns the item count of every kind, the caller must hold mu.
+func (f *MemFreezerRemoteServerAPI) kinds() map[string]uint64 {
+	kinds := make(map[string]uint64)
+	for _, kind := range freezerRemoteKinds {
+		kinds[kind] = f.count
 	}
+	return kinds
+}
+
+// FreezerState mirrors rawdb.FreezerRemoteState.
+type FreezerState struct {
+	Ancients uint64            `json:"ancients"`
+	Tail     uint64            `json:"tail"`
+	Kinds    map[string]uint64 `json:"kinds"`
+}
+
+func (f *MemFreezerRemoteServerAPI) State() (*FreezerState, error) {
+	// fmt.Println("mock server called", "method=State")
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return &FreezerState{Ancients: f.count, Kinds: f.kinds()}, nil
+}
+
+// AppendAncient appends the items of a block. A retried append carrying the
+// idempotency key of a recent append which landed succeeds without a write.
+func (f *MemFreezerRemoteServerAPI) AppendAncient(number uint64, hash, header, body, receipt, td []byte, key *string) error {
+	// fmt.Println("mock server called", "method=AppendAncient", "number=", number, "header", fmt.Sprintf("%x", header))
 	fields := [][]byte{hash, header, body, receipt, td}
+	f.write.Lock()
+	defer f.write.Unlock()
+	defer atomic.StoreInt64(&f.lastWrite, time.Now().UnixNano())
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if key != nil {
+		if n, ok := f.keys[*key]; ok && n == number && n < f.count {
+			return nil
+		}
+	}
 	if number != f.count {
 		return errOutOfOrder
 	}
-	f.count = number + 1
-	f.mu.Lock()
-	defer f.mu.Unlock()
 	for i, fv := range fields {
-		kind := fieldNames[i]
+		kind := freezerRemoteKinds[i]
 		f.store[f.storeKey(kind, number)] = fv
 	}
+	f.count = number + 1
+	if key != nil {
+		f.rememberKey(*key, number)
+	}
 	return nil
 }
 
+// rememberKey records an append idempotency key, forgetting the oldest one once
+// more than recentAppendKeys are known. The caller must hold write.
+func (f *MemFreezerRemoteServerAPI) rememberKey(key string, number uint64) {
+	if _, ok := f.keys[key]; !ok {
+		f.keyOrder = append(f.keyOrder, key)
+	}
+	f.keys[key] = number
+	if len(f.keyOrder) > recentAppendKeys {
+		delete(f.keys, f.keyOrder[0])
+		f.keyOrder = f.keyOrder[1:]
+	}
+}
+
 func (f *MemFreezerRemoteServerAPI) TruncateAncients(n uint64) error {
 	// fmt.Println("mock server called", "method=TruncateAncients")
-	f.count = n
+	f.write.Lock()
+	defer f.write.Unlock()
+	defer atomic.StoreInt64(&f.lastWrite, time.Now().UnixNano())
+
+	// Hide the truncated items from readers, drop the compacted segments beyond
+	// them and collect their individually stored keys.
 	f.mu.Lock()
-	defer f.mu.Unlock()
+	f.count = n
+	for len(f.segments) > 0 && f.segments[len(f.segments)-1].start >= n {
+		f.segments = f.segments[:len(f.segments)-1]
+	}
+	if len(f.segments) > 0 {
+		if last := f.segments[len(f.segments)-1]; last.end > n {
+			trimmed := *last
+			trimmed.end = n
+			f.segments[len(f.segments)-1] = &trimmed
+		}
+	}
+	var keys []string
 	for k := range f.store {
 		spl := strings.Split(k, "-")
 		num, err := strconv.ParseUint(spl[1], 10, 64)
 		if err != nil {
+			f.mu.Unlock()
 			return err
 		}
 		if num >= n {
+			keys = append(keys, k)
+		}
+	}
+	f.mu.Unlock()
+
+	// Delete them in batches, releasing the lock in between so reads of the
+	// remaining items are not blocked for the whole truncation.
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > truncateBatchSize {
+			batch = batch[:truncateBatchSize]
+		}
+		keys = keys[len(batch):]
+
+		f.mu.Lock()
+		for _, k := range batch {
 			delete(f.store, k)
 		}
+		f.mu.Unlock()
+
+		if f.truncateHook != nil {
+			f.truncateHook()
+		}
+	}
+	return nil
+}
+
+// Compact merges adjacent small segments, ie. individually stored items and compacted
+// segments of fewer than compactSegmentItems items, into segments of up to
+// compactSegmentItems items. If a target segment size is set, segments are instead cut
+// at the item boundaries nearest to multiples of it, see SetSegmentSize. It returns the
+// number of segments created.
+//
+// Appends and truncations wait for a compaction to finish, reads do not: merged
+// segments are built without holding the read lock and each one replaces the
+// segments it merges in a single short critical section.
+func (f *MemFreezerRemoteServerAPI) Compact() (int, error) {
+	// fmt.Println("mock server called", "method=Compact")
+	f.write.Lock()
+	defer f.write.Unlock()
+
+	// The store is only modified while holding write, so it can be read without mu.
+	type span struct{ start, end uint64 }
+	var (
+		groups [][]span
+		group  []span
+		size   uint64
+	)
+	for number := uint64(0); number < f.count; {
+		next := span{number, number + 1}
+		if s := f.segment(number); s != nil {
+			next.end = s.end
+		}
+		number = next.end
+
+		if f.segmentSize == 0 {
+			if size+next.end-next.start > compactSegmentItems {
+				groups, group, size = append(groups, group), nil, 0
+			}
+			group, size = append(group, next), size+next.end-next.start
+			continue
+		}
+		// Cut at the item boundary nearest to the target byte size.
+		spanBytes := f.spanSize(next.start, next.end)
+		if size > 0 && size+spanBytes > f.segmentSize && size+spanBytes-f.segmentSize >= f.segmentSize-size {
+			groups, group, size = append(groups, group), nil, 0
+		}
+		group, size = append(group, next), size+spanBytes
+		if size >= f.segmentSize {
+			groups, group, size = append(groups, group), nil, 0
+		}
+	}
+	groups = append(groups, group)
+
+	merged := 0
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+		start, end := group[0].start, group[len(group)-1].end
+		seg := &memSegment{
+			start:   start,
+			end:     end,
+			data:    make(map[string][]byte),
+			offsets: make(map[string][]uint64),
+		}
+		for _, kind := range freezerRemoteKinds {
+			for number := start; number < end; number++ {
+				v, _ := f.lookup(kind, number)
+				seg.data[kind] = append(seg.data[kind], v...)
+				seg.offsets[kind] = append(seg.offsets[kind], uint64(len(seg.data[kind])))
+			}
+		}
+		f.mu.Lock()
+		first := sort.Search(len(f.segments), func(i int) bool { return f.segments[i].end > start })
+		last := first
+		for last < len(f.segments) && f.segments[last].start < end {
+			last++
+		}
+		f.segments = append(f.segments[:first], append([]*memSegment{seg}, f.segments[last:]...)...)
+		for number := start; number < end; number++ {
+			for _, kind := range freezerRemoteKinds {
+				delete(f.store, f.storeKey(kind, number))
+			}
+		}
+		f.mu.Unlock()
+		merged++
+	}
+	return merged, nil
+}
+
+// RunCompaction compacts the store whenever it has not been written to for the given
+// idle period, until quit is closed.
+func RunCompaction(f *MemFreezerRemoteServerAPI, idle time.Duration, quit <-chan struct{}) {
+	ticker := time.NewTicker(idle)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&f.lastWrite))) >= idle {
+				f.Compact()
+			}
+		}
+	}
+}
+
+// Corrupt flips the lowest bit of the first byte of an item in place, simulating
+// bit-rot of the stored data, eg. to test integrity checks of clients.
+func (f *MemFreezerRemoteServerAPI) Corrupt(kind string, number uint64) error {
+	f.write.Lock()
+	defer f.write.Unlock()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if number >= f.count {
+		return errOutOfBounds
+	}
+	v, ok := f.lookup(kind, number)
+	if !ok || len(v) == 0 {
+		return fmt.Errorf("no %s data at #%d to corrupt", kind, number)
 	}
+	v[0] ^= 0x01
 	return nil
 }
 
@@ -0,0 +1,245 @@
+// Copyright 2020 The core-geth Authors
+// This file is part of the core-geth library.
+//
+// The core-geth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The core-geth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the core-geth library. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemFreezerReadsDuringTruncate(t *testing.T) {
+	f := NewMemFreezerRemoteServerAPI()
+	for i := uint64(0); i < 2000; i++ {
+		b := []byte{byte(i)}
+		if err := f.AppendAncient(i, b, b, b, b, b, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Stall the truncation after its first batch until the reads are done.
+	started, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	f.truncateHook = func() {
+		once.Do(func() {
+			close(started)
+			<-release
+		})
+	}
+	done := make(chan error)
+	go func() { done <- f.TruncateAncients(100) }()
+	<-started
+
+	var wg sync.WaitGroup
+	errc := make(chan error, 100)
+	for i := uint64(0); i < 100; i++ {
+		wg.Add(1)
+		go func(number uint64) {
+			defer wg.Done()
+			v, err := f.Ancient(freezerRemoteHeaderTable, number)
+			if err == nil && !bytes.Equal(v, []byte{byte(number)}) {
+				t.Errorf("ancient %d: have %x, want %x", number, v, []byte{byte(number)})
+			}
+			errc <- err
+		}(i)
+	}
+	reads := make(chan struct{})
+	go func() { wg.Wait(); close(reads) }()
+	select {
+	case <-reads:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reads below the truncation target blocked by truncate")
+	}
+	close(errc)
+	for err := range errc {
+		if err != nil {
+			t.Errorf("read during truncate: %v", err)
+		}
+	}
+	// Items above the target are already hidden.
+	if n, _ := f.Ancients(); n != 100 {
+		t.Errorf("ancients during truncate: have %d, want 100", n)
+	}
+	if _, err := f.Ancient(freezerRemoteHeaderTable, 1500); err != errOutOfBounds {
+		t.Errorf("read above truncation target: have %v, want %v", err, errOutOfBounds)
+	}
+	select {
+	case <-done:
+		t.Fatal("truncate finished before being released")
+	default:
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(f.store) != 100*5 {
+		t.Errorf("store size after truncate: have %d, want %d", len(f.store), 100*5)
+	}
+}
+
+func TestMemFreezerCompact(t *testing.T) {
+	f := NewMemFreezerRemoteServerAPI()
+	const items = 3000
+	for i := uint64(0); i < items; i++ {
+		b := []byte{byte(i), byte(i >> 8)}
+		if err := f.AppendAncient(i, b, b, b, b, b, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(t *testing.T, count uint64) {
+		t.Helper()
+		if n, _ := f.Ancients(); n != count {
+			t.Errorf("ancients: have %d, want %d", n, count)
+		}
+		for i := uint64(0); i < count; i++ {
+			want := []byte{byte(i), byte(i >> 8)}
+			for _, kind := range freezerRemoteKinds {
+				v, err := f.Ancient(kind, i)
+				if err != nil {
+					t.Fatalf("ancient %s %d: %v", kind, i, err)
+				}
+				if !bytes.Equal(v, want) {
+					t.Fatalf("ancient %s %d: have %x, want %x", kind, i, v, want)
+				}
+			}
+		}
+		if _, err := f.Ancient(freezerRemoteHeaderTable, count); err != errOutOfBounds {
+			t.Errorf("read above count: have %v, want %v", err, errOutOfBounds)
+		}
+	}
+
+	// Read concurrently with the compaction.
+	stop, reads := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(reads)
+		for i := uint64(0); ; i = (i + 7) % items {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			v, err := f.Ancient(freezerRemoteBodiesTable, i)
+			if err != nil || !bytes.Equal(v, []byte{byte(i), byte(i >> 8)}) {
+				t.Errorf("ancient %d during compaction: have %x, %v", i, v, err)
+				return
+			}
+		}
+	}()
+	merged, err := f.Compact()
+	close(stop)
+	<-reads
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged != 3 {
+		t.Errorf("merged segments: have %d, want 3", merged)
+	}
+	if len(f.store) != 0 || len(f.segments) != 3 {
+		t.Errorf("after compaction: have %d items and %d segments, want 0 and 3", len(f.store), len(f.segments))
+	}
+	check(t, items)
+
+	// Compacting again leaves the full segments alone and merges the small tail.
+	if merged, _ := f.Compact(); merged != 0 {
+		t.Errorf("merged segments on recompaction: have %d, want 0", merged)
+	}
+	if err := f.TruncateAncients(2500); err != nil {
+		t.Fatal(err)
+	}
+	check(t, 2500)
+	for i := uint64(2500); i < 2600; i++ {
+		b := []byte{byte(i), byte(i >> 8)}
+		if err := f.AppendAncient(i, b, b, b, b, b, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if merged, _ := f.Compact(); merged != 1 {
+		t.Errorf("merged segments after append: have %d, want 1", merged)
+	}
+	if len(f.store) != 0 || len(f.segments) != 3 {
+		t.Errorf("after recompaction: have %d items and %d segments, want 0 and 3", len(f.store), len(f.segments))
+	}
+	check(t, 2600)
+	if size, _ := f.AncientSize(freezerRemoteHashTable); size != 2600*2 {
+		t.Errorf("ancient size: have %d, want %d", size, 2600*2)
+	}
+}
+
+func TestMemFreezerSegmentSize(t *testing.T) {
+	f := NewMemFreezerRemoteServerAPI()
+	f.SetSegmentSize(100)
+
+	// Items of varying sizes, 5 to 50 bytes summed over all kinds.
+	blob := func(number uint64) []byte {
+		return bytes.Repeat([]byte{byte(number)}, int(1+number%10))
+	}
+	const items = 200
+	for i := uint64(0); i < items; i++ {
+		b := blob(i)
+		if err := f.AppendAncient(i, b, b, b, b, b, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := f.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	layout, _ := f.Layout()
+	if len(layout) < 2 {
+		t.Fatalf("segments: have %d, want several", len(layout))
+	}
+	// Segments are contiguous and cut at the item boundary nearest to the target.
+	next := uint64(0)
+	for i, seg := range layout {
+		if seg.Start != next {
+			t.Fatalf("segment %d: starts at %d, want %d", i, seg.Start, next)
+		}
+		next = seg.End
+		if i == len(layout)-1 {
+			break
+		}
+		shorter := seg.Size - 5*uint64(len(blob(seg.End-1)))
+		longer := seg.Size + 5*uint64(len(blob(seg.End)))
+		if dist(seg.Size, 100) > dist(shorter, 100) || dist(seg.Size, 100) > dist(longer, 100) {
+			t.Errorf("segment %d [%d, %d): size %d not nearest to target (%d or %d)", i, seg.Start, seg.End, seg.Size, shorter, longer)
+		}
+	}
+	if uint64(len(f.store)) != (items-next)*5 {
+		t.Errorf("segments end at %d, %d items stored individually", next, len(f.store)/5)
+	}
+	// Reads across segment boundaries return the original items.
+	for _, seg := range layout {
+		for _, number := range []uint64{seg.Start, seg.End - 1} {
+			for _, kind := range freezerRemoteKinds {
+				if v, err := f.Ancient(kind, number); err != nil || !bytes.Equal(v, blob(number)) {
+					t.Errorf("ancient %s %d: have %x (%v), want %x", kind, number, v, err, blob(number))
+				}
+			}
+		}
+	}
+	for i := uint64(0); i < items; i++ {
+		if v, err := f.Ancient(freezerRemoteHeaderTable, i); err != nil || !bytes.Equal(v, blob(i)) {
+			t.Errorf("ancient %d: have %x (%v), want %x", i, v, err, blob(i))
+		}
+	}
+}
+
+func dist(a, b uint64) uint64 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
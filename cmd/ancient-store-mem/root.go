@@ -21,12 +21,24 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/ethereum/go-ethereum/cmd/ancient-store-mem/lib"
 	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/spf13/cobra"
 )
 
+var (
+	// compactIdle is the idle period after which the store is compacted, zero disables compaction.
+	compactIdle time.Duration
+
+	// segmentSize is the target byte size of compacted segments, zero cuts them by item count.
+	segmentSize uint64
+
+	// capacity is the byte size the stored items may fill, zero if unlimited.
+	capacity uint64
+)
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "ancient-store-mem",
@@ -57,11 +69,16 @@ Package 'lib' logic may be imported and used in testing contexts as well.
 		}
 		defer os.Remove(ipcPath)
 		mock := lib.NewMemFreezerRemoteServerAPI()
+		mock.SetSegmentSize(segmentSize)
+		mock.SetCapacity(capacity)
 		err = server.RegisterName("freezer", mock)
 		if err != nil {
 			log.Fatalln(err)
 		}
 		quit := make(chan bool, 1)
+		if compactIdle > 0 {
+			go lib.RunCompaction(mock, compactIdle, nil)
+		}
 		go func() {
 			log.Println("Serving", listener.Addr())
 			log.Fatalln(server.ServeListener(listener))
@@ -70,6 +87,12 @@ Package 'lib' logic may be imported and used in testing contexts as well.
 	},
 }
 
+func init() {
+	rootCmd.Flags().DurationVar(&compactIdle, "compact-idle", time.Minute, "Idle period after which small segments are merged (0 disables compaction)")
+	rootCmd.Flags().Uint64Var(&segmentSize, "segment-size", 0, "Target byte size of compacted segments, cut at the nearest block boundary (0 cuts by block count)")
+	rootCmd.Flags().Uint64Var(&capacity, "capacity", 0, "Byte size the stored blocks may fill, reported as free space to freezer clients (0 is unlimited)")
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
@@ -69,6 +69,17 @@ var (
 		utils.DataDirFlag,
 		utils.AncientFlag,
 		utils.AncientRPCFlag,
+		utils.AncientRPCWarmupFlag,
+		utils.AncientRPCBatchFlag,
+		utils.AncientRPCBatchIntervalFlag,
+		utils.AncientRPCVerbosityFlag,
+		utils.AncientRPCReplicasFlag,
+		utils.AncientRPCSerializerFlag,
+		utils.AncientRPCReadAheadFlag,
+		utils.AncientRPCStaleRetriesFlag,
+		utils.AncientRPCStaleBackoffFlag,
+		utils.AncientPruneUnclesFlag,
+		utils.AncientLogIndexFlag,
 		utils.KeyStoreDirFlag,
 		utils.ExternalSignerFlag,
 		utils.NoUSBFlag,
@@ -241,6 +252,8 @@ func init() {
 		dumpCommand,
 		dumpGenesisCommand,
 		inspectCommand,
+		freezerSelfTestCommand,
+		freezerChecksumCommand,
 		// See accountcmd.go:
 		accountCommand,
 		walletCommand,
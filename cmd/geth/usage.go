@@ -37,6 +37,17 @@ var AppHelpFlagGroups = []flags.FlagGroup{
 			utils.DataDirFlag,
 			utils.AncientFlag,
 			utils.AncientRPCFlag,
+			utils.AncientRPCWarmupFlag,
+			utils.AncientRPCBatchFlag,
+			utils.AncientRPCBatchIntervalFlag,
+			utils.AncientRPCVerbosityFlag,
+			utils.AncientRPCReplicasFlag,
+			utils.AncientRPCSerializerFlag,
+			utils.AncientRPCReadAheadFlag,
+			utils.AncientRPCStaleRetriesFlag,
+			utils.AncientRPCStaleBackoffFlag,
+			utils.AncientPruneUnclesFlag,
+			utils.AncientLogIndexFlag,
 			utils.KeyStoreDirFlag,
 			utils.NoUSBFlag,
 			utils.SmartCardDaemonPathFlag,
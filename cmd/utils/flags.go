@@ -123,6 +123,59 @@ var (
 		Usage: "Connect to a remote freezer via RPC. Value must an HTTP(S), WS(S), unix socket, or 'stdio' URL. Incompatible with --datadir.ancient",
 		Value: "",
 	}
+	AncientRPCWarmupFlag = cli.Uint64Flag{
+		Name:  "ancient.rpc.warmup",
+		Usage: "Number of most recent frozen blocks to preload from the remote freezer on startup (0 = disabled)",
+		Value: 0,
+	}
+	AncientRPCBatchFlag = cli.IntFlag{
+		Name:  "ancient.rpc.batch",
+		Usage: "Number of appends sent to the remote freezer in a single batch request (0 = disabled)",
+		Value: 0,
+	}
+	AncientRPCBatchIntervalFlag = cli.DurationFlag{
+		Name:  "ancient.rpc.batch.interval",
+		Usage: "Maximum time appends are held back in a remote freezer batch (0 = flush on batch size only)",
+		Value: time.Second,
+	}
+	AncientRPCVerbosityFlag = cli.IntFlag{
+		Name:  "ancient.rpc.verbosity",
+		Usage: "Detail of the remote freezer's freezing logs: 0=segments, 1=batches, 2=blocks",
+		Value: 0,
+	}
+	AncientRPCReplicasFlag = cli.StringFlag{
+		Name:  "ancient.rpc.replicas",
+		Usage: "Comma separated read replica endpoints of the remote freezer, serving ancient item reads in turns",
+		Value: "",
+	}
+	AncientRPCSerializerFlag = cli.StringFlag{
+		Name:  "ancient.rpc.serializer",
+		Usage: "Serialization of the payloads stored by the remote freezer (rlp, framed), which must support it",
+		Value: rawdb.FreezerSerializerRLPName,
+	}
+	AncientRPCReadAheadFlag = cli.IntFlag{
+		Name:  "ancient.rpc.readahead",
+		Usage: "Number of items prefetched from the remote freezer following sequential reads (0 = disabled)",
+		Value: 0,
+	}
+	AncientRPCStaleRetriesFlag = cli.IntFlag{
+		Name:  "ancient.rpc.staleretries",
+		Usage: "Number of times reads of items a lagging read replica reports as not found, though the primary froze them, are retried on the replicas (0 = disabled)",
+		Value: 0,
+	}
+	AncientRPCStaleBackoffFlag = cli.DurationFlag{
+		Name:  "ancient.rpc.staleretries.backoff",
+		Usage: "Wait before the first retry of a read of an item not yet replicated, doubled by every further retry",
+		Value: 100 * time.Millisecond,
+	}
+	AncientPruneUnclesFlag = cli.BoolFlag{
+		Name:  "ancient.pruneuncles",
+		Usage: "Omit uncles from the block bodies moved into the ancient store from now on (irreversible)",
+	}
+	AncientLogIndexFlag = cli.BoolFlag{
+		Name:  "ancient.logindex",
+		Usage: "Index the log positions within the receipts moved into the ancient store, speeding up log queries of ancient blocks",
+	}
 	KeyStoreDirFlag = DirectoryFlag{
 		Name:  "keystore",
 		Usage: "Directory for the keystore (default = inside the datadir)",
@@ -1642,6 +1695,15 @@ func SetEthConfig(ctx *cli.Context, stack *node.Node, cfg *eth.Config) {
 	if ctx.GlobalIsSet(AncientRPCFlag.Name) {
 		cfg.DatabaseFreezerRemote = ctx.GlobalString(AncientRPCFlag.Name)
 	}
+	if ctx.GlobalIsSet(AncientRPCReplicasFlag.Name) {
+		cfg.DatabaseFreezerReplicas = SplitAndTrim(ctx.GlobalString(AncientRPCReplicasFlag.Name))
+	}
+	if ctx.GlobalIsSet(AncientRPCSerializerFlag.Name) {
+		cfg.DatabaseFreezerSerializer = ctx.GlobalString(AncientRPCSerializerFlag.Name)
+	}
+	if ctx.GlobalIsSet(AncientRPCReadAheadFlag.Name) {
+		cfg.DatabaseFreezerReadAhead = ctx.GlobalInt(AncientRPCReadAheadFlag.Name)
+	}
 
 	if gcmode := ctx.GlobalString(GCModeFlag.Name); gcmode != "full" && gcmode != "archive" {
 		Fatalf("--%s must be either 'full' or 'archive'", GCModeFlag.Name)
@@ -1922,13 +1984,55 @@ func MakeChainDatabase(ctx *cli.Context, stack *node.Node) ethdb.Database {
 		name = "lightchaindata"
 	}
 	if ctx.GlobalIsSet(AncientRPCFlag.Name) {
-		chainDb, err = stack.OpenDatabaseWithFreezerRemote(name, cache, handles, ctx.GlobalString(AncientRPCFlag.Name))
+		opts := rawdb.FreezerRemoteOptions{ReadAhead: ctx.GlobalInt(AncientRPCReadAheadFlag.Name)}
+		if ctx.GlobalIsSet(AncientRPCSerializerFlag.Name) {
+			if opts.Serializer, err = rawdb.FreezerSerializerByName(ctx.GlobalString(AncientRPCSerializerFlag.Name)); err != nil {
+				Fatalf("Could not configure remote freezer serializer: %v", err)
+			}
+		}
+		chainDb, err = stack.OpenDatabaseWithFreezerRemote(name, cache, handles, ctx.GlobalString(AncientRPCFlag.Name), opts, SplitAndTrim(ctx.GlobalString(AncientRPCReplicasFlag.Name))...)
 	} else {
 		chainDb, err = stack.OpenDatabaseWithFreezer(name, cache, handles, ctx.GlobalString(AncientFlag.Name), "")
 	}
 	if err != nil {
 		Fatalf("Could not open database: %v", err)
 	}
+	if size := ctx.GlobalInt(AncientRPCBatchFlag.Name); size > 0 && ctx.GlobalIsSet(AncientRPCFlag.Name) {
+		if b, ok := chainDb.(interface {
+			SetWriteBatch(size int, interval time.Duration) error
+		}); ok {
+			if err := b.SetWriteBatch(size, ctx.GlobalDuration(AncientRPCBatchIntervalFlag.Name)); err != nil {
+				Fatalf("Could not configure remote freezer batching: %v", err)
+			}
+		}
+	}
+	if retries := ctx.GlobalInt(AncientRPCStaleRetriesFlag.Name); retries > 0 && ctx.GlobalIsSet(AncientRPCFlag.Name) {
+		if r, ok := chainDb.(interface {
+			SetStaleReadRetry(retries int, backoff time.Duration)
+		}); ok {
+			r.SetStaleReadRetry(retries, ctx.GlobalDuration(AncientRPCStaleBackoffFlag.Name))
+		}
+	}
+	if ctx.GlobalBool(AncientPruneUnclesFlag.Name) {
+		if err := rawdb.EnableAncientUnclesPruning(chainDb); err != nil {
+			Fatalf("Could not prune uncles from the ancient store: %v", err)
+		}
+	}
+	if ctx.GlobalBool(AncientLogIndexFlag.Name) {
+		if err := rawdb.EnableAncientLogIndex(chainDb); err != nil {
+			Fatalf("Could not index logs in the ancient store: %v", err)
+		}
+	}
+	if ctx.GlobalIsSet(AncientRPCVerbosityFlag.Name) {
+		rawdb.SetFreezeVerbosity(ctx.GlobalInt(AncientRPCVerbosityFlag.Name))
+	}
+	if blocks := ctx.GlobalUint64(AncientRPCWarmupFlag.Name); blocks > 0 && ctx.GlobalIsSet(AncientRPCFlag.Name) {
+		if w, ok := chainDb.(interface{ Warmup(blocks uint64) error }); ok {
+			if err := w.Warmup(blocks); err != nil {
+				Fatalf("Could not warm up remote freezer: %v", err)
+			}
+		}
+	}
 	return chainDb
 }
 
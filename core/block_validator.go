@@ -32,7 +32,7 @@ import (
 //
 // BlockValidator implements Validator.
 type BlockValidator struct {
-	config ctypes.ChainConfigurator // Chain configuration options
+	config ctypes.ChainConfigurator // Chain configuration options, superseded by the chain's
 	bc     *BlockChain              // Canonical block chain
 	engine consensus.Engine         // Consensus engine used for validating
 }
@@ -47,6 +47,15 @@ func NewBlockValidator(config ctypes.ChainConfigurator, blockchain *BlockChain,
 	return validator
 }
 
+// chainConfig returns the current configuration of the chain, which may have been
+// updated since construction, see UpdateChainConfig.
+func (v *BlockValidator) chainConfig() ctypes.ChainConfigurator {
+	if v.bc != nil {
+		return v.bc.Config()
+	}
+	return v.config
+}
+
 // ValidateBody validates the given block's uncles and verifies the block
 // header's transaction and uncle roots. The headers are assumed to be already
 // validated at this point.
@@ -57,6 +66,9 @@ func (v *BlockValidator) ValidateBody(block *types.Block) error {
 	}
 	// Header validity is known at this point, check the uncles and transactions
 	header := block.Header()
+	if err := v.validateGasLimitDelta(header); err != nil {
+		return err
+	}
 	if err := v.engine.VerifyUncles(v.bc, block); err != nil {
 		return err
 	}
@@ -75,6 +87,28 @@ func (v *BlockValidator) ValidateBody(block *types.Block) error {
 	return nil
 }
 
+// validateGasLimitDelta checks the gas limit change of the header relative to its
+// parent against the chain configuration's bound, which applies in addition to the
+// consensus engine's. Headers with unknown parents are left to the ancestry checks.
+func (v *BlockValidator) validateGasLimitDelta(header *types.Header) error {
+	bound := v.chainConfig().GetGasLimitMaxDelta()
+	if bound == nil {
+		return nil
+	}
+	parent := v.bc.GetHeader(header.ParentHash, header.Number.Uint64()-1)
+	if parent == nil {
+		return nil
+	}
+	delta := header.GasLimit - parent.GasLimit
+	if header.GasLimit < parent.GasLimit {
+		delta = parent.GasLimit - header.GasLimit
+	}
+	if delta > *bound {
+		return fmt.Errorf("%w: have %d, parent %d, max delta %d", ErrGasLimitMaxDelta, header.GasLimit, parent.GasLimit, *bound)
+	}
+	return nil
+}
+
 // ValidateState validates the various changes that happen after a state
 // transition, such as amount of used gas, the receipt roots and the state root
 // itself. ValidateState returns a database batch if the validation was a success
@@ -96,7 +130,8 @@ func (v *BlockValidator) ValidateState(block *types.Block, statedb *state.StateD
 		return fmt.Errorf("invalid receipt root hash (remote: %x local: %x)", header.ReceiptHash, receiptSha)
 	}
 	// Validate the state root against the received state root and throw
-	if root := statedb.IntermediateRoot(v.config.IsEnabled(v.config.GetEIP161dTransition, header.Number)); header.Root != root {
+	config := v.chainConfig()
+	if root := statedb.IntermediateRoot(config.IsEnabled(config.GetEIP161dTransition, header.Number)); header.Root != root {
 		// an error if they don't match.
 		return fmt.Errorf("invalid merkle root (remote: %x local: %x)", header.Root, root)
 	}
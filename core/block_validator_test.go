@@ -17,6 +17,7 @@
 package core
 
 import (
+	"errors"
 	"runtime"
 	"testing"
 	"time"
@@ -198,3 +199,42 @@ func testHeaderConcurrentAbortion(t *testing.T, threads int) {
 		t.Errorf("verification count too large: have %d, want below %d", verified, 2*threads)
 	}
 }
+
+// Tests that blocks changing the gas limit beyond the chain configuration's bound
+// are rejected, even if the engine accepts them.
+func TestGasLimitMaxDelta(t *testing.T) {
+	config := *params.MessNetConfig
+	bound := uint64(1000)
+	config.SetGasLimitMaxDelta(&bound)
+
+	var (
+		engine  = ethash.NewFaker()
+		gspec   = &genesisT.Genesis{Config: &config, GasLimit: 10485760}
+		gendb   = rawdb.NewMemoryDatabase()
+		genesis = MustCommitGenesis(gendb, gspec)
+	)
+	// Change the gas limit within the bound, up to it, and beyond it, but within the engine's
+	deltas := []int64{500, -1000, 5000}
+	blocks, _ := GenerateChain(&config, genesis, engine, gendb, len(deltas), func(i int, b *BlockGen) {
+		b.header.GasLimit = uint64(int64(b.parent.GasLimit()) + deltas[i])
+	})
+	db := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(db, gspec)
+	chain, err := NewBlockChain(db, nil, &config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if n, err := chain.InsertChain(blocks); n != 2 || !errors.Is(err, ErrGasLimitMaxDelta) {
+		t.Fatalf("insert: have block %d error %v, want block 2 error %v", n, err, ErrGasLimitMaxDelta)
+	}
+	if head := chain.CurrentBlock().NumberU64(); head != 2 {
+		t.Errorf("head mismatch: have #%d, want #2", head)
+	}
+	// Without a bound only the engine's apply
+	config.SetGasLimitMaxDelta(nil)
+	if _, err := chain.InsertChain(blocks[2:]); err != nil {
+		t.Fatalf("unbounded insert: %v", err)
+	}
+}
@@ -18,11 +18,13 @@
 package core
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"math/big"
 	mrand "math/rand"
+	"reflect"
 	"sort"
 	"sync"
 	"sync/atomic"
@@ -37,10 +39,12 @@ import (
 	"github.com/ethereum/go-ethereum/core/state/snapshot"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/params/confp"
 	"github.com/ethereum/go-ethereum/params/types/ctypes"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/trie"
@@ -79,7 +83,10 @@ var (
 	blockPrefetchExecuteTimer   = metrics.NewRegisteredTimer("chain/prefetch/executes", nil)
 	blockPrefetchInterruptMeter = metrics.NewRegisteredMeter("chain/prefetch/interrupts", nil)
 
+	emptyCodeHash = crypto.Keccak256Hash(nil)
+
 	errInsertionInterrupted = errors.New("insertion is interrupted")
+	errTxIndexerStopped     = errors.New("transaction indexer not running")
 )
 
 const (
@@ -158,8 +165,8 @@ var defaultCacheConfig = &CacheConfig{
 // included in the canonical one where as GetBlockByNumber always represents the
 // canonical chain.
 type BlockChain struct {
-	chainConfig ctypes.ChainConfigurator // Chain & network configuration
-	cacheConfig *CacheConfig             // Cache configuration for pruning
+	chainConfig atomic.Value // Chain & network configuration (chainConfigHolder)
+	cacheConfig *CacheConfig // Cache configuration for pruning
 
 	db     ethdb.Database // Low level persistent database to store final content in
 	snaps  *snapshot.Tree // Snapshot tree for fast trie leaf access
@@ -173,20 +180,33 @@ type BlockChain struct {
 	//  * nil: disable tx reindexer/deleter, but still index new blocks
 	txLookupLimit uint64
 
-	hc            *HeaderChain
-	rmLogsFeed    event.Feed
-	chainFeed     event.Feed
-	chainSideFeed event.Feed
-	chainHeadFeed event.Feed
-	logsFeed      event.Feed
-	blockProcFeed event.Feed
-	scope         event.SubscriptionScope
-	genesisBlock  *types.Block
+	// txIndexRequests changes the txlookup limit of the transaction indexer, which
+	// brings the index up to date with it and the current head. Nil if the indexer
+	// is not running.
+	txIndexRequests chan *txIndexRequest
+
+	hc             *HeaderChain
+	rmLogsFeed     event.Feed
+	chainFeed      event.Feed
+	chainSideFeed  event.Feed
+	chainHeadFeed  event.Feed
+	logsFeed       event.Feed
+	blockProcFeed  event.Feed
+	chainCfgFeed   event.Feed // Feed of ChainConfigEvent
+	afEngagedFeed  event.Feed // Feed of ArtificialFinalityEngagedEvent
+	afStallFeed    event.Feed // Feed of ArtificialFinalityStallEvent
+	afDecisionFeed event.Feed // Feed of ArtificialFinalityDecisionEvent
+	scope          event.SubscriptionScope
+	genesisBlock   *types.Block
 
 	chainmu sync.RWMutex // blockchain insertion lock
 
 	currentBlock     atomic.Value // Current head of the block chain
 	currentFastBlock atomic.Value // Current head of the fast-sync chain (may be above the block chain!)
+	clock            atomic.Value // Source of the wall-clock time (clockHolder)
+	senderProvider   atomic.Value // Trusted source of transaction senders (senderProviderHolder)
+	afRejectHandler  atomic.Value // Handler of segments rejected by artificial finality (afRejectHandlerHolder)
+	preCommitHook    atomic.Value // Hook called before every block is written (preCommitHookHolder)
 
 	stateCache    state.Database // State database to reuse between imports (contains state cache)
 	bodyCache     *lru.Cache     // Cache for the most recent block bodies
@@ -211,7 +231,39 @@ type BlockChain struct {
 	shouldPreserve  func(*types.Block) bool        // Function used to determine whether should preserve the given block.
 	terminateInsert func(common.Hash, uint64) bool // Testing hook used to terminate ancient receipt chain insertion.
 
-	artificialFinalityEnabled int32 // toggles artificial finality features
+	artificialFinalityEnabled        int32  // toggles artificial finality features
+	artificialFinalityRejectPolicy   int32  // ArtificialFinalityRejectPolicy for segments rejected by artificial finality
+	artificialFinalityTiePolicy      int32  // ArtificialFinalityTiePolicy for segments tying with the head under artificial finality
+	artificialFinalityEqualLength    int32  // ArtificialFinalityEqualLengthPolicy for segments as long as the current one
+	artificialFinalityClockSkewGrace uint32 // seconds of timestamp skew ignored by artificial finality
+	artificialFinalityTDRatioWindow  uint32 // number of proposed blocks the reported TD ratio is averaged over
+	artificialFinalityMaxFutureTime  uint32 // seconds blocks may be ahead of the clock while artificial finality is enabled
+	artificialFinalityPersist        int32  // persists artificial finality decisions to the database if 1
+	artificialFinalityMinSegment     uint32 // length of proposed segments up to which artificial finality never rejects
+	artificialFinalityDeferred       int32  // 1 while enabled artificial finality awaits catching up with the network
+	artificialFinalityCatchUp        uint64 // distance from the network head within which deferred artificial finality engages
+	artificialFinalityNetworkHead    uint64 // number of the network's head block, 0 if unknown
+	artificialFinalityStall          int64  // duration without canonical progress after which rejecting artificial finality is disabled, 0 if never
+	artificialFinalityStallRejects   uint32 // number of rejections since the last canonical progress required to disable on stall
+	artificialFinalityProgress       int64  // unix time in nanoseconds of the last canonical progress
+	artificialFinalityRejects        uint32 // number of rejections by artificial finality since the last canonical progress
+	verifyReceiptBlooms              int32  // toggles log bloom verification in InsertReceiptChain
+	headerInsertChunk                int32  // maximum number of headers InsertHeaderChain writes holding the chain lock at once, 0 if unlimited
+
+	inserts     *insertQueue      // Queue of InsertChain calls waiting for the chain, by priority
+	sideLimiter *sideChainLimiter // Rate limiter of side-chain blocks accepted per parent
+	sideHeads   *sideHeadSet      // Recently written side-chain blocks without known children
+	reorgs      *reorgHistory     // Most recent reorgs of the canonical chain
+	afPending   *afPending        // Segments rejected by artificial finality, to report once insertions return
+
+	ancientScans       map[uint64]*ancientScan // Ancients verifications started by StartVerifyAncients, by id
+	ancientScanID      uint64                  // Id of the last ancients verification started
+	ancientScanWorkers int32                   // Number of concurrent workers of the verifications (atomic)
+	ancientScanLock    sync.Mutex
+
+	logRanges *lru.Cache // Logs matched by the recent LogsForRange queries, by logRangeKey
+
+	ancientCheck *ancientConsistencyCheck // Periodic check of the ancient store against the header chain
 }
 
 // NewBlockChain returns a fully initialised block chain using information
@@ -228,9 +280,9 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, chainConfig ctyp
 	txLookupCache, _ := lru.New(txLookupCacheLimit)
 	futureBlocks, _ := lru.New(maxFutureBlocks)
 	badBlocks, _ := lru.New(badBlockLimit)
+	logRanges, _ := lru.New(logRangeCacheLimit)
 
 	bc := &BlockChain{
-		chainConfig:    chainConfig,
 		cacheConfig:    cacheConfig,
 		db:             db,
 		triegc:         prque.New(nil),
@@ -246,7 +298,19 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, chainConfig ctyp
 		engine:         engine,
 		vmConfig:       vmConfig,
 		badBlocks:      badBlocks,
-	}
+		inserts:        new(insertQueue),
+		sideLimiter:    newSideChainLimiter(),
+		sideHeads:      newSideHeadSet(),
+		reorgs:         newReorgHistory(),
+		afPending:      new(afPending),
+		logRanges:      logRanges,
+		ancientCheck:   new(ancientConsistencyCheck),
+	}
+	bc.chainConfig.Store(chainConfigHolder{chainConfig})
+	bc.SetClock(nil)
+	bc.SetSenderProvider(nil)
+	bc.SetArtificialFinalityRejectHandler(nil)
+	bc.SetPreCommitHook(nil)
 	bc.validator = NewBlockValidator(chainConfig, bc, engine)
 	bc.prefetcher = newStatePrefetcher(chainConfig, bc, engine)
 	bc.processor = NewStateProcessor(chainConfig, bc, engine)
@@ -301,10 +365,17 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, chainConfig ctyp
 		// The head full block may be rolled back to a very low height due to
 		// blockchain repair. If the head full block is even lower than the ancient
 		// chain, truncate the ancient store.
+		//
+		// A remote freezer trusted ahead of the head (see FreezerRemoteAheadTrust) is
+		// not rolled back, its blocks are imported on top of the head full block.
 		fullBlock := bc.CurrentBlock()
 		if fullBlock != nil && fullBlock.Hash() != bc.genesisBlock.Hash() && fullBlock.NumberU64() < frozen-1 {
-			needRewind = true
-			low = fullBlock.NumberU64()
+			if rawdb.GetFreezerRemoteAheadPolicy() == rawdb.FreezerRemoteAheadTrust {
+				log.Warn("Keeping trusted ancient chain ahead of the head block", "number", fullBlock.NumberU64(), "ancients", frozen)
+			} else {
+				needRewind = true
+				low = fullBlock.NumberU64()
+			}
 		}
 		// In fast sync, it may happen that ancient data has been written to the
 		// ancient store, but the LastFastBlock has not been updated, truncate the
@@ -349,8 +420,10 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, chainConfig ctyp
 	}
 	// Take ownership of this particular state
 	go bc.update()
+	go bc.evictFrozenSideBlocks()
 	if txLookupLimit != nil {
 		bc.txLookupLimit = *txLookupLimit
+		bc.txIndexRequests = make(chan *txIndexRequest)
 		go bc.maintainTxIndex(txIndexBlock)
 	}
 	// If periodic cache journal is required, spin it up.
@@ -616,6 +689,48 @@ func (bc *BlockChain) CurrentFastBlock() *types.Block {
 	return bc.currentFastBlock.Load().(*types.Block)
 }
 
+// HeadSnapshot is a mutually consistent view of the chain heads and the artificial
+// finality state, as returned by BlockChain.HeadSnapshot.
+type HeadSnapshot struct {
+	Number uint64      // Number of the head block
+	Hash   common.Hash // Hash of the head block
+	Td     *big.Int    // Total difficulty of the head block
+
+	FastBlockNumber uint64      // Number of the fast-sync head block
+	FastBlockHash   common.Hash // Hash of the fast-sync head block
+	HeaderNumber    uint64      // Number of the head header
+	HeaderHash      common.Hash // Hash of the head header
+
+	ArtificialFinalityEnabled bool // Whether artificial finality is enabled, see IsArtificialFinalityEnabled
+	ArtificialFinalityActive  bool // Whether artificial finality is enabled and activated for the head block
+}
+
+// HeadSnapshot returns the chain heads and the artificial finality state, captured
+// under the chain lock so that they are consistent with each other even during a
+// reorg, unlike the values of the individual getters.
+func (bc *BlockChain) HeadSnapshot() *HeadSnapshot {
+	bc.chainmu.RLock()
+	defer bc.chainmu.RUnlock()
+
+	var (
+		block  = bc.CurrentBlock()
+		fast   = bc.CurrentFastBlock()
+		header = bc.CurrentHeader()
+	)
+	enabled := bc.IsArtificialFinalityEnabled()
+	return &HeadSnapshot{
+		Number:                    block.NumberU64(),
+		Hash:                      block.Hash(),
+		Td:                        bc.GetTd(block.Hash(), block.NumberU64()),
+		FastBlockNumber:           fast.NumberU64(),
+		FastBlockHash:             fast.Hash(),
+		HeaderNumber:              header.Number.Uint64(),
+		HeaderHash:                header.Hash(),
+		ArtificialFinalityEnabled: enabled,
+		ArtificialFinalityActive:  enabled && bc.Config().IsEnabled(bc.Config().GetECBP1100Transition, block.Number()),
+	}
+}
+
 // Validator returns the current validator.
 func (bc *BlockChain) Validator() Validator {
 	return bc.validator
@@ -653,8 +768,12 @@ func (bc *BlockChain) ResetWithGenesisBlock(genesis *types.Block) error {
 	if err := bc.SetHead(0); err != nil {
 		return err
 	}
+	var report afReport
+	defer bc.postArtificialFinality(&report)
+
 	bc.chainmu.Lock()
 	defer bc.chainmu.Unlock()
+	defer bc.afPending.take(&report)
 
 	// Prepare the genesis block and reinitialise the chain
 	batch := bc.db.NewBatch()
@@ -708,6 +827,53 @@ func (bc *BlockChain) ExportN(w io.Writer, first uint64, last uint64) error {
 	return nil
 }
 
+// TxIndexEntry is a transaction lookup entry written by StreamTxIndex.
+type TxIndexEntry struct {
+	Hash        common.Hash // Hash of the transaction
+	BlockNumber uint64      // Number of the canonical block including the transaction
+	Index       uint64      // Position of the transaction within the block
+}
+
+// StreamTxIndex writes the RLP encoded lookup entries of the transactions indexed in
+// the canonical blocks from first to last, both inclusive, to the given writer. The
+// range is clipped to the retained index, from the tail of the tx index up to the
+// current head. Transactions without a lookup entry pointing to their block are
+// skipped, so the written entries match those found by ReadTxLookupEntry.
+func (bc *BlockChain) StreamTxIndex(w io.Writer, first uint64, last uint64) error {
+	bc.chainmu.RLock()
+	defer bc.chainmu.RUnlock()
+
+	if first > last {
+		return fmt.Errorf("export failed: first (%d) is greater than last (%d)", first, last)
+	}
+	if tail := rawdb.ReadTxIndexTail(bc.db); tail != nil && *tail > first {
+		first = *tail
+	}
+	if head := bc.CurrentBlock().NumberU64(); head < last {
+		last = head
+	}
+	start, reported := time.Now(), time.Now()
+	for nr := first; nr <= last; nr++ {
+		block := bc.GetBlockByNumber(nr)
+		if block == nil {
+			return fmt.Errorf("export failed on #%d: not found", nr)
+		}
+		for i, tx := range block.Transactions() {
+			if number := rawdb.ReadTxLookupEntry(bc.db, tx.Hash()); number == nil || *number != nr {
+				continue
+			}
+			if err := rlp.Encode(w, &TxIndexEntry{Hash: tx.Hash(), BlockNumber: nr, Index: uint64(i)}); err != nil {
+				return err
+			}
+		}
+		if time.Since(reported) >= statsReportLimit {
+			log.Info("Exporting transaction index", "exported", nr-first, "elapsed", common.PrettyDuration(time.Since(start)))
+			reported = time.Now()
+		}
+	}
+	return nil
+}
+
 // writeHeadBlock injects a new head block into the current block chain. This method
 // assumes that the block is indeed a true head. It will also reset the head
 // header and the head fast sync block to this very same block if they are older
@@ -741,6 +907,10 @@ func (bc *BlockChain) writeHeadBlock(block *types.Block) {
 	}
 	bc.currentBlock.Store(block)
 	headBlockGauge.Update(int64(block.NumberU64()))
+
+	bc.engageArtificialFinality()
+	bc.artificialFinalityProgressed()
+	bc.updateECBP1100ThresholdGauges(block.Header())
 }
 
 // Genesis retrieves the chain's genesis block.
@@ -770,7 +940,8 @@ func (bc *BlockChain) GetBody(hash common.Hash) *types.Body {
 }
 
 // GetBodyRLP retrieves a block body in RLP encoding from the database by hash,
-// caching it if found.
+// caching it if found. Bodies whose uncles were pruned from the ancient store are
+// incomplete, nil is returned for them.
 func (bc *BlockChain) GetBodyRLP(hash common.Hash) rlp.RawValue {
 	// Short circuit if the body's already in the cache, retrieve otherwise
 	if cached, ok := bc.bodyRLPCache.Get(hash); ok {
@@ -781,7 +952,7 @@ func (bc *BlockChain) GetBodyRLP(hash common.Hash) rlp.RawValue {
 		return nil
 	}
 	body := rawdb.ReadBodyRLP(bc.db, hash, *number)
-	if len(body) == 0 {
+	if len(body) == 0 || rawdb.UnclesPruned(bc.db, hash, *number) {
 		return nil
 	}
 	// Cache the found body for next time and return
@@ -869,7 +1040,7 @@ func (bc *BlockChain) GetReceiptsByHash(hash common.Hash) types.Receipts {
 	if number == nil {
 		return nil
 	}
-	receipts := rawdb.ReadReceipts(bc.db, hash, *number, bc.chainConfig)
+	receipts := rawdb.ReadReceipts(bc.db, hash, *number, bc.Config())
 	if receipts == nil {
 		return nil
 	}
@@ -877,6 +1048,64 @@ func (bc *BlockChain) GetReceiptsByHash(hash common.Hash) types.Receipts {
 	return receipts
 }
 
+// GetReceiptsByHashContext retrieves the receipts for all transactions in a given
+// block like GetReceiptsByHash, but binds ancient reads to ctx so that slow
+// reads from a remote freezer are aborted once ctx is done. The context's error
+// is returned in that case.
+func (bc *BlockChain) GetReceiptsByHashContext(ctx context.Context, hash common.Hash) (types.Receipts, error) {
+	if receipts, ok := bc.receiptsCache.Get(hash); ok {
+		return receipts.(types.Receipts), nil
+	}
+	number := rawdb.ReadHeaderNumber(bc.db, hash)
+	if number == nil {
+		return nil, nil
+	}
+	receipts := rawdb.ReadReceipts(rawdb.ReaderWithContext(ctx, bc.db), hash, *number, bc.Config())
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if receipts == nil {
+		return nil, nil
+	}
+	bc.receiptsCache.Add(hash, receipts)
+	return receipts, nil
+}
+
+// ReceiptRootMismatch is a canonical block whose stored receipts do not derive the
+// trusted receipt root.
+type ReceiptRootMismatch struct {
+	Number   uint64
+	Hash     common.Hash
+	Trusted  common.Hash // Receipt root of the checkpoint
+	Computed common.Hash // Receipt root derived from the stored receipts
+}
+
+// VerifyReceiptRange recomputes the receipt roots of the canonical blocks from and to,
+// inclusive, which have a root in trustedRoots, eg. after importing their receipts from
+// an untrusted source, and returns those differing from the trusted root. Blocks without
+// a trusted root are not verified. Missing receipts derive the empty root.
+func (bc *BlockChain) VerifyReceiptRange(from, to uint64, trustedRoots map[uint64]common.Hash) ([]ReceiptRootMismatch, error) {
+	if from > to {
+		return nil, fmt.Errorf("invalid receipt range #%d-#%d", from, to)
+	}
+	var mismatches []ReceiptRootMismatch
+	for number := from; number <= to; number++ {
+		trusted, ok := trustedRoots[number]
+		if !ok {
+			continue
+		}
+		hash := bc.GetCanonicalHash(number)
+		if hash == (common.Hash{}) {
+			return mismatches, fmt.Errorf("canonical block #%d unknown", number)
+		}
+		receipts := rawdb.ReadRawReceipts(bc.db, hash, number)
+		if computed := types.DeriveSha(receipts, trie.NewStackTrie(nil)); computed != trusted {
+			mismatches = append(mismatches, ReceiptRootMismatch{Number: number, Hash: hash, Trusted: trusted, Computed: computed})
+		}
+	}
+	return mismatches, nil
+}
+
 // GetBlocksFromHash returns the block corresponding to hash and up to n-1 ancestors.
 // [deprecated by eth/62]
 func (bc *BlockChain) GetBlocksFromHash(hash common.Hash, n int) (blocks []*types.Block) {
@@ -998,6 +1227,26 @@ func (bc *BlockChain) StopInsert() {
 	atomic.StoreInt32(&bc.procInterrupt, 1)
 }
 
+// waitDiskSpace blocks while the free disk space checked by the disk guard of the
+// ancient store is low, see rawdb.WaitDiskSpace. It returns errInsertionInterrupted
+// if the chain is stopped meanwhile. It must not be called holding the chain lock,
+// insertions already holding it use checkDiskSpace instead.
+func (bc *BlockChain) waitDiskSpace() error {
+	if !rawdb.WaitDiskSpace(bc.db, bc.quit) {
+		return errInsertionInterrupted
+	}
+	return nil
+}
+
+// checkDiskSpace returns ErrLowDiskSpace if the free disk space checked by the disk
+// guard of the ancient store is low, without waiting for it to recover.
+func (bc *BlockChain) checkDiskSpace() error {
+	if rawdb.LowDiskSpace(bc.db) {
+		return ErrLowDiskSpace
+	}
+	return nil
+}
+
 // insertStopped returns true after StopInsert has been called.
 func (bc *BlockChain) insertStopped() bool {
 	return atomic.LoadInt32(&bc.procInterrupt) == 1
@@ -1068,6 +1317,50 @@ type numberHash struct {
 	hash   common.Hash
 }
 
+// SetVerifyReceiptBlooms toggles recomputing the logs bloom of every receipt and
+// block handed to InsertReceiptChain, rejecting the chain if any disagrees with the
+// stored receipt bloom or the header. It is off by default since fast sync already
+// verifies the receipt root; enable it when importing from an untrusted source.
+func (bc *BlockChain) SetVerifyReceiptBlooms(enable bool) {
+	if enable {
+		atomic.StoreInt32(&bc.verifyReceiptBlooms, 1)
+	} else {
+		atomic.StoreInt32(&bc.verifyReceiptBlooms, 0)
+	}
+}
+
+// verifyReceiptChainBlooms checks the logs blooms of the receipts against the
+// logs they contain, and the combined bloom against the block header.
+func verifyReceiptChainBlooms(block *types.Block, receipts types.Receipts) error {
+	for i, receipt := range receipts {
+		if want := types.BytesToBloom(types.LogsBloom(receipt.Logs)); receipt.Bloom != want {
+			return fmt.Errorf("invalid receipt %d bloom in block #%d [%x…] (remote: %x  local: %x)", i, block.NumberU64(), block.Hash().Bytes()[:4], receipt.Bloom, want)
+		}
+	}
+	if want := types.CreateBloom(receipts); block.Bloom() != want {
+		return fmt.Errorf("invalid bloom in block #%d [%x…] (remote: %x  local: %x)", block.NumberU64(), block.Hash().Bytes()[:4], block.Bloom(), want)
+	}
+	return nil
+}
+
+// checkAncientTail returns an error wrapping ErrBelowTail if the block is below the
+// first one retained by the ancient store, if it discards old items. Blocks of a
+// batch are contiguous, checking the first one covers the batch.
+func (bc *BlockChain) checkAncientTail(block *types.Block) error {
+	f, ok := bc.db.(interface{ AncientTail() (uint64, error) })
+	if !ok {
+		return nil
+	}
+	tail, err := f.AncientTail()
+	if err != nil {
+		return err
+	}
+	if block.NumberU64() < tail {
+		return fmt.Errorf("%w: block #%d [%x…], tail #%d", ErrBelowTail, block.NumberU64(), block.Hash().Bytes()[:4], tail)
+	}
+	return nil
+}
+
 // InsertReceiptChain attempts to complete an already existing header chain with
 // transaction and receipt data.
 func (bc *BlockChain) InsertReceiptChain(blockChain types.Blocks, receiptChain []types.Receipts, ancientLimit uint64) (int, error) {
@@ -1090,12 +1383,29 @@ func (bc *BlockChain) InsertReceiptChain(blockChain types.Blocks, receiptChain [
 					blockChain[i-1].Hash().Bytes()[:4], i, blockChain[i].NumberU64(), blockChain[i].Hash().Bytes()[:4], blockChain[i].ParentHash().Bytes()[:4])
 			}
 		}
+		if i == 0 {
+			if err := bc.checkAncientTail(blockChain[0]); err != nil {
+				return 0, err
+			}
+		}
+		if atomic.LoadInt32(&bc.verifyReceiptBlooms) == 1 {
+			if err := verifyReceiptChainBlooms(blockChain[i], receiptChain[i]); err != nil {
+				log.Error("Invalid receipt bloom", "number", blockChain[i].Number(), "hash", blockChain[i].Hash(), "err", err)
+				return 0, err
+			}
+		}
 		if blockChain[i].NumberU64() <= ancientLimit {
 			ancientBlocks, ancientReceipts = append(ancientBlocks, blockChain[i]), append(ancientReceipts, receiptChain[i])
 		} else {
 			liveBlocks, liveReceipts = append(liveBlocks, blockChain[i]), append(liveReceipts, receiptChain[i])
 		}
 	}
+	if err := bc.checkAncientDrift(); err != nil {
+		return 0, err
+	}
+	if err := bc.waitDiskSpace(); err != nil {
+		return 0, err
+	}
 
 	var (
 		stats = struct{ processed, ignored int32 }{}
@@ -1169,7 +1479,7 @@ func (bc *BlockChain) InsertReceiptChain(blockChain types.Blocks, receiptChain [
 				}
 				h := rawdb.ReadCanonicalHash(bc.db, frozen)
 				b := rawdb.ReadBlock(bc.db, h, frozen)
-				size += rawdb.WriteAncientBlock(bc.db, b, rawdb.ReadReceipts(bc.db, h, frozen, bc.chainConfig), rawdb.ReadTd(bc.db, h, frozen))
+				size += rawdb.WriteAncientBlock(bc.db, b, rawdb.ReadReceipts(bc.db, h, frozen, bc.Config()), rawdb.ReadTd(bc.db, h, frozen))
 				count += 1
 
 				// Always keep genesis block in active database.
@@ -1212,6 +1522,9 @@ func (bc *BlockChain) InsertReceiptChain(blockChain types.Blocks, receiptChain [
 				log.Info("Migrated ancient blocks", "count", count, "elapsed", common.PrettyDuration(time.Since(start)))
 			}
 			// Flush data into ancient database.
+			if err := bc.preCommit(block, receiptChain[i]); err != nil {
+				return i, err
+			}
 			size += rawdb.WriteAncientBlock(bc.db, block, receiptChain[i], bc.GetTd(block.Hash(), block.NumberU64()))
 
 			// Write tx indices if any condition is satisfied:
@@ -1233,6 +1546,9 @@ func (bc *BlockChain) InsertReceiptChain(blockChain types.Blocks, receiptChain [
 			stats.processed++
 		}
 		// Flush all tx-lookup index data.
+		if err := bc.checkDiskSpace(); err != nil {
+			return 0, err
+		}
 		size += batch.ValueSize()
 		if err := batch.Write(); err != nil {
 			return 0, err
@@ -1310,6 +1626,9 @@ func (bc *BlockChain) InsertReceiptChain(blockChain types.Blocks, receiptChain [
 				}
 			}
 			// Write all the data out into the database
+			if err := bc.preCommit(block, receiptChain[i]); err != nil {
+				return i, err
+			}
 			rawdb.WriteBody(batch, block.Hash(), block.NumberU64(), block.Body())
 			rawdb.WriteReceipts(batch, block.Hash(), block.NumberU64(), receiptChain[i])
 			rawdb.WriteTxLookupEntriesByBlock(batch, block) // Always write tx indices for live blocks, we assume they are needed
@@ -1318,6 +1637,9 @@ func (bc *BlockChain) InsertReceiptChain(blockChain types.Blocks, receiptChain [
 			// we can ensure all components of body is completed(body, receipts,
 			// tx indexes)
 			if batch.ValueSize() >= ethdb.IdealBatchSize {
+				if err := bc.checkDiskSpace(); err != nil {
+					return 0, err
+				}
 				if err := batch.Write(); err != nil {
 					return 0, err
 				}
@@ -1330,6 +1652,9 @@ func (bc *BlockChain) InsertReceiptChain(blockChain types.Blocks, receiptChain [
 		// we can ensure all components of body is completed(body, receipts,
 		// tx indexes)
 		if batch.ValueSize() > 0 {
+			if err := bc.checkDiskSpace(); err != nil {
+				return 0, err
+			}
 			size += batch.ValueSize()
 			if err := batch.Write(); err != nil {
 				return 0, err
@@ -1389,12 +1714,212 @@ func (bc *BlockChain) SetTxLookupLimit(limit uint64) {
 	bc.txLookupLimit = limit
 }
 
+// txIndexRequest is a txlookup limit change for the transaction indexer, done being
+// closed once the index is in line with it.
+type txIndexRequest struct {
+	limit uint64
+	done  chan struct{}
+}
+
+// SetTxLookupLimitAndWait updates the txlookup limit like SetTxLookupLimit, and
+// waits until the transaction indexer brought the index in line with it: the
+// missing indices of the retained blocks written, the stale ones deleted and the
+// index tail moved. It returns once done, or when ctx is done or the chain stopped
+// meanwhile.
+func (bc *BlockChain) SetTxLookupLimitAndWait(ctx context.Context, limit uint64) error {
+	if bc.txIndexRequests == nil {
+		return errTxIndexerStopped
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	select {
+	case bc.txIndexRequests <- &txIndexRequest{limit: limit, done: done}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-bc.quit:
+		return errTxIndexerStopped
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-bc.quit:
+		return errTxIndexerStopped
+	}
+}
+
 // TxLookupLimit retrieves the txlookup limit used by blockchain to prune
 // stale transaction indices.
 func (bc *BlockChain) TxLookupLimit() uint64 {
 	return bc.txLookupLimit
 }
 
+// RepairTxIndexTail scans the canonical chain downwards from the current head for
+// the lowest block from which on all transactions are indexed, and rewrites the
+// stored tx index tail to match if it disagrees. Blocks without transactions are
+// considered indexed. The repaired tail, or the stored one if it was correct, is
+// returned.
+//
+// The method should not run concurrently with an active (un)indexing of
+// transactions, as triggered by head changes when a txlookup limit is set.
+func (bc *BlockChain) RepairTxIndexTail() uint64 {
+	head := bc.CurrentBlock().NumberU64()
+	tail := txIndexTail(bc.db, head)
+	stored := rawdb.ReadTxIndexTail(bc.db)
+	if stored != nil && *stored == tail {
+		return tail
+	}
+	if stored == nil {
+		log.Warn("Repairing missing transaction index tail", "tail", tail, "head", head)
+	} else {
+		log.Warn("Repairing transaction index tail", "stored", *stored, "actual", tail, "head", head)
+	}
+	rawdb.WriteTxIndexTail(bc.db, tail)
+	return tail
+}
+
+// txIndexTail scans the canonical chain downwards from head for the lowest block
+// from which on all transactions are indexed, head+1 if the transactions of the
+// head block are not.
+func txIndexTail(db ethdb.Database, head uint64) uint64 {
+	tail := head + 1
+	for number := head + 1; number > 0; number-- {
+		block := rawdb.ReadBlock(db, rawdb.ReadCanonicalHash(db, number-1), number-1)
+		if block == nil {
+			break
+		}
+		for _, tx := range block.Transactions() {
+			if n := rawdb.ReadTxLookupEntry(db, tx.Hash()); n == nil || *n != block.NumberU64() {
+				return tail
+			}
+		}
+		tail = number - 1
+	}
+	return tail
+}
+
+// PruneStateBelow deletes the state of all blocks below the given number from the
+// database, retaining the state of the canonical blocks from number up to the current
+// head. Trie nodes shared with a retained state are kept, as is all contract code.
+// Block, receipt and other chain data, including the ancients, are left in place.
+//
+// Unless trie write caching is disabled (ie. on an archive node), the state of the
+// most recent TriesInMemory blocks is retained regardless, as it may still be
+// referenced from memory. Pruning above the current head, or without the state of
+// the head being available, is refused. The hashes of all retained trie nodes are
+// held in memory while pruning.
+func (bc *BlockChain) PruneStateBelow(number uint64) error {
+	bc.chainmu.Lock()
+	defer bc.chainmu.Unlock()
+
+	head := bc.CurrentBlock()
+	if number > head.NumberU64() {
+		return fmt.Errorf("cannot prune state above head: number %d, head %d", number, head.NumberU64())
+	}
+	if !bc.HasState(head.Root()) {
+		return fmt.Errorf("head state missing: number %d, root %x", head.NumberU64(), head.Root())
+	}
+	if !bc.cacheConfig.TrieDirtyDisabled {
+		if head.NumberU64()+1 < TriesInMemory {
+			number = 0
+		} else if recent := head.NumberU64() + 1 - TriesInMemory; recent < number {
+			number = recent
+		}
+	}
+	// Mark all trie nodes reachable from the retained states
+	var (
+		start  = time.Now()
+		triedb = bc.stateCache.TrieDB()
+		keep   = make(map[common.Hash]struct{})
+	)
+	for n := number; n <= head.NumberU64(); n++ {
+		header := bc.GetHeaderByNumber(n)
+		if header == nil || !bc.HasState(header.Root) {
+			continue
+		}
+		if err := markStateTrie(triedb, header.Root, keep, true); err != nil {
+			return fmt.Errorf("failed to mark state of block #%d: %v", n, err)
+		}
+	}
+	// Sweep all the others from the key-value store
+	var (
+		deleted int
+		batch   = bc.db.NewBatch()
+		it      = bc.db.NewIterator(nil, nil)
+	)
+	defer it.Release()
+	for it.Next() {
+		key := it.Key()
+		if len(key) != common.HashLength {
+			continue
+		}
+		hash := common.BytesToHash(key)
+		if _, ok := keep[hash]; ok {
+			continue
+		}
+		if err := batch.Delete(key); err != nil {
+			return err
+		}
+		triedb.Evict(hash)
+		deleted++
+
+		if batch.ValueSize() > ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	log.Info("Pruned historical state", "below", number, "head", head.NumberU64(), "kept", len(keep), "deleted", deleted, "elapsed", common.PrettyDuration(time.Since(start)))
+	return nil
+}
+
+// markStateTrie adds the hashes of all nodes of the trie with the given root to keep.
+// Subtries already marked are skipped. If accounts is set, the trie is an account
+// trie and the storage tries and code hashes of its accounts are marked too, as code
+// may be stored under its raw hash (the legacy scheme) among the trie nodes.
+func markStateTrie(triedb *trie.Database, root common.Hash, keep map[common.Hash]struct{}, accounts bool) error {
+	t, err := trie.New(root, triedb)
+	if err != nil {
+		return err
+	}
+	it := t.NodeIterator(nil)
+	for descend := true; it.Next(descend); {
+		descend = true
+		if hash := it.Hash(); hash != (common.Hash{}) {
+			if _, ok := keep[hash]; ok {
+				descend = false
+				continue
+			}
+			keep[hash] = struct{}{}
+		}
+		if accounts && it.Leaf() {
+			var acc state.Account
+			if err := rlp.DecodeBytes(it.LeafBlob(), &acc); err != nil {
+				return err
+			}
+			if acc.Root != types.EmptyRootHash {
+				if err := markStateTrie(triedb, acc.Root, keep, false); err != nil {
+					return err
+				}
+			}
+			if codeHash := common.BytesToHash(acc.CodeHash); codeHash != emptyCodeHash {
+				keep[codeHash] = struct{}{}
+			}
+		}
+	}
+	return it.Error()
+}
+
 var lastWrite uint64
 
 // writeBlockWithoutState writes only the block and its metadata to the database,
@@ -1404,12 +1929,16 @@ func (bc *BlockChain) writeBlockWithoutState(block *types.Block, td *big.Int) (e
 	bc.wg.Add(1)
 	defer bc.wg.Done()
 
+	if err := bc.preCommit(block, nil); err != nil {
+		return err
+	}
 	batch := bc.db.NewBatch()
 	rawdb.WriteTd(batch, block.Hash(), block.NumberU64(), td)
 	rawdb.WriteBlock(batch, block)
 	if err := batch.Write(); err != nil {
 		log.Crit("Failed to write block into disk", "err", err)
 	}
+	bc.trackSideHead(block, td)
 	return nil
 }
 
@@ -1433,8 +1962,12 @@ func (bc *BlockChain) writeKnownBlockAsHead(block *types.Block) error {
 
 // WriteBlockWithState writes the block and all associated state to the database.
 func (bc *BlockChain) WriteBlockWithState(block *types.Block, receipts []*types.Receipt, logs []*types.Log, state *state.StateDB, emitHeadEvent bool) (status WriteStatus, err error) {
+	var report afReport
+	defer bc.postArtificialFinality(&report)
+
 	bc.chainmu.Lock()
 	defer bc.chainmu.Unlock()
+	defer bc.afPending.take(&report)
 
 	return bc.writeBlockWithState(block, receipts, logs, state, emitHeadEvent)
 }
@@ -1450,6 +1983,9 @@ func (bc *BlockChain) writeBlockWithState(block *types.Block, receipts []*types.
 	if ptd == nil {
 		return NonStatTy, consensus.ErrUnknownAncestor
 	}
+	if err := bc.preCommit(block, receipts); err != nil {
+		return NonStatTy, err
+	}
 	// Make sure no inconsistent state is leaked during insertion
 	currentBlock := bc.CurrentBlock()
 	localTd := bc.GetTd(currentBlock.Hash(), currentBlock.NumberU64())
@@ -1468,7 +2004,7 @@ func (bc *BlockChain) writeBlockWithState(block *types.Block, receipts []*types.
 		log.Crit("Failed to write block into disk", "err", err)
 	}
 	// Commit all cached state changes into underlying memory database.
-	root, err := state.Commit(bc.chainConfig.IsEnabled(bc.chainConfig.GetEIP161dTransition, block.Number()))
+	root, err := state.Commit(bc.Config().IsEnabled(bc.Config().GetEIP161dTransition, block.Number()))
 	if err != nil {
 		return NonStatTy, err
 	}
@@ -1534,7 +2070,15 @@ func (bc *BlockChain) writeBlockWithState(block *types.Block, receipts []*types.
 	if !reorg && externTd.Cmp(localTd) == 0 {
 		// Split same-difficulty blocks by number, then preferentially select
 		// the block generated by the local miner as the canonical block.
-		if block.NumberU64() < currentBlock.NumberU64() {
+		// Under artificial finality ties are settled by the configured policy.
+		if bc.IsArtificialFinalityEnabled() &&
+			bc.Config().IsEnabled(bc.Config().GetECBP1100Transition, currentBlock.Number()) {
+			var err error
+			if reorg, err = bc.artificialFinalityTie(currentBlock, block); err != nil {
+				log.Warn("Reorg disallowed", "error", err)
+				return NonStatTy, err
+			}
+		} else if block.NumberU64() < currentBlock.NumberU64() {
 			reorg = true
 		} else if block.NumberU64() == currentBlock.NumberU64() {
 			var currentPreserve, blockPreserve bool
@@ -1557,12 +2101,15 @@ func (bc *BlockChain) writeBlockWithState(block *types.Block, receipts []*types.
 				// Proceed with further reorg arbitration.
 				// If the node is mining and trying to insert their own block, we want to allow that (do not override miners).
 				if bc.IsArtificialFinalityEnabled() &&
-					bc.chainConfig.IsEnabled(bc.chainConfig.GetECBP1100Transition, currentBlock.Number()) {
+					bc.Config().IsEnabled(bc.Config().GetECBP1100Transition, currentBlock.Number()) {
 
 					if err := bc.ecbp1100(d.commonBlock.Header(), currentBlock.Header(), block.Header()); err != nil {
 
 						canonicalDisallowed = true
-						log.Warn("Reorg disallowed", "error", err)
+						log.Warn("Reorg disallowed", "trace", ArtificialFinalityTraceID(err), "error", err)
+						if bc.ArtificialFinalityRejectPolicy() != ArtificialFinalityRejectSidechain {
+							return NonStatTy, err
+						}
 
 					} else if len(d.oldChain) > 2 {
 
@@ -1616,16 +2163,60 @@ func (bc *BlockChain) writeBlockWithState(block *types.Block, receipts []*types.
 			bc.chainHeadFeed.Send(ChainHeadEvent{Block: block})
 		}
 	} else {
+		bc.trackSideHead(block, externTd)
 		bc.chainSideFeed.Send(ChainSideEvent{Block: block})
 	}
 	return status, nil
 }
 
+// Clock is a source of the wall-clock time.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the real time Clock.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// clockHolder wraps a Clock, so that different implementations can be stored in
+// the same atomic.Value.
+type clockHolder struct{ Clock }
+
+// SetClock sets the clock used by the blockchain whenever it refers to the current
+// time, like when deciding whether blocks are too far in the future. A nil clock
+// restores the system clock. It is intended for tests which need deterministic
+// chain insertion independent of the real time, eg. of artificial finality decisions.
+//
+// Note that the consensus engine verifies headers against its own clock.
+func (bc *BlockChain) SetClock(clock Clock) {
+	if clock == nil {
+		clock = systemClock{}
+	}
+	bc.clock.Store(clockHolder{clock})
+}
+
+// now returns the current time according to the blockchain's clock.
+func (bc *BlockChain) now() time.Time {
+	return bc.clock.Load().(clockHolder).Now()
+}
+
+// SetSenderProvider sets a trusted source of transaction senders, whose senders are
+// cached before inserted blocks are validated instead of recovering them from the
+// signatures. The senders the provider doesn't know are recovered as usual. A nil
+// provider, the default, recovers all the senders.
+func (bc *BlockChain) SetSenderProvider(provider SenderProvider) {
+	bc.senderProvider.Store(senderProviderHolder{provider})
+}
+
 // addFutureBlock checks if the block is within the max allowed window to get
 // accepted for future processing, and returns an error if the block is too far
 // ahead and was not added.
 func (bc *BlockChain) addFutureBlock(block *types.Block) error {
-	max := uint64(time.Now().Unix() + maxTimeFutureBlocks)
+	if err := bc.ecbp1100FutureTime(block.Header()); err != nil {
+		return err
+	}
+	max := uint64(bc.now().Unix() + maxTimeFutureBlocks)
 	if block.Time() > max {
 		return fmt.Errorf("future block timestamp %v > allowed %v", block.Time(), max)
 	}
@@ -1640,6 +2231,13 @@ func (bc *BlockChain) addFutureBlock(block *types.Block) error {
 //
 // After insertion is done, all accumulated events will be fired.
 func (bc *BlockChain) InsertChain(chain types.Blocks) (int, error) {
+	return bc.InsertChainWithPriority(chain, InsertPriorityNetwork)
+}
+
+// InsertChainWithPriority is InsertChain for blocks of the given priority. While an
+// insertion is ongoing, the waiting ones are admitted highest priority first, and in
+// the order they arrived in within a priority.
+func (bc *BlockChain) InsertChainWithPriority(chain types.Blocks, priority InsertPriority) (int, error) {
 	// Sanity check that we have something meaningful to import
 	if len(chain) == 0 {
 		return 0, nil
@@ -1665,11 +2263,33 @@ func (bc *BlockChain) InsertChain(chain types.Blocks) (int, error) {
 				prev.Hash().Bytes()[:4], i, block.NumberU64(), block.Hash().Bytes()[:4], block.ParentHash().Bytes()[:4])
 		}
 	}
+	// Blocks extending the head are above any tail, only check older ones.
+	if chain[0].NumberU64() <= bc.CurrentBlock().NumberU64() {
+		if err := bc.checkAncientTail(chain[0]); err != nil {
+			return 0, err
+		}
+	}
+	if err := bc.checkAncientDrift(); err != nil {
+		return 0, err
+	}
+	// Wait for room on disk before taking the chain lock, so the paused import doesn't
+	// hold up anything else.
+	if err := bc.waitDiskSpace(); err != nil {
+		return 0, err
+	}
 	// Pre-checks passed, start the full block imports
+	if err := bc.inserts.acquire(priority); err != nil {
+		return 0, err
+	}
+	defer bc.inserts.release()
+
+	var report afReport
 	bc.wg.Add(1)
 	bc.chainmu.Lock()
 	n, err := bc.insertChain(chain, true)
+	bc.afPending.take(&report)
 	bc.chainmu.Unlock()
+	bc.postArtificialFinality(&report)
 	bc.wg.Done()
 
 	return n, err
@@ -1689,13 +2309,13 @@ func (bc *BlockChain) insertChain(chain types.Blocks, verifySeals bool) (int, er
 		return 0, nil
 	}
 	// Start a parallel signature recovery (signer will fluke on fork transition, minimal perf loss)
-	senderCacher.recoverFromBlocks(types.MakeSigner(bc.chainConfig, chain[0].Number()), chain)
+	senderCacher.recoverFromBlocks(types.MakeSigner(bc.Config(), chain[0].Number()), chain, bc.senderProvider.Load().(senderProviderHolder).SenderProvider)
 
 	var (
 		stats = insertStats{
 			startTime: mclock.Now(),
 			artificialFinality: bc.IsArtificialFinalityEnabled() &&
-				bc.chainConfig.IsEnabled(bc.chainConfig.GetECBP1100Transition, bc.CurrentBlock().Number()),
+				bc.Config().IsEnabled(bc.Config().GetECBP1100Transition, bc.CurrentBlock().Number()),
 		}
 		lastCanon *types.Block
 	)
@@ -1760,12 +2380,18 @@ func (bc *BlockChain) insertChain(chain types.Blocks, verifySeals bool) (int, er
 						// effectively overriding the simple (original) TD comparison check.
 
 						if bc.IsArtificialFinalityEnabled() &&
-							bc.chainConfig.IsEnabled(bc.chainConfig.GetECBP1100Transition, current.Number()) {
+							bc.Config().IsEnabled(bc.Config().GetECBP1100Transition, current.Number()) {
 
 							if err := bc.ecbp1100(reorgData.commonBlock.Header(), current.Header(), block.Header()); err != nil {
 
 								canonicalDisallowed = true
-								log.Trace("Reorg disallowed", "error", err)
+								log.Trace("Reorg disallowed", "trace", ArtificialFinalityTraceID(err), "error", err)
+								switch bc.ArtificialFinalityRejectPolicy() {
+								case ArtificialFinalityRejectError:
+									return it.index, err
+								case ArtificialFinalityRejectStop:
+									return it.index, &ArtificialFinalityStopError{Index: it.index, Number: block.NumberU64(), Hash: block.Hash(), Err: err}
+								}
 
 							}
 						}
@@ -1847,6 +2473,10 @@ func (bc *BlockChain) insertChain(chain types.Blocks, verifySeals bool) (int, er
 			bc.reportBlock(block, nil, ErrBlacklistedHash)
 			return it.index, ErrBlacklistedHash
 		}
+		// Blocks too far in the future must not be considered by artificial finality.
+		if err := bc.ecbp1100FutureTime(block.Header()); err != nil {
+			return it.index, err
+		}
 		// If the block is known (in the middle of the chain), it's a special case for
 		// Clique blocks where they can share state among each other, so importing an
 		// older block might complete the state of the subsequent one. In this case,
@@ -1854,7 +2484,7 @@ func (bc *BlockChain) insertChain(chain types.Blocks, verifySeals bool) (int, er
 		// its header and body was already in the database).
 		if err == ErrKnownBlock {
 			logger := log.Debug
-			if !bc.chainConfig.GetConsensusEngineType().IsClique() {
+			if !bc.Config().GetConsensusEngineType().IsClique() {
 				logger = log.Warn
 			}
 			logger("Inserted known block", "number", block.Number(), "hash", block.Hash(),
@@ -1885,6 +2515,14 @@ func (bc *BlockChain) insertChain(chain types.Blocks, verifySeals bool) (int, er
 			lastCanon = block
 			continue
 		}
+		// Refuse side-chain blocks beyond the rate limit of their parent
+		if err := bc.allowSideBlock(block.ParentHash(), block.Hash()); err != nil {
+			return it.index, err
+		}
+		// Stop before blocks rejected by artificial finality, if so configured
+		if err := bc.ecbp1100Stop(it.index, block); err != nil {
+			return it.index, err
+		}
 		// Retrieve the parent block and it's state to execute on top
 		start := time.Now()
 
@@ -1949,7 +2587,11 @@ func (bc *BlockChain) insertChain(chain types.Blocks, verifySeals bool) (int, er
 
 		blockValidationTimer.Update(time.Since(substart) - (statedb.AccountHashes + statedb.StorageHashes - triehash))
 
-		// Write the block to the chain and get the status.
+		// Write the block to the chain and get the status, if there's room for it.
+		if err := bc.checkDiskSpace(); err != nil {
+			atomic.StoreUint32(&followupInterrupt, 1)
+			return it.index, err
+		}
 		substart = time.Now()
 		status, err := bc.writeBlockWithState(block, receipts, logs, statedb, false)
 		atomic.StoreUint32(&followupInterrupt, 1)
@@ -2067,6 +2709,15 @@ func (bc *BlockChain) insertSideChain(block *types.Block, it *insertIterator) (i
 		externTd = new(big.Int).Add(externTd, block.Difficulty())
 
 		if !bc.HasBlock(block.Hash(), block.NumberU64()) {
+			if err := bc.allowSideBlock(block.ParentHash(), block.Hash()); err != nil {
+				return it.index, err
+			}
+			if err := bc.ecbp1100Stop(it.index, block); err != nil {
+				return it.index, err
+			}
+			if err := bc.checkDiskSpace(); err != nil {
+				return it.index, err
+			}
 			start := time.Now()
 			if err := bc.writeBlockWithoutState(block, externTd); err != nil {
 				return it.index, err
@@ -2189,7 +2840,7 @@ func (bc *BlockChain) getReorgData(oldBlock, newBlock *types.Block) *reorgData {
 			if number == nil {
 				return
 			}
-			receipts := rawdb.ReadReceipts(bc.db, hash, *number, bc.chainConfig)
+			receipts := rawdb.ReadReceipts(bc.db, hash, *number, bc.Config())
 
 			var logs []*types.Log
 			for _, receipt := range receipts {
@@ -2311,7 +2962,7 @@ func (bc *BlockChain) reorg(data *reorgData) error {
 			if number == nil {
 				return
 			}
-			receipts := rawdb.ReadReceipts(bc.db, hash, *number, bc.chainConfig)
+			receipts := rawdb.ReadReceipts(bc.db, hash, *number, bc.Config())
 
 			var logs []*types.Log
 			for _, receipt := range receipts {
@@ -2388,10 +3039,15 @@ func (bc *BlockChain) reorg(data *reorgData) error {
 		bc.logsFeed.Send(mergeLogs(data.rebirthLogs, false))
 	}
 	if len(data.oldChain) > 0 {
+		// The displaced chain is a side chain from now on
+		if td := bc.GetTd(data.oldChain[0].Hash(), data.oldChain[0].NumberU64()); td != nil {
+			bc.trackSideHead(data.oldChain[0], td)
+		}
 		for i := len(data.oldChain) - 1; i >= 0; i-- {
 			bc.chainSideFeed.Send(ChainSideEvent{Block: data.oldChain[i]})
 		}
 	}
+	bc.recordReorg(data)
 	return nil
 }
 
@@ -2408,6 +3064,43 @@ func (bc *BlockChain) update() {
 	}
 }
 
+// evictFrozenSideBlocks drops the side chain blocks the freezer wiped from the database
+// along with a frozen range from the caches, so they are not served anymore. Cached
+// canonical blocks stay valid, their data is identical in the ancient store.
+func (bc *BlockChain) evictFrozenSideBlocks() {
+	frozenCh := make(chan rawdb.FreezeEvent, 16)
+	sub := bc.SubscribeFreezeEvent(frozenCh)
+	if sub == nil {
+		return // The chain was stopped already
+	}
+	defer sub.Unsubscribe()
+
+	for {
+		select {
+		case ev := <-frozenCh:
+			hashes := make(map[common.Hash]struct{})
+			for _, cache := range []*lru.Cache{bc.blockCache, bc.bodyCache, bc.bodyRLPCache, bc.receiptsCache} {
+				for _, key := range cache.Keys() {
+					hashes[key.(common.Hash)] = struct{}{}
+				}
+			}
+			for hash := range hashes {
+				number := bc.hc.GetBlockNumber(hash)
+				if number != nil && (*number < ev.First || *number > ev.Last || rawdb.ReadCanonicalHash(bc.db, *number) == hash) {
+					continue
+				}
+				for _, cache := range []*lru.Cache{bc.blockCache, bc.bodyCache, bc.bodyRLPCache, bc.receiptsCache, bc.hc.headerCache, bc.hc.numberCache, bc.hc.tdCache} {
+					cache.Remove(hash)
+				}
+			}
+		case <-sub.Err():
+			return
+		case <-bc.quit:
+			return
+		}
+	}
+}
+
 // maintainTxIndex is responsible for the construction and deletion of the
 // transaction index.
 //
@@ -2464,9 +3157,18 @@ func (bc *BlockChain) maintainTxIndex(ancients uint64) {
 	}
 	// Any reindexing done, start listening to chain events and moving the index window
 	var (
-		done   chan struct{}                  // Non-nil if background unindexing or reindexing routine is active.
-		headCh = make(chan ChainHeadEvent, 1) // Buffered to avoid locking up the event feed
+		done    chan struct{}                  // Non-nil if background unindexing or reindexing routine is active.
+		headCh  = make(chan ChainHeadEvent, 1) // Buffered to avoid locking up the event feed
+		running []*txIndexRequest              // Limit changes served by the active routine
+		waiting []*txIndexRequest              // Limit changes to serve once the active routine finished
 	)
+	// serve applies the last waiting limit change and starts a routine serving them.
+	// The limit is only changed while no routine is active.
+	serve := func() {
+		bc.txLookupLimit = waiting[len(waiting)-1].limit
+		done, running, waiting = make(chan struct{}), waiting, nil
+		go indexBlocks(rawdb.ReadTxIndexTail(bc.db), bc.CurrentBlock().NumberU64(), done)
+	}
 	sub := bc.SubscribeChainHeadEvent(headCh)
 	if sub == nil {
 		return
@@ -2480,8 +3182,20 @@ func (bc *BlockChain) maintainTxIndex(ancients uint64) {
 				done = make(chan struct{})
 				go indexBlocks(rawdb.ReadTxIndexTail(bc.db), head.Block.NumberU64(), done)
 			}
+		case req := <-bc.txIndexRequests:
+			waiting = append(waiting, req)
+			if done == nil {
+				serve()
+			}
 		case <-done:
 			done = nil
+			for _, req := range running {
+				close(req.done)
+			}
+			running = nil
+			if len(waiting) > 0 {
+				serve()
+			}
 		case <-bc.quit:
 			return
 		}
@@ -2525,7 +3239,18 @@ Hash: 0x%x
 
 Error: %v
 ##############################
-`, bc.chainConfig, block.Number(), block.Hash(), receiptString, err))
+`, bc.Config(), block.Number(), block.Hash(), receiptString, err))
+}
+
+// SetHeaderInsertChunk limits the number of headers InsertHeaderChain writes holding
+// the chain lock at once to size, releasing it between the chunks of larger batches.
+// A size of 0 removes the limit, which is the default.
+func (bc *BlockChain) SetHeaderInsertChunk(size int) {
+	if size < 0 {
+		size = 0
+	}
+	atomic.StoreInt32(&bc.headerInsertChunk, int32(size))
+	log.Info("Header insertion chunk size configured", "size", size)
 }
 
 // InsertHeaderChain attempts to insert the given header chain in to the local
@@ -2536,22 +3261,77 @@ Error: %v
 // should be done or not. The reason behind the optional check is because some
 // of the header retrieval mechanisms already need to verify nonces, as well as
 // because nonces can be verified sparsely, not needing to check each.
+//
+// The headers are written in chunks of the size set by SetHeaderInsertChunk, if
+// any, releasing the chain lock between them. Chunked insertion is not atomic: if
+// a chunk fails, the chunks before it stay written, possibly as the header head.
+// The returned index of the failing header counts from the start of chain.
 func (bc *BlockChain) InsertHeaderChain(chain []*types.Header, checkFreq int) (int, error) {
 	start := time.Now()
 	if i, err := bc.hc.ValidateHeaderChain(chain, checkFreq); err != nil {
 		return i, err
 	}
+	if err := bc.checkAncientDrift(); err != nil {
+		return 0, err
+	}
+	var report afReport
+	defer bc.postArtificialFinality(&report)
 
+	size := int(atomic.LoadInt32(&bc.headerInsertChunk))
+	if size <= 0 || size > len(chain) {
+		size = len(chain)
+	}
+	for i := 0; i < len(chain); i += size {
+		end := i + size
+		if end > len(chain) {
+			end = len(chain)
+		}
+		// Each chunk reports its own import stats, the first one including the validation
+		if i > 0 {
+			start = time.Now()
+		}
+		if n, err := bc.insertHeaderChunk(chain[i:end], start, &report); err != nil {
+			if end-i < len(chain) {
+				log.Debug("Header chunk insertion failed", "index", i+n, "number", chain[i+n].Number,
+					"first", chain[i].Number, "last", chain[end-1].Number, "err", err)
+			}
+			return i + n, err
+		}
+	}
+	return 0, nil
+}
+
+// insertHeaderChunk writes a chunk of a validated header chain holding the chain
+// lock, see InsertHeaderChain, adding what artificial finality collected meanwhile
+// to report.
+func (bc *BlockChain) insertHeaderChunk(chain []*types.Header, start time.Time, report *afReport) (int, error) {
 	// Make sure only one thread manipulates the chain at once
 	bc.chainmu.Lock()
 	defer bc.chainmu.Unlock()
+	defer bc.afPending.take(report)
 
 	bc.wg.Add(1)
 	defer bc.wg.Done()
 
 	whFunc := func(header *types.Header) error {
-		_, err := bc.hc.WriteHeader(header)
-		return err
+		// Artificial finality applies to header chain reorgs just like to block reorgs,
+		// otherwise a rejected segment could become the header head before its bodies arrive.
+		canonicalDisallowed := false
+		afErr := bc.ecbp1100Header(header)
+		if afErr != nil {
+			canonicalDisallowed = true
+			log.Warn("Header reorg disallowed", "trace", ArtificialFinalityTraceID(afErr), "error", afErr)
+			if bc.ArtificialFinalityRejectPolicy() == ArtificialFinalityRejectStop {
+				return afErr
+			}
+		}
+		if _, err := bc.hc.writeHeader(header, canonicalDisallowed); err != nil {
+			return err
+		}
+		if afErr != nil && bc.ArtificialFinalityRejectPolicy() == ArtificialFinalityRejectError {
+			return afErr
+		}
+		return nil
 	}
 	return bc.hc.InsertHeaderChain(chain, whFunc, start)
 }
@@ -2574,6 +3354,18 @@ func (bc *BlockChain) GetTdByHash(hash common.Hash) *big.Int {
 	return bc.hc.GetTdByHash(hash)
 }
 
+// ComputeTd computes the total difficulty a header of the given difficulty would have
+// on top of the given parent, which need not be canonical. The header itself need not
+// be known, allowing to evaluate hypothetical blocks. An error wrapping
+// consensus.ErrUnknownAncestor is returned if the parent's total difficulty is unknown.
+func (bc *BlockChain) ComputeTd(parentHash common.Hash, parentNumber uint64, headerDifficulty *big.Int) (*big.Int, error) {
+	ptd := bc.GetTd(parentHash, parentNumber)
+	if ptd == nil {
+		return nil, fmt.Errorf("%w: parent #%d [%x]", consensus.ErrUnknownAncestor, parentNumber, parentHash)
+	}
+	return new(big.Int).Add(ptd, headerDifficulty), nil
+}
+
 // GetHeader retrieves a block header from the database by hash and number,
 // caching it if found.
 func (bc *BlockChain) GetHeader(hash common.Hash, number uint64) *types.Header {
@@ -2634,8 +3426,101 @@ func (bc *BlockChain) GetTransactionLookup(hash common.Hash) *rawdb.LegacyTxLook
 	return lookup
 }
 
+// chainConfigHolder wraps a ChainConfigurator, so that different implementations can
+// be stored in the same atomic.Value.
+type chainConfigHolder struct{ ctypes.ChainConfigurator }
+
 // Config retrieves the chain's fork configuration.
-func (bc *BlockChain) Config() ctypes.ChainConfigurator { return bc.chainConfig }
+func (bc *BlockChain) Config() ctypes.ChainConfigurator {
+	return bc.chainConfig.Load().(chainConfigHolder).ChainConfigurator
+}
+
+// UpdateChainConfig replaces the chain's fork configuration with config at runtime,
+// eg. to schedule an emergency fork, and persists it. The configuration must be valid
+// at the current head, and must not change any fork the chain has already passed,
+// which would invalidate processed blocks. A new configuration is built from config
+// and swapped in holding the insertion lock, so no block is processed under a
+// partially applied configuration; the configuration previously returned by Config
+// is left untouched.
+//
+// The block validator and processor, the header chain, the fork id filter and the
+// miner read the chain's configuration on every use; the transaction pool follows the
+// change through SubscribeChainConfigEvent. Components
+// holding on to the configuration they were created with don't see the change. The
+// parameters the consensus engine and the transaction signers are set up with at
+// startup (the consensus engine type, the chain id, the ECIP1099 transition and the
+// clique period and epoch) can't be changed: ErrChainConfigRestart is returned.
+func (bc *BlockChain) UpdateChainConfig(config ctypes.ChainConfigurator) error {
+	updated, err := bc.updateChainConfig(config)
+	if err != nil {
+		return err
+	}
+	bc.chainCfgFeed.Send(ChainConfigEvent{Config: updated})
+	return nil
+}
+
+// updateChainConfig swaps in the configuration built from config holding the chain
+// lock, and returns it.
+func (bc *BlockChain) updateChainConfig(config ctypes.ChainConfigurator) (ctypes.ChainConfigurator, error) {
+	bc.chainmu.Lock()
+	defer bc.chainmu.Unlock()
+
+	head := bc.CurrentBlock().NumberU64()
+	if err := confp.IsValid(config, &head); err != nil {
+		return nil, err
+	}
+	current := bc.Config()
+	if err := chainConfigRestartRequired(current, config); err != nil {
+		return nil, err
+	}
+	if err := confp.Compatible(&head, current, config); err != nil {
+		return nil, err
+	}
+	// Build the new configuration of the same type as the chain's
+	updated, ok := reflect.New(reflect.TypeOf(current).Elem()).Interface().(ctypes.ChainConfigurator)
+	if !ok {
+		return nil, fmt.Errorf("unsupported chain configuration type %T", current)
+	}
+	if err := confp.Convert(config, updated); err != nil {
+		return nil, err
+	}
+	rawdb.WriteChainConfig(bc.db, bc.genesisBlock.Hash(), updated)
+	bc.chainConfig.Store(chainConfigHolder{updated})
+	bc.hc.setConfig(updated)
+
+	log.Info("Updated chain configuration", "head", head, "config", updated)
+	return updated, nil
+}
+
+// chainConfigRestartRequired returns an error wrapping ErrChainConfigRestart if config
+// changes any parameter the consensus engine or the transaction signers are set up
+// with at startup.
+func chainConfigRestartRequired(current, config ctypes.ChainConfigurator) error {
+	sameTransition := func(a, b *uint64) bool {
+		return (a == nil) == (b == nil) && (a == nil || *a == *b)
+	}
+	switch {
+	case current.GetConsensusEngineType() != config.GetConsensusEngineType():
+		return fmt.Errorf("%w: consensus engine type %v != %v", ErrChainConfigRestart, config.GetConsensusEngineType(), current.GetConsensusEngineType())
+	case (current.GetChainID() == nil) != (config.GetChainID() == nil) ||
+		(current.GetChainID() != nil && current.GetChainID().Cmp(config.GetChainID()) != 0):
+		return fmt.Errorf("%w: chain id %v != %v", ErrChainConfigRestart, config.GetChainID(), current.GetChainID())
+	case !sameTransition(current.GetEthashECIP1099Transition(), config.GetEthashECIP1099Transition()):
+		return fmt.Errorf("%w: ECIP1099 transition changed", ErrChainConfigRestart)
+	case current.GetCliquePeriod() != config.GetCliquePeriod() || current.GetCliqueEpoch() != config.GetCliqueEpoch():
+		return fmt.Errorf("%w: clique period or epoch changed", ErrChainConfigRestart)
+	}
+	return nil
+}
+
+// Signer returns the transaction signer of the fork active at the given block
+// number, or at the current head block if it is nil.
+func (bc *BlockChain) Signer(blockNumber *big.Int) types.Signer {
+	if blockNumber == nil {
+		blockNumber = bc.CurrentBlock().Number()
+	}
+	return types.MakeSigner(bc.Config(), blockNumber)
+}
 
 // Engine retrieves the blockchain's consensus engine.
 func (bc *BlockChain) Engine() consensus.Engine { return bc.engine }
@@ -2660,11 +3545,58 @@ func (bc *BlockChain) SubscribeChainSideEvent(ch chan<- ChainSideEvent) event.Su
 	return bc.scope.Track(bc.chainSideFeed.Subscribe(ch))
 }
 
+// SubscribeFreezeEvent registers a subscription of rawdb.FreezeEvent, posted when
+// a range of blocks has been moved from the key-value store into the ancient store.
+// If the database has no freezer, the subscription never delivers any events.
+func (bc *BlockChain) SubscribeFreezeEvent(ch chan<- rawdb.FreezeEvent) event.Subscription {
+	if db, ok := bc.db.(interface {
+		SubscribeFreezeEvent(ch chan<- rawdb.FreezeEvent) event.Subscription
+	}); ok {
+		return bc.scope.Track(db.SubscribeFreezeEvent(ch))
+	}
+	return bc.scope.Track(event.NewSubscription(func(quit <-chan struct{}) error {
+		<-quit
+		return nil
+	}))
+}
+
+// FreezeUpTo moves the canonical blocks below number from the key-value store into the
+// ancient store on demand, returning once the ancient store confirmed they are durable.
+// Like the background freezer, it leaves the blocks within the freezing threshold of
+// the head block in the key-value store, where they may still be reorganized, so the
+// ancients may remain below number. Only remote freezers support freezing on demand.
+func (bc *BlockChain) FreezeUpTo(number uint64) error {
+	if db, ok := bc.db.(interface {
+		FreezeUpTo(number uint64) error
+	}); ok {
+		return db.FreezeUpTo(number)
+	}
+	return errors.New("freezing on demand not supported by the database")
+}
+
+// FreezeUpToContext is like FreezeUpTo, but stops freezing once ctx is cancelled,
+// returning ctx.Err() after the blocks frozen by then are durable. It returns the
+// number of ancients reached.
+func (bc *BlockChain) FreezeUpToContext(ctx context.Context, number uint64) (uint64, error) {
+	if db, ok := bc.db.(interface {
+		FreezeUpToContext(ctx context.Context, number uint64) (uint64, error)
+	}); ok {
+		return db.FreezeUpToContext(ctx, number)
+	}
+	return 0, errors.New("freezing on demand not supported by the database")
+}
+
 // SubscribeLogsEvent registers a subscription of []*types.Log.
 func (bc *BlockChain) SubscribeLogsEvent(ch chan<- []*types.Log) event.Subscription {
 	return bc.scope.Track(bc.logsFeed.Subscribe(ch))
 }
 
+// SubscribeChainConfigEvent registers a subscription of ChainConfigEvent, posted
+// whenever the chain's fork configuration is replaced by UpdateChainConfig.
+func (bc *BlockChain) SubscribeChainConfigEvent(ch chan<- ChainConfigEvent) event.Subscription {
+	return bc.scope.Track(bc.chainCfgFeed.Subscribe(ch))
+}
+
 // SubscribeBlockProcessingEvent registers a subscription of bool where true means
 // block processing has started while false means it has stopped.
 func (bc *BlockChain) SubscribeBlockProcessingEvent(ch chan<- bool) event.Subscription {
@@ -1,20 +1,61 @@
 package core
 
 import (
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"math/big"
+	"sort"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/trie"
 )
 
-// errReorgFinality represents an error caused by artificial finality mechanisms.
-var errReorgFinality = errors.New("finality-enforced invalid new chain")
+var (
+	ecbp1100AcceptedMeter = metrics.NewRegisteredMeter("chain/ecbp1100/accepted", nil)
+	ecbp1100RejectedMeter = metrics.NewRegisteredMeter("chain/ecbp1100/rejected", nil)
+)
+
+// ecbp1100ThresholdGauge reports the antigravity threshold MESS enforces at the head
+// for competing segments whose common ancestor is the latest canonical block at least
+// the given time delta older than the head.
+type ecbp1100ThresholdGauge struct {
+	delta time.Duration
+	gauge metrics.GaugeFloat64
+}
+
+// ecbp1100ThresholdGauges break the antigravity threshold down by representative time
+// deltas, labeled by the gauge names' suffix in seconds.
+var ecbp1100ThresholdGauges = func() []ecbp1100ThresholdGauge {
+	var gauges []ecbp1100ThresholdGauge
+	for _, delta := range []time.Duration{time.Minute, 10 * time.Minute, time.Hour, 3 * time.Hour, 7 * time.Hour} {
+		name := fmt.Sprintf("chain/ecbp1100/threshold/%ds", int64(delta/time.Second))
+		gauges = append(gauges, ecbp1100ThresholdGauge{delta: delta, gauge: metrics.NewRegisteredGaugeFloat64(name, nil)})
+	}
+	return gauges
+}()
+
+// ErrArtificialFinalityReject represents an error caused by artificial finality mechanisms.
+var ErrArtificialFinalityReject = errors.New("finality-enforced invalid new chain")
+
+// ErrArtificialFinalityFutureBlock is returned for blocks exceeding the strict future time bound
+// enforced while artificial finality is enabled.
+var ErrArtificialFinalityFutureBlock = errors.New("finality-enforced future block")
 
 // EnableArtificialFinality enables and disable artificial finality features for the blockchain.
 // Currently toggled features include:
@@ -23,8 +64,23 @@ var errReorgFinality = errors.New("finality-enforced invalid new chain")
 // This level of activation works BELOW the chain configuration for any of the
 // potential features. eg. If ECBP1100 is not activated at the chain config x block number,
 // then calling bc.EnableArtificialFinality(true) will be a noop.
+//
+// If a catch-up distance is configured with SetArtificialFinalityCatchUp, and the head
+// block is further than it behind the network head, enabling is deferred until the node
+// caught up; see SetArtificialFinalityCatchUp.
 // The method is idempotent.
 func (bc *BlockChain) EnableArtificialFinality(enable bool, logValues ...interface{}) {
+	if enable && bc.artificialFinalityBehind() {
+		atomic.StoreInt32(&bc.artificialFinalityEnabled, 0)
+		if atomic.SwapInt32(&bc.artificialFinalityDeferred, 1) == 0 {
+			log.Info("Deferred artificial finality features until caught up", append([]interface{}{
+				"head", bc.CurrentBlock().NumberU64(), "network", atomic.LoadUint64(&bc.artificialFinalityNetworkHead),
+				"distance", atomic.LoadUint64(&bc.artificialFinalityCatchUp)}, logValues...)...)
+		}
+		return
+	}
+	atomic.StoreInt32(&bc.artificialFinalityDeferred, 0)
+
 	// Store enable/disable value regardless of config activation.
 	var statusLog string
 	if enable {
@@ -34,7 +90,7 @@ func (bc *BlockChain) EnableArtificialFinality(enable bool, logValues ...interfa
 		statusLog = "Disabled"
 		atomic.StoreInt32(&bc.artificialFinalityEnabled, 0)
 	}
-	if !bc.chainConfig.IsEnabled(bc.chainConfig.GetECBP1100Transition, bc.CurrentHeader().Number) {
+	if !bc.Config().IsEnabled(bc.Config().GetECBP1100Transition, bc.CurrentHeader().Number) {
 		// Don't log anything if the config hasn't enabled it yet.
 		return
 	}
@@ -48,46 +104,831 @@ func (bc *BlockChain) EnableArtificialFinality(enable bool, logValues ...interfa
 // IsArtificialFinalityEnabled returns the status of the blockchain's artificial
 // finality feature setting.
 // This status is agnostic of feature activation by chain configuration.
+// Artificial finality whose enabling is deferred is not enabled.
 func (bc *BlockChain) IsArtificialFinalityEnabled() bool {
 	return atomic.LoadInt32(&bc.artificialFinalityEnabled) == 1
 }
 
+// IsArtificialFinalityDeferred returns whether artificial finality was enabled, but
+// awaits the node catching up with the network head to engage.
+func (bc *BlockChain) IsArtificialFinalityDeferred() bool {
+	return atomic.LoadInt32(&bc.artificialFinalityDeferred) == 1
+}
+
+// SetArtificialFinalityCatchUp sets the distance, in blocks, the head block must be
+// within of the network head, as reported by SetArtificialFinalityNetworkHead, for
+// EnableArtificialFinality to take effect. Enabling further behind is deferred until
+// the node caught up, when artificial finality engages and an ArtificialFinalityEngagedEvent
+// is posted. This avoids rejecting legitimate reorgs while the node is still syncing.
+// Zero, the default, enables artificial finality immediately.
+func (bc *BlockChain) SetArtificialFinalityCatchUp(distance uint64) {
+	atomic.StoreUint64(&bc.artificialFinalityCatchUp, distance)
+	bc.engageArtificialFinality()
+}
+
+// SetArtificialFinalityNetworkHead reports the number of the network's head block,
+// which deferred artificial finality waits for the node to catch up with.
+func (bc *BlockChain) SetArtificialFinalityNetworkHead(number uint64) {
+	atomic.StoreUint64(&bc.artificialFinalityNetworkHead, number)
+	bc.engageArtificialFinality()
+}
+
+// SubscribeArtificialFinalityEngaged registers a subscription of ArtificialFinalityEngagedEvent.
+// Artificial finality engaging on a new head block is posted once the insertion of
+// the block returns, outside the chain lock. Engaging as the catch-up distance or the
+// network head is set is posted once the next insertion returns.
+func (bc *BlockChain) SubscribeArtificialFinalityEngaged(ch chan<- ArtificialFinalityEngagedEvent) event.Subscription {
+	return bc.scope.Track(bc.afEngagedFeed.Subscribe(ch))
+}
+
+// artificialFinalityBehind returns whether the head block is further than the catch-up
+// distance behind the network head. An unknown network head is never ahead.
+func (bc *BlockChain) artificialFinalityBehind() bool {
+	distance := atomic.LoadUint64(&bc.artificialFinalityCatchUp)
+	if distance == 0 {
+		return false
+	}
+	return atomic.LoadUint64(&bc.artificialFinalityNetworkHead) > bc.CurrentBlock().NumberU64()+distance
+}
+
+// engageArtificialFinality enables deferred artificial finality once the node caught
+// up, queuing the ArtificialFinalityEngagedEvent, see postArtificialFinality.
+func (bc *BlockChain) engageArtificialFinality() {
+	if !bc.IsArtificialFinalityDeferred() || bc.artificialFinalityBehind() {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&bc.artificialFinalityDeferred, 1, 0) {
+		return
+	}
+	atomic.StoreInt32(&bc.artificialFinalityEnabled, 1)
+
+	head, network := bc.CurrentBlock().NumberU64(), atomic.LoadUint64(&bc.artificialFinalityNetworkHead)
+	log.Info("Engaged artificial finality features", "head", head, "network", network)
+	bc.afPending.queue(ArtificialFinalityEngagedEvent{Number: head, NetworkHead: network})
+}
+
+// SetArtificialFinalityStallWatchdog configures a watchdog disabling artificial finality
+// if the chain made no canonical progress for at least stall, while artificial finality
+// rejected at least rejections competing segments meanwhile, each counted once per
+// insertion however many of its blocks were rejected. A node stuck on a dead chain
+// this way follows the heaviest chain again: the rejection tripping the watchdog is
+// overridden, and an ArtificialFinalityStallEvent is posted. A stall of zero, the default,
+// disables the watchdog. Configuring the watchdog restarts its stall timer.
+func (bc *BlockChain) SetArtificialFinalityStallWatchdog(stall time.Duration, rejections uint32) {
+	atomic.StoreUint32(&bc.artificialFinalityStallRejects, rejections)
+	atomic.StoreInt64(&bc.artificialFinalityStall, int64(stall))
+	bc.artificialFinalityProgressed()
+}
+
+// SubscribeArtificialFinalityStall registers a subscription of ArtificialFinalityStallEvent.
+func (bc *BlockChain) SubscribeArtificialFinalityStall(ch chan<- ArtificialFinalityStallEvent) event.Subscription {
+	return bc.scope.Track(bc.afStallFeed.Subscribe(ch))
+}
+
+// SubscribeArtificialFinalityDecision registers a subscription of
+// ArtificialFinalityDecisionEvent. The decisions made by an insertion are posted once
+// it returns, outside the chain lock.
+func (bc *BlockChain) SubscribeArtificialFinalityDecision(ch chan<- ArtificialFinalityDecisionEvent) event.Subscription {
+	return bc.scope.Track(bc.afDecisionFeed.Subscribe(ch))
+}
+
+// afTracedError is an ECBP1100 rejection carrying the trace id of the decision. Its
+// message is the rejection reason's, so that decisions are comparable by message.
+type afTracedError struct {
+	err error
+	id  string
+}
+
+func (e *afTracedError) Error() string { return e.err.Error() }
+func (e *afTracedError) Unwrap() error { return e.err }
+
+// ArtificialFinalityTraceID returns the trace id of the ECBP1100 decision err is the
+// rejection of, an empty string if it is none.
+func ArtificialFinalityTraceID(err error) string {
+	var traced *afTracedError
+	if errors.As(err, &traced) {
+		return traced.id
+	}
+	return ""
+}
+
+// newArtificialFinalityTraceID returns a random id of an ECBP1100 decision, in the
+// format of W3C trace context trace ids.
+func newArtificialFinalityTraceID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// updateECBP1100ThresholdGauges reports the antigravity thresholds enforced at the new
+// head block, the ratio of the subchain total difficulties a competing segment must
+// exceed, as ecbp1100PolynomialV computes it for the segment's common ancestor, or
+// zero if MESS is not enforced there.
+func (bc *BlockChain) updateECBP1100ThresholdGauges(head *types.Header) {
+	active := bc.IsArtificialFinalityEnabled() && bc.Config().IsEnabled(bc.Config().GetECBP1100Transition, head.Number)
+	for _, g := range ecbp1100ThresholdGauges {
+		if !active {
+			g.gauge.Update(0)
+			continue
+		}
+		var at uint64
+		if delta := uint64(g.delta.Seconds()); head.Time > delta {
+			at = head.Time - delta
+		}
+		threshold, _ := new(big.Float).Quo(
+			new(big.Float).SetInt(ecbp1100PolynomialV(bc.ecbp1100Input(bc.canonicalAncestorAt(head, at), head))),
+			new(big.Float).SetInt(ecbp1100PolynomialVCurveFunctionDenominator),
+		).Float64()
+		g.gauge.Update(threshold)
+	}
+}
+
+// canonicalAncestorAt returns the latest canonical block before head whose timestamp
+// is at most timestamp, or the genesis block if there is none.
+func (bc *BlockChain) canonicalAncestorAt(head *types.Header, timestamp uint64) *types.Header {
+	lo, hi := uint64(0), head.Number.Uint64()
+	for lo+1 < hi {
+		mid := lo + (hi-lo)/2
+		if header := bc.GetHeaderByNumber(mid); header != nil && header.Time <= timestamp {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return bc.GetHeaderByNumber(lo)
+}
+
+// artificialFinalityProgressed restarts the stall watchdog on canonical progress.
+func (bc *BlockChain) artificialFinalityProgressed() {
+	atomic.StoreInt64(&bc.artificialFinalityProgress, bc.now().UnixNano())
+	atomic.StoreUint32(&bc.artificialFinalityRejects, 0)
+}
+
+// artificialFinalityStalled counts a rejection by artificial finality if it rejects a
+// new segment, rather than the next block of a segment rejected by the insertion, and
+// disables artificial finality if the stall watchdog trips, returning whether it did.
+func (bc *BlockChain) artificialFinalityStalled(newSegment bool) bool {
+	rejections := atomic.LoadUint32(&bc.artificialFinalityRejects)
+	if newSegment {
+		rejections = atomic.AddUint32(&bc.artificialFinalityRejects, 1)
+	}
+	stall := time.Duration(atomic.LoadInt64(&bc.artificialFinalityStall))
+	if stall == 0 || rejections < atomic.LoadUint32(&bc.artificialFinalityStallRejects) {
+		return false
+	}
+	since := bc.now().Sub(time.Unix(0, atomic.LoadInt64(&bc.artificialFinalityProgress)))
+	if since < stall {
+		return false
+	}
+	if !atomic.CompareAndSwapInt32(&bc.artificialFinalityEnabled, 1, 0) {
+		return false
+	}
+	head := bc.CurrentBlock().NumberU64()
+	log.Error("########## ARTIFICIAL FINALITY DISABLED ##########")
+	log.Error("Chain stalled while artificial finality rejected competing segments, following the heaviest chain",
+		"head", head, "stalled", common.PrettyDuration(since), "rejections", rejections)
+	bc.afPending.queue(ArtificialFinalityStallEvent{Number: head, Stalled: since, Rejections: rejections})
+	return true
+}
+
+// ArtificialFinalityRejectPolicy defines how chain insertion treats a competing
+// segment which has sufficient total difficulty, but is rejected by artificial finality.
+type ArtificialFinalityRejectPolicy int32
+
+const (
+	// ArtificialFinalityRejectSidechain retains the rejected segment as a side chain
+	// and does not report an error. This is the default.
+	ArtificialFinalityRejectSidechain ArtificialFinalityRejectPolicy = iota
+
+	// ArtificialFinalityRejectError retains the rejected segment as a side chain and aborts
+	// the insertion with an error wrapping ErrArtificialFinalityReject.
+	ArtificialFinalityRejectError
+
+	// ArtificialFinalityRejectStop inserts the blocks preceding the first rejected one and
+	// stops the insertion there, without storing the rejected block or any following it.
+	// InsertChain returns the index of the rejected block, which is the number of blocks
+	// inserted, along with an *ArtificialFinalityStopError.
+	ArtificialFinalityRejectStop
+)
+
+// ArtificialFinalityStopError reports the block InsertChain stopped at under the
+// ArtificialFinalityRejectStop policy. It unwraps to the rejection reason, which
+// wraps ErrArtificialFinalityReject.
+type ArtificialFinalityStopError struct {
+	Index  int         // Index of the rejected block in the inserted batch
+	Number uint64      // Number of the rejected block
+	Hash   common.Hash // Hash of the rejected block
+	Err    error       // Rejection reason
+}
+
+func (e *ArtificialFinalityStopError) Error() string {
+	return fmt.Sprintf("insertion stopped at item %d, block #%d [%x…]: %v", e.Index, e.Number, e.Hash.Bytes()[:4], e.Err)
+}
+
+func (e *ArtificialFinalityStopError) Unwrap() error {
+	return e.Err
+}
+
+// SetArtificialFinalityRejectPolicy sets the policy applied to chain segments rejected by
+// artificial finality. In either case the rejected segment does not become canonical.
+func (bc *BlockChain) SetArtificialFinalityRejectPolicy(policy ArtificialFinalityRejectPolicy) {
+	atomic.StoreInt32(&bc.artificialFinalityRejectPolicy, int32(policy))
+}
+
+// ArtificialFinalityRejectPolicy returns the policy applied to chain segments rejected by
+// artificial finality.
+func (bc *BlockChain) ArtificialFinalityRejectPolicy() ArtificialFinalityRejectPolicy {
+	return ArtificialFinalityRejectPolicy(atomic.LoadInt32(&bc.artificialFinalityRejectPolicy))
+}
+
+// ArtificialFinalityRejection describes a chain segment rejected by artificial
+// finality, as passed to an ArtificialFinalityRejectHandler.
+type ArtificialFinalityRejection struct {
+	CommonAncestor *types.Header // Common ancestor of the current and the proposed segment
+	Current        *types.Header // Head of the current segment
+	Proposed       *types.Header // Head of the proposed, rejected segment
+	Err            error         // Rejection reason, wrapping ErrArtificialFinalityReject
+	TraceID        string        // Unique id of the decision, see ArtificialFinalityDecisionEvent
+}
+
+// ArtificialFinalityRejectHandler is called for every chain segment rejected by
+// artificial finality, once per insertion, see SetArtificialFinalityRejectHandler.
+type ArtificialFinalityRejectHandler func(rejection *ArtificialFinalityRejection)
+
+// afRejectHandlerHolder wraps an ArtificialFinalityRejectHandler, so that nil
+// handlers can be stored in an atomic.Value too.
+type afRejectHandlerHolder struct {
+	ArtificialFinalityRejectHandler
+}
+
+// SetArtificialFinalityRejectHandler sets a handler called for every chain segment
+// rejected by artificial finality, eg. to raise alerts. The handler is called once
+// per segment an insertion rejected, with the rejection of the last block or header
+// of the segment evaluated, synchronously as the insertion returns, outside the chain
+// lock. It should not block for long, as it holds up the insertion. A nil handler, the
+// default, removes the handler.
+func (bc *BlockChain) SetArtificialFinalityRejectHandler(handler ArtificialFinalityRejectHandler) {
+	bc.afRejectHandler.Store(afRejectHandlerHolder{handler})
+}
+
+// afReport is the chain segments artificial finality rejected, and the events it
+// raised, to report once an insertion returns.
+type afReport struct {
+	rejections []*ArtificialFinalityRejection // Rejected segments, the latest rejection of each
+	events     []interface{}                  // Events to post, the oldest first
+}
+
+// reject adds a rejection, replacing the one of the same segment if any. Proposed
+// blocks of the same common ancestor and current head extend the same segment.
+func (r *afReport) reject(rejection *ArtificialFinalityRejection) {
+	for i, rej := range r.rejections {
+		if rej.CommonAncestor.Hash() == rejection.CommonAncestor.Hash() && rej.Current.Hash() == rejection.Current.Hash() {
+			r.rejections[i] = rejection
+			return
+		}
+	}
+	r.rejections = append(r.rejections, rejection)
+}
+
+// afPending collects the chain segments artificial finality rejected, and the events
+// it raised, during insertions made holding the chain lock. Insertions take them
+// before releasing the lock, so that they don't take those of an insertion still in
+// progress, and report them once they released it, see postArtificialFinality.
+type afPending struct {
+	afReport
+	lock sync.Mutex
+}
+
+// reject adds a rejection, replacing the one of the same segment if any.
+func (p *afPending) reject(rejection *ArtificialFinalityRejection) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.afReport.reject(rejection)
+}
+
+// queue adds an event to post.
+func (p *afPending) queue(ev interface{}) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.events = append(p.events, ev)
+}
+
+// rejected returns whether a rejection of the segment of the given common ancestor
+// and current head was collected.
+func (p *afPending) rejected(commonAncestor, current *types.Header) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, r := range p.rejections {
+		if r.CommonAncestor.Hash() == commonAncestor.Hash() && r.Current.Hash() == current.Hash() {
+			return true
+		}
+	}
+	return false
+}
+
+// take moves the collected rejections and events to report, merging the rejections
+// of the same segment, and clears them. It must be called holding the chain lock.
+func (p *afPending) take(report *afReport) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, r := range p.rejections {
+		report.reject(r)
+	}
+	report.events = append(report.events, p.events...)
+	p.rejections, p.events = nil, nil
+}
+
+// postArtificialFinality reports the chain segments artificial finality rejected
+// during an insertion, once per segment, by adding them to the reorg history and
+// handing them to the reject handler, and posts the events it raised meanwhile. It
+// is called where insertions return, with the report taken from afPending before
+// releasing the chain lock, once it is released, so that slow subscribers don't hold
+// up the chain.
+func (bc *BlockChain) postArtificialFinality(report *afReport) {
+	handler := bc.afRejectHandler.Load().(afRejectHandlerHolder).ArtificialFinalityRejectHandler
+	for _, r := range report.rejections {
+		bc.recordRejectedReorg(r.CommonAncestor, r.Current, r.Proposed, r.TraceID)
+		if handler != nil {
+			handler(r)
+		}
+	}
+	for _, ev := range report.events {
+		switch ev := ev.(type) {
+		case ArtificialFinalityDecisionEvent:
+			bc.afDecisionFeed.Send(ev)
+		case ArtificialFinalityStallEvent:
+			bc.afStallFeed.Send(ev)
+		case ArtificialFinalityEngagedEvent:
+			bc.afEngagedFeed.Send(ev)
+		}
+	}
+}
+
+// ErrArtificialFinalityTie is returned for competing segments tying with the head under
+// the ArtificialFinalityTieReject policy.
+var ErrArtificialFinalityTie = errors.New("finality-enforced total difficulty tie")
+
+// ArtificialFinalityTiePolicy defines how chain insertion treats a competing segment
+// whose total difficulty exactly equals the head's while artificial finality is active.
+type ArtificialFinalityTiePolicy int32
+
+const (
+	// ArtificialFinalityTieKeepCurrent keeps the current head, retaining the competing
+	// segment as a side chain. This is the default.
+	ArtificialFinalityTieKeepCurrent ArtificialFinalityTiePolicy = iota
+
+	// ArtificialFinalityTieAdoptNew reorganizes to the competing segment, subject to
+	// ECBP1100 like any other reorganization.
+	ArtificialFinalityTieAdoptNew
+
+	// ArtificialFinalityTieReject retains the competing segment as a side chain and
+	// aborts the insertion with an error wrapping ErrArtificialFinalityTie.
+	ArtificialFinalityTieReject
+)
+
+// SetArtificialFinalityTiePolicy sets the policy applied to competing segments tying
+// with the head while artificial finality is active. Ties are otherwise split by
+// block number, then by the preference of locally mined blocks, then randomly.
+func (bc *BlockChain) SetArtificialFinalityTiePolicy(policy ArtificialFinalityTiePolicy) {
+	atomic.StoreInt32(&bc.artificialFinalityTiePolicy, int32(policy))
+}
+
+// ArtificialFinalityTiePolicy returns the policy applied to competing segments tying
+// with the head while artificial finality is active.
+func (bc *BlockChain) ArtificialFinalityTiePolicy() ArtificialFinalityTiePolicy {
+	return ArtificialFinalityTiePolicy(atomic.LoadInt32(&bc.artificialFinalityTiePolicy))
+}
+
+// artificialFinalityTie settles a tie between the current head and a competing block
+// of equal total difficulty by the tie policy, returning whether to reorganize to it.
+func (bc *BlockChain) artificialFinalityTie(current, block *types.Block) (bool, error) {
+	switch bc.ArtificialFinalityTiePolicy() {
+	case ArtificialFinalityTieAdoptNew:
+		return true, nil
+	case ArtificialFinalityTieReject:
+		return false, fmt.Errorf("%w: block #%d [%x…] ties with head #%d [%x…]", ErrArtificialFinalityTie,
+			block.NumberU64(), block.Hash().Bytes()[:4], current.NumberU64(), current.Hash().Bytes()[:4])
+	}
+	return false, nil
+}
+
+// ArtificialFinalityEqualLengthPolicy defines how ECBP1100 judges a competing segment
+// of the same length as the current one above their common ancestor, whose total
+// difficulty outweighs it.
+type ArtificialFinalityEqualLengthPolicy int32
+
+const (
+	// ArtificialFinalityEqualLengthAntigravity applies antigravity as to segments of
+	// any other length. This is the default.
+	ArtificialFinalityEqualLengthAntigravity ArtificialFinalityEqualLengthPolicy = iota
+
+	// ArtificialFinalityEqualLengthTD bypasses antigravity, accepting the heavier
+	// segment by pure total difficulty.
+	ArtificialFinalityEqualLengthTD
+)
+
+// SetArtificialFinalityEqualLengthPolicy sets the policy ECBP1100 applies to competing
+// segments of the same length as the current one. Near the antigravity threshold the
+// decision about such segments depends on slight differences of their difficulties,
+// which the policy makes explicit.
+func (bc *BlockChain) SetArtificialFinalityEqualLengthPolicy(policy ArtificialFinalityEqualLengthPolicy) {
+	atomic.StoreInt32(&bc.artificialFinalityEqualLength, int32(policy))
+}
+
+// ArtificialFinalityEqualLengthPolicy returns the policy ECBP1100 applies to competing
+// segments of the same length as the current one.
+func (bc *BlockChain) ArtificialFinalityEqualLengthPolicy() ArtificialFinalityEqualLengthPolicy {
+	return ArtificialFinalityEqualLengthPolicy(atomic.LoadInt32(&bc.artificialFinalityEqualLength))
+}
+
+// artificialFinalityPlausibleTDRatio is the greatest total difficulty ratio (proposed over local segment) a competing
+// chain segment is assumed to be able to muster; eg. 2 is an attacker with twice the honest hash rate
+// over the same span of time.
+var artificialFinalityPlausibleTDRatio = big.NewInt(2)
+
+// IsEffectivelyFinal returns true if the canonical block with the given hash
+// cannot plausibly be reorganized out of the chain under the artificial finality (MESS) rules.
+//
+// The returned value assumes that artificial finality is enabled and activated by chain configuration
+// for the current head (otherwise false is returned), that a competing segment would fork from the block's parent
+// and be judged against the current head, and that a competing segment cannot have a total difficulty ratio
+// greater than artificialFinalityPlausibleTDRatio over the displaced local segment.
+// Under these assumptions the block is final when the antigravity threshold for the block's depth
+// (the time span between its parent and the current head) exceeds the plausible ratio.
+// Unknown and non-canonical blocks are never final.
+func (bc *BlockChain) IsEffectivelyFinal(hash common.Hash) bool {
+	return bc.isEffectivelyFinal(hash, artificialFinalityPlausibleTDRatio)
+}
+
+// isEffectivelyFinal returns true if the canonical block with the given hash is
+// effectively final as defined by IsEffectivelyFinal, assuming a competing segment
+// cannot have a total difficulty ratio greater than ratio over the local one.
+func (bc *BlockChain) isEffectivelyFinal(hash common.Hash, ratio *big.Int) bool {
+	current := bc.CurrentBlock().Header()
+	if !bc.IsArtificialFinalityEnabled() || !bc.Config().IsEnabled(bc.Config().GetECBP1100Transition, current.Number) {
+		return false
+	}
+	header := bc.GetHeaderByHash(hash)
+	if header == nil || header.Number.Sign() == 0 || bc.GetCanonicalHash(header.Number.Uint64()) != hash {
+		return false
+	}
+	parent := bc.GetHeader(header.ParentHash, header.Number.Uint64()-1)
+	if parent == nil {
+		return false
+	}
+	// The segment would be accepted, at best, when
+	//   proposed_subchain_td * CURVE_FUNCTION_DENOMINATOR >= get_curve_function_numerator(current.Time - commonAncestor.Time) * local_subchain_td
+	// where proposed_subchain_td = plausible_ratio * local_subchain_td.
+	want := ecbp1100PolynomialV(big.NewInt(int64(current.Time - parent.Time)))
+	got := new(big.Int).Mul(ratio, ecbp1100PolynomialVCurveFunctionDenominator)
+	return got.Cmp(want) < 0
+}
+
+// ReorgDifficultyRequirement returns the minimum total difficulty a competing segment
+// needs to reorganize the last depth blocks out of the canonical chain, ie. to become
+// canonical forking from the block depth below the current head. The segment must
+// outweigh the displaced one and, while artificial finality is enabled and activated
+// for the current head, also meet the antigravity threshold at the time span of the
+// displaced segment. Segments within the minimum segment length are not exempted.
+// The total difficulty is that of the competing segment alone, above the fork point.
+// Nil is returned if depth is zero or exceeds the head block's number.
+func (bc *BlockChain) ReorgDifficultyRequirement(depth uint64) *big.Int {
+	current := bc.CurrentBlock().Header()
+	if depth == 0 || depth > current.Number.Uint64() {
+		return nil
+	}
+	ancestor := bc.GetHeaderByNumber(current.Number.Uint64() - depth)
+	if ancestor == nil {
+		return nil
+	}
+	localTD, ancestorTD := bc.GetTd(current.Hash(), current.Number.Uint64()), bc.GetTd(ancestor.Hash(), ancestor.Number.Uint64())
+	if localTD == nil || ancestorTD == nil {
+		return nil
+	}
+	local := new(big.Int).Sub(localTD, ancestorTD)
+	required := new(big.Int).Add(local, common.Big1)
+
+	if !bc.IsArtificialFinalityEnabled() || !bc.Config().IsEnabled(bc.Config().GetECBP1100Transition, current.Number) {
+		return required
+	}
+	// The segment is accepted when
+	//   proposed_subchain_td * CURVE_FUNCTION_DENOMINATOR >= get_curve_function_numerator(current.Time - commonAncestor.Time) * local_subchain_td
+	// so the least proposed_subchain_td accepted is the quotient, rounded up.
+	want := new(big.Int).Mul(ecbp1100PolynomialV(bc.ecbp1100Input(ancestor, current)), local)
+	want.Add(want, new(big.Int).Sub(ecbp1100PolynomialVCurveFunctionDenominator, common.Big1))
+	want.Div(want, ecbp1100PolynomialVCurveFunctionDenominator)
+	if want.Cmp(required) > 0 {
+		required = want
+	}
+	return required
+}
+
+// SubscribeFinalityConfirmation registers a subscription of FinalityConfirmationEvent.
+// An event is posted, in ascending block order, for each canonical block which is at least depth blocks
+// below the current head and is effectively final as defined by IsEffectivelyFinal, with safetyFactor as the
+// greatest total difficulty ratio a competing segment is assumed to muster; a nil or non-positive safetyFactor
+// applies artificialFinalityPlausibleTDRatio. The greater the safety factor, the deeper blocks are confirmed.
+// Blocks already confirmed at the time of subscription are not reported.
+// No events are delivered while artificial finality is disabled or not yet activated.
+func (bc *BlockChain) SubscribeFinalityConfirmation(depth uint64, safetyFactor *big.Int, ch chan<- FinalityConfirmationEvent) event.Subscription {
+	ratio := artificialFinalityPlausibleTDRatio
+	if safetyFactor != nil && safetyFactor.Sign() > 0 {
+		ratio = new(big.Int).Set(safetyFactor)
+	}
+	heads := make(chan ChainHeadEvent, chainHeadChanSize)
+	headSub := bc.chainHeadFeed.Subscribe(heads)
+
+	// Find the first unconfirmed block. Confirmation is monotonic in depth, so
+	// the confirmed blocks always form a prefix of the canonical chain.
+	head := bc.CurrentBlock().NumberU64()
+	next := uint64(1) + uint64(sort.Search(int(head), func(i int) bool {
+		return !bc.isFinalityConfirmed(uint64(i)+1, head, depth, ratio)
+	}))
+
+	return bc.scope.Track(event.NewSubscription(func(quit <-chan struct{}) error {
+		defer headSub.Unsubscribe()
+		for {
+			head := bc.CurrentBlock().NumberU64()
+			for ; next <= head && bc.isFinalityConfirmed(next, head, depth, ratio); next++ {
+				select {
+				case ch <- FinalityConfirmationEvent{Hash: bc.GetCanonicalHash(next), Number: next}:
+				case <-quit:
+					return nil
+				}
+			}
+			select {
+			case <-heads:
+			case err := <-headSub.Err():
+				return err
+			case <-quit:
+				return nil
+			}
+		}
+	}))
+}
+
+// isFinalityConfirmed returns true if the canonical block with the given number is
+// at least depth blocks below head and effectively final under the given ratio.
+func (bc *BlockChain) isFinalityConfirmed(number, head, depth uint64, ratio *big.Int) bool {
+	if number > head || head-number < depth {
+		return false
+	}
+	return bc.isEffectivelyFinal(bc.GetCanonicalHash(number), ratio)
+}
+
+// EffectiveFinalityDepth returns the depth below the current head of the most recent
+// canonical block which is effectively final as defined by IsEffectivelyFinal, ie. the number
+// of blocks a block must currently be buried under to be considered final. False is returned
+// if no block is effectively final.
+func (bc *BlockChain) EffectiveFinalityDepth() (uint64, bool) {
+	return bc.effectiveFinalityDepth(bc.CurrentBlock().NumberU64())
+}
+
+// effectiveFinalityDepth returns the depth below head of the most recent effectively
+// final canonical block, and false if there is none.
+func (bc *BlockChain) effectiveFinalityDepth(head uint64) (uint64, bool) {
+	// Finality is monotonic in depth, so the final blocks form a prefix of the canonical chain.
+	final := uint64(sort.Search(int(head), func(i int) bool {
+		return !bc.IsEffectivelyFinal(bc.GetCanonicalHash(uint64(i) + 1))
+	}))
+	if final == 0 {
+		return 0, false
+	}
+	return head - final, true
+}
+
+// SubscribeEffectiveFinalityDepth registers a subscription of EffectiveFinalityDepthEvent.
+// An event is posted whenever the effective-finality depth, as returned by EffectiveFinalityDepth,
+// differs by more than delta blocks from the one last posted, or from the depth at the time
+// of subscription if none was posted yet. If no block was effectively final at subscription,
+// the first depth available is posted.
+// No events are delivered while artificial finality is disabled or not yet activated.
+func (bc *BlockChain) SubscribeEffectiveFinalityDepth(delta uint64, ch chan<- EffectiveFinalityDepthEvent) event.Subscription {
+	heads := make(chan ChainHeadEvent, chainHeadChanSize)
+	headSub := bc.chainHeadFeed.Subscribe(heads)
+
+	last, known := bc.EffectiveFinalityDepth()
+
+	return bc.scope.Track(event.NewSubscription(func(quit <-chan struct{}) error {
+		defer headSub.Unsubscribe()
+		for {
+			select {
+			case <-heads:
+				head := bc.CurrentBlock()
+				depth, ok := bc.effectiveFinalityDepth(head.NumberU64())
+				if !ok || (known && depth <= last+delta && depth+delta >= last) {
+					continue
+				}
+				last, known = depth, true
+				select {
+				case ch <- EffectiveFinalityDepthEvent{Head: head.Hash(), Depth: depth}:
+				case <-quit:
+					return nil
+				}
+			case err := <-headSub.Err():
+				return err
+			case <-quit:
+				return nil
+			}
+		}
+	}))
+}
+
+// SetArtificialFinalityTDRatioWindow sets the number of most recent blocks of a proposed
+// segment over which the total difficulty ratio is averaged, smoothing out noisy
+// difficulties. Artificial finality decides on the averaged ratio, which is also the
+// one reported. Zero or one (the default) use the ratio at the proposed block only.
+func (bc *BlockChain) SetArtificialFinalityTDRatioWindow(window uint32) {
+	atomic.StoreUint32(&bc.artificialFinalityTDRatioWindow, window)
+}
+
 // getTDRatio is a helper function returning the total difficulty ratio of
 // proposed over current chain segments.
+// The ratio is averaged over the configured window of proposed blocks, ending
+// with the proposed block and not reaching beyond the common ancestor.
 func (bc *BlockChain) getTDRatio(commonAncestor, current, proposed *types.Header) float64 {
+	proposedParentTD := bc.GetTd(proposed.ParentHash, proposed.Number.Uint64()-1)
+	return bc.getTDRatioTD(commonAncestor, current, proposed, new(big.Int).Add(proposed.Difficulty, proposedParentTD))
+}
+
+// getTDRatioTD is getTDRatio with the total difficulty of the proposed block given,
+// allowing the evaluation of blocks not (yet) stored.
+func (bc *BlockChain) getTDRatioTD(commonAncestor, current, proposed *types.Header, proposedTD *big.Int) float64 {
 	// Get the total difficulty ratio of the proposed chain segment over the existing one.
 	commonAncestorTD := bc.GetTd(commonAncestor.Hash(), commonAncestor.Number.Uint64())
 
-	proposedParentTD := bc.GetTd(proposed.ParentHash, proposed.Number.Uint64()-1)
-	proposedTD := new(big.Int).Add(proposed.Difficulty, proposedParentTD)
-
 	localTD := bc.GetTd(current.Hash(), current.Number.Uint64())
 
+	sum, n := bc.ecbp1100ProposedSubchainTD(commonAncestor, proposed, proposedTD, commonAncestorTD)
 	tdRatio, _ := new(big.Float).Quo(
-		new(big.Float).SetInt(new(big.Int).Sub(proposedTD, commonAncestorTD)),
-		new(big.Float).SetInt(new(big.Int).Sub(localTD, commonAncestorTD)),
+		new(big.Float).SetInt(sum),
+		new(big.Float).SetInt(new(big.Int).Mul(new(big.Int).Sub(localTD, commonAncestorTD), big.NewInt(n))),
 	).Float64()
 	return tdRatio
 }
 
+// ecbp1100ProposedSubchainTD returns the sum of the total difficulties above the common
+// ancestor of the proposed block, of the given total difficulty, and of its most recent
+// ancestors within the TD ratio window, along with their number. The ancestors' total
+// difficulties are derived from the proposed one, so the proposed block need not be
+// stored.
+func (bc *BlockChain) ecbp1100ProposedSubchainTD(commonAncestor, proposed *types.Header, proposedTD, commonAncestorTD *big.Int) (*big.Int, int64) {
+	window := int64(atomic.LoadUint32(&bc.artificialFinalityTDRatioWindow))
+	if window < 1 {
+		window = 1
+	}
+	var (
+		sum = new(big.Int)
+		td  = new(big.Int).Set(proposedTD)
+		n   int64
+	)
+	for header := proposed; header != nil && n < window && header.Number.Cmp(commonAncestor.Number) > 0; n++ {
+		sum.Add(sum, new(big.Int).Sub(td, commonAncestorTD))
+		td.Sub(td, header.Difficulty)
+
+		header = bc.GetHeader(header.ParentHash, header.Number.Uint64()-1)
+	}
+	if n == 0 {
+		n = 1
+	}
+	return sum, n
+}
+
 // ecbp1100 implements the "MESS" artificial finality mechanism
 // "Modified Exponential Subjective Scoring" used to prefer known chain segments
 // over later-to-come counterparts, especially proposed segments stretching far into the past.
+//
+// Every decision is identified by a unique trace id, which is logged, posted with the
+// ArtificialFinalityDecisionEvent and carried by the rejection error, see
+// ArtificialFinalityTraceID.
 func (bc *BlockChain) ecbp1100(commonAncestor, current, proposed *types.Header) error {
+	proposedParentTD := bc.GetTd(proposed.ParentHash, proposed.Number.Uint64()-1)
+	err := bc.ecbp1100TD(commonAncestor, current, proposed, new(big.Int).Add(proposed.Difficulty, proposedParentTD))
+	if err != nil && bc.artificialFinalityStalled(!bc.afPending.rejected(commonAncestor, current)) {
+		err = nil
+	}
+	id := newArtificialFinalityTraceID()
+	if err != nil {
+		err = &afTracedError{err: err, id: id}
+		ecbp1100RejectedMeter.Mark(1)
+		bc.afPending.reject(&ArtificialFinalityRejection{CommonAncestor: commonAncestor, Current: current, Proposed: proposed, Err: err, TraceID: id})
+	} else {
+		ecbp1100AcceptedMeter.Mark(1)
+	}
+	log.Debug("ECBP1100-MESS decision", "trace", id, "accepted", err == nil,
+		"common.bno", commonAncestor.Number, "common.hash", commonAncestor.Hash(),
+		"current.bno", current.Number, "current.hash", current.Hash(),
+		"proposed.bno", proposed.Number, "proposed.hash", proposed.Hash())
+	bc.afPending.queue(ArtificialFinalityDecisionEvent{
+		TraceID:        id,
+		CommonAncestor: commonAncestor,
+		Current:        current,
+		Proposed:       proposed,
+		Err:            err,
+	})
+	if bc.IsArtificialFinalityPersisted() {
+		threshold, _ := new(big.Float).Quo(
+			new(big.Float).SetInt(ecbp1100PolynomialV(bc.ecbp1100Input(commonAncestor, current))),
+			new(big.Float).SetInt(ecbp1100PolynomialVCurveFunctionDenominator),
+		).Float64()
+		rawdb.WriteArtificialFinalityDecision(bc.db, &rawdb.ArtificialFinalityDecision{
+			Time:           uint64(bc.now().Unix()),
+			Ancestor:       commonAncestor.Hash(),
+			AncestorNumber: commonAncestor.Number.Uint64(),
+			Proposed:       proposed.Hash(),
+			Current:        current.Hash(),
+			SegmentLength:  proposed.Number.Uint64() - commonAncestor.Number.Uint64(),
+			Ratio:          bc.getTDRatio(commonAncestor, current, proposed),
+			Threshold:      threshold,
+			Accepted:       err == nil,
+		})
+	}
+	return err
+}
+
+// SetArtificialFinalityPersist enables or disables persisting a record of every artificial
+// finality decision on chain and header insertion to the database, to be read back with
+// rawdb.ReadArtificialFinalityDecisions. Persistence is disabled by default.
+func (bc *BlockChain) SetArtificialFinalityPersist(enable bool) {
+	if enable {
+		atomic.StoreInt32(&bc.artificialFinalityPersist, 1)
+	} else {
+		atomic.StoreInt32(&bc.artificialFinalityPersist, 0)
+	}
+}
+
+// IsArtificialFinalityPersisted returns whether artificial finality decisions are
+// persisted to the database.
+func (bc *BlockChain) IsArtificialFinalityPersisted() bool {
+	return atomic.LoadInt32(&bc.artificialFinalityPersist) == 1
+}
+
+// ArtificialFinalityDecisionFor returns the most recent persisted artificial finality
+// decision about a proposed segment containing the block with the given hash, or nil
+// if there is none. Only decisions made while persistence was enabled are available,
+// see SetArtificialFinalityPersist.
+// Blocks which were never stored, like those rejected under ArtificialFinalityRejectStop,
+// are only found as the head of a proposed segment.
+func (bc *BlockChain) ArtificialFinalityDecisionFor(hash common.Hash) *rawdb.ArtificialFinalityDecision {
+	header := bc.GetHeaderByHash(hash)
+	decisions := rawdb.ReadArtificialFinalityDecisions(bc.db, 0, math.MaxUint64)
+	for i := len(decisions) - 1; i >= 0; i-- {
+		d := decisions[i]
+		if d.Proposed == hash {
+			return d
+		}
+		if header == nil {
+			continue
+		}
+		number, head := header.Number.Uint64(), d.AncestorNumber+d.SegmentLength
+		if number <= d.AncestorNumber || number > head {
+			continue
+		}
+		maxNonCanonical := d.SegmentLength
+		if ancestor, _ := bc.GetAncestor(d.Proposed, head, head-number, &maxNonCanonical); ancestor == hash {
+			return d
+		}
+	}
+	return nil
+}
+
+// ecbp1100TD is ecbp1100 with the total difficulty of the proposed block given,
+// allowing the evaluation of blocks not (yet) stored. Decisions are not metered.
+func (bc *BlockChain) ecbp1100TD(commonAncestor, current, proposed *types.Header, proposedTD *big.Int) error {
+	// Segments up to the minimum length are ordinary network reorgs, never rejected.
+	if proposed.Number.Uint64()-commonAncestor.Number.Uint64() <= uint64(atomic.LoadUint32(&bc.artificialFinalityMinSegment)) {
+		return nil
+	}
+	// Segments of equal length may be judged by total difficulty alone.
+	if proposed.Number.Cmp(current.Number) == 0 && bc.ArtificialFinalityEqualLengthPolicy() == ArtificialFinalityEqualLengthTD {
+		return nil
+	}
 
 	// Get the total difficulties of the proposed chain segment and the existing one.
 	commonAncestorTD := bc.GetTd(commonAncestor.Hash(), commonAncestor.Number.Uint64())
-	proposedParentTD := bc.GetTd(proposed.ParentHash, proposed.Number.Uint64()-1)
-	proposedTD := new(big.Int).Add(proposed.Difficulty, proposedParentTD)
 	localTD := bc.GetTd(current.Hash(), current.Number.Uint64())
 
 	// if proposed_subchain_td * CURVE_FUNCTION_DENOMINATOR < get_curve_function_numerator(proposed.Time - commonAncestor.Time) * local_subchain_td.
-	proposedSubchainTD := new(big.Int).Sub(proposedTD, commonAncestorTD)
+	// The proposed subchain TD is averaged over the TD ratio window, summed over n blocks.
+	proposedSubchainTD, n := bc.ecbp1100ProposedSubchainTD(commonAncestor, proposed, proposedTD, commonAncestorTD)
 	localSubchainTD := new(big.Int).Sub(localTD, commonAncestorTD)
 
-	xBig := big.NewInt(int64(current.Time - commonAncestor.Time))
+	xBig := bc.ecbp1100Input(commonAncestor, current)
 	eq := ecbp1100PolynomialV(xBig)
+
+	// The required threshold is the antigravity value expressed as a TD ratio,
+	// ie. without the curve function denominator.
+	threshold, _ := new(big.Float).Quo(
+		new(big.Float).SetInt(eq),
+		new(big.Float).SetInt(ecbp1100PolynomialVCurveFunctionDenominator),
+	).Float64()
+
 	want := eq.Mul(eq, localSubchainTD)
+	want.Mul(want, big.NewInt(n))
 
 	got := new(big.Int).Mul(proposedSubchainTD, ecbp1100PolynomialVCurveFunctionDenominator)
 
@@ -96,11 +937,15 @@ func (bc *BlockChain) ecbp1100(commonAncestor, current, proposed *types.Header)
 			new(big.Float).SetInt(got),
 			new(big.Float).SetInt(want),
 		).Float64()
-		return fmt.Errorf(`%w: ECBP1100-MESS 🔒 status=rejected age=%v current.span=%v proposed.span=%v tdr/gravity=%0.6f common.bno=%d common.hash=%s current.bno=%d current.hash=%s proposed.bno=%d proposed.hash=%s`,
-			errReorgFinality,
-			common.PrettyAge(time.Unix(int64(commonAncestor.Time), 0)),
+		return fmt.Errorf(`%w: ECBP1100-MESS 🔒 status=rejected age=%v current.span=%v proposed.span=%v segment.len=%d tdr=%0.6f threshold=%0.6f tdr/gravity=%0.6f common.bno=%d common.hash=%s current.bno=%d current.hash=%s proposed.bno=%d proposed.hash=%s`,
+			ErrArtificialFinalityReject,
+			// PrettyAge measures against the system clock, shift by the offset of the blockchain's clock.
+			common.PrettyAge(time.Unix(int64(commonAncestor.Time), 0).Add(time.Since(bc.now()))),
 			common.PrettyDuration(time.Duration(current.Time-commonAncestor.Time)*time.Second),
 			common.PrettyDuration(time.Duration(int32(xBig.Uint64()))*time.Second),
+			proposed.Number.Uint64()-commonAncestor.Number.Uint64(),
+			bc.getTDRatioTD(commonAncestor, current, proposed, proposedTD),
+			threshold,
 			prettyRatio,
 			commonAncestor.Number.Uint64(), commonAncestor.Hash().Hex(),
 			current.Number.Uint64(), current.Hash().Hex(),
@@ -110,6 +955,415 @@ func (bc *BlockChain) ecbp1100(commonAncestor, current, proposed *types.Header)
 	return nil
 }
 
+// SetArtificialFinalityClockSkewGrace sets the grace, in seconds, within which block
+// timestamp skews are ignored by ECBP1100. The antigravity input, the time span between
+// the common ancestor and the current head, is measured up to the blockchain's clock
+// rather than the head's timestamp while they differ by no more than the grace; beyond
+// it, the head's timestamp is clamped to within the grace of the clock. Skews of the
+// head up to the grace therefore leave the decision unchanged, while greater
+// manipulations affect it by no more than their excess over the grace. Zero, the
+// default, measures the span up to the head's timestamp.
+func (bc *BlockChain) SetArtificialFinalityClockSkewGrace(seconds uint32) {
+	atomic.StoreUint32(&bc.artificialFinalityClockSkewGrace, seconds)
+}
+
+// SetArtificialFinalityMinSegmentLength sets the length, in blocks above the common
+// ancestor, of proposed segments which ECBP1100 never rejects regardless of the time
+// span they cover, tolerating ordinary network reorgs. Longer segments are evaluated
+// as usual. Zero, the default, evaluates every segment.
+func (bc *BlockChain) SetArtificialFinalityMinSegmentLength(blocks uint32) {
+	atomic.StoreUint32(&bc.artificialFinalityMinSegment, blocks)
+}
+
+// ecbp1100Input returns the antigravity input for ECBP1100: the time span between the
+// common ancestor and the current head, with the head's timestamp clamped to within
+// the clock skew grace of the blockchain's clock.
+func (bc *BlockChain) ecbp1100Input(commonAncestor, current *types.Header) *big.Int {
+	head := current.Time
+	if grace := uint64(atomic.LoadUint32(&bc.artificialFinalityClockSkewGrace)); grace > 0 {
+		switch now := uint64(bc.now().Unix()); {
+		case head+grace < now:
+			head += grace
+		case head > now+grace:
+			head -= grace
+		default:
+			head = now
+		}
+	}
+	if head < commonAncestor.Time {
+		return new(big.Int)
+	}
+	return new(big.Int).SetUint64(head - commonAncestor.Time)
+}
+
+// SetArtificialFinalityMaxFutureTime sets a strict bound, in seconds, on how far ahead of the
+// blockchain's clock block timestamps may be while artificial finality is enabled and activated.
+// Since the antigravity curve depends on timestamps, such blocks are rejected before they
+// reach the ECBP1100 evaluation. Zero, the default, leaves the regular future block handling
+// as the only bound.
+func (bc *BlockChain) SetArtificialFinalityMaxFutureTime(seconds uint32) {
+	atomic.StoreUint32(&bc.artificialFinalityMaxFutureTime, seconds)
+}
+
+// ecbp1100FutureTime returns an error wrapping ErrArtificialFinalityFutureBlock if the
+// header's timestamp exceeds the strict future time bound, and nil if it does not,
+// no bound is set, or if artificial finality is disabled or not yet activated.
+func (bc *BlockChain) ecbp1100FutureTime(header *types.Header) error {
+	bound := uint64(atomic.LoadUint32(&bc.artificialFinalityMaxFutureTime))
+	if bound == 0 || !bc.IsArtificialFinalityEnabled() ||
+		!bc.Config().IsEnabled(bc.Config().GetECBP1100Transition, bc.CurrentHeader().Number) {
+		return nil
+	}
+	if max := uint64(bc.now().Unix()) + bound; header.Time > max {
+		return fmt.Errorf("%w: timestamp %v > allowed %v", ErrArtificialFinalityFutureBlock, header.Time, max)
+	}
+	return nil
+}
+
+// ecbp1100Header applies ECBP1100 to a header about to be written to the header chain,
+// using header total difficulties. It returns an error if writing the header would
+// reorganize the header chain in a way artificial finality rejects, and nil
+// if the header extends the current header head, does not cause a reorg, or if
+// artificial finality is disabled or not yet activated.
+func (bc *BlockChain) ecbp1100Header(header *types.Header) error {
+	if err := bc.ecbp1100FutureTime(header); err != nil {
+		return err
+	}
+	current := bc.hc.CurrentHeader()
+	if header.ParentHash == current.Hash() || !bc.IsArtificialFinalityEnabled() ||
+		!bc.Config().IsEnabled(bc.Config().GetECBP1100Transition, current.Number) {
+		return nil
+	}
+	// Unknown parents are left to the header chain to handle.
+	parent := bc.GetHeader(header.ParentHash, header.Number.Uint64()-1)
+	if parent == nil {
+		return nil
+	}
+	ptd := bc.GetTd(parent.Hash(), parent.Number.Uint64())
+	if ptd == nil {
+		return nil
+	}
+	// Only (potential) reorgs are subject to artificial finality, ties included.
+	externTd := new(big.Int).Add(ptd, header.Difficulty)
+	if externTd.Cmp(bc.GetTd(current.Hash(), current.Number.Uint64())) < 0 {
+		return nil
+	}
+	commonAncestor := rawdb.FindCommonAncestor(bc.db, parent, current)
+	if commonAncestor == nil {
+		return nil
+	}
+	return bc.ecbp1100(commonAncestor, current, header)
+}
+
+// ecbp1100Block applies ECBP1100 to a block about to be inserted, before it is
+// written, using block total difficulties. It returns an error if the block would
+// reorganize the chain in a way artificial finality rejects, and nil if the block
+// extends the current head, is lighter than it, or if artificial finality is
+// disabled or not yet activated. It has no side effects: the decision is neither
+// metered, posted, handed to the reject handler nor persisted.
+func (bc *BlockChain) ecbp1100Block(block *types.Block) error {
+	commonAncestor, current, td := bc.ecbp1100BlockInputs(block)
+	if commonAncestor == nil {
+		return nil
+	}
+	return bc.ecbp1100TD(commonAncestor, current, block.Header(), td)
+}
+
+// ecbp1100BlockInputs returns the common ancestor of a block about to be inserted
+// with the current head, the current head and the total difficulty of the block, or
+// nils if the block is not subject to artificial finality, see ecbp1100Block.
+func (bc *BlockChain) ecbp1100BlockInputs(block *types.Block) (*types.Header, *types.Header, *big.Int) {
+	current := bc.CurrentBlock()
+	if block.ParentHash() == current.Hash() || !bc.IsArtificialFinalityEnabled() ||
+		!bc.Config().IsEnabled(bc.Config().GetECBP1100Transition, current.Number()) {
+		return nil, nil, nil
+	}
+	// Unknown parents are left to the block import to handle.
+	parent := bc.GetHeader(block.ParentHash(), block.NumberU64()-1)
+	if parent == nil {
+		return nil, nil, nil
+	}
+	ptd := bc.GetTd(parent.Hash(), parent.Number.Uint64())
+	if ptd == nil {
+		return nil, nil, nil
+	}
+	// Only (potential) reorgs are subject to artificial finality. Ties are too, as the
+	// tie policy or the header chain may reorg to them, like ecbp1100Header does.
+	externTd := new(big.Int).Add(ptd, block.Difficulty())
+	if externTd.Cmp(bc.GetTd(current.Hash(), current.NumberU64())) < 0 {
+		return nil, nil, nil
+	}
+	commonAncestor := rawdb.FindCommonAncestor(bc.db, parent, current.Header())
+	if commonAncestor == nil {
+		return nil, nil, nil
+	}
+	return commonAncestor, current.Header(), externTd
+}
+
+// ecbp1100Stop checks a block about to be inserted, at index of the inserted batch,
+// under the ArtificialFinalityRejectStop policy. It returns an *ArtificialFinalityStopError
+// stopping the insertion before the block if artificial finality rejects it, and nil
+// under the other policies. Only rejections are recorded as decisions, the blocks
+// accepted are decided on as usual once written.
+func (bc *BlockChain) ecbp1100Stop(index int, block *types.Block) error {
+	if bc.ArtificialFinalityRejectPolicy() != ArtificialFinalityRejectStop {
+		return nil
+	}
+	if bc.ecbp1100Block(block) == nil {
+		return nil
+	}
+	// Rejected, record the decision, which the stall watchdog may still override
+	commonAncestor, current, _ := bc.ecbp1100BlockInputs(block)
+	err := bc.ecbp1100(commonAncestor, current, block.Header())
+	if err == nil {
+		return nil
+	}
+	log.Warn("Reorg disallowed, stopping insertion", "number", block.Number(), "hash", block.Hash(), "trace", ArtificialFinalityTraceID(err), "error", err)
+	return &ArtificialFinalityStopError{Index: index, Number: block.NumberU64(), Hash: block.Hash(), Err: err}
+}
+
+// ArtificialFinalityCurve holds the ECBP1100 inputs of a proposed chain segment
+// competing with the current one, by depth above their common ancestor. Item i of
+// every slice is for depth i+1, up to the proposed head.
+type ArtificialFinalityCurve struct {
+	Numbers     []uint64   // Block numbers
+	CurrentTDs  []*big.Int // Total difficulties of the current segment, nil beyond its head
+	ProposedTDs []*big.Int // Total difficulties of the proposed segment
+	TDRatios    []float64  // Total difficulty ratios of the proposed over the current segment
+	Thresholds  []float64  // Antigravity thresholds at the time span of the proposed blocks
+}
+
+// ArtificialFinalityCurve returns the total difficulties, total difficulty ratios and
+// antigravity thresholds of the proposed segment competing with the current one, both
+// descending from the common ancestor. Ratios are taken against the whole current
+// segment, as ECBP1100 does; thresholds are the antigravity curve evaluated at the time
+// span between the ancestor and each proposed block.
+func (bc *BlockChain) ArtificialFinalityCurve(commonAncestor, current, proposed common.Hash) (*ArtificialFinalityCurve, error) {
+	ancestor := bc.GetHeaderByHash(commonAncestor)
+	if ancestor == nil {
+		return nil, fmt.Errorf("common ancestor %x not found", commonAncestor)
+	}
+	// segment returns the headers descending from the ancestor up to head, oldest first.
+	segment := func(head common.Hash) ([]*types.Header, error) {
+		header := bc.GetHeaderByHash(head)
+		if header == nil {
+			return nil, fmt.Errorf("head %x not found", head)
+		}
+		if header.Number.Cmp(ancestor.Number) <= 0 {
+			return nil, fmt.Errorf("head %x #%d not above common ancestor #%d", head, header.Number, ancestor.Number)
+		}
+		headers := make([]*types.Header, header.Number.Uint64()-ancestor.Number.Uint64())
+		for i := len(headers) - 1; i >= 0; i-- {
+			if header == nil {
+				return nil, fmt.Errorf("head %x: missing ancestor #%d", head, ancestor.Number.Uint64()+uint64(i)+1)
+			}
+			headers[i] = header
+			header = bc.GetHeader(header.ParentHash, header.Number.Uint64()-1)
+		}
+		if header == nil || header.Hash() != commonAncestor {
+			return nil, fmt.Errorf("head %x does not descend from %x", head, commonAncestor)
+		}
+		return headers, nil
+	}
+	currents, err := segment(current)
+	if err != nil {
+		return nil, err
+	}
+	proposeds, err := segment(proposed)
+	if err != nil {
+		return nil, err
+	}
+	curve := &ArtificialFinalityCurve{
+		Numbers:     make([]uint64, len(proposeds)),
+		CurrentTDs:  make([]*big.Int, len(proposeds)),
+		ProposedTDs: make([]*big.Int, len(proposeds)),
+		TDRatios:    make([]float64, len(proposeds)),
+		Thresholds:  make([]float64, len(proposeds)),
+	}
+	head := currents[len(currents)-1]
+	for i, header := range proposeds {
+		curve.Numbers[i] = header.Number.Uint64()
+		if i < len(currents) {
+			curve.CurrentTDs[i] = bc.GetTd(currents[i].Hash(), currents[i].Number.Uint64())
+		}
+		curve.ProposedTDs[i] = bc.GetTd(header.Hash(), header.Number.Uint64())
+		curve.TDRatios[i] = bc.getTDRatio(ancestor, head, header)
+		curve.Thresholds[i], _ = new(big.Float).Quo(
+			new(big.Float).SetInt(ecbp1100PolynomialV(bc.ecbp1100Input(ancestor, header))),
+			new(big.Float).SetInt(ecbp1100PolynomialVCurveFunctionDenominator),
+		).Float64()
+	}
+	return curve, nil
+}
+
+// ArtificialFinalityBoundary returns the decision boundary of ECBP1100 for a proposed
+// segment of the given length, in blocks: the smallest time delta, in seconds, between
+// the common ancestor and the current head at which the segment is rejected. The
+// boundary is computed analytically, assuming blocks of equal difficulty on both
+// segments, and a current segment of a block every blockTime seconds. Proposed
+// segments of a current segment spanning less time are accepted.
+func ArtificialFinalityBoundary(segmentLen, blockTime uint64) uint64 {
+	if blockTime == 0 {
+		return 0
+	}
+	// rejected returns whether the segment is rejected at the time delta, ie. its TD
+	// falls short of the antigravity threshold over the current segment's TD. The
+	// threshold grows with the time delta, so does the current segment.
+	proposed := new(big.Int).Mul(new(big.Int).SetUint64(segmentLen), ecbp1100PolynomialVCurveFunctionDenominator)
+	rejected := func(delta uint64) bool {
+		current := new(big.Int).SetUint64(delta / blockTime)
+		want := current.Mul(current, ecbp1100PolynomialV(new(big.Int).SetUint64(delta)))
+		return proposed.Cmp(want) < 0
+	}
+	// A current segment of more blocks than the proposed one is rejected regardless.
+	lo, hi := uint64(0), (segmentLen+1)*blockTime
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if rejected(mid) {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return lo
+}
+
+// WriteArtificialFinalityBoundaryCSV writes the decision boundary of ECBP1100, see
+// ArtificialFinalityBoundary, for the segment lengths from and up to to (inclusive)
+// as CSV to w: a "segmentLen,minTimeDelta" header, followed by a row per length.
+func WriteArtificialFinalityBoundaryCSV(w io.Writer, from, to, blockTime uint64) error {
+	if from > to {
+		return fmt.Errorf("invalid segment lengths %d-%d", from, to)
+	}
+	out := csv.NewWriter(w)
+	if err := out.Write([]string{"segmentLen", "minTimeDelta"}); err != nil {
+		return err
+	}
+	for length := from; length <= to; length++ {
+		row := []string{strconv.FormatUint(length, 10), strconv.FormatUint(ArtificialFinalityBoundary(length, blockTime), 10)}
+		if err := out.Write(row); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// SimulateInsert predicts the outcome of inserting the given contiguous blocks, without
+// writing them or changing the canonical chain. The blocks are verified and executed on
+// top of the state of the first block's parent, and each is then arbitrated against the
+// canonical head as InsertChain would, including ECBP1100. If the parent state has been
+// pruned the blocks are not executed, like InsertChain does for such side chains until
+// they outweigh the canonical chain.
+//
+// wouldBeHead reports whether the last block would become the head, messAccept whether
+// artificial finality would allow every reorganization the blocks cause. Equal total
+// difficulty at equal heights, settled randomly on insertion, is predicted not to reorg,
+// unless artificial finality is active, which settles ties by its tie policy.
+// Validation failures are returned as an error.
+func (bc *BlockChain) SimulateInsert(blocks types.Blocks) (wouldBeHead bool, messAccept bool, err error) {
+	if len(blocks) == 0 {
+		return false, true, nil
+	}
+	for i := 1; i < len(blocks); i++ {
+		if blocks[i].NumberU64() != blocks[i-1].NumberU64()+1 || blocks[i].ParentHash() != blocks[i-1].Hash() {
+			return false, false, fmt.Errorf("non contiguous blocks: item %d is #%d [%x…], item %d is #%d [%x…] (parent [%x…])", i-1, blocks[i-1].NumberU64(),
+				blocks[i-1].Hash().Bytes()[:4], i, blocks[i].NumberU64(), blocks[i].Hash().Bytes()[:4], blocks[i].ParentHash().Bytes()[:4])
+		}
+	}
+	bc.chainmu.RLock()
+	defer bc.chainmu.RUnlock()
+
+	first := blocks[0]
+	parent := bc.GetBlock(first.ParentHash(), first.NumberU64()-1)
+	if parent == nil {
+		return false, false, consensus.ErrUnknownAncestor
+	}
+	var statedb *state.StateDB
+	if bc.HasState(parent.Root()) {
+		if statedb, err = state.New(parent.Root(), bc.stateCache, bc.snaps); err != nil {
+			return false, false, err
+		}
+	}
+	var (
+		current        = bc.CurrentBlock()
+		localTd        = bc.GetTd(current.Hash(), current.NumberU64())
+		externTd       = new(big.Int).Set(bc.GetTd(parent.Hash(), parent.NumberU64()))
+		commonAncestor = rawdb.FindCommonAncestor(bc.db, parent.Header(), current.Header())
+		head           = current
+		artificial     = bc.IsArtificialFinalityEnabled() &&
+			bc.Config().IsEnabled(bc.Config().GetECBP1100Transition, current.Number())
+	)
+	headers := make([]*types.Header, len(blocks))
+	seals := make([]bool, len(blocks))
+	for i, block := range blocks {
+		headers[i] = block.Header()
+		seals[i] = true
+	}
+	abort, results := bc.engine.VerifyHeaders(bc, headers, seals)
+	defer close(abort)
+
+	messAccept = true
+	for _, block := range blocks {
+		if err := <-results; err != nil {
+			return false, messAccept, err
+		}
+		if BadHashes[block.Hash()] {
+			return false, messAccept, ErrBlacklistedHash
+		}
+		if err := bc.ecbp1100FutureTime(block.Header()); err != nil {
+			return false, messAccept, err
+		}
+		// The validator requires parents to be stored, check the body directly.
+		if err := bc.engine.VerifyUncles(bc, block); err != nil {
+			return false, messAccept, err
+		}
+		if hash := types.CalcUncleHash(block.Uncles()); hash != block.UncleHash() {
+			return false, messAccept, fmt.Errorf("uncle root hash mismatch: have %x, want %x", hash, block.UncleHash())
+		}
+		if hash := types.DeriveSha(block.Transactions(), trie.NewStackTrie(nil)); hash != block.TxHash() {
+			return false, messAccept, fmt.Errorf("transaction root hash mismatch: have %x, want %x", hash, block.TxHash())
+		}
+		if statedb != nil {
+			receipts, _, usedGas, err := bc.processor.Process(block, statedb, bc.vmConfig)
+			if err != nil {
+				return false, messAccept, err
+			}
+			if err := bc.validator.ValidateState(block, statedb, receipts, usedGas); err != nil {
+				return false, messAccept, err
+			}
+		}
+		externTd.Add(externTd, block.Difficulty())
+
+		// Arbitrate against the (simulated) head, see writeBlockWithState.
+		reorg := externTd.Cmp(localTd) > 0
+		if !reorg && externTd.Cmp(localTd) == 0 {
+			if artificial {
+				var err error
+				if reorg, err = bc.artificialFinalityTie(head, block); err != nil {
+					return false, false, nil
+				}
+			} else {
+				reorg = block.NumberU64() < head.NumberU64()
+			}
+		}
+		if !reorg {
+			continue
+		}
+		if block.ParentHash() != head.Hash() && artificial && commonAncestor != nil {
+			if err := bc.ecbp1100TD(commonAncestor, head.Header(), block.Header(), externTd); err != nil {
+				messAccept = false
+				if bc.ArtificialFinalityRejectPolicy() != ArtificialFinalityRejectSidechain {
+					return false, messAccept, nil
+				}
+				continue
+			}
+		}
+		head, localTd = block, new(big.Int).Set(externTd)
+	}
+	return head.Hash() == blocks[len(blocks)-1].Hash(), messAccept, nil
+}
+
 /*
 ecbp1100PolynomialV is a cubic function that looks a lot like Option 3's sin function,
 but adds the benefit that the calculation can be done with integers (instead of yucky floating points).
@@ -0,0 +1,139 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// ArtificialFinalityAuditFinding is a reorg of the canonical chain artificial finality
+// would reject under the current settings, found by AuditCanonicalUnderMESS.
+type ArtificialFinalityAuditFinding struct {
+	Reorg ReorgRecord // Reorg which made the segment canonical
+	Err   error       // Rejection of the segment by artificial finality
+}
+
+// ArtificialFinalityAudit is the report of AuditCanonicalUnderMESS.
+type ArtificialFinalityAudit struct {
+	From, To uint64 // Range of canonical blocks audited (inclusive)
+	Checked  int    // Number of reorgs re-evaluated
+	Skipped  int    // Number of reorgs whose blocks are no longer available
+
+	Findings []ArtificialFinalityAuditFinding // Reorgs artificial finality would reject
+}
+
+// Audited reports whether any reorg was re-evaluated.
+func (a *ArtificialFinalityAudit) Audited() bool {
+	return a.Checked > 0
+}
+
+// Consistent reports whether artificial finality would accept every canonical
+// segment audited. An audit which re-evaluated no reorg is not consistent, as
+// nothing was audited.
+func (a *ArtificialFinalityAudit) Consistent() bool {
+	return a.Audited() && len(a.Findings) == 0
+}
+
+// AuditCanonicalUnderMESS re-evaluates the artificial finality (ECBP1100-MESS) decision
+// of every known reorg point which made canonical a segment of blocks from and up to
+// to, under the current artificial finality settings. A reorg artificial finality
+// would reject now is reported as a finding: a canonical block the node would not
+// accept anymore.
+//
+// The reorg points are those of the accepted artificial finality decisions persisted
+// to the database (see SetArtificialFinalityPersist), along with the reorgs of the
+// reorg history since startup (see RecentReorgs); the segments of rejected reorgs are
+// audited only if they became canonical since.
+//
+// The audit is read-only: decisions are not metered, posted, handed to the reject
+// handler nor persisted, and the chain is not modified. Artificial finality is
+// evaluated whether it's enabled or not, from its activation block on.
+func (bc *BlockChain) AuditCanonicalUnderMESS(from, to uint64) (*ArtificialFinalityAudit, error) {
+	if from > to {
+		return nil, fmt.Errorf("invalid audit range #%d-#%d", from, to)
+	}
+	audit := &ArtificialFinalityAudit{From: from, To: to}
+	for _, reorg := range bc.auditedReorgs() {
+		var (
+			ancestor = bc.GetHeaderByHash(reorg.CommonAncestor)
+			current  = bc.GetHeaderByHash(reorg.OldHead)
+			proposed = bc.GetHeaderByHash(reorg.NewHead)
+		)
+		if ancestor == nil || current == nil || proposed == nil {
+			audit.Skipped++
+			continue
+		}
+		// Only segments of the canonical chain within the range are audited
+		number := proposed.Number.Uint64()
+		if reorg.CommonNumber >= to || number < from || bc.GetCanonicalHash(number) != reorg.NewHead {
+			continue
+		}
+		if !bc.Config().IsEnabled(bc.Config().GetECBP1100Transition, current.Number) {
+			continue
+		}
+		td := bc.GetTd(reorg.NewHead, number)
+		if td == nil || bc.GetTd(reorg.CommonAncestor, reorg.CommonNumber) == nil || bc.GetTd(reorg.OldHead, current.Number.Uint64()) == nil {
+			audit.Skipped++
+			continue
+		}
+		audit.Checked++
+		if err := bc.ecbp1100TD(ancestor, current, proposed, td); err != nil {
+			audit.Findings = append(audit.Findings, ArtificialFinalityAuditFinding{Reorg: reorg, Err: err})
+		}
+	}
+	if !audit.Audited() {
+		log.Warn("No reorg to audit under ECBP1100-MESS", "from", from, "to", to, "skipped", audit.Skipped)
+		return audit, nil
+	}
+	log.Info("Audited canonical chain under ECBP1100-MESS", "from", from, "to", to,
+		"checked", audit.Checked, "skipped", audit.Skipped, "findings", len(audit.Findings))
+	return audit, nil
+}
+
+// auditedReorgs returns the reorg points known to the node: the ones of the accepted
+// artificial finality decisions persisted to the database, followed by the ones of the
+// reorg history not among them.
+func (bc *BlockChain) auditedReorgs() []ReorgRecord {
+	type reorgKey struct{ ancestor, old, new common.Hash }
+
+	var (
+		reorgs []ReorgRecord
+		known  = make(map[reorgKey]bool)
+	)
+	for _, d := range rawdb.ReadArtificialFinalityDecisions(bc.db, 0, math.MaxUint64) {
+		// Decisions of older versions lack the local segment, they can't be re-evaluated
+		if !d.Accepted || d.Current == (common.Hash{}) {
+			continue
+		}
+		key := reorgKey{d.Ancestor, d.Current, d.Proposed}
+		if known[key] {
+			continue
+		}
+		known[key] = true
+
+		reorg := ReorgRecord{
+			Time:               time.Unix(int64(d.Time), 0),
+			CommonAncestor:     d.Ancestor,
+			CommonNumber:       d.AncestorNumber,
+			OldHead:            d.Current,
+			NewHead:            d.Proposed,
+			Added:              int(d.SegmentLength),
+			ArtificialFinality: true,
+		}
+		if current := bc.GetHeaderByHash(d.Current); current != nil && current.Number.Uint64() >= d.AncestorNumber {
+			reorg.Depth = current.Number.Uint64() - d.AncestorNumber
+			reorg.Removed = int(reorg.Depth)
+		}
+		reorgs = append(reorgs, reorg)
+	}
+	for _, reorg := range bc.RecentReorgs() {
+		if !known[reorgKey{reorg.CommonAncestor, reorg.OldHead, reorg.NewHead}] {
+			reorgs = append(reorgs, reorg)
+		}
+	}
+	return reorgs
+}
@@ -0,0 +1,144 @@
+package core
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// newAuditTestChain returns a chain of 500 blocks with artificial finality enabled
+// if af and its decisions persisted, along with a heavier fork of 250 blocks from #250
+// which artificial finality rejects, and the database of their states.
+func newAuditTestChain(t *testing.T, af bool) (*BlockChain, ethdb.Database, []*types.Block, []*types.Block) {
+	engine := ethash.NewFaker()
+	genesis := params.DefaultMessNetGenesisBlock()
+
+	gendb := rawdb.NewMemoryDatabase()
+	genesisB := MustCommitGenesis(gendb, genesis)
+	easy, _ := GenerateChain(genesis.Config, genesisB, engine, gendb, 500, nil)
+	hard, _ := GenerateChain(genesis.Config, easy[249], engine, gendb, 250, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x01}) // Don't share states with the easy chain
+		b.OffsetTime(-9)
+	})
+	db := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(db, genesis)
+	chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.EnableArtificialFinality(af)
+	chain.SetArtificialFinalityRejectPolicy(ArtificialFinalityRejectError)
+	chain.SetArtificialFinalityPersist(true)
+
+	if n, err := chain.InsertChain(easy); err != nil {
+		chain.Stop()
+		t.Fatalf("failed to insert block %d: %v", n, err)
+	}
+	return chain, gendb, easy, hard
+}
+
+// Tests that the audit of a canonical chain built under artificial finality, through
+// accepted reorgs and a rejected one, is clean.
+func TestAuditCanonicalUnderMESS(t *testing.T) {
+	chain, gendb, easy, hard := newAuditTestChain(t, true)
+	defer chain.Stop()
+
+	// Short forks off the head are accepted
+	parent := easy[len(easy)-3]
+	for i := 0; i < 3; i++ {
+		fork, _ := GenerateChain(chain.Config(), parent, chain.engine, gendb, 6, func(j int, b *BlockGen) {
+			b.SetCoinbase(common.Address{0x02, byte(i)})
+		})
+		if n, err := chain.InsertChain(fork); err != nil {
+			t.Fatalf("fork %d: failed to insert block %d: %v", i, n, err)
+		}
+		parent = fork[4]
+	}
+	// The long fork is rejected
+	if _, err := chain.InsertChain(hard); !errors.Is(err, ErrArtificialFinalityReject) {
+		t.Fatalf("want %v, got %v", ErrArtificialFinalityReject, err)
+	}
+	var accepted, rejected int
+	for _, reorg := range chain.RecentReorgs() {
+		if reorg.Rejected {
+			rejected++
+		} else {
+			accepted++
+		}
+	}
+	if accepted != 3 || rejected == 0 {
+		t.Fatalf("reorgs: have %d accepted and %d rejected, want 3 and some", accepted, rejected)
+	}
+	audit, err := chain.AuditCanonicalUnderMESS(0, chain.CurrentBlock().NumberU64())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !audit.Consistent() {
+		t.Errorf("canonical chain inconsistent: %v", audit.Findings[0].Err)
+	}
+	if audit.Checked != 3 || audit.Skipped != 0 {
+		t.Errorf("reorgs audited: have %d checked and %d skipped, want 3 and 0", audit.Checked, audit.Skipped)
+	}
+	// Reorgs below the range are not audited, which is not consistent
+	if audit, err := chain.AuditCanonicalUnderMESS(0, 400); err != nil || audit.Checked != 0 {
+		t.Errorf("audit below the reorgs: have %d checked (err %v), want 0", audit.Checked, err)
+	} else if audit.Audited() || audit.Consistent() {
+		t.Errorf("audit below the reorgs: audited %v, consistent %v, want neither", audit.Audited(), audit.Consistent())
+	}
+	if _, err := chain.AuditCanonicalUnderMESS(10, 9); err == nil {
+		t.Errorf("invalid range audited")
+	}
+	// The reorgs are audited from the persisted decisions after a restart
+	chain.Stop()
+	chain, err = NewBlockChain(chain.db, nil, chain.Config(), chain.engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+
+	if len(chain.RecentReorgs()) != 0 {
+		t.Fatalf("reorg history kept across restarts")
+	}
+	audit, err = chain.AuditCanonicalUnderMESS(0, chain.CurrentBlock().NumberU64())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !audit.Consistent() || audit.Checked != 3 || audit.Skipped != 0 {
+		t.Errorf("reorgs audited after restart: have %d checked, %d skipped and %d findings, want 3, 0 and 0", audit.Checked, audit.Skipped, len(audit.Findings))
+	}
+}
+
+// Tests that a reorg made without artificial finality, which it would reject, is
+// reported by the audit.
+func TestAuditCanonicalUnderMESSInconsistent(t *testing.T) {
+	chain, _, easy, hard := newAuditTestChain(t, false)
+	defer chain.Stop()
+
+	if n, err := chain.InsertChain(hard); err != nil {
+		t.Fatalf("failed to insert block %d: %v", n, err)
+	}
+	if chain.CurrentBlock().Hash() != hard[len(hard)-1].Hash() {
+		t.Fatalf("fork not canonical")
+	}
+	audit, err := chain.AuditCanonicalUnderMESS(0, chain.CurrentBlock().NumberU64())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(audit.Findings) != 1 {
+		t.Fatalf("findings: have %d, want 1", len(audit.Findings))
+	}
+	finding := audit.Findings[0]
+	if !errors.Is(finding.Err, ErrArtificialFinalityReject) {
+		t.Errorf("finding error: want %v, got %v", ErrArtificialFinalityReject, finding.Err)
+	}
+	if finding.Reorg.CommonAncestor != easy[249].Hash() || finding.Reorg.OldHead != easy[499].Hash() {
+		t.Errorf("finding of the wrong reorg: %+v", finding.Reorg)
+	}
+}
@@ -1,12 +1,22 @@
 package core
 
 import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"image/color"
+	"io"
 	"log"
 	"math"
 	"math/big"
 	"math/rand"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -15,7 +25,11 @@ import (
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/core/vm"
+	gethlog "github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/metrics/prometheus"
 	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/params/types/genesisT"
 	"gonum.org/v1/plot"
 	"gonum.org/v1/plot/plotter"
 	"gonum.org/v1/plot/vg"
@@ -242,6 +256,447 @@ func TestAFKnownBlock(t *testing.T) {
 	}
 }
 
+// TestBlockChain_AF_ECBP1100_RejectErrorMessage tests that the error returned for
+// a MESS-rejected segment describes the numbers the decision was made with.
+// The chain shapes are taken from a rejected case of the TestBlockChain_AF_ECBP1100 matrix.
+func TestBlockChain_AF_ECBP1100_RejectErrorMessage(t *testing.T) {
+	engine := ethash.NewFaker()
+
+	db := rawdb.NewMemoryDatabase()
+	genesis := params.DefaultMessNetGenesisBlock()
+	genesisB := MustCommitGenesis(db, genesis)
+
+	chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+	chain.EnableArtificialFinality(true)
+
+	easy, _ := GenerateChain(genesis.Config, genesisB, engine, db, 500, func(i int, b *BlockGen) {
+		b.SetNonce(types.EncodeNonce(uint64(rand.Int63n(math.MaxInt64))))
+	})
+	commonAncestor := easy[249]
+	hard, _ := GenerateChain(genesis.Config, commonAncestor, engine, db, 250, func(i int, b *BlockGen) {
+		b.SetNonce(types.EncodeNonce(uint64(rand.Int63n(math.MaxInt64))))
+		b.OffsetTime(-9)
+	})
+	if _, err := chain.InsertChain(easy); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.InsertChain(hard); err != nil {
+		t.Fatal(err)
+	}
+	if chain.CurrentBlock().Hash() != easy[len(easy)-1].Hash() {
+		t.Fatal("hard chain got head, want MESS rejection")
+	}
+
+	current, proposed := chain.CurrentHeader(), hard[len(hard)-1].Header()
+	err = chain.ecbp1100(commonAncestor.Header(), current, proposed)
+	if !errors.Is(err, ErrArtificialFinalityReject) {
+		t.Fatalf("want: %v, got: %v", ErrArtificialFinalityReject, err)
+	}
+
+	threshold, _ := new(big.Float).Quo(
+		new(big.Float).SetInt(ecbp1100PolynomialV(big.NewInt(int64(current.Time-commonAncestor.Time())))),
+		new(big.Float).SetInt(ecbp1100PolynomialVCurveFunctionDenominator),
+	).Float64()
+
+	for _, want := range []string{
+		fmt.Sprintf("common.bno=%d", commonAncestor.NumberU64()),
+		fmt.Sprintf("segment.len=%d", len(hard)),
+		fmt.Sprintf("tdr=%0.6f", chain.getTDRatio(commonAncestor.Header(), current, proposed)),
+		fmt.Sprintf("threshold=%0.6f", threshold),
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error message missing %q: %v", want, err)
+		}
+	}
+}
+
+// TestBlockChain_AF_ECBP1100_PersistDecisions tests that MESS decisions are persisted
+// to the database and survive a restart of the chain.
+func TestBlockChain_AF_ECBP1100_PersistDecisions(t *testing.T) {
+	engine := ethash.NewFaker()
+
+	db := rawdb.NewMemoryDatabase()
+	genesis := params.DefaultMessNetGenesisBlock()
+	genesisB := MustCommitGenesis(db, genesis)
+
+	chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.EnableArtificialFinality(true)
+	chain.SetArtificialFinalityPersist(true)
+
+	easy, _ := GenerateChain(genesis.Config, genesisB, engine, db, 500, func(i int, b *BlockGen) {
+		b.SetNonce(types.EncodeNonce(uint64(rand.Int63n(math.MaxInt64))))
+	})
+	commonAncestor := easy[249]
+	hard, _ := GenerateChain(genesis.Config, commonAncestor, engine, db, 250, func(i int, b *BlockGen) {
+		b.SetNonce(types.EncodeNonce(uint64(rand.Int63n(math.MaxInt64))))
+		b.OffsetTime(-9)
+	})
+	if _, err := chain.InsertChain(easy); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.InsertChain(hard); err != nil {
+		t.Fatal(err)
+	}
+	if chain.CurrentBlock().Hash() != easy[len(easy)-1].Hash() {
+		t.Fatal("hard chain got head, want MESS rejection")
+	}
+	now := uint64(chain.now().Unix())
+	chain.Stop()
+
+	chain, err = NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+
+	decisions := rawdb.ReadArtificialFinalityDecisions(db, 0, math.MaxUint64)
+	if len(decisions) == 0 {
+		t.Fatal("no decisions persisted")
+	}
+	proposed := make(map[common.Hash]uint64)
+	for i, block := range hard {
+		proposed[block.Hash()] = uint64(i + 1)
+	}
+	for _, d := range decisions {
+		if d.Accepted {
+			t.Errorf("decision for %x accepted, want rejected", d.Proposed)
+		}
+		if d.Ancestor != commonAncestor.Hash() || d.AncestorNumber != commonAncestor.NumberU64() {
+			t.Errorf("ancestor mismatch: have #%d [%x], want #%d [%x]", d.AncestorNumber, d.Ancestor, commonAncestor.NumberU64(), commonAncestor.Hash())
+		}
+		if length, ok := proposed[d.Proposed]; !ok || d.SegmentLength != length {
+			t.Errorf("segment length of %x: have %d, want %d", d.Proposed, d.SegmentLength, length)
+		}
+		if d.Ratio >= d.Threshold {
+			t.Errorf("rejected with ratio %f >= threshold %f", d.Ratio, d.Threshold)
+		}
+		if d.Time > now {
+			t.Errorf("decision time %d after %d", d.Time, now)
+		}
+	}
+	if decisions := rawdb.ReadArtificialFinalityDecisions(db, now+1, math.MaxUint64); len(decisions) != 0 {
+		t.Errorf("decisions after %d: have %d, want 0", now, len(decisions))
+	}
+}
+
+// TestBlockChain_AF_ECBP1100_DecisionFor tests that persisted MESS decisions can be
+// looked up by any block of the rejected segment.
+func TestBlockChain_AF_ECBP1100_DecisionFor(t *testing.T) {
+	engine := ethash.NewFaker()
+
+	db := rawdb.NewMemoryDatabase()
+	genesis := params.DefaultMessNetGenesisBlock()
+	genesisB := MustCommitGenesis(db, genesis)
+
+	chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+	chain.EnableArtificialFinality(true)
+	chain.SetArtificialFinalityPersist(true)
+
+	easy, _ := GenerateChain(genesis.Config, genesisB, engine, db, 500, func(i int, b *BlockGen) {
+		b.SetNonce(types.EncodeNonce(uint64(rand.Int63n(math.MaxInt64))))
+	})
+	commonAncestor := easy[249]
+	hard, _ := GenerateChain(genesis.Config, commonAncestor, engine, db, 250, func(i int, b *BlockGen) {
+		b.SetNonce(types.EncodeNonce(uint64(rand.Int63n(math.MaxInt64))))
+		b.OffsetTime(-9)
+	})
+	if _, err := chain.InsertChain(easy); err != nil {
+		t.Fatal(err)
+	}
+	if chain.ArtificialFinalityDecisionFor(easy[300].Hash()) != nil {
+		t.Fatal("decision found before any reorg")
+	}
+	if _, err := chain.InsertChain(hard); err != nil {
+		t.Fatal(err)
+	}
+	if chain.CurrentBlock().Hash() != easy[len(easy)-1].Hash() {
+		t.Fatal("hard chain got head, want MESS rejection")
+	}
+	// The first blocks of the rejected segment are too light to be evaluated themselves,
+	// the decision about their descendants involves them nonetheless.
+	for _, block := range []*types.Block{hard[0], hard[len(hard)/2], hard[len(hard)-1]} {
+		d := chain.ArtificialFinalityDecisionFor(block.Hash())
+		if d == nil {
+			t.Fatalf("no decision for #%d [%x]", block.NumberU64(), block.Hash())
+		}
+		if d.Accepted {
+			t.Errorf("decision for #%d accepted, want rejected", block.NumberU64())
+		}
+		if d.Ancestor != commonAncestor.Hash() {
+			t.Errorf("decision for #%d: ancestor mismatch: have %x, want %x", block.NumberU64(), d.Ancestor, commonAncestor.Hash())
+		}
+		if d.AncestorNumber+d.SegmentLength < block.NumberU64() {
+			t.Errorf("decision for #%d about segment up to #%d", block.NumberU64(), d.AncestorNumber+d.SegmentLength)
+		}
+	}
+	if d := chain.ArtificialFinalityDecisionFor(hard[len(hard)-1].Hash()); d.Proposed != hard[len(hard)-1].Hash() {
+		t.Errorf("decision for the segment head about %x", d.Proposed)
+	}
+	// Blocks outside the segments are not involved.
+	for _, block := range []*types.Block{easy[100], commonAncestor} {
+		if d := chain.ArtificialFinalityDecisionFor(block.Hash()); d != nil {
+			t.Errorf("decision for #%d outside the segment: %+v", block.NumberU64(), d)
+		}
+	}
+	if d := chain.ArtificialFinalityDecisionFor(common.Hash{0xff}); d != nil {
+		t.Errorf("decision for unknown block: %+v", d)
+	}
+}
+
+func TestBlockChain_IsEffectivelyFinal(t *testing.T) {
+	engine := ethash.NewFaker()
+
+	db := rawdb.NewMemoryDatabase()
+	genesis := params.DefaultMessNetGenesisBlock()
+	genesisB := MustCommitGenesis(db, genesis)
+
+	chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+
+	blocks, _ := GenerateChain(genesis.Config, genesisB, engine, db, 500, nil)
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatal(err)
+	}
+	deep, shallow := blocks[99].Hash(), blocks[489].Hash()
+
+	if chain.IsEffectivelyFinal(deep) {
+		t.Fatal("deep block final with artificial finality disabled")
+	}
+	chain.EnableArtificialFinality(true)
+	if !chain.IsEffectivelyFinal(deep) {
+		t.Error("deep block not final")
+	}
+	if chain.IsEffectivelyFinal(shallow) {
+		t.Error("shallow block final")
+	}
+	if chain.IsEffectivelyFinal(common.Hash{0x1}) {
+		t.Error("unknown block final")
+	}
+}
+
+// Tests that the total difficulty required to reorg the chain grows with the depth,
+// and that artificial finality raises it above the displaced segment's.
+func TestBlockChain_ReorgDifficultyRequirement(t *testing.T) {
+	engine := ethash.NewFaker()
+
+	db := rawdb.NewMemoryDatabase()
+	genesis := params.DefaultMessNetGenesisBlock()
+	genesisB := MustCommitGenesis(db, genesis)
+
+	chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+
+	// Space the blocks apart for the antigravity threshold to rise within the chain.
+	blocks, _ := GenerateChain(genesis.Config, genesisB, engine, db, 40, func(i int, b *BlockGen) {
+		b.OffsetTime(600)
+	})
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatal(err)
+	}
+	head := blocks[len(blocks)-1]
+	headTd := chain.GetTd(head.Hash(), head.NumberU64())
+
+	// local returns the total difficulty of the last depth blocks.
+	local := func(depth uint64) *big.Int {
+		ancestor := chain.GetHeaderByNumber(head.NumberU64() - depth)
+		return new(big.Int).Sub(headTd, chain.GetTd(ancestor.Hash(), ancestor.Number.Uint64()))
+	}
+	for depth := uint64(1); depth <= head.NumberU64(); depth++ {
+		if have, want := chain.ReorgDifficultyRequirement(depth), new(big.Int).Add(local(depth), common.Big1); have.Cmp(want) != 0 {
+			t.Fatalf("depth %d without artificial finality: have %v, want %v", depth, have, want)
+		}
+	}
+	chain.EnableArtificialFinality(true)
+
+	last := new(big.Int)
+	for depth := uint64(1); depth <= head.NumberU64(); depth++ {
+		have := chain.ReorgDifficultyRequirement(depth)
+		if have.Cmp(last) <= 0 {
+			t.Errorf("depth %d: requirement did not grow: have %v, previous %v", depth, have, last)
+		}
+		if have.Cmp(local(depth)) <= 0 {
+			t.Errorf("depth %d: requirement %v does not outweigh the displaced %v", depth, have, local(depth))
+		}
+		last = have
+	}
+	// Deep reorgs need a multiple of the displaced total difficulty.
+	if have, min := chain.ReorgDifficultyRequirement(30), new(big.Int).Mul(local(30), big.NewInt(2)); have.Cmp(min) < 0 {
+		t.Errorf("deep requirement %v below twice the displaced %v", have, local(30))
+	}
+	if req := chain.ReorgDifficultyRequirement(0); req != nil {
+		t.Errorf("requirement of no blocks: have %v, want nil", req)
+	}
+	if req := chain.ReorgDifficultyRequirement(head.NumberU64() + 1); req != nil {
+		t.Errorf("requirement beyond genesis: have %v, want nil", req)
+	}
+}
+
+func TestBlockChain_SubscribeFinalityConfirmation(t *testing.T) {
+	engine := ethash.NewFaker()
+
+	db := rawdb.NewMemoryDatabase()
+	genesis := params.DefaultMessNetGenesisBlock()
+	genesisB := MustCommitGenesis(db, genesis)
+
+	chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+	chain.EnableArtificialFinality(true)
+
+	blocks, _ := GenerateChain(genesis.Config, genesisB, engine, db, 500, nil)
+	if _, err := chain.InsertChain(blocks[:1]); err != nil {
+		t.Fatal(err)
+	}
+
+	// The shallow subscriptions are bound by finality, the deep one by depth. The
+	// greater safety factor confirms fewer blocks than the default one.
+	subs := []struct {
+		depth  uint64
+		factor *big.Int
+	}{{0, nil}, {290, nil}, {0, big.NewInt(3)}}
+	chans := make([]chan FinalityConfirmationEvent, len(subs))
+	for i, s := range subs {
+		chans[i] = make(chan FinalityConfirmationEvent, len(blocks))
+		sub := chain.SubscribeFinalityConfirmation(s.depth, s.factor, chans[i])
+		defer sub.Unsubscribe()
+	}
+	for i := 1; i < len(blocks); i++ {
+		if _, err := chain.InsertChain(blocks[i : i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	head := chain.CurrentBlock().NumberU64()
+
+	confirmed := make([]uint64, len(subs))
+	for i, s := range subs {
+		ratio := artificialFinalityPlausibleTDRatio
+		if s.factor != nil {
+			ratio = s.factor
+		}
+		// All blocks up to the deepest one not yet confirmed must have fired, in order.
+		want := uint64(1)
+		for ; chain.isFinalityConfirmed(want, head, s.depth, ratio); want++ {
+			select {
+			case ev := <-chans[i]:
+				if ev.Number != want || ev.Hash != blocks[want-1].Hash() {
+					t.Fatalf("sub %d: confirmation mismatch: have #%d [%x], want #%d [%x]", i, ev.Number, ev.Hash, want, blocks[want-1].Hash())
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("sub %d: timed out waiting for confirmation #%d", i, want)
+			}
+		}
+		if want == 1 {
+			t.Fatalf("sub %d: no blocks confirmed", i)
+		}
+		confirmed[i] = want - 1
+		if s.depth > 0 && head-want >= s.depth {
+			t.Errorf("sub %d: block #%d unconfirmed at depth %d", i, want, head-want)
+		}
+		if s.depth == 0 && chain.isEffectivelyFinal(blocks[want-1].Hash(), ratio) {
+			t.Errorf("sub %d: final block #%d unconfirmed", i, want)
+		}
+		select {
+		case ev := <-chans[i]:
+			t.Errorf("sub %d: unexpected confirmation #%d, head #%d", i, ev.Number, head)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	if confirmed[2] >= confirmed[0] {
+		t.Errorf("safety factor 3: have %d blocks confirmed, want fewer than the %d of the default", confirmed[2], confirmed[0])
+	}
+}
+
+func TestBlockChain_SubscribeEffectiveFinalityDepth(t *testing.T) {
+	engine := ethash.NewFaker()
+
+	db := rawdb.NewMemoryDatabase()
+	genesis := params.DefaultMessNetGenesisBlock()
+	genesisB := MustCommitGenesis(db, genesis)
+
+	chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+	chain.EnableArtificialFinality(true)
+
+	// A steady chain, followed by a difficulty swing stretching the block times.
+	fast, _ := GenerateChain(genesis.Config, genesisB, engine, db, 400, nil)
+	slow, _ := GenerateChain(genesis.Config, fast[len(fast)-1], engine, db, 50, func(i int, b *BlockGen) {
+		b.OffsetTime(120)
+	})
+	if _, err := chain.InsertChain(fast); err != nil {
+		t.Fatal(err)
+	}
+	initial, ok := chain.EffectiveFinalityDepth()
+	if !ok {
+		t.Fatal("no effectively final block")
+	}
+	const delta = 50
+	ch := make(chan EffectiveFinalityDepthEvent, len(slow))
+	sub := chain.SubscribeEffectiveFinalityDepth(delta, ch)
+	defer sub.Unsubscribe()
+	quiet := make(chan EffectiveFinalityDepthEvent, len(slow))
+	quietSub := chain.SubscribeEffectiveFinalityDepth(1000, quiet)
+	defer quietSub.Unsubscribe()
+
+	for i := range slow {
+		if _, err := chain.InsertChain(slow[i : i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	final, _ := chain.EffectiveFinalityDepth()
+	if final+delta >= initial {
+		t.Fatalf("difficulty swing too small: depth %d -> %d", initial, final)
+	}
+	// Every change beyond delta fires, down to within delta of the new depth.
+	last, events := initial, 0
+	for done := false; !done; {
+		select {
+		case ev := <-ch:
+			if ev.Depth+delta >= last {
+				t.Errorf("depth change within delta: %d -> %d", last, ev.Depth)
+			}
+			if chain.GetHeaderByHash(ev.Head) == nil {
+				t.Errorf("depth %d reported for unknown head %x", ev.Depth, ev.Head)
+			}
+			last, events = ev.Depth, events+1
+		case <-time.After(100 * time.Millisecond):
+			done = true
+		}
+	}
+	if events == 0 {
+		t.Fatal("no depth change reported")
+	}
+	if last > final+delta {
+		t.Errorf("last reported depth %d, want within %d of %d", last, delta, final)
+	}
+	select {
+	case ev := <-quiet:
+		t.Errorf("unexpected depth event beyond delta: %d", ev.Depth)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
 // TestEcbp1100PolynomialV tests the general shape and return values of the ECBP1100 polynomial curve.
 // It makes sure domain values above the 'cap' do indeed get limited, as well
 // as sanity check some normal domain values.
@@ -423,40 +878,262 @@ func TestGenerateChainTargetingHashrate(t *testing.T) {
 }
 
 func runMESSTest(t *testing.T, easyL, hardL, caN int, easyT, hardT int64) (hardHead bool, err error) {
+	return runMESS(yuckyGlobalTestEnableMess, easyL, hardL, caN, easyT, hardT)
+}
+
+// runMESS inserts an easy chain and a competing hard chain forking off at caN,
+// returning whether the hard chain became head and the error inserting it.
+// Failures setting up the chains panic.
+func runMESS(enableMess bool, easyL, hardL, caN int, easyT, hardT int64) (hardHead bool, err error) {
+	genesis, easy, hard := generateMESS(easyL, hardL, caN, easyT, hardT)
+
+	chain := newMESSChain(genesis, enableMess)
+	defer chain.Stop()
+
+	if _, err := chain.InsertChain(easy); err != nil {
+		panic(err)
+	}
+	_, err = chain.InsertChain(hard)
+	hardHead = chain.CurrentBlock().Hash() == hard[len(hard)-1].Hash()
+	return
+}
+
+// generateMESS generates an easy chain of easyL blocks and a competing hard chain
+// of hardL blocks forking off at caN, their blocks offset in time by easyT and hardT.
+func generateMESS(easyL, hardL, caN int, easyT, hardT int64) (genesis *genesisT.Genesis, easy, hard []*types.Block) {
 	// Generate the original common chain segment and the two competing forks
 	engine := ethash.NewFaker()
 
 	db := rawdb.NewMemoryDatabase()
-	genesis := params.DefaultMessNetGenesisBlock()
+	genesis = params.DefaultMessNetGenesisBlock()
 	genesisB := MustCommitGenesis(db, genesis)
 
-	chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer chain.Stop()
-	chain.EnableArtificialFinality(yuckyGlobalTestEnableMess)
-
-	easy, _ := GenerateChain(genesis.Config, genesisB, engine, db, easyL, func(i int, b *BlockGen) {
+	easy, _ = GenerateChain(genesis.Config, genesisB, engine, db, easyL, func(i int, b *BlockGen) {
 		b.SetNonce(types.EncodeNonce(uint64(rand.Int63n(math.MaxInt64))))
 		b.OffsetTime(easyT)
 	})
 	commonAncestor := easy[caN-1]
-	hard, _ := GenerateChain(genesis.Config, commonAncestor, engine, db, hardL, func(i int, b *BlockGen) {
+	hard, _ = GenerateChain(genesis.Config, commonAncestor, engine, db, hardL, func(i int, b *BlockGen) {
 		b.SetNonce(types.EncodeNonce(uint64(rand.Int63n(math.MaxInt64))))
 		b.OffsetTime(hardT)
 	})
+	return genesis, easy, hard
+}
 
-	if _, err := chain.InsertChain(easy); err != nil {
-		t.Fatal(err)
+// newMESSChain creates a chain on the genesis in a fresh database, with MESS
+// enabled or not. The chain retains the states of all the blocks, like the
+// database chains are generated in, so that segments forking off deep can be
+// imported as side chains. Failures panic.
+func newMESSChain(genesis *genesisT.Genesis, enableMess bool) *BlockChain {
+	db := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(db, genesis)
+
+	cacheConfig := *defaultCacheConfig
+	cacheConfig.TrieDirtyDisabled = true
+	chain, err := NewBlockChain(db, &cacheConfig, genesis.Config, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		panic(err)
 	}
-	_, err = chain.InsertChain(hard)
-	hardHead = chain.CurrentBlock().Hash() == hard[len(hard)-1].Hash()
-	return
+	chain.EnableArtificialFinality(enableMess)
+	return chain
 }
 
-var yuckyGlobalTestEnableMess = false
-
+// BenchmarkInsertChain_MESS measures the insertion of a competing segment reorging
+// the chain, with MESS enabled and disabled over the same generated chains, for
+// varying segment lengths. The ns/block metric reports the insertion time per
+// block of the segment, the difference between the two runs of a length being the
+// cost of the antigravity evaluation. Segments MESS rejects are imported as a side
+// chain instead, which the enabled run includes.
+func BenchmarkInsertChain_MESS(b *testing.B) {
+	const easyLen = 300
+
+	for _, segment := range []int{1, 10, 50, 200} {
+		genesis, easy, hard := generateMESS(easyLen, segment+1, easyLen-segment, 0, 0)
+
+		for _, enableMess := range []bool{false, true} {
+			b.Run(fmt.Sprintf("segment=%d/mess=%t", segment, enableMess), func(b *testing.B) {
+				var elapsed time.Duration
+
+				b.ReportAllocs()
+				b.StopTimer()
+				for i := 0; i < b.N; i++ {
+					chain := newMESSChain(genesis, enableMess)
+					if _, err := chain.InsertChain(easy); err != nil {
+						b.Fatalf("failed to insert easy chain: %v", err)
+					}
+					start := time.Now()
+					b.StartTimer()
+					_, err := chain.InsertChain(hard)
+					b.StopTimer()
+					elapsed += time.Since(start)
+
+					chain.Stop()
+					if err != nil {
+						b.Fatalf("failed to insert hard segment: %v", err)
+					}
+				}
+				b.ReportMetric(float64(elapsed.Nanoseconds())/float64(b.N*len(hard)), "ns/block")
+			})
+		}
+	}
+}
+
+// SweepOutcome classifies how a proposed chain segment was handled.
+type SweepOutcome int
+
+const (
+	SweepAccepted    SweepOutcome = iota // Proposed chain became head
+	SweepSidechained                     // Proposed chain was imported without becoming head
+	SweepRejected                        // Proposed chain import failed
+)
+
+func (o SweepOutcome) String() string {
+	switch o {
+	case SweepAccepted:
+		return "accepted"
+	case SweepSidechained:
+		return "sidechained"
+	case SweepRejected:
+		return "rejected"
+	}
+	return fmt.Sprintf("SweepOutcome(%d)", int(o))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (o SweepOutcome) MarshalText() ([]byte, error) {
+	return []byte(o.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (o *SweepOutcome) UnmarshalText(text []byte) error {
+	for _, outcome := range []SweepOutcome{SweepAccepted, SweepSidechained, SweepRejected} {
+		if outcome.String() == string(text) {
+			*o = outcome
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown sweep outcome %q", text)
+}
+
+// SweepResult is the outcome grid of a MESS parameter sweep.
+type SweepResult struct {
+	EasyLen  int
+	HardLens []int   // Proposed segment lengths, the rows of Grid
+	Offsets  []int64 // Proposed block time offsets (10 seconds + y), the columns of Grid
+	Grid     [][]SweepOutcome
+	Errors   [][]error // Import errors, parallel to Grid
+}
+
+// sweepMESSOffsets are the block time offsets swept by SweepMESS, from the
+// hardest to the easiest possible difficulty adjustment.
+var sweepMESSOffsets = func() (offsets []int64) {
+	for j := int64(-9); j <= 8; j++ {
+		offsets = append(offsets, j)
+	}
+	return
+}()
+
+// SweepMESS imports competing chains of length 1..maxHardLen, forking off an
+// easyLen long chain so that both end at the same height, over a range of block time
+// offsets, classifying the outcome of each import with MESS enabled.
+func SweepMESS(easyLen, maxHardLen int) SweepResult {
+	res := SweepResult{EasyLen: easyLen, Offsets: sweepMESSOffsets}
+	for i := 1; i <= maxHardLen; i++ {
+		res.HardLens = append(res.HardLens, i)
+		row := make([]SweepOutcome, len(res.Offsets))
+		errs := make([]error, len(res.Offsets))
+		for j, offset := range res.Offsets {
+			hardHead, err := runMESS(true, easyLen, i, easyLen-i, 0, offset)
+			switch {
+			case err != nil:
+				row[j] = SweepRejected
+			case hardHead:
+				row[j] = SweepAccepted
+			default:
+				row[j] = SweepSidechained
+			}
+			errs[j] = err
+		}
+		res.Grid = append(res.Grid, row)
+		res.Errors = append(res.Errors, errs)
+	}
+	return res
+}
+
+// sweepRecord is a single classified point of a MESS sweep in its JSON output form.
+type sweepRecord struct {
+	HardLen    int          `json:"hardLen"`
+	TimeOffset int64        `json:"timeOffset"`
+	Outcome    SweepOutcome `json:"outcome"`
+}
+
+// WriteJSON writes the sweep outcomes to w as newline delimited JSON records,
+// one per grid point, ordered by hard segment length and time offset.
+func (res SweepResult) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	for i, row := range res.Grid {
+		for j, outcome := range row {
+			if err := enc.Encode(sweepRecord{HardLen: res.HardLens[i], TimeOffset: res.Offsets[j], Outcome: outcome}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteMESSSweepJSON runs SweepMESS and writes its outcomes to w as JSON,
+// for rendering with external tools.
+func WriteMESSSweepJSON(w io.Writer, easyLen, maxHardLen int) error {
+	return SweepMESS(easyLen, maxHardLen).WriteJSON(w)
+}
+
+func TestWriteMESSSweepJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteMESSSweepJSON(&buf, 30, 2); err != nil {
+		t.Fatal(err)
+	}
+	var records []sweepRecord
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var rec sweepRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatalf("record %d: %v", len(records), err)
+		}
+		records = append(records, rec)
+	}
+	if want := 2 * len(sweepMESSOffsets); len(records) != want {
+		t.Fatalf("have %d records, want %d", len(records), want)
+	}
+	if rec := records[0]; rec.HardLen != 1 || rec.TimeOffset != sweepMESSOffsets[0] || rec.Outcome != SweepAccepted {
+		t.Errorf("unexpected first record: %+v", rec)
+	}
+	if rec := records[len(records)-1]; rec.HardLen != 2 || rec.TimeOffset != sweepMESSOffsets[len(sweepMESSOffsets)-1] {
+		t.Errorf("unexpected last record: %+v", rec)
+	}
+}
+
+func TestSweepMESS(t *testing.T) {
+	res := SweepMESS(30, 4)
+	if len(res.Grid) != 4 || len(res.Errors) != 4 || len(res.HardLens) != 4 {
+		t.Fatalf("unexpected number of rows: grid=%d errors=%d lens=%d", len(res.Grid), len(res.Errors), len(res.HardLens))
+	}
+	for i, row := range res.Grid {
+		if len(row) != len(res.Offsets) {
+			t.Fatalf("row %d: have %d columns, want %d", i, len(row), len(res.Offsets))
+		}
+	}
+	// A single block of greater difficulty is a plain reorg, one of lesser
+	// difficulty is only a sidechain.
+	if got := res.Grid[0][0]; got != SweepAccepted {
+		t.Errorf("hard len 1, offset %d: have %v, want accepted", res.Offsets[0], got)
+	}
+	if got := res.Grid[0][len(res.Offsets)-1]; got == SweepAccepted {
+		t.Errorf("hard len 1, offset %d: accepted easier chain", res.Offsets[len(res.Offsets)-1])
+	}
+}
+
+var yuckyGlobalTestEnableMess = false
+
 func TestBlockChain_GenerateMESSPlot(t *testing.T) {
 	t.Skip("This test plots graph of chain acceptance for visualization.")
 	easyLen := 500
@@ -475,21 +1152,18 @@ func TestBlockChain_GenerateMESSPlot(t *testing.T) {
 		rejecteds := plotter.XYs{}
 		sides := plotter.XYs{}
 
-		for i := 1; i <= maxHardLen; i++ {
-			for j := -9; j <= 8; j++ {
-				fmt.Println("running", i, j)
-				hardHead, err := runMESSTest(t, easyLen, i, easyLen-i, 0, int64(j))
-				point := plotter.XY{X: float64(i), Y: float64(j)}
-				if err == nil && hardHead {
+		res := SweepMESS(easyLen, maxHardLen)
+		for i, row := range res.Grid {
+			for j, outcome := range row {
+				point := plotter.XY{X: float64(res.HardLens[i]), Y: float64(res.Offsets[j])}
+				switch outcome {
+				case SweepAccepted:
 					accepteds = append(accepteds, point)
-				} else if err == nil && !hardHead {
+				case SweepSidechained:
 					sides = append(sides, point)
-				} else if err != nil {
+				case SweepRejected:
 					rejecteds = append(rejecteds, point)
-				}
-
-				if err != nil {
-					t.Log(err)
+					t.Log(res.Errors[i][j])
 				}
 			}
 		}
@@ -524,14 +1198,20 @@ func TestBlockChain_GenerateMESSPlot(t *testing.T) {
 			log.Panic(err)
 		}
 	}
-	yuckyGlobalTestEnableMess = true
-	defer func() {
-		yuckyGlobalTestEnableMess = false
-	}()
 	baseTitle := fmt.Sprintf("Accept/Reject Reorgs: Relative Time (Difficulty) over Proposed Segment Length (%d-block original chain)", easyLen)
 	generatePlot(baseTitle, "reorgs-MESS.png")
-	yuckyGlobalTestEnableMess = false
-	// generatePlot("WITHOUT MESS: "+baseTitle, "reorgs-noMESS.png")
+}
+
+func TestBlockChain_GenerateMESSJSON(t *testing.T) {
+	t.Skip("This test writes the chain acceptance data plotted by TestBlockChain_GenerateMESSPlot as JSON.")
+	f, err := os.Create("reorgs-MESS.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := WriteMESSSweepJSON(f, 500, 400); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestBlockChain_AF_ECBP1100(t *testing.T) {
@@ -1095,3 +1775,1642 @@ got.tdr=%v got.pen=%v`,
 	}
 
 }
+
+func TestBlockChain_AF_ECBP1100_RejectPolicy(t *testing.T) {
+	for _, policy := range []ArtificialFinalityRejectPolicy{ArtificialFinalityRejectSidechain, ArtificialFinalityRejectError} {
+		engine := ethash.NewFaker()
+
+		db := rawdb.NewMemoryDatabase()
+		genesis := params.DefaultMessNetGenesisBlock()
+		genesisB := MustCommitGenesis(db, genesis)
+
+		chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain.EnableArtificialFinality(true)
+		chain.SetArtificialFinalityRejectPolicy(policy)
+
+		easy, _ := GenerateChain(genesis.Config, genesisB, engine, db, 500, func(i int, b *BlockGen) {
+			b.SetNonce(types.EncodeNonce(uint64(rand.Int63n(math.MaxInt64))))
+		})
+		hard, _ := GenerateChain(genesis.Config, easy[249], engine, db, 250, func(i int, b *BlockGen) {
+			b.SetNonce(types.EncodeNonce(uint64(rand.Int63n(math.MaxInt64))))
+			b.OffsetTime(-9)
+		})
+		if _, err := chain.InsertChain(easy); err != nil {
+			t.Fatal(err)
+		}
+		_, err = chain.InsertChain(hard)
+		switch policy {
+		case ArtificialFinalityRejectSidechain:
+			if err != nil {
+				t.Errorf("sidechain policy: unexpected error: %v", err)
+			}
+		case ArtificialFinalityRejectError:
+			if !errors.Is(err, ErrArtificialFinalityReject) {
+				t.Errorf("error policy: want %v, got %v", ErrArtificialFinalityReject, err)
+			}
+		}
+		if chain.CurrentBlock().Hash() != easy[len(easy)-1].Hash() {
+			t.Errorf("policy %d: rejected chain got head", policy)
+		}
+		chain.Stop()
+	}
+}
+
+// Tests that a registered reject handler is called with the details of a rejected
+// fork before the insertion returns.
+func TestBlockChain_AF_ECBP1100_RejectHandler(t *testing.T) {
+	engine := ethash.NewFaker()
+	genesis := params.DefaultMessNetGenesisBlock()
+
+	gendb := rawdb.NewMemoryDatabase()
+	genesisB := MustCommitGenesis(gendb, genesis)
+	easy, _ := GenerateChain(genesis.Config, genesisB, engine, gendb, 500, nil)
+	hard, _ := GenerateChain(genesis.Config, easy[249], engine, gendb, 250, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x01}) // Don't share states with the easy chain
+		b.OffsetTime(-9)
+	})
+	db := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(db, genesis)
+	chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+	chain.EnableArtificialFinality(true)
+	chain.SetArtificialFinalityRejectPolicy(ArtificialFinalityRejectError)
+
+	var rejections []*ArtificialFinalityRejection
+	chain.SetArtificialFinalityRejectHandler(func(rejection *ArtificialFinalityRejection) {
+		rejections = append(rejections, rejection)
+	})
+	if _, err := chain.InsertChain(easy); err != nil {
+		t.Fatal(err)
+	}
+	if len(rejections) != 0 {
+		t.Fatalf("handler called for the canonical chain: %d times", len(rejections))
+	}
+	_, err = chain.InsertChain(hard)
+	if !errors.Is(err, ErrArtificialFinalityReject) {
+		t.Fatalf("want %v, got %v", ErrArtificialFinalityReject, err)
+	}
+	if len(rejections) != 1 {
+		t.Fatalf("handler calls mismatch: have %d, want 1", len(rejections))
+	}
+	rejection := rejections[0]
+	if have, want := rejection.CommonAncestor.Hash(), easy[249].Hash(); have != want {
+		t.Errorf("common ancestor mismatch: have %x, want %x", have, want)
+	}
+	if have, want := rejection.Current.Hash(), easy[len(easy)-1].Hash(); have != want {
+		t.Errorf("current head mismatch: have %x, want %x", have, want)
+	}
+	if number := rejection.Proposed.Number.Uint64(); number <= easy[249].NumberU64() || number > hard[len(hard)-1].NumberU64() ||
+		hard[number-hard[0].NumberU64()].Hash() != rejection.Proposed.Hash() {
+		t.Errorf("proposed head #%d [%x] not in the fork", number, rejection.Proposed.Hash())
+	}
+	if rejection.Err == nil || rejection.Err.Error() != err.Error() {
+		t.Errorf("rejection reason mismatch: have %v, want %v", rejection.Err, err)
+	}
+	// Without a handler, rejections go unreported.
+	other, _ := GenerateChain(genesis.Config, easy[249], engine, gendb, 250, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x02})
+		b.OffsetTime(-9)
+	})
+	chain.SetArtificialFinalityRejectHandler(nil)
+	if _, err := chain.InsertChain(other); !errors.Is(err, ErrArtificialFinalityReject) {
+		t.Fatalf("want %v, got %v", ErrArtificialFinalityReject, err)
+	}
+	if len(rejections) != 1 {
+		t.Errorf("removed handler called")
+	}
+	// A rejected header segment is reported once, outside the chain lock, with the
+	// rejection of its last header
+	chain.SetArtificialFinalityRejectPolicy(ArtificialFinalityRejectSidechain)
+	headers := make([]*types.Header, len(hard))
+	for i, block := range hard {
+		headers[i] = block.Header()
+	}
+	unlocked := make(chan bool, len(headers))
+	chain.SetArtificialFinalityRejectHandler(func(rejection *ArtificialFinalityRejection) {
+		rejections = append(rejections, rejection)
+
+		locked := make(chan struct{})
+		go func() {
+			chain.chainmu.Lock()
+			chain.chainmu.Unlock()
+			close(locked)
+		}()
+		select {
+		case <-locked:
+			unlocked <- true
+		case <-time.After(time.Second):
+			unlocked <- false
+		}
+	})
+	if n, err := chain.InsertHeaderChain(headers, 1); err != nil {
+		t.Fatalf("failed to insert header %d: %v", n, err)
+	}
+	if chain.CurrentHeader().Hash() != easy[len(easy)-1].Hash() {
+		t.Fatal("rejected header segment applied")
+	}
+	if len(rejections) != 2 {
+		t.Fatalf("handler calls for the header segment: have %d, want 1", len(rejections)-1)
+	}
+	if have, want := rejections[1].Proposed.Hash(), hard[len(hard)-1].Hash(); have != want {
+		t.Errorf("header segment head mismatch: have %x, want %x", have, want)
+	}
+	if !<-unlocked {
+		t.Errorf("handler called holding the chain lock")
+	}
+}
+
+// callbackClock is a frozen Clock calling a function whenever it is read.
+type callbackClock struct {
+	now time.Time
+	fn  func()
+}
+
+func (c *callbackClock) Now() time.Time {
+	if c.fn != nil {
+		c.fn()
+	}
+	return c.now
+}
+
+// Tests that reporting the network head while an insertion holds the chain lock
+// doesn't report the segments it rejects before it returns, splitting them up into
+// rejections of different trace ids.
+func TestBlockChain_AF_ECBP1100_RejectHandlerSetterRace(t *testing.T) {
+	engine := ethash.NewFaker()
+	genesis := params.DefaultMessNetGenesisBlock()
+
+	gendb := rawdb.NewMemoryDatabase()
+	genesisB := MustCommitGenesis(gendb, genesis)
+	easy, _ := GenerateChain(genesis.Config, genesisB, engine, gendb, 500, nil)
+	hard, _ := GenerateChain(genesis.Config, easy[249], engine, gendb, 250, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x01}) // Don't share states with the easy chain
+		b.OffsetTime(-9)
+	})
+	db := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(db, genesis)
+	chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+	chain.EnableArtificialFinality(true)
+	chain.SetArtificialFinalityRejectPolicy(ArtificialFinalityRejectSidechain)
+
+	if _, err := chain.InsertChain(easy); err != nil {
+		t.Fatal(err)
+	}
+	// The clock is read holding the chain lock as each header is evaluated
+	clock := &callbackClock{now: time.Unix(int64(easy[len(easy)-1].Time()), 0)}
+	chain.SetClock(clock)
+	clock.fn = func() { chain.SetArtificialFinalityNetworkHead(uint64(len(easy))) }
+
+	var rejections []*ArtificialFinalityRejection
+	chain.SetArtificialFinalityRejectHandler(func(rejection *ArtificialFinalityRejection) {
+		rejections = append(rejections, rejection)
+	})
+	decisions := make(chan ArtificialFinalityDecisionEvent, len(hard))
+	sub := chain.SubscribeArtificialFinalityDecision(decisions)
+	defer sub.Unsubscribe()
+
+	headers := make([]*types.Header, len(hard))
+	for i, block := range hard {
+		headers[i] = block.Header()
+	}
+	if n, err := chain.InsertHeaderChain(headers, 1); err != nil {
+		t.Fatalf("failed to insert header %d: %v", n, err)
+	}
+	clock.fn = nil
+
+	if len(rejections) != 1 {
+		t.Fatalf("handler calls for the header segment: have %d, want 1", len(rejections))
+	}
+	var last ArtificialFinalityDecisionEvent
+	for len(decisions) > 0 {
+		last = <-decisions
+	}
+	if rejections[0].TraceID == "" || rejections[0].TraceID != last.TraceID {
+		t.Errorf("rejection trace mismatch: have %q, want the last decision's %q", rejections[0].TraceID, last.TraceID)
+	}
+	if have, want := rejections[0].Proposed.Hash(), hard[len(hard)-1].Hash(); have != want {
+		t.Errorf("header segment head mismatch: have %x, want %x", have, want)
+	}
+}
+
+// Tests that competing segments of total difficulty equal to the head's are settled
+// by the tie policy while artificial finality is active.
+func TestBlockChain_AF_ECBP1100_TiePolicy(t *testing.T) {
+	for _, policy := range []ArtificialFinalityTiePolicy{ArtificialFinalityTieKeepCurrent, ArtificialFinalityTieAdoptNew, ArtificialFinalityTieReject} {
+		engine := ethash.NewFaker()
+
+		db := rawdb.NewMemoryDatabase()
+		genesis := params.DefaultMessNetGenesisBlock()
+		genesisB := MustCommitGenesis(db, genesis)
+
+		chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain.EnableArtificialFinality(true)
+		chain.SetArtificialFinalityTiePolicy(policy)
+
+		// The competing segment has the same timestamps, thus difficulties, as the
+		// canonical one it displaces, differing by coinbase only.
+		canon, _ := GenerateChain(genesis.Config, genesisB, engine, db, 15, nil)
+		fork, _ := GenerateChain(genesis.Config, canon[11], engine, db, 3, func(i int, b *BlockGen) {
+			b.SetCoinbase(common.Address{0x01})
+		})
+		if _, err := chain.InsertChain(canon); err != nil {
+			t.Fatal(err)
+		}
+		for i, block := range fork {
+			if block.Difficulty().Cmp(canon[12+i].Difficulty()) != 0 {
+				t.Fatalf("policy %d: block #%d difficulty mismatch: have %v, want %v", policy, block.NumberU64(), block.Difficulty(), canon[12+i].Difficulty())
+			}
+		}
+		_, err = chain.InsertChain(fork)
+
+		want := canon[len(canon)-1]
+		switch policy {
+		case ArtificialFinalityTieKeepCurrent:
+			if err != nil {
+				t.Errorf("keep-current policy: unexpected error: %v", err)
+			}
+		case ArtificialFinalityTieAdoptNew:
+			if err != nil {
+				t.Errorf("adopt-new policy: unexpected error: %v", err)
+			}
+			want = fork[len(fork)-1]
+		case ArtificialFinalityTieReject:
+			if !errors.Is(err, ErrArtificialFinalityTie) {
+				t.Errorf("reject policy: want %v, got %v", ErrArtificialFinalityTie, err)
+			}
+		}
+		if head := chain.CurrentBlock(); head.Hash() != want.Hash() {
+			t.Errorf("policy %d: head mismatch: have #%d [%x…], want #%d [%x…]", policy, head.NumberU64(), head.Hash().Bytes()[:4], want.NumberU64(), want.Hash().Bytes()[:4])
+		}
+		chain.Stop()
+	}
+}
+
+// Tests that the header and the block checks of artificial finality agree on competing
+// segments tying with the head: both evaluate them, as they may be reorged to.
+func TestBlockChain_AF_ECBP1100_EqualTD(t *testing.T) {
+	engine := ethash.NewFaker()
+
+	db := rawdb.NewMemoryDatabase()
+	genesis := params.DefaultMessNetGenesisBlock()
+	genesisB := MustCommitGenesis(db, genesis)
+
+	chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+	chain.EnableArtificialFinality(true)
+
+	// The competing segment has the same timestamps, thus difficulties, as the
+	// canonical one, spaced apart for the antigravity threshold to exceed 1.
+	canon, _ := GenerateChain(genesis.Config, genesisB, engine, db, 20, func(i int, b *BlockGen) {
+		b.OffsetTime(90)
+	})
+	fork, _ := GenerateChain(genesis.Config, canon[9], engine, db, 10, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x01})
+		b.OffsetTime(90)
+	})
+	if _, err := chain.InsertChain(canon); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.InsertChain(fork[:len(fork)-1]); err != nil {
+		t.Fatal(err)
+	}
+	tie := fork[len(fork)-1]
+	if have, want := new(big.Int).Add(chain.GetTd(tie.ParentHash(), tie.NumberU64()-1), tie.Difficulty()), chain.GetTd(canon[len(canon)-1].Hash(), canon[len(canon)-1].NumberU64()); have.Cmp(want) != 0 {
+		t.Fatalf("competing segment TD mismatch: have %v, want %v", have, want)
+	}
+	headerErr, blockErr := chain.ecbp1100Header(tie.Header()), chain.ecbp1100Block(tie)
+	if !errors.Is(headerErr, ErrArtificialFinalityReject) {
+		t.Errorf("header check of the tie: want %v, got %v", ErrArtificialFinalityReject, headerErr)
+	}
+	if !errors.Is(blockErr, ErrArtificialFinalityReject) {
+		t.Errorf("block check of the tie: want %v, got %v", ErrArtificialFinalityReject, blockErr)
+	}
+}
+
+// Tests that under the stop policy, InsertChain inserts the blocks preceding the
+// first one rejected by artificial finality, and reports the rejected one.
+func TestBlockChain_AF_ECBP1100_RejectStop(t *testing.T) {
+	engine := ethash.NewFaker()
+
+	db := rawdb.NewMemoryDatabase()
+	genesis := params.DefaultMessNetGenesisBlock()
+	genesisB := MustCommitGenesis(db, genesis)
+
+	chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+	chain.EnableArtificialFinality(true)
+	chain.SetArtificialFinalityRejectPolicy(ArtificialFinalityRejectStop)
+
+	easy, _ := GenerateChain(genesis.Config, genesisB, engine, db, 500, func(i int, b *BlockGen) {
+		b.SetNonce(types.EncodeNonce(uint64(rand.Int63n(math.MaxInt64))))
+	})
+	hard, _ := GenerateChain(genesis.Config, easy[249], engine, db, 250, func(i int, b *BlockGen) {
+		b.SetNonce(types.EncodeNonce(uint64(rand.Int63n(math.MaxInt64))))
+		b.OffsetTime(-9)
+	})
+	if _, err := chain.InsertChain(easy); err != nil {
+		t.Fatal(err)
+	}
+	decisions := make(chan ArtificialFinalityDecisionEvent, len(hard))
+	sub := chain.SubscribeArtificialFinalityDecision(decisions)
+	defer sub.Unsubscribe()
+
+	// A short fork is accepted, decided on once per block
+	fork, _ := GenerateChain(genesis.Config, easy[len(easy)-3], engine, db, 6, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x02})
+	})
+	if _, err := chain.InsertChain(fork); err != nil {
+		t.Fatalf("short fork: %v", err)
+	}
+	if chain.CurrentBlock().Hash() != fork[len(fork)-1].Hash() {
+		t.Fatal("short fork not accepted")
+	}
+	decided := make(map[common.Hash]int)
+	for len(decisions) > 0 {
+		ev := <-decisions
+		if decided[ev.Proposed.Hash()]++; decided[ev.Proposed.Hash()] > 1 {
+			t.Errorf("block #%d decided on more than once", ev.Proposed.Number)
+		}
+	}
+	if len(decided) == 0 {
+		t.Error("short fork not decided on")
+	}
+	easy = append(easy[:len(easy)-2], fork...)
+
+	// The first hard block outweighing the easy head is the first one subject to,
+	// and rejected by, artificial finality.
+	var (
+		localTd  = chain.GetTd(easy[len(easy)-1].Hash(), easy[len(easy)-1].NumberU64())
+		externTd = new(big.Int).Set(chain.GetTd(easy[249].Hash(), easy[249].NumberU64()))
+		k        = -1
+	)
+	for i, block := range hard {
+		if externTd.Add(externTd, block.Difficulty()); externTd.Cmp(localTd) > 0 {
+			k = i
+			break
+		}
+	}
+	if k < 0 {
+		t.Fatal("hard chain does not outweigh the easy one")
+	}
+	n, err := chain.InsertChain(hard)
+	if n != k {
+		t.Errorf("stop index mismatch: have %d, want %d", n, k)
+	}
+	var stop *ArtificialFinalityStopError
+	if !errors.As(err, &stop) {
+		t.Fatalf("want %T, got %v", stop, err)
+	}
+	if stop.Index != k || stop.Hash != hard[k].Hash() || stop.Number != hard[k].NumberU64() {
+		t.Errorf("stop error mismatch: have item %d #%d [%x], want item %d #%d [%x]", stop.Index, stop.Number, stop.Hash, k, hard[k].NumberU64(), hard[k].Hash())
+	}
+	if !errors.Is(err, ErrArtificialFinalityReject) {
+		t.Errorf("stop reason: want %v, got %v", ErrArtificialFinalityReject, stop.Err)
+	}
+	for i, block := range hard {
+		if have := chain.HasBlock(block.Hash(), block.NumberU64()); have != (i < k) {
+			t.Errorf("hard block %d: stored %v, want %v", i, have, i < k)
+		}
+	}
+	if chain.CurrentBlock().Hash() != easy[len(easy)-1].Hash() {
+		t.Error("rejected chain got head")
+	}
+	// The rejection is decided on once
+	if len(decisions) != 1 {
+		t.Fatalf("decisions of the rejection: have %d, want 1", len(decisions))
+	}
+	if ev := <-decisions; ev.Proposed.Hash() != hard[k].Hash() || ev.TraceID != ArtificialFinalityTraceID(err) {
+		t.Errorf("decision mismatch: have #%d trace %s, want #%d trace %s", ev.Proposed.Number, ev.TraceID, hard[k].NumberU64(), ArtificialFinalityTraceID(err))
+	}
+}
+
+// frozenClock is a Clock always returning the same time.
+type frozenClock time.Time
+
+func (c frozenClock) Now() time.Time { return time.Time(c) }
+
+// Tests that a rejection carries the same trace id in the decision event, the log and
+// the error.
+func TestBlockChain_AF_ECBP1100_TraceID(t *testing.T) {
+	engine := ethash.NewFaker()
+	genesis := params.DefaultMessNetGenesisBlock()
+
+	gendb := rawdb.NewMemoryDatabase()
+	genesisB := MustCommitGenesis(gendb, genesis)
+	easy, _ := GenerateChain(genesis.Config, genesisB, engine, gendb, 500, nil)
+	hard, _ := GenerateChain(genesis.Config, easy[249], engine, gendb, 250, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x01}) // Don't share states with the easy chain
+		b.OffsetTime(-9)
+	})
+	db := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(db, genesis)
+	chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+	chain.EnableArtificialFinality(true)
+	chain.SetArtificialFinalityRejectPolicy(ArtificialFinalityRejectError)
+
+	if _, err := chain.InsertChain(easy); err != nil {
+		t.Fatal(err)
+	}
+	// Collect the decisions posted and logged while inserting the rejected fork
+	decisions := make(chan ArtificialFinalityDecisionEvent, len(hard))
+	sub := chain.SubscribeArtificialFinalityDecision(decisions)
+	defer sub.Unsubscribe()
+
+	var (
+		logged []string
+		lock   sync.Mutex
+	)
+	defer gethlog.Root().SetHandler(gethlog.Root().GetHandler())
+	gethlog.Root().SetHandler(gethlog.FuncHandler(func(r *gethlog.Record) error {
+		if r.Msg != "ECBP1100-MESS decision" {
+			return nil
+		}
+		for i := 0; i+1 < len(r.Ctx); i += 2 {
+			if r.Ctx[i] == "trace" {
+				lock.Lock()
+				logged = append(logged, r.Ctx[i+1].(string))
+				lock.Unlock()
+			}
+		}
+		return nil
+	}))
+	_, err = chain.InsertChain(hard)
+	if !errors.Is(err, ErrArtificialFinalityReject) {
+		t.Fatalf("want %v, got %v", ErrArtificialFinalityReject, err)
+	}
+	id := ArtificialFinalityTraceID(err)
+	if len(id) != 32 {
+		t.Fatalf("invalid trace id %q", id)
+	}
+	var event *ArtificialFinalityDecisionEvent
+	for len(decisions) > 0 {
+		if ev := <-decisions; ev.TraceID == id {
+			event = &ev
+		}
+	}
+	if event == nil {
+		t.Fatalf("no decision event of trace %s", id)
+	}
+	if event.Err == nil || event.Err.Error() != err.Error() {
+		t.Errorf("event rejection mismatch: have %v, want %v", event.Err, err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+
+	var found int
+	for _, trace := range logged {
+		if trace == id {
+			found++
+		}
+	}
+	if found != 1 {
+		t.Errorf("trace %s logged %d times, want once among %d decisions", id, found, len(logged))
+	}
+}
+
+// Tests that the decisions of an insertion are posted once it released the chain
+// lock, so that a slow subscriber doesn't hold up the chain.
+func TestBlockChain_AF_ECBP1100_DecisionOutsideLock(t *testing.T) {
+	engine := ethash.NewFaker()
+	genesis := params.DefaultMessNetGenesisBlock()
+
+	gendb := rawdb.NewMemoryDatabase()
+	genesisB := MustCommitGenesis(gendb, genesis)
+	easy, _ := GenerateChain(genesis.Config, genesisB, engine, gendb, 500, nil)
+	hard, _ := GenerateChain(genesis.Config, easy[249], engine, gendb, 250, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x01}) // Don't share states with the easy chain
+		b.OffsetTime(-9)
+	})
+	db := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(db, genesis)
+	chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+	chain.EnableArtificialFinality(true)
+	chain.SetArtificialFinalityRejectPolicy(ArtificialFinalityRejectError)
+
+	if _, err := chain.InsertChain(easy); err != nil {
+		t.Fatal(err)
+	}
+	// Hold up the delivery of the decisions on a second subscription
+	decisions, held := make(chan ArtificialFinalityDecisionEvent), make(chan ArtificialFinalityDecisionEvent)
+	sub := chain.SubscribeArtificialFinalityDecision(decisions)
+	defer sub.Unsubscribe()
+	heldSub := chain.SubscribeArtificialFinalityDecision(held)
+	defer heldSub.Unsubscribe()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := chain.InsertChain(hard)
+		done <- err
+	}()
+	var ev ArtificialFinalityDecisionEvent
+	select {
+	case ev = <-decisions:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no decision posted")
+	}
+	// The chain lock is free while the decision is being posted
+	locked := make(chan struct{})
+	go func() {
+		chain.chainmu.Lock()
+		chain.chainmu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatalf("chain lock held while posting decisions")
+	}
+	for {
+		<-held
+		if ev.Err != nil {
+			break
+		}
+		ev = <-decisions
+	}
+	if err := <-done; !errors.Is(err, ErrArtificialFinalityReject) || ArtificialFinalityTraceID(err) != ev.TraceID {
+		t.Fatalf("want rejection of trace %s, got %v", ev.TraceID, err)
+	}
+}
+
+// Tests that a heavier competing segment of the same length as the canonical one is
+// judged by antigravity or by total difficulty alone as the equal-length policy
+// selects, while shorter segments are judged by antigravity regardless.
+func TestBlockChain_AF_ECBP1100_EqualLengthPolicy(t *testing.T) {
+	engine := ethash.NewFaker()
+	genesis := params.DefaultMessNetGenesisBlock()
+
+	gendb := rawdb.NewMemoryDatabase()
+	genesisB := MustCommitGenesis(gendb, genesis)
+	easy, _ := GenerateChain(genesis.Config, genesisB, engine, gendb, 500, nil)
+	hard, _ := GenerateChain(genesis.Config, easy[249], engine, gendb, 250, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x01}) // Don't share states with the easy chain
+		b.OffsetTime(-9)
+	})
+	for _, tt := range []struct {
+		policy ArtificialFinalityEqualLengthPolicy
+		fork   []*types.Block
+		adopt  bool
+	}{
+		{ArtificialFinalityEqualLengthAntigravity, hard, false},
+		{ArtificialFinalityEqualLengthTD, hard, true},
+		{ArtificialFinalityEqualLengthAntigravity, hard[:240], false},
+		{ArtificialFinalityEqualLengthTD, hard[:240], false},
+	} {
+		db := rawdb.NewMemoryDatabase()
+		MustCommitGenesis(db, genesis)
+		chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain.EnableArtificialFinality(true)
+		chain.SetArtificialFinalityEqualLengthPolicy(tt.policy)
+
+		if _, err := chain.InsertChain(easy); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := chain.InsertChain(tt.fork); err != nil {
+			t.Fatalf("policy %d, fork of %d blocks: %v", tt.policy, len(tt.fork), err)
+		}
+		canon, fork := easy[len(easy)-1], tt.fork[len(tt.fork)-1]
+		if chain.GetTd(fork.Hash(), fork.NumberU64()).Cmp(chain.GetTd(canon.Hash(), canon.NumberU64())) <= 0 {
+			t.Fatalf("fork of %d blocks does not outweigh the canonical chain", len(tt.fork))
+		}
+		want := canon
+		if tt.adopt {
+			want = fork
+		}
+		if head := chain.CurrentBlock(); head.Hash() != want.Hash() {
+			t.Errorf("policy %d, fork of %d blocks: head mismatch: have #%d [%x…], want #%d [%x…]", tt.policy, len(tt.fork), head.NumberU64(), head.Hash().Bytes()[:4], want.NumberU64(), want.Hash().Bytes()[:4])
+		}
+		chain.Stop()
+	}
+}
+
+func TestBlockChain_AF_ECBP1100_FrozenClock(t *testing.T) {
+	engine := ethash.NewFaker()
+	genesis := params.DefaultMessNetGenesisBlock()
+
+	gendb := rawdb.NewMemoryDatabase()
+	genesisB := MustCommitGenesis(gendb, genesis)
+	easy, _ := GenerateChain(genesis.Config, genesisB, engine, gendb, 500, nil)
+	hard, _ := GenerateChain(genesis.Config, easy[249], engine, gendb, 250, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x01}) // Don't share states with the easy chain
+		b.OffsetTime(-9)
+	})
+	clock := frozenClock(time.Unix(int64(easy[len(easy)-1].Time()), 0).Add(time.Hour))
+
+	// The same chains imported at different real times yield identical decisions.
+	var first error
+	for run := 0; run < 2; run++ {
+		db := rawdb.NewMemoryDatabase()
+		MustCommitGenesis(db, genesis)
+		chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain.SetClock(clock)
+		chain.EnableArtificialFinality(true)
+		chain.SetArtificialFinalityRejectPolicy(ArtificialFinalityRejectError)
+
+		if _, err := chain.InsertChain(easy); err != nil {
+			t.Fatal(err)
+		}
+		_, err = chain.InsertChain(hard)
+		chain.Stop()
+		if !errors.Is(err, ErrArtificialFinalityReject) {
+			t.Fatalf("run %d: want %v, got %v", run, ErrArtificialFinalityReject, err)
+		}
+		if run == 0 {
+			first = err
+			continue
+		}
+		if err.Error() != first.Error() {
+			t.Errorf("run %d: decision differs:\nhave %v\nwant %v", run, err, first)
+		}
+		time.Sleep(time.Second)
+	}
+	age := common.PrettyAge(time.Now().Add(-time.Time(clock).Sub(time.Unix(int64(easy[249].Time()), 0)))).String()
+	if !strings.Contains(first.Error(), "age="+age+" ") {
+		t.Errorf("age not relative to the frozen clock, want %s: %v", age, first)
+	}
+
+	// The future block window is relative to the frozen clock too.
+	db := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(db, genesis)
+	chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+	chain.SetClock(clock)
+	for _, tt := range []struct {
+		offset int64
+		ok     bool
+	}{{maxTimeFutureBlocks, true}, {maxTimeFutureBlocks + 1, false}} {
+		block := types.NewBlockWithHeader(&types.Header{Number: common.Big1, Time: uint64(time.Time(clock).Unix() + tt.offset)})
+		if err := chain.addFutureBlock(block); (err == nil) != tt.ok {
+			t.Errorf("future block at +%ds: have error %v, want ok %v", tt.offset, err, tt.ok)
+		}
+	}
+}
+
+func TestBlockChain_AF_ECBP1100_PrometheusMetrics(t *testing.T) {
+	rec := httptest.NewRecorder()
+	prometheus.Handler(metrics.DefaultRegistry).ServeHTTP(rec, httptest.NewRequest("GET", "/debug/metrics/prometheus", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE chain_ecbp1100_accepted gauge\nchain_ecbp1100_accepted ",
+		"# TYPE chain_ecbp1100_rejected gauge\nchain_ecbp1100_rejected ",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("prometheus output missing %q", want)
+		}
+	}
+}
+
+func TestBlockChain_AF_ECBP1100_HeaderChain(t *testing.T) {
+	for _, enableMess := range []bool{false, true} {
+		engine := ethash.NewFaker()
+
+		db := rawdb.NewMemoryDatabase()
+		genesis := params.DefaultMessNetGenesisBlock()
+		genesisB := MustCommitGenesis(db, genesis)
+
+		chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain.EnableArtificialFinality(enableMess)
+		chain.SetArtificialFinalityRejectPolicy(ArtificialFinalityRejectError)
+
+		easy, _ := GenerateChain(genesis.Config, genesisB, engine, db, 500, func(i int, b *BlockGen) {
+			b.SetNonce(types.EncodeNonce(uint64(rand.Int63n(math.MaxInt64))))
+		})
+		hard, _ := GenerateChain(genesis.Config, easy[249], engine, db, 250, func(i int, b *BlockGen) {
+			b.SetNonce(types.EncodeNonce(uint64(rand.Int63n(math.MaxInt64))))
+			b.OffsetTime(-9)
+		})
+		headers := func(blocks types.Blocks) []*types.Header {
+			headers := make([]*types.Header, len(blocks))
+			for i, block := range blocks {
+				headers[i] = block.Header()
+			}
+			return headers
+		}
+		if _, err := chain.InsertHeaderChain(headers(easy), 1); err != nil {
+			t.Fatal(err)
+		}
+		_, err = chain.InsertHeaderChain(headers(hard), 1)
+		if !enableMess {
+			// Without MESS the hard header chain wins on total difficulty alone.
+			if err != nil {
+				t.Fatal(err)
+			}
+			if chain.CurrentHeader().Hash() != hard[len(hard)-1].Hash() {
+				t.Fatal("hard header chain did not get header head without MESS")
+			}
+		} else {
+			if !errors.Is(err, ErrArtificialFinalityReject) {
+				t.Errorf("want: %v, got: %v", ErrArtificialFinalityReject, err)
+			}
+			if chain.CurrentHeader().Hash() != easy[len(easy)-1].Hash() {
+				t.Error("hard header chain got header head, want MESS rejection")
+			}
+		}
+		chain.Stop()
+	}
+}
+
+// Tests that a header chain rejected by ECBP1100 in a later chunk fails at the same
+// index as when inserted at once, leaving the headers of the earlier chunks written.
+func TestBlockChain_AF_ECBP1100_HeaderChainChunked(t *testing.T) {
+	engine := ethash.NewFaker()
+	genesis := params.DefaultMessNetGenesisBlock()
+
+	gendb := rawdb.NewMemoryDatabase()
+	genesisB := MustCommitGenesis(gendb, genesis)
+	easy, _ := GenerateChain(genesis.Config, genesisB, engine, gendb, 500, nil)
+	hard, _ := GenerateChain(genesis.Config, easy[249], engine, gendb, 250, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x01})
+		b.OffsetTime(-9)
+	})
+	headers := func(blocks types.Blocks) []*types.Header {
+		headers := make([]*types.Header, len(blocks))
+		for i, block := range blocks {
+			headers[i] = block.Header()
+		}
+		return headers
+	}
+	insert := func(chunk int) (*BlockChain, int, error) {
+		db := rawdb.NewMemoryDatabase()
+		MustCommitGenesis(db, genesis)
+		chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain.EnableArtificialFinality(true)
+		chain.SetArtificialFinalityRejectPolicy(ArtificialFinalityRejectStop)
+		if _, err := chain.InsertHeaderChain(headers(easy), 1); err != nil {
+			t.Fatal(err)
+		}
+		chain.SetHeaderInsertChunk(chunk)
+		n, err := chain.InsertHeaderChain(headers(hard), 1)
+		return chain, n, err
+	}
+	single, want, err := insert(0)
+	defer single.Stop()
+	if !errors.Is(err, ErrArtificialFinalityReject) {
+		t.Fatalf("single batch: want: %v, got: %v", ErrArtificialFinalityReject, err)
+	}
+	if want < 7 {
+		t.Fatalf("rejected at index %d, want a later chunk", want)
+	}
+	chunked, n, err := insert(7)
+	defer chunked.Stop()
+	if !errors.Is(err, ErrArtificialFinalityReject) {
+		t.Fatalf("chunked: want: %v, got: %v", ErrArtificialFinalityReject, err)
+	}
+	if n != want {
+		t.Errorf("failing index mismatch: have %d, want %d", n, want)
+	}
+	if chunked.CurrentHeader().Hash() != easy[len(easy)-1].Hash() {
+		t.Error("rejected header chain got header head")
+	}
+	for i, block := range hard {
+		if have := chunked.HasHeader(block.Hash(), block.NumberU64()); have != (i < n) {
+			t.Errorf("header %d written: have %v, want %v", i, have, i < n)
+		}
+	}
+}
+
+// Tests that skews of the current head's timestamp within the clock skew grace leave
+// ECBP1100 decisions unchanged, while greater manipulations still affect them.
+func TestBlockChain_AF_ECBP1100_ClockSkewGrace(t *testing.T) {
+	engine := ethash.NewFaker()
+	genesis := params.DefaultMessNetGenesisBlock()
+
+	gendb := rawdb.NewMemoryDatabase()
+	genesisB := MustCommitGenesis(gendb, genesis)
+	shared, _ := GenerateChain(genesis.Config, genesisB, engine, gendb, 10, nil)
+	commonAncestor := shared[len(shared)-1]
+
+	// A faster, heavier proposed segment, spanning less time than the current one.
+	hard, _ := GenerateChain(genesis.Config, commonAncestor, engine, gendb, 450, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x01})
+	})
+	// newChain returns a chain of a slow current segment, whose head's timestamp is
+	// skewed by the given seconds, clocked at the unskewed time of the head.
+	newChain := func(skew int64, grace uint32) *BlockChain {
+		easy, _ := GenerateChain(genesis.Config, commonAncestor, engine, gendb, 100, func(i int, b *BlockGen) {
+			b.OffsetTime(40)
+			if i == 99 {
+				b.OffsetTime(skew)
+			}
+		})
+		db := rawdb.NewMemoryDatabase()
+		MustCommitGenesis(db, genesis)
+		chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain.SetClock(frozenClock(time.Unix(int64(easy[99].Time())-skew, 0)))
+		chain.EnableArtificialFinality(true)
+		chain.SetArtificialFinalityClockSkewGrace(grace)
+
+		if _, err := chain.InsertChain(append(shared, easy...)); err != nil {
+			chain.Stop()
+			t.Fatal(err)
+		}
+		return chain
+	}
+	// The proposed segment is cut at the shortest length accepted without skew.
+	chain := newChain(0, 0)
+	for i := range hard {
+		if _, err := chain.InsertChain(hard[i : i+1]); err != nil {
+			t.Fatal(err)
+		}
+		if chain.CurrentBlock().Hash() == hard[i].Hash() {
+			hard = hard[:i+1]
+			break
+		}
+	}
+	chain.Stop()
+	if chain.CurrentBlock().Hash() != hard[len(hard)-1].Hash() {
+		t.Fatal("proposed segment never accepted")
+	}
+	accepted := func(skew int64, grace uint32) bool {
+		chain := newChain(skew, grace)
+		defer chain.Stop()
+
+		if _, err := chain.InsertChain(hard); err != nil {
+			t.Fatal(err)
+		}
+		return chain.CurrentBlock().Hash() == hard[len(hard)-1].Hash()
+	}
+	// Without a grace, a small skew swings the decision.
+	if accepted(30, 0) {
+		t.Fatal("small skew did not affect the decision without grace")
+	}
+	for _, skew := range []int64{-30, 0, 30} {
+		if !accepted(skew, 60) {
+			t.Errorf("skew %d within grace changed the decision", skew)
+		}
+	}
+	// Manipulation beyond the grace still affects it.
+	if accepted(300, 60) {
+		t.Error("large skew did not affect the decision")
+	}
+}
+
+// Tests that proposed segments up to the minimum length are never rejected by
+// ECBP1100, and that longer ones are evaluated.
+func TestBlockChain_AF_ECBP1100_MinSegmentLength(t *testing.T) {
+	engine := ethash.NewFaker()
+
+	db := rawdb.NewMemoryDatabase()
+	genesis := params.DefaultMessNetGenesisBlock()
+	genesisB := MustCommitGenesis(db, genesis)
+
+	chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+	chain.EnableArtificialFinality(true)
+
+	shared, _ := GenerateChain(genesis.Config, genesisB, engine, db, 10, nil)
+	commonAncestor := shared[len(shared)-1]
+	// A slow current segment spanning a long time, and a faster, heavier proposed one.
+	easy, _ := GenerateChain(genesis.Config, commonAncestor, engine, db, 10, func(i int, b *BlockGen) {
+		b.OffsetTime(1000)
+	})
+	hard, _ := GenerateChain(genesis.Config, commonAncestor, engine, db, 12, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x01})
+	})
+	if _, err := chain.InsertChain(append(shared, easy...)); err != nil {
+		t.Fatal(err)
+	}
+	// The proposed segment is rejected, and retained as a side chain.
+	if _, err := chain.InsertChain(hard); err != nil {
+		t.Fatal(err)
+	}
+	current := chain.CurrentHeader()
+	if current.Hash() != easy[len(easy)-1].Hash() {
+		t.Fatal("proposed segment not rejected without minimum segment length")
+	}
+	const min = 10
+	chain.SetArtificialFinalityMinSegmentLength(min)
+	for i, b := range hard {
+		length := i + 1
+		err := chain.ecbp1100(commonAncestor.Header(), current, b.Header())
+		if length <= min && err != nil {
+			t.Errorf("segment length %d at or below minimum rejected: %v", length, err)
+		}
+		if length > min && !errors.Is(err, ErrArtificialFinalityReject) {
+			t.Errorf("segment length %d above minimum: want %v, got %v", length, ErrArtificialFinalityReject, err)
+		}
+	}
+}
+
+func TestBlockChain_getTDRatio_Window(t *testing.T) {
+	engine := ethash.NewFaker()
+
+	db := rawdb.NewMemoryDatabase()
+	genesis := params.DefaultMessNetGenesisBlock()
+	genesisB := MustCommitGenesis(db, genesis)
+
+	chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+
+	easy, _ := GenerateChain(genesis.Config, genesisB, engine, db, 60, nil)
+	commonAncestor := easy[29]
+	// A noisy proposed segment, alternating between fast and slow blocks.
+	hard, _ := GenerateChain(genesis.Config, commonAncestor, engine, db, 30, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x01})
+		if i%2 == 0 {
+			b.OffsetTime(-9)
+		} else {
+			b.OffsetTime(10)
+		}
+	})
+	if _, err := chain.InsertChain(easy); err != nil {
+		t.Fatal(err)
+	}
+	current := chain.CurrentHeader()
+	if _, err := chain.InsertChain(hard); err != nil {
+		t.Fatal(err)
+	}
+
+	ratios := func(window uint32) []float64 {
+		chain.SetArtificialFinalityTDRatioWindow(window)
+		out := make([]float64, len(hard))
+		for i, b := range hard {
+			out[i] = chain.getTDRatio(commonAncestor.Header(), current, b.Header())
+		}
+		return out
+	}
+	// The variance of the ratio's steps measures the noise.
+	stepVariance := func(rs []float64) float64 {
+		var sum, sq float64
+		for i := 1; i < len(rs); i++ {
+			d := rs[i] - rs[i-1]
+			sum += d
+			sq += d * d
+		}
+		n := float64(len(rs) - 1)
+		return sq/n - (sum/n)*(sum/n)
+	}
+
+	// A window of one block is the plain ratio at the proposed block.
+	localTD := new(big.Int).Sub(chain.GetTd(current.Hash(), current.Number.Uint64()), chain.GetTd(commonAncestor.Hash(), commonAncestor.NumberU64()))
+	single := ratios(1)
+	for i, b := range hard {
+		proposedTD := new(big.Int).Sub(chain.GetTd(b.Hash(), b.NumberU64()), chain.GetTd(commonAncestor.Hash(), commonAncestor.NumberU64()))
+		want, _ := new(big.Float).Quo(new(big.Float).SetInt(proposedTD), new(big.Float).SetInt(localTD)).Float64()
+		if single[i] != want {
+			t.Errorf("block %d: window 1 ratio mismatch: have %v, want %v", i, single[i], want)
+		}
+	}
+	for i, r := range ratios(0) {
+		if r != single[i] {
+			t.Errorf("block %d: window 0 ratio %v differs from window 1 ratio %v", i, r, single[i])
+		}
+	}
+
+	// A larger window smooths out the noise.
+	smoothed := ratios(4)
+	if have, noisy := stepVariance(smoothed[4:]), stepVariance(single[4:]); have >= noisy {
+		t.Errorf("window 4 did not smooth the ratio: step variance %v, want < %v", have, noisy)
+	}
+	// The first blocks average over what is available back to the common ancestor.
+	if smoothed[0] != single[0] {
+		t.Errorf("first block ratio: have %v, want %v", smoothed[0], single[0])
+	}
+}
+
+func TestBlockChain_AF_ECBP1100_MaxFutureTime(t *testing.T) {
+	engine := ethash.NewFaker()
+	genesis := params.DefaultMessNetGenesisBlock()
+
+	gendb := rawdb.NewMemoryDatabase()
+	genesisB := MustCommitGenesis(gendb, genesis)
+	easy, _ := GenerateChain(genesis.Config, genesisB, engine, gendb, 50, nil)
+	// The fork outweighs the local chain, its tip being 45 seconds ahead of the local head.
+	fork, _ := GenerateChain(genesis.Config, easy[39], engine, gendb, 12, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x01})
+		if i == 11 {
+			b.OffsetTime(25)
+		}
+	})
+	// The blockchain's clock is at the local head, the fork's timestamps are in the past
+	// for the consensus engine.
+	clock := frozenClock(time.Unix(int64(easy[len(easy)-1].Time()), 0))
+
+	run := func(enable bool, bound uint32) (*types.Block, error) {
+		db := rawdb.NewMemoryDatabase()
+		MustCommitGenesis(db, genesis)
+		chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer chain.Stop()
+		chain.SetClock(clock)
+		chain.EnableArtificialFinality(enable)
+		chain.SetArtificialFinalityMaxFutureTime(bound)
+
+		if _, err := chain.InsertChain(easy); err != nil {
+			t.Fatal(err)
+		}
+		_, err = chain.InsertChain(fork)
+		return chain.CurrentBlock(), err
+	}
+
+	// Without the strict bound the fork is accepted.
+	if head, err := run(true, 0); err != nil || head.Hash() != fork[len(fork)-1].Hash() {
+		t.Fatalf("no bound: want fork head, got err %v, head #%d", err, head.NumberU64())
+	}
+	// The bound only applies with artificial finality enabled.
+	if head, err := run(false, 30); err != nil || head.Hash() != fork[len(fork)-1].Hash() {
+		t.Fatalf("disabled: want fork head, got err %v, head #%d", err, head.NumberU64())
+	}
+	// Under the strict bound the future block is rejected, its parents are not.
+	head, err := run(true, 30)
+	if !errors.Is(err, ErrArtificialFinalityFutureBlock) {
+		t.Fatalf("want: %v, got: %v", ErrArtificialFinalityFutureBlock, err)
+	}
+	if head.Hash() != fork[len(fork)-2].Hash() {
+		t.Errorf("want head %x, got #%d %x", fork[len(fork)-2].Hash(), head.NumberU64(), head.Hash())
+	}
+}
+
+func TestBlockChain_SimulateInsert(t *testing.T) {
+	engine := ethash.NewFaker()
+	genesis := params.DefaultMessNetGenesisBlock()
+
+	gendb := rawdb.NewMemoryDatabase()
+	genesisB := MustCommitGenesis(gendb, genesis)
+	easy, _ := GenerateChain(genesis.Config, genesisB, engine, gendb, 500, nil)
+
+	for _, c := range []struct {
+		name        string
+		ca, hardLen int
+		hardOffset  int64
+		wantHead    bool
+		wantAccept  bool
+	}{
+		{"accepted", 489, 12, 0, true, true},
+		{"rejected", 249, 250, -9, false, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			hard, _ := GenerateChain(genesis.Config, easy[c.ca], engine, gendb, c.hardLen, func(i int, b *BlockGen) {
+				b.SetCoinbase(common.Address{0x01})
+				b.OffsetTime(c.hardOffset)
+			})
+			for _, policy := range []ArtificialFinalityRejectPolicy{ArtificialFinalityRejectSidechain, ArtificialFinalityRejectError} {
+				db := rawdb.NewMemoryDatabase()
+				MustCommitGenesis(db, genesis)
+				chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				chain.EnableArtificialFinality(true)
+				chain.SetArtificialFinalityRejectPolicy(policy)
+				if _, err := chain.InsertChain(easy); err != nil {
+					t.Fatal(err)
+				}
+				wouldBeHead, messAccept, err := chain.SimulateInsert(hard)
+				if err != nil {
+					t.Fatalf("policy %d: simulate: %v", policy, err)
+				}
+				if wouldBeHead != c.wantHead || messAccept != c.wantAccept {
+					t.Errorf("policy %d: predicted head %v, accept %v, want %v, %v", policy, wouldBeHead, messAccept, c.wantHead, c.wantAccept)
+				}
+				// The simulation leaves the chain untouched.
+				if chain.CurrentBlock().Hash() != easy[len(easy)-1].Hash() {
+					t.Fatalf("policy %d: simulation changed head", policy)
+				}
+				for _, b := range hard {
+					if chain.HasBlock(b.Hash(), b.NumberU64()) {
+						t.Fatalf("policy %d: simulation stored block #%d", policy, b.NumberU64())
+					}
+				}
+				// The predictions match a real insert.
+				_, err = chain.InsertChain(hard)
+				if rejected := errors.Is(err, ErrArtificialFinalityReject); rejected != (!messAccept && policy == ArtificialFinalityRejectError) {
+					t.Errorf("policy %d: insert error %v, predicted accept %v", policy, err, messAccept)
+				} else if err != nil && !rejected {
+					t.Fatalf("policy %d: insert: %v", policy, err)
+				}
+				if isHead := chain.CurrentBlock().Hash() == hard[len(hard)-1].Hash(); isHead != wouldBeHead {
+					t.Errorf("policy %d: head after insert %v, predicted %v", policy, isHead, wouldBeHead)
+				}
+				chain.Stop()
+			}
+		})
+	}
+}
+
+// Tests that the ECBP1100 curve of a fork reports the total difficulties, ratios and
+// antigravity thresholds ECBP1100 computes.
+func TestBlockChain_ArtificialFinalityCurve(t *testing.T) {
+	engine := ethash.NewFaker()
+
+	db := rawdb.NewMemoryDatabase()
+	genesis := params.DefaultMessNetGenesisBlock()
+	genesisB := MustCommitGenesis(db, genesis)
+
+	chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+
+	easy, _ := GenerateChain(genesis.Config, genesisB, engine, db, 20, nil)
+	commonAncestor := easy[9]
+	hard, _ := GenerateChain(genesis.Config, commonAncestor, engine, db, 15, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x01})
+		b.OffsetTime(-9)
+	})
+	if _, err := chain.InsertChain(easy); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.InsertChain(hard); err != nil {
+		t.Fatal(err)
+	}
+	current, proposed := easy[len(easy)-1], hard[len(hard)-1]
+
+	curve, err := chain.ArtificialFinalityCurve(commonAncestor.Hash(), current.Hash(), proposed.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(curve.Numbers) != len(hard) || len(curve.CurrentTDs) != len(hard) || len(curve.ProposedTDs) != len(hard) ||
+		len(curve.TDRatios) != len(hard) || len(curve.Thresholds) != len(hard) {
+		t.Fatalf("curve length mismatch: have %d/%d/%d/%d/%d, want %d", len(curve.Numbers), len(curve.CurrentTDs),
+			len(curve.ProposedTDs), len(curve.TDRatios), len(curve.Thresholds), len(hard))
+	}
+	for i, b := range hard {
+		if curve.Numbers[i] != b.NumberU64() {
+			t.Errorf("depth %d: number mismatch: have %d, want %d", i+1, curve.Numbers[i], b.NumberU64())
+		}
+		if want := chain.GetTd(b.Hash(), b.NumberU64()); curve.ProposedTDs[i].Cmp(want) != 0 {
+			t.Errorf("depth %d: proposed td mismatch: have %v, want %v", i+1, curve.ProposedTDs[i], want)
+		}
+		if n := int(commonAncestor.NumberU64()) + i; n < len(easy) {
+			if want := chain.GetTd(easy[n].Hash(), easy[n].NumberU64()); curve.CurrentTDs[i] == nil || curve.CurrentTDs[i].Cmp(want) != 0 {
+				t.Errorf("depth %d: current td mismatch: have %v, want %v", i+1, curve.CurrentTDs[i], want)
+			}
+		} else if curve.CurrentTDs[i] != nil {
+			t.Errorf("depth %d: current td beyond current head: have %v, want nil", i+1, curve.CurrentTDs[i])
+		}
+		if want := chain.getTDRatio(commonAncestor.Header(), current.Header(), b.Header()); curve.TDRatios[i] != want {
+			t.Errorf("depth %d: td ratio mismatch: have %v, want %v", i+1, curve.TDRatios[i], want)
+		}
+		want, _ := new(big.Float).Quo(
+			new(big.Float).SetInt(ecbp1100PolynomialV(new(big.Int).SetUint64(b.Time()-commonAncestor.Time()))),
+			new(big.Float).SetInt(ecbp1100PolynomialVCurveFunctionDenominator),
+		).Float64()
+		if curve.Thresholds[i] != want {
+			t.Errorf("depth %d: threshold mismatch: have %v, want %v", i+1, curve.Thresholds[i], want)
+		}
+	}
+	// Heads not descending from the common ancestor are refused.
+	if _, err := chain.ArtificialFinalityCurve(hard[0].Hash(), current.Hash(), proposed.Hash()); err == nil {
+		t.Error("curve of unrelated segments returned")
+	}
+}
+
+// Tests that the ECBP1100 decision boundary CSV has a row per segment length, with
+// boundaries growing with the length.
+func TestWriteArtificialFinalityBoundaryCSV(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteArtificialFinalityBoundaryCSV(&buf, 1, 500, 13); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 501 {
+		t.Fatalf("row count mismatch: have %d, want %d", len(rows), 501)
+	}
+	if header := strings.Join(rows[0], ","); header != "segmentLen,minTimeDelta" {
+		t.Fatalf("header mismatch: have %q", header)
+	}
+	var last uint64
+	for i, row := range rows[1:] {
+		length, err := strconv.ParseUint(row[0], 10, 64)
+		if err != nil || length != uint64(i+1) {
+			t.Fatalf("row %d: segment length mismatch: have %q, want %d", i+1, row[0], i+1)
+		}
+		delta, err := strconv.ParseUint(row[1], 10, 64)
+		if err != nil {
+			t.Fatalf("row %d: invalid time delta %q: %v", i+1, row[1], err)
+		}
+		if delta < last {
+			t.Errorf("row %d: boundary decreased: have %d, previous %d", i+1, delta, last)
+		}
+		last = delta
+	}
+	// A single block is rejected once the current segment has two, at double the block time.
+	if have := ArtificialFinalityBoundary(1, 13); have != 26 {
+		t.Errorf("single block boundary mismatch: have %d, want 26", have)
+	}
+	// Beyond the cap of the curve the antigravity threshold is 31, 62000 blocks are
+	// rejected once the current segment has 2001.
+	if have, want := ArtificialFinalityBoundary(62000, 13), uint64(2001*13); have != want {
+		t.Errorf("capped boundary mismatch: have %d, want %d", have, want)
+	}
+}
+
+// Tests that enabling artificial finality far behind the network head is deferred,
+// and that it engages once the node caught up.
+func TestBlockChain_AF_CatchUp(t *testing.T) {
+	engine := ethash.NewFaker()
+
+	db := rawdb.NewMemoryDatabase()
+	genesis := params.DefaultMessNetGenesisBlock()
+	genesisB := MustCommitGenesis(db, genesis)
+
+	chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+
+	blocks, _ := GenerateChain(genesis.Config, genesisB, engine, db, 20, nil)
+	if _, err := chain.InsertChain(blocks[:5]); err != nil {
+		t.Fatal(err)
+	}
+	engaged := make(chan ArtificialFinalityEngagedEvent, 1)
+	sub := chain.SubscribeArtificialFinalityEngaged(engaged)
+	defer sub.Unsubscribe()
+
+	chain.SetArtificialFinalityCatchUp(5)
+	chain.SetArtificialFinalityNetworkHead(20)
+	chain.EnableArtificialFinality(true)
+	if chain.IsArtificialFinalityEnabled() || !chain.IsArtificialFinalityDeferred() {
+		t.Fatalf("far behind: enabled %v, deferred %v, want deferred only", chain.IsArtificialFinalityEnabled(), chain.IsArtificialFinalityDeferred())
+	}
+	// Still further than the catch-up distance behind the network.
+	if _, err := chain.InsertChain(blocks[5:14]); err != nil {
+		t.Fatal(err)
+	}
+	if chain.IsArtificialFinalityEnabled() {
+		t.Fatalf("enabled at #%d, %d blocks behind", chain.CurrentBlock().NumberU64(), 20-chain.CurrentBlock().NumberU64())
+	}
+	select {
+	case ev := <-engaged:
+		t.Fatalf("engaged event while behind: %+v", ev)
+	default:
+	}
+	// Catching up within the distance engages artificial finality. The event is
+	// posted outside the chain lock, which a held up subscriber doesn't hold.
+	held := make(chan ArtificialFinalityEngagedEvent)
+	heldSub := chain.SubscribeArtificialFinalityEngaged(held)
+	defer heldSub.Unsubscribe()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := chain.InsertChain(blocks[14:15])
+		done <- err
+	}()
+	select {
+	case ev := <-engaged:
+		if ev.Number != 15 || ev.NetworkHead != 20 {
+			t.Errorf("engaged event mismatch: have %+v, want head 15, network 20", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no engaged event")
+	}
+	locked := make(chan struct{})
+	go func() {
+		chain.chainmu.Lock()
+		chain.chainmu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("chain lock held while posting the engaged event")
+	}
+	<-held
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	heldSub.Unsubscribe()
+	if !chain.IsArtificialFinalityEnabled() || chain.IsArtificialFinalityDeferred() {
+		t.Fatalf("caught up: enabled %v, deferred %v, want enabled only", chain.IsArtificialFinalityEnabled(), chain.IsArtificialFinalityDeferred())
+	}
+	// Disabling while deferred cancels the engagement.
+	chain.EnableArtificialFinality(false)
+	chain.SetArtificialFinalityNetworkHead(100)
+	chain.EnableArtificialFinality(true)
+	chain.EnableArtificialFinality(false)
+	chain.SetArtificialFinalityNetworkHead(15)
+	if chain.IsArtificialFinalityEnabled() || chain.IsArtificialFinalityDeferred() {
+		t.Fatalf("disabled: enabled %v, deferred %v, want neither", chain.IsArtificialFinalityEnabled(), chain.IsArtificialFinalityDeferred())
+	}
+	// Engaging as the network head is reported only queues the event, posted once
+	// the next insertion returns.
+	chain.SetArtificialFinalityNetworkHead(100)
+	chain.EnableArtificialFinality(true)
+	chain.SetArtificialFinalityNetworkHead(18)
+	if !chain.IsArtificialFinalityEnabled() || chain.IsArtificialFinalityDeferred() {
+		t.Fatalf("network caught up with: enabled %v, deferred %v, want enabled only", chain.IsArtificialFinalityEnabled(), chain.IsArtificialFinalityDeferred())
+	}
+	select {
+	case ev := <-engaged:
+		t.Fatalf("engaged event posted by the setter: %+v", ev)
+	default:
+	}
+	if _, err := chain.InsertChain(blocks[15:16]); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-engaged:
+		if ev.Number != 15 || ev.NetworkHead != 18 {
+			t.Errorf("engaged event mismatch: have %+v, want head 15, network 18", ev)
+		}
+	default:
+		t.Fatal("no engaged event after the insertion")
+	}
+}
+
+func TestBlockChain_AF_ECBP1100_StallWatchdog(t *testing.T) {
+	engine := ethash.NewFaker()
+
+	db := rawdb.NewMemoryDatabase()
+	genesis := params.DefaultMessNetGenesisBlock()
+	genesisB := MustCommitGenesis(db, genesis)
+
+	chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+	chain.EnableArtificialFinality(true)
+	chain.SetArtificialFinalityRejectPolicy(ArtificialFinalityRejectStop)
+
+	easy, _ := GenerateChain(genesis.Config, genesisB, engine, db, 500, func(i int, b *BlockGen) {
+		b.SetNonce(types.EncodeNonce(uint64(rand.Int63n(math.MaxInt64))))
+	})
+	hard, _ := GenerateChain(genesis.Config, easy[249], engine, db, 250, func(i int, b *BlockGen) {
+		b.SetNonce(types.EncodeNonce(uint64(rand.Int63n(math.MaxInt64))))
+		b.OffsetTime(-9)
+	})
+	now := time.Unix(int64(easy[len(easy)-1].Time()), 0)
+	chain.SetClock(frozenClock(now))
+	chain.SetArtificialFinalityStallWatchdog(time.Hour, 3)
+
+	stalled := make(chan ArtificialFinalityStallEvent, 1)
+	sub := chain.SubscribeArtificialFinalityStall(stalled)
+	defer sub.Unsubscribe()
+
+	if _, err := chain.InsertChain(easy); err != nil {
+		t.Fatal(err)
+	}
+	// Repeated rejections do not trip the watchdog before the stall duration passed.
+	for i := 0; i < 3; i++ {
+		chain.SetClock(frozenClock(now.Add(time.Duration(i) * time.Minute)))
+		if _, err := chain.InsertChain(hard); !errors.Is(err, ErrArtificialFinalityReject) {
+			t.Fatalf("attempt %d: want %v, got %v", i, ErrArtificialFinalityReject, err)
+		}
+	}
+	if !chain.IsArtificialFinalityEnabled() {
+		t.Fatal("disabled before stall")
+	}
+	select {
+	case ev := <-stalled:
+		t.Fatalf("stall event before stall: %+v", ev)
+	default:
+	}
+	// Once stalled, the watchdog disables artificial finality and the heaviest chain is followed.
+	chain.SetClock(frozenClock(now.Add(time.Hour)))
+	if _, err := chain.InsertChain(hard); err != nil {
+		t.Fatalf("stalled: %v", err)
+	}
+	if chain.IsArtificialFinalityEnabled() {
+		t.Error("enabled after stall")
+	}
+	if chain.CurrentBlock().Hash() != hard[len(hard)-1].Hash() {
+		t.Error("heaviest chain not followed after stall")
+	}
+	select {
+	case ev := <-stalled:
+		if ev.Number != easy[len(easy)-1].NumberU64() || ev.Stalled != time.Hour || ev.Rejections < 3 {
+			t.Errorf("stall event mismatch: have %+v, want head %d, stalled %v, at least 3 rejections", ev, easy[len(easy)-1].NumberU64(), time.Hour)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no stall event")
+	}
+}
+
+// Tests that the stall watchdog counts a segment rejected block after block by one
+// insertion as one rejection.
+func TestBlockChain_AF_ECBP1100_StallWatchdogPerSegment(t *testing.T) {
+	engine := ethash.NewFaker()
+	genesis := params.DefaultMessNetGenesisBlock()
+
+	gendb := rawdb.NewMemoryDatabase()
+	genesisB := MustCommitGenesis(gendb, genesis)
+	easy, _ := GenerateChain(genesis.Config, genesisB, engine, gendb, 500, nil)
+	fork := func(coinbase byte) []*types.Block {
+		blocks, _ := GenerateChain(genesis.Config, easy[249], engine, gendb, 250, func(i int, b *BlockGen) {
+			b.SetCoinbase(common.Address{coinbase}) // Don't share states with the easy chain
+			b.OffsetTime(-9)
+		})
+		return blocks
+	}
+	db := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(db, genesis)
+	chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+	chain.EnableArtificialFinality(true)
+	chain.SetArtificialFinalityRejectPolicy(ArtificialFinalityRejectSidechain)
+
+	now := time.Unix(int64(easy[len(easy)-1].Time()), 0)
+	chain.SetClock(frozenClock(now))
+	chain.SetArtificialFinalityStallWatchdog(time.Hour, 3)
+
+	stalled := make(chan ArtificialFinalityStallEvent, 1)
+	sub := chain.SubscribeArtificialFinalityStall(stalled)
+	defer sub.Unsubscribe()
+
+	if _, err := chain.InsertChain(easy); err != nil {
+		t.Fatal(err)
+	}
+	// Long stalled, the segments of two insertions are two rejections
+	chain.SetClock(frozenClock(now.Add(2 * time.Hour)))
+	for i := byte(1); i <= 2; i++ {
+		if _, err := chain.InsertChain(fork(i)); err != nil {
+			t.Fatalf("fork %d: %v", i, err)
+		}
+		if !chain.IsArtificialFinalityEnabled() || chain.CurrentBlock().Hash() != easy[len(easy)-1].Hash() {
+			t.Fatalf("fork %d: watchdog tripped by a single segment", i)
+		}
+	}
+	// The third one trips the watchdog
+	blocks := fork(3)
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("fork 3: %v", err)
+	}
+	if chain.IsArtificialFinalityEnabled() {
+		t.Error("enabled after the third rejected segment")
+	}
+	if chain.CurrentBlock().Hash() != blocks[len(blocks)-1].Hash() {
+		t.Error("heaviest chain not followed after stall")
+	}
+	select {
+	case ev := <-stalled:
+		if ev.Rejections != 3 {
+			t.Errorf("stall event rejections: have %d, want 3", ev.Rejections)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no stall event")
+	}
+}
+
+func TestBlockChain_AF_ECBP1100_ThresholdGauges(t *testing.T) {
+	gauges := ecbp1100ThresholdGauges
+	ecbp1100ThresholdGauges = make([]ecbp1100ThresholdGauge, len(gauges))
+	for i, g := range gauges {
+		ecbp1100ThresholdGauges[i] = ecbp1100ThresholdGauge{delta: g.delta, gauge: new(metrics.StandardGaugeFloat64)}
+	}
+	defer func() { ecbp1100ThresholdGauges = gauges }()
+
+	engine := ethash.NewFaker()
+
+	db := rawdb.NewMemoryDatabase()
+	genesis := params.DefaultMessNetGenesisBlock()
+	genesisB := MustCommitGenesis(db, genesis)
+
+	chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+	chain.EnableArtificialFinality(true)
+
+	// MESS is not enforced before its transition. Blocks are 10 minutes apart, so
+	// that the common ancestors of the thresholds differ.
+	blocks, _ := GenerateChain(genesis.Config, genesisB, engine, db, 12, func(i int, b *BlockGen) {
+		b.OffsetTime(590)
+	})
+	if _, err := chain.InsertChain(blocks[:5]); err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range ecbp1100ThresholdGauges {
+		if v := g.gauge.Value(); v != 0 {
+			t.Errorf("threshold for %v before the transition: have %v, want 0", g.delta, v)
+		}
+	}
+	if _, err := chain.InsertChain(blocks[5:]); err != nil {
+		t.Fatal(err)
+	}
+	// Each threshold is the one enforced for a segment forking off the latest block
+	// at least its delta older than the head, the genesis block if there is none.
+	head := blocks[len(blocks)-1]
+	ancestors := map[time.Duration]*types.Block{
+		time.Minute:      blocks[len(blocks)-2],
+		10 * time.Minute: blocks[len(blocks)-2],
+		time.Hour:        blocks[len(blocks)-7],
+		3 * time.Hour:    genesisB,
+		7 * time.Hour:    genesisB,
+	}
+	for _, g := range ecbp1100ThresholdGauges {
+		ancestor := ancestors[g.delta]
+		if ancestor != genesisB && ancestor.Time() > head.Time()-uint64(g.delta.Seconds()) {
+			t.Fatalf("ancestor #%d for %v newer than the delta", ancestor.NumberU64(), g.delta)
+		}
+		x := new(big.Int).SetUint64(head.Time() - ancestor.Time())
+		want, _ := new(big.Float).Quo(new(big.Float).SetInt(ecbp1100PolynomialV(x)), big.NewFloat(128)).Float64()
+		if have := g.gauge.Value(); have != want {
+			t.Errorf("threshold for %v: have %v, want %v", g.delta, have, want)
+		}
+	}
+	if low, high := ecbp1100ThresholdGauges[0].gauge.Value(), ecbp1100ThresholdGauges[len(ecbp1100ThresholdGauges)-1].gauge.Value(); low >= high {
+		t.Errorf("threshold not rising with the common ancestor's age: %v >= %v", low, high)
+	}
+}
+
+// Tests that artificial finality decides on the TD ratio averaged over the window: a
+// proposed segment whose ratio at its head meets the threshold, but not on average
+// over the window, is rejected.
+func TestBlockChain_AF_ECBP1100_TDRatioWindow(t *testing.T) {
+	engine := ethash.NewFaker()
+	genesis := params.DefaultMessNetGenesisBlock()
+
+	gendb := rawdb.NewMemoryDatabase()
+	genesisB := MustCommitGenesis(gendb, genesis)
+	easy, _ := GenerateChain(genesis.Config, genesisB, engine, gendb, 100, nil)
+	hard, _ := GenerateChain(genesis.Config, easy[49], engine, gendb, 51, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x01})
+		b.OffsetTime(-8)
+	})
+	for _, tt := range []struct {
+		window   uint32
+		accepted bool
+	}{
+		{1, true},
+		{8, false},
+	} {
+		db := rawdb.NewMemoryDatabase()
+		MustCommitGenesis(db, genesis)
+		chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := chain.InsertChain(easy); err != nil {
+			t.Fatalf("failed to insert block %d: %v", n, err)
+		}
+		chain.EnableArtificialFinality(true)
+		chain.SetArtificialFinalityRejectPolicy(ArtificialFinalityRejectSidechain)
+		chain.SetArtificialFinalityTDRatioWindow(tt.window)
+
+		// The segment is rejected up to its last block, which meets the threshold
+		if n, err := chain.InsertChain(hard); err != nil {
+			t.Fatalf("window %d: failed to insert block %d: %v", tt.window, n, err)
+		}
+		want := easy[len(easy)-1].Hash()
+		if tt.accepted {
+			want = hard[len(hard)-1].Hash()
+		}
+		if head := chain.CurrentBlock().Hash(); head != want {
+			t.Errorf("window %d: head mismatch: have %x, want %x (accepted %v)", tt.window, head, want, tt.accepted)
+		}
+		chain.Stop()
+	}
+}
@@ -0,0 +1,75 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// ErrAncientDrift is returned by chain insertions once the periodic consistency check
+// found the ancient store ahead of the header chain, if configured to halt on it.
+var ErrAncientDrift = errors.New("ancient store drifted ahead of the header chain")
+
+// ancientConsistencyCheck periodically asserts the ancient store is consistent with
+// the header chain during chain insertions.
+type ancientConsistencyCheck struct {
+	interval uint64 // Number of chain insertions between checks, 0 if disabled
+	halt     bool   // Whether chain insertions are refused once drift is detected
+	inserts  uint64 // Number of chain insertions since the last check
+	drift    error  // Drift detected under halt, refusing chain insertions
+	lock     sync.Mutex
+}
+
+// SetAncientConsistencyCheck makes every interval-th chain insertion, of blocks,
+// receipts or headers, check that the ancient store holds no blocks above the header
+// chain's head before it starts, a lighter version of the check repairing the chain
+// on startup which catches the key-value store and the ancient store drifting apart
+// during long syncs early. Drift is logged; if halt is set, that insertion and all
+// the following ones fail with an error wrapping ErrAncientDrift until the chain is
+// restarted, which repairs it. An interval of 0 disables the check, which is the
+// default.
+func (bc *BlockChain) SetAncientConsistencyCheck(interval uint64, halt bool) {
+	bc.ancientCheck.lock.Lock()
+	defer bc.ancientCheck.lock.Unlock()
+
+	bc.ancientCheck.interval, bc.ancientCheck.halt = interval, halt
+	bc.ancientCheck.inserts = 0
+	log.Info("Ancient consistency check configured", "interval", interval, "halt", halt)
+}
+
+// checkAncientDrift runs the periodic consistency check of the ancient store, if
+// due, returning an error wrapping ErrAncientDrift if insertions are to halt.
+func (bc *BlockChain) checkAncientDrift() error {
+	check := bc.ancientCheck
+
+	check.lock.Lock()
+	defer check.lock.Unlock()
+
+	if check.drift != nil {
+		return check.drift
+	}
+	if check.interval == 0 {
+		return nil
+	}
+	if check.inserts++; check.inserts < check.interval {
+		return nil
+	}
+	check.inserts = 0
+
+	frozen, err := bc.db.Ancients()
+	if err != nil || frozen == 0 {
+		return nil
+	}
+	head := bc.CurrentHeader().Number.Uint64()
+	if frozen <= head+1 {
+		return nil
+	}
+	log.Error("Ancient store drifted ahead of the header chain", "ancients", frozen, "head", head, "halt", check.halt)
+	if !check.halt {
+		return nil
+	}
+	check.drift = fmt.Errorf("%w: %d ancients, header head #%d", ErrAncientDrift, frozen, head)
+	return check.drift
+}
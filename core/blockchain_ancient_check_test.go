@@ -0,0 +1,119 @@
+package core
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/params/types/genesisT"
+)
+
+// Tests that the periodic consistency check detects the ancient store drifting
+// ahead of the header chain, halting insertions only if configured to.
+func TestAncientConsistencyCheck(t *testing.T) {
+	// Count the drifts detected
+	var drifts int32
+	defer log.Root().SetHandler(log.Root().GetHandler())
+	log.Root().SetHandler(log.FuncHandler(func(r *log.Record) error {
+		if r.Msg == "Ancient store drifted ahead of the header chain" {
+			atomic.AddInt32(&drifts, 1)
+		}
+		return nil
+	}))
+	for _, halt := range []bool{false, true} {
+		atomic.StoreInt32(&drifts, 0)
+
+		var (
+			engine  = ethash.NewFaker()
+			gspec   = &genesisT.Genesis{Config: params.TestChainConfig}
+			gendb   = rawdb.NewMemoryDatabase()
+			genesis = MustCommitGenesis(gendb, gspec)
+		)
+		blocks, receipts := GenerateChain(gspec.Config, genesis, engine, gendb, 10, nil)
+
+		frdir, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatalf("failed to create temp freezer dir: %v", err)
+		}
+		defer os.RemoveAll(frdir)
+		db, err := rawdb.NewDatabaseWithFreezer(rawdb.NewMemoryDatabase(), frdir, "")
+		if err != nil {
+			t.Fatalf("failed to create temp freezer db: %v", err)
+		}
+		defer db.Close()
+		MustCommitGenesis(db, gspec)
+		chain, err := NewBlockChain(db, nil, gspec.Config, engine, vm.Config{}, nil, nil)
+		if err != nil {
+			t.Fatalf("failed to create tester chain: %v", err)
+		}
+		defer chain.Stop()
+		chain.SetAncientConsistencyCheck(2, halt)
+
+		if _, err := chain.InsertChain(blocks); err != nil {
+			t.Fatalf("failed to insert chain: %v", err)
+		}
+		// Freeze the chain, the second insertion checks the consistent ancients
+		rawdb.WriteAncientBlock(db, genesis, nil, chain.GetTd(genesis.Hash(), 0))
+		for i, block := range blocks {
+			rawdb.WriteAncientBlock(db, block, receipts[i], chain.GetTd(block.Hash(), block.NumberU64()))
+		}
+		head := blocks[len(blocks)-1:]
+		if _, err := chain.InsertChain(head); err != nil {
+			t.Fatalf("halt %v: checked insertion with consistent ancients failed: %v", halt, err)
+		}
+		// Rewind the header chain behind the ancients, only every second insertion checks
+		chain.hc.SetCurrentHeader(blocks[4].Header())
+
+		if _, err := chain.InsertChain(head); err != nil {
+			t.Fatalf("halt %v: unchecked insertion failed: %v", halt, err)
+		}
+		_, err = chain.InsertChain(head)
+		if n := atomic.LoadInt32(&drifts); n != 1 {
+			t.Fatalf("halt %v: drifts detected: have %d, want 1", halt, n)
+		}
+		headers := []*types.Header{head[0].Header()}
+		if halt {
+			if !errors.Is(err, ErrAncientDrift) {
+				t.Fatalf("halt %v: checked insertion: want %v, got %v", halt, ErrAncientDrift, err)
+			}
+			// Once halted, all insertions fail
+			if _, err := chain.InsertChain(head); !errors.Is(err, ErrAncientDrift) {
+				t.Fatalf("halt %v: insertion after drift: want %v, got %v", halt, ErrAncientDrift, err)
+			}
+			if _, err := chain.InsertHeaderChain(headers, 1); !errors.Is(err, ErrAncientDrift) {
+				t.Fatalf("halt %v: header insertion after drift: want %v, got %v", halt, ErrAncientDrift, err)
+			}
+			if _, err := chain.InsertReceiptChain(head, receipts[len(receipts)-1:], 0); !errors.Is(err, ErrAncientDrift) {
+				t.Fatalf("halt %v: receipt insertion after drift: want %v, got %v", halt, ErrAncientDrift, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("halt %v: checked insertion failed: %v", halt, err)
+		}
+		// Header and receipt insertions are checked too
+		chain.SetAncientConsistencyCheck(1, halt)
+		chain.hc.SetCurrentHeader(blocks[4].Header())
+		if _, err := chain.InsertHeaderChain(headers, 1); err != nil {
+			t.Fatalf("halt %v: checked header insertion failed: %v", halt, err)
+		}
+		if n := atomic.LoadInt32(&drifts); n != 2 {
+			t.Fatalf("halt %v: drifts detected by header insertion: have %d, want 2", halt, n)
+		}
+		chain.hc.SetCurrentHeader(blocks[4].Header())
+		if _, err := chain.InsertReceiptChain(head, receipts[len(receipts)-1:], 0); err != nil {
+			t.Fatalf("halt %v: checked receipt insertion failed: %v", halt, err)
+		}
+		if n := atomic.LoadInt32(&drifts); n != 3 {
+			t.Fatalf("halt %v: drifts detected by receipt insertion: have %d, want 3", halt, n)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package core
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/params/types/genesisT"
+)
+
+// testDiskSpace is a rawdb.DiskSpaceReporter of a fixed free space.
+type testDiskSpace struct {
+	free   uint64
+	checks uint64 // Number of checks of the free space (atomic)
+}
+
+func (s *testDiskSpace) FreeDiskSpace() (uint64, error) {
+	atomic.AddUint64(&s.checks, 1)
+	return s.free, nil
+}
+
+// Tests that block imports are paused while the disk guard of the ancient store
+// reports low free space, until the chain is stopped.
+func TestInsertChainDiskGuard(t *testing.T) {
+	var (
+		gspec   = &genesisT.Genesis{Config: params.TestChainConfig}
+		gendb   = rawdb.NewMemoryDatabase()
+		genesis = MustCommitGenesis(gendb, gspec)
+	)
+	blocks, _ := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), gendb, 8, nil)
+
+	frdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp freezer dir: %v", err)
+	}
+	defer os.RemoveAll(frdir)
+	db, err := rawdb.NewDatabaseWithFreezer(rawdb.NewMemoryDatabase(), frdir, "")
+	if err != nil {
+		t.Fatalf("failed to create temp freezer db: %v", err)
+	}
+	defer db.Close()
+	MustCommitGenesis(db, gspec)
+	chain, err := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+
+	space := &testDiskSpace{free: 1024}
+	if err := db.(interface {
+		SetDiskGuard(threshold uint64, reporter rawdb.DiskSpaceReporter) error
+	}).SetDiskGuard(4096, space); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := chain.InsertChain(blocks)
+		done <- err
+	}()
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadUint64(&space.checks) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("free disk space not checked")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("import not paused: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if head := chain.CurrentBlock().NumberU64(); head != 0 {
+		t.Fatalf("imported up to #%d while paused", head)
+	}
+	// The paused import doesn't hold the chain lock
+	locked := make(chan struct{})
+	go func() {
+		chain.chainmu.Lock()
+		chain.chainmu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("chain lock held by the paused import")
+	}
+	// Stopping the chain interrupts the paused import
+	chain.Stop()
+	select {
+	case err := <-done:
+		if err != errInsertionInterrupted {
+			t.Errorf("paused import: want %v, got %v", errInsertionInterrupted, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("paused import not interrupted")
+	}
+	if head := chain.CurrentBlock().NumberU64(); head != 0 {
+		t.Errorf("imported up to #%d while paused", head)
+	}
+}
+
+// lowingDiskSpace is a rawdb.DiskSpaceReporter reporting low free space after a
+// number of checks.
+type lowingDiskSpace struct {
+	checks uint64 // Number of checks of the free space (atomic)
+	after  uint64 // Number of checks reporting enough free space
+}
+
+func (s *lowingDiskSpace) FreeDiskSpace() (uint64, error) {
+	if atomic.AddUint64(&s.checks, 1) > s.after {
+		return 1024, nil
+	}
+	return 8192, nil
+}
+
+// Tests that block imports running low on disk space while holding the chain lock
+// abort instead of waiting for it to recover.
+func TestInsertChainDiskGuardLocked(t *testing.T) {
+	var (
+		gspec   = &genesisT.Genesis{Config: params.TestChainConfig}
+		gendb   = rawdb.NewMemoryDatabase()
+		genesis = MustCommitGenesis(gendb, gspec)
+	)
+	blocks, _ := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), gendb, 8, nil)
+
+	frdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp freezer dir: %v", err)
+	}
+	defer os.RemoveAll(frdir)
+	db, err := rawdb.NewDatabaseWithFreezer(rawdb.NewMemoryDatabase(), frdir, "")
+	if err != nil {
+		t.Fatalf("failed to create temp freezer db: %v", err)
+	}
+	defer db.Close()
+	MustCommitGenesis(db, gspec)
+	chain, err := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+
+	// The check before taking the lock and those of the first 3 blocks pass
+	space := &lowingDiskSpace{after: 4}
+	if err := db.(interface {
+		SetDiskGuard(threshold uint64, reporter rawdb.DiskSpaceReporter) error
+	}).SetDiskGuard(4096, space); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	var n int
+	go func() {
+		var err error
+		n, err = chain.InsertChain(blocks)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrLowDiskSpace) {
+			t.Fatalf("import error: want %v, got %v", ErrLowDiskSpace, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("import waiting for disk space while holding the chain lock")
+	}
+	if n != 3 {
+		t.Errorf("failing block: have %d, want 3", n)
+	}
+	if head := chain.CurrentBlock().NumberU64(); head != 3 {
+		t.Errorf("head block: have #%d, want #3", head)
+	}
+}
@@ -0,0 +1,95 @@
+package core
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// ErrInsertQueueFull is returned by chain insertions when the configured number of
+// insertions is already waiting for the chain.
+var ErrInsertQueueFull = errors.New("chain insertion queue full")
+
+// InsertPriority orders the chain insertions waiting for an ongoing one to finish.
+type InsertPriority int
+
+const (
+	// InsertPriorityNetwork is the priority of blocks received from the network,
+	// used by InsertChain. This is the default.
+	InsertPriorityNetwork InsertPriority = iota
+
+	// InsertPriorityLocal is the priority of locally produced blocks, eg. mined
+	// ones, which are inserted before any waiting network blocks.
+	InsertPriorityLocal
+
+	insertPriorities // Number of priorities
+)
+
+// insertQueue admits chain insertions one at a time, first by priority, then in the
+// order they arrived in.
+type insertQueue struct {
+	limit   int                               // Maximum number of waiting insertions, 0 if unlimited
+	busy    bool                              // Whether an insertion is admitted
+	waiting [insertPriorities][]chan struct{} // Waiting insertions by priority, oldest first
+	lock    sync.Mutex
+}
+
+// acquire waits until the insertion of the given priority is admitted, or returns
+// ErrInsertQueueFull if too many insertions are waiting already.
+func (q *insertQueue) acquire(priority InsertPriority) error {
+	if priority < 0 || priority >= insertPriorities {
+		priority = InsertPriorityNetwork
+	}
+	q.lock.Lock()
+	if !q.busy {
+		q.busy = true
+		q.lock.Unlock()
+		return nil
+	}
+	if q.limit > 0 && q.waiters() >= q.limit {
+		q.lock.Unlock()
+		return ErrInsertQueueFull
+	}
+	admit := make(chan struct{})
+	q.waiting[priority] = append(q.waiting[priority], admit)
+	q.lock.Unlock()
+
+	<-admit
+	return nil
+}
+
+// release finishes the admitted insertion, handing over to the next waiting one.
+func (q *insertQueue) release() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for priority := insertPriorities - 1; priority >= 0; priority-- {
+		if waiting := q.waiting[priority]; len(waiting) > 0 {
+			q.waiting[priority] = waiting[1:]
+			close(waiting[0])
+			return
+		}
+	}
+	q.busy = false
+}
+
+// waiters returns the number of waiting insertions. The lock must be held.
+func (q *insertQueue) waiters() int {
+	var n int
+	for _, waiting := range q.waiting {
+		n += len(waiting)
+	}
+	return n
+}
+
+// SetInsertQueueLimit limits the number of chain insertions waiting for an ongoing
+// one to finish to limit, rejecting the excess ones with ErrInsertQueueFull. A limit
+// of 0 removes the limit, which is the default.
+func (bc *BlockChain) SetInsertQueueLimit(limit int) {
+	bc.inserts.lock.Lock()
+	defer bc.inserts.lock.Unlock()
+
+	bc.inserts.limit = limit
+	log.Info("Chain insertion queue limit configured", "limit", limit)
+}
@@ -0,0 +1,121 @@
+package core
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/params/types/genesisT"
+)
+
+// waitInsertQueue waits until n insertions are waiting in the queue.
+func waitInsertQueue(t *testing.T, q *insertQueue, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		q.lock.Lock()
+		waiting := q.waiters()
+		q.lock.Unlock()
+		if waiting == n {
+			return
+		}
+	}
+	t.Fatalf("insertions not queued: want %d", n)
+}
+
+// Tests that a high priority insertion is admitted before a flood of low priority
+// ones waiting already, which are admitted in the order they arrived in.
+func TestInsertQueuePriority(t *testing.T) {
+	var (
+		queue = new(insertQueue)
+		order []int
+		lock  sync.Mutex
+		wg    sync.WaitGroup
+	)
+	// insert queues an insertion, recording its id once admitted.
+	insert := func(id int, priority InsertPriority) {
+		defer wg.Done()
+		if err := queue.acquire(priority); err != nil {
+			t.Error(err)
+			return
+		}
+		lock.Lock()
+		order = append(order, id)
+		lock.Unlock()
+		queue.release()
+	}
+	// Hold the queue while flooding it with low priority insertions
+	if err := queue.acquire(InsertPriorityNetwork); err != nil {
+		t.Fatal(err)
+	}
+	const flood = 32
+	for i := 1; i <= flood; i++ {
+		wg.Add(1)
+		go insert(i, InsertPriorityNetwork)
+		waitInsertQueue(t, queue, i)
+	}
+	wg.Add(1)
+	go insert(0, InsertPriorityLocal)
+	waitInsertQueue(t, queue, flood+1)
+
+	queue.release()
+	wg.Wait()
+
+	want := make([]int, flood+1)
+	for i := range want {
+		want[i] = i
+	}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("admission order mismatch: have %v, want %v", order, want)
+	}
+	if queue.busy {
+		t.Errorf("queue busy after all insertions finished")
+	}
+}
+
+// Tests that insertions beyond the queue limit are rejected.
+func TestInsertQueueLimit(t *testing.T) {
+	var (
+		engine  = ethash.NewFaker()
+		gspec   = &genesisT.Genesis{Config: params.TestChainConfig}
+		gendb   = rawdb.NewMemoryDatabase()
+		genesis = MustCommitGenesis(gendb, gspec)
+	)
+	blocks, _ := GenerateChain(gspec.Config, genesis, engine, gendb, 2, nil)
+
+	db := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(db, gspec)
+	chain, err := NewBlockChain(db, nil, gspec.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	defer chain.Stop()
+	chain.SetInsertQueueLimit(1)
+
+	// Occupy the chain, queue one insertion and overflow the queue with another
+	if err := chain.inserts.acquire(InsertPriorityNetwork); err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := chain.InsertChain(blocks)
+		errc <- err
+	}()
+	waitInsertQueue(t, chain.inserts, 1)
+
+	if _, err := chain.InsertChainWithPriority(blocks, InsertPriorityLocal); !errors.Is(err, ErrInsertQueueFull) {
+		t.Fatalf("overflowing insertion: want %v, got %v", ErrInsertQueueFull, err)
+	}
+	chain.inserts.release()
+	if err := <-errc; err != nil {
+		t.Fatalf("queued insertion failed: %v", err)
+	}
+	if head := chain.CurrentBlock().NumberU64(); head != 2 {
+		t.Errorf("head mismatch: have #%d, want #2", head)
+	}
+}
@@ -0,0 +1,194 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// logRangeCacheLimit is the number of LogsForRange queries whose matched logs are
+// retained.
+const logRangeCacheLimit = 32
+
+// logRangeKey identifies a LogsForRange query. The canonical hash of the last block
+// of the range pins the whole range, so queries are not served across reorgs.
+type logRangeKey struct {
+	from, to uint64
+	head     common.Hash // Canonical hash of block to
+	filter   string      // Addresses and topics of the query, serialized
+}
+
+// newLogRangeKey returns the cache key of a LogsForRange query.
+func newLogRangeKey(from, to uint64, head common.Hash, addresses []common.Address, topics [][]common.Hash) logRangeKey {
+	var filter strings.Builder
+	for _, addr := range addresses {
+		filter.Write(addr.Bytes())
+	}
+	for _, sub := range topics {
+		filter.WriteByte('|')
+		for _, topic := range sub {
+			filter.Write(topic.Bytes())
+		}
+	}
+	return logRangeKey{from: from, to: to, head: head, filter: filter.String()}
+}
+
+// LogsForRange returns the logs of the canonical blocks from and up to to (inclusive)
+// emitted by one of the addresses, if any are given, and matching the topics, with
+// the semantics of eth_getLogs: every position of topics lists the alternatives
+// accepted at that position, an empty list accepting any topic. Blocks are skipped
+// by their header's bloom before their receipts are read, from the freezer for the
+// frozen ones, whose logs are read through the log index of the ancient store instead
+// if it's enabled, see rawdb.EnableAncientLogIndex. The logs matched by the last
+// logRangeCacheLimit queries are cached.
+func (bc *BlockChain) LogsForRange(from, to uint64, addresses []common.Address, topics [][]common.Hash) ([]*types.Log, error) {
+	if from > to {
+		return nil, fmt.Errorf("invalid log range #%d-#%d", from, to)
+	}
+	if head := bc.CurrentFastBlock().NumberU64(); to > head {
+		return nil, fmt.Errorf("log range #%d-#%d beyond head #%d", from, to, head)
+	}
+	headHash := rawdb.ReadCanonicalHash(bc.db, to)
+	if headHash == (common.Hash{}) {
+		return nil, fmt.Errorf("canonical hash #%d not found", to)
+	}
+	key := newLogRangeKey(from, to, headHash, addresses, topics)
+	if logs, ok := bc.logRanges.Get(key); ok {
+		return append([]*types.Log{}, logs.([]*types.Log)...), nil
+	}
+	var logs []*types.Log
+	frozen, _ := bc.db.Ancients()
+	for number := from; number <= to; number++ {
+		header := bc.GetHeaderByNumber(number)
+		if header == nil {
+			return nil, fmt.Errorf("canonical header #%d not found", number)
+		}
+		if !logsBloomMatch(header.Bloom, addresses, topics) {
+			continue
+		}
+		if number < frozen {
+			matched, err := bc.frozenLogs(header, addresses, topics)
+			if err == nil {
+				logs = append(logs, matched...)
+				continue
+			}
+			if !errors.Is(err, rawdb.ErrLogsNotIndexed) {
+				return nil, err
+			}
+		}
+		receipts := bc.GetReceiptsByHash(header.Hash())
+		if receipts == nil {
+			return nil, fmt.Errorf("receipts #%d [%x] not found", number, header.Hash())
+		}
+		for _, receipt := range receipts {
+			for _, log := range receipt.Logs {
+				if logMatch(log, addresses, topics) {
+					logs = append(logs, log)
+				}
+			}
+		}
+	}
+	// Don't cache logs of a range reorged while it was read.
+	if rawdb.ReadCanonicalHash(bc.db, to) == headHash {
+		bc.logRanges.Add(key, logs)
+	}
+	return append([]*types.Log{}, logs...), nil
+}
+
+// frozenLogs returns the logs of the frozen block of the header emitted by one of the
+// addresses and matching the topics, read through the log index of the ancient store,
+// see LogsForRange. The block's body is only read to populate the transaction hashes
+// of matching logs. rawdb.ErrLogsNotIndexed is returned if the block is not indexed.
+func (bc *BlockChain) frozenLogs(header *types.Header, addresses []common.Address, topics [][]common.Hash) ([]*types.Log, error) {
+	indexed, err := rawdb.ReadAncientLogs(bc.db, header.Hash(), header.Number.Uint64())
+	if err != nil {
+		return nil, err
+	}
+	var logs []*types.Log
+	for _, log := range indexed {
+		if logMatch(log, addresses, topics) {
+			logs = append(logs, log)
+		}
+	}
+	if len(logs) == 0 {
+		return nil, nil
+	}
+	body := bc.GetBody(header.Hash())
+	if body == nil {
+		return nil, fmt.Errorf("body #%d [%x] not found", header.Number, header.Hash())
+	}
+	for _, log := range logs {
+		if int(log.TxIndex) >= len(body.Transactions) {
+			return nil, fmt.Errorf("log %d of block #%d [%x] beyond its transactions", log.Index, header.Number, header.Hash())
+		}
+		log.TxHash = body.Transactions[log.TxIndex].Hash()
+	}
+	return logs, nil
+}
+
+// logsBloomMatch reports whether a block of the given bloom may contain logs emitted
+// by one of the addresses and matching the topics, see LogsForRange.
+func logsBloomMatch(bloom types.Bloom, addresses []common.Address, topics [][]common.Hash) bool {
+	if len(addresses) > 0 {
+		var included bool
+		for _, addr := range addresses {
+			if types.BloomLookup(bloom, addr) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+	for _, sub := range topics {
+		included := len(sub) == 0 // Empty alternatives accept any topic
+		for _, topic := range sub {
+			if types.BloomLookup(bloom, topic) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+	return true
+}
+
+// logMatch reports whether the log was emitted by one of the addresses and matches
+// the topics, see LogsForRange.
+func logMatch(log *types.Log, addresses []common.Address, topics [][]common.Hash) bool {
+	if len(addresses) > 0 {
+		var included bool
+		for _, addr := range addresses {
+			if log.Address == addr {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+	if len(topics) > len(log.Topics) {
+		return false
+	}
+	for i, sub := range topics {
+		match := len(sub) == 0 // Empty alternatives accept any topic
+		for _, topic := range sub {
+			if log.Topics[i] == topic {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false
+		}
+	}
+	return true
+}
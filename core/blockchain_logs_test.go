@@ -0,0 +1,118 @@
+package core
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/params/types/genesisT"
+)
+
+// Tests that the logs of a range spanning the freezer and the key-value store match
+// those filtered from the receipts manually, and are served from the cache again.
+func TestLogsForRange(t *testing.T) {
+	var (
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		addr    = crypto.PubkeyToAddress(key.PublicKey)
+		gspec   = &genesisT.Genesis{Config: params.TestChainConfig, Alloc: genesisT.GenesisAlloc{addr: {Balance: big.NewInt(10000000000000)}}}
+		gendb   = rawdb.NewMemoryDatabase()
+		genesis = MustCommitGenesis(gendb, gspec)
+		signer  = types.NewEIP155Signer(gspec.Config.GetChainID())
+	)
+	// Every other block deploys a contract emitting a log
+	blocks, receipts := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), gendb, 32, func(i int, gen *BlockGen) {
+		if i%2 == 0 {
+			tx, err := types.SignTx(types.NewContractCreation(gen.TxNonce(addr), new(big.Int), 1000000, new(big.Int), logCode), signer, key)
+			if err != nil {
+				t.Fatalf("failed to create tx: %v", err)
+			}
+			gen.AddTx(tx)
+		}
+	})
+	frdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp freezer dir: %v", err)
+	}
+	defer os.RemoveAll(frdir)
+	db, err := rawdb.NewDatabaseWithFreezer(rawdb.NewMemoryDatabase(), frdir, "")
+	if err != nil {
+		t.Fatalf("failed to create temp freezer db: %v", err)
+	}
+	defer db.Close()
+	MustCommitGenesis(db, gspec)
+	chain, _ := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, nil)
+	defer chain.Stop()
+
+	headers := make([]*types.Header, len(blocks))
+	for i, block := range blocks {
+		headers[i] = block.Header()
+	}
+	if n, err := chain.InsertHeaderChain(headers, 1); err != nil {
+		t.Fatalf("failed to insert header %d: %v", n, err)
+	}
+	if n, err := chain.InsertReceiptChain(blocks, receipts, 16); err != nil {
+		t.Fatalf("failed to insert receipt %d: %v", n, err)
+	}
+	if frozen, _ := db.Ancients(); frozen <= 8 || frozen > 24 {
+		t.Fatalf("freeze boundary #%d outside the queried range", frozen)
+	}
+	var (
+		topic    = receipts[0][0].Logs[0].Topics[0]
+		contract = receipts[10][0].Logs[0].Address
+	)
+	tests := []struct {
+		addresses []common.Address
+		topics    [][]common.Hash
+		logs      int
+	}{
+		{nil, nil, 8},
+		{nil, [][]common.Hash{{topic}}, 8},
+		{[]common.Address{contract}, nil, 1},
+		{[]common.Address{contract, addr}, [][]common.Hash{{}}, 1},
+		{nil, [][]common.Hash{{common.Hash{1}}}, 0},
+		{nil, [][]common.Hash{{topic}, {topic}}, 0},
+	}
+	for i, tt := range tests {
+		var want []*types.Log
+		for number := uint64(8); number <= 24; number++ {
+			hash := rawdb.ReadCanonicalHash(db, number)
+			for _, receipt := range rawdb.ReadReceipts(db, hash, number, gspec.Config) {
+				for _, log := range receipt.Logs {
+					if logMatch(log, tt.addresses, tt.topics) {
+						want = append(want, log)
+					}
+				}
+			}
+		}
+		if len(want) != tt.logs {
+			t.Fatalf("test %d: filtered %d logs manually, want %d", i, len(want), tt.logs)
+		}
+		for _, pass := range []string{"read", "cached"} {
+			have, err := chain.LogsForRange(8, 24, tt.addresses, tt.topics)
+			if err != nil {
+				t.Fatalf("test %d, %s: %v", i, pass, err)
+			}
+			if len(have) != len(want) || (len(want) > 0 && !reflect.DeepEqual(have, want)) {
+				t.Errorf("test %d, %s: have %d logs, want %d", i, pass, len(have), len(want))
+			}
+		}
+	}
+	if chain.logRanges.Len() != len(tests) {
+		t.Errorf("cached ranges mismatch: have %d, want %d", chain.logRanges.Len(), len(tests))
+	}
+	if _, err := chain.LogsForRange(24, 8, nil, nil); err == nil {
+		t.Errorf("inverted range accepted")
+	}
+	if _, err := chain.LogsForRange(8, 33, nil, nil); err == nil {
+		t.Errorf("range beyond the head accepted")
+	}
+}
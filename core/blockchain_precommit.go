@@ -0,0 +1,42 @@
+package core
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// PreCommitHook is called with every block imported and its receipts just before
+// they are written, see SetPreCommitHook. An error aborts the write.
+type PreCommitHook func(block *types.Block, receipts types.Receipts) error
+
+// preCommitHookHolder wraps a PreCommitHook, so that nil hooks can be stored in an
+// atomic.Value too.
+type preCommitHookHolder struct {
+	PreCommitHook
+}
+
+// SetPreCommitHook sets a hook called with every block and its receipts just before
+// they are written to the database, eg. for indexers to prepare derived data along
+// with the write. The hook is called for the blocks of all insertion methods: those
+// processed with their state, side chain blocks written without it, whose receipts
+// are nil as they weren't computed, and the blocks InsertReceiptChain writes with
+// their receipts. It is called holding the chain lock, apart from InsertReceiptChain,
+// which doesn't take it, so it must not block for long nor access the chain's
+// insertion methods. An error returned by the hook aborts the write, failing the
+// insertion with it. A nil hook, the default, removes the hook.
+func (bc *BlockChain) SetPreCommitHook(hook PreCommitHook) {
+	bc.preCommitHook.Store(preCommitHookHolder{hook})
+}
+
+// preCommit calls the pre-commit hook, if any, with the block about to be written.
+func (bc *BlockChain) preCommit(block *types.Block, receipts types.Receipts) error {
+	hook := bc.preCommitHook.Load().(preCommitHookHolder).PreCommitHook
+	if hook == nil {
+		return nil
+	}
+	if err := hook(block, receipts); err != nil {
+		return fmt.Errorf("pre-commit hook aborted block #%d [%x]: %w", block.NumberU64(), block.Hash(), err)
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package core
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/params/types/genesisT"
+)
+
+// Tests that a pre-commit hook sees every block before it's written, and that an
+// error returned by it keeps the block from being written.
+func TestPreCommitHook(t *testing.T) {
+	var (
+		gspec   = &genesisT.Genesis{Config: params.TestChainConfig}
+		gendb   = rawdb.NewMemoryDatabase()
+		genesis = MustCommitGenesis(gendb, gspec)
+	)
+	blocks, _ := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), gendb, 10, nil)
+
+	db := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(db, gspec)
+	chain, err := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	defer chain.Stop()
+
+	errAbort := errors.New("abort")
+	var seen []uint64
+	chain.SetPreCommitHook(func(block *types.Block, receipts types.Receipts) error {
+		if len(receipts) != len(block.Transactions()) {
+			t.Errorf("block #%d: %d receipts, want %d", block.NumberU64(), len(receipts), len(block.Transactions()))
+		}
+		// The block is not written yet
+		if chain.HasBlock(block.Hash(), block.NumberU64()) {
+			t.Errorf("block #%d written before the hook", block.NumberU64())
+		}
+		seen = append(seen, block.NumberU64())
+		if block.NumberU64() == 5 {
+			return errAbort
+		}
+		return nil
+	})
+	if n, err := chain.InsertChain(blocks); !errors.Is(err, errAbort) || n != 4 {
+		t.Fatalf("insertion: have index %d (err %v), want 4 (%v)", n, err, errAbort)
+	}
+	if len(seen) != 5 || seen[0] != 1 || seen[4] != 5 {
+		t.Errorf("blocks passed to the hook: have %v, want #1-#5", seen)
+	}
+	if head := chain.CurrentBlock().NumberU64(); head != 4 {
+		t.Errorf("head: have #%d, want #4", head)
+	}
+	if chain.HasBlock(blocks[4].Hash(), 5) || chain.GetReceiptsByHash(blocks[4].Hash()) != nil {
+		t.Errorf("aborted block #5 written")
+	}
+	// Without the hook the rest of the chain is written
+	chain.SetPreCommitHook(nil)
+	if n, err := chain.InsertChain(blocks[4:]); err != nil {
+		t.Fatalf("failed to insert block %d: %v", n, err)
+	}
+	if head := chain.CurrentBlock().NumberU64(); head != 10 {
+		t.Errorf("head: have #%d, want #10", head)
+	}
+}
+
+// Tests that the pre-commit hook sees the side chain blocks written without their
+// state, and the blocks inserted along with their receipts.
+func TestPreCommitHookWithoutState(t *testing.T) {
+	var (
+		gspec   = &genesisT.Genesis{Config: params.TestChainConfig}
+		gendb   = rawdb.NewMemoryDatabase()
+		genesis = MustCommitGenesis(gendb, gspec)
+		engine  = ethash.NewFaker()
+	)
+	// The state of the fork point is pruned, so the fork is written without state
+	blocks, receipts := GenerateChain(gspec.Config, genesis, engine, gendb, 2*TriesInMemory, nil)
+	fork, _ := GenerateChain(gspec.Config, blocks[9], engine, gendb, 5, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x01})
+	})
+	db := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(db, gspec)
+	chain, err := NewBlockChain(db, nil, gspec.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if n, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert block %d: %v", n, err)
+	}
+	errAbort := errors.New("abort")
+	var seen []uint64
+	chain.SetPreCommitHook(func(block *types.Block, receipts types.Receipts) error {
+		if receipts != nil {
+			t.Errorf("side block #%d: receipts passed without state", block.NumberU64())
+		}
+		seen = append(seen, block.NumberU64())
+		if block.Hash() == fork[2].Hash() {
+			return errAbort
+		}
+		return nil
+	})
+	if n, err := chain.InsertChain(fork); !errors.Is(err, errAbort) || n != 2 {
+		t.Fatalf("side chain insertion: have index %d (err %v), want 2 (%v)", n, err, errAbort)
+	}
+	if len(seen) != 3 || seen[0] != fork[0].NumberU64() || seen[2] != fork[2].NumberU64() {
+		t.Errorf("side blocks passed to the hook: have %v, want #%d-#%d", seen, fork[0].NumberU64(), fork[2].NumberU64())
+	}
+	if !chain.HasBlock(fork[1].Hash(), fork[1].NumberU64()) || chain.HasBlock(fork[2].Hash(), fork[2].NumberU64()) {
+		t.Errorf("side blocks written up to the aborted one: #%d %v, #%d %v", fork[1].NumberU64(), chain.HasBlock(fork[1].Hash(), fork[1].NumberU64()),
+			fork[2].NumberU64(), chain.HasBlock(fork[2].Hash(), fork[2].NumberU64()))
+	}
+	// Blocks inserted with their receipts are passed with them, both the ancient and
+	// the live ones
+	frdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp freezer dir: %v", err)
+	}
+	defer os.RemoveAll(frdir)
+	fastdb, err := rawdb.NewDatabaseWithFreezer(rawdb.NewMemoryDatabase(), frdir, "")
+	if err != nil {
+		t.Fatalf("failed to create temp freezer db: %v", err)
+	}
+	defer fastdb.Close()
+	MustCommitGenesis(fastdb, gspec)
+	fast, err := NewBlockChain(fastdb, nil, gspec.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	defer fast.Stop()
+
+	headers := make([]*types.Header, len(blocks))
+	for i, block := range blocks {
+		headers[i] = block.Header()
+	}
+	if n, err := fast.InsertHeaderChain(headers, 1); err != nil {
+		t.Fatalf("failed to insert header %d: %v", n, err)
+	}
+	seen = seen[:0]
+	fast.SetPreCommitHook(func(block *types.Block, passed types.Receipts) error {
+		if len(passed) != len(receipts[block.NumberU64()-1]) {
+			t.Errorf("block #%d: %d receipts, want %d", block.NumberU64(), len(passed), len(receipts[block.NumberU64()-1]))
+		}
+		if fast.HasBlock(block.Hash(), block.NumberU64()) {
+			t.Errorf("block #%d written before the hook", block.NumberU64())
+		}
+		seen = append(seen, block.NumberU64())
+		return nil
+	})
+	ancientLimit, live := uint64(len(blocks)/2), len(blocks)-5
+	if n, err := fast.InsertReceiptChain(blocks[:live], receipts[:live], ancientLimit); err != nil {
+		t.Fatalf("failed to insert receipt %d: %v", n, err)
+	}
+	if len(seen) != live || seen[0] != 1 || seen[len(seen)-1] != uint64(live) {
+		t.Errorf("blocks passed to the hook: have %d from #%d, want #1-#%d", len(seen), seen[0], live)
+	}
+	// An error aborts the receipt chain insertion
+	aborted := blocks[live+2]
+	fast.SetPreCommitHook(func(block *types.Block, receipts types.Receipts) error {
+		if block.Hash() == aborted.Hash() {
+			return errAbort
+		}
+		return nil
+	})
+	if _, err := fast.InsertReceiptChain(blocks[live:], receipts[live:], ancientLimit); !errors.Is(err, errAbort) {
+		t.Fatalf("receipt chain insertion: want %v, got %v", errAbort, err)
+	}
+	if fast.HasBlock(aborted.Hash(), aborted.NumberU64()) {
+		t.Errorf("aborted block #%d written", aborted.NumberU64())
+	}
+}
@@ -17,10 +17,14 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"io/ioutil"
 	"math/big"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -35,6 +39,7 @@ import (
 	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/params/types/genesisT"
 	"github.com/ethereum/go-ethereum/params/vars"
+	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/ethereum/go-ethereum/trie"
 )
@@ -562,3 +567,412 @@ func TestSkipStaleTxIndicesInFastSync_RemoteFreezer(t *testing.T) {
 	tail := uint64(32)
 	check(&tail, chain)
 }
+
+// Tests that AncientKinds reports every standard freezer kind, with a length
+// matching Ancients(), for both the built in and remote ancient stores.
+func TestAncientKinds_RemoteFreezer(t *testing.T) {
+	var (
+		gendb   = rawdb.NewMemoryDatabase()
+		gspec   = &genesisT.Genesis{Config: params.TestChainConfig}
+		genesis = MustCommitGenesis(gendb, gspec)
+	)
+	blocks, receipts := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), gendb, 64, nil)
+
+	headers := make([]*types.Header, len(blocks))
+	for i, block := range blocks {
+		headers[i] = block.Header()
+	}
+
+	check := func(t *testing.T, db ethdb.Database) {
+		MustCommitGenesis(db, gspec)
+		chain, _ := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, nil)
+		defer chain.Stop()
+
+		if n, err := chain.InsertHeaderChain(headers, 1); err != nil {
+			t.Fatalf("failed to insert header %d: %v", n, err)
+		}
+		if n, err := chain.InsertReceiptChain(blocks, receipts, uint64(len(blocks)/2)); err != nil {
+			t.Fatalf("failed to insert receipt %d: %v", n, err)
+		}
+		frozen, err := db.Ancients()
+		if err != nil {
+			t.Fatalf("ancients: %v", err)
+		}
+		if frozen == 0 {
+			t.Fatal("no ancients were written")
+		}
+		kinds, err := db.AncientKinds()
+		if err != nil {
+			t.Fatalf("ancient kinds: %v", err)
+		}
+		for _, kind := range []string{"hashes", "headers", "bodies", "receipts", "diffs"} {
+			n, ok := kinds[kind]
+			if !ok {
+				t.Errorf("missing kind %q", kind)
+				continue
+			}
+			if n != frozen {
+				t.Errorf("kind %q length mismatch: have %d, want %d", kind, n, frozen)
+			}
+		}
+	}
+
+	t.Run("local", func(t *testing.T) {
+		frdir, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatalf("failed to create temp freezer dir: %v", err)
+		}
+		defer os.RemoveAll(frdir)
+
+		db, err := rawdb.NewDatabaseWithFreezer(rawdb.NewMemoryDatabase(), frdir, "")
+		if err != nil {
+			t.Fatalf("failed to create temp freezer db: %v", err)
+		}
+		defer db.Close()
+		check(t, db)
+	})
+	t.Run("remote", func(t *testing.T) {
+		freezerRPCEndpoint, server, db := testRPCRemoteFreezer(t)
+		if server != nil {
+			defer os.RemoveAll(filepath.Dir(freezerRPCEndpoint))
+			defer server.Stop()
+		}
+		defer db.Close()
+		defer func() {
+			if err := db.TruncateAncients(0); err != nil {
+				t.Fatalf("deferred truncate ancients error: %v", err)
+			}
+		}()
+		if err := db.TruncateAncients(0); err != nil {
+			t.Fatalf("truncate ancients: %v", err)
+		}
+		check(t, db)
+	})
+}
+
+// Tests that ReadBlock returns blocks on both sides of the freeze boundary,
+// whether they live in the ancient store or the key-value store.
+func TestReadBlockFreezeBoundary_RemoteFreezer(t *testing.T) {
+	var (
+		gendb   = rawdb.NewMemoryDatabase()
+		gspec   = &genesisT.Genesis{Config: params.TestChainConfig}
+		genesis = MustCommitGenesis(gendb, gspec)
+	)
+	blocks, receipts := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), gendb, 64, nil)
+
+	headers := make([]*types.Header, len(blocks))
+	for i, block := range blocks {
+		headers[i] = block.Header()
+	}
+
+	check := func(t *testing.T, db ethdb.Database) {
+		MustCommitGenesis(db, gspec)
+		chain, _ := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, nil)
+		defer chain.Stop()
+
+		if n, err := chain.InsertHeaderChain(headers, 1); err != nil {
+			t.Fatalf("failed to insert header %d: %v", n, err)
+		}
+		if n, err := chain.InsertReceiptChain(blocks, receipts, uint64(len(blocks)/2)); err != nil {
+			t.Fatalf("failed to insert receipt %d: %v", n, err)
+		}
+		frozen, err := db.Ancients()
+		if err != nil {
+			t.Fatalf("ancients: %v", err)
+		}
+		if frozen < 2 || frozen > uint64(len(blocks)) {
+			t.Fatalf("freeze boundary not within chain: ancients %d", frozen)
+		}
+		for _, block := range blocks {
+			number := block.NumberU64()
+			if hash, _ := db.Ancient("hashes", number); (number < frozen) != (common.BytesToHash(hash) == block.Hash()) {
+				t.Fatalf("block #%d: unexpected ancient hash %x, ancients %d", number, hash, frozen)
+			}
+			have := rawdb.ReadBlock(db, block.Hash(), number)
+			if have == nil {
+				t.Errorf("block #%d (ancients %d) not found", number, frozen)
+				continue
+			}
+			if have.Hash() != block.Hash() {
+				t.Errorf("block #%d hash mismatch: have %x, want %x", number, have.Hash(), block.Hash())
+			}
+			if have.Transactions().Len() != block.Transactions().Len() || len(have.Uncles()) != len(block.Uncles()) {
+				t.Errorf("block #%d body mismatch", number)
+			}
+		}
+	}
+
+	t.Run("local", func(t *testing.T) {
+		frdir, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatalf("failed to create temp freezer dir: %v", err)
+		}
+		defer os.RemoveAll(frdir)
+
+		db, err := rawdb.NewDatabaseWithFreezer(rawdb.NewMemoryDatabase(), frdir, "")
+		if err != nil {
+			t.Fatalf("failed to create temp freezer db: %v", err)
+		}
+		defer db.Close()
+		check(t, db)
+	})
+	t.Run("remote", func(t *testing.T) {
+		freezerRPCEndpoint, server, db := testRPCRemoteFreezer(t)
+		if server != nil {
+			defer os.RemoveAll(filepath.Dir(freezerRPCEndpoint))
+			defer server.Stop()
+		}
+		defer db.Close()
+		defer func() {
+			if err := db.TruncateAncients(0); err != nil {
+				t.Fatalf("deferred truncate ancients error: %v", err)
+			}
+		}()
+		if err := db.TruncateAncients(0); err != nil {
+			t.Fatalf("truncate ancients: %v", err)
+		}
+		check(t, db)
+	})
+}
+
+// slowReceiptsFreezer is a mock freezer server whose receipt reads block until
+// released, while slow is set.
+type slowReceiptsFreezer struct {
+	*lib.MemFreezerRemoteServerAPI
+	slow    int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (f *slowReceiptsFreezer) Ancient(kind string, number uint64) ([]byte, error) {
+	if kind == "receipts" && atomic.LoadInt32(&f.slow) == 1 {
+		f.started <- struct{}{}
+		<-f.release
+	}
+	return f.MemFreezerRemoteServerAPI.Ancient(kind, number)
+}
+
+// Tests that reads of ancient receipts, as served to RPC requests, are aborted
+// once the request's deadline expires.
+func TestReceiptsContextDeadline_RemoteFreezer(t *testing.T) {
+	var (
+		gendb   = rawdb.NewMemoryDatabase()
+		gspec   = &genesisT.Genesis{Config: params.TestChainConfig}
+		genesis = MustCommitGenesis(gendb, gspec)
+	)
+	blocks, receipts := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), gendb, 64, nil)
+
+	mock := &slowReceiptsFreezer{
+		MemFreezerRemoteServerAPI: lib.NewMemFreezerRemoteServerAPI(),
+		started:                   make(chan struct{}, 1),
+		release:                   make(chan struct{}),
+	}
+	server := rpc.NewServer()
+	defer server.Stop()
+	if err := server.RegisterName("freezer", mock); err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	defer close(mock.release)
+
+	db, err := rawdb.NewDatabaseWithFreezerRemote(rawdb.NewMemoryDatabase(), httpServer.URL)
+	if err != nil {
+		t.Fatalf("failed to create remote freezer db: %v", err)
+	}
+	defer db.Close()
+	MustCommitGenesis(db, gspec)
+	chain, _ := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, nil)
+	defer chain.Stop()
+
+	headers := make([]*types.Header, len(blocks))
+	for i, block := range blocks {
+		headers[i] = block.Header()
+	}
+	if n, err := chain.InsertHeaderChain(headers, 1); err != nil {
+		t.Fatalf("failed to insert header %d: %v", n, err)
+	}
+	if n, err := chain.InsertReceiptChain(blocks, receipts, uint64(len(blocks)/2)); err != nil {
+		t.Fatalf("failed to insert receipt %d: %v", n, err)
+	}
+	frozen := blocks[0].Hash()
+	if n := rawdb.ReadHeaderNumber(db, frozen); n == nil {
+		t.Fatal("frozen block number missing")
+	} else if ancients, _ := db.Ancients(); *n >= ancients {
+		t.Fatalf("block #%d not frozen, ancients %d", *n, ancients)
+	}
+
+	atomic.StoreInt32(&mock.slow, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = chain.GetReceiptsByHashContext(ctx, frozen)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expired read: want %v, got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expired read took %v", elapsed)
+	}
+	select {
+	case <-mock.started:
+	default:
+		t.Fatal("slow freezer read not issued")
+	}
+}
+
+// Tests that committing a genesis to a database whose remote freezer holds another
+// chain fails with a genesis mismatch.
+func TestCommitGenesisMismatch_RemoteFreezer(t *testing.T) {
+	var (
+		frozen   = &genesisT.Genesis{Config: params.TestChainConfig, ExtraData: []byte("frozen")}
+		proposed = &genesisT.Genesis{Config: params.TestChainConfig, ExtraData: []byte("proposed")}
+		block    = GenesisToBlock(frozen, nil)
+	)
+	// Pre-populate the remote freezer with the frozen chain's genesis
+	server := rpc.NewServer()
+	defer server.Stop()
+	mock := lib.NewMemFreezerRemoteServerAPI()
+	if err := server.RegisterName("freezer", mock); err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	header, _ := rlp.EncodeToBytes(block.Header())
+	body, _ := rlp.EncodeToBytes(block.Body())
+	receipts, _ := rlp.EncodeToBytes([]*types.ReceiptForStorage{})
+	td, _ := rlp.EncodeToBytes(block.Difficulty())
+	if err := mock.AppendAncient(0, block.Hash().Bytes(), header, body, receipts, td, nil); err != nil {
+		t.Fatal(err)
+	}
+	db, err := rawdb.NewDatabaseWithFreezerRemote(rawdb.NewMemoryDatabase(), httpServer.URL)
+	if err != nil {
+		t.Fatalf("failed to create remote freezer db: %v", err)
+	}
+	defer db.Close()
+
+	_, err = CommitGenesis(proposed, db)
+	var mismatch *genesisT.GenesisMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("proposed genesis: want genesis mismatch, got %v", err)
+	}
+	if want := GenesisToBlock(proposed, nil).Hash(); mismatch.Stored != block.Hash() || mismatch.New != want {
+		t.Errorf("mismatch: have %x != %x, want %x != %x", mismatch.Stored, mismatch.New, block.Hash(), want)
+	}
+	if hash := rawdb.ReadHeadHeaderHash(db); hash != (common.Hash{}) {
+		t.Errorf("mismatching genesis committed: head %x", hash)
+	}
+	// The genesis of the frozen chain is committed fine
+	if _, err := CommitGenesis(frozen, db); err != nil {
+		t.Fatalf("frozen genesis: %v", err)
+	}
+}
+
+// Tests that a remote freezer ahead of the head block, whose height is trusted, is not
+// rolled back by the blockchain, and that the chain carries on importing its blocks.
+func TestFreezerRemoteAheadTrust_RemoteFreezer(t *testing.T) {
+	defer rawdb.SetFreezerRemoteAheadPolicy(rawdb.FreezerRemoteAheadTruncate)
+
+	var (
+		gspec   = &genesisT.Genesis{Config: params.TestChainConfig}
+		gendb   = rawdb.NewMemoryDatabase()
+		genesis = MustCommitGenesis(gendb, gspec)
+	)
+	blocks, receipts := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), gendb, 64, nil)
+
+	// Another writer froze blocks #0-#39 of the chain
+	server := rpc.NewServer()
+	defer server.Stop()
+	mock := lib.NewMemFreezerRemoteServerAPI()
+	if err := server.RegisterName("freezer", mock); err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	td := new(big.Int)
+	for i, block := range append([]*types.Block{genesis}, blocks[:39]...) {
+		var stored []*types.ReceiptForStorage
+		if i > 0 {
+			for _, receipt := range receipts[i-1] {
+				stored = append(stored, (*types.ReceiptForStorage)(receipt))
+			}
+		}
+		td.Add(td, block.Difficulty())
+		header, _ := rlp.EncodeToBytes(block.Header())
+		body, _ := rlp.EncodeToBytes(block.Body())
+		receipts, _ := rlp.EncodeToBytes(stored)
+		tdBlob, _ := rlp.EncodeToBytes(td)
+		if err := mock.AppendAncient(uint64(i), block.Hash().Bytes(), header, body, receipts, tdBlob, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The node only imported up to #20 of the same chain
+	kvdb := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(kvdb, gspec)
+	chain, err := NewBlockChain(kvdb, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := chain.InsertChain(blocks[:20]); err != nil {
+		t.Fatalf("failed to insert block %d: %v", n, err)
+	}
+	chain.Stop()
+
+	rawdb.SetFreezerRemoteAheadPolicy(rawdb.FreezerRemoteAheadTrust)
+	db, err := rawdb.NewDatabaseWithFreezerRemote(kvdb, httpServer.URL)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	chain, err = NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+
+	if frozen, err := db.Ancients(); err != nil || frozen != 40 {
+		t.Fatalf("ancients: have %d (err %v), want 40", frozen, err)
+	}
+	if head := chain.CurrentBlock(); head.Hash() != blocks[19].Hash() {
+		t.Errorf("head block: have #%d, want #20", head.NumberU64())
+	}
+	if head := chain.CurrentHeader(); head.Hash() != blocks[38].Hash() {
+		t.Errorf("head header: have #%d, want #39", head.Number)
+	}
+	// The chain carries on from the head block over the frozen blocks
+	if n, err := chain.InsertChain(blocks[20:]); err != nil {
+		t.Fatalf("failed to insert block %d: %v", n, err)
+	}
+	if head := chain.CurrentBlock(); head.Hash() != blocks[63].Hash() {
+		t.Errorf("head block after import: have #%d, want #64", head.NumberU64())
+	}
+}
+
+// Tests that committing a genesis fails if the frozen items of the remote freezer
+// can't be retrieved, rather than skipping the genesis check.
+func TestCommitGenesisUnavailable_RemoteFreezer(t *testing.T) {
+	server := rpc.NewServer()
+	defer server.Stop()
+	if err := server.RegisterName("freezer", lib.NewMemFreezerRemoteServerAPI()); err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(server)
+	db, err := rawdb.NewDatabaseWithFreezerRemote(rawdb.NewMemoryDatabase(), httpServer.URL)
+	if err != nil {
+		httpServer.Close()
+		t.Fatalf("failed to create remote freezer db: %v", err)
+	}
+	defer db.Close()
+	httpServer.Close()
+
+	genesis := &genesisT.Genesis{Config: params.TestChainConfig}
+	if _, err := CommitGenesis(genesis, db); err == nil {
+		t.Fatal("genesis committed without its frozen items")
+	}
+	if hash := rawdb.ReadHeadHeaderHash(db); hash != (common.Hash{}) {
+		t.Errorf("genesis committed: head %x", hash)
+	}
+}
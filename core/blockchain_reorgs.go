@@ -0,0 +1,133 @@
+package core
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// reorgHistoryLimit is the default number of reorgs retained by the reorg history,
+// see SetReorgHistoryLimit.
+const reorgHistoryLimit = 64
+
+// ReorgRecord describes a reorganization of the canonical chain, or one artificial
+// finality (MESS) rejected.
+type ReorgRecord struct {
+	Time           time.Time   // Time of the reorg, by the chain's clock
+	CommonAncestor common.Hash // Hash of the common ancestor of the old and new chains
+	CommonNumber   uint64      // Number of the common ancestor
+	OldHead        common.Hash // Hash of the head block replaced
+	NewHead        common.Hash // Hash of the head block of the new chain
+	Depth          uint64      // Distance of the old head from the common ancestor
+	Added          int         // Number of blocks added to the canonical chain
+	Removed        int         // Number of blocks removed from the canonical chain
+
+	ArtificialFinality bool   // Whether artificial finality (MESS) arbitrated the reorg
+	Rejected           bool   // Whether artificial finality rejected the reorg, which wasn't applied
+	TraceID            string // Trace id of the artificial finality decision, if rejected
+}
+
+// reorgHistory is a ring buffer of the most recent reorgs.
+type reorgHistory struct {
+	records []ReorgRecord // Recorded reorgs, the oldest at next once full
+	next    int           // Position of the next record
+	limit   int           // Maximum number of reorgs retained
+	lock    sync.Mutex
+}
+
+func newReorgHistory() *reorgHistory {
+	return &reorgHistory{limit: reorgHistoryLimit}
+}
+
+// add records a reorg, overwriting the oldest one if the history is full.
+func (h *reorgHistory) add(record ReorgRecord) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.limit == 0 {
+		return
+	}
+	if len(h.records) < h.limit {
+		h.records = append(h.records, record)
+		return
+	}
+	h.records[h.next] = record
+	h.next = (h.next + 1) % h.limit
+}
+
+// list returns the recorded reorgs, the oldest first. The lock must be held.
+func (h *reorgHistory) list() []ReorgRecord {
+	records := make([]ReorgRecord, 0, len(h.records))
+	records = append(records, h.records[h.next:]...)
+	return append(records, h.records[:h.next]...)
+}
+
+// recordReorg adds a reorg applied to the canonical chain to the reorg history.
+func (bc *BlockChain) recordReorg(data *reorgData) {
+	bc.reorgs.add(ReorgRecord{
+		Time:           bc.now(),
+		CommonAncestor: data.commonBlock.Hash(),
+		CommonNumber:   data.commonBlock.NumberU64(),
+		OldHead:        data.oldChain[0].Hash(),
+		NewHead:        data.newChain[0].Hash(),
+		Depth:          data.oldChain[0].NumberU64() - data.commonBlock.NumberU64(),
+		Added:          len(data.newChain),
+		Removed:        len(data.oldChain),
+		ArtificialFinality: bc.IsArtificialFinalityEnabled() &&
+			bc.Config().IsEnabled(bc.Config().GetECBP1100Transition, data.oldChain[0].Number()),
+	})
+}
+
+// recordRejectedReorg adds a reorg artificial finality rejected to the reorg history.
+func (bc *BlockChain) recordRejectedReorg(commonAncestor, current, proposed *types.Header, id string) {
+	var (
+		ancestor = commonAncestor.Number.Uint64()
+		depth    = current.Number.Uint64() - ancestor
+	)
+	bc.reorgs.add(ReorgRecord{
+		Time:               bc.now(),
+		CommonAncestor:     commonAncestor.Hash(),
+		CommonNumber:       ancestor,
+		OldHead:            current.Hash(),
+		NewHead:            proposed.Hash(),
+		Depth:              depth,
+		Added:              int(proposed.Number.Uint64() - ancestor),
+		Removed:            int(depth),
+		ArtificialFinality: true,
+		Rejected:           true,
+		TraceID:            id,
+	})
+}
+
+// RecentReorgs returns the most recent reorgs of the canonical chain, including the
+// ones artificial finality rejected, the oldest first. A rejected segment is recorded
+// once per insertion, up to the last of its blocks evaluated. The reorgs are recorded
+// in memory since startup, a limited number of them is retained, see
+// SetReorgHistoryLimit.
+func (bc *BlockChain) RecentReorgs() []ReorgRecord {
+	bc.reorgs.lock.Lock()
+	defer bc.reorgs.lock.Unlock()
+
+	return bc.reorgs.list()
+}
+
+// SetReorgHistoryLimit sets the number of the most recent reorgs retained for
+// RecentReorgs, forgetting the oldest ones beyond it. A limit of 0 disables the
+// history; the default is reorgHistoryLimit.
+func (bc *BlockChain) SetReorgHistoryLimit(limit int) {
+	if limit < 0 {
+		limit = 0
+	}
+	bc.reorgs.lock.Lock()
+	defer bc.reorgs.lock.Unlock()
+
+	records := bc.reorgs.list()
+	if len(records) > limit {
+		records = records[len(records)-limit:]
+	}
+	bc.reorgs.records, bc.reorgs.next, bc.reorgs.limit = records, 0, limit
+	log.Info("Reorg history limit configured", "limit", limit)
+}
@@ -0,0 +1,217 @@
+package core
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/params/types/genesisT"
+)
+
+// Tests that the reorgs of the canonical chain are recorded in order, with their
+// common ancestors and depths, and that only the most recent ones are retained.
+func TestRecentReorgs(t *testing.T) {
+	var (
+		gspec   = &genesisT.Genesis{Config: params.TestChainConfig}
+		gendb   = rawdb.NewMemoryDatabase()
+		genesis = MustCommitGenesis(gendb, gspec)
+		engine  = ethash.NewFaker()
+	)
+	// Every chain forks off the previous one below its head, and outgrows it
+	fork := func(parent *types.Block, n int, coinbase byte) []*types.Block {
+		blocks, _ := GenerateChain(gspec.Config, parent, engine, gendb, n, func(i int, b *BlockGen) {
+			b.SetCoinbase(common.Address{coinbase})
+		})
+		return blocks
+	}
+	a := fork(genesis, 10, 0x00)
+	b := fork(a[4], 8, 0x01)
+	c := fork(b[3], 10, 0x02)
+	d := fork(c[5], 8, 0x03)
+	e := fork(d[3], 8, 0x04)
+
+	db := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(db, gspec)
+	chain, err := NewBlockChain(db, nil, gspec.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	defer chain.Stop()
+
+	type reorg struct {
+		ancestor, oldHead *types.Block
+	}
+	check := func(want []reorg) {
+		t.Helper()
+		have := chain.RecentReorgs()
+		if len(have) != len(want) {
+			t.Fatalf("reorgs: have %d, want %d", len(have), len(want))
+		}
+		for i, r := range have {
+			depth := want[i].oldHead.NumberU64() - want[i].ancestor.NumberU64()
+			if r.CommonAncestor != want[i].ancestor.Hash() || r.CommonNumber != want[i].ancestor.NumberU64() {
+				t.Errorf("reorg %d: common ancestor: have #%d [%x], want #%d [%x]", i, r.CommonNumber, r.CommonAncestor, want[i].ancestor.NumberU64(), want[i].ancestor.Hash())
+			}
+			if r.OldHead != want[i].oldHead.Hash() {
+				t.Errorf("reorg %d: old head: have %x, want %x", i, r.OldHead, want[i].oldHead.Hash())
+			}
+			if r.Depth != depth || r.Removed != int(depth) {
+				t.Errorf("reorg %d: have depth %d (%d removed), want %d", i, r.Depth, r.Removed, depth)
+			}
+			newHead := chain.GetHeaderByHash(r.NewHead)
+			if newHead == nil {
+				t.Errorf("reorg %d: unknown new head %x", i, r.NewHead)
+			} else if added := newHead.Number.Uint64() - r.CommonNumber; r.Added != int(added) {
+				t.Errorf("reorg %d: have %d added, want %d", i, r.Added, added)
+			}
+			if r.ArtificialFinality || r.Rejected {
+				t.Errorf("reorg %d: arbitrated by artificial finality", i)
+			}
+		}
+	}
+	for _, blocks := range [][]*types.Block{a, b, c, d} {
+		if n, err := chain.InsertChain(blocks); err != nil {
+			t.Fatalf("failed to insert block %d: %v", n, err)
+		}
+	}
+	check([]reorg{{a[4], a[9]}, {b[3], b[7]}, {c[5], c[9]}})
+
+	// Shrinking the history forgets the oldest reorgs, the newest replace them
+	chain.SetReorgHistoryLimit(2)
+	check([]reorg{{b[3], b[7]}, {c[5], c[9]}})
+
+	if n, err := chain.InsertChain(e); err != nil {
+		t.Fatalf("failed to insert block %d: %v", n, err)
+	}
+	check([]reorg{{c[5], c[9]}, {d[3], d[7]}})
+}
+
+// Tests that the reorgs rejected by artificial finality are recorded with the trace
+// id of the decision.
+func TestRecentReorgsArtificialFinality(t *testing.T) {
+	engine := ethash.NewFaker()
+	genesis := params.DefaultMessNetGenesisBlock()
+
+	gendb := rawdb.NewMemoryDatabase()
+	genesisB := MustCommitGenesis(gendb, genesis)
+	easy, _ := GenerateChain(genesis.Config, genesisB, engine, gendb, 500, nil)
+	hard, _ := GenerateChain(genesis.Config, easy[249], engine, gendb, 250, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x01}) // Don't share states with the easy chain
+		b.OffsetTime(-9)
+	})
+	db := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(db, genesis)
+	chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+	chain.EnableArtificialFinality(true)
+	chain.SetArtificialFinalityRejectPolicy(ArtificialFinalityRejectError)
+
+	if _, err := chain.InsertChain(easy); err != nil {
+		t.Fatal(err)
+	}
+	_, err = chain.InsertChain(hard)
+	if !errors.Is(err, ErrArtificialFinalityReject) {
+		t.Fatalf("want %v, got %v", ErrArtificialFinalityReject, err)
+	}
+	reorgs := chain.RecentReorgs()
+	if len(reorgs) == 0 {
+		t.Fatal("rejected reorg not recorded")
+	}
+	r := reorgs[len(reorgs)-1]
+	if !r.Rejected || !r.ArtificialFinality {
+		t.Errorf("reorg not recorded as rejected by artificial finality: %+v", r)
+	}
+	if r.TraceID != ArtificialFinalityTraceID(err) {
+		t.Errorf("trace id: have %q, want %q", r.TraceID, ArtificialFinalityTraceID(err))
+	}
+	if r.CommonAncestor != easy[249].Hash() || r.OldHead != easy[499].Hash() {
+		t.Errorf("reorg: have common ancestor %x, old head %x, want %x, %x", r.CommonAncestor, r.OldHead, easy[249].Hash(), easy[499].Hash())
+	}
+	if r.Depth != 250 || r.Removed != 250 {
+		t.Errorf("depth: have %d (%d removed), want 250", r.Depth, r.Removed)
+	}
+	if head := chain.CurrentBlock().Hash(); head != easy[499].Hash() {
+		t.Errorf("rejected reorg applied")
+	}
+}
+
+// Tests that a segment rejected by artificial finality is recorded once per insertion,
+// however many of its blocks or headers were evaluated.
+func TestRecentReorgsArtificialFinalityPerSegment(t *testing.T) {
+	engine := ethash.NewFaker()
+	genesis := params.DefaultMessNetGenesisBlock()
+
+	gendb := rawdb.NewMemoryDatabase()
+	genesisB := MustCommitGenesis(gendb, genesis)
+	easy, _ := GenerateChain(genesis.Config, genesisB, engine, gendb, 500, nil)
+	fork := func(coinbase byte) []*types.Block {
+		blocks, _ := GenerateChain(genesis.Config, easy[249], engine, gendb, 250, func(i int, b *BlockGen) {
+			b.SetCoinbase(common.Address{coinbase}) // Don't share states with the easy chain
+			b.OffsetTime(-9)
+		})
+		return blocks
+	}
+	db := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(db, genesis)
+	chain, err := NewBlockChain(db, nil, genesis.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+	chain.EnableArtificialFinality(true)
+	chain.SetArtificialFinalityRejectPolicy(ArtificialFinalityRejectSidechain)
+
+	if n, err := chain.InsertChain(easy); err != nil {
+		t.Fatalf("failed to insert block %d: %v", n, err)
+	}
+	// rejected returns the number of rejected reorgs recorded since the last call.
+	var seen int
+	rejected := func() int {
+		var n int
+		for _, reorg := range chain.RecentReorgs() {
+			if reorg.Rejected {
+				n++
+			}
+		}
+		n, seen = n-seen, n
+		return n
+	}
+	// Every block of the fork heavier than the head is rejected, as one segment
+	blocks := fork(0x01)
+	if n, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert block %d: %v", n, err)
+	}
+	if chain.CurrentBlock().Hash() != easy[len(easy)-1].Hash() {
+		t.Fatal("rejected fork applied")
+	}
+	if n := rejected(); n != 1 {
+		t.Errorf("rejected block segment: have %d records, want 1", n)
+	}
+	reorgs := chain.RecentReorgs()
+	if r := reorgs[len(reorgs)-1]; r.NewHead != blocks[len(blocks)-1].Hash() {
+		t.Errorf("rejected block segment: have head %x, want %x", r.NewHead, blocks[len(blocks)-1].Hash())
+	}
+	// So is every header of another one
+	blocks = fork(0x02)
+	headers := make([]*types.Header, len(blocks))
+	for i, block := range blocks {
+		headers[i] = block.Header()
+	}
+	if n, err := chain.InsertHeaderChain(headers, 1); err != nil {
+		t.Fatalf("failed to insert header %d: %v", n, err)
+	}
+	if chain.CurrentHeader().Hash() != easy[len(easy)-1].Hash() {
+		t.Fatal("rejected header fork applied")
+	}
+	if n := rejected(); n != 1 {
+		t.Errorf("rejected header segment: have %d records, want 1", n)
+	}
+}
@@ -0,0 +1,123 @@
+package core
+
+import (
+	"bytes"
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// sideHeadsLimit is the default number of side-chain heads tracked, the ones of the
+// lowest total difficulty are forgotten beyond it, see SetSideHeadsLimit.
+const sideHeadsLimit = 256
+
+// sideHead is a tracked non-canonical block without known children.
+type sideHead struct {
+	number uint64
+	td     *big.Int
+}
+
+// sideHeadSet is the set of tracked side-chain heads.
+type sideHeadSet struct {
+	heads map[common.Hash]sideHead // Side-chain heads, by hash
+	limit int                      // Maximum number of heads tracked, 0 if unlimited
+	lock  sync.Mutex
+}
+
+func newSideHeadSet() *sideHeadSet {
+	return &sideHeadSet{heads: make(map[common.Hash]sideHead), limit: sideHeadsLimit}
+}
+
+// trackSideHead records a block written as a side-chain block with the given total
+// difficulty as a side-chain head, replacing its parent.
+func (bc *BlockChain) trackSideHead(block *types.Block, td *big.Int) {
+	bc.sideHeads.lock.Lock()
+	defer bc.sideHeads.lock.Unlock()
+
+	delete(bc.sideHeads.heads, block.ParentHash())
+	bc.sideHeads.heads[block.Hash()] = sideHead{number: block.NumberU64(), td: new(big.Int).Set(td)}
+	bc.evictSideHeads()
+}
+
+// evictSideHeads forgets the side-chain heads of the lowest total difficulty beyond
+// the limit. Heads reorged into the canonical chain, ancestors of the head, are no
+// side-chain heads anymore and are dropped first. The lock must be held.
+func (bc *BlockChain) evictSideHeads() {
+	set := bc.sideHeads
+	if set.limit == 0 || len(set.heads) <= set.limit {
+		return
+	}
+	hashes := make([]common.Hash, 0, len(set.heads))
+	for hash, side := range set.heads {
+		if bc.GetCanonicalHash(side.number) == hash {
+			delete(set.heads, hash)
+			continue
+		}
+		hashes = append(hashes, hash)
+	}
+	if len(hashes) <= set.limit {
+		return
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		if c := set.heads[hashes[i]].td.Cmp(set.heads[hashes[j]].td); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(hashes[i][:], hashes[j][:]) < 0
+	})
+	for _, hash := range hashes[:len(hashes)-set.limit] {
+		log.Trace("Forgetting side-chain head", "number", set.heads[hash].number, "hash", hash, "td", set.heads[hash].td)
+		delete(set.heads, hash)
+	}
+}
+
+// SetSideHeadsLimit limits the number of side-chain heads tracked for
+// HeaviestSideChain to limit, bounding the memory competing chains occupy, eg. under
+// MESS. Beyond the limit the heads of the lowest total difficulty are forgotten.
+// A limit of 0 removes the limit; the default is sideHeadsLimit.
+func (bc *BlockChain) SetSideHeadsLimit(limit int) {
+	bc.sideHeads.lock.Lock()
+	defer bc.sideHeads.lock.Unlock()
+
+	bc.sideHeads.limit = limit
+	bc.evictSideHeads()
+	log.Info("Side-chain heads limit configured", "limit", limit)
+}
+
+// HeaviestSideChain returns the head and total difficulty of the heaviest non-canonical
+// chain written by recent insertions, and its depth: the number of its blocks above the
+// common ancestor with the canonical chain. A zero hash is returned if there is none.
+//
+// Side chains are tracked in memory from the chain insertions since startup, a limited
+// number of the heaviest ones is retained, see SetSideHeadsLimit.
+func (bc *BlockChain) HeaviestSideChain() (head common.Hash, td *big.Int, depth uint64) {
+	var number uint64
+
+	bc.sideHeads.lock.Lock()
+	for hash, side := range bc.sideHeads.heads {
+		if bc.GetCanonicalHash(side.number) == hash {
+			delete(bc.sideHeads.heads, hash) // Reorged into the canonical chain
+			continue
+		}
+		if td == nil || side.td.Cmp(td) > 0 {
+			head, td, number = hash, side.td, side.number
+		}
+	}
+	bc.sideHeads.lock.Unlock()
+
+	if td == nil {
+		return common.Hash{}, nil, 0
+	}
+	header := bc.GetHeader(head, number)
+	if header == nil {
+		return head, new(big.Int).Set(td), 0
+	}
+	if ancestor := rawdb.FindCommonAncestor(bc.db, header, bc.CurrentHeader()); ancestor != nil {
+		depth = number - ancestor.Number.Uint64()
+	}
+	return head, new(big.Int).Set(td), depth
+}
@@ -0,0 +1,145 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/params/types/genesisT"
+)
+
+// Tests that the heaviest of the competing forks inserted is reported as the
+// heaviest side chain, including chains displaced by a reorg.
+func TestHeaviestSideChain(t *testing.T) {
+	var (
+		engine  = ethash.NewFaker()
+		gspec   = &genesisT.Genesis{Config: params.TestChainConfig}
+		gendb   = rawdb.NewMemoryDatabase()
+		genesis = MustCommitGenesis(gendb, gspec)
+	)
+	canon, _ := GenerateChain(gspec.Config, genesis, engine, gendb, 10, nil)
+	light, _ := GenerateChain(gspec.Config, canon[2], engine, gendb, 3, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x01})
+	})
+	heavy, _ := GenerateChain(gspec.Config, canon[4], engine, gendb, 4, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x02})
+	})
+	db := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(db, gspec)
+	chain, err := NewBlockChain(db, nil, gspec.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if _, err := chain.InsertChain(canon); err != nil {
+		t.Fatalf("failed to insert canonical chain: %v", err)
+	}
+	if head, td, _ := chain.HeaviestSideChain(); head != (common.Hash{}) || td != nil {
+		t.Fatalf("side chain without forks: have %x (td %v), want none", head, td)
+	}
+	for _, fork := range [][]*types.Block{heavy, light} {
+		if _, err := chain.InsertChain(fork); err != nil {
+			t.Fatalf("failed to insert fork: %v", err)
+		}
+	}
+	if chain.CurrentBlock().Hash() != canon[len(canon)-1].Hash() {
+		t.Fatal("fork became canonical")
+	}
+	want := heavy[len(heavy)-1]
+	head, td, depth := chain.HeaviestSideChain()
+	if head != want.Hash() {
+		t.Fatalf("heaviest side chain mismatch: have #%d [%x], want #%d [%x]", chain.GetHeaderByHash(head).Number, head, want.NumberU64(), want.Hash())
+	}
+	if wantTd := chain.GetTd(want.Hash(), want.NumberU64()); td.Cmp(wantTd) != 0 {
+		t.Errorf("td mismatch: have %v, want %v", td, wantTd)
+	}
+	if depth != uint64(len(heavy)) {
+		t.Errorf("depth mismatch: have %d, want %d", depth, len(heavy))
+	}
+	// Once the heavy fork outweighs the canonical chain, the displaced chain is the heaviest side chain.
+	extension, _ := GenerateChain(gspec.Config, want, engine, gendb, 3, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x02})
+	})
+	if _, err := chain.InsertChain(extension); err != nil {
+		t.Fatalf("failed to extend fork: %v", err)
+	}
+	if chain.CurrentBlock().Hash() != extension[len(extension)-1].Hash() {
+		t.Fatal("extended fork did not become canonical")
+	}
+	if head, _, depth := chain.HeaviestSideChain(); head != canon[len(canon)-1].Hash() || depth != 5 {
+		t.Errorf("heaviest side chain after reorg: have [%x] depth %d, want [%x] depth 5", head, depth, canon[len(canon)-1].Hash())
+	}
+}
+
+// Tests that beyond the limit the side-chain heads of the lowest total difficulty
+// are forgotten, regardless of the order they were inserted in.
+func TestSideHeadsLimit(t *testing.T) {
+	var (
+		engine  = ethash.NewFaker()
+		gspec   = &genesisT.Genesis{Config: params.TestChainConfig}
+		gendb   = rawdb.NewMemoryDatabase()
+		genesis = MustCommitGenesis(gendb, gspec)
+	)
+	canon, _ := GenerateChain(gspec.Config, genesis, engine, gendb, 10, nil)
+
+	// Forks of increasing length, all lighter than the canonical chain
+	forks := make([][]*types.Block, 6)
+	for i := range forks {
+		coinbase := common.Address{byte(i + 1)}
+		forks[i], _ = GenerateChain(gspec.Config, canon[2], engine, gendb, i+1, func(_ int, b *BlockGen) {
+			b.SetCoinbase(coinbase)
+		})
+	}
+	db := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(db, gspec)
+	chain, err := NewBlockChain(db, nil, gspec.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	defer chain.Stop()
+	chain.SetSideHeadsLimit(3)
+
+	if _, err := chain.InsertChain(canon); err != nil {
+		t.Fatalf("failed to insert canonical chain: %v", err)
+	}
+	// Insert the heaviest forks first, the lightest last
+	for i := len(forks) - 1; i >= 0; i-- {
+		if _, err := chain.InsertChain(forks[i]); err != nil {
+			t.Fatalf("failed to insert fork %d: %v", i, err)
+		}
+	}
+	if chain.CurrentBlock().Hash() != canon[len(canon)-1].Hash() {
+		t.Fatal("fork became canonical")
+	}
+	// checkHeads checks that the heads of the given forks are tracked, and only those.
+	checkHeads := func(retained ...int) {
+		t.Helper()
+
+		chain.sideHeads.lock.Lock()
+		defer chain.sideHeads.lock.Unlock()
+
+		if len(chain.sideHeads.heads) != len(retained) {
+			t.Errorf("tracked heads mismatch: have %d, want %d", len(chain.sideHeads.heads), len(retained))
+		}
+		for _, i := range retained {
+			head := forks[i][len(forks[i])-1]
+			if _, ok := chain.sideHeads.heads[head.Hash()]; !ok {
+				t.Errorf("head of fork %d (#%d) not tracked", i, head.NumberU64())
+			}
+		}
+	}
+	checkHeads(3, 4, 5)
+
+	want := forks[5][len(forks[5])-1]
+	if head, _, _ := chain.HeaviestSideChain(); head != want.Hash() {
+		t.Errorf("heaviest side chain mismatch: have [%x], want #%d [%x]", head, want.NumberU64(), want.Hash())
+	}
+	// Lowering the limit forgets the lightest of the tracked heads right away.
+	chain.SetSideHeadsLimit(1)
+	checkHeads(5)
+}
@@ -0,0 +1,94 @@
+package core
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// ErrSideChainRateLimited is returned when a side-chain block is rejected because
+// its parent already received the configured number of distinct side-chain children
+// within the rate limit window.
+var ErrSideChainRateLimited = errors.New("side-chain block rate limited")
+
+// sideChainLimiterParents is the number of parents whose side-chain children are
+// tracked, the least recently extended ones are forgotten beyond it.
+const sideChainLimiterParents = 1024
+
+// sideChainLimiter limits the number of distinct side-chain blocks accepted per
+// parent within a time window.
+type sideChainLimiter struct {
+	limit   int           // Maximum number of distinct children per parent, 0 if unlimited
+	window  time.Duration // Time span the children are counted over
+	parents *lru.Cache    // Acceptance times of the children of a parent, by child hash
+	lock    sync.Mutex
+}
+
+func newSideChainLimiter() *sideChainLimiter {
+	parents, _ := lru.New(sideChainLimiterParents)
+	return &sideChainLimiter{parents: parents}
+}
+
+// allow records the side-chain block hash as a child of parent at time now, and
+// returns false instead if the parent has no allowance left.
+func (l *sideChainLimiter) allow(parent, hash common.Hash, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.limit == 0 {
+		return true
+	}
+	var children map[common.Hash]time.Time
+	if cached, ok := l.parents.Get(parent); ok {
+		children = cached.(map[common.Hash]time.Time)
+	} else {
+		children = make(map[common.Hash]time.Time)
+		l.parents.Add(parent, children)
+	}
+	if _, ok := children[hash]; ok {
+		return true
+	}
+	for child, accepted := range children {
+		if now.Sub(accepted) >= l.window {
+			delete(children, child)
+		}
+	}
+	if len(children) >= l.limit {
+		return false
+	}
+	children[hash] = now
+	return true
+}
+
+// SetSideChainRateLimit limits the number of distinct side-chain blocks the chain
+// accepts into storage per parent block to limit within every window, rejecting
+// the excess ones with ErrSideChainRateLimited. A limit of 0 removes the limit,
+// which is the default.
+//
+// A block is considered a side-chain block if it does not extend the current head
+// block when being imported.
+func (bc *BlockChain) SetSideChainRateLimit(limit int, window time.Duration) {
+	bc.sideLimiter.lock.Lock()
+	defer bc.sideLimiter.lock.Unlock()
+
+	bc.sideLimiter.limit, bc.sideLimiter.window = limit, window
+	bc.sideLimiter.parents.Purge()
+	log.Info("Side-chain rate limit configured", "limit", limit, "window", window)
+}
+
+// allowSideBlock returns ErrSideChainRateLimited if the block does not extend the
+// current head block and its parent is out of side-chain allowance.
+func (bc *BlockChain) allowSideBlock(parent, hash common.Hash) error {
+	if parent == bc.CurrentBlock().Hash() {
+		return nil
+	}
+	if !bc.sideLimiter.allow(parent, hash, bc.now()) {
+		log.Debug("Side-chain block rate limited", "parent", parent, "hash", hash)
+		return ErrSideChainRateLimited
+	}
+	return nil
+}
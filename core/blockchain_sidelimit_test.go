@@ -0,0 +1,77 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/params/types/genesisT"
+)
+
+// Tests that side-chain blocks flooding a parent beyond the configured rate are
+// rejected, until the window passed.
+func TestSideChainRateLimit(t *testing.T) {
+	var (
+		engine  = ethash.NewFaker()
+		gspec   = &genesisT.Genesis{Config: params.TestChainConfig}
+		gendb   = rawdb.NewMemoryDatabase()
+		genesis = MustCommitGenesis(gendb, gspec)
+	)
+	blocks, _ := GenerateChain(gspec.Config, genesis, engine, gendb, 3, nil)
+
+	// Generate distinct side blocks on top of the first block
+	sides := make([]*types.Block, 6)
+	for i := range sides {
+		i := i
+		side, _ := GenerateChain(gspec.Config, blocks[0], engine, gendb, 1, func(_ int, b *BlockGen) {
+			b.SetCoinbase(common.Address{byte(i + 1)})
+		})
+		sides[i] = side[0]
+	}
+	db := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(db, gspec)
+	chain, err := NewBlockChain(db, nil, gspec.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	defer chain.Stop()
+
+	now := time.Unix(int64(blocks[len(blocks)-1].Time()), 0)
+	chain.SetClock(frozenClock(now))
+	chain.SetSideChainRateLimit(3, time.Minute)
+
+	if n, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("block %d: failed to insert into chain: %v", n, err)
+	}
+	for i, side := range sides[:3] {
+		if _, err := chain.InsertChain(types.Blocks{side}); err != nil {
+			t.Fatalf("side block %d: failed to insert into chain: %v", i, err)
+		}
+	}
+	// The parent's allowance is used up, further side blocks are rejected unstored
+	if _, err := chain.InsertChain(types.Blocks{sides[3]}); !errors.Is(err, ErrSideChainRateLimited) {
+		t.Fatalf("excess side block: want %v, got %v", ErrSideChainRateLimited, err)
+	}
+	if chain.HasBlock(sides[3].Hash(), sides[3].NumberU64()) {
+		t.Errorf("excess side block stored")
+	}
+	// Blocks extending the head are not limited
+	extension, _ := GenerateChain(gspec.Config, blocks[len(blocks)-1], engine, gendb, 1, nil)
+	if _, err := chain.InsertChain(extension); err != nil {
+		t.Fatalf("failed to extend chain: %v", err)
+	}
+	// Once the window passed, the parent has a new allowance
+	chain.SetClock(frozenClock(now.Add(time.Minute)))
+	if _, err := chain.InsertChain(types.Blocks{sides[3]}); err != nil {
+		t.Fatalf("side block after window: failed to insert into chain: %v", err)
+	}
+	if !chain.HasBlock(sides[3].Hash(), sides[3].NumberU64()) {
+		t.Errorf("side block after window not stored")
+	}
+}
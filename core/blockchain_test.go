@@ -17,11 +17,16 @@
 package core
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/big"
 	"math/rand"
 	"os"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
@@ -29,6 +34,7 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus"
 	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/forkid"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/types"
@@ -36,9 +42,12 @@ import (
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/params/confp"
+	"github.com/ethereum/go-ethereum/params/types/coregeth"
 	"github.com/ethereum/go-ethereum/params/types/genesisT"
 	"github.com/ethereum/go-ethereum/params/types/goethereum"
 	"github.com/ethereum/go-ethereum/params/vars"
+	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/trie"
 )
 
@@ -513,7 +522,7 @@ func testReorgBadHashes(t *testing.T, full bool) {
 	blockchain.Stop()
 
 	// Create a new BlockChain and check that it rolled back the state.
-	ncm, err := NewBlockChain(blockchain.db, nil, blockchain.chainConfig, ethash.NewFaker(), vm.Config{}, nil, nil)
+	ncm, err := NewBlockChain(blockchain.db, nil, blockchain.Config(), ethash.NewFaker(), vm.Config{}, nil, nil)
 	if err != nil {
 		t.Fatalf("failed to create new chain manager: %v", err)
 	}
@@ -1218,7 +1227,7 @@ func TestCanonicalBlockRetrieval(t *testing.T) {
 	}
 	defer blockchain.Stop()
 
-	chain, _ := GenerateChain(blockchain.chainConfig, blockchain.genesisBlock, ethash.NewFaker(), blockchain.db, 10, func(i int, gen *BlockGen) {})
+	chain, _ := GenerateChain(blockchain.Config(), blockchain.genesisBlock, ethash.NewFaker(), blockchain.db, 10, func(i int, gen *BlockGen) {})
 
 	var pend sync.WaitGroup
 	pend.Add(len(chain))
@@ -1257,6 +1266,42 @@ func TestCanonicalBlockRetrieval(t *testing.T) {
 	pend.Wait()
 }
 
+// Tests that the chain's signer follows the signing forks across their transitions.
+func TestBlockChainSigner(t *testing.T) {
+	var (
+		db    = rawdb.NewMemoryDatabase()
+		gspec = &genesisT.Genesis{
+			Config: &goethereum.ChainConfig{
+				ChainID:        big.NewInt(1),
+				HomesteadBlock: big.NewInt(1),
+				EIP150Block:    big.NewInt(0),
+				EIP155Block:    big.NewInt(3),
+			},
+		}
+		genesis = MustCommitGenesis(db, gspec)
+	)
+	blockchain, _ := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, nil)
+	defer blockchain.Stop()
+
+	eip155 := types.NewEIP155Signer(gspec.Config.GetChainID())
+	for number, want := range []types.Signer{types.FrontierSigner{}, types.HomesteadSigner{}, types.HomesteadSigner{}, eip155, eip155} {
+		if have := blockchain.Signer(big.NewInt(int64(number))); !have.Equal(want) {
+			t.Errorf("block #%d: signer mismatch: have %T, want %T", number, have, want)
+		}
+	}
+	// Without a number, the signer of the head block is returned.
+	if have := blockchain.Signer(nil); !have.Equal(types.FrontierSigner{}) {
+		t.Errorf("genesis head: signer mismatch: have %T, want %T", have, types.FrontierSigner{})
+	}
+	blocks, _ := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), db, 3, nil)
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatal(err)
+	}
+	if have := blockchain.Signer(nil); !have.Equal(eip155) {
+		t.Errorf("head #3: signer mismatch: have %T, want %T", have, eip155)
+	}
+}
+
 func TestEIP155Transition(t *testing.T) {
 	// Configure and generate a sample block chain
 	var (
@@ -1636,6 +1681,85 @@ func TestBlockchainRecovery(t *testing.T) {
 	}
 }
 
+// Tests that a verify-only open of the broken database from the recovery scenario
+// reports the inconsistencies without repairing them.
+func TestBlockchainReadOnlyVerify(t *testing.T) {
+	// Configure and generate a sample block chain
+	var (
+		gendb   = rawdb.NewMemoryDatabase()
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		funds   = big.NewInt(1000000000)
+		gspec   = &genesisT.Genesis{Config: params.TestChainConfig, Alloc: genesisT.GenesisAlloc{address: {Balance: funds}}}
+		genesis = MustCommitGenesis(gendb, gspec)
+	)
+	height := uint64(1024)
+	blocks, receipts := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), gendb, int(height), nil)
+
+	// Import the chain as a ancient-first node
+	frdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp freezer dir: %v", err)
+	}
+	defer os.Remove(frdir)
+
+	ancientDb, err := rawdb.NewDatabaseWithFreezer(rawdb.NewMemoryDatabase(), frdir, "")
+	if err != nil {
+		t.Fatalf("failed to create temp freezer db: %v", err)
+	}
+	defer ancientDb.Close()
+	MustCommitGenesis(ancientDb, gspec)
+	ancient, _ := NewBlockChain(ancientDb, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, nil)
+
+	headers := make([]*types.Header, len(blocks))
+	for i, block := range blocks {
+		headers[i] = block.Header()
+	}
+	if n, err := ancient.InsertHeaderChain(headers, 1); err != nil {
+		t.Fatalf("failed to insert header %d: %v", n, err)
+	}
+	if n, err := ancient.InsertReceiptChain(blocks, receipts, uint64(3*len(blocks)/4)); err != nil {
+		t.Fatalf("failed to insert receipt %d: %v", n, err)
+	}
+	ancient.Stop()
+
+	report, err := NewBlockChainReadOnlyVerify(ancientDb)
+	if err != nil {
+		t.Fatalf("failed to verify chain: %v", err)
+	}
+	if !report.Consistent() {
+		t.Fatalf("intact chain reported inconsistent: %v", report.Inconsistencies)
+	}
+	// Destroy head fast block and tx index tail manually
+	midBlock := blocks[len(blocks)/2]
+	rawdb.WriteHeadFastBlockHash(ancientDb, midBlock.Hash())
+	rawdb.WriteTxIndexTail(ancientDb, 100)
+
+	report, err = NewBlockChainReadOnlyVerify(ancientDb)
+	if err != nil {
+		t.Fatalf("failed to verify chain: %v", err)
+	}
+	if report.HeadBlock != 0 || report.HeadFastBlock != midBlock.NumberU64() || report.HeadHeader != height || report.Ancients != 3*height/4+1 {
+		t.Errorf("heads mismatch: have block #%d, fast #%d, header #%d, ancients %d", report.HeadBlock, report.HeadFastBlock, report.HeadHeader, report.Ancients)
+	}
+	want := []ChainInconsistencyKind{InconsistencyFastBelowAncients, InconsistencyTxIndexTail}
+	if len(report.Inconsistencies) != len(want) {
+		t.Fatalf("inconsistencies mismatch: have %v, want %v", report.Inconsistencies, want)
+	}
+	for i, kind := range want {
+		if report.Inconsistencies[i].Kind != kind {
+			t.Errorf("inconsistency %d: have %v, want %v", i, report.Inconsistencies[i], kind)
+		}
+	}
+	// Nothing was repaired
+	if hash := rawdb.ReadHeadFastBlockHash(ancientDb); hash != midBlock.Hash() {
+		t.Errorf("head fast block modified: have %x, want %x", hash, midBlock.Hash())
+	}
+	if frozen, _ := ancientDb.Ancients(); frozen != 3*height/4+1 {
+		t.Errorf("ancients modified: have %d, want %d", frozen, 3*height/4+1)
+	}
+}
+
 func TestIncompleteAncientReceiptChainInsertion(t *testing.T) {
 	// Configure and generate a sample block chain
 	var (
@@ -1693,458 +1817,889 @@ func TestIncompleteAncientReceiptChainInsertion(t *testing.T) {
 	}
 }
 
-// Tests that importing a very large side fork, which is larger than the canon chain,
-// but where the difficulty per block is kept low: this means that it will not
-// overtake the 'canon' chain until after it's passed canon by about 200 blocks.
-//
-// Details at:
-//  - https://github.com/ethereum/go-ethereum/issues/18977
-//  - https://github.com/ethereum/go-ethereum/pull/18988
-func TestLowDiffLongChain(t *testing.T) {
-	// Generate a canonical chain to act as the main dataset
-	engine := ethash.NewFaker()
-	db := rawdb.NewMemoryDatabase()
-	genesis := MustCommitGenesis(db, new(genesisT.Genesis))
-
-	// We must use a pretty long chain to ensure that the fork doesn't overtake us
-	// until after at least 128 blocks post tip
-	blocks, _ := GenerateChain(params.TestChainConfig, genesis, engine, db, 6*TriesInMemory, func(i int, b *BlockGen) {
-		b.SetCoinbase(common.Address{1})
-		b.OffsetTime(-9)
-	})
+// fakeFreezer is an in-process rawdb.Freezer with injectable latency and faults.
+type fakeFreezer struct {
+	items    []map[string][]byte
+	latency  time.Duration // Delay of every append
+	failSync bool          // Whether syncing fails
+	tail     uint64        // Number of the first item retained, as reported by AncientTail
+	lock     sync.Mutex
+}
 
-	// Import the canonical chain
-	diskdb := rawdb.NewMemoryDatabase()
-	MustCommitGenesis(diskdb, new(genesisT.Genesis))
+func (f *fakeFreezer) AppendAncient(number uint64, hash, header, body, receipt, td []byte) error {
+	time.Sleep(f.latency)
+	f.lock.Lock()
+	defer f.lock.Unlock()
 
-	chain, err := NewBlockChain(diskdb, nil, params.TestChainConfig, engine, vm.Config{}, nil, nil)
-	if err != nil {
-		t.Fatalf("failed to create tester chain: %v", err)
-	}
-	if n, err := chain.InsertChain(blocks); err != nil {
-		t.Fatalf("block %d: failed to insert into chain: %v", n, err)
+	if number != uint64(len(f.items)) {
+		return fmt.Errorf("append of #%d out of order, have %d items", number, len(f.items))
 	}
-	// Generate fork chain, starting from an early block
-	parent := blocks[10]
-	fork, _ := GenerateChain(params.TestChainConfig, parent, engine, db, 8*TriesInMemory, func(i int, b *BlockGen) {
-		b.SetCoinbase(common.Address{2})
-	})
+	f.items = append(f.items, map[string][]byte{"hashes": hash, "headers": header, "bodies": body, "receipts": receipt, "diffs": td})
+	return nil
+}
 
-	// And now import the fork
-	if i, err := chain.InsertChain(fork); err != nil {
-		t.Fatalf("block %d: failed to insert into chain: %v", i, err)
-	}
-	head := chain.CurrentBlock()
-	if got := fork[len(fork)-1].Hash(); got != head.Hash() {
-		t.Fatalf("head wrong, expected %x got %x", head.Hash(), got)
+func (f *fakeFreezer) Ancient(kind string, number uint64) ([]byte, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if number >= uint64(len(f.items)) {
+		return nil, errors.New("out of bounds")
 	}
-	// Sanity check that all the canonical numbers are present
-	header := chain.CurrentHeader()
-	for number := head.NumberU64(); number > 0; number-- {
-		if hash := chain.GetHeaderByNumber(number).Hash(); hash != header.Hash() {
-			t.Fatalf("header %d: canonical hash mismatch: have %x, want %x", number, hash, header.Hash())
-		}
-		header = chain.GetHeader(header.ParentHash, number-1)
+	return f.items[number][kind], nil
+}
+
+func (f *fakeFreezer) TruncateAncients(n uint64) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if n < uint64(len(f.items)) {
+		f.items = f.items[:n]
 	}
+	return nil
 }
 
-// Tests that importing a sidechain (S), where
-// - S is sidechain, containing blocks [Sn...Sm]
-// - C is canon chain, containing blocks [G..Cn..Cm]
-// - A common ancestor is placed at prune-point + blocksBetweenCommonAncestorAndPruneblock
-// - The sidechain S is prepended with numCanonBlocksInSidechain blocks from the canon chain
-func testSideImport(t *testing.T, numCanonBlocksInSidechain, blocksBetweenCommonAncestorAndPruneblock int) {
+func (f *fakeFreezer) Ancients() (uint64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
 
-	// Generate a canonical chain to act as the main dataset
-	engine := ethash.NewFaker()
-	db := rawdb.NewMemoryDatabase()
-	genesis := MustCommitGenesis(db, new(genesisT.Genesis))
+	return uint64(len(f.items)), nil
+}
 
-	// Generate and import the canonical chain
-	blocks, _ := GenerateChain(params.TestChainConfig, genesis, engine, db, 2*TriesInMemory, nil)
-	diskdb := rawdb.NewMemoryDatabase()
-	MustCommitGenesis(diskdb, new(genesisT.Genesis))
-	chain, err := NewBlockChain(diskdb, nil, params.TestChainConfig, engine, vm.Config{}, nil, nil)
-	if err != nil {
-		t.Fatalf("failed to create tester chain: %v", err)
-	}
-	if n, err := chain.InsertChain(blocks); err != nil {
-		t.Fatalf("block %d: failed to insert into chain: %v", n, err)
-	}
+func (f *fakeFreezer) AncientTail() (uint64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
 
-	lastPrunedIndex := len(blocks) - TriesInMemory - 1
-	lastPrunedBlock := blocks[lastPrunedIndex]
-	firstNonPrunedBlock := blocks[len(blocks)-TriesInMemory]
+	return f.tail, nil
+}
 
-	// Verify pruning of lastPrunedBlock
-	if chain.HasBlockAndState(lastPrunedBlock.Hash(), lastPrunedBlock.NumberU64()) {
-		t.Errorf("Block %d not pruned", lastPrunedBlock.NumberU64())
-	}
-	// Verify firstNonPrunedBlock is not pruned
-	if !chain.HasBlockAndState(firstNonPrunedBlock.Hash(), firstNonPrunedBlock.NumberU64()) {
-		t.Errorf("Block %d pruned", firstNonPrunedBlock.NumberU64())
+func (f *fakeFreezer) Sync() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.failSync {
+		return errors.New("injected sync fault")
 	}
-	// Generate the sidechain
-	// First block should be a known block, block after should be a pruned block. So
-	// canon(pruned), side, side...
+	return nil
+}
 
-	// Generate fork chain, make it longer than canon
-	parentIndex := lastPrunedIndex + blocksBetweenCommonAncestorAndPruneblock
-	parent := blocks[parentIndex]
-	fork, _ := GenerateChain(params.TestChainConfig, parent, engine, db, 2*TriesInMemory, func(i int, b *BlockGen) {
-		b.SetCoinbase(common.Address{2})
+// Tests that receipt chains are inserted into a custom freezer, and that ancients
+// which failed to sync are rolled back.
+func TestAncientReceiptChainInsertionCustomFreezer(t *testing.T) {
+	// Configure and generate a sample block chain
+	var (
+		gendb   = rawdb.NewMemoryDatabase()
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		funds   = big.NewInt(1000000000)
+		gspec   = &genesisT.Genesis{Config: params.TestChainConfig, Alloc: genesisT.GenesisAlloc{address: {Balance: funds}}}
+		genesis = MustCommitGenesis(gendb, gspec)
+		signer  = types.NewEIP155Signer(gspec.Config.GetChainID())
+	)
+	height := uint64(64)
+	blocks, receipts := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), gendb, int(height), func(i int, block *BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), common.Address{0x00}, big.NewInt(1000), vars.TxGas, nil, nil), signer, key)
+		if err != nil {
+			panic(err)
+		}
+		block.AddTx(tx)
 	})
-	// Prepend the parent(s)
-	var sidechain []*types.Block
-	for i := numCanonBlocksInSidechain; i > 0; i-- {
-		sidechain = append(sidechain, blocks[parentIndex+1-i])
-	}
-	sidechain = append(sidechain, fork...)
-	_, err = chain.InsertChain(sidechain)
+	fake := &fakeFreezer{latency: time.Millisecond, failSync: true}
+	ancientDb, err := rawdb.NewDatabaseWithCustomFreezer(rawdb.NewMemoryDatabase(), fake)
 	if err != nil {
-		t.Errorf("Got error, %v", err)
+		t.Fatalf("failed to create custom freezer db: %v", err)
 	}
-	head := chain.CurrentBlock()
-	if got := fork[len(fork)-1].Hash(); got != head.Hash() {
-		t.Fatalf("head wrong, expected %x got %x", head.Hash(), got)
+	defer ancientDb.Close()
+	MustCommitGenesis(ancientDb, gspec)
+	ancient, _ := NewBlockChain(ancientDb, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, nil)
+	defer ancient.Stop()
+
+	headers := make([]*types.Header, len(blocks))
+	for i, block := range blocks {
+		headers[i] = block.Header()
+	}
+	if n, err := ancient.InsertHeaderChain(headers, 1); err != nil {
+		t.Fatalf("failed to insert header %d: %v", n, err)
+	}
+	// A faulting freezer aborts the insertion and the ancients are rolled back
+	if _, err := ancient.InsertReceiptChain(blocks, receipts, height/2); err == nil {
+		t.Fatalf("receipt chain insertion succeeded despite freezer fault")
+	}
+	if frozen, _ := fake.Ancients(); frozen != 1 {
+		t.Fatalf("ancients not rolled back: have %d, want 1", frozen)
+	}
+	if num := ancient.CurrentFastBlock().NumberU64(); num != 0 {
+		t.Fatalf("head fast block mismatch: have #%d, want #0", num)
+	}
+	// Once the freezer recovers, the insertion goes through
+	fake.lock.Lock()
+	fake.failSync = false
+	fake.lock.Unlock()
+	if n, err := ancient.InsertReceiptChain(blocks, receipts, height/2); err != nil {
+		t.Fatalf("failed to insert receipt %d: %v", n, err)
+	}
+	if frozen, _ := fake.Ancients(); frozen != height/2+1 {
+		t.Fatalf("ancients mismatch: have %d, want %d", frozen, height/2+1)
+	}
+	if num := ancient.CurrentFastBlock().NumberU64(); num != height {
+		t.Fatalf("head fast block mismatch: have #%d, want #%d", num, height)
+	}
+	for i, block := range blocks {
+		have := ancient.GetReceiptsByHash(block.Hash())
+		if len(have) != len(receipts[i]) || have[0].TxHash != receipts[i][0].TxHash {
+			t.Errorf("block #%d: receipts mismatch", block.NumberU64())
+		}
 	}
 }
 
-// Tests that importing a sidechain (S), where
-// - S is sidechain, containing blocks [Sn...Sm]
-// - C is canon chain, containing blocks [G..Cn..Cm]
-// - The common ancestor Cc is pruned
-// - The first block in S: Sn, is == Cn
-// That is: the sidechain for import contains some blocks already present in canon chain.
-// So the blocks are
-// [ Cn, Cn+1, Cc, Sn+3 ... Sm]
-//   ^    ^    ^  pruned
-func TestPrunedImportSide(t *testing.T) {
-	//glogger := log.NewGlogHandler(log.StreamHandler(os.Stdout, log.TerminalFormat(false)))
-	//glogger.Verbosity(3)
-	//log.Root().SetHandler(log.Handler(glogger))
-	testSideImport(t, 3, 3)
-	testSideImport(t, 3, -3)
-	testSideImport(t, 10, 0)
-	testSideImport(t, 1, 10)
-	testSideImport(t, 1, -10)
+// testSenderProvider is a SenderProvider knowing a fixed set of senders, recording
+// the transactions it was asked for.
+type testSenderProvider struct {
+	senders map[common.Hash]common.Address
+	asked   int
+	lock    sync.Mutex
 }
 
-func TestInsertKnownHeaders(t *testing.T)      { testInsertKnownChainData(t, "headers") }
-func TestInsertKnownReceiptChain(t *testing.T) { testInsertKnownChainData(t, "receipts") }
-func TestInsertKnownBlocks(t *testing.T)       { testInsertKnownChainData(t, "blocks") }
-
-func testInsertKnownChainData(t *testing.T, typ string) {
-	engine := ethash.NewFaker()
+func (p *testSenderProvider) Sender(hash common.Hash) (common.Address, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
 
-	db := rawdb.NewMemoryDatabase()
-	genesis := MustCommitGenesis(db, new(genesisT.Genesis))
-
-	blocks, receipts := GenerateChain(params.TestChainConfig, genesis, engine, db, 32, func(i int, b *BlockGen) { b.SetCoinbase(common.Address{1}) })
-	// A longer chain but total difficulty is lower.
-	blocks2, receipts2 := GenerateChain(params.TestChainConfig, blocks[len(blocks)-1], engine, db, 65, func(i int, b *BlockGen) { b.SetCoinbase(common.Address{1}) })
-	// A shorter chain but total difficulty is higher.
-	blocks3, receipts3 := GenerateChain(params.TestChainConfig, blocks[len(blocks)-1], engine, db, 64, func(i int, b *BlockGen) {
-		b.SetCoinbase(common.Address{1})
-		b.OffsetTime(-9) // A higher difficulty
-	})
-	// Import the shared chain and the original canonical one
-	dir, err := ioutil.TempDir("", "")
-	if err != nil {
-		t.Fatalf("failed to create temp freezer dir: %v", err)
-	}
-	defer os.Remove(dir)
-	chaindb, err := rawdb.NewDatabaseWithFreezer(rawdb.NewMemoryDatabase(), dir, "")
-	if err != nil {
-		t.Fatalf("failed to create temp freezer db: %v", err)
-	}
-	MustCommitGenesis(chaindb, new(genesisT.Genesis))
-	defer os.RemoveAll(dir)
-
-	chain, err := NewBlockChain(chaindb, nil, params.TestChainConfig, engine, vm.Config{}, nil, nil)
-	if err != nil {
-		t.Fatalf("failed to create tester chain: %v", err)
-	}
+	p.asked++
+	from, ok := p.senders[hash]
+	return from, ok
+}
 
+// Tests that the senders known by a sender provider are used as they are, the others
+// being recovered from the signatures.
+func TestSenderProvider(t *testing.T) {
 	var (
-		inserter func(blocks []*types.Block, receipts []types.Receipts) error
-		asserter func(t *testing.T, block *types.Block)
-	)
-	if typ == "headers" {
-		inserter = func(blocks []*types.Block, receipts []types.Receipts) error {
-			headers := make([]*types.Header, 0, len(blocks))
-			for _, block := range blocks {
-				headers = append(headers, block.Header())
-			}
-			_, err := chain.InsertHeaderChain(headers, 1)
-			return err
+		gendb   = rawdb.NewMemoryDatabase()
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		gspec   = &genesisT.Genesis{
+			Config: params.TestChainConfig,
+			Alloc:  genesisT.GenesisAlloc{address: {Balance: big.NewInt(1000000000)}},
 		}
-		asserter = func(t *testing.T, block *types.Block) {
-			if chain.CurrentHeader().Hash() != block.Hash() {
-				t.Fatalf("current head header mismatch, have %v, want %v", chain.CurrentHeader().Hash().Hex(), block.Hash().Hex())
+		genesis = MustCommitGenesis(gendb, gspec)
+		signer  = types.NewEIP155Signer(gspec.Config.GetChainID())
+	)
+	blocks, _ := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), gendb, 4, func(i int, block *BlockGen) {
+		for j := 0; j < 2; j++ {
+			tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), common.Address{0x01}, big.NewInt(1000), vars.TxGas, nil, nil), signer, key)
+			if err != nil {
+				panic(err)
 			}
+			block.AddTx(tx)
 		}
-	} else if typ == "receipts" {
-		inserter = func(blocks []*types.Block, receipts []types.Receipts) error {
-			headers := make([]*types.Header, 0, len(blocks))
-			for _, block := range blocks {
-				headers = append(headers, block.Header())
-			}
-			_, err := chain.InsertHeaderChain(headers, 1)
+	})
+	// fresh copies the blocks, without the senders cached by their generation.
+	fresh := func() types.Blocks {
+		var copies types.Blocks
+		for _, block := range blocks {
+			blob, err := rlp.EncodeToBytes(block)
 			if err != nil {
-				return err
+				t.Fatal(err)
 			}
-			_, err = chain.InsertReceiptChain(blocks, receipts, 0)
-			return err
-		}
-		asserter = func(t *testing.T, block *types.Block) {
-			if chain.CurrentFastBlock().Hash() != block.Hash() {
-				t.Fatalf("current head fast block mismatch, have %v, want %v", chain.CurrentFastBlock().Hash().Hex(), block.Hash().Hex())
+			copied := new(types.Block)
+			if err := rlp.DecodeBytes(blob, copied); err != nil {
+				t.Fatal(err)
 			}
+			copies = append(copies, copied)
 		}
-	} else {
-		inserter = func(blocks []*types.Block, receipts []types.Receipts) error {
-			_, err := chain.InsertChain(blocks)
-			return err
+		return copies
+	}
+	newChain := func(provider SenderProvider) *BlockChain {
+		db := rawdb.NewMemoryDatabase()
+		MustCommitGenesis(db, gspec)
+		chain, err := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, nil)
+		if err != nil {
+			t.Fatalf("failed to create tester chain: %v", err)
 		}
-		asserter = func(t *testing.T, block *types.Block) {
-			if chain.CurrentBlock().Hash() != block.Hash() {
-				t.Fatalf("current head block mismatch, have %v, want %v", chain.CurrentBlock().Hash().Hex(), block.Hash().Hex())
+		t.Cleanup(chain.Stop)
+		chain.SetSenderProvider(provider)
+		return chain
+	}
+	// Provided senders skip the recovery: a bogus one is trusted, failing the block
+	bogus := common.Address{0xde, 0xad}
+	copies := fresh()
+	tx := copies[0].Transactions()[0]
+	if _, err := newChain(&testSenderProvider{senders: map[common.Hash]common.Address{tx.Hash(): bogus}}).InsertChain(copies); err == nil {
+		t.Fatalf("block with bogus provided sender accepted")
+	}
+	if from, _ := types.Sender(signer, tx); from != bogus {
+		t.Fatalf("provided sender not cached: have %x, want %x", from, bogus)
+	}
+	// Senders known by the provider and recovered ones mix
+	provider := &testSenderProvider{senders: make(map[common.Hash]common.Address)}
+	copies = fresh()
+	var txs int
+	for _, block := range copies {
+		for i, tx := range block.Transactions() {
+			if i%2 == 0 {
+				provider.senders[tx.Hash()] = address
+			}
+			txs++
+		}
+	}
+	if n, err := newChain(provider).InsertChain(copies); err != nil {
+		t.Fatalf("failed to insert block %d: %v", n, err)
+	}
+	if provider.asked != txs {
+		t.Errorf("provider asked for %d senders, want %d", provider.asked, txs)
+	}
+	for _, block := range copies {
+		for _, tx := range block.Transactions() {
+			if from, _ := types.Sender(signer, tx); from != address {
+				t.Errorf("tx %x: sender %x, want %x", tx.Hash(), from, address)
 			}
 		}
 	}
+}
 
-	if err := inserter(blocks, receipts); err != nil {
-		t.Fatalf("failed to insert chain data: %v", err)
+// Tests that inserting blocks below the tail retained by the ancient store fails.
+func TestInsertBelowAncientTail(t *testing.T) {
+	var (
+		gendb   = rawdb.NewMemoryDatabase()
+		gspec   = &genesisT.Genesis{Config: params.TestChainConfig}
+		genesis = MustCommitGenesis(gendb, gspec)
+	)
+	blocks, receipts := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), gendb, 32, nil)
+
+	// newChain creates a chain on top of a fake freezer retaining items from tail.
+	newChain := func(tail uint64) (*BlockChain, *fakeFreezer) {
+		freezer := &fakeFreezer{tail: tail}
+		db, err := rawdb.NewDatabaseWithCustomFreezer(rawdb.NewMemoryDatabase(), freezer)
+		if err != nil {
+			t.Fatalf("failed to create custom freezer db: %v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		MustCommitGenesis(db, gspec)
+		chain, err := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, nil)
+		if err != nil {
+			t.Fatalf("failed to create tester chain: %v", err)
+		}
+		t.Cleanup(chain.Stop)
+		return chain, freezer
+	}
+	// Receipts of blocks below the tail are refused, those of live blocks accepted.
+	fast, _ := newChain(10)
+	headers := make([]*types.Header, len(blocks))
+	for i, block := range blocks {
+		headers[i] = block.Header()
+	}
+	if n, err := fast.InsertHeaderChain(headers, 1); err != nil {
+		t.Fatalf("failed to insert header %d: %v", n, err)
+	}
+	if _, err := fast.InsertReceiptChain(blocks[5:15], receipts[5:15], 16); !errors.Is(err, ErrBelowTail) {
+		t.Fatalf("receipts below the tail: want %v, got %v", ErrBelowTail, err)
+	}
+	if n, err := fast.InsertReceiptChain(blocks[20:], receipts[20:], 16); err != nil {
+		t.Fatalf("failed to insert receipt %d: %v", n, err)
 	}
+	// Known blocks below the tail are refused, blocks extending the chain accepted.
+	full, freezer := newChain(0)
+	if n, err := full.InsertChain(blocks[:20]); err != nil {
+		t.Fatalf("failed to insert block %d: %v", n, err)
+	}
+	freezer.lock.Lock()
+	freezer.tail = 10
+	freezer.lock.Unlock()
 
-	// Reimport the chain data again. All the imported
-	// chain data are regarded "known" data.
-	if err := inserter(blocks, receipts); err != nil {
-		t.Fatalf("failed to insert chain data: %v", err)
+	if _, err := full.InsertChain(blocks[5:15]); !errors.Is(err, ErrBelowTail) {
+		t.Fatalf("blocks below the tail: want %v, got %v", ErrBelowTail, err)
 	}
-	asserter(t, blocks[len(blocks)-1])
+	if n, err := full.InsertChain(blocks[20:]); err != nil {
+		t.Fatalf("failed to insert block %d: %v", n, err)
+	}
+}
 
-	// Import a long canonical chain with some known data as prefix.
-	rollback := blocks[len(blocks)/2].NumberU64()
+// newVerifyAncientsChain creates a chain of 32 blocks of a transaction each, the
+// first 17 of which are frozen into a fake freezer.
+func newVerifyAncientsChain(t *testing.T) (*BlockChain, *fakeFreezer) {
+	var (
+		gendb   = rawdb.NewMemoryDatabase()
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		gspec   = &genesisT.Genesis{Config: params.TestChainConfig, Alloc: genesisT.GenesisAlloc{address: {Balance: big.NewInt(1000000000)}}}
+		genesis = MustCommitGenesis(gendb, gspec)
+		signer  = types.NewEIP155Signer(gspec.Config.GetChainID())
+	)
+	blocks, receipts := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), gendb, 32, func(i int, block *BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), common.Address{0x00}, big.NewInt(1000), vars.TxGas, nil, nil), signer, key)
+		if err != nil {
+			panic(err)
+		}
+		block.AddTx(tx)
+	})
+	fake := new(fakeFreezer)
+	ancientDb, err := rawdb.NewDatabaseWithCustomFreezer(rawdb.NewMemoryDatabase(), fake)
+	if err != nil {
+		t.Fatalf("failed to create custom freezer db: %v", err)
+	}
+	t.Cleanup(func() { ancientDb.Close() })
+	MustCommitGenesis(ancientDb, gspec)
+	ancient, _ := NewBlockChain(ancientDb, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, nil)
+	t.Cleanup(ancient.Stop)
 
-	chain.SetHead(rollback - 1)
-	if err := inserter(append(blocks, blocks2...), append(receipts, receipts2...)); err != nil {
-		t.Fatalf("failed to insert chain data: %v", err)
+	headers := make([]*types.Header, len(blocks))
+	for i, block := range blocks {
+		headers[i] = block.Header()
 	}
-	asserter(t, blocks2[len(blocks2)-1])
+	if n, err := ancient.InsertHeaderChain(headers, 1); err != nil {
+		t.Fatalf("failed to insert header %d: %v", n, err)
+	}
+	if n, err := ancient.InsertReceiptChain(blocks, receipts, 16); err != nil {
+		t.Fatalf("failed to insert receipt %d: %v", n, err)
+	}
+	return ancient, fake
+}
 
-	// Import a heavier shorter but higher total difficulty chain with some known data as prefix.
-	if err := inserter(append(blocks, blocks3...), append(receipts, receipts3...)); err != nil {
-		t.Fatalf("failed to insert chain data: %v", err)
+// Tests that background ancients verifications run to completion, reporting the
+// mismatches of corrupted items.
+func TestStartVerifyAncients(t *testing.T) {
+	ancient, fake := newVerifyAncientsChain(t)
+
+	// verify polls a verification of the range to completion.
+	verify := func(from, to uint64) *AncientScanStatus {
+		t.Helper()
+		id, err := ancient.StartVerifyAncients(from, to)
+		if err != nil {
+			t.Fatalf("failed to start verification: %v", err)
+		}
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			status, err := ancient.StatusVerifyAncients(id)
+			if err != nil {
+				t.Fatalf("failed to retrieve status: %v", err)
+			}
+			if status.Done {
+				if status.Error != "" {
+					t.Fatalf("verification failed: %v", status.Error)
+				}
+				if status.Verified != to-from+1 {
+					t.Fatalf("verified blocks mismatch: have %d, want %d", status.Verified, to-from+1)
+				}
+				return status
+			}
+		}
+		t.Fatalf("verification not done")
+		return nil
 	}
-	asserter(t, blocks3[len(blocks3)-1])
+	if status := verify(1, 16); len(status.Mismatches) != 0 {
+		t.Fatalf("clean ancients reported mismatches: %v", status.Mismatches)
+	}
+	// Swap the bodies of two blocks, leaving every item decodable.
+	fake.lock.Lock()
+	fake.items[5]["bodies"], fake.items[6]["bodies"] = fake.items[6]["bodies"], fake.items[5]["bodies"]
+	fake.lock.Unlock()
 
-	// Import a longer but lower total difficulty chain with some known data as prefix.
-	if err := inserter(append(blocks, blocks2...), append(receipts, receipts2...)); err != nil {
-		t.Fatalf("failed to insert chain data: %v", err)
+	status := verify(1, 16)
+	if len(status.Mismatches) != 2 {
+		t.Fatalf("mismatch count: have %d, want 2: %v", len(status.Mismatches), status.Mismatches)
 	}
-	// The head shouldn't change.
-	asserter(t, blocks3[len(blocks3)-1])
+	for i, number := range []uint64{5, 6} {
+		if have := status.Mismatches[i]; have.Number != number || have.Kind != "bodies" {
+			t.Errorf("mismatch %d: have %v, want bodies of #%d", i, have, number)
+		}
+	}
+	if _, err := ancient.StartVerifyAncients(1, 17); err == nil {
+		t.Errorf("verification beyond the ancients started")
+	}
+	if _, err := ancient.StatusVerifyAncients(42); err == nil {
+		t.Errorf("status of unknown verification retrieved")
+	}
+}
 
-	// Rollback the heavier chain and re-insert the longer chain again
-	chain.SetHead(rollback - 1)
-	if err := inserter(append(blocks, blocks2...), append(receipts, receipts2...)); err != nil {
-		t.Fatalf("failed to insert chain data: %v", err)
+// Tests that verifying ancients with concurrent workers reports the same mismatches,
+// in the same order, as verifying them one block after the other.
+func TestVerifyAncientsParallel(t *testing.T) {
+	chain, fake := newVerifyAncientsChain(t)
+
+	// Swap two bodies, and mangle a total difficulty, mismatching the next one too
+	fake.lock.Lock()
+	fake.items[5]["bodies"], fake.items[6]["bodies"] = fake.items[6]["bodies"], fake.items[5]["bodies"]
+	fake.items[13]["diffs"] = []byte{0x01}
+	fake.lock.Unlock()
+
+	serial, err := VerifyAncients(context.Background(), chain.db, 1, 16, 1, nil)
+	if err != nil {
+		t.Fatalf("serial verification failed: %v", err)
+	}
+	if len(serial) != 4 {
+		t.Fatalf("serial mismatch count: have %d, want 4: %v", len(serial), serial)
+	}
+	for _, workers := range []int{2, 3, 4, 16, 64} {
+		verified := make(map[uint64]int)
+		mismatches, err := VerifyAncients(context.Background(), chain.db, 1, 16, workers, func(number uint64) {
+			verified[number]++
+		})
+		if err != nil {
+			t.Fatalf("%d workers: verification failed: %v", workers, err)
+		}
+		if !reflect.DeepEqual(mismatches, serial) {
+			t.Errorf("%d workers: mismatches differ:\nhave %v\nwant %v", workers, mismatches, serial)
+		}
+		for number := uint64(1); number <= 16; number++ {
+			if verified[number] != 1 {
+				t.Errorf("%d workers: block #%d reported verified %d times", workers, number, verified[number])
+			}
+		}
+		if len(verified) != 16 {
+			t.Errorf("%d workers: %d blocks reported verified, want 16", workers, len(verified))
+		}
 	}
-	asserter(t, blocks2[len(blocks2)-1])
 }
 
-// getLongAndShortChains returns two chains,
-// A is longer, B is heavier
-func getLongAndShortChains() (*BlockChain, []*types.Block, []*types.Block, error) {
+// Tests that importing a very large side fork, which is larger than the canon chain,
+// but where the difficulty per block is kept low: this means that it will not
+// overtake the 'canon' chain until after it's passed canon by about 200 blocks.
+//
+// Details at:
+//  - https://github.com/ethereum/go-ethereum/issues/18977
+//  - https://github.com/ethereum/go-ethereum/pull/18988
+func TestLowDiffLongChain(t *testing.T) {
 	// Generate a canonical chain to act as the main dataset
 	engine := ethash.NewFaker()
 	db := rawdb.NewMemoryDatabase()
 	genesis := MustCommitGenesis(db, new(genesisT.Genesis))
 
-	// Generate and import the canonical chain,
-	// Offset the time, to keep the difficulty low
-	longChain, _ := GenerateChain(params.TestChainConfig, genesis, engine, db, 80, func(i int, b *BlockGen) {
+	// We must use a pretty long chain to ensure that the fork doesn't overtake us
+	// until after at least 128 blocks post tip
+	blocks, _ := GenerateChain(params.TestChainConfig, genesis, engine, db, 6*TriesInMemory, func(i int, b *BlockGen) {
 		b.SetCoinbase(common.Address{1})
+		b.OffsetTime(-9)
 	})
+
+	// Import the canonical chain
 	diskdb := rawdb.NewMemoryDatabase()
 	MustCommitGenesis(diskdb, new(genesisT.Genesis))
 
 	chain, err := NewBlockChain(diskdb, nil, params.TestChainConfig, engine, vm.Config{}, nil, nil)
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("failed to create tester chain: %v", err)
+		t.Fatalf("failed to create tester chain: %v", err)
 	}
-
-	// Generate fork chain, make it shorter than canon, with common ancestor pretty early
-	parentIndex := 3
-	parent := longChain[parentIndex]
-	heavyChain, _ := GenerateChain(params.TestChainConfig, parent, engine, db, 75, func(i int, b *BlockGen) {
+	if n, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("block %d: failed to insert into chain: %v", n, err)
+	}
+	// Generate fork chain, starting from an early block
+	parent := blocks[10]
+	fork, _ := GenerateChain(params.TestChainConfig, parent, engine, db, 8*TriesInMemory, func(i int, b *BlockGen) {
 		b.SetCoinbase(common.Address{2})
-		b.OffsetTime(-9)
 	})
-	// Verify that the test is sane
-	var (
-		longerTd  = new(big.Int)
-		shorterTd = new(big.Int)
-	)
-	for index, b := range longChain {
-		longerTd.Add(longerTd, b.Difficulty())
-		if index <= parentIndex {
-			shorterTd.Add(shorterTd, b.Difficulty())
-		}
-	}
-	for _, b := range heavyChain {
-		shorterTd.Add(shorterTd, b.Difficulty())
+
+	// And now import the fork
+	if i, err := chain.InsertChain(fork); err != nil {
+		t.Fatalf("block %d: failed to insert into chain: %v", i, err)
 	}
-	if shorterTd.Cmp(longerTd) <= 0 {
-		return nil, nil, nil, fmt.Errorf("Test is moot, heavyChain td (%v) must be larger than canon td (%v)", shorterTd, longerTd)
+	head := chain.CurrentBlock()
+	if got := fork[len(fork)-1].Hash(); got != head.Hash() {
+		t.Fatalf("head wrong, expected %x got %x", head.Hash(), got)
 	}
-	longerNum := longChain[len(longChain)-1].NumberU64()
-	shorterNum := heavyChain[len(heavyChain)-1].NumberU64()
-	if shorterNum >= longerNum {
-		return nil, nil, nil, fmt.Errorf("Test is moot, heavyChain num (%v) must be lower than canon num (%v)", shorterNum, longerNum)
+	// Sanity check that all the canonical numbers are present
+	header := chain.CurrentHeader()
+	for number := head.NumberU64(); number > 0; number-- {
+		if hash := chain.GetHeaderByNumber(number).Hash(); hash != header.Hash() {
+			t.Fatalf("header %d: canonical hash mismatch: have %x, want %x", number, hash, header.Hash())
+		}
+		header = chain.GetHeader(header.ParentHash, number-1)
 	}
-	return chain, longChain, heavyChain, nil
 }
 
-// TestReorgToShorterRemovesCanonMapping tests that if we
-// 1. Have a chain [0 ... N .. X]
-// 2. Reorg to shorter but heavier chain [0 ... N ... Y]
-// 3. Then there should be no canon mapping for the block at height X
-func TestReorgToShorterRemovesCanonMapping(t *testing.T) {
-	chain, canonblocks, sideblocks, err := getLongAndShortChains()
-	if err != nil {
-		t.Fatal(err)
-	}
-	if n, err := chain.InsertChain(canonblocks); err != nil {
+// Tests that importing a sidechain (S), where
+// - S is sidechain, containing blocks [Sn...Sm]
+// - C is canon chain, containing blocks [G..Cn..Cm]
+// - A common ancestor is placed at prune-point + blocksBetweenCommonAncestorAndPruneblock
+// - The sidechain S is prepended with numCanonBlocksInSidechain blocks from the canon chain
+func testSideImport(t *testing.T, numCanonBlocksInSidechain, blocksBetweenCommonAncestorAndPruneblock int) {
+
+	// Generate a canonical chain to act as the main dataset
+	engine := ethash.NewFaker()
+	db := rawdb.NewMemoryDatabase()
+	genesis := MustCommitGenesis(db, new(genesisT.Genesis))
+
+	// Generate and import the canonical chain
+	blocks, _ := GenerateChain(params.TestChainConfig, genesis, engine, db, 2*TriesInMemory, nil)
+	diskdb := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(diskdb, new(genesisT.Genesis))
+	chain, err := NewBlockChain(diskdb, nil, params.TestChainConfig, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	if n, err := chain.InsertChain(blocks); err != nil {
 		t.Fatalf("block %d: failed to insert into chain: %v", n, err)
 	}
-	canonNum := chain.CurrentBlock().NumberU64()
-	_, err = chain.InsertChain(sideblocks)
+
+	lastPrunedIndex := len(blocks) - TriesInMemory - 1
+	lastPrunedBlock := blocks[lastPrunedIndex]
+	firstNonPrunedBlock := blocks[len(blocks)-TriesInMemory]
+
+	// Verify pruning of lastPrunedBlock
+	if chain.HasBlockAndState(lastPrunedBlock.Hash(), lastPrunedBlock.NumberU64()) {
+		t.Errorf("Block %d not pruned", lastPrunedBlock.NumberU64())
+	}
+	// Verify firstNonPrunedBlock is not pruned
+	if !chain.HasBlockAndState(firstNonPrunedBlock.Hash(), firstNonPrunedBlock.NumberU64()) {
+		t.Errorf("Block %d pruned", firstNonPrunedBlock.NumberU64())
+	}
+	// Generate the sidechain
+	// First block should be a known block, block after should be a pruned block. So
+	// canon(pruned), side, side...
+
+	// Generate fork chain, make it longer than canon
+	parentIndex := lastPrunedIndex + blocksBetweenCommonAncestorAndPruneblock
+	parent := blocks[parentIndex]
+	fork, _ := GenerateChain(params.TestChainConfig, parent, engine, db, 2*TriesInMemory, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{2})
+	})
+	// Prepend the parent(s)
+	var sidechain []*types.Block
+	for i := numCanonBlocksInSidechain; i > 0; i-- {
+		sidechain = append(sidechain, blocks[parentIndex+1-i])
+	}
+	sidechain = append(sidechain, fork...)
+	_, err = chain.InsertChain(sidechain)
 	if err != nil {
 		t.Errorf("Got error, %v", err)
 	}
 	head := chain.CurrentBlock()
-	if got := sideblocks[len(sideblocks)-1].Hash(); got != head.Hash() {
+	if got := fork[len(fork)-1].Hash(); got != head.Hash() {
 		t.Fatalf("head wrong, expected %x got %x", head.Hash(), got)
 	}
-	// We have now inserted a sidechain.
-	if blockByNum := chain.GetBlockByNumber(canonNum); blockByNum != nil {
-		t.Errorf("expected block to be gone: %v", blockByNum.NumberU64())
-	}
-	if headerByNum := chain.GetHeaderByNumber(canonNum); headerByNum != nil {
-		t.Errorf("expected header to be gone: %v", headerByNum.Number.Uint64())
-	}
 }
 
-// TestReorgToShorterRemovesCanonMappingHeaderChain is the same scenario
-// as TestReorgToShorterRemovesCanonMapping, but applied on headerchain
-// imports -- that is, for fast sync
-func TestReorgToShorterRemovesCanonMappingHeaderChain(t *testing.T) {
-	chain, canonblocks, sideblocks, err := getLongAndShortChains()
+// Tests that importing a sidechain (S), where
+// - S is sidechain, containing blocks [Sn...Sm]
+// - C is canon chain, containing blocks [G..Cn..Cm]
+// - The common ancestor Cc is pruned
+// - The first block in S: Sn, is == Cn
+// That is: the sidechain for import contains some blocks already present in canon chain.
+// So the blocks are
+// [ Cn, Cn+1, Cc, Sn+3 ... Sm]
+//   ^    ^    ^  pruned
+func TestPrunedImportSide(t *testing.T) {
+	//glogger := log.NewGlogHandler(log.StreamHandler(os.Stdout, log.TerminalFormat(false)))
+	//glogger.Verbosity(3)
+	//log.Root().SetHandler(log.Handler(glogger))
+	testSideImport(t, 3, 3)
+	testSideImport(t, 3, -3)
+	testSideImport(t, 10, 0)
+	testSideImport(t, 1, 10)
+	testSideImport(t, 1, -10)
+}
+
+func TestInsertKnownHeaders(t *testing.T)      { testInsertKnownChainData(t, "headers") }
+func TestInsertKnownReceiptChain(t *testing.T) { testInsertKnownChainData(t, "receipts") }
+func TestInsertKnownBlocks(t *testing.T)       { testInsertKnownChainData(t, "blocks") }
+
+func testInsertKnownChainData(t *testing.T, typ string) {
+	engine := ethash.NewFaker()
+
+	db := rawdb.NewMemoryDatabase()
+	genesis := MustCommitGenesis(db, new(genesisT.Genesis))
+
+	blocks, receipts := GenerateChain(params.TestChainConfig, genesis, engine, db, 32, func(i int, b *BlockGen) { b.SetCoinbase(common.Address{1}) })
+	// A longer chain but total difficulty is lower.
+	blocks2, receipts2 := GenerateChain(params.TestChainConfig, blocks[len(blocks)-1], engine, db, 65, func(i int, b *BlockGen) { b.SetCoinbase(common.Address{1}) })
+	// A shorter chain but total difficulty is higher.
+	blocks3, receipts3 := GenerateChain(params.TestChainConfig, blocks[len(blocks)-1], engine, db, 64, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{1})
+		b.OffsetTime(-9) // A higher difficulty
+	})
+	// Import the shared chain and the original canonical one
+	dir, err := ioutil.TempDir("", "")
 	if err != nil {
-		t.Fatal(err)
-	}
-	// Convert into headers
-	canonHeaders := make([]*types.Header, len(canonblocks))
-	for i, block := range canonblocks {
-		canonHeaders[i] = block.Header()
-	}
-	if n, err := chain.InsertHeaderChain(canonHeaders, 0); err != nil {
-		t.Fatalf("header %d: failed to insert into chain: %v", n, err)
-	}
-	canonNum := chain.CurrentHeader().Number.Uint64()
-	sideHeaders := make([]*types.Header, len(sideblocks))
-	for i, block := range sideblocks {
-		sideHeaders[i] = block.Header()
-	}
-	if n, err := chain.InsertHeaderChain(sideHeaders, 0); err != nil {
-		t.Fatalf("header %d: failed to insert into chain: %v", n, err)
-	}
-	head := chain.CurrentHeader()
-	if got := sideblocks[len(sideblocks)-1].Hash(); got != head.Hash() {
-		t.Fatalf("head wrong, expected %x got %x", head.Hash(), got)
+		t.Fatalf("failed to create temp freezer dir: %v", err)
 	}
-	// We have now inserted a sidechain.
-	if blockByNum := chain.GetBlockByNumber(canonNum); blockByNum != nil {
-		t.Errorf("expected block to be gone: %v", blockByNum.NumberU64())
+	defer os.Remove(dir)
+	chaindb, err := rawdb.NewDatabaseWithFreezer(rawdb.NewMemoryDatabase(), dir, "")
+	if err != nil {
+		t.Fatalf("failed to create temp freezer db: %v", err)
 	}
-	if headerByNum := chain.GetHeaderByNumber(canonNum); headerByNum != nil {
-		t.Errorf("expected header to be gone: %v", headerByNum.Number.Uint64())
+	MustCommitGenesis(chaindb, new(genesisT.Genesis))
+	defer os.RemoveAll(dir)
+
+	chain, err := NewBlockChain(chaindb, nil, params.TestChainConfig, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
 	}
-}
 
-func TestTransactionIndices(t *testing.T) {
-	// Configure and generate a sample block chain
 	var (
-		gendb   = rawdb.NewMemoryDatabase()
-		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
-		address = crypto.PubkeyToAddress(key.PublicKey)
-		funds   = big.NewInt(1000000000)
-		gspec   = &genesisT.Genesis{Config: params.TestChainConfig, Alloc: genesisT.GenesisAlloc{address: {Balance: funds}}}
-		genesis = MustCommitGenesis(gendb, gspec)
-		signer  = types.NewEIP155Signer(gspec.Config.GetChainID())
+		inserter func(blocks []*types.Block, receipts []types.Receipts) error
+		asserter func(t *testing.T, block *types.Block)
 	)
-	height := uint64(128)
-	blocks, receipts := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), gendb, int(height), func(i int, block *BlockGen) {
-		tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), common.Address{0x00}, big.NewInt(1000), vars.TxGas, nil, nil), signer, key)
-		if err != nil {
-			panic(err)
+	if typ == "headers" {
+		inserter = func(blocks []*types.Block, receipts []types.Receipts) error {
+			headers := make([]*types.Header, 0, len(blocks))
+			for _, block := range blocks {
+				headers = append(headers, block.Header())
+			}
+			_, err := chain.InsertHeaderChain(headers, 1)
+			return err
 		}
-		block.AddTx(tx)
-	})
-	blocks2, _ := GenerateChain(gspec.Config, blocks[len(blocks)-1], ethash.NewFaker(), gendb, 10, nil)
-
-	check := func(tail *uint64, chain *BlockChain) {
-		stored := rawdb.ReadTxIndexTail(chain.db)
-		if tail == nil && stored != nil {
-			t.Fatalf("Oldest indexded block mismatch, want nil, have %d", *stored)
+		asserter = func(t *testing.T, block *types.Block) {
+			if chain.CurrentHeader().Hash() != block.Hash() {
+				t.Fatalf("current head header mismatch, have %v, want %v", chain.CurrentHeader().Hash().Hex(), block.Hash().Hex())
+			}
 		}
-		if tail != nil && *stored != *tail {
-			t.Fatalf("Oldest indexded block mismatch, want %d, have %d", *tail, *stored)
+	} else if typ == "receipts" {
+		inserter = func(blocks []*types.Block, receipts []types.Receipts) error {
+			headers := make([]*types.Header, 0, len(blocks))
+			for _, block := range blocks {
+				headers = append(headers, block.Header())
+			}
+			_, err := chain.InsertHeaderChain(headers, 1)
+			if err != nil {
+				return err
+			}
+			_, err = chain.InsertReceiptChain(blocks, receipts, 0)
+			return err
 		}
-		if tail != nil {
-			for i := *tail; i <= chain.CurrentBlock().NumberU64(); i++ {
-				block := rawdb.ReadBlock(chain.db, rawdb.ReadCanonicalHash(chain.db, i), i)
-				if block.Transactions().Len() == 0 {
-					continue
-				}
-				for _, tx := range block.Transactions() {
-					if index := rawdb.ReadTxLookupEntry(chain.db, tx.Hash()); index == nil {
-						t.Fatalf("Miss transaction indice, number %d hash %s", i, tx.Hash().Hex())
-					}
-				}
+		asserter = func(t *testing.T, block *types.Block) {
+			if chain.CurrentFastBlock().Hash() != block.Hash() {
+				t.Fatalf("current head fast block mismatch, have %v, want %v", chain.CurrentFastBlock().Hash().Hex(), block.Hash().Hex())
 			}
-			for i := uint64(0); i < *tail; i++ {
-				block := rawdb.ReadBlock(chain.db, rawdb.ReadCanonicalHash(chain.db, i), i)
-				if block.Transactions().Len() == 0 {
-					continue
-				}
-				for _, tx := range block.Transactions() {
-					if index := rawdb.ReadTxLookupEntry(chain.db, tx.Hash()); index != nil {
-						t.Fatalf("Transaction indice should be deleted, number %d hash %s", i, tx.Hash().Hex())
-					}
-				}
+		}
+	} else {
+		inserter = func(blocks []*types.Block, receipts []types.Receipts) error {
+			_, err := chain.InsertChain(blocks)
+			return err
+		}
+		asserter = func(t *testing.T, block *types.Block) {
+			if chain.CurrentBlock().Hash() != block.Hash() {
+				t.Fatalf("current head block mismatch, have %v, want %v", chain.CurrentBlock().Hash().Hex(), block.Hash().Hex())
 			}
 		}
 	}
-	frdir, err := ioutil.TempDir("", "")
-	if err != nil {
-		t.Fatalf("failed to create temp freezer dir: %v", err)
+
+	if err := inserter(blocks, receipts); err != nil {
+		t.Fatalf("failed to insert chain data: %v", err)
 	}
-	defer os.Remove(frdir)
-	ancientDb, err := rawdb.NewDatabaseWithFreezer(rawdb.NewMemoryDatabase(), frdir, "")
-	if err != nil {
-		t.Fatalf("failed to create temp freezer db: %v", err)
+
+	// Reimport the chain data again. All the imported
+	// chain data are regarded "known" data.
+	if err := inserter(blocks, receipts); err != nil {
+		t.Fatalf("failed to insert chain data: %v", err)
 	}
-	MustCommitGenesis(ancientDb, gspec)
+	asserter(t, blocks[len(blocks)-1])
 
-	// Import all blocks into ancient db
-	l := uint64(0)
-	chain, err := NewBlockChain(ancientDb, nil, params.TestChainConfig, ethash.NewFaker(), vm.Config{}, nil, &l)
-	if err != nil {
-		t.Fatalf("failed to create tester chain: %v", err)
+	// Import a long canonical chain with some known data as prefix.
+	rollback := blocks[len(blocks)/2].NumberU64()
+
+	chain.SetHead(rollback - 1)
+	if err := inserter(append(blocks, blocks2...), append(receipts, receipts2...)); err != nil {
+		t.Fatalf("failed to insert chain data: %v", err)
+	}
+	asserter(t, blocks2[len(blocks2)-1])
+
+	// Import a heavier shorter but higher total difficulty chain with some known data as prefix.
+	if err := inserter(append(blocks, blocks3...), append(receipts, receipts3...)); err != nil {
+		t.Fatalf("failed to insert chain data: %v", err)
+	}
+	asserter(t, blocks3[len(blocks3)-1])
+
+	// Import a longer but lower total difficulty chain with some known data as prefix.
+	if err := inserter(append(blocks, blocks2...), append(receipts, receipts2...)); err != nil {
+		t.Fatalf("failed to insert chain data: %v", err)
+	}
+	// The head shouldn't change.
+	asserter(t, blocks3[len(blocks3)-1])
+
+	// Rollback the heavier chain and re-insert the longer chain again
+	chain.SetHead(rollback - 1)
+	if err := inserter(append(blocks, blocks2...), append(receipts, receipts2...)); err != nil {
+		t.Fatalf("failed to insert chain data: %v", err)
+	}
+	asserter(t, blocks2[len(blocks2)-1])
+}
+
+// getLongAndShortChains returns two chains,
+// A is longer, B is heavier
+func getLongAndShortChains() (*BlockChain, []*types.Block, []*types.Block, error) {
+	// Generate a canonical chain to act as the main dataset
+	engine := ethash.NewFaker()
+	db := rawdb.NewMemoryDatabase()
+	genesis := MustCommitGenesis(db, new(genesisT.Genesis))
+
+	// Generate and import the canonical chain,
+	// Offset the time, to keep the difficulty low
+	longChain, _ := GenerateChain(params.TestChainConfig, genesis, engine, db, 80, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{1})
+	})
+	diskdb := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(diskdb, new(genesisT.Genesis))
+
+	chain, err := NewBlockChain(diskdb, nil, params.TestChainConfig, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create tester chain: %v", err)
+	}
+
+	// Generate fork chain, make it shorter than canon, with common ancestor pretty early
+	parentIndex := 3
+	parent := longChain[parentIndex]
+	heavyChain, _ := GenerateChain(params.TestChainConfig, parent, engine, db, 75, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{2})
+		b.OffsetTime(-9)
+	})
+	// Verify that the test is sane
+	var (
+		longerTd  = new(big.Int)
+		shorterTd = new(big.Int)
+	)
+	for index, b := range longChain {
+		longerTd.Add(longerTd, b.Difficulty())
+		if index <= parentIndex {
+			shorterTd.Add(shorterTd, b.Difficulty())
+		}
+	}
+	for _, b := range heavyChain {
+		shorterTd.Add(shorterTd, b.Difficulty())
+	}
+	if shorterTd.Cmp(longerTd) <= 0 {
+		return nil, nil, nil, fmt.Errorf("Test is moot, heavyChain td (%v) must be larger than canon td (%v)", shorterTd, longerTd)
+	}
+	longerNum := longChain[len(longChain)-1].NumberU64()
+	shorterNum := heavyChain[len(heavyChain)-1].NumberU64()
+	if shorterNum >= longerNum {
+		return nil, nil, nil, fmt.Errorf("Test is moot, heavyChain num (%v) must be lower than canon num (%v)", shorterNum, longerNum)
+	}
+	return chain, longChain, heavyChain, nil
+}
+
+// TestReorgToShorterRemovesCanonMapping tests that if we
+// 1. Have a chain [0 ... N .. X]
+// 2. Reorg to shorter but heavier chain [0 ... N ... Y]
+// 3. Then there should be no canon mapping for the block at height X
+func TestReorgToShorterRemovesCanonMapping(t *testing.T) {
+	chain, canonblocks, sideblocks, err := getLongAndShortChains()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := chain.InsertChain(canonblocks); err != nil {
+		t.Fatalf("block %d: failed to insert into chain: %v", n, err)
+	}
+	canonNum := chain.CurrentBlock().NumberU64()
+	_, err = chain.InsertChain(sideblocks)
+	if err != nil {
+		t.Errorf("Got error, %v", err)
+	}
+	head := chain.CurrentBlock()
+	if got := sideblocks[len(sideblocks)-1].Hash(); got != head.Hash() {
+		t.Fatalf("head wrong, expected %x got %x", head.Hash(), got)
+	}
+	// We have now inserted a sidechain.
+	if blockByNum := chain.GetBlockByNumber(canonNum); blockByNum != nil {
+		t.Errorf("expected block to be gone: %v", blockByNum.NumberU64())
+	}
+	if headerByNum := chain.GetHeaderByNumber(canonNum); headerByNum != nil {
+		t.Errorf("expected header to be gone: %v", headerByNum.Number.Uint64())
+	}
+}
+
+// TestReorgToShorterRemovesCanonMappingHeaderChain is the same scenario
+// as TestReorgToShorterRemovesCanonMapping, but applied on headerchain
+// imports -- that is, for fast sync
+func TestReorgToShorterRemovesCanonMappingHeaderChain(t *testing.T) {
+	chain, canonblocks, sideblocks, err := getLongAndShortChains()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Convert into headers
+	canonHeaders := make([]*types.Header, len(canonblocks))
+	for i, block := range canonblocks {
+		canonHeaders[i] = block.Header()
+	}
+	if n, err := chain.InsertHeaderChain(canonHeaders, 0); err != nil {
+		t.Fatalf("header %d: failed to insert into chain: %v", n, err)
+	}
+	canonNum := chain.CurrentHeader().Number.Uint64()
+	sideHeaders := make([]*types.Header, len(sideblocks))
+	for i, block := range sideblocks {
+		sideHeaders[i] = block.Header()
+	}
+	if n, err := chain.InsertHeaderChain(sideHeaders, 0); err != nil {
+		t.Fatalf("header %d: failed to insert into chain: %v", n, err)
+	}
+	head := chain.CurrentHeader()
+	if got := sideblocks[len(sideblocks)-1].Hash(); got != head.Hash() {
+		t.Fatalf("head wrong, expected %x got %x", head.Hash(), got)
+	}
+	// We have now inserted a sidechain.
+	if blockByNum := chain.GetBlockByNumber(canonNum); blockByNum != nil {
+		t.Errorf("expected block to be gone: %v", blockByNum.NumberU64())
+	}
+	if headerByNum := chain.GetHeaderByNumber(canonNum); headerByNum != nil {
+		t.Errorf("expected header to be gone: %v", headerByNum.Number.Uint64())
+	}
+}
+
+func TestTransactionIndices(t *testing.T) {
+	// Configure and generate a sample block chain
+	var (
+		gendb   = rawdb.NewMemoryDatabase()
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		funds   = big.NewInt(1000000000)
+		gspec   = &genesisT.Genesis{Config: params.TestChainConfig, Alloc: genesisT.GenesisAlloc{address: {Balance: funds}}}
+		genesis = MustCommitGenesis(gendb, gspec)
+		signer  = types.NewEIP155Signer(gspec.Config.GetChainID())
+	)
+	height := uint64(128)
+	blocks, receipts := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), gendb, int(height), func(i int, block *BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), common.Address{0x00}, big.NewInt(1000), vars.TxGas, nil, nil), signer, key)
+		if err != nil {
+			panic(err)
+		}
+		block.AddTx(tx)
+	})
+	blocks2, _ := GenerateChain(gspec.Config, blocks[len(blocks)-1], ethash.NewFaker(), gendb, 10, nil)
+
+	check := func(tail *uint64, chain *BlockChain) {
+		stored := rawdb.ReadTxIndexTail(chain.db)
+		if tail == nil && stored != nil {
+			t.Fatalf("Oldest indexded block mismatch, want nil, have %d", *stored)
+		}
+		if tail != nil && *stored != *tail {
+			t.Fatalf("Oldest indexded block mismatch, want %d, have %d", *tail, *stored)
+		}
+		if tail != nil {
+			for i := *tail; i <= chain.CurrentBlock().NumberU64(); i++ {
+				block := rawdb.ReadBlock(chain.db, rawdb.ReadCanonicalHash(chain.db, i), i)
+				if block.Transactions().Len() == 0 {
+					continue
+				}
+				for _, tx := range block.Transactions() {
+					if index := rawdb.ReadTxLookupEntry(chain.db, tx.Hash()); index == nil {
+						t.Fatalf("Miss transaction indice, number %d hash %s", i, tx.Hash().Hex())
+					}
+				}
+			}
+			for i := uint64(0); i < *tail; i++ {
+				block := rawdb.ReadBlock(chain.db, rawdb.ReadCanonicalHash(chain.db, i), i)
+				if block.Transactions().Len() == 0 {
+					continue
+				}
+				for _, tx := range block.Transactions() {
+					if index := rawdb.ReadTxLookupEntry(chain.db, tx.Hash()); index != nil {
+						t.Fatalf("Transaction indice should be deleted, number %d hash %s", i, tx.Hash().Hex())
+					}
+				}
+			}
+		}
+	}
+	frdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp freezer dir: %v", err)
+	}
+	defer os.Remove(frdir)
+	ancientDb, err := rawdb.NewDatabaseWithFreezer(rawdb.NewMemoryDatabase(), frdir, "")
+	if err != nil {
+		t.Fatalf("failed to create temp freezer db: %v", err)
+	}
+	MustCommitGenesis(ancientDb, gspec)
+
+	// Import all blocks into ancient db
+	l := uint64(0)
+	chain, err := NewBlockChain(ancientDb, nil, params.TestChainConfig, ethash.NewFaker(), vm.Config{}, nil, &l)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
 	}
 	headers := make([]*types.Header, len(blocks))
 	for i, block := range blocks {
@@ -2202,6 +2757,59 @@ func TestTransactionIndices(t *testing.T) {
 	}
 }
 
+// Tests that changing the txlookup limit and waiting for the indexer leaves the
+// index in line with the new limit, without waiting for it any other way.
+func TestSetTxLookupLimitAndWait(t *testing.T) {
+	var (
+		db      = rawdb.NewMemoryDatabase()
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		gspec   = &genesisT.Genesis{Config: params.TestChainConfig, Alloc: genesisT.GenesisAlloc{address: {Balance: big.NewInt(1000000000)}}}
+		genesis = MustCommitGenesis(db, gspec)
+		signer  = types.NewEIP155Signer(gspec.Config.GetChainID())
+	)
+	blocks, _ := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), db, 128, func(i int, block *BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), common.Address{0x00}, big.NewInt(1000), vars.TxGas, nil, nil), signer, key)
+		if err != nil {
+			panic(err)
+		}
+		block.AddTx(tx)
+	})
+	limit := uint64(0)
+	chain, err := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, &limit)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	defer chain.Stop()
+	if n, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert block %d: %v", n, err)
+	}
+	for _, limit := range []uint64{32 /* drop stale */, 64 /* extend history */, 0 /* restore all */} {
+		if err := chain.SetTxLookupLimitAndWait(context.Background(), limit); err != nil {
+			t.Fatalf("limit %d: failed to wait for the indexer: %v", limit, err)
+		}
+		var want uint64
+		if limit != 0 {
+			want = 128 - limit + 1
+		}
+		if tail := rawdb.ReadTxIndexTail(db); tail == nil || *tail != want {
+			t.Fatalf("limit %d: index tail mismatch: have %v, want %d", limit, tail, want)
+		}
+		for _, block := range blocks {
+			indexed := rawdb.ReadTxLookupEntry(db, block.Transactions()[0].Hash()) != nil
+			if want := block.NumberU64() >= want; indexed != want {
+				t.Fatalf("limit %d: block #%d indexed %t, want %t", limit, block.NumberU64(), indexed, want)
+			}
+		}
+	}
+	// Waiting is cancelled with the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := chain.SetTxLookupLimitAndWait(ctx, 16); err != context.Canceled {
+		t.Fatalf("cancelled wait: want %v, got %v", context.Canceled, err)
+	}
+}
+
 func TestSkipStaleTxIndicesInFastSync(t *testing.T) {
 	// Configure and generate a sample block chain
 	var (
@@ -2518,51 +3126,446 @@ func TestDeleteCreateRevert(t *testing.T) {
 	}
 }
 
-// TestDeleteRecreateSlots tests a state-transition that contains both deletion
-// and recreation of contract state.
-// Contract A exists, has slots 1 and 2 set
-// Tx 1: Selfdestruct A
-// Tx 2: Re-create A, set slots 3 and 4
-// Expected outcome is that _all_ slots are cleared from A, due to the selfdestruct,
-// and then the new slots exist
-func TestDeleteRecreateSlots(t *testing.T) {
+// TestDeleteRecreateSlots tests a state-transition that contains both deletion
+// and recreation of contract state.
+// Contract A exists, has slots 1 and 2 set
+// Tx 1: Selfdestruct A
+// Tx 2: Re-create A, set slots 3 and 4
+// Expected outcome is that _all_ slots are cleared from A, due to the selfdestruct,
+// and then the new slots exist
+func TestDeleteRecreateSlots(t *testing.T) {
+	var (
+		// Generate a canonical chain to act as the main dataset
+		engine = ethash.NewFaker()
+		db     = rawdb.NewMemoryDatabase()
+		// A sender who makes transactions, has some funds
+		key, _    = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address   = crypto.PubkeyToAddress(key.PublicKey)
+		funds     = big.NewInt(1000000000)
+		bb        = common.HexToAddress("0x000000000000000000000000000000000000bbbb")
+		aaStorage = make(map[common.Hash]common.Hash)          // Initial storage in AA
+		aaCode    = []byte{byte(vm.PC), byte(vm.SELFDESTRUCT)} // Code for AA (simple selfdestruct)
+	)
+	// Populate two slots
+	aaStorage[common.HexToHash("01")] = common.HexToHash("01")
+	aaStorage[common.HexToHash("02")] = common.HexToHash("02")
+
+	// The bb-code needs to CREATE2 the aa contract. It consists of
+	// both initcode and deployment code
+	// initcode:
+	// 1. Set slots 3=3, 4=4,
+	// 2. Return aaCode
+
+	initCode := []byte{
+		byte(vm.PUSH1), 0x3, // value
+		byte(vm.PUSH1), 0x3, // location
+		byte(vm.SSTORE),     // Set slot[3] = 1
+		byte(vm.PUSH1), 0x4, // value
+		byte(vm.PUSH1), 0x4, // location
+		byte(vm.SSTORE), // Set slot[4] = 1
+		// Slots are set, now return the code
+		byte(vm.PUSH2), byte(vm.PC), byte(vm.SELFDESTRUCT), // Push code on stack
+		byte(vm.PUSH1), 0x0, // memory start on stack
+		byte(vm.MSTORE),
+		// Code is now in memory.
+		byte(vm.PUSH1), 0x2, // size
+		byte(vm.PUSH1), byte(32 - 2), // offset
+		byte(vm.RETURN),
+	}
+	if l := len(initCode); l > 32 {
+		t.Fatalf("init code is too long for a pushx, need a more elaborate deployer")
+	}
+	bbCode := []byte{
+		// Push initcode onto stack
+		byte(vm.PUSH1) + byte(len(initCode)-1)}
+	bbCode = append(bbCode, initCode...)
+	bbCode = append(bbCode, []byte{
+		byte(vm.PUSH1), 0x0, // memory start on stack
+		byte(vm.MSTORE),
+		byte(vm.PUSH1), 0x00, // salt
+		byte(vm.PUSH1), byte(len(initCode)), // size
+		byte(vm.PUSH1), byte(32 - len(initCode)), // offset
+		byte(vm.PUSH1), 0x00, // endowment
+		byte(vm.CREATE2),
+	}...)
+
+	initHash := crypto.Keccak256Hash(initCode)
+	aa := crypto.CreateAddress2(bb, [32]byte{}, initHash[:])
+	t.Logf("Destination address: %x\n", aa)
+
+	gspec := &genesisT.Genesis{
+		Config: params.TestChainConfig,
+		Alloc: genesisT.GenesisAlloc{
+			address: {Balance: funds},
+			// The address 0xAAAAA selfdestructs if called
+			aa: {
+				// Code needs to just selfdestruct
+				Code:    aaCode,
+				Nonce:   1,
+				Balance: big.NewInt(0),
+				Storage: aaStorage,
+			},
+			// The contract BB recreates AA
+			bb: {
+				Code:    bbCode,
+				Balance: big.NewInt(1),
+			},
+		},
+	}
+	genesis := MustCommitGenesis(db, gspec)
+
+	blocks, _ := GenerateChain(params.TestChainConfig, genesis, engine, db, 1, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{1})
+		// One transaction to AA, to kill it
+		tx, _ := types.SignTx(types.NewTransaction(0, aa,
+			big.NewInt(0), 50000, big.NewInt(1), nil), types.HomesteadSigner{}, key)
+		b.AddTx(tx)
+		// One transaction to BB, to recreate AA
+		tx, _ = types.SignTx(types.NewTransaction(1, bb,
+			big.NewInt(0), 100000, big.NewInt(1), nil), types.HomesteadSigner{}, key)
+		b.AddTx(tx)
+	})
+	// Import the canonical chain
+	diskdb := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(diskdb, gspec)
+	chain, err := NewBlockChain(diskdb, nil, params.TestChainConfig, engine, vm.Config{
+		Debug:  true,
+		Tracer: vm.NewJSONLogger(nil, os.Stdout),
+	}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	if n, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("block %d: failed to insert into chain: %v", n, err)
+	}
+	statedb, _ := chain.State()
+
+	// If all is correct, then slot 1 and 2 are zero
+	if got, exp := statedb.GetState(aa, common.HexToHash("01")), (common.Hash{}); got != exp {
+		t.Errorf("got %x exp %x", got, exp)
+	}
+	if got, exp := statedb.GetState(aa, common.HexToHash("02")), (common.Hash{}); got != exp {
+		t.Errorf("got %x exp %x", got, exp)
+	}
+	// Also, 3 and 4 should be set
+	if got, exp := statedb.GetState(aa, common.HexToHash("03")), common.HexToHash("03"); got != exp {
+		t.Fatalf("got %x exp %x", got, exp)
+	}
+	if got, exp := statedb.GetState(aa, common.HexToHash("04")), common.HexToHash("04"); got != exp {
+		t.Fatalf("got %x exp %x", got, exp)
+	}
+}
+
+// TestDeleteRecreateAccount tests a state-transition that contains deletion of a
+// contract with storage, and a recreate of the same contract via a
+// regular value-transfer
+// Expected outcome is that _all_ slots are cleared from A
+func TestDeleteRecreateAccount(t *testing.T) {
+	var (
+		// Generate a canonical chain to act as the main dataset
+		engine = ethash.NewFaker()
+		db     = rawdb.NewMemoryDatabase()
+		// A sender who makes transactions, has some funds
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		funds   = big.NewInt(1000000000)
+
+		aa        = common.HexToAddress("0x7217d81b76bdd8707601e959454e3d776aee5f43")
+		aaStorage = make(map[common.Hash]common.Hash)          // Initial storage in AA
+		aaCode    = []byte{byte(vm.PC), byte(vm.SELFDESTRUCT)} // Code for AA (simple selfdestruct)
+	)
+	// Populate two slots
+	aaStorage[common.HexToHash("01")] = common.HexToHash("01")
+	aaStorage[common.HexToHash("02")] = common.HexToHash("02")
+
+	gspec := &genesisT.Genesis{
+		Config: params.TestChainConfig,
+		Alloc: genesisT.GenesisAlloc{
+			address: {Balance: funds},
+			// The address 0xAAAAA selfdestructs if called
+			aa: {
+				// Code needs to just selfdestruct
+				Code:    aaCode,
+				Nonce:   1,
+				Balance: big.NewInt(0),
+				Storage: aaStorage,
+			},
+		},
+	}
+	genesis := MustCommitGenesis(db, gspec)
+
+	blocks, _ := GenerateChain(params.TestChainConfig, genesis, engine, db, 1, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{1})
+		// One transaction to AA, to kill it
+		tx, _ := types.SignTx(types.NewTransaction(0, aa,
+			big.NewInt(0), 50000, big.NewInt(1), nil), types.HomesteadSigner{}, key)
+		b.AddTx(tx)
+		// One transaction to AA, to recreate it (but without storage
+		tx, _ = types.SignTx(types.NewTransaction(1, aa,
+			big.NewInt(1), 100000, big.NewInt(1), nil), types.HomesteadSigner{}, key)
+		b.AddTx(tx)
+	})
+	// Import the canonical chain
+	diskdb := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(diskdb, gspec)
+	chain, err := NewBlockChain(diskdb, nil, params.TestChainConfig, engine, vm.Config{
+		Debug:  true,
+		Tracer: vm.NewJSONLogger(nil, os.Stdout),
+	}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	if n, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("block %d: failed to insert into chain: %v", n, err)
+	}
+	statedb, _ := chain.State()
+
+	// If all is correct, then both slots are zero
+	if got, exp := statedb.GetState(aa, common.HexToHash("01")), (common.Hash{}); got != exp {
+		t.Errorf("got %x exp %x", got, exp)
+	}
+	if got, exp := statedb.GetState(aa, common.HexToHash("02")), (common.Hash{}); got != exp {
+		t.Errorf("got %x exp %x", got, exp)
+	}
+}
+
+// TestDeleteRecreateSlotsAcrossManyBlocks tests multiple state-transition that contains both deletion
+// and recreation of contract state.
+// Contract A exists, has slots 1 and 2 set
+// Tx 1: Selfdestruct A
+// Tx 2: Re-create A, set slots 3 and 4
+// Expected outcome is that _all_ slots are cleared from A, due to the selfdestruct,
+// and then the new slots exist
+func TestDeleteRecreateSlotsAcrossManyBlocks(t *testing.T) {
+	var (
+		// Generate a canonical chain to act as the main dataset
+		engine = ethash.NewFaker()
+		db     = rawdb.NewMemoryDatabase()
+		// A sender who makes transactions, has some funds
+		key, _    = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address   = crypto.PubkeyToAddress(key.PublicKey)
+		funds     = big.NewInt(1000000000)
+		bb        = common.HexToAddress("0x000000000000000000000000000000000000bbbb")
+		aaStorage = make(map[common.Hash]common.Hash)          // Initial storage in AA
+		aaCode    = []byte{byte(vm.PC), byte(vm.SELFDESTRUCT)} // Code for AA (simple selfdestruct)
+	)
+	// Populate two slots
+	aaStorage[common.HexToHash("01")] = common.HexToHash("01")
+	aaStorage[common.HexToHash("02")] = common.HexToHash("02")
+
+	// The bb-code needs to CREATE2 the aa contract. It consists of
+	// both initcode and deployment code
+	// initcode:
+	// 1. Set slots 3=blocknum+1, 4=4,
+	// 2. Return aaCode
+
+	initCode := []byte{
+		byte(vm.PUSH1), 0x1, //
+		byte(vm.NUMBER),     // value = number + 1
+		byte(vm.ADD),        //
+		byte(vm.PUSH1), 0x3, // location
+		byte(vm.SSTORE),     // Set slot[3] = number + 1
+		byte(vm.PUSH1), 0x4, // value
+		byte(vm.PUSH1), 0x4, // location
+		byte(vm.SSTORE), // Set slot[4] = 4
+		// Slots are set, now return the code
+		byte(vm.PUSH2), byte(vm.PC), byte(vm.SELFDESTRUCT), // Push code on stack
+		byte(vm.PUSH1), 0x0, // memory start on stack
+		byte(vm.MSTORE),
+		// Code is now in memory.
+		byte(vm.PUSH1), 0x2, // size
+		byte(vm.PUSH1), byte(32 - 2), // offset
+		byte(vm.RETURN),
+	}
+	if l := len(initCode); l > 32 {
+		t.Fatalf("init code is too long for a pushx, need a more elaborate deployer")
+	}
+	bbCode := []byte{
+		// Push initcode onto stack
+		byte(vm.PUSH1) + byte(len(initCode)-1)}
+	bbCode = append(bbCode, initCode...)
+	bbCode = append(bbCode, []byte{
+		byte(vm.PUSH1), 0x0, // memory start on stack
+		byte(vm.MSTORE),
+		byte(vm.PUSH1), 0x00, // salt
+		byte(vm.PUSH1), byte(len(initCode)), // size
+		byte(vm.PUSH1), byte(32 - len(initCode)), // offset
+		byte(vm.PUSH1), 0x00, // endowment
+		byte(vm.CREATE2),
+	}...)
+
+	initHash := crypto.Keccak256Hash(initCode)
+	aa := crypto.CreateAddress2(bb, [32]byte{}, initHash[:])
+	t.Logf("Destination address: %x\n", aa)
+	gspec := &genesisT.Genesis{
+		Config: params.TestChainConfig,
+		Alloc: genesisT.GenesisAlloc{
+			address: {Balance: funds},
+			// The address 0xAAAAA selfdestructs if called
+			aa: {
+				// Code needs to just selfdestruct
+				Code:    aaCode,
+				Nonce:   1,
+				Balance: big.NewInt(0),
+				Storage: aaStorage,
+			},
+			// The contract BB recreates AA
+			bb: {
+				Code:    bbCode,
+				Balance: big.NewInt(1),
+			},
+		},
+	}
+	genesis := MustCommitGenesis(db, gspec)
+	var nonce uint64
+
+	type expectation struct {
+		exist    bool
+		blocknum int
+		values   map[int]int
+	}
+	var current = &expectation{
+		exist:    true, // exists in genesis
+		blocknum: 0,
+		values:   map[int]int{1: 1, 2: 2},
+	}
+	var expectations []*expectation
+	var newDestruct = func(e *expectation) *types.Transaction {
+		tx, _ := types.SignTx(types.NewTransaction(nonce, aa,
+			big.NewInt(0), 50000, big.NewInt(1), nil), types.HomesteadSigner{}, key)
+		nonce++
+		if e.exist {
+			e.exist = false
+			e.values = nil
+		}
+		t.Logf("block %d; adding destruct\n", e.blocknum)
+		return tx
+	}
+	var newResurrect = func(e *expectation) *types.Transaction {
+		tx, _ := types.SignTx(types.NewTransaction(nonce, bb,
+			big.NewInt(0), 100000, big.NewInt(1), nil), types.HomesteadSigner{}, key)
+		nonce++
+		if !e.exist {
+			e.exist = true
+			e.values = map[int]int{3: e.blocknum + 1, 4: 4}
+		}
+		t.Logf("block %d; adding resurrect\n", e.blocknum)
+		return tx
+	}
+
+	blocks, _ := GenerateChain(params.TestChainConfig, genesis, engine, db, 150, func(i int, b *BlockGen) {
+		var exp = new(expectation)
+		exp.blocknum = i + 1
+		exp.values = make(map[int]int)
+		for k, v := range current.values {
+			exp.values[k] = v
+		}
+		exp.exist = current.exist
+
+		b.SetCoinbase(common.Address{1})
+		if i%2 == 0 {
+			b.AddTx(newDestruct(exp))
+		}
+		if i%3 == 0 {
+			b.AddTx(newResurrect(exp))
+		}
+		if i%5 == 0 {
+			b.AddTx(newDestruct(exp))
+		}
+		if i%7 == 0 {
+			b.AddTx(newResurrect(exp))
+		}
+		expectations = append(expectations, exp)
+		current = exp
+	})
+	// Import the canonical chain
+	diskdb := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(diskdb, gspec)
+	chain, err := NewBlockChain(diskdb, nil, params.TestChainConfig, engine, vm.Config{
+		//Debug:  true,
+		//Tracer: vm.NewJSONLogger(nil, os.Stdout),
+	}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	var asHash = func(num int) common.Hash {
+		return common.BytesToHash([]byte{byte(num)})
+	}
+	for i, block := range blocks {
+		blockNum := i + 1
+		if n, err := chain.InsertChain([]*types.Block{block}); err != nil {
+			t.Fatalf("block %d: failed to insert into chain: %v", n, err)
+		}
+		statedb, _ := chain.State()
+		// If all is correct, then slot 1 and 2 are zero
+		if got, exp := statedb.GetState(aa, common.HexToHash("01")), (common.Hash{}); got != exp {
+			t.Errorf("block %d, got %x exp %x", blockNum, got, exp)
+		}
+		if got, exp := statedb.GetState(aa, common.HexToHash("02")), (common.Hash{}); got != exp {
+			t.Errorf("block %d, got %x exp %x", blockNum, got, exp)
+		}
+		exp := expectations[i]
+		if exp.exist {
+			if !statedb.Exist(aa) {
+				t.Fatalf("block %d, expected %v to exist, it did not", blockNum, aa)
+			}
+			for slot, val := range exp.values {
+				if gotValue, expValue := statedb.GetState(aa, asHash(slot)), asHash(val); gotValue != expValue {
+					t.Fatalf("block %d, slot %d, got %x exp %x", blockNum, slot, gotValue, expValue)
+				}
+			}
+		} else {
+			if statedb.Exist(aa) {
+				t.Fatalf("block %d, expected %v to not exist, it did", blockNum, aa)
+			}
+		}
+	}
+}
+
+// TestInitThenFailCreateContract tests a pretty notorious case that happened
+// on mainnet over blocks 7338108, 7338110 and 7338115.
+// - Block 7338108: address e771789f5cccac282f23bb7add5690e1f6ca467c is initiated
+//   with 0.001 ether (thus created but no code)
+// - Block 7338110: a CREATE2 is attempted. The CREATE2 would deploy code on
+//   the same address e771789f5cccac282f23bb7add5690e1f6ca467c. However, the
+//   deployment fails due to OOG during initcode execution
+// - Block 7338115: another tx checks the balance of
+//   e771789f5cccac282f23bb7add5690e1f6ca467c, and the snapshotter returned it as
+//   zero.
+//
+// The problem being that the snapshotter maintains a destructset, and adds items
+// to the destructset in case something is created "onto" an existing item.
+// We need to either roll back the snapDestructs, or not place it into snapDestructs
+// in the first place.
+//
+func TestInitThenFailCreateContract(t *testing.T) {
 	var (
 		// Generate a canonical chain to act as the main dataset
 		engine = ethash.NewFaker()
 		db     = rawdb.NewMemoryDatabase()
 		// A sender who makes transactions, has some funds
-		key, _    = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
-		address   = crypto.PubkeyToAddress(key.PublicKey)
-		funds     = big.NewInt(1000000000)
-		bb        = common.HexToAddress("0x000000000000000000000000000000000000bbbb")
-		aaStorage = make(map[common.Hash]common.Hash)          // Initial storage in AA
-		aaCode    = []byte{byte(vm.PC), byte(vm.SELFDESTRUCT)} // Code for AA (simple selfdestruct)
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		funds   = big.NewInt(1000000000)
+		bb      = common.HexToAddress("0x000000000000000000000000000000000000bbbb")
 	)
-	// Populate two slots
-	aaStorage[common.HexToHash("01")] = common.HexToHash("01")
-	aaStorage[common.HexToHash("02")] = common.HexToHash("02")
 
 	// The bb-code needs to CREATE2 the aa contract. It consists of
 	// both initcode and deployment code
 	// initcode:
-	// 1. Set slots 3=3, 4=4,
-	// 2. Return aaCode
-
+	// 1. If blocknum < 1, error out (e.g invalid opcode)
+	// 2. else, return a snippet of code
 	initCode := []byte{
-		byte(vm.PUSH1), 0x3, // value
-		byte(vm.PUSH1), 0x3, // location
-		byte(vm.SSTORE),     // Set slot[3] = 1
-		byte(vm.PUSH1), 0x4, // value
-		byte(vm.PUSH1), 0x4, // location
-		byte(vm.SSTORE), // Set slot[4] = 1
-		// Slots are set, now return the code
-		byte(vm.PUSH2), byte(vm.PC), byte(vm.SELFDESTRUCT), // Push code on stack
-		byte(vm.PUSH1), 0x0, // memory start on stack
-		byte(vm.MSTORE),
-		// Code is now in memory.
+		byte(vm.PUSH1), 0x1, // y (2)
+		byte(vm.NUMBER), // x (number)
+		byte(vm.GT),     // x > y?
+		byte(vm.PUSH1), byte(0x8),
+		byte(vm.JUMPI), // jump to label if number > 2
+		byte(0xFE),     // illegal opcode
+		byte(vm.JUMPDEST),
 		byte(vm.PUSH1), 0x2, // size
-		byte(vm.PUSH1), byte(32 - 2), // offset
-		byte(vm.RETURN),
+		byte(vm.PUSH1), 0x0, // offset
+		byte(vm.RETURN), // return 2 bytes of zero-code
 	}
 	if l := len(initCode); l > 32 {
 		t.Fatalf("init code is too long for a pushx, need a more elaborate deployer")
@@ -2589,15 +3592,9 @@ func TestDeleteRecreateSlots(t *testing.T) {
 		Config: params.TestChainConfig,
 		Alloc: genesisT.GenesisAlloc{
 			address: {Balance: funds},
-			// The address 0xAAAAA selfdestructs if called
-			aa: {
-				// Code needs to just selfdestruct
-				Code:    aaCode,
-				Nonce:   1,
-				Balance: big.NewInt(0),
-				Storage: aaStorage,
-			},
-			// The contract BB recreates AA
+			// The address aa has some funds
+			aa: {Balance: big.NewInt(100000)},
+			// The contract BB tries to create code onto AA
 			bb: {
 				Code:    bbCode,
 				Balance: big.NewInt(1),
@@ -2605,434 +3602,814 @@ func TestDeleteRecreateSlots(t *testing.T) {
 		},
 	}
 	genesis := MustCommitGenesis(db, gspec)
-
-	blocks, _ := GenerateChain(params.TestChainConfig, genesis, engine, db, 1, func(i int, b *BlockGen) {
+	nonce := uint64(0)
+	blocks, _ := GenerateChain(params.TestChainConfig, genesis, engine, db, 4, func(i int, b *BlockGen) {
 		b.SetCoinbase(common.Address{1})
-		// One transaction to AA, to kill it
-		tx, _ := types.SignTx(types.NewTransaction(0, aa,
-			big.NewInt(0), 50000, big.NewInt(1), nil), types.HomesteadSigner{}, key)
-		b.AddTx(tx)
-		// One transaction to BB, to recreate AA
-		tx, _ = types.SignTx(types.NewTransaction(1, bb,
+		// One transaction to BB
+		tx, _ := types.SignTx(types.NewTransaction(nonce, bb,
 			big.NewInt(0), 100000, big.NewInt(1), nil), types.HomesteadSigner{}, key)
 		b.AddTx(tx)
+		nonce++
+	})
+
+	// Import the canonical chain
+	diskdb := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(diskdb, gspec)
+	chain, err := NewBlockChain(diskdb, nil, params.TestChainConfig, engine, vm.Config{
+		//Debug:  true,
+		//Tracer: vm.NewJSONLogger(nil, os.Stdout),
+	}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	statedb, _ := chain.State()
+	if got, exp := statedb.GetBalance(aa), big.NewInt(100000); got.Cmp(exp) != 0 {
+		t.Fatalf("Genesis err, got %v exp %v", got, exp)
+	}
+	// First block tries to create, but fails
+	{
+		block := blocks[0]
+		if _, err := chain.InsertChain([]*types.Block{blocks[0]}); err != nil {
+			t.Fatalf("block %d: failed to insert into chain: %v", block.NumberU64(), err)
+		}
+		statedb, _ = chain.State()
+		if got, exp := statedb.GetBalance(aa), big.NewInt(100000); got.Cmp(exp) != 0 {
+			t.Fatalf("block %d: got %v exp %v", block.NumberU64(), got, exp)
+		}
+	}
+	// Import the rest of the blocks
+	for _, block := range blocks[1:] {
+		if _, err := chain.InsertChain([]*types.Block{block}); err != nil {
+			t.Fatalf("block %d: failed to insert into chain: %v", block.NumberU64(), err)
+		}
+	}
+}
+
+// Tests that moving blocks from the key-value store into the ancient store
+// is announced to freeze event subscribers with the frozen range.
+func TestFreezeEvent(t *testing.T) {
+	var (
+		gspec   = &genesisT.Genesis{Config: params.TestChainConfig}
+		genesis = MustCommitGenesis(rawdb.NewMemoryDatabase(), gspec)
+	)
+	blocks, _ := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), rawdb.NewMemoryDatabase(), 64, nil)
+
+	frdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp freezer dir: %v", err)
+	}
+	defer os.RemoveAll(frdir)
+	db, err := rawdb.NewDatabaseWithFreezer(rawdb.NewMemoryDatabase(), frdir, "")
+	if err != nil {
+		t.Fatalf("failed to create temp freezer db: %v", err)
+	}
+	defer db.Close()
+	MustCommitGenesis(db, gspec)
+
+	chain, err := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	defer chain.Stop()
+
+	events := make(chan rawdb.FreezeEvent, 1)
+	sub := chain.SubscribeFreezeEvent(events)
+	defer sub.Unsubscribe()
+
+	if n, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("block %d: failed to insert into chain: %v", n, err)
+	}
+	// Freeze everything but the 16 most recent blocks.
+	db.(interface{ Freeze(threshold uint64) }).Freeze(16)
+
+	select {
+	case ev := <-events:
+		if ev.First != 0 || ev.Last != 64-16 {
+			t.Fatalf("frozen range mismatch: have [%d, %d], want [0, %d]", ev.First, ev.Last, 64-16)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no freeze event")
+	}
+	if frozen, err := db.Ancients(); err != nil || frozen != 64-16+1 {
+		t.Fatalf("ancients mismatch: have %d, want %d (err=%v)", frozen, 64-16+1, err)
+	}
+}
+
+// Tests that cached blocks are served correctly once frozen, while cached side chain
+// blocks the freezer wiped are not served anymore.
+func TestBlockCacheAcrossFreeze(t *testing.T) {
+	var (
+		gspec   = &genesisT.Genesis{Config: params.TestChainConfig}
+		genDb   = rawdb.NewMemoryDatabase()
+		genesis = MustCommitGenesis(genDb, gspec)
+	)
+	blocks, _ := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), genDb, 64, nil)
+	forks, _ := GenerateChain(gspec.Config, blocks[9], ethash.NewFaker(), genDb, 3, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{1})
+	})
+	frdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp freezer dir: %v", err)
+	}
+	defer os.RemoveAll(frdir)
+	db, err := rawdb.NewDatabaseWithFreezer(rawdb.NewMemoryDatabase(), frdir, "")
+	if err != nil {
+		t.Fatalf("failed to create temp freezer db: %v", err)
+	}
+	defer db.Close()
+	MustCommitGenesis(db, gspec)
+
+	chain, err := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if n, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("block %d: failed to insert into chain: %v", n, err)
+	}
+	if n, err := chain.InsertChain(forks); err != nil {
+		t.Fatalf("fork %d: failed to insert into chain: %v", n, err)
+	}
+	// Cache a canonical and a side chain block, both of frozen heights.
+	canonical, side := blocks[10], forks[0]
+	for _, block := range []*types.Block{canonical, side} {
+		if cached := chain.GetBlockByHash(block.Hash()); cached == nil || cached.Hash() != block.Hash() {
+			t.Fatalf("block #%d [%x] not cached", block.NumberU64(), block.Hash())
+		}
+	}
+	events := make(chan rawdb.FreezeEvent, 1)
+	sub := chain.SubscribeFreezeEvent(events)
+	defer sub.Unsubscribe()
+
+	db.(interface{ Freeze(threshold uint64) }).Freeze(16)
+	select {
+	case <-events:
+	case <-time.After(time.Second):
+		t.Fatal("no freeze event")
+	}
+	// The side chain block is evicted in the background.
+	for deadline := time.Now().Add(time.Second); chain.GetBlockByHash(side.Hash()) != nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("wiped side chain block #%d [%x] still served", side.NumberU64(), side.Hash())
+		}
+	}
+	if chain.HasBlock(side.Hash(), side.NumberU64()) {
+		t.Errorf("wiped side chain block #%d [%x] reported present", side.NumberU64(), side.Hash())
+	}
+	if frozen, err := db.Ancients(); err != nil || frozen <= canonical.NumberU64() {
+		t.Fatalf("block #%d not frozen: ancients %d (err %v)", canonical.NumberU64(), frozen, err)
+	}
+	if cached := chain.GetBlockByHash(canonical.Hash()); cached == nil || cached.Hash() != canonical.Hash() {
+		t.Fatalf("frozen block #%d: have %v, want [%x]", canonical.NumberU64(), cached, canonical.Hash())
+	}
+	if read := chain.GetBlockByNumber(canonical.NumberU64()); read == nil || read.Hash() != canonical.Hash() {
+		t.Fatalf("frozen block #%d by number: have %v, want [%x]", canonical.NumberU64(), read, canonical.Hash())
+	}
+}
+
+func TestInsertReceiptChainVerifyBlooms(t *testing.T) {
+	var (
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		gendb   = rawdb.NewMemoryDatabase()
+		gspec   = &genesisT.Genesis{
+			Config: params.TestChainConfig,
+			Alloc:  genesisT.GenesisAlloc{address: {Balance: big.NewInt(1000000000)}},
+		}
+		genesis = MustCommitGenesis(gendb, gspec)
+		signer  = types.NewEIP155Signer(gspec.Config.GetChainID())
+	)
+	blocks, receipts := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), gendb, 8, func(i int, block *BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), common.Address{0x00}, big.NewInt(1000), vars.TxGas, nil, nil), signer, key)
+		if err != nil {
+			panic(err)
+		}
+		block.AddTx(tx)
+	})
+	// Corrupt the bloom of a receipt in the middle of the chain.
+	receipts[4][0].Bloom[0] ^= 0xff
+
+	db := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(db, gspec)
+	chain, _ := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, nil)
+	defer chain.Stop()
+
+	headers := make([]*types.Header, len(blocks))
+	for i, block := range blocks {
+		headers[i] = block.Header()
+	}
+	if n, err := chain.InsertHeaderChain(headers, 1); err != nil {
+		t.Fatalf("failed to insert header %d: %v", n, err)
+	}
+	chain.SetVerifyReceiptBlooms(true)
+	if _, err := chain.InsertReceiptChain(blocks, receipts, 0); err == nil {
+		t.Fatal("corrupted receipt bloom accepted with verification enabled")
+	}
+	if head := chain.CurrentFastBlock().NumberU64(); head != 0 {
+		t.Fatalf("fast block advanced on rejected chain: have #%d, want #0", head)
+	}
+	chain.SetVerifyReceiptBlooms(false)
+	if n, err := chain.InsertReceiptChain(blocks, receipts, 0); err != nil {
+		t.Fatalf("failed to insert receipt %d with verification disabled: %v", n, err)
+	}
+	if head := chain.CurrentFastBlock().NumberU64(); head != blocks[len(blocks)-1].NumberU64() {
+		t.Fatalf("fast block mismatch: have #%d, want #%d", head, blocks[len(blocks)-1].NumberU64())
+	}
+}
+
+func TestRepairTxIndexTail(t *testing.T) {
+	var (
+		gendb   = rawdb.NewMemoryDatabase()
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		funds   = big.NewInt(1000000000)
+		gspec   = &genesisT.Genesis{Config: params.TestChainConfig, Alloc: genesisT.GenesisAlloc{address: {Balance: funds}}}
+		genesis = MustCommitGenesis(gendb, gspec)
+		signer  = types.NewEIP155Signer(gspec.Config.GetChainID())
+	)
+	blocks, _ := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), gendb, 128, func(i int, block *BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), common.Address{0x00}, big.NewInt(1000), vars.TxGas, nil, nil), signer, key)
+		if err != nil {
+			panic(err)
+		}
+		block.AddTx(tx)
+	})
+	db := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(db, gspec)
+	limit := uint64(64)
+	chain, err := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, &limit)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	defer chain.Stop()
+	if n, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("block %d: failed to insert into chain: %v", n, err)
+	}
+	// Wait for the indexer to prune the stale indices.
+	want := uint64(128 - 64 + 1)
+	for i := 0; ; i++ {
+		if tail := rawdb.ReadTxIndexTail(db); tail != nil && *tail == want {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("tx index tail not written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if tail := chain.RepairTxIndexTail(); tail != want {
+		t.Fatalf("consistent tail changed: have %d, want %d", tail, want)
+	}
+	for _, corrupt := range []uint64{10, 100} {
+		rawdb.WriteTxIndexTail(db, corrupt)
+		if tail := chain.RepairTxIndexTail(); tail != want {
+			t.Errorf("repaired tail from %d: have %d, want %d", corrupt, tail, want)
+		}
+		if stored := rawdb.ReadTxIndexTail(db); stored == nil || *stored != want {
+			t.Errorf("stored tail after repair from %d: have %v, want %d", corrupt, stored, want)
+		}
+	}
+}
+
+// Tests that the streamed tx index covers the retained range and round-trips
+// through the lookup entries of the database.
+func TestStreamTxIndex(t *testing.T) {
+	var (
+		gendb   = rawdb.NewMemoryDatabase()
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		funds   = big.NewInt(1000000000)
+		gspec   = &genesisT.Genesis{Config: params.TestChainConfig, Alloc: genesisT.GenesisAlloc{address: {Balance: funds}}}
+		genesis = MustCommitGenesis(gendb, gspec)
+		signer  = types.NewEIP155Signer(gspec.Config.GetChainID())
+	)
+	blocks, _ := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), gendb, 16, func(i int, block *BlockGen) {
+		for j := 0; j < 2; j++ {
+			tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), common.Address{0x00}, big.NewInt(1000), vars.TxGas, nil, nil), signer, key)
+			if err != nil {
+				panic(err)
+			}
+			block.AddTx(tx)
+		}
 	})
-	// Import the canonical chain
-	diskdb := rawdb.NewMemoryDatabase()
-	MustCommitGenesis(diskdb, gspec)
-	chain, err := NewBlockChain(diskdb, nil, params.TestChainConfig, engine, vm.Config{
-		Debug:  true,
-		Tracer: vm.NewJSONLogger(nil, os.Stdout),
-	}, nil, nil)
+	db := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(db, gspec)
+	limit := uint64(8)
+	chain, err := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, &limit)
 	if err != nil {
 		t.Fatalf("failed to create tester chain: %v", err)
 	}
+	defer chain.Stop()
 	if n, err := chain.InsertChain(blocks); err != nil {
 		t.Fatalf("block %d: failed to insert into chain: %v", n, err)
 	}
-	statedb, _ := chain.State()
-
-	// If all is correct, then slot 1 and 2 are zero
-	if got, exp := statedb.GetState(aa, common.HexToHash("01")), (common.Hash{}); got != exp {
-		t.Errorf("got %x exp %x", got, exp)
+	// Wait for the indexer to prune the stale indices.
+	tail := uint64(16 - 8 + 1)
+	for i := 0; ; i++ {
+		if stored := rawdb.ReadTxIndexTail(db); stored != nil && *stored == tail {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("tx index tail not written")
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
-	if got, exp := statedb.GetState(aa, common.HexToHash("02")), (common.Hash{}); got != exp {
-		t.Errorf("got %x exp %x", got, exp)
+	var buf bytes.Buffer
+	if err := chain.StreamTxIndex(&buf, 0, 100); err != nil {
+		t.Fatalf("failed to stream tx index: %v", err)
 	}
-	// Also, 3 and 4 should be set
-	if got, exp := statedb.GetState(aa, common.HexToHash("03")), common.HexToHash("03"); got != exp {
-		t.Fatalf("got %x exp %x", got, exp)
+	stream := rlp.NewStream(&buf, 0)
+	var entries int
+	for ; ; entries++ {
+		var entry TxIndexEntry
+		if err := stream.Decode(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("entry %d: failed to decode: %v", entries, err)
+		}
+		if entry.BlockNumber < tail {
+			t.Errorf("entry %d: block #%d below the tail %d", entries, entry.BlockNumber, tail)
+		}
+		if number := rawdb.ReadTxLookupEntry(db, entry.Hash); number == nil || *number != entry.BlockNumber {
+			t.Errorf("entry %d: lookup mismatch: have %v, want %d", entries, number, entry.BlockNumber)
+		}
+		txs := chain.GetBlockByNumber(entry.BlockNumber).Transactions()
+		if entry.Index >= uint64(len(txs)) || txs[entry.Index].Hash() != entry.Hash {
+			t.Errorf("entry %d: tx %x not at #%d index %d", entries, entry.Hash, entry.BlockNumber, entry.Index)
+		}
 	}
-	if got, exp := statedb.GetState(aa, common.HexToHash("04")), common.HexToHash("04"); got != exp {
-		t.Fatalf("got %x exp %x", got, exp)
+	if want := 2 * int(16-tail+1); entries != want {
+		t.Errorf("entry count mismatch: have %d, want %d", entries, want)
 	}
 }
 
-// TestDeleteRecreateAccount tests a state-transition that contains deletion of a
-// contract with storage, and a recreate of the same contract via a
-// regular value-transfer
-// Expected outcome is that _all_ slots are cleared from A
-func TestDeleteRecreateAccount(t *testing.T) {
+func TestPruneStateBelow(t *testing.T) {
 	var (
-		// Generate a canonical chain to act as the main dataset
-		engine = ethash.NewFaker()
-		db     = rawdb.NewMemoryDatabase()
-		// A sender who makes transactions, has some funds
+		gendb   = rawdb.NewMemoryDatabase()
 		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
 		address = crypto.PubkeyToAddress(key.PublicKey)
 		funds   = big.NewInt(1000000000)
+		// The contract stores the block number in its first slot when called: NUMBER PUSH1 0 SSTORE
+		contract = common.Address{0xc0}
+		gspec    = &genesisT.Genesis{Config: params.TestChainConfig, Alloc: genesisT.GenesisAlloc{
+			address:  {Balance: funds},
+			contract: {Balance: common.Big0, Code: common.FromHex("0x43600055")},
+		}}
+		genesis = MustCommitGenesis(gendb, gspec)
+		signer  = types.NewEIP155Signer(gspec.Config.GetChainID())
+	)
+	blocks, receipts := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), gendb, 64, func(i int, block *BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), contract, big.NewInt(1000), 100000, nil, nil), signer, key)
+		if err != nil {
+			panic(err)
+		}
+		block.AddTx(tx)
+	})
+	db := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(db, gspec)
+	chain, err := NewBlockChain(db, &CacheConfig{TrieDirtyDisabled: true}, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	defer chain.Stop()
+	if n, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("block %d: failed to insert into chain: %v", n, err)
+	}
+	// Nodes of older versions stored the contract code under its raw hash.
+	codeHash := crypto.Keccak256Hash(gspec.Alloc[contract].Code)
+	if err := db.Put(codeHash[:], gspec.Alloc[contract].Code); err != nil {
+		t.Fatal(err)
+	}
+	rawdb.DeleteCode(db, codeHash)
 
-		aa        = common.HexToAddress("0x7217d81b76bdd8707601e959454e3d776aee5f43")
-		aaStorage = make(map[common.Hash]common.Hash)          // Initial storage in AA
-		aaCode    = []byte{byte(vm.PC), byte(vm.SELFDESTRUCT)} // Code for AA (simple selfdestruct)
+	// State needed by the head can't be pruned.
+	if err := chain.PruneStateBelow(uint64(len(blocks)) + 1); err == nil {
+		t.Fatal("pruned state above head")
+	}
+	below := uint64(48)
+	if err := chain.PruneStateBelow(below); err != nil {
+		t.Fatalf("failed to prune state: %v", err)
+	}
+	for i, block := range blocks {
+		number := block.NumberU64()
+		if got := chain.GetBlockByNumber(number); got == nil || got.Hash() != block.Hash() {
+			t.Fatalf("block #%d missing after pruning", number)
+		}
+		if got := chain.GetReceiptsByHash(block.Hash()); len(got) != len(receipts[i]) {
+			t.Fatalf("block #%d: have %d receipts, want %d", number, len(got), len(receipts[i]))
+		}
+		statedb, err := chain.StateAt(block.Root())
+		if number < below {
+			if err == nil {
+				t.Fatalf("block #%d: state readable after pruning", number)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("block #%d: retained state missing: %v", number, err)
+		}
+		if have, want := statedb.GetState(contract, common.Hash{}), common.BigToHash(block.Number()); have != want {
+			t.Fatalf("block #%d: contract storage mismatch: have %x, want %x", number, have, want)
+		}
+	}
+	// The code stored under the legacy scheme is live.
+	if code := rawdb.ReadCode(db, codeHash); !bytes.Equal(code, gspec.Alloc[contract].Code) {
+		t.Fatalf("contract code pruned: have %x, want %x", code, gspec.Alloc[contract].Code)
+	}
+	// The retained states must be complete.
+	for number := below; number <= uint64(len(blocks)); number++ {
+		if err := markStateTrie(chain.stateCache.TrieDB(), blocks[number-1].Root(), make(map[common.Hash]struct{}), true); err != nil {
+			t.Fatalf("block #%d: retained state incomplete: %v", number, err)
+		}
+	}
+}
+
+// Tests that the head snapshot is consistent while the chain keeps reorganizing.
+func TestHeadSnapshotConsistency(t *testing.T) {
+	var (
+		db      = rawdb.NewMemoryDatabase()
+		gspec   = &genesisT.Genesis{Config: params.TestChainConfig}
+		genesis = MustCommitGenesis(db, gspec)
+		engine  = ethash.NewFaker()
 	)
-	// Populate two slots
-	aaStorage[common.HexToHash("01")] = common.HexToHash("01")
-	aaStorage[common.HexToHash("02")] = common.HexToHash("02")
+	chain, err := NewBlockChain(db, nil, gspec.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	defer chain.Stop()
 
-	gspec := &genesisT.Genesis{
-		Config: params.TestChainConfig,
-		Alloc: genesisT.GenesisAlloc{
-			address: {Balance: funds},
-			// The address 0xAAAAA selfdestructs if called
-			aa: {
-				// Code needs to just selfdestruct
-				Code:    aaCode,
-				Nonce:   1,
-				Balance: big.NewInt(0),
-				Storage: aaStorage,
-			},
-		},
+	// Two forks, inserted alternately, each taking over the head from the other.
+	forkA, _ := GenerateChain(gspec.Config, genesis, engine, db, 64, nil)
+	forkB, _ := GenerateChain(gspec.Config, genesis, engine, db, 64, func(i int, gen *BlockGen) {
+		gen.OffsetTime(-1)
+	})
+	done := make(chan error)
+	go func() {
+		for i := range forkA {
+			if _, err := chain.InsertChain(forkA[i : i+1]); err != nil {
+				done <- err
+				return
+			}
+			if _, err := chain.InsertChain(forkB[i : i+1]); err != nil {
+				done <- err
+				return
+			}
+			chain.EnableArtificialFinality(i%2 == 0)
+		}
+		done <- nil
+	}()
+	for snapshots := 0; ; snapshots++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("failed to insert chain: %v", err)
+			}
+			if snapshots == 0 {
+				t.Fatal("no snapshots taken")
+			}
+			return
+		default:
+		}
+		snap := chain.HeadSnapshot()
+		if snap.HeaderHash != snap.Hash || snap.HeaderNumber != snap.Number {
+			t.Fatalf("head header #%d [%x] inconsistent with head block #%d [%x]", snap.HeaderNumber, snap.HeaderHash, snap.Number, snap.Hash)
+		}
+		if snap.FastBlockHash != snap.Hash || snap.FastBlockNumber != snap.Number {
+			t.Fatalf("head fast block #%d [%x] inconsistent with head block #%d [%x]", snap.FastBlockNumber, snap.FastBlockHash, snap.Number, snap.Hash)
+		}
+		if td := chain.GetTd(snap.Hash, snap.Number); td == nil || snap.Td.Cmp(td) != 0 {
+			t.Fatalf("head TD %v inconsistent with head block #%d [%x] TD %v", snap.Td, snap.Number, snap.Hash, td)
+		}
+		if snap.ArtificialFinalityActive && !snap.ArtificialFinalityEnabled {
+			t.Fatal("artificial finality active while disabled")
+		}
 	}
-	genesis := MustCommitGenesis(db, gspec)
+}
 
-	blocks, _ := GenerateChain(params.TestChainConfig, genesis, engine, db, 1, func(i int, b *BlockGen) {
+// Tests that the total difficulty computed for a header on top of a parent matches
+// the one of stored blocks, canonical or not.
+func TestComputeTd(t *testing.T) {
+	var (
+		engine  = ethash.NewFaker()
+		gspec   = &genesisT.Genesis{Config: params.TestChainConfig}
+		db      = rawdb.NewMemoryDatabase()
+		genesis = MustCommitGenesis(db, gspec)
+	)
+	blocks, _ := GenerateChain(gspec.Config, genesis, engine, db, 10, nil)
+	forks, _ := GenerateChain(gspec.Config, blocks[4], engine, db, 3, func(_ int, b *BlockGen) {
 		b.SetCoinbase(common.Address{1})
-		// One transaction to AA, to kill it
-		tx, _ := types.SignTx(types.NewTransaction(0, aa,
-			big.NewInt(0), 50000, big.NewInt(1), nil), types.HomesteadSigner{}, key)
-		b.AddTx(tx)
-		// One transaction to AA, to recreate it (but without storage
-		tx, _ = types.SignTx(types.NewTransaction(1, aa,
-			big.NewInt(1), 100000, big.NewInt(1), nil), types.HomesteadSigner{}, key)
-		b.AddTx(tx)
 	})
-	// Import the canonical chain
-	diskdb := rawdb.NewMemoryDatabase()
-	MustCommitGenesis(diskdb, gspec)
-	chain, err := NewBlockChain(diskdb, nil, params.TestChainConfig, engine, vm.Config{
-		Debug:  true,
-		Tracer: vm.NewJSONLogger(nil, os.Stdout),
-	}, nil, nil)
+	chain, err := NewBlockChain(db, nil, gspec.Config, engine, vm.Config{}, nil, nil)
 	if err != nil {
 		t.Fatalf("failed to create tester chain: %v", err)
 	}
-	if n, err := chain.InsertChain(blocks); err != nil {
-		t.Fatalf("block %d: failed to insert into chain: %v", n, err)
-	}
-	statedb, _ := chain.State()
+	defer chain.Stop()
 
-	// If all is correct, then both slots are zero
-	if got, exp := statedb.GetState(aa, common.HexToHash("01")), (common.Hash{}); got != exp {
-		t.Errorf("got %x exp %x", got, exp)
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
 	}
-	if got, exp := statedb.GetState(aa, common.HexToHash("02")), (common.Hash{}); got != exp {
-		t.Errorf("got %x exp %x", got, exp)
+	if _, err := chain.InsertChain(forks); err != nil {
+		t.Fatalf("failed to insert fork: %v", err)
+	}
+	for _, block := range append(blocks, forks...) {
+		td, err := chain.ComputeTd(block.ParentHash(), block.NumberU64()-1, block.Difficulty())
+		if err != nil {
+			t.Fatalf("block #%d [%x]: %v", block.NumberU64(), block.Hash(), err)
+		}
+		if want := chain.GetTd(block.Hash(), block.NumberU64()); td.Cmp(want) != 0 {
+			t.Errorf("block #%d [%x]: TD mismatch: have %v, want %v", block.NumberU64(), block.Hash(), td, want)
+		}
+	}
+	// The parent's cached TD is left untouched
+	parent := blocks[len(blocks)-1]
+	want := new(big.Int).Set(chain.GetTd(parent.Hash(), parent.NumberU64()))
+	if _, err := chain.ComputeTd(parent.Hash(), parent.NumberU64(), big.NewInt(1)); err != nil {
+		t.Fatal(err)
+	}
+	if have := chain.GetTd(parent.Hash(), parent.NumberU64()); have.Cmp(want) != 0 {
+		t.Errorf("parent TD modified: have %v, want %v", have, want)
+	}
+	// Unknown parents are rejected
+	if _, err := chain.ComputeTd(common.Hash{0xff}, 5, big.NewInt(1)); !errors.Is(err, consensus.ErrUnknownAncestor) {
+		t.Errorf("unknown parent: want %v, got %v", consensus.ErrUnknownAncestor, err)
 	}
 }
 
-// TestDeleteRecreateSlotsAcrossManyBlocks tests multiple state-transition that contains both deletion
-// and recreation of contract state.
-// Contract A exists, has slots 1 and 2 set
-// Tx 1: Selfdestruct A
-// Tx 2: Re-create A, set slots 3 and 4
-// Expected outcome is that _all_ slots are cleared from A, due to the selfdestruct,
-// and then the new slots exist
-func TestDeleteRecreateSlotsAcrossManyBlocks(t *testing.T) {
+// Tests that receipt roots are verified against trusted roots, flagging only the
+// blocks whose receipts do not match.
+func TestVerifyReceiptRange(t *testing.T) {
 	var (
-		// Generate a canonical chain to act as the main dataset
-		engine = ethash.NewFaker()
-		db     = rawdb.NewMemoryDatabase()
-		// A sender who makes transactions, has some funds
-		key, _    = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
-		address   = crypto.PubkeyToAddress(key.PublicKey)
-		funds     = big.NewInt(1000000000)
-		bb        = common.HexToAddress("0x000000000000000000000000000000000000bbbb")
-		aaStorage = make(map[common.Hash]common.Hash)          // Initial storage in AA
-		aaCode    = []byte{byte(vm.PC), byte(vm.SELFDESTRUCT)} // Code for AA (simple selfdestruct)
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		engine  = ethash.NewFaker()
+		gspec   = &genesisT.Genesis{
+			Config: params.TestChainConfig,
+			Alloc:  genesisT.GenesisAlloc{address: {Balance: big.NewInt(1000000000000000)}},
+		}
+		db      = rawdb.NewMemoryDatabase()
+		genesis = MustCommitGenesis(db, gspec)
 	)
-	// Populate two slots
-	aaStorage[common.HexToHash("01")] = common.HexToHash("01")
-	aaStorage[common.HexToHash("02")] = common.HexToHash("02")
+	blocks, _ := GenerateChain(gspec.Config, genesis, engine, db, 5, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(address), common.Address{0xaa}, big.NewInt(1), vars.TxGas, big.NewInt(1), nil), types.HomesteadSigner{}, key)
+		b.AddTx(tx)
+	})
+	chain, err := NewBlockChain(db, nil, gspec.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	defer chain.Stop()
 
-	// The bb-code needs to CREATE2 the aa contract. It consists of
-	// both initcode and deployment code
-	// initcode:
-	// 1. Set slots 3=blocknum+1, 4=4,
-	// 2. Return aaCode
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	trusted := make(map[uint64]common.Hash)
+	for _, block := range blocks[1:] {
+		trusted[block.NumberU64()] = block.ReceiptHash()
+	}
+	trusted[3] = common.Hash{0x03}
 
-	initCode := []byte{
-		byte(vm.PUSH1), 0x1, //
-		byte(vm.NUMBER),     // value = number + 1
-		byte(vm.ADD),        //
-		byte(vm.PUSH1), 0x3, // location
-		byte(vm.SSTORE),     // Set slot[3] = number + 1
-		byte(vm.PUSH1), 0x4, // value
-		byte(vm.PUSH1), 0x4, // location
-		byte(vm.SSTORE), // Set slot[4] = 4
-		// Slots are set, now return the code
-		byte(vm.PUSH2), byte(vm.PC), byte(vm.SELFDESTRUCT), // Push code on stack
-		byte(vm.PUSH1), 0x0, // memory start on stack
-		byte(vm.MSTORE),
-		// Code is now in memory.
-		byte(vm.PUSH1), 0x2, // size
-		byte(vm.PUSH1), byte(32 - 2), // offset
-		byte(vm.RETURN),
+	mismatches, err := chain.VerifyReceiptRange(1, 5, trusted)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if l := len(initCode); l > 32 {
-		t.Fatalf("init code is too long for a pushx, need a more elaborate deployer")
+	if len(mismatches) != 1 {
+		t.Fatalf("have %d mismatches, want 1: %+v", len(mismatches), mismatches)
 	}
-	bbCode := []byte{
-		// Push initcode onto stack
-		byte(vm.PUSH1) + byte(len(initCode)-1)}
-	bbCode = append(bbCode, initCode...)
-	bbCode = append(bbCode, []byte{
-		byte(vm.PUSH1), 0x0, // memory start on stack
-		byte(vm.MSTORE),
-		byte(vm.PUSH1), 0x00, // salt
-		byte(vm.PUSH1), byte(len(initCode)), // size
-		byte(vm.PUSH1), byte(32 - len(initCode)), // offset
-		byte(vm.PUSH1), 0x00, // endowment
-		byte(vm.CREATE2),
-	}...)
+	if m := mismatches[0]; m.Number != 3 || m.Hash != blocks[2].Hash() || m.Trusted != (common.Hash{0x03}) || m.Computed != blocks[2].ReceiptHash() {
+		t.Errorf("unexpected mismatch: %+v", m)
+	}
+	if _, err := chain.VerifyReceiptRange(5, 6, map[uint64]common.Hash{6: {}}); err == nil {
+		t.Error("verified receipts of an unknown block")
+	}
+}
 
-	initHash := crypto.Keccak256Hash(initCode)
-	aa := crypto.CreateAddress2(bb, [32]byte{}, initHash[:])
-	t.Logf("Destination address: %x\n", aa)
-	gspec := &genesisT.Genesis{
-		Config: params.TestChainConfig,
-		Alloc: genesisT.GenesisAlloc{
-			address: {Balance: funds},
-			// The address 0xAAAAA selfdestructs if called
-			aa: {
-				// Code needs to just selfdestruct
-				Code:    aaCode,
-				Nonce:   1,
-				Balance: big.NewInt(0),
-				Storage: aaStorage,
-			},
-			// The contract BB recreates AA
-			bb: {
-				Code:    bbCode,
-				Balance: big.NewInt(1),
-			},
-		},
+// Tests that the chain configuration can be updated at runtime with forks ahead of
+// the head, but not with ones changing blocks already processed.
+func TestUpdateChainConfig(t *testing.T) {
+	// copyConfig returns a copy of the test configuration in the core-geth schema.
+	copyConfig := func() *coregeth.CoreGethChainConfig {
+		config := new(coregeth.CoreGethChainConfig)
+		if err := confp.Convert(params.TestChainConfig, config); err != nil {
+			t.Fatal(err)
+		}
+		return config
 	}
-	genesis := MustCommitGenesis(db, gspec)
-	var nonce uint64
+	var (
+		engine  = ethash.NewFaker()
+		gspec   = &genesisT.Genesis{Config: copyConfig()}
+		db      = rawdb.NewMemoryDatabase()
+		genesis = MustCommitGenesis(db, gspec)
+	)
+	blocks, _ := GenerateChain(gspec.Config, genesis, engine, db, 10, nil)
+	chain, err := NewBlockChain(db, nil, gspec.Config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	defer chain.Stop()
 
-	type expectation struct {
-		exist    bool
-		blocknum int
-		values   map[int]int
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
 	}
-	var current = &expectation{
-		exist:    true, // exists in genesis
-		blocknum: 0,
-		values:   map[int]int{1: 1, 2: 2},
+	filter := forkid.NewFilter(chain)
+
+	events := make(chan ChainConfigEvent, 1)
+	sub := chain.SubscribeChainConfigEvent(events)
+	defer sub.Unsubscribe()
+
+	pool := NewTxPool(testTxPoolConfig, chain.Config(), chain)
+	defer pool.Stop()
+
+	// A fork ahead of the head is applied and persisted.
+	future := uint64(100)
+	config := copyConfig()
+	if err := config.SetEIP2537Transition(&future); err != nil {
+		t.Fatal(err)
 	}
-	var expectations []*expectation
-	var newDestruct = func(e *expectation) *types.Transaction {
-		tx, _ := types.SignTx(types.NewTransaction(nonce, aa,
-			big.NewInt(0), 50000, big.NewInt(1), nil), types.HomesteadSigner{}, key)
-		nonce++
-		if e.exist {
-			e.exist = false
-			e.values = nil
-		}
-		t.Logf("block %d; adding destruct\n", e.blocknum)
-		return tx
+	// A peer past the fork is only known once it's scheduled
+	remote := forkid.NewID(config, genesis.Hash(), 2*future)
+	if err := filter(remote); !errors.Is(err, forkid.ErrLocalIncompatibleOrStale) {
+		t.Fatalf("peer past the unscheduled fork: want %v, got %v", forkid.ErrLocalIncompatibleOrStale, err)
 	}
-	var newResurrect = func(e *expectation) *types.Transaction {
-		tx, _ := types.SignTx(types.NewTransaction(nonce, bb,
-			big.NewInt(0), 100000, big.NewInt(1), nil), types.HomesteadSigner{}, key)
-		nonce++
-		if !e.exist {
-			e.exist = true
-			e.values = map[int]int{3: e.blocknum + 1, 4: 4}
+	if err := chain.UpdateChainConfig(config); err != nil {
+		t.Fatalf("forward compatible update rejected: %v", err)
+	}
+	if n := chain.Config().GetEIP2537Transition(); n == nil || *n != future {
+		t.Fatalf("active EIP2537 transition: have %v, want %d", n, future)
+	}
+	if n := chain.hc.Config().GetEIP2537Transition(); n == nil || *n != future {
+		t.Fatalf("header chain EIP2537 transition: have %v, want %d", n, future)
+	}
+	if err := filter(remote); err != nil {
+		t.Fatalf("peer past the scheduled fork rejected: %v", err)
+	}
+	// The configuration is swapped, not modified in place
+	if chain.Config() == gspec.Config || chain.Config() == config {
+		t.Fatalf("chain configuration not replaced")
+	}
+	if n := gspec.Config.GetEIP2537Transition(); n != nil {
+		t.Fatalf("previous configuration modified: EIP2537 transition %d", *n)
+	}
+	if n := rawdb.ReadChainConfig(db, genesis.Hash()).GetEIP2537Transition(); n == nil || *n != future {
+		t.Fatalf("stored EIP2537 transition: have %v, want %d", n, future)
+	}
+	// Subscribers, such as the transaction pool, are handed the new configuration
+	select {
+	case ev := <-events:
+		if ev.Config != chain.Config() {
+			t.Fatalf("announced configuration mismatch")
 		}
-		t.Logf("block %d; adding resurrect\n", e.blocknum)
-		return tx
+	case <-time.After(time.Second):
+		t.Fatalf("configuration change not announced")
 	}
-
-	blocks, _ := GenerateChain(params.TestChainConfig, genesis, engine, db, 150, func(i int, b *BlockGen) {
-		var exp = new(expectation)
-		exp.blocknum = i + 1
-		exp.values = make(map[int]int)
-		for k, v := range current.values {
-			exp.values[k] = v
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		pool.mu.RLock()
+		updated := pool.chainconfig == chain.Config()
+		pool.mu.RUnlock()
+		if updated {
+			break
 		}
-		exp.exist = current.exist
-
-		b.SetCoinbase(common.Address{1})
-		if i%2 == 0 {
-			b.AddTx(newDestruct(exp))
+		if time.Since(start) > time.Second {
+			t.Fatalf("transaction pool configuration not updated")
 		}
-		if i%3 == 0 {
-			b.AddTx(newResurrect(exp))
+	}
+	// Parameters the engine and signers are set up with at startup are rejected.
+	for name, modify := range map[string]func(*coregeth.CoreGethChainConfig) error{
+		"chain id": func(config *coregeth.CoreGethChainConfig) error {
+			return config.SetChainID(big.NewInt(1337))
+		},
+		"ECIP1099": func(config *coregeth.CoreGethChainConfig) error {
+			return config.SetEthashECIP1099Transition(&future)
+		},
+	} {
+		config := copyConfig()
+		if err := config.SetEIP2537Transition(&future); err != nil {
+			t.Fatal(err)
 		}
-		if i%5 == 0 {
-			b.AddTx(newDestruct(exp))
+		if err := modify(config); err != nil {
+			t.Fatal(err)
 		}
-		if i%7 == 0 {
-			b.AddTx(newResurrect(exp))
+		if err := chain.UpdateChainConfig(config); !errors.Is(err, ErrChainConfigRestart) {
+			t.Fatalf("%s update: want %v, got %v", name, ErrChainConfigRestart, err)
 		}
-		expectations = append(expectations, exp)
-		current = exp
-	})
-	// Import the canonical chain
-	diskdb := rawdb.NewMemoryDatabase()
-	MustCommitGenesis(diskdb, gspec)
-	chain, err := NewBlockChain(diskdb, nil, params.TestChainConfig, engine, vm.Config{
-		//Debug:  true,
-		//Tracer: vm.NewJSONLogger(nil, os.Stdout),
-	}, nil, nil)
-	if err != nil {
-		t.Fatalf("failed to create tester chain: %v", err)
 	}
-	var asHash = func(num int) common.Hash {
-		return common.BytesToHash([]byte{byte(num)})
+	// A fork the chain already passed is rejected, leaving the configuration alone.
+	past := uint64(5)
+	config = copyConfig()
+	if err := config.SetEIP2537Transition(&past); err != nil {
+		t.Fatal(err)
 	}
-	for i, block := range blocks {
-		blockNum := i + 1
-		if n, err := chain.InsertChain([]*types.Block{block}); err != nil {
-			t.Fatalf("block %d: failed to insert into chain: %v", n, err)
-		}
-		statedb, _ := chain.State()
-		// If all is correct, then slot 1 and 2 are zero
-		if got, exp := statedb.GetState(aa, common.HexToHash("01")), (common.Hash{}); got != exp {
-			t.Errorf("block %d, got %x exp %x", blockNum, got, exp)
+	var compatErr *confp.ConfigCompatError
+	if err := chain.UpdateChainConfig(config); !errors.As(err, &compatErr) {
+		t.Fatalf("retroactive update: want %T, got %v", compatErr, err)
+	}
+	if n := chain.Config().GetEIP2537Transition(); n == nil || *n != future {
+		t.Fatalf("active EIP2537 transition after rejection: have %v, want %d", n, future)
+	}
+}
+
+// Tests that inserting header chains in small chunks, releasing the chain lock between
+// them, results in the same canonical chain as inserting them at once, reorgs included.
+func TestInsertHeaderChainChunked(t *testing.T) {
+	gendb, genesisChain, err := newCanonical(ethash.NewFaker(), 0, false)
+	if err != nil {
+		t.Fatalf("failed to create pristine chain: %v", err)
+	}
+	genesisChain.Stop()
+
+	// A long easy chain, and a shorter heavier one reorging it
+	easy, _ := GenerateChain(params.TestChainConfig, genesisChain.CurrentBlock(), ethash.NewFaker(), gendb, 1024, nil)
+	heavy, _ := GenerateChain(params.TestChainConfig, genesisChain.CurrentBlock(), ethash.NewFaker(), gendb, 1000, func(i int, b *BlockGen) {
+		b.OffsetTime(-9)
+	})
+	headers := func(blocks []*types.Block) []*types.Header {
+		headers := make([]*types.Header, len(blocks))
+		for i, block := range blocks {
+			headers[i] = block.Header()
 		}
-		if got, exp := statedb.GetState(aa, common.HexToHash("02")), (common.Hash{}); got != exp {
-			t.Errorf("block %d, got %x exp %x", blockNum, got, exp)
+		return headers
+	}
+	insert := func(chunk int) *BlockChain {
+		_, chain, err := newCanonical(ethash.NewFaker(), 0, false)
+		if err != nil {
+			t.Fatalf("failed to create pristine chain: %v", err)
 		}
-		exp := expectations[i]
-		if exp.exist {
-			if !statedb.Exist(aa) {
-				t.Fatalf("block %d, expected %v to exist, it did not", blockNum, aa)
-			}
-			for slot, val := range exp.values {
-				if gotValue, expValue := statedb.GetState(aa, asHash(slot)), asHash(val); gotValue != expValue {
-					t.Fatalf("block %d, slot %d, got %x exp %x", blockNum, slot, gotValue, expValue)
-				}
-			}
-		} else {
-			if statedb.Exist(aa) {
-				t.Fatalf("block %d, expected %v to not exist, it did", blockNum, aa)
+		chain.SetHeaderInsertChunk(chunk)
+		for _, headers := range [][]*types.Header{headers(easy), headers(heavy)} {
+			if n, err := chain.InsertHeaderChain(headers, 1); err != nil {
+				t.Fatalf("chunk %d: failed to insert header %d: %v", chunk, n, err)
 			}
 		}
+		return chain
+	}
+	single := insert(0)
+	defer single.Stop()
+	chunked := insert(7)
+	defer chunked.Stop()
+
+	if have, want := chunked.CurrentHeader().Hash(), single.CurrentHeader().Hash(); have != want || want != heavy[len(heavy)-1].Hash() {
+		t.Fatalf("head header mismatch: have %x, want %x (heavy head %x)", have, want, heavy[len(heavy)-1].Hash())
+	}
+	for number := uint64(0); number <= uint64(len(easy)); number++ {
+		if have, want := chunked.GetCanonicalHash(number), single.GetCanonicalHash(number); have != want {
+			t.Fatalf("canonical hash #%d mismatch: have %x, want %x", number, have, want)
+		}
 	}
 }
 
-// TestInitThenFailCreateContract tests a pretty notorious case that happened
-// on mainnet over blocks 7338108, 7338110 and 7338115.
-// - Block 7338108: address e771789f5cccac282f23bb7add5690e1f6ca467c is initiated
-//   with 0.001 ether (thus created but no code)
-// - Block 7338110: a CREATE2 is attempted. The CREATE2 would deploy code on
-//   the same address e771789f5cccac282f23bb7add5690e1f6ca467c. However, the
-//   deployment fails due to OOG during initcode execution
-// - Block 7338115: another tx checks the balance of
-//   e771789f5cccac282f23bb7add5690e1f6ca467c, and the snapshotter returned it as
-//   zero.
-//
-// The problem being that the snapshotter maintains a destructset, and adds items
-// to the destructset in case something is created "onto" an existing item.
-// We need to either roll back the snapDestructs, or not place it into snapDestructs
-// in the first place.
-//
-func TestInitThenFailCreateContract(t *testing.T) {
+// Tests that blocks whose uncles were pruned from the ancient store are not served,
+// while their transactions and the blocks frozen before pruning are.
+func TestPrunedUnclesNotServed(t *testing.T) {
 	var (
-		// Generate a canonical chain to act as the main dataset
-		engine = ethash.NewFaker()
-		db     = rawdb.NewMemoryDatabase()
-		// A sender who makes transactions, has some funds
-		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
-		address = crypto.PubkeyToAddress(key.PublicKey)
-		funds   = big.NewInt(1000000000)
-		bb      = common.HexToAddress("0x000000000000000000000000000000000000bbbb")
+		gendb   = rawdb.NewMemoryDatabase()
+		gspec   = &genesisT.Genesis{Config: params.TestChainConfig}
+		genesis = MustCommitGenesis(gendb, gspec)
 	)
-
-	// The bb-code needs to CREATE2 the aa contract. It consists of
-	// both initcode and deployment code
-	// initcode:
-	// 1. If blocknum < 1, error out (e.g invalid opcode)
-	// 2. else, return a snippet of code
-	initCode := []byte{
-		byte(vm.PUSH1), 0x1, // y (2)
-		byte(vm.NUMBER), // x (number)
-		byte(vm.GT),     // x > y?
-		byte(vm.PUSH1), byte(0x8),
-		byte(vm.JUMPI), // jump to label if number > 2
-		byte(0xFE),     // illegal opcode
-		byte(vm.JUMPDEST),
-		byte(vm.PUSH1), 0x2, // size
-		byte(vm.PUSH1), 0x0, // offset
-		byte(vm.RETURN), // return 2 bytes of zero-code
+	blocks, receipts := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), gendb, 8, func(i int, block *BlockGen) {
+		if i > 0 {
+			block.AddUncle(&types.Header{ParentHash: block.PrevBlock(i - 1).Hash(), Number: big.NewInt(int64(i)), Extra: []byte("uncle")})
+		}
+	})
+	frdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp freezer dir: %v", err)
 	}
-	if l := len(initCode); l > 32 {
-		t.Fatalf("init code is too long for a pushx, need a more elaborate deployer")
+	defer os.RemoveAll(frdir)
+	db, err := rawdb.NewDatabaseWithFreezer(rawdb.NewMemoryDatabase(), frdir, "")
+	if err != nil {
+		t.Fatalf("failed to create temp freezer db: %v", err)
 	}
-	bbCode := []byte{
-		// Push initcode onto stack
-		byte(vm.PUSH1) + byte(len(initCode)-1)}
-	bbCode = append(bbCode, initCode...)
-	bbCode = append(bbCode, []byte{
-		byte(vm.PUSH1), 0x0, // memory start on stack
-		byte(vm.MSTORE),
-		byte(vm.PUSH1), 0x00, // salt
-		byte(vm.PUSH1), byte(len(initCode)), // size
-		byte(vm.PUSH1), byte(32 - len(initCode)), // offset
-		byte(vm.PUSH1), 0x00, // endowment
-		byte(vm.CREATE2),
-	}...)
+	defer db.Close()
+	MustCommitGenesis(db, gspec)
 
-	initHash := crypto.Keccak256Hash(initCode)
-	aa := crypto.CreateAddress2(bb, [32]byte{}, initHash[:])
-	t.Logf("Destination address: %x\n", aa)
+	// Freeze up to #4 with the uncles, the rest without
+	rawdb.WriteAncientUnclesPruned(db, 5)
+	chain, _ := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, nil)
+	defer chain.Stop()
 
-	gspec := &genesisT.Genesis{
-		Config: params.TestChainConfig,
-		Alloc: genesisT.GenesisAlloc{
-			address: {Balance: funds},
-			// The address aa has some funds
-			aa: {Balance: big.NewInt(100000)},
-			// The contract BB tries to create code onto AA
-			bb: {
-				Code:    bbCode,
-				Balance: big.NewInt(1),
-			},
-		},
+	headers := make([]*types.Header, len(blocks))
+	for i, block := range blocks {
+		headers[i] = block.Header()
 	}
-	genesis := MustCommitGenesis(db, gspec)
-	nonce := uint64(0)
-	blocks, _ := GenerateChain(params.TestChainConfig, genesis, engine, db, 4, func(i int, b *BlockGen) {
-		b.SetCoinbase(common.Address{1})
-		// One transaction to BB
-		tx, _ := types.SignTx(types.NewTransaction(nonce, bb,
-			big.NewInt(0), 100000, big.NewInt(1), nil), types.HomesteadSigner{}, key)
-		b.AddTx(tx)
-		nonce++
-	})
-
-	// Import the canonical chain
-	diskdb := rawdb.NewMemoryDatabase()
-	MustCommitGenesis(diskdb, gspec)
-	chain, err := NewBlockChain(diskdb, nil, params.TestChainConfig, engine, vm.Config{
-		//Debug:  true,
-		//Tracer: vm.NewJSONLogger(nil, os.Stdout),
-	}, nil, nil)
-	if err != nil {
-		t.Fatalf("failed to create tester chain: %v", err)
+	if n, err := chain.InsertHeaderChain(headers, 1); err != nil {
+		t.Fatalf("failed to insert header %d: %v", n, err)
 	}
-	statedb, _ := chain.State()
-	if got, exp := statedb.GetBalance(aa), big.NewInt(100000); got.Cmp(exp) != 0 {
-		t.Fatalf("Genesis err, got %v exp %v", got, exp)
+	if n, err := chain.InsertReceiptChain(blocks, receipts, uint64(len(blocks))); err != nil {
+		t.Fatalf("failed to insert receipt %d: %v", n, err)
 	}
-	// First block tries to create, but fails
-	{
-		block := blocks[0]
-		if _, err := chain.InsertChain([]*types.Block{blocks[0]}); err != nil {
-			t.Fatalf("block %d: failed to insert into chain: %v", block.NumberU64(), err)
+	for _, block := range blocks[1:] {
+		hash, number := block.Hash(), block.NumberU64()
+		pruned := number >= 5
+		if have := chain.GetBlock(hash, number) == nil; have != pruned {
+			t.Errorf("block #%d: missing %v, want %v", number, have, pruned)
 		}
-		statedb, _ = chain.State()
-		if got, exp := statedb.GetBalance(aa), big.NewInt(100000); got.Cmp(exp) != 0 {
-			t.Fatalf("block %d: got %v exp %v", block.NumberU64(), got, exp)
+		if have := chain.GetBodyRLP(hash) == nil; have != pruned {
+			t.Errorf("block #%d: body RLP missing %v, want %v", number, have, pruned)
 		}
-	}
-	// Import the rest of the blocks
-	for _, block := range blocks[1:] {
-		if _, err := chain.InsertChain([]*types.Block{block}); err != nil {
-			t.Fatalf("block %d: failed to insert into chain: %v", block.NumberU64(), err)
+		if have := rawdb.UnclesPruned(db, hash, number); have != pruned {
+			t.Errorf("block #%d: uncles pruned %v, want %v", number, have, pruned)
+		}
+		if r := chain.GetReceiptsByHash(hash); len(r) != len(block.Transactions()) {
+			t.Errorf("block #%d: have %d receipts, want %d", number, len(r), len(block.Transactions()))
 		}
 	}
 }
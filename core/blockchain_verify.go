@@ -0,0 +1,137 @@
+package core
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// ChainInconsistencyKind identifies a class of problems detected by
+// NewBlockChainReadOnlyVerify.
+type ChainInconsistencyKind string
+
+const (
+	InconsistencyHeadBlockMissing     ChainInconsistencyKind = "head-block-missing"      // Head block hash or block unavailable, NewBlockChain resets the chain
+	InconsistencyHeadHeaderMissing    ChainInconsistencyKind = "head-header-missing"     // Head header hash stored but header unavailable
+	InconsistencyHeadFastBlockMissing ChainInconsistencyKind = "head-fast-block-missing" // Head fast block hash stored but block unavailable
+	InconsistencyNotCanonical         ChainInconsistencyKind = "not-canonical"           // A head is not the canonical block of its number
+	InconsistencyHeadStateMissing     ChainInconsistencyKind = "head-state-missing"      // State of the head block unavailable, NewBlockChain rewinds
+	InconsistencyHeadBelowAncients    ChainInconsistencyKind = "head-below-ancients"     // Head block below the frozen ones, NewBlockChain truncates the ancients
+	InconsistencyFastBelowAncients    ChainInconsistencyKind = "fast-below-ancients"     // Head fast block below the frozen ones, NewBlockChain truncates the ancients
+	InconsistencyBadHash              ChainInconsistencyKind = "bad-hash"                // A known bad block is canonical, NewBlockChain rewinds
+	InconsistencyTxIndexTail          ChainInconsistencyKind = "tx-index-tail"           // Stored tx index tail disagrees with the indexed blocks
+)
+
+// ChainInconsistency is a single problem detected by NewBlockChainReadOnlyVerify.
+type ChainInconsistency struct {
+	Kind   ChainInconsistencyKind
+	Number uint64 // Number of the block concerned
+	Detail string
+}
+
+func (c ChainInconsistency) String() string {
+	return fmt.Sprintf("%s #%d: %s", c.Kind, c.Number, c.Detail)
+}
+
+// ChainVerifyReport is the result of NewBlockChainReadOnlyVerify.
+type ChainVerifyReport struct {
+	HeadBlock     uint64 // Number of the head block, 0 if unavailable
+	HeadFastBlock uint64 // Number of the head fast block, 0 if unavailable
+	HeadHeader    uint64 // Number of the head header, 0 if unavailable
+	Ancients      uint64 // Number of frozen items
+
+	Inconsistencies []ChainInconsistency
+}
+
+// Consistent returns whether no problems were detected.
+func (r *ChainVerifyReport) Consistent() bool {
+	return len(r.Inconsistencies) == 0
+}
+
+func (r *ChainVerifyReport) add(kind ChainInconsistencyKind, number uint64, format string, args ...interface{}) {
+	r.Inconsistencies = append(r.Inconsistencies, ChainInconsistency{Kind: kind, Number: number, Detail: fmt.Sprintf(format, args...)})
+}
+
+// NewBlockChainReadOnlyVerify opens the chain stored in db without modifying it,
+// and checks the consistency of the chain heads, the ancient store and the tx
+// index tail. Instead of repairing the problems as NewBlockChain does, all of
+// them are enumerated in the returned report. An error is returned only if the
+// chain could not be opened at all.
+func NewBlockChainReadOnlyVerify(db ethdb.Database) (*ChainVerifyReport, error) {
+	genesis := rawdb.ReadCanonicalHash(db, 0)
+	if genesis == (common.Hash{}) {
+		return nil, ErrNoGenesis
+	}
+	report := new(ChainVerifyReport)
+	report.Ancients, _ = db.Ancients()
+
+	// canonical checks that hash is the canonical block of number.
+	canonical := func(head string, hash common.Hash, number uint64) {
+		if have := rawdb.ReadCanonicalHash(db, number); have != hash {
+			report.add(InconsistencyNotCanonical, number, "%s %x, canonical %x", head, hash, have)
+		}
+	}
+	// Check the head block and its state
+	hash := rawdb.ReadHeadBlockHash(db)
+	if hash == (common.Hash{}) {
+		report.add(InconsistencyHeadBlockMissing, 0, "head block hash unavailable")
+		return report, nil
+	}
+	number := rawdb.ReadHeaderNumber(db, hash)
+	if number == nil {
+		report.add(InconsistencyHeadBlockMissing, 0, "head block %x unavailable", hash)
+		return report, nil
+	}
+	head := rawdb.ReadBlock(db, hash, *number)
+	if head == nil {
+		report.add(InconsistencyHeadBlockMissing, *number, "head block %x unavailable", hash)
+		return report, nil
+	}
+	report.HeadBlock, report.HeadFastBlock, report.HeadHeader = head.NumberU64(), head.NumberU64(), head.NumberU64()
+	canonical("head block", hash, head.NumberU64())
+	if _, err := state.New(head.Root(), state.NewDatabase(db), nil); err != nil {
+		report.add(InconsistencyHeadStateMissing, head.NumberU64(), "state %x unavailable", head.Root())
+	}
+	// Check the head header and fast block, which default to the head block
+	if hash := rawdb.ReadHeadHeaderHash(db); hash != (common.Hash{}) {
+		if number := rawdb.ReadHeaderNumber(db, hash); number == nil || rawdb.ReadHeader(db, hash, *number) == nil {
+			report.add(InconsistencyHeadHeaderMissing, 0, "head header %x unavailable", hash)
+		} else {
+			report.HeadHeader = *number
+			canonical("head header", hash, *number)
+		}
+	}
+	if hash := rawdb.ReadHeadFastBlockHash(db); hash != (common.Hash{}) {
+		if number := rawdb.ReadHeaderNumber(db, hash); number == nil || rawdb.ReadBlock(db, hash, *number) == nil {
+			report.add(InconsistencyHeadFastBlockMissing, 0, "head fast block %x unavailable", hash)
+		} else {
+			report.HeadFastBlock = *number
+			canonical("head fast block", hash, *number)
+		}
+	}
+	// Check the heads against the ancients
+	if frozen := report.Ancients; frozen > 0 {
+		if head.Hash() != genesis && report.HeadBlock < frozen-1 {
+			report.add(InconsistencyHeadBelowAncients, report.HeadBlock, "head block below %d ancients", frozen)
+		}
+		if report.HeadFastBlock < frozen-1 {
+			report.add(InconsistencyFastBelowAncients, report.HeadFastBlock, "head fast block below %d ancients", frozen)
+		}
+	}
+	// Check the canonical chain for bad blocks
+	for hash := range BadHashes {
+		if number := rawdb.ReadHeaderNumber(db, hash); number != nil && rawdb.ReadCanonicalHash(db, *number) == hash {
+			report.add(InconsistencyBadHash, *number, "bad block %x canonical", hash)
+		}
+	}
+	// Check the stored tx index tail, if any
+	if stored := rawdb.ReadTxIndexTail(db); stored != nil {
+		if tail := txIndexTail(db, report.HeadBlock); *stored != tail {
+			report.add(InconsistencyTxIndexTail, *stored, "tx index tail stored as %d, indexed from %d", *stored, tail)
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,349 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// maxAncientScans is the number of the last ancients verifications started whose
+// statuses are retained for StatusVerifyAncients.
+const maxAncientScans = 16
+
+const (
+	// maxAncientScanWorkers bounds the concurrent workers of an ancients verification,
+	// and so its requests in flight against a remote freezer.
+	maxAncientScanWorkers = 16
+
+	// ancientScanChunk is the maximum number of blocks a worker of an ancients
+	// verification checks as one range.
+	ancientScanChunk = 1024
+)
+
+// AncientMismatch is an inconsistency of the frozen items of a block detected by
+// VerifyAncients.
+type AncientMismatch struct {
+	Number uint64 `json:"number"`
+	Kind   string `json:"kind"` // Ancient kind of the inconsistent item, eg. "bodies"
+	Detail string `json:"detail"`
+}
+
+func (m AncientMismatch) String() string {
+	return fmt.Sprintf("%s #%d: %s", m.Kind, m.Number, m.Detail)
+}
+
+// VerifyAncients checks the frozen items of the blocks from and up to to (inclusive)
+// against each other: the header against the canonical hash and its parent, the
+// transactions and uncles of the body and the receipts against the roots of the
+// header (unless the uncles were pruned, see rawdb.EnableAncientUnclesPruning),
+// and the total difficulty against the parent's. Every inconsistency is
+// reported as a mismatch, the scan fails only if an item can't be read at all, or
+// ctx is cancelled. If progress is not nil, it is called with the number of every
+// block verified.
+//
+// With more than one worker, up to maxAncientScanWorkers, the range is split into
+// chunks verified concurrently. The mismatches are reported in the order of the
+// blocks regardless, but progress is called in no particular order (though never
+// concurrently), and a failing scan reports the mismatches of the chunks done.
+func VerifyAncients(ctx context.Context, db ethdb.AncientReader, from, to uint64, workers int, progress func(number uint64)) ([]AncientMismatch, error) {
+	if from > to {
+		return nil, fmt.Errorf("invalid ancients range #%d-#%d", from, to)
+	}
+	if frozen, err := db.Ancients(); err != nil {
+		return nil, err
+	} else if to >= frozen {
+		return nil, fmt.Errorf("ancients range #%d-#%d beyond %d ancients", from, to, frozen)
+	}
+	if workers > maxAncientScanWorkers {
+		workers = maxAncientScanWorkers
+	}
+	if workers <= 1 || from == to {
+		return verifyAncientsRange(ctx, db, from, to, progress)
+	}
+	// Split the range into chunks, at least one per worker
+	chunk := (to - from + uint64(workers)) / uint64(workers)
+	if chunk > ancientScanChunk {
+		chunk = ancientScanChunk
+	}
+	chunks := int((to-from)/chunk) + 1
+	if workers > chunks {
+		workers = chunks
+	}
+	var (
+		results = make([][]AncientMismatch, chunks)
+		errs    = make([]error, chunks)
+		tasks   = make(chan int, chunks)
+		lock    sync.Mutex // Serializes the calls to progress
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < chunks; i++ {
+		tasks <- i
+	}
+	close(tasks)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	report := progress
+	if progress != nil {
+		report = func(number uint64) {
+			lock.Lock()
+			defer lock.Unlock()
+			progress(number)
+		}
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range tasks {
+				start := from + uint64(i)*chunk
+				end := start + chunk - 1
+				if end > to {
+					end = to
+				}
+				if results[i], errs[i] = verifyAncientsRange(ctx, db, start, end, report); errs[i] != nil {
+					cancel() // Abort the other chunks too
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var mismatches []AncientMismatch
+	for i := range results {
+		mismatches = append(mismatches, results[i]...)
+	}
+	// Report the error of the chunk which failed first, rather than the cancellation
+	// of the others.
+	var err error
+	for _, e := range errs {
+		if e != nil && (err == nil || errors.Is(err, context.Canceled)) {
+			err = e
+		}
+	}
+	return mismatches, err
+}
+
+// verifyAncientsRange checks the frozen items of the blocks from and up to to, see
+// VerifyAncients, which validated the range.
+func verifyAncientsRange(ctx context.Context, db ethdb.AncientReader, from, to uint64, progress func(number uint64)) ([]AncientMismatch, error) {
+	var (
+		mismatches []AncientMismatch
+		parentHash common.Hash
+		parentTd   *big.Int
+	)
+	add := func(number uint64, kind string, format string, args ...interface{}) {
+		mismatches = append(mismatches, AncientMismatch{Number: number, Kind: kind, Detail: fmt.Sprintf(format, args...)})
+	}
+	// The parent of the first block is checked against too, if frozen.
+	if from > 0 {
+		if blob, err := db.Ancient(rawdb.FreezerRemoteHashTable, from-1); err == nil {
+			parentHash = common.BytesToHash(blob)
+		}
+		if blob, err := db.Ancient(rawdb.FreezerRemoteDifficultyTable, from-1); err == nil {
+			parentTd = new(big.Int)
+			if err := rlp.DecodeBytes(blob, parentTd); err != nil {
+				parentTd = nil
+			}
+		}
+	}
+	for number := from; number <= to; number++ {
+		if err := ctx.Err(); err != nil {
+			return mismatches, err
+		}
+		var items [5][]byte
+		for i, kind := range []string{rawdb.FreezerRemoteHashTable, rawdb.FreezerRemoteHeaderTable, rawdb.FreezerRemoteBodiesTable, rawdb.FreezerRemoteReceiptTable, rawdb.FreezerRemoteDifficultyTable} {
+			blob, err := db.Ancient(kind, number)
+			if err != nil {
+				return mismatches, fmt.Errorf("ancient %s #%d: %v", kind, number, err)
+			}
+			items[i] = blob
+		}
+		hashBlob, headerBlob, bodyBlob, receiptsBlob, tdBlob := items[0], items[1], items[2], items[3], items[4]
+
+		// Check the header against the canonical hash and the parent
+		hash := common.BytesToHash(hashBlob)
+		if len(hashBlob) != common.HashLength {
+			add(number, rawdb.FreezerRemoteHashTable, "invalid hash length %d", len(hashBlob))
+		}
+		header := new(types.Header)
+		if err := rlp.DecodeBytes(headerBlob, header); err != nil {
+			add(number, rawdb.FreezerRemoteHeaderTable, "undecodable header: %v", err)
+			header = nil
+		} else {
+			if have := header.Hash(); have != hash {
+				add(number, rawdb.FreezerRemoteHeaderTable, "header hash %x, canonical %x", have, hash)
+			}
+			if header.Number == nil || header.Number.Uint64() != number {
+				add(number, rawdb.FreezerRemoteHeaderTable, "header number %v", header.Number)
+			}
+			if parentHash != (common.Hash{}) && header.ParentHash != parentHash {
+				add(number, rawdb.FreezerRemoteHeaderTable, "parent hash %x, parent %x", header.ParentHash, parentHash)
+			}
+		}
+		// Check the body and the receipts against the header
+		body := new(types.Body)
+		if err := rlp.DecodeBytes(bodyBlob, body); err != nil {
+			add(number, rawdb.FreezerRemoteBodiesTable, "undecodable body: %v", err)
+		} else if header != nil {
+			if have := types.DeriveSha(types.Transactions(body.Transactions), trie.NewStackTrie(nil)); have != header.TxHash {
+				add(number, rawdb.FreezerRemoteBodiesTable, "transaction root %x, header %x", have, header.TxHash)
+			}
+			// Uncles omitted from the frozen body are not a mismatch
+			pruned := false
+			if kv, ok := db.(ethdb.KeyValueReader); ok && len(body.Uncles) == 0 {
+				pruned = rawdb.AncientUnclesPruned(kv, number)
+			}
+			if have := types.CalcUncleHash(body.Uncles); have != header.UncleHash && !pruned {
+				add(number, rawdb.FreezerRemoteBodiesTable, "uncle hash %x, header %x", have, header.UncleHash)
+			}
+		}
+		var stored []*types.ReceiptForStorage
+		if err := rlp.DecodeBytes(receiptsBlob, &stored); err != nil {
+			add(number, rawdb.FreezerRemoteReceiptTable, "undecodable receipts: %v", err)
+		} else if header != nil {
+			receipts := make(types.Receipts, len(stored))
+			for i, receipt := range stored {
+				receipts[i] = (*types.Receipt)(receipt)
+				receipts[i].Bloom = types.CreateBloom(types.Receipts{receipts[i]})
+			}
+			if have := types.DeriveSha(receipts, trie.NewStackTrie(nil)); have != header.ReceiptHash {
+				add(number, rawdb.FreezerRemoteReceiptTable, "receipt root %x, header %x", have, header.ReceiptHash)
+			}
+		}
+		// Check the total difficulty against the parent's
+		td := new(big.Int)
+		if err := rlp.DecodeBytes(tdBlob, td); err != nil {
+			add(number, rawdb.FreezerRemoteDifficultyTable, "undecodable total difficulty: %v", err)
+			td = nil
+		} else if header != nil && parentTd != nil {
+			if want := new(big.Int).Add(parentTd, header.Difficulty); td.Cmp(want) != 0 {
+				add(number, rawdb.FreezerRemoteDifficultyTable, "total difficulty %v, want %v", td, want)
+			}
+		}
+		parentHash, parentTd = hash, td
+		if progress != nil {
+			progress(number)
+		}
+	}
+	return mismatches, nil
+}
+
+// AncientScanStatus reports the progress, and once done the result, of an ancients
+// verification started by StartVerifyAncients.
+type AncientScanStatus struct {
+	ID         uint64            `json:"id"`
+	From       uint64            `json:"from"`
+	To         uint64            `json:"to"`
+	Verified   uint64            `json:"verified"` // Number of blocks verified so far
+	Done       bool              `json:"done"`
+	Error      string            `json:"error,omitempty"` // Reason the verification failed, if it did
+	Mismatches []AncientMismatch `json:"mismatches"`      // Inconsistencies detected, once done
+}
+
+// ancientScan is an ancients verification running in the background.
+type ancientScan struct {
+	status AncientScanStatus
+	lock   sync.Mutex
+}
+
+// StartVerifyAncients starts verifying the frozen items of the blocks from and up to
+// to (inclusive) in the background, see VerifyAncients and SetVerifyAncientsWorkers,
+// and returns the id of the verification to poll StatusVerifyAncients with. The
+// verification is aborted when the chain is stopped. The statuses of the last
+// maxAncientScans verifications started are retained.
+func (bc *BlockChain) StartVerifyAncients(from, to uint64) (uint64, error) {
+	if from > to {
+		return 0, fmt.Errorf("invalid ancients range #%d-#%d", from, to)
+	}
+	frozen, err := bc.db.Ancients()
+	if err != nil {
+		return 0, err
+	}
+	if to >= frozen {
+		return 0, fmt.Errorf("ancients range #%d-#%d beyond %d ancients", from, to, frozen)
+	}
+	bc.ancientScanLock.Lock()
+	if bc.ancientScans == nil {
+		bc.ancientScans = make(map[uint64]*ancientScan)
+	}
+	bc.ancientScanID++
+	id := bc.ancientScanID
+	scan := &ancientScan{status: AncientScanStatus{ID: id, From: from, To: to, Mismatches: []AncientMismatch{}}}
+	bc.ancientScans[id] = scan
+	delete(bc.ancientScans, id-maxAncientScans)
+	bc.ancientScanLock.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	bc.wg.Add(1)
+	go func() {
+		defer bc.wg.Done()
+		defer cancel()
+
+		go func() {
+			select {
+			case <-bc.quit:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		workers := int(atomic.LoadInt32(&bc.ancientScanWorkers))
+		mismatches, err := VerifyAncients(ctx, bc.db, from, to, workers, func(number uint64) {
+			scan.lock.Lock()
+			scan.status.Verified++
+			scan.lock.Unlock()
+		})
+		scan.lock.Lock()
+		defer scan.lock.Unlock()
+
+		scan.status.Done = true
+		scan.status.Mismatches = append(scan.status.Mismatches, mismatches...)
+		if err != nil {
+			scan.status.Error = err.Error()
+		}
+		log.Info("Verified ancients", "id", id, "from", from, "to", to, "verified", scan.status.Verified, "mismatches", len(mismatches), "err", err)
+	}()
+	return id, nil
+}
+
+// SetVerifyAncientsWorkers sets the number of concurrent workers of the ancients
+// verifications started afterwards, bounded by maxAncientScanWorkers. A single
+// worker, the default, verifies the blocks in order.
+func (bc *BlockChain) SetVerifyAncientsWorkers(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > maxAncientScanWorkers {
+		workers = maxAncientScanWorkers
+	}
+	atomic.StoreInt32(&bc.ancientScanWorkers, int32(workers))
+	log.Info("Ancients verification workers configured", "workers", workers)
+}
+
+// StatusVerifyAncients returns the status of the ancients verification of the given id.
+func (bc *BlockChain) StatusVerifyAncients(id uint64) (*AncientScanStatus, error) {
+	bc.ancientScanLock.Lock()
+	scan := bc.ancientScans[id]
+	bc.ancientScanLock.Unlock()
+	if scan == nil {
+		return nil, fmt.Errorf("unknown ancients verification %d", id)
+	}
+	scan.lock.Lock()
+	defer scan.lock.Unlock()
+
+	status := scan.status
+	status.Mismatches = append([]AncientMismatch{}, scan.status.Mismatches...)
+	return &status, nil
+}
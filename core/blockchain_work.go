@@ -0,0 +1,53 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ErrNotAncestor is returned by WorkBetween for blocks which aren't an ancestor and
+// a descendant of it.
+var ErrNotAncestor = errors.New("not an ancestor of the descendant")
+
+// WorkBetween returns the cumulative difficulty of the blocks above ancestor up to and
+// including descendant, eg. for tools implementing their own fork choice. Between two
+// canonical blocks it's the difference of their total difficulties; otherwise the
+// parents of descendant are walked down to ancestor, so the descendant needn't be
+// canonical. The work between a block and itself is zero.
+func (bc *BlockChain) WorkBetween(ancestor, descendant common.Hash) (*big.Int, error) {
+	from := bc.GetHeaderByHash(ancestor)
+	if from == nil {
+		return nil, fmt.Errorf("unknown ancestor %x", ancestor)
+	}
+	header := bc.GetHeaderByHash(descendant)
+	if header == nil {
+		return nil, fmt.Errorf("unknown descendant %x", descendant)
+	}
+	number := from.Number.Uint64()
+	if header.Number.Uint64() < number {
+		return nil, fmt.Errorf("%w: ancestor #%d above descendant #%d", ErrNotAncestor, number, header.Number.Uint64())
+	}
+	// Between canonical blocks, the work is the difference of their total difficulties
+	if bc.GetCanonicalHash(number) == ancestor && bc.GetCanonicalHash(header.Number.Uint64()) == descendant {
+		ancestorTd, descendantTd := bc.GetTd(ancestor, number), bc.GetTd(descendant, header.Number.Uint64())
+		if ancestorTd != nil && descendantTd != nil {
+			return new(big.Int).Sub(descendantTd, ancestorTd), nil
+		}
+	}
+	work := new(big.Int)
+	for header.Number.Uint64() > number {
+		work.Add(work, header.Difficulty)
+		parent := bc.GetHeader(header.ParentHash, header.Number.Uint64()-1)
+		if parent == nil {
+			return nil, fmt.Errorf("missing header #%d [%x]", header.Number.Uint64()-1, header.ParentHash)
+		}
+		header = parent
+	}
+	if header.Hash() != ancestor {
+		return nil, fmt.Errorf("%w: #%d [%x] is not on the chain of %x", ErrNotAncestor, number, ancestor, descendant)
+	}
+	return work, nil
+}
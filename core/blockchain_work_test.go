@@ -0,0 +1,92 @@
+package core
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/params/types/genesisT"
+)
+
+// Tests that the work between blocks equals the difference of their total
+// difficulties, on the canonical chain and on side chains.
+func TestWorkBetween(t *testing.T) {
+	var (
+		gspec   = &genesisT.Genesis{Config: params.TestChainConfig}
+		gendb   = rawdb.NewMemoryDatabase()
+		genesis = MustCommitGenesis(gendb, gspec)
+	)
+	blocks, _ := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), gendb, 20, nil)
+	fork, _ := GenerateChain(gspec.Config, blocks[9], ethash.NewFaker(), gendb, 5, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{0x01})
+	})
+	db := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(db, gspec)
+	chain, err := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if n, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert block %d: %v", n, err)
+	}
+	if n, err := chain.InsertChain(fork); err != nil {
+		t.Fatalf("failed to insert fork block %d: %v", n, err)
+	}
+	if chain.CurrentBlock().Hash() != blocks[19].Hash() {
+		t.Fatalf("fork became canonical")
+	}
+	tdDiff := func(ancestor, descendant *types.Block) *big.Int {
+		return new(big.Int).Sub(chain.GetTd(descendant.Hash(), descendant.NumberU64()), chain.GetTd(ancestor.Hash(), ancestor.NumberU64()))
+	}
+	for i, tt := range []struct{ ancestor, descendant *types.Block }{
+		{genesis, blocks[19]},
+		{blocks[4], blocks[14]},
+		{blocks[7], blocks[7]},
+		{blocks[9], fork[4]},
+		{genesis, fork[2]},
+	} {
+		work, err := chain.WorkBetween(tt.ancestor.Hash(), tt.descendant.Hash())
+		if err != nil {
+			t.Errorf("test %d: #%d-#%d: %v", i, tt.ancestor.NumberU64(), tt.descendant.NumberU64(), err)
+			continue
+		}
+		if want := tdDiff(tt.ancestor, tt.descendant); work.Cmp(want) != 0 {
+			t.Errorf("test %d: #%d-#%d: have work %v, want %v", i, tt.ancestor.NumberU64(), tt.descendant.NumberU64(), work, want)
+		}
+	}
+	for i, tt := range []struct{ ancestor, descendant *types.Block }{
+		{blocks[14], blocks[4]},
+		{blocks[11], fork[4]},
+		{fork[0], blocks[19]},
+	} {
+		if _, err := chain.WorkBetween(tt.ancestor.Hash(), tt.descendant.Hash()); !errors.Is(err, ErrNotAncestor) {
+			t.Errorf("unrelated test %d: want %v, got %v", i, ErrNotAncestor, err)
+		}
+	}
+	if _, err := chain.WorkBetween(common.Hash{0x01}, blocks[19].Hash()); err == nil {
+		t.Errorf("work from an unknown block returned")
+	}
+	// The headers between canonical blocks aren't needed, unlike the fork's
+	for _, block := range blocks[5:14] {
+		rawdb.DeleteHeader(db, block.Hash(), block.NumberU64())
+	}
+	rawdb.DeleteHeader(db, fork[1].Hash(), fork[1].NumberU64())
+	chain.hc.headerCache.Purge()
+
+	if work, err := chain.WorkBetween(blocks[4].Hash(), blocks[14].Hash()); err != nil {
+		t.Errorf("canonical blocks without the headers between: %v", err)
+	} else if want := tdDiff(blocks[4], blocks[14]); work.Cmp(want) != 0 {
+		t.Errorf("canonical blocks without the headers between: have work %v, want %v", work, want)
+	}
+	if _, err := chain.WorkBetween(blocks[9].Hash(), fork[4].Hash()); err == nil {
+		t.Errorf("work of a fork missing a header returned")
+	}
+}
@@ -27,6 +27,23 @@ var (
 
 	// ErrNoGenesis is returned when there is no Genesis Block.
 	ErrNoGenesis = errors.New("genesis not found in chain")
+
+	// ErrGasLimitMaxDelta is returned if the gas limit of a block to import changed
+	// more than the chain configuration's bound relative to its parent.
+	ErrGasLimitMaxDelta = errors.New("gas limit change out of configured bounds")
+
+	// ErrBelowTail is returned when inserting a block below the first one retained
+	// by an ancient store discarding old items.
+	ErrBelowTail = errors.New("block below the retained ancient tail")
+
+	// ErrChainConfigRestart is returned when updating the chain configuration at runtime
+	// with changes to parameters the consensus engine or the transaction signers were
+	// set up with, which only a restart applies.
+	ErrChainConfigRestart = errors.New("chain configuration change requires a restart")
+
+	// ErrLowDiskSpace is returned when the disk guard of the ancient store reports low
+	// free space in the midst of an insertion, which doesn't wait for it to recover.
+	ErrLowDiskSpace = errors.New("low free disk space")
 )
 
 // List of evm-call-message pre-checking errors. All state transition messages will
@@ -17,8 +17,11 @@
 package core
 
 import (
+	"time"
+
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params/types/ctypes"
 )
 
 // NewTxsEvent is posted when a batch of transactions enter the transaction pool.
@@ -41,3 +44,48 @@ type ChainSideEvent struct {
 }
 
 type ChainHeadEvent struct{ Block *types.Block }
+
+// FinalityConfirmationEvent is posted when a canonical block becomes buried deep
+// enough to be considered effectively final.
+type FinalityConfirmationEvent struct {
+	Hash   common.Hash
+	Number uint64
+}
+
+// EffectiveFinalityDepthEvent is posted when the number of blocks below the head
+// at which canonical blocks become effectively final shifts.
+type EffectiveFinalityDepthEvent struct {
+	Head  common.Hash // Head the depth was computed for
+	Depth uint64      // Depth of the most recent effectively final block below the head
+}
+
+// ArtificialFinalityEngagedEvent is posted when artificial finality, whose enabling
+// was deferred until the node caught up with the network, actually engages.
+type ArtificialFinalityEngagedEvent struct {
+	Number      uint64 // Number of the head block at engagement
+	NetworkHead uint64 // Number of the network's head block at engagement
+}
+
+// ArtificialFinalityStallEvent is posted when the stall watchdog disabled artificial
+// finality, as the chain made no canonical progress while it rejected competing segments.
+type ArtificialFinalityStallEvent struct {
+	Number     uint64        // Number of the head block the chain stalled at
+	Stalled    time.Duration // Time since the last canonical progress
+	Rejections uint32        // Number of rejections since the last canonical progress
+}
+
+// ArtificialFinalityDecisionEvent is posted for every decision of ECBP1100 about a
+// competing chain segment.
+type ArtificialFinalityDecisionEvent struct {
+	TraceID        string        // Unique id of the decision, also logged with it and carried by the rejection
+	CommonAncestor *types.Header // Common ancestor of the current and the proposed segment
+	Current        *types.Header // Head of the current segment
+	Proposed       *types.Header // Head of the proposed segment
+	Err            error         // Rejection reason, nil if the proposed segment was accepted
+}
+
+// ChainConfigEvent is posted when the chain's fork configuration was replaced at
+// runtime, see BlockChain.UpdateChainConfig.
+type ChainConfigEvent struct {
+	Config ctypes.ChainConfigurator // New configuration of the chain
+}
@@ -22,6 +22,7 @@ import (
 	"errors"
 	"hash/crc32"
 	"math"
+	"sync"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
@@ -83,15 +84,28 @@ func NewID(config ctypes.ChainConfigurator, genesis common.Hash, head uint64) ID
 }
 
 // NewFilter creates a filter that returns if a fork ID should be rejected or not
-// based on the local chain's status.
+// based on the local chain's status. The filter follows the chain's configuration,
+// it's rebuilt whenever the chain's configuration is replaced.
 func NewFilter(chain Blockchain) Filter {
-	return newFilter(
-		chain.Config(),
-		chain.Genesis().Hash(),
-		func() uint64 {
+	var (
+		genesis = chain.Genesis().Hash()
+		headfn  = func() uint64 {
 			return chain.CurrentHeader().Number.Uint64()
-		},
+		}
+		lock   sync.Mutex
+		config ctypes.ChainConfigurator
+		filter Filter
 	)
+	return func(id ID) error {
+		lock.Lock()
+		if current := chain.Config(); current != config || filter == nil {
+			config, filter = current, newFilter(current, genesis, headfn)
+		}
+		fn := filter
+		lock.Unlock()
+
+		return fn(id)
+	}
 }
 
 // NewStaticFilter creates a filter at block zero.
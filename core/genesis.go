@@ -17,8 +17,13 @@
 package core
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"math/big"
+	"reflect"
+	"sort"
+	"strings"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/rawdb"
@@ -31,6 +36,7 @@ import (
 	"github.com/ethereum/go-ethereum/params/types/ctypes"
 	"github.com/ethereum/go-ethereum/params/types/genesisT"
 	"github.com/ethereum/go-ethereum/params/vars"
+	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/trie"
 )
 
@@ -191,6 +197,11 @@ func GenesisToBlock(g *genesisT.Genesis, db ethdb.Database) *types.Block {
 	statedb, _ := state.New(common.Hash{}, state.NewDatabase(db), nil)
 	for addr, account := range g.Alloc {
 		statedb.AddBalance(addr, account.Balance)
+		if g.AllocDuplicates == genesisT.GenesisAllocDuplicateMerge {
+			for _, dup := range account.Duplicates {
+				statedb.AddBalance(addr, dup.Balance)
+			}
+		}
 		statedb.SetCode(addr, account.Code)
 		statedb.SetNonce(addr, account.Nonce)
 		for key, value := range account.Storage {
@@ -224,12 +235,22 @@ func GenesisToBlock(g *genesisT.Genesis, db ethdb.Database) *types.Block {
 }
 
 // CommitGenesis writes the block and state of a genesis specification to the database.
-// The block is committed as the canonical head block.
+// The block is committed as the canonical head block. Addresses allocated more than
+// once are handled according to the genesis policy for alloc duplicates.
 func CommitGenesis(g *genesisT.Genesis, db ethdb.Database) (*types.Block, error) {
+	if err := g.CheckAllocDuplicates(); err != nil {
+		return nil, err
+	}
 	block := GenesisToBlock(g, db)
 	if block.Number().Sign() != 0 {
 		return nil, fmt.Errorf("can't commit genesis block with number > 0")
 	}
+	// Refuse to pair the block with an ancient store frozen for another chain
+	if frozen, err := frozenGenesisHash(db); err != nil {
+		return nil, err
+	} else if frozen != (common.Hash{}) && frozen != block.Hash() {
+		return nil, &genesisT.GenesisMismatchError{Stored: frozen, New: block.Hash()}
+	}
 	config := g.Config
 	if config == nil {
 		config = params.AllEthashProtocolChanges
@@ -245,6 +266,31 @@ func CommitGenesis(g *genesisT.Genesis, db ethdb.Database) (*types.Block, error)
 	return block, nil
 }
 
+// frozenGenesisHash returns the hash of the genesis header frozen in the ancient
+// store of db (eg. a remote freezer already holding a chain), or the zero hash if
+// nothing is frozen or db has no ancient store.
+func frozenGenesisHash(db ethdb.Database) (common.Hash, error) {
+	frozen, err := db.Ancients()
+	if err != nil {
+		if !rawdb.HasAncientStore(db) {
+			return common.Hash{}, nil
+		}
+		return common.Hash{}, fmt.Errorf("failed to retrieve frozen items: %v", err)
+	}
+	if frozen == 0 {
+		return common.Hash{}, nil
+	}
+	blob, err := db.Ancient(rawdb.FreezerRemoteHeaderTable, 0)
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("failed to retrieve frozen genesis header: %v", err)
+	}
+	header := new(types.Header)
+	if err := rlp.DecodeBytes(blob, header); err != nil {
+		return common.Hash{}, fmt.Errorf("invalid frozen genesis header: %v", err)
+	}
+	return header.Hash(), nil
+}
+
 // MustCommitGenesis writes the genesis block and state to db, panicking on error.
 // The block is committed as the canonical head block.
 func MustCommitGenesis(db ethdb.Database, g *genesisT.Genesis) *types.Block {
@@ -260,3 +306,123 @@ func GenesisBlockForTesting(db ethdb.Database, addr common.Address, balance *big
 	g := genesisT.Genesis{Alloc: genesisT.GenesisAlloc{addr: {Balance: balance}}}
 	return MustCommitGenesis(db, &g)
 }
+
+// GenesisDiff describes how a proposed genesis specification differs from the
+// genesis already committed to a database.
+type GenesisDiff struct {
+	Stored common.Hash // Hash of the stored genesis block
+	New    common.Hash // Hash of the genesis block the specification would produce
+
+	Config []GenesisConfigDiff // Chain configuration values which differ
+	Alloc  []GenesisAllocDiff  // Genesis accounts which differ
+}
+
+// GenesisConfigDiff is a chain configuration value which differs between the
+// stored and proposed genesis. Field names the ctypes.ChainConfigurator getter
+// without its "Get" prefix.
+type GenesisConfigDiff struct {
+	Field  string
+	Stored interface{}
+	New    interface{}
+}
+
+// GenesisAllocDiff is a genesis account which differs between the stored and
+// proposed genesis. A nil account means the account does not exist on that side.
+type GenesisAllocDiff struct {
+	Address common.Address
+	Stored  *state.DumpAccount
+	New     *state.DumpAccount
+}
+
+// Empty returns true if the proposed genesis matches the stored one.
+func (d *GenesisDiff) Empty() bool {
+	return d.Stored == d.New && len(d.Config) == 0 && len(d.Alloc) == 0
+}
+
+// GenesisMismatch compares the genesis specification against the genesis stored
+// in db without writing anything, returning the differing configuration fields
+// and alloc entries. Where SetupGenesisBlock or MustCommitGenesis would only
+// report a mismatch, this allows operators to see what actually changed.
+func GenesisMismatch(db ethdb.Database, genesis *genesisT.Genesis) (*GenesisDiff, error) {
+	if genesis == nil {
+		return nil, errors.New("no genesis specification")
+	}
+	stored := rawdb.ReadCanonicalHash(db, 0)
+	if (stored == common.Hash{}) {
+		return nil, errors.New("no stored genesis block")
+	}
+	header := rawdb.ReadHeader(db, stored, 0)
+	if header == nil {
+		return nil, fmt.Errorf("missing stored genesis header %x", stored)
+	}
+	// Build the proposed genesis into a scratch database, leaving db untouched.
+	proposedDB := rawdb.NewMemoryDatabase()
+	block := GenesisToBlock(genesis, proposedDB)
+	diff := &GenesisDiff{Stored: stored, New: block.Hash()}
+
+	// Compare every configuration getter. An old database may not have a stored
+	// config, in which case SetupGenesisBlock would write the new one anyway.
+	if storedcfg := rawdb.ReadChainConfig(db, stored); storedcfg != nil {
+		newcfg := genesis.Config
+		if newcfg == nil {
+			newcfg = params.AllEthashProtocolChanges
+		}
+		diff.Config = genesisConfigDiff(storedcfg, newcfg)
+	}
+
+	// Compare the genesis allocations.
+	storedState, err := state.New(header.Root, state.NewDatabase(db), nil)
+	if err != nil {
+		return nil, fmt.Errorf("stored genesis state: %v", err)
+	}
+	newState, err := state.New(block.Root(), state.NewDatabase(proposedDB), nil)
+	if err != nil {
+		return nil, fmt.Errorf("proposed genesis state: %v", err)
+	}
+	diff.Alloc = genesisAllocDiff(storedState.RawDump(false, false, false), newState.RawDump(false, false, false))
+
+	return diff, nil
+}
+
+// genesisConfigDiff compares the results of all argument-less getters of the
+// chain configurator interface.
+func genesisConfigDiff(a, b ctypes.ChainConfigurator) []GenesisConfigDiff {
+	var diffs []GenesisConfigDiff
+	iface := reflect.TypeOf((*ctypes.ChainConfigurator)(nil)).Elem()
+	for i := 0; i < iface.NumMethod(); i++ {
+		m := iface.Method(i)
+		if !strings.HasPrefix(m.Name, "Get") || m.Type.NumIn() != 0 || m.Type.NumOut() != 1 {
+			continue
+		}
+		res1 := reflect.ValueOf(a).MethodByName(m.Name).Call([]reflect.Value{})[0].Interface()
+		res2 := reflect.ValueOf(b).MethodByName(m.Name).Call([]reflect.Value{})[0].Interface()
+		if !reflect.DeepEqual(res1, res2) {
+			diffs = append(diffs, GenesisConfigDiff{Field: strings.TrimPrefix(m.Name, "Get"), Stored: res1, New: res2})
+		}
+	}
+	return diffs
+}
+
+// genesisAllocDiff compares two state dumps, returning the differing accounts
+// sorted by address.
+func genesisAllocDiff(a, b state.Dump) []GenesisAllocDiff {
+	var diffs []GenesisAllocDiff
+	for addr, acc := range a.Accounts {
+		acc := acc
+		if other, ok := b.Accounts[addr]; !ok {
+			diffs = append(diffs, GenesisAllocDiff{Address: addr, Stored: &acc})
+		} else if !reflect.DeepEqual(acc, other) {
+			diffs = append(diffs, GenesisAllocDiff{Address: addr, Stored: &acc, New: &other})
+		}
+	}
+	for addr, acc := range b.Accounts {
+		acc := acc
+		if _, ok := a.Accounts[addr]; !ok {
+			diffs = append(diffs, GenesisAllocDiff{Address: addr, New: &acc})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		return bytes.Compare(diffs[i].Address[:], diffs[j].Address[:]) < 0
+	})
+	return diffs
+}
@@ -19,16 +19,19 @@ package core
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"math/big"
 	"reflect"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/params/confp"
 	"github.com/ethereum/go-ethereum/params/types/coregeth"
 	"github.com/ethereum/go-ethereum/params/types/ctypes"
+	"github.com/ethereum/go-ethereum/params/types/genesisT"
 	"github.com/ethereum/go-ethereum/params/types/multigeth"
 )
 
@@ -305,3 +308,102 @@ func TestSetupGenesisBlock2(t *testing.T) {
 		t.Fatal("different config")
 	}
 }
+
+func TestGenesisMismatch(t *testing.T) {
+	db := rawdb.NewMemoryDatabase()
+	stored := params.DefaultMessNetGenesisBlock()
+	MustCommitGenesis(db, stored)
+
+	diff, err := GenesisMismatch(db, params.DefaultMessNetGenesisBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !diff.Empty() {
+		t.Fatalf("unexpected diff for identical genesis: %+v", diff)
+	}
+
+	// Copy the config so the package-level MessNetConfig stays untouched.
+	modified := params.DefaultMessNetGenesisBlock()
+	b, err := json.Marshal(modified.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := new(coregeth.CoreGethChainConfig)
+	if err := json.Unmarshal(b, config); err != nil {
+		t.Fatal(err)
+	}
+	n := uint64(42)
+	if err := config.SetECBP1100Transition(&n); err != nil {
+		t.Fatal(err)
+	}
+	modified.Config = config
+	modified.Alloc = genesisT.GenesisAlloc{}
+	for addr, acc := range stored.Alloc {
+		modified.Alloc[addr] = acc
+	}
+	extra := common.HexToAddress("0xdeadbeef")
+	modified.Alloc[extra] = genesisT.GenesisAccount{Balance: big.NewInt(42)}
+
+	diff, err = GenesisMismatch(db, modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.Stored == diff.New {
+		t.Errorf("expected differing genesis hashes, both %x", diff.Stored)
+	}
+	if len(diff.Config) != 1 || diff.Config[0].Field != "ECBP1100Transition" {
+		t.Fatalf("unexpected config diff: %+v", diff.Config)
+	}
+	if got := diff.Config[0].New.(*uint64); got == nil || *got != n {
+		t.Errorf("new ECBP1100Transition: have %v, want %d", got, n)
+	}
+	if len(diff.Alloc) != 1 || diff.Alloc[0].Address != extra || diff.Alloc[0].Stored != nil || diff.Alloc[0].New.Balance != "42" {
+		t.Fatalf("unexpected alloc diff: %+v", diff.Alloc)
+	}
+}
+
+// Tests that addresses allocated more than once are rejected by default, and have
+// their balances merged if so configured.
+func TestGenesisAllocDuplicates(t *testing.T) {
+	const spec = `{
+		"config": {"chainId": 1},
+		"gasLimit": "0x47b760",
+		"difficulty": "0x1",
+		"alloc": {
+			"0x0000000000000000000000000000000000000001": {"balance": "1"},
+			"0000000000000000000000000000000000000002": {"balance": "2"},
+			"0000000000000000000000000000000000000001": {"balance": "10", "nonce": "0x5"},
+			"0x0000000000000000000000000000000000000001": {"balance": "100", "nonce": "0x7"}
+		}
+	}`
+	genesis := new(genesisT.Genesis)
+	if err := json.Unmarshal([]byte(spec), genesis); err != nil {
+		t.Fatal(err)
+	}
+	dup, other := common.HexToAddress("0x01"), common.HexToAddress("0x02")
+	if dups := genesis.Alloc.Duplicates(); !reflect.DeepEqual(dups, []common.Address{dup}) {
+		t.Fatalf("duplicates: have %v, want %v", dups, []common.Address{dup})
+	}
+	if _, err := CommitGenesis(genesis, rawdb.NewMemoryDatabase()); !errors.Is(err, genesisT.ErrGenesisAllocDuplicate) {
+		t.Fatalf("commit rejecting duplicates: want %v, got %v", genesisT.ErrGenesisAllocDuplicate, err)
+	}
+	genesis.AllocDuplicates = genesisT.GenesisAllocDuplicateMerge
+	db := rawdb.NewMemoryDatabase()
+	block, err := CommitGenesis(genesis, db)
+	if err != nil {
+		t.Fatalf("commit merging duplicates: %v", err)
+	}
+	statedb, err := state.New(block.Root(), state.NewDatabase(db), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance := statedb.GetBalance(dup); balance.Cmp(big.NewInt(111)) != 0 {
+		t.Errorf("merged balance: have %v, want 111", balance)
+	}
+	if nonce := statedb.GetNonce(dup); nonce != 7 {
+		t.Errorf("merged nonce: have %d, want 7", nonce)
+	}
+	if balance := statedb.GetBalance(other); balance.Cmp(big.NewInt(2)) != 0 {
+		t.Errorf("balance: have %v, want 2", balance)
+	}
+}
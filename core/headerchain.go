@@ -56,7 +56,7 @@ const (
 // It is not thread safe either, the encapsulating chain structures should do
 // the necessary mutex locking/unlocking.
 type HeaderChain struct {
-	config ctypes.ChainConfigurator
+	config atomic.Value // Chain configuration (chainConfigHolder)
 
 	chainDb       ethdb.Database
 	genesisHeader *types.Header
@@ -88,7 +88,6 @@ func NewHeaderChain(chainDb ethdb.Database, config ctypes.ChainConfigurator, eng
 	}
 
 	hc := &HeaderChain{
-		config:        config,
 		chainDb:       chainDb,
 		headerCache:   headerCache,
 		tdCache:       tdCache,
@@ -98,6 +97,8 @@ func NewHeaderChain(chainDb ethdb.Database, config ctypes.ChainConfigurator, eng
 		engine:        engine,
 	}
 
+	hc.config.Store(chainConfigHolder{config})
+
 	hc.genesisHeader = hc.GetHeaderByNumber(0)
 	if hc.genesisHeader == nil {
 		return nil, ErrNoGenesis
@@ -139,6 +140,12 @@ func (hc *HeaderChain) GetBlockNumber(hash common.Hash) *uint64 {
 // in two scenarios: pure-header mode of operation (light clients), or properly
 // separated header/block phases (non-archive clients).
 func (hc *HeaderChain) WriteHeader(header *types.Header) (status WriteStatus, err error) {
+	return hc.writeHeader(header, false)
+}
+
+// writeHeader implements WriteHeader. If canonicalDisallowed is set, the header
+// is written as a side chain header regardless of its total difficulty.
+func (hc *HeaderChain) writeHeader(header *types.Header, canonicalDisallowed bool) (status WriteStatus, err error) {
 	// Cache some values to prevent constant recalculation
 	var (
 		hash   = header.Hash()
@@ -174,7 +181,7 @@ func (hc *HeaderChain) WriteHeader(header *types.Header) (status WriteStatus, er
 			reorg = mrand.Float64() < 0.5
 		}
 	}
-	if reorg {
+	if reorg && !canonicalDisallowed {
 		// If the header can be added into canonical chain, adjust the
 		// header chain markers(canonical indexes and head header flag).
 		//
@@ -591,7 +598,14 @@ func (hc *HeaderChain) SetGenesis(head *types.Header) {
 }
 
 // Config retrieves the header chain's chain configuration.
-func (hc *HeaderChain) Config() ctypes.ChainConfigurator { return hc.config }
+func (hc *HeaderChain) Config() ctypes.ChainConfigurator {
+	return hc.config.Load().(chainConfigHolder).ChainConfigurator
+}
+
+// setConfig replaces the header chain's chain configuration.
+func (hc *HeaderChain) setConfig(config ctypes.ChainConfigurator) {
+	hc.config.Store(chainConfigHolder{config})
+}
 
 // Engine retrieves the header chain's consensus engine.
 func (hc *HeaderChain) Engine() consensus.Engine { return hc.engine }
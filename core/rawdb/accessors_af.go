@@ -0,0 +1,62 @@
+package rawdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// ArtificialFinalityDecision is the record of an artificial finality (ECBP1100-MESS)
+// evaluation of a proposed chain segment against the local one.
+type ArtificialFinalityDecision struct {
+	Time           uint64      `json:"time"`           // Unix time of the decision, by the blockchain's clock
+	Ancestor       common.Hash `json:"ancestor"`       // Common ancestor of the segments
+	AncestorNumber uint64      `json:"ancestorNumber"` // Number of the common ancestor
+	Proposed       common.Hash `json:"proposed"`       // Head of the proposed segment
+	Current        common.Hash `json:"current"`        // Head of the local segment, zero in decisions of older versions
+	SegmentLength  uint64      `json:"segmentLength"`  // Number of blocks of the proposed segment above the ancestor
+	Ratio          float64     `json:"ratio"`          // Total difficulty ratio of the proposed over the local segment
+	Threshold      float64     `json:"threshold"`      // Ratio required for the proposed segment to be accepted
+	Accepted       bool        `json:"accepted"`       // Whether the proposed segment was accepted
+}
+
+// ReadArtificialFinalityDecisions retrieves the artificial finality decisions made
+// between the given unix times (both inclusive), ordered by time.
+func ReadArtificialFinalityDecisions(db ethdb.Iteratee, from, to uint64) []*ArtificialFinalityDecision {
+	it := db.NewIterator(artificialFinalityDecisionPrefix, encodeBlockNumber(from))
+	defer it.Release()
+
+	var decisions []*ArtificialFinalityDecision
+	for it.Next() {
+		key := it.Key()
+		if len(key) != len(artificialFinalityDecisionPrefix)+8+common.HashLength || !bytes.HasPrefix(key, artificialFinalityDecisionPrefix) {
+			continue
+		}
+		if binary.BigEndian.Uint64(key[len(artificialFinalityDecisionPrefix):]) > to {
+			break
+		}
+		decision := new(ArtificialFinalityDecision)
+		if err := json.Unmarshal(it.Value(), decision); err != nil {
+			log.Error("Invalid artificial finality decision JSON", "key", key, "err", err)
+			continue
+		}
+		decisions = append(decisions, decision)
+	}
+	return decisions
+}
+
+// WriteArtificialFinalityDecision stores an artificial finality decision. Decisions
+// about the same proposed block at the same time replace each other.
+func WriteArtificialFinalityDecision(db ethdb.KeyValueWriter, decision *ArtificialFinalityDecision) {
+	data, err := json.Marshal(decision)
+	if err != nil {
+		log.Crit("Failed to JSON encode artificial finality decision", "err", err)
+	}
+	if err := db.Put(artificialFinalityDecisionKey(decision.Time, decision.Proposed), data); err != nil {
+		log.Crit("Failed to store artificial finality decision", "err", err)
+	}
+}
@@ -423,8 +423,20 @@ func HasBody(db ethdb.Reader, hash common.Hash, number uint64) bool {
 	return true
 }
 
-// ReadBody retrieves the block body corresponding to the hash.
+// ReadBody retrieves the block body corresponding to the hash. Bodies whose uncles
+// were pruned from the ancient store are incomplete, nil is returned for them, see
+// UnclesPruned.
 func ReadBody(db ethdb.Reader, hash common.Hash, number uint64) *types.Body {
+	body := readBody(db, hash, number)
+	if body == nil || unclesPruned(db, hash, number, body) {
+		return nil
+	}
+	return body
+}
+
+// readBody retrieves the block body corresponding to the hash, without its uncles
+// if they were pruned from the ancient store.
+func readBody(db ethdb.Reader, hash common.Hash, number uint64) *types.Body {
 	data := ReadBodyRLP(db, hash, number)
 	if len(data) == 0 {
 		return nil
@@ -594,7 +606,7 @@ func ReadReceipts(db ethdb.Reader, hash common.Hash, number uint64, config ctype
 	if receipts == nil {
 		return nil
 	}
-	body := ReadBody(db, hash, number)
+	body := readBody(db, hash, number)
 	if body == nil {
 		log.Error("Missing body but have receipt", "hash", hash, "number", number)
 		return nil
@@ -634,6 +646,9 @@ func DeleteReceipts(db ethdb.KeyValueWriter, hash common.Hash, number uint64) {
 // back from the stored header and body. If either the header or body could not
 // be retrieved nil is returned.
 //
+// Both the ancient store (local or remote) and the key-value store are consulted,
+// so callers need not know whether the block has already been frozen.
+//
 // Note, due to concurrent download of header and block body the header and thus
 // canonical hash can be stored in the database but the body data not (yet).
 func ReadBlock(db ethdb.Reader, hash common.Hash, number uint64) *types.Block {
@@ -665,6 +680,9 @@ func WriteAncientBlock(db ethdb.AncientWriter, block *types.Block, receipts type
 	if err != nil {
 		log.Crit("Failed to RLP encode body", "err", err)
 	}
+	if kv, ok := db.(ethdb.KeyValueReader); ok {
+		bodyBlob = ancientBody(kv, block.NumberU64(), bodyBlob)
+	}
 	storageReceipts := make([]*types.ReceiptForStorage, len(receipts))
 	for i, receipt := range receipts {
 		storageReceipts[i] = (*types.ReceiptForStorage)(receipt)
@@ -0,0 +1,50 @@
+package rawdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// FrozenRange is the record of a contiguous range of blocks moved from the key-value
+// store into the ancient store, as announced by a FreezeEvent.
+type FrozenRange struct {
+	First uint64    // Number of the first frozen block
+	Last  uint64    // Number of the last frozen block (inclusive)
+	Time  time.Time // Wall-clock time the range was frozen at
+}
+
+// FrozenRangesBetween retrieves the ranges of blocks frozen between the given times
+// (both inclusive), ordered by time.
+func FrozenRangesBetween(db ethdb.Iteratee, t0, t1 time.Time) []FrozenRange {
+	it := db.NewIterator(frozenRangePrefix, encodeBlockNumber(uint64(t0.UnixNano())))
+	defer it.Release()
+
+	var ranges []FrozenRange
+	for it.Next() {
+		key := it.Key()
+		if len(key) != len(frozenRangePrefix)+16 || !bytes.HasPrefix(key, frozenRangePrefix) || len(it.Value()) != 8 {
+			continue
+		}
+		nanos := binary.BigEndian.Uint64(key[len(frozenRangePrefix):])
+		if nanos > uint64(t1.UnixNano()) {
+			break
+		}
+		ranges = append(ranges, FrozenRange{
+			First: binary.BigEndian.Uint64(key[len(frozenRangePrefix)+8:]),
+			Last:  binary.BigEndian.Uint64(it.Value()),
+			Time:  time.Unix(0, int64(nanos)),
+		})
+	}
+	return ranges
+}
+
+// WriteFrozenRange stores the record of a range of blocks frozen at the given time.
+func WriteFrozenRange(db ethdb.KeyValueWriter, first, last uint64, frozen time.Time) {
+	if err := db.Put(frozenRangeKey(uint64(frozen.UnixNano()), first), encodeBlockNumber(last)); err != nil {
+		log.Crit("Failed to store frozen range", "err", err)
+	}
+}
@@ -18,6 +18,7 @@ package rawdb
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"os"
@@ -29,6 +30,7 @@ import (
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/ethdb/leveldb"
 	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/olekukonko/tablewriter"
 )
@@ -71,6 +73,181 @@ func (frdb *freezerdb) Freeze(threshold uint64) {
 	<-trigger
 }
 
+// FreezeUpTo moves the canonical blocks below number, which are at least the freezing
+// threshold below the head block, from the key-value store into the ancient store,
+// returning once the ancient store synced them. Blocks above the threshold are left in
+// the key-value store, so Ancients() may remain below number. Only remote freezers
+// are supported.
+func (frdb *freezerdb) FreezeUpTo(number uint64) error {
+	_, err := frdb.FreezeUpToContext(context.Background(), number)
+	return err
+}
+
+// FreezeUpToContext is like FreezeUpTo, but stops freezing once ctx is cancelled. The
+// blocks appended to the ancient store by then are synced and removed from the key-value
+// store before returning ctx.Err(), leaving both consistent. It returns the number of
+// ancients reached, all of which are durable.
+func (frdb *freezerdb) FreezeUpToContext(ctx context.Context, number uint64) (uint64, error) {
+	if f, ok := frdb.AncientStore.(interface {
+		freezeUpTo(ctx context.Context, db ethdb.KeyValueStore, number uint64) (uint64, error)
+	}); ok {
+		return f.freezeUpTo(ctx, frdb.KeyValueStore, number)
+	}
+	return 0, errNotSupported
+}
+
+// SubscribeFreezeEvent registers a subscription of FreezeEvent, posted by the
+// background freezer loop whenever a range of blocks was frozen.
+func (frdb *freezerdb) SubscribeFreezeEvent(ch chan<- FreezeEvent) event.Subscription {
+	if f, ok := frdb.AncientStore.(interface {
+		SubscribeFreezeEvent(ch chan<- FreezeEvent) event.Subscription
+	}); ok {
+		return f.SubscribeFreezeEvent(ch)
+	}
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		<-quit
+		return nil
+	})
+}
+
+// Warmup preloads the most recent given number of frozen blocks into the read
+// cache of the ancient store, if it has one (ie. it is a remote freezer).
+func (frdb *freezerdb) Warmup(blocks uint64) error {
+	if f, ok := frdb.AncientStore.(interface {
+		Warmup(blocks uint64) error
+	}); ok {
+		return f.Warmup(blocks)
+	}
+	return nil
+}
+
+// SetReadAhead enables prefetching the given window of items following sequential
+// reads of the ancient store, if it supports it (ie. it is a remote freezer).
+func (frdb *freezerdb) SetReadAhead(window int) {
+	if f, ok := frdb.AncientStore.(interface{ SetReadAhead(window int) }); ok {
+		f.SetReadAhead(window)
+	}
+}
+
+// SetStaleReadRetry makes reads of items not yet replicated retry on the read replicas,
+// if the ancient store supports it (ie. it is a remote freezer), see
+// FreezerRemoteClient.SetStaleReadRetry.
+func (frdb *freezerdb) SetStaleReadRetry(retries int, backoff time.Duration) {
+	if f, ok := frdb.AncientStore.(interface {
+		SetStaleReadRetry(retries int, backoff time.Duration)
+	}); ok {
+		f.SetStaleReadRetry(retries, backoff)
+	}
+}
+
+// SetWriteBatch configures batching of appends to the ancient store, if it
+// supports it (ie. it is a remote freezer).
+func (frdb *freezerdb) SetWriteBatch(size int, interval time.Duration) error {
+	if f, ok := frdb.AncientStore.(interface {
+		SetWriteBatch(size int, interval time.Duration) error
+	}); ok {
+		return f.SetWriteBatch(size, interval)
+	}
+	return nil
+}
+
+// SetDiskGuard pauses freezing batches, and the imports of blocks waiting on it (see
+// WaitDiskSpace), while the free space reported by reporter is below threshold, if
+// the ancient store supports it (ie. it is a builtin or remote freezer). A nil reporter checks the storage of the ancient store itself, the file
+// system of the builtin freezer, or the space reported by the remote server.
+func (frdb *freezerdb) SetDiskGuard(threshold uint64, reporter DiskSpaceReporter) error {
+	if f, ok := frdb.AncientStore.(interface {
+		SetDiskGuard(threshold uint64, reporter DiskSpaceReporter)
+	}); ok {
+		f.SetDiskGuard(threshold, reporter)
+		return nil
+	}
+	return errNotSupported
+}
+
+// FreezerInfo returns the server info of the ancient store if it is a remote
+// freezer which reported it, or nil otherwise.
+func (frdb *freezerdb) FreezerInfo() *FreezerRemoteInfo {
+	if f, ok := frdb.AncientStore.(interface {
+		FreezerInfo() *FreezerRemoteInfo
+	}); ok {
+		return f.FreezerInfo()
+	}
+	return nil
+}
+
+// AncientContext retrieves an ancient binary blob, aborting the retrieval once
+// ctx is done if the ancient store supports it (ie. it is a remote freezer).
+func (frdb *freezerdb) AncientContext(ctx context.Context, kind string, number uint64) ([]byte, error) {
+	if f, ok := frdb.AncientStore.(ancientContextReader); ok {
+		return f.AncientContext(ctx, kind, number)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return frdb.AncientStore.Ancient(kind, number)
+}
+
+// AncientTail returns the number of the first item retained by the ancient store,
+// if it discards old items (ie. a pruning remote freezer), and 0 otherwise.
+func (frdb *freezerdb) AncientTail() (uint64, error) {
+	if f, ok := frdb.AncientStore.(ancientTailReader); ok {
+		return f.AncientTail()
+	}
+	return 0, nil
+}
+
+// ancientTailReader is implemented by ancient stores discarding old items.
+type ancientTailReader interface {
+	AncientTail() (uint64, error)
+}
+
+// AncientRange retrieves count ancient binary blobs of the kind from start, in a
+// single request if the ancient store supports it (ie. it is a remote freezer).
+func (frdb *freezerdb) AncientRange(kind string, start, count uint64) ([][]byte, error) {
+	if f, ok := frdb.AncientStore.(ancientRangeReader); ok {
+		return f.AncientRange(kind, start, count)
+	}
+	items := make([][]byte, count)
+	for i := range items {
+		blob, err := frdb.AncientStore.Ancient(kind, start+uint64(i))
+		if err != nil {
+			return nil, err
+		}
+		items[i] = blob
+	}
+	return items, nil
+}
+
+// ancientContextReader is implemented by ancient stores whose reads can be aborted.
+type ancientContextReader interface {
+	AncientContext(ctx context.Context, kind string, number uint64) ([]byte, error)
+}
+
+// contextReader is a database reader binding all ancient reads to a context.
+type contextReader struct {
+	ethdb.Reader
+	ctx context.Context
+}
+
+// ReaderWithContext wraps db so that its ancient reads are bound to ctx. Reads of
+// an ancient store supporting it, like a remote freezer, are aborted once ctx is
+// done, no ancient read is started after that at all.
+func ReaderWithContext(ctx context.Context, db ethdb.Reader) ethdb.Reader {
+	return &contextReader{Reader: db, ctx: ctx}
+}
+
+// Ancient retrieves an ancient binary blob, bound to the reader's context.
+func (r *contextReader) Ancient(kind string, number uint64) ([]byte, error) {
+	if f, ok := r.Reader.(ancientContextReader); ok {
+		return f.AncientContext(r.ctx, kind, number)
+	}
+	if err := r.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.Reader.Ancient(kind, number)
+}
+
 // nofreezedb is a database wrapper that disables freezer data retrievals.
 type nofreezedb struct {
 	ethdb.KeyValueStore
@@ -91,6 +268,11 @@ func (db *nofreezedb) Ancients() (uint64, error) {
 	return 0, errNotSupported
 }
 
+// AncientKinds returns an error as we don't have a backing chain freezer.
+func (db *nofreezedb) AncientKinds() (map[string]uint64, error) {
+	return nil, errNotSupported
+}
+
 // AncientSize returns an error as we don't have a backing chain freezer.
 func (db *nofreezedb) AncientSize(kind string) (uint64, error) {
 	return 0, errNotSupported
@@ -111,6 +293,13 @@ func (db *nofreezedb) Sync() error {
 	return errNotSupported
 }
 
+// HasAncientStore reports whether the database is backed by an ancient store, ie.
+// whether its ancient item count is available.
+func HasAncientStore(db ethdb.AncientReader) bool {
+	_, err := db.Ancients()
+	return err != errNotSupported
+}
+
 // NewDatabase creates a high level database on top of a given key-value data
 // store without a freezer moving immutable chain segments into cold storage.
 func NewDatabase(db ethdb.KeyValueStore) ethdb.Database {
@@ -119,18 +308,66 @@ func NewDatabase(db ethdb.KeyValueStore) ethdb.Database {
 	}
 }
 
+// FreezerRemoteOptions configures the client of a remote freezer. The options are
+// applied before the database is validated against the freezer and the freezing
+// loop starts, so they are in effect for every item read or written.
+type FreezerRemoteOptions struct {
+	Serializer FreezerSerializer // Serialization of the stored payloads, nil for the RLP passthrough
+	ReadAhead  int               // Window of items prefetched following sequential reads, 0 to disable, see SetReadAhead
+}
+
 // NewDatabaseWithFreezerRemote creates a high level database on top of a given key-
 // value data store with a freezer moving immutable chain segments into cold
-// storage.
-func NewDatabaseWithFreezerRemote(db ethdb.KeyValueStore, freezerURL string) (ethdb.Database, error) {
+// storage. Ancient items are read from the read replicas of the remote freezer,
+// if any are given, see NewFreezerRemoteClientWithReplicas.
+func NewDatabaseWithFreezerRemote(db ethdb.KeyValueStore, freezerURL string, readReplicas ...string) (ethdb.Database, error) {
+	return newDatabaseWithFreezerRemote(db, freezerURL, readReplicas, FreezerRemoteOptions{}, "", "", nil)
+}
+
+// NewDatabaseWithFreezerRemoteOptions creates a high level database on top of a given
+// key-value data store with a freezer moving immutable chain segments into cold
+// storage, whose client is configured by the given options.
+func NewDatabaseWithFreezerRemoteOptions(db ethdb.KeyValueStore, freezerURL string, opts FreezerRemoteOptions, readReplicas ...string) (ethdb.Database, error) {
+	return newDatabaseWithFreezerRemote(db, freezerURL, readReplicas, opts, "", "", nil)
+}
+
+// NewDatabaseWithFreezerRemoteKinds creates a high level database on top of a given
+// key-value data store with a freezer moving immutable chain segments into cold
+// storage, storing only the given kinds in the remote freezer. The other kinds are
+// stored in a local freezer in the given directory, and reads are served from the
+// freezer storing the kind. A nil remoteKinds stores all kinds remotely.
+func NewDatabaseWithFreezerRemoteKinds(db ethdb.KeyValueStore, freezerURL string, freezer string, namespace string, remoteKinds []string) (ethdb.Database, error) {
+	return newDatabaseWithFreezerRemote(db, freezerURL, nil, FreezerRemoteOptions{}, freezer, namespace, remoteKinds)
+}
+
+func newDatabaseWithFreezerRemote(db ethdb.KeyValueStore, freezerURL string, readReplicas []string, opts FreezerRemoteOptions, freezer string, namespace string, remoteKinds []string) (ethdb.Database, error) {
 	// Create the idle freezer instance
-	log.Info("New remote freezer", "freezer", freezerURL)
+	log.Info("New remote freezer", "freezer", freezerURL, "replicas", readReplicas, "kinds", remoteKinds)
 
-	frdb, err := newFreezerRemoteClient(freezerURL)
+	remote, err := NewFreezerRemoteClientWithReplicas(freezerURL, readReplicas)
 	if err != nil {
 		log.Error("NewDatabaseWithFreezerRemote error", "error", err)
 		return nil, err
 	}
+	if err := remote.SetSerializer(opts.Serializer); err != nil {
+		remote.Close()
+		return nil, err
+	}
+	if opts.ReadAhead > 0 {
+		remote.SetReadAhead(opts.ReadAhead)
+	}
+	var frdb interface {
+		ethdb.AncientStore
+		State() (*FreezerRemoteState, error)
+	} = remote
+	if remoteKinds != nil {
+		split, err := newFreezerSplit(remote, freezer, namespace, remoteKinds)
+		if err != nil {
+			remote.Close()
+			return nil, err
+		}
+		frdb = split
+	}
 	// Core-Geth: The validation below is the original and contemporary upstream
 	// ethereum/go-ethereum implementation of validations in NewDatabaseWithFreezer. Core-Geth's
 	// implementation of the "standard" (built-in FS) freezer initialization has been
@@ -159,8 +396,21 @@ func NewDatabaseWithFreezerRemote(db ethdb.KeyValueStore, freezerURL string) (et
 	//     upgrading to the freezer release, or we might have had a small chain and
 	//     not frozen anything yet. Ensure that no blocks are missing yet from the
 	//     key-value store, since that would mean we already had an old freezer.
+	//
+	// Core-Geth: The freezer's counts are fetched in a single round-trip, and are
+	// required to be consistent across all kinds.
+	state, err := frdb.State()
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve remote freezer state: %v", err)
+	}
+	log.Info("Remote freezer state", "ancients", state.Ancients, "tail", state.Tail)
+	for _, kind := range freezerKinds {
+		if n, ok := state.Kinds[kind]; ok && n != state.Ancients {
+			return nil, fmt.Errorf("remote freezer inconsistent: %d %s, %d ancients", n, kind, state.Ancients)
+		}
+	}
 	if kvgenesis, _ := db.Get(headerHashKey(0)); len(kvgenesis) > 0 {
-		if frozen, _ := frdb.Ancients(); frozen > 0 {
+		if frozen := state.Ancients; frozen > 0 {
 			// If the freezer already contains something, ensure that the genesis blocks
 			// match, otherwise we might mix up freezers across chains and destroy both
 			// the freezer and the key-value store.
@@ -180,6 +430,14 @@ func NewDatabaseWithFreezerRemote(db ethdb.KeyValueStore, freezerURL string) (et
 				}
 				// Database contains only older data than the freezer, this happens if the
 				// state was wiped and reinited from an existing freezer.
+				//
+				// Core-Geth: or if another writer advanced the remote freezer beyond the
+				// head of the key-value store, see FreezerRemoteAheadPolicy.
+				if freezerRemoteAhead(db, frozen) {
+					if err := reconcileFreezerRemoteAhead(db, frdb, frozen); err != nil {
+						return nil, err
+					}
+				}
 			}
 			// Otherwise, key-value store continues where the freezer left off, all is fine.
 			// We might have duplicate blocks (crash after freezer write but before key-value
@@ -203,7 +461,13 @@ Please set --ancient.rpc to the correct path, and/or review the remote freezer's
 		}
 	}
 	// Freezer is consistent with the key-value database, permit combining the two
-	go freezeRemote(db, frdb, frdb.threshold, frdb.quit, frdb.trigger)
+	if remote.ReadOnly() {
+		log.Warn("Remote freezer is read-only, not freezing ancient blocks")
+	} else if split, ok := frdb.(*freezerSplit); ok {
+		go freezeRemote(db, split, split.local.threshold, &split.freezeMu, split.local.quit, split.local.trigger, &split.local.freezeFeed)
+	} else {
+		go freezeRemote(db, remote, remote.threshold, &remote.freezeMu, remote.quit, remote.trigger, &remote.freezeFeed)
+	}
 
 	return &freezerdb{
 		KeyValueStore: db,
@@ -305,12 +569,12 @@ func NewLevelDBDatabase(file string, cache int, handles int, namespace string) (
 
 // NewLevelDBDatabaseWithFreezer creates a persistent key-value database with a
 // freezer moving immutable chain segments into cold storage.
-func NewLevelDBDatabaseWithFreezerRemote(file string, cache int, handles int, freezerURL string) (ethdb.Database, error) {
+func NewLevelDBDatabaseWithFreezerRemote(file string, cache int, handles int, freezerURL string, opts FreezerRemoteOptions, readReplicas ...string) (ethdb.Database, error) {
 	kvdb, err := leveldb.New(file, cache, handles, "eth/db/chaindata")
 	if err != nil {
 		return nil, err
 	}
-	frdb, err := NewDatabaseWithFreezerRemote(kvdb, freezerURL)
+	frdb, err := NewDatabaseWithFreezerRemoteOptions(kvdb, freezerURL, opts, readReplicas...)
 	if err != nil {
 		kvdb.Close()
 		return nil, err
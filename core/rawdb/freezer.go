@@ -28,6 +28,7 @@ import (
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/params/vars"
@@ -78,10 +79,29 @@ type freezer struct {
 
 	trigger chan chan struct{} // Manual blocking freeze trigger, test determinism
 
+	freezeFeed event.Feed // Feed announcing ranges moved from the key-value store into the freezer
+
+	datadir string           // Directory of the data tables
+	guard   freezerDiskGuard // Pauses freezing while the free disk space is low
+	logs    freezerLogIndex  // Optional index of the log positions within the frozen receipts
+
 	quit      chan struct{}
 	closeOnce sync.Once
 }
 
+// FreezeEvent is posted when a contiguous range of blocks has been moved from
+// the key-value store into the ancient store, once the ancient store has been synced
+// and the frozen blocks have been deleted from the key-value store.
+type FreezeEvent struct {
+	First uint64 // Number of the first frozen block
+	Last  uint64 // Number of the last frozen block (inclusive)
+}
+
+// SubscribeFreezeEvent registers a subscription of FreezeEvent.
+func (f *freezer) SubscribeFreezeEvent(ch chan<- FreezeEvent) event.Subscription {
+	return f.freezeFeed.Subscribe(ch)
+}
+
 // newFreezer creates a chain freezer that moves ancient chain data into
 // append-only flat file containers.
 func newFreezer(datadir string, namespace string) (*freezer, error) {
@@ -110,6 +130,7 @@ func newFreezer(datadir string, namespace string) (*freezer, error) {
 		tables:       make(map[string]*freezerTable),
 		instanceLock: lock,
 		trigger:      make(chan chan struct{}),
+		datadir:      datadir,
 		quit:         make(chan struct{}),
 	}
 	for name, disableSnappy := range freezerNoSnappy {
@@ -144,6 +165,11 @@ func (f *freezer) Close() error {
 				errs = append(errs, err)
 			}
 		}
+		if table := f.logIndexTable(); table != nil {
+			if err := table.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
 		if err := f.instanceLock.Release(); err != nil {
 			errs = append(errs, err)
 		}
@@ -157,6 +183,10 @@ func (f *freezer) Close() error {
 // HasAncient returns an indicator whether the specified ancient data exists
 // in the freezer.
 func (f *freezer) HasAncient(kind string, number uint64) (bool, error) {
+	if kind == freezerLogIndexTable {
+		_, err := f.logIndex(number)
+		return err == nil, nil
+	}
 	if table := f.tables[kind]; table != nil {
 		return table.has(number), nil
 	}
@@ -165,6 +195,9 @@ func (f *freezer) HasAncient(kind string, number uint64) (bool, error) {
 
 // Ancient retrieves an ancient binary blob from the append-only immutable files.
 func (f *freezer) Ancient(kind string, number uint64) ([]byte, error) {
+	if kind == freezerLogIndexTable {
+		return f.logIndex(number)
+	}
 	if table := f.tables[kind]; table != nil {
 		return table.Retrieve(number)
 	}
@@ -176,6 +209,15 @@ func (f *freezer) Ancients() (uint64, error) {
 	return atomic.LoadUint64(&f.frozen), nil
 }
 
+// AncientKinds returns the freezer tables and the number of items in each.
+func (f *freezer) AncientKinds() (map[string]uint64, error) {
+	kinds := make(map[string]uint64, len(f.tables))
+	for kind, table := range f.tables {
+		kinds[kind] = atomic.LoadUint64(&table.items)
+	}
+	return kinds, nil
+}
+
 // AncientSize returns the ancient size of the specified category.
 func (f *freezer) AncientSize(kind string) (uint64, error) {
 	if table := f.tables[kind]; table != nil {
@@ -206,7 +248,12 @@ func (f *freezer) AppendAncient(number uint64, hash, header, body, receipts, td
 			log.Info("Append ancient failed", "number", number, "err", err)
 		}
 	}()
-	// Inject all the components into the relevant data tables
+	// Inject all the components into the relevant data tables, the log index first
+	// as repairing aligns it to the others
+	if err := f.appendLogIndex(f.frozen, hash, receipts); err != nil {
+		log.Error("Failed to append ancient log index", "number", f.frozen, "hash", hash, "err", err)
+		return err
+	}
 	if err := f.tables[freezerHashTable].Append(f.frozen, hash[:]); err != nil {
 		log.Error("Failed to append ancient hash", "number", f.frozen, "hash", hash, "err", err)
 		return err
@@ -241,6 +288,9 @@ func (f *freezer) TruncateAncients(items uint64) error {
 			return err
 		}
 	}
+	if err := f.truncateLogIndex(items); err != nil {
+		return err
+	}
 	atomic.StoreUint64(&f.frozen, items)
 	return nil
 }
@@ -253,6 +303,11 @@ func (f *freezer) Sync() error {
 			errs = append(errs, err)
 		}
 	}
+	if table := f.logIndexTable(); table != nil {
+		if err := table.Sync(); err != nil {
+			errs = append(errs, err)
+		}
+	}
 	if errs != nil {
 		return fmt.Errorf("%v", errs)
 	}
@@ -326,6 +381,9 @@ func (f *freezer) freeze(db ethdb.KeyValueStore) {
 			backoff = true
 			continue
 		}
+		if !f.guard.wait(f.quit, "freezing") {
+			return
+		}
 		// Seems we have data ready to be frozen, process in usable batches
 		limit := *number - threshold
 		if limit-f.frozen > freezerBatchLimit {
@@ -353,6 +411,7 @@ func (f *freezer) freeze(db ethdb.KeyValueStore) {
 				log.Error("Block body missing, can't freeze", "number", f.frozen, "hash", hash)
 				break
 			}
+			body = ancientBody(nfdb, f.frozen, body)
 			receipts := ReadReceiptsRLP(nfdb, hash, f.frozen)
 			if len(receipts) == 0 {
 				log.Error("Block receipts missing, can't freeze", "number", f.frozen, "hash", hash)
@@ -447,6 +506,11 @@ func (f *freezer) freeze(db ethdb.KeyValueStore) {
 		}
 		log.Info("Deep froze chain segment", context...)
 
+		if n := len(ancients); n > 0 {
+			WriteFrozenRange(db, first, first+uint64(n)-1, time.Now())
+			f.freezeFeed.Send(FreezeEvent{First: first, Last: first + uint64(n) - 1})
+		}
+
 		// Avoid database thrashing with tiny writes
 		if f.frozen-first < freezerBatchLimit {
 			backoff = true
@@ -468,6 +532,9 @@ func (f *freezer) repair() error {
 			return err
 		}
 	}
+	if err := f.truncateLogIndex(min); err != nil {
+		return err
+	}
 	atomic.StoreUint64(&f.frozen, min)
 	return nil
 }
@@ -0,0 +1,102 @@
+package rawdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc64"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// freezerChecksumTable is the polynomial table of the ancient item checksums.
+var freezerChecksumTable = crc64.MakeTable(crc64.ECMA)
+
+// FreezerChecksums are rolling checksums of the first Items ancient items of every kind.
+type FreezerChecksums struct {
+	Items uint64            `json:"items"` // Number of items covered
+	Kinds map[string]uint64 `json:"kinds"` // CRC-64 of the concatenated items, by kind
+}
+
+// FreezerChecksumReport is the result of CheckFreezerChecksums.
+type FreezerChecksumReport struct {
+	Checksums *FreezerChecksums // Checksums over all the current items
+	Baseline  *FreezerChecksums // Previously recorded checksums, nil if there were none
+	Drifted   []string          // Kinds whose items covered by the baseline changed since
+}
+
+// ReadFreezerChecksums retrieves the ancient item checksums recorded by the last
+// freezer check, nil if there are none.
+func ReadFreezerChecksums(db ethdb.KeyValueReader) *FreezerChecksums {
+	data, _ := db.Get(freezerChecksumsKey)
+	if len(data) == 0 {
+		return nil
+	}
+	sums := new(FreezerChecksums)
+	if err := json.Unmarshal(data, sums); err != nil {
+		log.Error("Invalid freezer checksums JSON", "err", err)
+		return nil
+	}
+	return sums
+}
+
+// WriteFreezerChecksums stores the ancient item checksums of a freezer check.
+func WriteFreezerChecksums(db ethdb.KeyValueWriter, sums *FreezerChecksums) {
+	data, err := json.Marshal(sums)
+	if err != nil {
+		log.Crit("Failed to JSON encode freezer checksums", "err", err)
+	}
+	if err := db.Put(freezerChecksumsKey, data); err != nil {
+		log.Crit("Failed to store freezer checksums", "err", err)
+	}
+}
+
+// CheckFreezerChecksums reads every ancient item of every kind and computes rolling
+// checksums over them, to detect bit-rot of the ancient store, eg. a remote freezer,
+// when run periodically. The checksums over the items covered by the previously
+// recorded ones are compared against them, and the kinds differing are reported as
+// drifted. If none drifted, the new checksums are recorded as the baseline of the
+// next check; otherwise the baseline is kept, so that the drift keeps being reported.
+//
+// If the ancient store was truncated below the recorded items, eg. by a rewind of
+// the chain, the baseline is discarded without comparison.
+func CheckFreezerChecksums(db ethdb.Database) (*FreezerChecksumReport, error) {
+	frozen, err := db.Ancients()
+	if err != nil {
+		return nil, err
+	}
+	report := &FreezerChecksumReport{
+		Checksums: &FreezerChecksums{Items: frozen, Kinds: make(map[string]uint64, len(freezerKinds))},
+		Baseline:  ReadFreezerChecksums(db),
+	}
+	if report.Baseline != nil && report.Baseline.Items > frozen {
+		log.Warn("Freezer truncated below checksum baseline, discarding it", "baseline", report.Baseline.Items, "ancients", frozen)
+		report.Baseline = nil
+	}
+	var covered uint64
+	if report.Baseline != nil {
+		covered = report.Baseline.Items
+	}
+	for _, kind := range freezerKinds {
+		var sum uint64
+		for number := uint64(0); number < frozen; number++ {
+			blob, err := db.Ancient(kind, number)
+			if err != nil {
+				return nil, fmt.Errorf("ancient %s #%d: %v", kind, number, err)
+			}
+			sum = crc64.Update(sum, freezerChecksumTable, blob)
+
+			if number+1 == covered {
+				if want, ok := report.Baseline.Kinds[kind]; ok && sum != want {
+					log.Warn("Freezer checksum drifted", "kind", kind, "items", covered, "have", sum, "want", want)
+					report.Drifted = append(report.Drifted, kind)
+				}
+			}
+		}
+		report.Checksums.Kinds[kind] = sum
+	}
+	if len(report.Drifted) == 0 {
+		WriteFreezerChecksums(db, report.Checksums)
+	}
+	return report, nil
+}
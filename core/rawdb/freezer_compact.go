@@ -0,0 +1,55 @@
+package rawdb
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// ReadAncientCompacted retrieves the number of ancients the key-value store was last
+// compacted up to by CompactRecentRange, 0 if it never was.
+func ReadAncientCompacted(db ethdb.KeyValueReader) uint64 {
+	data, _ := db.Get(ancientCompactedKey)
+	if len(data) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(data)
+}
+
+// WriteAncientCompacted stores the number of ancients the key-value store was
+// compacted up to.
+func WriteAncientCompacted(db ethdb.KeyValueWriter, number uint64) {
+	if err := db.Put(ancientCompactedKey, encodeBlockNumber(number)); err != nil {
+		log.Crit("Failed to store ancient compaction progress", "err", err)
+	}
+}
+
+// CompactRecentRange compacts the key ranges of the key-value store vacated by the
+// blocks frozen since the last call, discarding the deletion markers freezing left
+// behind, eg. after a large migration with FreezeUpTo. The headers, bodies, receipts
+// and canonical hashes are compacted, which are keyed by block number; the scattered
+// hash to number mappings are not. It returns the range of blocks compacted, from
+// and up to to (exclusive), empty if no blocks were frozen since.
+func CompactRecentRange(db ethdb.Database) (from uint64, to uint64, err error) {
+	if to, err = db.Ancients(); err != nil {
+		return 0, 0, err
+	}
+	from = ReadAncientCompacted(db)
+	if from >= to {
+		return from, from, nil
+	}
+	start := time.Now()
+	for _, prefix := range [][]byte{headerPrefix, blockBodyPrefix, blockReceiptsPrefix} {
+		startKey := append(append([]byte{}, prefix...), encodeBlockNumber(from)...)
+		limitKey := append(append([]byte{}, prefix...), encodeBlockNumber(to)...)
+		if err := db.Compact(startKey, limitKey); err != nil {
+			return from, from, err
+		}
+	}
+	WriteAncientCompacted(db, to)
+	log.Info("Compacted key-value store after freezing", "from", from, "to", to, "elapsed", common.PrettyDuration(time.Since(start)))
+	return from, to, nil
+}
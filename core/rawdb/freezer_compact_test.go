@@ -0,0 +1,99 @@
+package rawdb
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb/leveldb"
+)
+
+// dirSize returns the total size of the files in dir.
+func dirSize(t *testing.T, dir string) int64 {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return size
+}
+
+func TestCompactRecentRange(t *testing.T) {
+	const blocks = 256
+
+	kvdir, err := ioutil.TempDir("", "chaindata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(kvdir)
+	frdir, err := ioutil.TempDir("", "freezer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(frdir)
+
+	kvdb, err := leveldb.New(kvdir, 16, 16, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDatabaseWithFreezer(kvdb, frdir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Nothing frozen, nothing to compact
+	if from, to, err := CompactRecentRange(db); err != nil || from != 0 || to != 0 {
+		t.Fatalf("empty compaction: have #%d-#%d (err %v), want #0-#0", from, to, err)
+	}
+	// Write a chain of blocks of incompressible bodies, and settle it on disk
+	var parent common.Hash
+	for i := int64(0); i < blocks; i++ {
+		data := make([]byte, 16*1024)
+		rand.Read(data)
+		txs := []*types.Transaction{types.NewTransaction(uint64(i), common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(1), data)}
+		block := types.NewBlock(&types.Header{Number: big.NewInt(i), ParentHash: parent}, txs, nil, nil, newHasher())
+
+		WriteBlock(db, block)
+		WriteReceipts(db, block.Hash(), block.NumberU64(), nil)
+		WriteTd(db, block.Hash(), block.NumberU64(), big.NewInt(i+1))
+		WriteCanonicalHash(db, block.Hash(), block.NumberU64())
+		WriteHeadBlockHash(db, block.Hash())
+		parent = block.Hash()
+	}
+	if err := db.Compact(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	written := dirSize(t, kvdir)
+
+	db.(*freezerdb).Freeze(0)
+	if frozen, _ := db.Ancients(); frozen != blocks {
+		t.Fatalf("frozen blocks mismatch: have %d, want %d", frozen, blocks)
+	}
+	if from, to, err := CompactRecentRange(db); err != nil || from != 0 || to != blocks {
+		t.Fatalf("compaction after freezing: have #%d-#%d (err %v), want #0-#%d", from, to, err, blocks)
+	}
+	// Obsolete tables may be deleted in the background
+	compacted := dirSize(t, kvdir)
+	for deadline := time.Now().Add(5 * time.Second); compacted >= written/2 && time.Now().Before(deadline); compacted = dirSize(t, kvdir) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if compacted >= written/2 {
+		t.Errorf("key-value store not shrunk: %d bytes before freezing, %d after compaction", written, compacted)
+	}
+	// The compacted range is not compacted again
+	if from, to, err := CompactRecentRange(db); err != nil || from != blocks || to != blocks {
+		t.Fatalf("repeated compaction: have #%d-#%d (err %v), want #%d-#%d", from, to, err, blocks, blocks)
+	}
+}
@@ -0,0 +1,143 @@
+package rawdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/params/vars"
+)
+
+// Freezer is the minimal append-only store of immutable chain segments a database
+// can be combined with using NewDatabaseWithCustomFreezer, eg. an in-process fake
+// used by tests. Every item number holds a blob of each of the ancient kinds. If a
+// Freezer also implements io.Closer, it is closed along with the database.
+type Freezer interface {
+	// AppendAncient injects all binary blobs belong to block at the end of the
+	// append-only immutable table files.
+	AppendAncient(number uint64, hash, header, body, receipt, td []byte) error
+
+	// Ancient retrieves an ancient binary blob from the append-only immutable files.
+	Ancient(kind string, number uint64) ([]byte, error)
+
+	// TruncateAncients discards all but the first n ancient data from the ancient store.
+	TruncateAncients(n uint64) error
+
+	// Ancients returns the ancient item numbers in the ancient store.
+	Ancients() (uint64, error)
+
+	// Sync flushes all in-memory ancient store data to durable storage.
+	Sync() error
+}
+
+// freezerCustom adapts a Freezer to an ethdb.AncientStore, and carries the state
+// of its background freezing loop.
+type freezerCustom struct {
+	Freezer
+
+	threshold  uint64             // Number of recent blocks not to freeze (params.FullImmutabilityThreshold apart from tests)
+	quit       chan struct{}      // Terminates the freezing loop
+	trigger    chan chan struct{} // Manual blocking freeze trigger, test determinism
+	closeOnce  sync.Once
+	freezeFeed event.Feed // Feed announcing ranges moved from the key-value store into the freezer
+	freezeMu   sync.Mutex // Serializes freezing batches of the background loop and freezeUpTo
+}
+
+// HasAncient returns an indicator whether the specified ancient data exists
+// in the freezer.
+func (f *freezerCustom) HasAncient(kind string, number uint64) (bool, error) {
+	if _, ok := freezerNoSnappy[kind]; !ok {
+		return false, nil
+	}
+	frozen, err := f.Ancients()
+	return number < frozen, err
+}
+
+// AncientSize returns the ancient size of the specified category, which is not
+// known for custom freezers.
+func (f *freezerCustom) AncientSize(kind string) (uint64, error) {
+	return 0, errNotSupported
+}
+
+// AncientKinds returns the number of items of every kind, which is the number of
+// ancients for all of them.
+func (f *freezerCustom) AncientKinds() (map[string]uint64, error) {
+	frozen, err := f.Ancients()
+	if err != nil {
+		return nil, err
+	}
+	kinds := make(map[string]uint64, len(freezerKinds))
+	for _, kind := range freezerKinds {
+		kinds[kind] = frozen
+	}
+	return kinds, nil
+}
+
+// AncientTail returns the number of the first item retained by the freezer, if it
+// discards old items, and 0 otherwise.
+func (f *freezerCustom) AncientTail() (uint64, error) {
+	if tail, ok := f.Freezer.(ancientTailReader); ok {
+		return tail.AncientTail()
+	}
+	return 0, nil
+}
+
+// Close terminates the freezing loop, and closes the freezer if it supports it.
+func (f *freezerCustom) Close() error {
+	f.closeOnce.Do(func() { close(f.quit) })
+	if closer, ok := f.Freezer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// SubscribeFreezeEvent registers a subscription of FreezeEvent.
+func (f *freezerCustom) SubscribeFreezeEvent(ch chan<- FreezeEvent) event.Subscription {
+	return f.freezeFeed.Subscribe(ch)
+}
+
+// freezeUpTo moves the canonical blocks below number, which are at least the freezing
+// threshold below the head block, from the key-value store into the freezer, returning
+// once it synced them, or ctx is cancelled. It returns the number of ancients.
+func (f *freezerCustom) freezeUpTo(ctx context.Context, db ethdb.KeyValueStore, number uint64) (uint64, error) {
+	return freezeRemoteUpTo(ctx, db, f, f.threshold, number, &f.freezeMu, &f.freezeFeed)
+}
+
+// NewDatabaseWithCustomFreezer creates a high level database on top of a given
+// key-value data store with the given freezer moving immutable chain segments into
+// cold storage, the same way as a remote freezer does. It allows any Freezer
+// implementation to back the ancient store, such as fakes with controlled latency
+// or faults in tests.
+func NewDatabaseWithCustomFreezer(db ethdb.KeyValueStore, freezer Freezer) (ethdb.Database, error) {
+	frdb := &freezerCustom{
+		Freezer:   freezer,
+		threshold: vars.FullImmutabilityThreshold,
+		quit:      make(chan struct{}),
+		trigger:   make(chan chan struct{}),
+	}
+	// Refuse to combine a key-value store and a freezer of different chains.
+	if kvgenesis, _ := db.Get(headerHashKey(0)); len(kvgenesis) > 0 {
+		frozen, err := frdb.Ancients()
+		if err != nil {
+			return nil, err
+		}
+		if frozen > 0 {
+			frgenesis, err := frdb.Ancient(freezerHashTable, 0)
+			if err != nil {
+				return nil, fmt.Errorf("failed to retrieve genesis from ancient %v", err)
+			} else if !bytes.Equal(kvgenesis, frgenesis) {
+				return nil, fmt.Errorf("genesis mismatch: %#x (leveldb) != %#x (ancients)", kvgenesis, frgenesis)
+			}
+		}
+	}
+	go freezeRemote(db, frdb, frdb.threshold, &frdb.freezeMu, frdb.quit, frdb.trigger, &frdb.freezeFeed)
+
+	return &freezerdb{
+		KeyValueStore: db,
+		AncientStore:  frdb,
+	}, nil
+}
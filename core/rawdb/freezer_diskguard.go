@@ -0,0 +1,165 @@
+package rawdb
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// FreezerMethodFreeSpace reports the space available to the remote freezer for
+// further items, in bytes.
+const FreezerMethodFreeSpace = "freezer_freeSpace"
+
+// freezerDiskGuardRecheck is the interval the free disk space is checked at while
+// writes are paused for the lack of it.
+var freezerDiskGuardRecheck = 30 * time.Second
+
+// DiskSpaceReporter reports the space available on the storage an ancient store
+// writes to.
+type DiskSpaceReporter interface {
+	FreeDiskSpace() (uint64, error)
+}
+
+// freezerDiskGuard pauses freezing, and the imports of blocks, while the free disk
+// space reported is below a threshold.
+type freezerDiskGuard struct {
+	threshold uint64 // Minimum free space to freeze batches with, 0 if the guard is disabled
+	reporter  DiskSpaceReporter
+	lock      sync.Mutex
+}
+
+// set configures the threshold and the reporter of the guard.
+func (g *freezerDiskGuard) set(threshold uint64, reporter DiskSpaceReporter) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.threshold, g.reporter = threshold, reporter
+}
+
+// check reports whether the free disk space is below the threshold, along with the
+// free space and the threshold. Free space which can't be determined doesn't pause
+// the writes, named by writes in the logs.
+func (g *freezerDiskGuard) check(writes string) (bool, uint64, uint64) {
+	g.lock.Lock()
+	threshold, reporter := g.threshold, g.reporter
+	g.lock.Unlock()
+
+	if threshold == 0 || reporter == nil {
+		return false, 0, 0
+	}
+	free, err := reporter.FreeDiskSpace()
+	if err != nil {
+		log.Warn("Failed to check free disk space, writing anyway", "writes", writes, "err", err)
+		return false, 0, threshold
+	}
+	return free < threshold, free, threshold
+}
+
+// wait blocks while the free disk space is below the threshold, checking it again
+// every freezerDiskGuardRecheck. It returns false if quit was received meanwhile.
+func (g *freezerDiskGuard) wait(quit chan struct{}, writes string) bool {
+	var paused time.Time
+	for {
+		low, free, threshold := g.check(writes)
+		if !low {
+			if !paused.IsZero() {
+				log.Info("Free disk space recovered, resuming writes", "writes", writes, "free", common.StorageSize(free), "paused", common.PrettyDuration(time.Since(paused)))
+			}
+			return true
+		}
+		if paused.IsZero() {
+			paused = time.Now()
+		}
+		log.Warn("Low free disk space, writes paused", "writes", writes, "free", common.StorageSize(free), "threshold", common.StorageSize(threshold))
+		select {
+		case <-time.After(freezerDiskGuardRecheck):
+		case <-quit:
+			return false
+		}
+	}
+}
+
+// diskGuardOf returns the disk guard of the ancient store of db, or nil if it has
+// none.
+func diskGuardOf(db ethdb.Database) *freezerDiskGuard {
+	frdb, ok := db.(*freezerdb)
+	if !ok {
+		return nil
+	}
+	if g, ok := frdb.AncientStore.(interface{ diskGuard() *freezerDiskGuard }); ok {
+		return g.diskGuard()
+	}
+	return nil
+}
+
+// WaitDiskSpace blocks while the free space checked by the disk guard of the ancient
+// store of db is below its threshold, see SetDiskGuard, pausing the imports of
+// blocks. It returns false if quit was received meanwhile, and true right away if
+// the database has no disk guard. It must not be called holding locks other writers
+// wait on, see LowDiskSpace.
+func WaitDiskSpace(db ethdb.Database, quit chan struct{}) bool {
+	if g := diskGuardOf(db); g != nil {
+		return g.wait(quit, "import")
+	}
+	return true
+}
+
+// LowDiskSpace reports whether the free space checked by the disk guard of the
+// ancient store of db is below its threshold, without waiting for it to recover.
+func LowDiskSpace(db ethdb.Database) bool {
+	if g := diskGuardOf(db); g != nil {
+		low, free, threshold := g.check("import")
+		if low {
+			log.Warn("Low free disk space, writes aborted", "writes", "import", "free", common.StorageSize(free), "threshold", common.StorageSize(threshold))
+		}
+		return low
+	}
+	return false
+}
+
+// FreeDiskSpace returns the space available on the file system of the freezer.
+func (f *freezer) FreeDiskSpace() (uint64, error) {
+	return freeDiskSpace(f.datadir)
+}
+
+// SetDiskGuard pauses freezing batches, and the imports of blocks waiting on it
+// (see WaitDiskSpace), while the free space reported by reporter, the file system
+// of the freezer if nil, is below threshold. A threshold of 0 disables the guard.
+func (f *freezer) SetDiskGuard(threshold uint64, reporter DiskSpaceReporter) {
+	if reporter == nil {
+		reporter = f
+	}
+	f.guard.set(threshold, reporter)
+}
+
+// diskGuard returns the guard of the freezer, see WaitDiskSpace.
+func (f *freezer) diskGuard() *freezerDiskGuard {
+	return &f.guard
+}
+
+// FreeDiskSpace returns the space available to the remote freezer, as reported by
+// the server.
+func (api *FreezerRemoteClient) FreeDiskSpace() (uint64, error) {
+	var free uint64
+	err := api.read(&free, FreezerMethodFreeSpace)
+	return free, err
+}
+
+// SetDiskGuard pauses freezing batches, and the imports of blocks waiting on it
+// (see WaitDiskSpace), while the free space reported by reporter, the server if
+// nil, is below threshold. A threshold of 0 disables the guard.
+func (api *FreezerRemoteClient) SetDiskGuard(threshold uint64, reporter DiskSpaceReporter) {
+	if reporter == nil {
+		reporter = api
+	}
+	api.guard.set(threshold, reporter)
+}
+
+// diskGuard returns the guard of the remote freezer, see freezeRemote and
+// WaitDiskSpace.
+func (api *FreezerRemoteClient) diskGuard() *freezerDiskGuard {
+	return &api.guard
+}
@@ -0,0 +1,195 @@
+package rawdb
+
+import (
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/cmd/ancient-store-mem/lib"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// testDiskSpace is a DiskSpaceReporter of a settable free space.
+type testDiskSpace struct {
+	free   uint64 // atomic
+	checks uint64 // Number of checks of the free space (atomic)
+}
+
+func (s *testDiskSpace) FreeDiskSpace() (uint64, error) {
+	atomic.AddUint64(&s.checks, 1)
+	return atomic.LoadUint64(&s.free), nil
+}
+
+func TestFreezerDiskGuard(t *testing.T) {
+	const blocks = 16
+
+	defer func(recheck time.Duration) { freezerDiskGuardRecheck = recheck }(freezerDiskGuardRecheck)
+	freezerDiskGuardRecheck = 10 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "freezer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDatabaseWithFreezer(NewMemoryDatabase(), dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	space := &testDiskSpace{free: 1024}
+	if err := db.(*freezerdb).SetDiskGuard(4096, space); err != nil {
+		t.Fatal(err)
+	}
+	var parent common.Hash
+	for i := int64(0); i < blocks; i++ {
+		block := types.NewBlock(&types.Header{Number: big.NewInt(i), ParentHash: parent}, nil, nil, nil, newHasher())
+
+		WriteBlock(db, block)
+		WriteReceipts(db, block.Hash(), block.NumberU64(), nil)
+		WriteTd(db, block.Hash(), block.NumberU64(), big.NewInt(i+1))
+		WriteCanonicalHash(db, block.Hash(), block.NumberU64())
+		WriteHeadBlockHash(db, block.Hash())
+		parent = block.Hash()
+	}
+	done := make(chan struct{})
+	go func() {
+		db.(*freezerdb).Freeze(0)
+		close(done)
+	}()
+	// Freezing is paused while the free space is below the threshold
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadUint64(&space.checks) < 3; {
+		if time.Now().After(deadline) {
+			t.Fatalf("free disk space not rechecked: %d checks", atomic.LoadUint64(&space.checks))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatalf("freezing not paused")
+	default:
+	}
+	if frozen, _ := db.Ancients(); frozen != 0 {
+		t.Fatalf("froze %d blocks while paused", frozen)
+	}
+	// Freezing resumes once space frees up
+	atomic.StoreUint64(&space.free, 4096)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("freezing not resumed")
+	}
+	if frozen, _ := db.Ancients(); frozen != blocks {
+		t.Fatalf("frozen blocks mismatch: have %d, want %d", frozen, blocks)
+	}
+}
+
+// Tests that imports waiting on the disk guard are paused while the free space is
+// low, until it frees up or they quit.
+func TestWaitDiskSpace(t *testing.T) {
+	defer func(recheck time.Duration) { freezerDiskGuardRecheck = recheck }(freezerDiskGuardRecheck)
+	freezerDiskGuardRecheck = 10 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "freezer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDatabaseWithFreezer(NewMemoryDatabase(), dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Databases without a disk guard don't pause
+	if !WaitDiskSpace(NewMemoryDatabase(), nil) || !WaitDiskSpace(db, nil) {
+		t.Fatalf("paused without a disk guard")
+	}
+	if LowDiskSpace(NewMemoryDatabase()) || LowDiskSpace(db) {
+		t.Fatalf("low disk space reported without a disk guard")
+	}
+	space := &testDiskSpace{free: 1024}
+	if err := db.(*freezerdb).SetDiskGuard(4096, space); err != nil {
+		t.Fatal(err)
+	}
+	if !LowDiskSpace(db) {
+		t.Fatalf("low disk space not reported")
+	}
+	quit, done := make(chan struct{}), make(chan bool)
+	go func() { done <- WaitDiskSpace(db, quit) }()
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadUint64(&space.checks) < 3; {
+		if time.Now().After(deadline) {
+			t.Fatalf("free disk space not rechecked: %d checks", atomic.LoadUint64(&space.checks))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(quit)
+	if <-done {
+		t.Fatalf("wait not interrupted")
+	}
+	go func() { done <- WaitDiskSpace(db, make(chan struct{})) }()
+	atomic.StoreUint64(&space.free, 4096)
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Fatalf("wait interrupted")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("wait not resumed")
+	}
+	if LowDiskSpace(db) {
+		t.Fatalf("low disk space reported after it freed up")
+	}
+}
+
+// Tests that the free space reported by the remote freezer server pauses freezing.
+func TestFreezerDiskGuardRemote(t *testing.T) {
+	mem := lib.NewMemFreezerRemoteServerAPI()
+	server := rpc.NewServer()
+	defer server.Stop()
+	if err := server.RegisterName("freezer", mem); err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	client, err := NewFreezerRemoteClient(httpServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if free, err := client.FreeDiskSpace(); err != nil || free != math.MaxUint64 {
+		t.Fatalf("unlimited free space: have %d (err %v), want %d", free, err, uint64(math.MaxUint64))
+	}
+	mem.SetCapacity(1000)
+	b := []byte{0x01, 0x02}
+	if err := client.AppendAncient(0, b, b, b, b, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if free, err := client.FreeDiskSpace(); err != nil || free != uint64(1000-5*len(b)) {
+		t.Fatalf("free space: have %d (err %v), want %d", free, err, 1000-5*len(b))
+	}
+	client.SetDiskGuard(4096, nil)
+	quit := make(chan struct{})
+	close(quit)
+	if client.diskGuard().wait(quit, "freezing") {
+		t.Fatalf("freezing not paused")
+	}
+	mem.SetCapacity(0)
+	if !client.diskGuard().wait(quit, "freezing") {
+		t.Fatalf("freezing not resumed")
+	}
+}
@@ -0,0 +1,10 @@
+// +build !linux,!darwin,!freebsd,!windows
+
+package rawdb
+
+import "errors"
+
+// freeDiskSpace is not supported on this platform.
+func freeDiskSpace(path string) (uint64, error) {
+	return 0, errors.New("free disk space not supported on this platform")
+}
@@ -0,0 +1,15 @@
+// +build linux darwin freebsd
+
+package rawdb
+
+import "golang.org/x/sys/unix"
+
+// freeDiskSpace returns the space available to unprivileged writes on the file
+// system of path.
+func freeDiskSpace(path string) (uint64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
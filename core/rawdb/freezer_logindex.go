@@ -0,0 +1,318 @@
+package rawdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// ErrLogsNotIndexed is returned reading the logs of a block whose log positions are
+// not indexed in the ancient store, see EnableAncientLogIndex.
+var ErrLogsNotIndexed = errors.New("logs not indexed in the ancient store")
+
+// logIndexEntrySize is the size of the index entry of a log: the index of its receipt
+// in the block, and the offset and size of its RLP encoding within the frozen
+// receipts, each a big endian uint32.
+const logIndexEntrySize = 12
+
+// freezerLogIndex is the optional index of the log positions within the frozen
+// receipts. Its item k holds the hash of block from+k, followed by the index entries
+// of its logs; the hashes tie the entries to the blocks they were computed from.
+type freezerLogIndex struct {
+	table *freezerTable // Index table, nil if the logs are not indexed
+	from  uint64        // Number of the first block indexed
+	lock  sync.Mutex
+}
+
+// ReadAncientLogIndex retrieves the number of the first block whose log positions are
+// indexed in the ancient store, nil if they were never indexed.
+func ReadAncientLogIndex(db ethdb.KeyValueReader) *uint64 {
+	data, _ := db.Get(ancientLogIndexKey)
+	if len(data) != 8 {
+		return nil
+	}
+	number := binary.BigEndian.Uint64(data)
+	return &number
+}
+
+// WriteAncientLogIndex stores the number of the first block whose log positions are
+// indexed in the ancient store.
+func WriteAncientLogIndex(db ethdb.KeyValueWriter, number uint64) {
+	if err := db.Put(ancientLogIndexKey, encodeBlockNumber(number)); err != nil {
+		log.Crit("Failed to store ancient log index", "err", err)
+	}
+}
+
+// EnableAncientLogIndex indexes the positions of the logs within the receipts moved
+// into the ancient store from now on, so that the logs of frozen blocks can be read
+// without decoding their receipts, see ReadAncientLogs. The number of the first block
+// indexed is recorded on the first call; blocks frozen since without the index enabled
+// are indexed from their receipts when it's enabled again, replacing the entries of
+// blocks truncated in the meantime. Only the builtin freezer supports the index.
+func EnableAncientLogIndex(db ethdb.Database) error {
+	frdb, ok := db.(*freezerdb)
+	if !ok {
+		return errNotSupported
+	}
+	f, ok := frdb.AncientStore.(*freezer)
+	if !ok {
+		return errNotSupported
+	}
+	from := ReadAncientLogIndex(db)
+	if from == nil {
+		frozen, _ := f.Ancients()
+		WriteAncientLogIndex(db, frozen)
+		from = &frozen
+	}
+	if err := f.enableLogIndex(*from); err != nil {
+		return err
+	}
+	log.Info("Indexing logs in the ancient store", "from", *from)
+	return nil
+}
+
+// enableLogIndex opens the log index of the blocks from from on, and brings it in
+// line with the frozen blocks: entries beyond them or of blocks replaced since, while
+// the index was not maintained, are discarded, and the missing ones computed from the
+// frozen receipts.
+func (f *freezer) enableLogIndex(from uint64) error {
+	f.logs.lock.Lock()
+	defer f.logs.lock.Unlock()
+
+	if f.logs.table != nil {
+		return nil
+	}
+	table, err := newTable(f.datadir, freezerLogIndexTable, metrics.NilMeter{}, metrics.NilMeter{}, metrics.NilGauge{}, true)
+	if err != nil {
+		return err
+	}
+	var (
+		frozen  = atomic.LoadUint64(&f.frozen)
+		indexed = from + atomic.LoadUint64(&table.items)
+	)
+	if frozen < from {
+		frozen = from
+	}
+	if indexed > frozen {
+		indexed = frozen
+	}
+	// Blocks may have been truncated and frozen again without the index, drop the
+	// entries of the replaced ones
+	for ; indexed > from && err == nil; indexed-- {
+		var item, hash []byte
+		if item, err = table.Retrieve(indexed - 1 - from); err != nil {
+			break
+		}
+		if hash, err = f.tables[freezerHashTable].Retrieve(indexed - 1); err != nil {
+			break
+		}
+		if len(item) >= common.HashLength && bytes.Equal(item[:common.HashLength], hash) {
+			break
+		}
+	}
+	if err == nil && atomic.LoadUint64(&table.items) > indexed-from {
+		log.Info("Discarding stale log index entries", "from", indexed)
+		err = table.truncate(indexed - from)
+	}
+	if err == nil && indexed < frozen {
+		log.Info("Indexing logs of frozen blocks", "from", indexed, "to", frozen-1)
+	}
+	for number := indexed; number < frozen && err == nil; number++ {
+		var hash, receipts, item []byte
+		if hash, err = f.tables[freezerHashTable].Retrieve(number); err != nil {
+			break
+		}
+		if receipts, err = f.tables[freezerReceiptTable].Retrieve(number); err != nil {
+			break
+		}
+		if item, err = logIndexItem(hash, receipts); err != nil {
+			err = fmt.Errorf("block #%d: %v", number, err)
+			break
+		}
+		err = table.Append(number-from, item)
+	}
+	if err != nil {
+		table.Close()
+		return err
+	}
+	f.logs.table, f.logs.from = table, from
+	return nil
+}
+
+// appendLogIndex appends the index entries of the logs within the receipts of the
+// block of the given number and hash to the log index, if enabled. It must precede
+// appending the block to the other tables.
+func (f *freezer) appendLogIndex(number uint64, hash, receipts []byte) error {
+	f.logs.lock.Lock()
+	defer f.logs.lock.Unlock()
+
+	if f.logs.table == nil || number < f.logs.from {
+		return nil
+	}
+	item, err := logIndexItem(hash, receipts)
+	if err != nil {
+		return err
+	}
+	return f.logs.table.Append(number-f.logs.from, item)
+}
+
+// truncateLogIndex discards the log index entries of the blocks from number on.
+func (f *freezer) truncateLogIndex(number uint64) error {
+	f.logs.lock.Lock()
+	defer f.logs.lock.Unlock()
+
+	if f.logs.table == nil {
+		return nil
+	}
+	var items uint64
+	if number > f.logs.from {
+		items = number - f.logs.from
+	}
+	if atomic.LoadUint64(&f.logs.table.items) <= items {
+		return nil
+	}
+	return f.logs.table.truncate(items)
+}
+
+// logIndexTable returns the table of the log index, nil if the logs are not indexed.
+func (f *freezer) logIndexTable() *freezerTable {
+	f.logs.lock.Lock()
+	defer f.logs.lock.Unlock()
+
+	return f.logs.table
+}
+
+// logIndex retrieves the log index entries of the block of the given number.
+func (f *freezer) logIndex(number uint64) ([]byte, error) {
+	f.logs.lock.Lock()
+	table, from := f.logs.table, f.logs.from
+	f.logs.lock.Unlock()
+
+	if table == nil || number < from {
+		return nil, ErrLogsNotIndexed
+	}
+	return table.Retrieve(number - from)
+}
+
+// logIndexItem returns the log index item of a block: its hash followed by the index
+// entries of the logs within its receipts.
+func logIndexItem(hash, receipts []byte) ([]byte, error) {
+	entries, err := logIndexEntries(receipts)
+	if err != nil {
+		return nil, err
+	}
+	return append(common.CopyBytes(hash), entries...), nil
+}
+
+// logIndexEntries returns the index entries of the logs within an RLP encoded list
+// of receipts in storage form.
+func logIndexEntries(receipts []byte) ([]byte, error) {
+	list, _, err := rlp.SplitList(receipts)
+	if err != nil {
+		return nil, err
+	}
+	var entries []byte
+	for tx := uint32(0); len(list) > 0; tx++ {
+		receipt, rest, err := rlp.SplitList(list)
+		if err != nil {
+			return nil, err
+		}
+		logs, err := receiptLogsRLP(receipt)
+		if err != nil {
+			return nil, fmt.Errorf("receipt %d: %v", tx, err)
+		}
+		for len(logs) > 0 {
+			_, _, tail, err := rlp.Split(logs)
+			if err != nil {
+				return nil, fmt.Errorf("receipt %d: %v", tx, err)
+			}
+			// The logs are a slice of the receipts, offset by the difference of their capacities
+			var entry [logIndexEntrySize]byte
+			binary.BigEndian.PutUint32(entry[0:], tx)
+			binary.BigEndian.PutUint32(entry[4:], uint32(cap(receipts)-cap(logs)))
+			binary.BigEndian.PutUint32(entry[8:], uint32(len(logs)-len(tail)))
+			entries = append(entries, entry[:]...)
+			logs = tail
+		}
+		list = rest
+	}
+	return entries, nil
+}
+
+// receiptLogsRLP returns the content of the RLP list of the logs of a receipt in any
+// of its storage encodings, given the content of its RLP list.
+func receiptLogsRLP(receipt []byte) ([]byte, error) {
+	var fields [][]byte
+	for rest := receipt; len(rest) > 0; {
+		_, _, tail, err := rlp.Split(rest)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, rest[:len(rest)-len(tail)])
+		rest = tail
+	}
+	var logs []byte
+	switch len(fields) {
+	case 3:
+		logs = fields[2] // Current encoding
+	case 6:
+		logs = fields[4] // Database version 4
+	case 7:
+		logs = fields[5] // Database version 3
+	default:
+		return nil, fmt.Errorf("unknown receipt encoding of %d fields", len(fields))
+	}
+	content, _, err := rlp.SplitList(logs)
+	return content, err
+}
+
+// ReadAncientLogs retrieves the logs of the frozen block corresponding to the hash,
+// decoding only the logs of its receipts, at the positions recorded by the log index.
+// The transaction hashes of the logs are not populated. ErrLogsNotIndexed is returned
+// if the block is not frozen, or its log positions are not indexed.
+func ReadAncientLogs(db ethdb.AncientReader, hash common.Hash, number uint64) ([]*types.Log, error) {
+	index, err := db.Ancient(freezerLogIndexTable, number)
+	if err != nil || len(index) < common.HashLength {
+		return nil, ErrLogsNotIndexed
+	}
+	if common.BytesToHash(index[:common.HashLength]) != hash {
+		return nil, ErrLogsNotIndexed
+	}
+	index = index[common.HashLength:]
+	receipts, err := db.Ancient(freezerReceiptTable, number)
+	if err != nil {
+		return nil, err
+	}
+	if len(index)%logIndexEntrySize != 0 {
+		return nil, fmt.Errorf("invalid log index of block #%d: %d bytes", number, len(index))
+	}
+	logs := make([]*types.Log, 0, len(index)/logIndexEntrySize)
+	for i := 0; i < len(index); i += logIndexEntrySize {
+		var (
+			tx     = binary.BigEndian.Uint32(index[i:])
+			offset = uint64(binary.BigEndian.Uint32(index[i+4:]))
+			size   = uint64(binary.BigEndian.Uint32(index[i+8:]))
+		)
+		if offset+size > uint64(len(receipts)) {
+			return nil, fmt.Errorf("log %d of block #%d beyond its receipts", len(logs), number)
+		}
+		var stored types.LogForStorage
+		if err := rlp.DecodeBytes(receipts[offset:offset+size], &stored); err != nil {
+			return nil, fmt.Errorf("log %d of block #%d: %v", len(logs), number, err)
+		}
+		l := types.Log(stored)
+		l.BlockNumber, l.BlockHash, l.TxIndex, l.Index = number, hash, uint(tx), uint(len(logs))
+		logs = append(logs, &l)
+	}
+	return logs, nil
+}
@@ -0,0 +1,262 @@
+package rawdb
+
+import (
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// writeTestChainWithLogs writes a canonical chain up to head whose blocks hold a few
+// transactions, with receipts of a few logs each.
+func writeTestChainWithLogs(db ethdb.KeyValueWriter, head uint64) {
+	writeTestForkWithLogs(db, common.Hash{}, 0, head, 0)
+}
+
+// writeTestForkWithLogs writes the canonical blocks from from up to head of the chain
+// writeTestChainWithLogs writes, on top of parent, whose logs differ by fork.
+func writeTestForkWithLogs(db ethdb.KeyValueWriter, parent common.Hash, from, head uint64, fork byte) {
+	for i := from; i <= head; i++ {
+		var (
+			txs      types.Transactions
+			receipts types.Receipts
+		)
+		for j := uint64(0); j < i%4; j++ {
+			txs = append(txs, types.NewTransaction(j, common.Address{byte(i)}, big.NewInt(1), 21000, big.NewInt(1), nil))
+			receipt := &types.Receipt{Status: types.ReceiptStatusSuccessful, CumulativeGasUsed: 21000 * (j + 1)}
+			for k := uint64(0); k < (i+j)%3; k++ {
+				receipt.Logs = append(receipt.Logs, &types.Log{
+					Address: common.Address{byte(i), byte(j), byte(k), fork},
+					Topics:  []common.Hash{{byte(i)}, {byte(k)}},
+					Data:    make([]byte, i*j*k),
+				})
+			}
+			receipts = append(receipts, receipt)
+		}
+		block := types.NewBlock(&types.Header{Number: new(big.Int).SetUint64(i), ParentHash: parent, Extra: []byte{'t', 'e', 's', 't', fork}}, txs, nil, receipts, newHasher())
+		WriteBlock(db, block)
+		WriteReceipts(db, block.Hash(), i, receipts)
+		WriteTd(db, block.Hash(), i, new(big.Int).SetUint64(i+1))
+		WriteCanonicalHash(db, block.Hash(), i)
+		WriteHeadBlockHash(db, block.Hash())
+		parent = block.Hash()
+	}
+}
+
+// Tests that the logs of frozen blocks read through the log index match the ones of
+// their fully decoded receipts, from the block the index was enabled at on.
+func TestAncientLogIndex(t *testing.T) {
+	const head = 64
+
+	dir, err := ioutil.TempDir("", "freezer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDatabaseWithFreezer(NewMemoryDatabase(), dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	writeTestChainWithLogs(db, head)
+	hashes := make([]common.Hash, head+1)
+	for i := range hashes {
+		hashes[i] = ReadCanonicalHash(db, uint64(i))
+	}
+	// Freeze some blocks without the index, then all of them with it
+	db.(*freezerdb).Freeze(head - 20)
+	if err := EnableAncientLogIndex(db); err != nil {
+		t.Fatalf("failed to enable the log index: %v", err)
+	}
+	from := ReadAncientLogIndex(db)
+	if from == nil || *from != 21 {
+		t.Fatalf("first block indexed: have %v, want 21", from)
+	}
+	db.(*freezerdb).Freeze(0)
+	if frozen, _ := db.Ancients(); frozen != head+1 {
+		t.Fatalf("frozen blocks mismatch: have %d, want %d", frozen, head+1)
+	}
+	var indexed int
+	for i, hash := range hashes {
+		number := uint64(i)
+		logs, err := ReadAncientLogs(db, hash, number)
+		if number < *from {
+			if !errors.Is(err, ErrLogsNotIndexed) {
+				t.Errorf("block #%d: want %v, got %v", number, ErrLogsNotIndexed, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("block #%d: %v", number, err)
+			continue
+		}
+		var want []*types.Log
+		for _, receipt := range ReadReceipts(db, hash, number, params.TestChainConfig) {
+			for _, log := range receipt.Logs {
+				log.TxHash = common.Hash{} // Not populated from the index
+				want = append(want, log)
+			}
+		}
+		if len(want) == 0 {
+			want = []*types.Log{}
+		}
+		if !reflect.DeepEqual(logs, want) {
+			t.Errorf("block #%d: logs mismatch:\nhave %+v\nwant %+v", number, logs, want)
+		}
+		indexed += len(logs)
+	}
+	if indexed == 0 {
+		t.Fatal("no logs indexed")
+	}
+	// Blocks of other hashes are not served
+	if _, err := ReadAncientLogs(db, common.Hash{0x01}, head); !errors.Is(err, ErrLogsNotIndexed) {
+		t.Errorf("non-canonical block: want %v, got %v", ErrLogsNotIndexed, err)
+	}
+	// Truncated blocks are dropped from the index
+	if err := db.TruncateAncients(40); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadAncientLogs(db, hashes[50], 50); !errors.Is(err, ErrLogsNotIndexed) {
+		t.Errorf("truncated block: want %v, got %v", ErrLogsNotIndexed, err)
+	}
+	if _, err := ReadAncientLogs(db, hashes[39], 39); err != nil {
+		t.Errorf("block #39: %v", err)
+	}
+}
+
+// Tests that enabling the log index indexes the blocks frozen since the first block
+// indexed from their receipts.
+func TestAncientLogIndexBackfill(t *testing.T) {
+	const head = 64
+
+	dir, err := ioutil.TempDir("", "freezer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDatabaseWithFreezer(NewMemoryDatabase(), dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	writeTestChainWithLogs(db, head)
+	hashes := make([]common.Hash, head+1)
+	for i := range hashes {
+		hashes[i] = ReadCanonicalHash(db, uint64(i))
+	}
+	want := make([]int, head+1)
+	for i, hash := range hashes {
+		for _, receipt := range ReadRawReceipts(db, hash, uint64(i)) {
+			want[i] += len(receipt.Logs)
+		}
+	}
+	db.(*freezerdb).Freeze(0)
+
+	// The index was enabled at #10, but not maintained since
+	WriteAncientLogIndex(db, 10)
+	if err := EnableAncientLogIndex(db); err != nil {
+		t.Fatalf("failed to enable the log index: %v", err)
+	}
+	for i := 10; i <= head; i++ {
+		logs, err := ReadAncientLogs(db, hashes[i], uint64(i))
+		if err != nil || len(logs) != want[i] {
+			t.Errorf("block #%d: have %d logs (err %v), want %d", i, len(logs), err, want[i])
+		}
+	}
+	if _, err := ReadAncientLogs(db, hashes[9], 9); !errors.Is(err, ErrLogsNotIndexed) {
+		t.Errorf("block #9: want %v, got %v", ErrLogsNotIndexed, err)
+	}
+}
+
+// Tests that enabling the log index discards the entries of blocks truncated and
+// frozen again while the index was not maintained.
+func TestAncientLogIndexTruncatedDisabled(t *testing.T) {
+	const (
+		head = 64
+		fork = 40
+	)
+	dir, err := ioutil.TempDir("", "freezer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := NewMemoryDatabase()
+	freeze := func(f *freezer, from uint64) {
+		for i := from; i <= head; i++ {
+			hash := ReadCanonicalHash(db, i)
+			if err := f.AppendAncient(i, hash[:], ReadHeaderRLP(db, hash, i), ReadBodyRLP(db, hash, i), ReadReceiptsRLP(db, hash, i), ReadTdRLP(db, hash, i)); err != nil {
+				t.Fatalf("failed to freeze block #%d: %v", i, err)
+			}
+		}
+	}
+	// closeFreezer closes a freezer whose freeze loop isn't running to take its quit signal
+	closeFreezer := func(f *freezer) {
+		go func() { <-f.quit }()
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Freeze a chain with the index enabled
+	writeTestChainWithLogs(db, head)
+	f, err := newFreezer(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.enableLogIndex(0); err != nil {
+		t.Fatalf("failed to enable the log index: %v", err)
+	}
+	freeze(f, 0)
+	closeFreezer(f)
+
+	// Replace its blocks from the fork point without the index
+	writeTestForkWithLogs(db, ReadCanonicalHash(db, fork-1), fork, head, 1)
+	if f, err = newFreezer(dir, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.TruncateAncients(fork); err != nil {
+		t.Fatal(err)
+	}
+	freeze(f, fork)
+	closeFreezer(f)
+
+	// Enable the index again, the entries of the replaced blocks must be rebuilt
+	if f, err = newFreezer(dir, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer closeFreezer(f)
+	if err := f.enableLogIndex(0); err != nil {
+		t.Fatalf("failed to enable the log index: %v", err)
+	}
+	for i := uint64(0); i <= head; i++ {
+		hash := ReadCanonicalHash(db, i)
+		logs, err := ReadAncientLogs(f, hash, i)
+		if err != nil {
+			t.Errorf("block #%d: %v", i, err)
+			continue
+		}
+		var want int
+		for _, receipt := range ReadRawReceipts(db, hash, i) {
+			for _, log := range receipt.Logs {
+				if want < len(logs) && log.Address != logs[want].Address {
+					t.Errorf("block #%d: log %d address mismatch: have %x, want %x", i, want, logs[want].Address, log.Address)
+				}
+				want++
+			}
+		}
+		if len(logs) != want {
+			t.Errorf("block #%d: have %d logs, want %d", i, len(logs), want)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package rawdb
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// FreezerMirrorPolicy defines how a FreezerMirror treats writes its secondary freezer
+// failed to confirm.
+type FreezerMirrorPolicy int
+
+const (
+	// FreezerMirrorBlock fails writes the secondary did not confirm, even though the
+	// primary did. This is the default.
+	FreezerMirrorBlock FreezerMirrorPolicy = iota
+
+	// FreezerMirrorWarn logs writes the secondary did not confirm, and acknowledges
+	// them once the primary did.
+	FreezerMirrorWarn
+)
+
+// FreezerMirror is a Freezer writing every item to both a primary and a secondary
+// freezer for redundancy, acknowledging writes once both confirmed them. Reads are
+// served by the primary.
+//
+// A secondary missing writes is caught up from the primary before the next write
+// mirrored to it, regardless of the policy.
+type FreezerMirror struct {
+	primary   Freezer
+	secondary Freezer
+	policy    FreezerMirrorPolicy
+	lagging   bool       // Whether the secondary missed writes of the primary
+	lock      sync.Mutex // Serializes writes, keeping both freezers in the same order
+}
+
+// NewFreezerMirror creates a Freezer mirroring the writes to primary to secondary,
+// treating writes failing on the secondary according to policy.
+func NewFreezerMirror(primary, secondary Freezer, policy FreezerMirrorPolicy) *FreezerMirror {
+	return &FreezerMirror{primary: primary, secondary: secondary, policy: policy}
+}
+
+// AppendAncient appends the item to the primary, and once it confirmed it, to the
+// secondary.
+func (m *FreezerMirror) AppendAncient(number uint64, hash, header, body, receipt, td []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.primary.AppendAncient(number, hash, header, body, receipt, td); err != nil {
+		return err
+	}
+	return m.mirror(number, func() error {
+		return m.secondary.AppendAncient(number, hash, header, body, receipt, td)
+	})
+}
+
+// Ancient retrieves an ancient binary blob from the primary.
+func (m *FreezerMirror) Ancient(kind string, number uint64) ([]byte, error) {
+	return m.primary.Ancient(kind, number)
+}
+
+// Ancients returns the number of items in the primary.
+func (m *FreezerMirror) Ancients() (uint64, error) {
+	return m.primary.Ancients()
+}
+
+// TruncateAncients discards all but the first n items from both freezers.
+func (m *FreezerMirror) TruncateAncients(n uint64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.primary.TruncateAncients(n); err != nil {
+		return err
+	}
+	return m.mirror(n, func() error {
+		return m.secondary.TruncateAncients(n)
+	})
+}
+
+// Sync flushes the data of both freezers to durable storage.
+func (m *FreezerMirror) Sync() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.primary.Sync(); err != nil {
+		return err
+	}
+	return m.mirror(0, m.secondary.Sync)
+}
+
+// Close closes both freezers if they support it.
+func (m *FreezerMirror) Close() error {
+	var errs []error
+	for _, freezer := range []Freezer{m.primary, m.secondary} {
+		if closer, ok := freezer.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// mirror runs the write to the secondary, catching the secondary up with the first
+// items of the primary before number first if it is lagging. Failures are handled
+// according to the policy. The write lock must be held.
+func (m *FreezerMirror) mirror(number uint64, write func() error) error {
+	var err error
+	if m.lagging {
+		err = m.catchUp(number)
+	}
+	if err == nil {
+		err = write()
+	}
+	if err != nil {
+		m.lagging = true
+		if m.policy == FreezerMirrorBlock {
+			return fmt.Errorf("secondary freezer: %w", err)
+		}
+		log.Warn("Secondary freezer lagging behind the primary", "number", number, "err", err)
+		return nil
+	}
+	m.lagging = false
+	return nil
+}
+
+// catchUp copies the items below number missing from the secondary from the primary,
+// discarding any the secondary has beyond it. A number of zero catches up with all
+// items of the primary.
+func (m *FreezerMirror) catchUp(number uint64) error {
+	if number == 0 {
+		frozen, err := m.primary.Ancients()
+		if err != nil {
+			return err
+		}
+		number = frozen
+	}
+	items, err := m.secondary.Ancients()
+	if err != nil {
+		return err
+	}
+	if items > number {
+		return m.secondary.TruncateAncients(number)
+	}
+	for ; items < number; items++ {
+		blobs := make([][]byte, len(freezerKinds))
+		for i, kind := range freezerKinds {
+			if blobs[i], err = m.primary.Ancient(kind, items); err != nil {
+				return err
+			}
+		}
+		if err := m.secondary.AppendAncient(items, blobs[0], blobs[1], blobs[2], blobs[3], blobs[4]); err != nil {
+			return err
+		}
+	}
+	log.Info("Caught up secondary freezer with the primary", "items", number)
+	return nil
+}
+
+// NewDatabaseWithFreezerRemoteMirror creates a high level database on top of a given
+// key-value data store, with immutable chain segments moved into the remote freezer
+// at primaryURL, and mirrored to the one at secondaryURL; see FreezerMirror.
+func NewDatabaseWithFreezerRemoteMirror(db ethdb.KeyValueStore, primaryURL, secondaryURL string, policy FreezerMirrorPolicy) (ethdb.Database, error) {
+	primary, err := NewFreezerRemoteClient(primaryURL)
+	if err != nil {
+		return nil, err
+	}
+	secondary, err := NewFreezerRemoteClient(secondaryURL)
+	if err != nil {
+		primary.Close()
+		return nil, err
+	}
+	mirror := NewFreezerMirror(primary, secondary, policy)
+	frdb, err := NewDatabaseWithCustomFreezer(db, mirror)
+	if err != nil {
+		mirror.Close()
+		return nil, err
+	}
+	log.Info("Opened mirrored remote freezer", "primary", primaryURL, "secondary", secondaryURL)
+	return frdb, nil
+}
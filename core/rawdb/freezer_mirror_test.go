@@ -0,0 +1,107 @@
+package rawdb
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/cmd/ancient-store-mem/lib"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// rejectingFreezer is a mock freezer server rejecting appends while reject is set.
+type rejectingFreezer struct {
+	*lib.MemFreezerRemoteServerAPI
+	reject int32
+}
+
+func (f *rejectingFreezer) AppendAncient(number uint64, hash, header, body, receipt, td []byte, key *string) error {
+	if atomic.LoadInt32(&f.reject) == 1 {
+		return errors.New("append rejected")
+	}
+	return f.MemFreezerRemoteServerAPI.AppendAncient(number, hash, header, body, receipt, td, key)
+}
+
+func TestFreezerMirror(t *testing.T) {
+	// serve starts a rejecting mock freezer server, and returns a client of it.
+	serve := func() (*rejectingFreezer, *FreezerRemoteClient) {
+		server := rpc.NewServer()
+		t.Cleanup(server.Stop)
+		mock := &rejectingFreezer{MemFreezerRemoteServerAPI: lib.NewMemFreezerRemoteServerAPI()}
+		if err := server.RegisterName("freezer", mock); err != nil {
+			t.Fatal(err)
+		}
+		httpServer := httptest.NewServer(server)
+		t.Cleanup(httpServer.Close)
+		client, err := NewFreezerRemoteClient(httpServer.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		return mock, client
+	}
+	appendItem := func(freezer Freezer, i uint64) error {
+		return freezer.AppendAncient(i, []byte{byte(i)}, []byte{byte(i), 1}, []byte{byte(i), 2}, []byte{byte(i), 3}, []byte{byte(i), 4})
+	}
+	// identical checks that both mock backends hold the same n items.
+	identical := func(primary, secondary *rejectingFreezer, n uint64) {
+		t.Helper()
+		for _, mock := range []*rejectingFreezer{primary, secondary} {
+			if frozen, _ := mock.Ancients(); frozen != n {
+				t.Fatalf("have %d items, want %d", frozen, n)
+			}
+		}
+		for i := uint64(0); i < n; i++ {
+			for _, kind := range freezerKinds {
+				want, _ := primary.Ancient(kind, i)
+				if have, _ := secondary.Ancient(kind, i); !bytes.Equal(have, want) {
+					t.Errorf("item %d %s: secondary has %x, primary %x", i, kind, have, want)
+				}
+			}
+		}
+	}
+	primary, primaryClient := serve()
+	secondary, secondaryClient := serve()
+	mirror := NewFreezerMirror(primaryClient, secondaryClient, FreezerMirrorBlock)
+
+	for i := uint64(0); i < 10; i++ {
+		if err := appendItem(mirror, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	identical(primary, secondary, 10)
+
+	// Writes rejected by the primary fail, and are not mirrored.
+	atomic.StoreInt32(&primary.reject, 1)
+	if err := appendItem(mirror, 10); err == nil {
+		t.Fatal("append rejected by the primary succeeded")
+	}
+	atomic.StoreInt32(&primary.reject, 0)
+	identical(primary, secondary, 10)
+
+	// Writes rejected by the secondary fail if blocking, and succeed if warning.
+	atomic.StoreInt32(&secondary.reject, 1)
+	if err := appendItem(mirror, 10); err == nil {
+		t.Fatal("append rejected by the blocking secondary succeeded")
+	}
+	mirror.policy = FreezerMirrorWarn
+	if err := appendItem(mirror, 11); err != nil {
+		t.Fatalf("append rejected by the warning secondary failed: %v", err)
+	}
+	// The lagging secondary is caught up on the next write.
+	atomic.StoreInt32(&secondary.reject, 0)
+	if err := appendItem(mirror, 12); err != nil {
+		t.Fatal(err)
+	}
+	identical(primary, secondary, 13)
+
+	// Reads are served by the primary.
+	if err := secondary.TruncateAncients(0); err != nil {
+		t.Fatal(err)
+	}
+	if blob, err := mirror.Ancient(freezerHeaderTable, 12); err != nil || !bytes.Equal(blob, []byte{12, 1}) {
+		t.Errorf("read: have %x (err %v), want %x", blob, err, []byte{12, 1})
+	}
+}
@@ -0,0 +1,152 @@
+package rawdb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// ancientReaderAtBatch is the maximum number of items an AncientReaderAt reads at
+// once, while indexing or serving a read.
+const ancientReaderAtBatch = 64
+
+// ancientRangeReader is implemented by ancient stores reading ranges of items in a
+// single request (ie. a remote freezer).
+type ancientRangeReader interface {
+	AncientRange(kind string, start, count uint64) ([][]byte, error)
+}
+
+// AncientReaderAt exposes the items of an ancient kind as a contiguous, read-only
+// byte stream, the items following each other in the order of their numbers. The
+// index mapping numbers to offsets in the stream is built lazily, as far as reads
+// reach. Items frozen later extend the stream; truncating the ancient store below
+// the indexed items invalidates it.
+type AncientReaderAt struct {
+	db      ethdb.AncientReader
+	kind    string
+	offsets []uint64 // Offsets of the indexed items, followed by the end of the last one
+	lock    sync.Mutex
+}
+
+// NewAncientReaderAt creates a byte stream over the items of the kind in db.
+func NewAncientReaderAt(db ethdb.AncientReader, kind string) *AncientReaderAt {
+	return &AncientReaderAt{db: db, kind: kind, offsets: []uint64{0}}
+}
+
+// Offset returns the offset of the item of the given number in the stream, and its
+// size.
+func (r *AncientReaderAt) Offset(number uint64) (offset uint64, size uint64, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if err := r.index(func() bool { return uint64(len(r.offsets)) > number+1 }); err != nil {
+		return 0, 0, err
+	}
+	if uint64(len(r.offsets)) <= number+1 {
+		return 0, 0, fmt.Errorf("%w: %s #%d", errOutOfBounds, r.kind, number)
+	}
+	return r.offsets[number], r.offsets[number+1] - r.offsets[number], nil
+}
+
+// Size returns the length of the stream, indexing all the items.
+func (r *AncientReaderAt) Size() (int64, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if err := r.index(func() bool { return false }); err != nil {
+		return 0, err
+	}
+	return int64(r.offsets[len(r.offsets)-1]), nil
+}
+
+// ReadAt implements io.ReaderAt, reading the items overlapping the requested range
+// of the stream.
+func (r *AncientReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	start, end := uint64(off), uint64(off)+uint64(len(p))
+	if err := r.index(func() bool { return r.offsets[len(r.offsets)-1] >= end }); err != nil {
+		return 0, err
+	}
+	indexed := uint64(len(r.offsets) - 1)
+
+	// Read the items from the one containing the start, up to the end.
+	number := uint64(sort.Search(int(indexed), func(i int) bool { return r.offsets[i+1] > start }))
+	var n int
+	for number < indexed && r.offsets[number] < end {
+		count := uint64(sort.Search(int(indexed-number), func(i int) bool { return r.offsets[number+uint64(i)] >= end }))
+		if count > ancientReaderAtBatch {
+			count = ancientReaderAtBatch
+		}
+		items, err := r.items(number, count)
+		if err != nil {
+			return n, err
+		}
+		for i, item := range items {
+			if skip := r.offsets[number+uint64(i)]; skip < start {
+				item = item[start-skip:]
+			}
+			n += copy(p[n:], item)
+		}
+		number += count
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// index extends the index until covered reports true, or all the items are indexed.
+// The lock must be held.
+func (r *AncientReaderAt) index(covered func() bool) error {
+	if covered() {
+		return nil
+	}
+	frozen, err := r.db.Ancients()
+	if err != nil {
+		return err
+	}
+	for !covered() {
+		indexed := uint64(len(r.offsets) - 1)
+		if indexed >= frozen {
+			return nil
+		}
+		count := frozen - indexed
+		if count > ancientReaderAtBatch {
+			count = ancientReaderAtBatch
+		}
+		items, err := r.items(indexed, count)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			r.offsets = append(r.offsets, r.offsets[len(r.offsets)-1]+uint64(len(item)))
+		}
+	}
+	return nil
+}
+
+// items reads count items from start, in a single request if the ancient store
+// supports it.
+func (r *AncientReaderAt) items(start, count uint64) ([][]byte, error) {
+	if f, ok := r.db.(ancientRangeReader); ok {
+		return f.AncientRange(r.kind, start, count)
+	}
+	items := make([][]byte, count)
+	for i := range items {
+		blob, err := r.db.Ancient(r.kind, start+uint64(i))
+		if err != nil {
+			return nil, err
+		}
+		items[i] = blob
+	}
+	return items, nil
+}
@@ -0,0 +1,109 @@
+package rawdb
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/cmd/ancient-store-mem/lib"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// testAncientReaderAt checks the byte stream over the bodies of db, holding the
+// given number of items appended by fillAncientReaderAt.
+func testAncientReaderAt(t *testing.T, db ethdb.AncientReader, items uint64) {
+	reader := NewAncientReaderAt(db, freezerBodiesTable)
+
+	// Every item is read back at its offset.
+	var stream []byte
+	for i := uint64(0); i < items; i++ {
+		want, err := db.Ancient(freezerBodiesTable, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset, size, err := reader.Offset(i)
+		if err != nil {
+			t.Fatalf("item %d: failed to retrieve offset: %v", i, err)
+		}
+		if offset != uint64(len(stream)) || size != uint64(len(want)) {
+			t.Fatalf("item %d: offset %d, size %d, want %d, %d", i, offset, size, len(stream), len(want))
+		}
+		have := make([]byte, size)
+		if _, err := reader.ReadAt(have, int64(offset)); err != nil {
+			t.Fatalf("item %d: failed to read: %v", i, err)
+		}
+		if !bytes.Equal(have, want) {
+			t.Fatalf("item %d: have %x, want %x", i, have, want)
+		}
+		stream = append(stream, want...)
+	}
+	if size, err := reader.Size(); err != nil || size != int64(len(stream)) {
+		t.Fatalf("size mismatch: have %d (err %v), want %d", size, err, len(stream))
+	}
+	if _, _, err := reader.Offset(items); err == nil {
+		t.Fatalf("offset of unknown item returned")
+	}
+	// Ranges spanning items are read across them, up to the end of the stream.
+	have := make([]byte, 100)
+	if _, err := reader.ReadAt(have, 3); err != nil || !bytes.Equal(have, stream[3:103]) {
+		t.Fatalf("spanning read mismatch: have %x (err %v), want %x", have, err, stream[3:103])
+	}
+	n, err := reader.ReadAt(have, int64(len(stream)-10))
+	if err != io.EOF || n != 10 || !bytes.Equal(have[:n], stream[len(stream)-10:]) {
+		t.Fatalf("read beyond the end: have %d bytes %x (err %v), want %x", n, have[:n], err, stream[len(stream)-10:])
+	}
+}
+
+// fillAncientReaderAt appends items of varying sizes to the freezer.
+func fillAncientReaderAt(t *testing.T, freezer interface {
+	AppendAncient(number uint64, hash, header, body, receipt, td []byte) error
+}, items uint64) {
+	for i := uint64(0); i < items; i++ {
+		b := byte(i)
+		if err := freezer.AppendAncient(i, []byte{b}, []byte{b, 1}, bytes.Repeat([]byte{b}, int(i%7)+1), []byte{b, 3}, []byte{b, 4}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAncientReaderAt(t *testing.T) {
+	const items = 150
+
+	dir, err := ioutil.TempDir("", "freezer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDatabaseWithFreezer(NewMemoryDatabase(), dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fillAncientReaderAt(t, db, items)
+	testAncientReaderAt(t, db, items)
+}
+
+func TestAncientReaderAtRemote(t *testing.T) {
+	const items = 150
+
+	server := rpc.NewServer()
+	defer server.Stop()
+	if err := server.RegisterName("freezer", lib.NewMemFreezerRemoteServerAPI()); err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	client, err := NewFreezerRemoteClient(httpServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	fillAncientReaderAt(t, client, items)
+	testAncientReaderAt(t, &freezerdb{KeyValueStore: NewMemoryDatabase(), AncientStore: client}, items)
+}
@@ -0,0 +1,94 @@
+package rawdb
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// RebuildCanonicalFromFreezer restores the canonical number->hash mappings of the
+// frozen blocks into the key-value store, eg. after they were lost with it. Every
+// frozen header is checked against the frozen canonical hash, its number and its
+// parent before its mapping is written; the walk stops at the first inconsistency,
+// keeping the mappings of the blocks before. It returns the number of mappings
+// written.
+func RebuildCanonicalFromFreezer(db ethdb.Database) (uint64, error) {
+	frozen, err := db.Ancients()
+	if err != nil {
+		return 0, err
+	}
+	var tail uint64
+	if f, ok := db.(ancientTailReader); ok {
+		if tail, err = f.AncientTail(); err != nil {
+			return 0, err
+		}
+	}
+	var (
+		batch   = db.NewBatch()
+		start   = time.Now()
+		logged  = start
+		parent  common.Hash
+		number  = tail
+		written = tail // Number of the first block whose mapping wasn't written yet
+	)
+	for ; number < frozen; number++ {
+		if parent, err = checkFrozenHeader(db, number, parent); err != nil {
+			break
+		}
+		WriteCanonicalHash(batch, parent, number)
+
+		if batch.ValueSize() > ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return written - tail, err
+			}
+			batch.Reset()
+			written = number + 1
+		}
+		if time.Since(logged) > 8*time.Second {
+			log.Info("Rebuilding canonical hashes from freezer", "total", frozen, "number", number, "elapsed", common.PrettyDuration(time.Since(start)))
+			logged = time.Now()
+		}
+	}
+	if werr := batch.Write(); werr != nil {
+		return written - tail, werr
+	}
+	if err != nil {
+		log.Error("Stopped rebuilding canonical hashes from freezer", "number", number, "err", err)
+		return number - tail, err
+	}
+	log.Info("Rebuilt canonical hashes from freezer", "from", tail, "blocks", frozen-tail, "elapsed", common.PrettyDuration(time.Since(start)))
+	return frozen - tail, nil
+}
+
+// checkFrozenHeader checks the frozen header of the given number against the frozen
+// canonical hash, its number and, unless zero, the hash of its parent. It returns the
+// frozen canonical hash.
+func checkFrozenHeader(db ethdb.AncientReader, number uint64, parent common.Hash) (common.Hash, error) {
+	blob, err := db.Ancient(freezerHashTable, number)
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("frozen hash #%d: %v", number, err)
+	}
+	hash := common.BytesToHash(blob)
+	if blob, err = db.Ancient(freezerHeaderTable, number); err != nil {
+		return common.Hash{}, fmt.Errorf("frozen header #%d: %v", number, err)
+	}
+	header := new(types.Header)
+	if err := rlp.DecodeBytes(blob, header); err != nil {
+		return common.Hash{}, fmt.Errorf("undecodable frozen header #%d: %v", number, err)
+	}
+	if have := header.Hash(); have != hash {
+		return common.Hash{}, fmt.Errorf("frozen header #%d hash %x, canonical %x", number, have, hash)
+	}
+	if header.Number == nil || header.Number.Uint64() != number {
+		return common.Hash{}, fmt.Errorf("frozen header #%d number %v", number, header.Number)
+	}
+	if parent != (common.Hash{}) && header.ParentHash != parent {
+		return common.Hash{}, fmt.Errorf("frozen header #%d parent hash %x, parent %x", number, header.ParentHash, parent)
+	}
+	return hash, nil
+}
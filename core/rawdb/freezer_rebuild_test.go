@@ -0,0 +1,86 @@
+package rawdb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/cmd/ancient-store-mem/lib"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// Tests that the canonical hashes of the frozen blocks are restored into a key-value
+// store which lost them.
+func TestRebuildCanonicalFromFreezer(t *testing.T) {
+	const head = 64
+
+	dir, err := ioutil.TempDir("", "freezer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDatabaseWithFreezer(NewMemoryDatabase(), dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	writeTestChain(db, head)
+	kvdb := NewDatabase(db.(*freezerdb).KeyValueStore)
+	original := make([]common.Hash, head+1)
+	for i := range original {
+		original[i] = ReadCanonicalHash(kvdb, uint64(i))
+	}
+	db.(*freezerdb).Freeze(0)
+	if frozen, _ := db.Ancients(); frozen != head+1 {
+		t.Fatalf("frozen blocks mismatch: have %d, want %d", frozen, head+1)
+	}
+	// Drop the canonical index from the key-value store, and rebuild it
+	for i := range original {
+		DeleteCanonicalHash(db, uint64(i))
+	}
+	if n, err := RebuildCanonicalFromFreezer(db); err != nil || n != head+1 {
+		t.Fatalf("rebuild: have %d mappings (err %v), want %d", n, err, head+1)
+	}
+	for i, want := range original {
+		if have := ReadCanonicalHash(kvdb, uint64(i)); have != want {
+			t.Errorf("block #%d: have %x, want %x", i, have, want)
+		}
+	}
+}
+
+// Tests that rebuilding the canonical hashes stops at a frozen header which doesn't
+// match its canonical hash, keeping the mappings of the blocks before it.
+func TestRebuildCanonicalFromFreezerCorrupt(t *testing.T) {
+	mem := lib.NewMemFreezerRemoteServerAPI()
+	server := rpc.NewServer()
+	defer server.Stop()
+	if err := server.RegisterName("freezer", mem); err != nil {
+		t.Fatal(err)
+	}
+	frClient := &FreezerRemoteClient{client: rpc.DialInProc(server), quit: make(chan struct{}), threshold: 16}
+	db := &freezerdb{KeyValueStore: NewMemoryDatabase(), AncientStore: frClient}
+
+	writeTestChain(db, 64)
+	if _, err := frClient.freezeUpTo(context.Background(), db, 40); err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.Corrupt(FreezerRemoteHashTable, 30); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := RebuildCanonicalFromFreezer(db); err == nil || n != 30 {
+		t.Fatalf("rebuild: have %d mappings (err %v), want 30 and an error", n, err)
+	}
+	kvdb := NewDatabase(db.KeyValueStore)
+	for i := uint64(0); i < 30; i++ {
+		if hash := ReadCanonicalHash(kvdb, i); hash == (common.Hash{}) {
+			t.Errorf("block #%d: mapping not rebuilt", i)
+		}
+	}
+	if hash := ReadCanonicalHash(kvdb, 30); hash != (common.Hash{}) {
+		t.Errorf("block #30: mapping of corrupt header rebuilt")
+	}
+}
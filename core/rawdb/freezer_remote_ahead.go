@@ -0,0 +1,126 @@
+package rawdb
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// FreezerRemoteAheadPolicy defines how opening a database with a remote freezer treats
+// a freezer holding blocks beyond the head header of the key-value store, eg. because
+// another writer advanced it.
+type FreezerRemoteAheadPolicy int32
+
+const (
+	// FreezerRemoteAheadTruncate truncates the remote freezer back to the head header
+	// of the key-value store. This is the default.
+	FreezerRemoteAheadTruncate FreezerRemoteAheadPolicy = iota
+
+	// FreezerRemoteAheadTrust adopts the height of the remote freezer, advancing the
+	// head header and the head fast block of the key-value store to its last block,
+	// provided the freezer extends the chain of the key-value store. The blockchain
+	// keeps the freezer ahead of its head block, which lacks the state of the frozen
+	// blocks, and carries on importing blocks from it.
+	FreezerRemoteAheadTrust
+)
+
+func (p FreezerRemoteAheadPolicy) String() string {
+	switch p {
+	case FreezerRemoteAheadTruncate:
+		return "truncate-remote"
+	case FreezerRemoteAheadTrust:
+		return "trust-remote"
+	default:
+		return fmt.Sprintf("unknown(%d)", int32(p))
+	}
+}
+
+// freezerRemoteAheadPolicy is the FreezerRemoteAheadPolicy of the databases opened
+// (atomic), see SetFreezerRemoteAheadPolicy.
+var freezerRemoteAheadPolicy int32
+
+// SetFreezerRemoteAheadPolicy sets how databases opened afterwards treat a remote
+// freezer ahead of the head header of their key-value store.
+func SetFreezerRemoteAheadPolicy(policy FreezerRemoteAheadPolicy) {
+	atomic.StoreInt32(&freezerRemoteAheadPolicy, int32(policy))
+}
+
+// GetFreezerRemoteAheadPolicy returns how databases opened treat a remote freezer ahead
+// of the head header of their key-value store, see SetFreezerRemoteAheadPolicy.
+func GetFreezerRemoteAheadPolicy() FreezerRemoteAheadPolicy {
+	return FreezerRemoteAheadPolicy(atomic.LoadInt32(&freezerRemoteAheadPolicy))
+}
+
+// reconcileFreezerRemoteAhead applies the FreezerRemoteAheadPolicy to a remote freezer
+// of frozen items ahead of the key-value store, see freezerRemoteAhead.
+func reconcileFreezerRemoteAhead(db ethdb.KeyValueStore, frdb ethdb.AncientStore, frozen uint64) error {
+	var (
+		headHash   = ReadHeadHeaderHash(db)
+		headNumber = ReadHeaderNumber(db, headHash)
+		policy     = GetFreezerRemoteAheadPolicy()
+	)
+	if headNumber == nil {
+		return fmt.Errorf("head header %x number missing", headHash)
+	}
+	switch policy {
+	case FreezerRemoteAheadTruncate:
+		log.Error("Remote freezer ahead of the key-value store, truncating it", "ancients", frozen, "head", *headNumber, "hash", headHash)
+		if err := frdb.TruncateAncients(*headNumber + 1); err != nil {
+			return fmt.Errorf("failed to truncate remote freezer ahead of the key-value store: %w", err)
+		}
+		return frdb.Sync()
+
+	case FreezerRemoteAheadTrust:
+		// The freezer must extend the chain of the key-value store
+		blob, err := frdb.Ancient(freezerHashTable, *headNumber)
+		if err != nil {
+			return fmt.Errorf("frozen hash #%d: %v", *headNumber, err)
+		}
+		if !bytes.Equal(blob, headHash.Bytes()) {
+			return fmt.Errorf("remote freezer ahead of the key-value store on another chain: #%d %x (leveldb) != %x (ancients)", *headNumber, headHash, blob)
+		}
+		log.Error("Remote freezer ahead of the key-value store, adopting its height", "ancients", frozen, "head", *headNumber, "hash", headHash)
+		var (
+			batch  = db.NewBatch()
+			parent = headHash
+		)
+		for number := *headNumber + 1; number < frozen; number++ {
+			if parent, err = checkFrozenHeader(frdb, number, parent); err != nil {
+				return err
+			}
+			WriteHeaderNumber(batch, parent, number)
+			if batch.ValueSize() > ethdb.IdealBatchSize {
+				if err := batch.Write(); err != nil {
+					return err
+				}
+				batch.Reset()
+			}
+		}
+		WriteHeadHeaderHash(batch, parent)
+		WriteHeadFastBlockHash(batch, parent)
+		if err := batch.Write(); err != nil {
+			return err
+		}
+		log.Warn("Adopted remote freezer height", "number", frozen-1, "hash", parent)
+		return nil
+
+	default:
+		return fmt.Errorf("unknown remote freezer ahead policy %v", policy)
+	}
+}
+
+// freezerRemoteAhead reports whether the frozen items of a remote freezer extend beyond
+// the head header of the key-value store. A key-value store holding only the genesis
+// is not behind, but about to be reinitialized from the freezer.
+func freezerRemoteAhead(db ethdb.KeyValueStore, frozen uint64) bool {
+	headHash := ReadHeadHeaderHash(db)
+	if headHash == (common.Hash{}) || headHash == ReadCanonicalHash(NewDatabase(db), 0) {
+		return false
+	}
+	headNumber := ReadHeaderNumber(db, headHash)
+	return headNumber != nil && *headNumber+1 < frozen
+}
@@ -0,0 +1,116 @@
+package rawdb
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/cmd/ancient-store-mem/lib"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// Tests that a remote freezer ahead of the key-value store it's opened with is either
+// truncated back to its head, or its height adopted, according to the policy.
+func TestFreezerRemoteAheadPolicy(t *testing.T) {
+	defer SetFreezerRemoteAheadPolicy(FreezerRemoteAheadTruncate)
+
+	for _, policy := range []FreezerRemoteAheadPolicy{FreezerRemoteAheadTruncate, FreezerRemoteAheadTrust} {
+		t.Run(policy.String(), func(t *testing.T) {
+			server := rpc.NewServer()
+			defer server.Stop()
+			if err := server.RegisterName("freezer", lib.NewMemFreezerRemoteServerAPI()); err != nil {
+				t.Fatal(err)
+			}
+			httpServer := httptest.NewServer(server)
+			defer httpServer.Close()
+
+			// Another writer froze blocks #0-#39 of the chain
+			writer := &FreezerRemoteClient{client: rpc.DialInProc(server), quit: make(chan struct{}), threshold: 16}
+			writerdb := NewMemoryDatabase()
+			writeTestChain(writerdb, 64)
+			if _, err := writer.freezeUpTo(context.Background(), writerdb, 40); err != nil {
+				t.Fatal(err)
+			}
+			// The key-value store only reached #20 of the same chain
+			kvdb := NewMemoryDatabase()
+			writeTestChain(kvdb, 20)
+			head := ReadHeadBlockHash(kvdb)
+			WriteHeadHeaderHash(kvdb, head)
+
+			SetFreezerRemoteAheadPolicy(policy)
+			db, err := NewDatabaseWithFreezerRemote(kvdb, httpServer.URL)
+			if err != nil {
+				t.Fatalf("failed to open database: %v", err)
+			}
+			defer db.Close()
+
+			frozen, err := db.Ancients()
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch policy {
+			case FreezerRemoteAheadTruncate:
+				if frozen != 21 {
+					t.Errorf("ancients: have %d, want 21", frozen)
+				}
+				if have := ReadHeadHeaderHash(db); have != head {
+					t.Errorf("head header: have %x, want %x", have, head)
+				}
+			case FreezerRemoteAheadTrust:
+				if frozen != 40 {
+					t.Errorf("ancients: have %d, want 40", frozen)
+				}
+				want := ReadCanonicalHash(db, 39)
+				if have := ReadHeadHeaderHash(db); have != want {
+					t.Errorf("head header: have %x, want %x", have, want)
+				}
+				if have := ReadHeadFastBlockHash(db); have != want {
+					t.Errorf("head fast block: have %x, want %x", have, want)
+				}
+				if number := ReadHeaderNumber(db, want); number == nil || *number != 39 {
+					t.Errorf("head header number: have %v, want 39", number)
+				}
+			}
+		})
+	}
+}
+
+// Tests that a remote freezer ahead of the key-value store on another chain is not
+// trusted.
+func TestFreezerRemoteAheadTrustOtherChain(t *testing.T) {
+	defer SetFreezerRemoteAheadPolicy(FreezerRemoteAheadTruncate)
+
+	server := rpc.NewServer()
+	defer server.Stop()
+	if err := server.RegisterName("freezer", lib.NewMemFreezerRemoteServerAPI()); err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	writer := &FreezerRemoteClient{client: rpc.DialInProc(server), quit: make(chan struct{}), threshold: 16}
+	writerdb := NewMemoryDatabase()
+	writeTestChain(writerdb, 64)
+	if _, err := writer.freezeUpTo(context.Background(), writerdb, 40); err != nil {
+		t.Fatal(err)
+	}
+	// Fork the head of the key-value store off the frozen chain
+	kvdb := NewMemoryDatabase()
+	writeTestChain(kvdb, 20)
+	fork := ReadHeader(kvdb, ReadCanonicalHash(kvdb, 20), 20)
+	fork.Extra = []byte("fork")
+	WriteHeader(kvdb, fork)
+	WriteCanonicalHash(kvdb, fork.Hash(), 20)
+	WriteHeadHeaderHash(kvdb, fork.Hash())
+
+	SetFreezerRemoteAheadPolicy(FreezerRemoteAheadTrust)
+	db, err := NewDatabaseWithFreezerRemote(kvdb, httpServer.URL)
+	if err == nil {
+		db.Close()
+		t.Fatalf("remote freezer on another chain trusted")
+	}
+	if !strings.Contains(err.Error(), "another chain") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
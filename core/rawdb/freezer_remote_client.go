@@ -1,25 +1,77 @@
 package rawdb
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/params/vars"
 	"github.com/ethereum/go-ethereum/rpc"
+	lru "github.com/hashicorp/golang-lru"
 )
 
 // FreezerRemoteClient is an RPC client implementing the interface of ethdb.AncientStore.
 // The struct's methods delegate the business logic to an external server
 // that is responsible for managing an actual ancient store.
 type FreezerRemoteClient struct {
+	maxResponseSize uint64 // Maximum size of a single ancient item accepted from the server (atomic, 0 = default)
+	unlimitedConns  bool   // Whether a connection's transport buffers responses before their size is checked
+
 	client    *rpc.Client
+	readers   chan *rpc.Client // Idle connections of the read pool, nil if reads share client
+	readPool  []*rpc.Client    // All connections of the read pool
+	writeMu   sync.Mutex       // Serializes writes to preserve append ordering
+	cache     *lru.Cache       // Read-through cache of ancient items, nil if disabled
+	cacheGen  uint64           // Truncation counter, guarding the cache against racing reads (atomic)
 	quit      chan struct{}
 	threshold uint64             // Number of recent blocks not to freeze (params.FullImmutabilityThreshold apart from tests)
 	trigger   chan chan struct{} // Manual blocking freeze trigger, test determinism
 	closeOnce sync.Once
+	info      *FreezerRemoteInfo // Server info fetched on connect, nil if not reported
+
+	replicas    chan *rpc.Client // Idle connections to the read replicas, nil if there are none
+	replicaPool []*rpc.Client    // All connections to the read replicas
+
+	serializer FreezerSerializer // Serializer of the stored payloads, nil for RLP passthrough
+
+	readAhead *freezerReadAhead // Prefetcher of sequential reads, nil if disabled
+
+	ancients uint64 // Number of items the server last reported frozen, bounding read retries (atomic)
+
+	staleRetries int           // Number of retries of reads of items not yet frozen, 0 if disabled
+	staleBackoff time.Duration // Wait before the first retry of a stale read, doubled by every further one
+
+	readOnly   int32         // 1 if another client holds the write lease, writes are refused (atomic)
+	leaseOwner string        // Identifier of the client's write lease, empty if the server has no leases
+	leaseQuit  chan struct{} // Stops the lease renewal, nil if it was not started
+
+	batchMu       sync.Mutex      // Protects the fields of the write batch
+	batch         []rpc.BatchElem // Appends not yet sent to the server
+	batchSize     int             // Number of appends flushed at once, 0 if appends are not batched
+	batchInterval time.Duration   // Maximum time an append is held back, 0 if unbounded
+	batchTimer    *time.Timer     // Pending interval flush, nil if none is scheduled
+	batchErr      error           // Error of the last interval flush, reported by the next write
+
+	freezeFeed event.Feed // Feed announcing ranges moved from the key-value store into the freezer
+	freezeMu   sync.Mutex // Serializes freezing batches of the background loop and freezeUpTo
+
+	guard freezerDiskGuard // Pauses freezing while the server's free disk space is low
 }
 
 const (
@@ -28,58 +80,900 @@ const (
 	FreezerMethodAncient          = "freezer_ancient"
 	FreezerMethodAncients         = "freezer_ancients"
 	FreezerMethodAncientSize      = "freezer_ancientSize"
+	FreezerMethodAncientKinds     = "freezer_ancientKinds"
 	FreezerMethodAppendAncient    = "freezer_appendAncient"
 	FreezerMethodTruncateAncients = "freezer_truncateAncients"
 	FreezerMethodSync             = "freezer_sync"
+	FreezerMethodInfo             = "freezer_info"
+	FreezerMethodState            = "freezer_state"
+	FreezerMethodAcquireLease     = "freezer_acquireLease"
+	FreezerMethodReleaseLease     = "freezer_releaseLease"
 )
 
-// newFreezerRemoteClient constructs a rpc client to connect to a remote freezer
-func newFreezerRemoteClient(endpoint string) (*FreezerRemoteClient, error) {
-	client, err := rpc.Dial(endpoint)
-	if err != nil {
-		return nil, err
+// FreezerRemoteState is the remote freezer's view of the item counts relevant to
+// reconciling the chain head pointers, as reported by freezer_state.
+type FreezerRemoteState struct {
+	Ancients uint64            `json:"ancients"` // Number of frozen items, as by Ancients
+	Tail     uint64            `json:"tail"`     // Number of the first item stored, 0 unless the server discards old items
+	Kinds    map[string]uint64 `json:"kinds"`    // Number of items per kind, as by AncientKinds
+}
+
+// FreezerRemoteInfo describes a remote freezer server, as reported by freezer_info.
+type FreezerRemoteInfo struct {
+	Version  string                `json:"version"`
+	Commit   string                `json:"commit"`
+	Features FreezerRemoteFeatures `json:"features"`
+}
+
+// FreezerRemoteFeatures are the optional capabilities of a remote freezer server.
+type FreezerRemoteFeatures struct {
+	Compression bool `json:"compression"` // Items are stored compressed
+	Batch       bool `json:"batch"`       // Batch requests are supported
+	Namespaces  bool `json:"namespaces"`  // Multiple isolated stores are served
+
+	// Appends accept a trailing idempotency key, a retried append which already
+	// landed succeeds without being written twice.
+	IdempotentAppend bool `json:"idempotentAppend"`
+
+	// An exclusive write lease is granted to a single client at a time, see
+	// freezer_acquireLease.
+	Lease bool `json:"lease"`
+
+	// Names of the payload serializations supported besides the RLP passthrough,
+	// see FreezerSerializer.
+	Serializers []string `json:"serializers,omitempty"`
+}
+
+var (
+	// ErrFreezerRemoteNotFound is returned when the remote freezer does not have the requested item.
+	ErrFreezerRemoteNotFound = errors.New("remote freezer item not found")
+
+	// ErrNotYetFrozen is returned when an ancient item is requested from the remote freezer
+	// for a number at or above its Ancients(), so callers may fall back to the key-value store.
+	// It wraps ErrFreezerRemoteNotFound.
+	ErrNotYetFrozen = fmt.Errorf("%w: not yet frozen", ErrFreezerRemoteNotFound)
+
+	// ErrFreezerRemoteUnauthorized is returned when the remote freezer rejects the client's credentials.
+	ErrFreezerRemoteUnauthorized = errors.New("remote freezer unauthorized")
+
+	// ErrFreezerRemoteProtocol is returned when the remote freezer does not understand the request,
+	// or responds with something the client does not understand; eg. because of an API version mismatch.
+	ErrFreezerRemoteProtocol = errors.New("remote freezer protocol error")
+
+	// ErrFreezerRemoteTransient is returned for transport failures which may go away on retry.
+	ErrFreezerRemoteTransient = errors.New("remote freezer transient transport error")
+
+	// ErrFreezerRemoteResponseTooLarge is returned when a remote freezer response exceeds
+	// the client's maximum response size.
+	ErrFreezerRemoteResponseTooLarge = errors.New("remote freezer response too large")
+
+	// ErrFreezerRemoteResponseLimitUnsupported is returned when setting the maximum
+	// response size of a client connected over a transport which can't enforce it.
+	ErrFreezerRemoteResponseLimitUnsupported = errors.New("remote freezer response size limit unsupported by transport")
+
+	// ErrFreezerRemoteReadOnly is returned for writes of a client which was refused the
+	// write lease of the remote freezer, because another client holds it.
+	ErrFreezerRemoteReadOnly = errors.New("remote freezer read-only: write lease held by another client")
+)
+
+// DefaultFreezerRemoteMaxResponseSize is the default maximum size of a single ancient
+// item accepted from a remote freezer. Real chain items are orders of magnitude smaller.
+const DefaultFreezerRemoteMaxResponseSize = 256 * 1024 * 1024
+
+// freezerRemoteResponseOverhead is the allowance for the JSON-RPC envelope around
+// an ancient item, on top of its base64 encoded size.
+const freezerRemoteResponseOverhead = 4096
+
+// freezerRemoteLeaseTTL is the time a write lease lapses after unless renewed. Leases
+// are renewed three times per TTL.
+const freezerRemoteLeaseTTL = 30 * time.Second
+
+// freezeBacklogGauge tracks the number of blocks the remote freezing loop found old
+// enough to freeze, but still in the key-value store.
+var freezeBacklogGauge = metrics.NewRegisteredGauge("ancient/backlog", nil)
+
+// freezeVerbosity is the level of detail of the remote freezing loop's logs (atomic),
+// see SetFreezeVerbosity.
+var freezeVerbosity int32
+
+// SetFreezeVerbosity sets the level of detail the remote freezing loop logs frozen
+// blocks with, eg. to follow a migration closely:
+//
+//   - 0: only a summary of every frozen chain segment (default)
+//   - 1: also the block range, byte count and round-trip time of every batch
+//   - 2: also the byte count and round-trip time of every frozen block
+func SetFreezeVerbosity(verbosity int) {
+	atomic.StoreInt32(&freezeVerbosity, int32(verbosity))
+}
+
+// freezerRemoteAppendRetries is the number of times an append failing with a transient
+// error is retried, if the server deduplicates appends by idempotency key.
+const freezerRemoteAppendRetries = 3
+
+// freezerRemoteReadRetries is the number of times an ancient read failing with a
+// transient error is retried, waiting freezerRemoteReadBackoff before the first retry
+// and twice as long before every further one. This bridges a restart of the server.
+const (
+	freezerRemoteReadRetries = 6
+	freezerRemoteReadBackoff = 50 * time.Millisecond
+)
+
+// classifyFreezerRemoteError wraps an error returned by the RPC client with one of the
+// ErrFreezerRemote* errors, if it can be classified. Unclassified errors are returned as-is.
+func classifyFreezerRemoteError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var (
+		rpcErr    rpc.Error
+		netErr    net.Error
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+	)
+	switch {
+	case errors.Is(err, ErrFreezerRemoteResponseTooLarge), errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return err
+	case errors.As(err, &rpcErr):
+		switch rpcErr.ErrorCode() {
+		case -32600, -32601, -32602, -32700:
+			return fmt.Errorf("%w: %v", ErrFreezerRemoteProtocol, err)
+		}
+		if msg := err.Error(); strings.Contains(msg, errOutOfBounds.Error()) || strings.Contains(msg, "not found") {
+			return fmt.Errorf("%w: %v", ErrFreezerRemoteNotFound, err)
+		}
+		return err
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return fmt.Errorf("%w: %v", ErrFreezerRemoteProtocol, err)
+	case errors.As(err, &netErr), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, rpc.ErrClientQuit):
+		return fmt.Errorf("%w: %v", ErrFreezerRemoteTransient, err)
 	}
-	return &FreezerRemoteClient{
-		client:    client,
+	// HTTP transports report non-2xx responses as errors carrying only the status line.
+	if fields := strings.Fields(err.Error()); len(fields) > 0 {
+		if code, cerr := strconv.Atoi(fields[0]); cerr == nil && http.StatusText(code) != "" {
+			switch {
+			case code == http.StatusUnauthorized || code == http.StatusForbidden:
+				return fmt.Errorf("%w: %v", ErrFreezerRemoteUnauthorized, err)
+			case code == http.StatusNotFound || code == http.StatusMethodNotAllowed || code == http.StatusUnsupportedMediaType:
+				return fmt.Errorf("%w: %v", ErrFreezerRemoteProtocol, err)
+			case code == http.StatusTooManyRequests || code >= 500:
+				return fmt.Errorf("%w: %v", ErrFreezerRemoteTransient, err)
+			}
+		}
+	}
+	return err
+}
+
+// NewFreezerRemoteClient constructs a rpc client to connect to a remote freezer.
+func NewFreezerRemoteClient(endpoint string) (*FreezerRemoteClient, error) {
+	return NewFreezerRemoteClientWithPool(endpoint, 0)
+}
+
+// NewFreezerRemoteClientWithPool constructs a rpc client to connect to a remote freezer,
+// serving reads over a pool of up to poolSize additional connections so concurrent
+// reads do not contend on a single transport. Writes always use a single connection
+// and are serialized. A poolSize of zero or one disables pooling.
+func NewFreezerRemoteClientWithPool(endpoint string, poolSize int) (*FreezerRemoteClient, error) {
+	api := &FreezerRemoteClient{
 		threshold: vars.FullImmutabilityThreshold,
 		quit:      make(chan struct{}),
 		trigger:   make(chan chan struct{}),
-	}, nil
+	}
+	var err error
+	if api.client, err = api.dial(endpoint); err != nil {
+		return nil, err
+	}
+	api.info = api.fetchInfo(endpoint)
+	if api.info != nil && api.info.Features.Lease {
+		if err := api.acquireLease(endpoint); err != nil {
+			api.client.Close()
+			return nil, err
+		}
+	}
+	if poolSize > 1 {
+		api.readers = make(chan *rpc.Client, poolSize)
+		for i := 0; i < poolSize; i++ {
+			client, err := api.dial(endpoint)
+			if err != nil {
+				api.closeClients()
+				return nil, err
+			}
+			api.readPool = append(api.readPool, client)
+			api.readers <- client
+		}
+	}
+	return api, nil
+}
+
+// NewFreezerRemoteClientWithReplicas constructs a rpc client to connect to a remote
+// freezer, serving ancient item reads from the given read replicas of it. Reads are
+// spread over the replicas not busy with another read, in turns; item counts are
+// always read from, and writes always go to, the primary endpoint. Items a replica
+// fails to serve, eg. because it lags behind the primary, are read from the primary.
+func NewFreezerRemoteClientWithReplicas(endpoint string, replicas []string) (*FreezerRemoteClient, error) {
+	api, err := NewFreezerRemoteClient(endpoint)
+	if err != nil || len(replicas) == 0 {
+		return api, err
+	}
+	api.replicas = make(chan *rpc.Client, len(replicas))
+	for _, replica := range replicas {
+		client, err := api.dial(replica)
+		if err != nil {
+			api.closeClients()
+			return nil, fmt.Errorf("replica %s: %v", replica, err)
+		}
+		api.replicaPool = append(api.replicaPool, client)
+		api.replicas <- client
+	}
+	return api, nil
+}
+
+// closeClients stops renewing the write lease and closes the connections of a client
+// being closed or failing to construct, leaving the remote freezer open for others.
+func (api *FreezerRemoteClient) closeClients() {
+	if api.leaseQuit != nil {
+		api.closeOnce.Do(func() { close(api.leaseQuit) })
+	}
+	api.client.Close()
+	for _, client := range api.readPool {
+		client.Close()
+	}
+	for _, client := range api.replicaPool {
+		client.Close()
+	}
+}
+
+// fetchInfo retrieves and logs the server info. Servers not implementing freezer_info
+// are still usable, nil is returned for them.
+func (api *FreezerRemoteClient) fetchInfo(endpoint string) *FreezerRemoteInfo {
+	info := new(FreezerRemoteInfo)
+	if err := api.call(info, FreezerMethodInfo); err != nil {
+		log.Warn("Remote freezer info unavailable", "freezer", endpoint, "err", err)
+		return nil
+	}
+	log.Info("Connected to remote freezer", "freezer", endpoint, "version", info.Version, "commit", info.Commit,
+		"compression", info.Features.Compression, "batch", info.Features.Batch, "namespaces", info.Features.Namespaces,
+		"idempotent", info.Features.IdempotentAppend, "serializers", info.Features.Serializers)
+	return info
+}
+
+// acquireLease requests the write lease of the server under a random owner identifier,
+// renewing it in the background if granted. If another client holds the lease, the
+// client is limited to reads.
+func (api *FreezerRemoteClient) acquireLease(endpoint string) error {
+	owner := make([]byte, 16)
+	rand.Read(owner)
+	api.leaseOwner = hex.EncodeToString(owner)
+
+	var granted bool
+	if err := api.call(&granted, FreezerMethodAcquireLease, api.leaseOwner, uint64(freezerRemoteLeaseTTL/time.Second)); err != nil {
+		return err
+	}
+	if !granted {
+		log.Warn("Remote freezer write lease held by another client, limited to reads", "freezer", endpoint)
+		atomic.StoreInt32(&api.readOnly, 1)
+		return nil
+	}
+	api.leaseQuit = make(chan struct{})
+	go api.renewLease(endpoint, api.leaseQuit)
+	return nil
+}
+
+// renewLease renews the write lease until quit is closed. If the lease was lost
+// meanwhile, eg. because renewals failed for longer than its TTL and another client
+// took it over, the client is limited to reads.
+func (api *FreezerRemoteClient) renewLease(endpoint string, quit chan struct{}) {
+	ticker := time.NewTicker(freezerRemoteLeaseTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			var granted bool
+			if err := api.call(&granted, FreezerMethodAcquireLease, api.leaseOwner, uint64(freezerRemoteLeaseTTL/time.Second)); err != nil {
+				log.Warn("Failed to renew remote freezer write lease", "freezer", endpoint, "err", err)
+				continue
+			}
+			if !granted {
+				log.Error("Remote freezer write lease lost to another client, limited to reads", "freezer", endpoint)
+				atomic.StoreInt32(&api.readOnly, 1)
+				return
+			}
+		case <-quit:
+			return
+		}
+	}
+}
+
+// ReadOnly returns whether the client is limited to reads, because another client
+// holds the write lease of the server.
+func (api *FreezerRemoteClient) ReadOnly() bool {
+	return atomic.LoadInt32(&api.readOnly) == 1
+}
+
+// FreezerInfo returns the server info reported when the client connected, or nil
+// if the server did not report any.
+func (api *FreezerRemoteClient) FreezerInfo() *FreezerRemoteInfo {
+	return api.info
+}
+
+// freezerRemoteCacheKey identifies an ancient item in the read cache.
+type freezerRemoteCacheKey struct {
+	kind   string
+	number uint64
+}
+
+// SetReadCache enables a read-through cache of the given number of ancient items,
+// replacing any existing one. Zero disables the cache. Ancient items are immutable
+// once frozen, entries are only dropped when they are truncated away.
+//
+// The method must be called before the client is used concurrently.
+func (api *FreezerRemoteClient) SetReadCache(items int) {
+	if items <= 0 {
+		api.cache = nil
+		return
+	}
+	api.cache, _ = lru.New(items)
+}
+
+// Warmup reads all kinds of the most recent given number of frozen blocks into the
+// read cache, so the hot range is primed before being served. It enables a cache
+// large enough for the range if there is none. Zero blocks disables warming up.
+func (api *FreezerRemoteClient) Warmup(blocks uint64) error {
+	if blocks == 0 {
+		return nil
+	}
+	if api.cache == nil {
+		api.SetReadCache(int(blocks) * len(freezerKinds))
+	}
+	frozen, err := api.Ancients()
+	if err != nil {
+		return err
+	}
+	first := uint64(0)
+	if frozen > blocks {
+		first = frozen - blocks
+	}
+	start := time.Now()
+	for number := frozen; number > first; number-- {
+		for _, kind := range freezerKinds {
+			if _, err := api.Ancient(kind, number-1); err != nil {
+				return fmt.Errorf("warmup %s #%d: %w", kind, number-1, err)
+			}
+		}
+	}
+	log.Info("Warmed up remote freezer cache", "blocks", frozen-first, "first", first, "elapsed", common.PrettyDuration(time.Since(start)))
+	return nil
+}
+
+// SetStaleReadRetry makes reads of items a read replica reports as not found, though
+// the primary froze them, retry on the replicas up to the given number of times,
+// waiting backoff before the first retry and twice as long before every further one,
+// before falling back to the primary. This tolerates the replication lag of the
+// replicas without loading the primary. Reads of items the primary did not freeze
+// yet are not retried. Zero retries, the default, disables retrying.
+//
+// The method must be called before the client is used concurrently.
+func (api *FreezerRemoteClient) SetStaleReadRetry(retries int, backoff time.Duration) {
+	if retries < 0 {
+		retries = 0
+	}
+	api.staleRetries, api.staleBackoff = retries, backoff
+}
+
+// SetSerializer selects the serialization of the payloads stored by the server, which
+// must support it as reported by freezer_info. The RLP passthrough, selected by a nil
+// serializer, is always supported and the default. Clients of the same server must use
+// the same serialization.
+//
+// The method must be called before the client is used concurrently.
+func (api *FreezerRemoteClient) SetSerializer(serializer FreezerSerializer) error {
+	if serializer == nil || serializer.Name() == FreezerSerializerRLPName {
+		api.serializer = nil
+		return nil
+	}
+	if api.info != nil {
+		for _, name := range api.info.Features.Serializers {
+			if name == serializer.Name() {
+				api.serializer = serializer
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: serializer %q not supported by the server", ErrFreezerRemoteProtocol, serializer.Name())
+}
+
+// SetWriteBatch enables batching of appends: up to size appends are held back and
+// sent to the server in a single batch request, once the batch is full, or at least
+// every interval after the first pending append. A zero interval flushes on size only.
+// Pending appends are also flushed before any other call, so they are always visible
+// to reads. A size of zero or one disables batching, flushing any pending appends.
+//
+// Errors of interval flushes are returned by the next write. The appends a flush failed
+// to send stay pending, and are sent again by the next flush.
+func (api *FreezerRemoteClient) SetWriteBatch(size int, interval time.Duration) error {
+	api.batchMu.Lock()
+	defer api.batchMu.Unlock()
+
+	err := api.flushLocked()
+	if size <= 1 {
+		size, interval = 0, 0
+	}
+	api.batchSize, api.batchInterval = size, interval
+	return err
+}
+
+// flush sends any pending appends to the server.
+func (api *FreezerRemoteClient) flush() error {
+	api.batchMu.Lock()
+	defer api.batchMu.Unlock()
+	return api.flushLocked()
+}
+
+// flushLocked sends any pending appends to the server, returning the first error
+// encountered, including that of an earlier interval flush. Appends which failed, and
+// those following them, stay pending and are sent again by the next flush; a batch
+// failing as a whole is sent again entirely. The caller must hold batchMu.
+func (api *FreezerRemoteClient) flushLocked() error {
+	if api.batchTimer != nil {
+		api.batchTimer.Stop()
+		api.batchTimer = nil
+	}
+	if err := api.batchErr; err != nil {
+		api.batchErr = nil
+		return err
+	}
+	if len(api.batch) == 0 {
+		return nil
+	}
+	batch := api.batch
+
+	api.writeMu.Lock()
+	defer api.writeMu.Unlock()
+	if err := api.retryAppend(func() error {
+		for i := range batch {
+			batch[i].Error = nil
+		}
+		return classifyFreezerRemoteError(api.client.BatchCall(batch))
+	}); err != nil {
+		return err
+	}
+	for i, elem := range batch {
+		if elem.Error != nil {
+			// The server applies the appends in order, the ones before went through
+			api.batch = batch[i:]
+			return classifyFreezerRemoteError(elem.Error)
+		}
+	}
+	api.batch = nil
+	return nil
+}
+
+// dial opens a new RPC connection to the remote freezer.
+func (api *FreezerRemoteClient) dial(endpoint string) (*rpc.Client, error) {
+	if strings.HasPrefix(endpoint, "http://") || strings.HasPrefix(endpoint, "https://") {
+		// Over HTTP the response size is limited while reading the body, so an
+		// oversized response is aborted before being buffered completely.
+		return rpc.DialHTTPWithClient(endpoint, &http.Client{
+			Transport: &freezerRemoteLimitTransport{api: api, next: http.DefaultTransport},
+		})
+	}
+	api.unlimitedConns = true
+	return rpc.Dial(endpoint)
+}
+
+// SetMaxResponseSize sets the maximum size of a single ancient item accepted from the
+// remote freezer. Zero restores DefaultFreezerRemoteMaxResponseSize.
+//
+// Only HTTP connections are protected from oversized responses, which are aborted as
+// soon as they exceed the limit. The RPC package reads the responses of the other
+// transports, such as IPC and websockets, completely before their size can be
+// checked, so ErrFreezerRemoteResponseLimitUnsupported is returned if any connection
+// of the client, including those of its read pool and replicas, uses one. These
+// still reject decoded items over DefaultFreezerRemoteMaxResponseSize.
+func (api *FreezerRemoteClient) SetMaxResponseSize(size uint64) error {
+	if api.unlimitedConns {
+		return ErrFreezerRemoteResponseLimitUnsupported
+	}
+	atomic.StoreUint64(&api.maxResponseSize, size)
+	return nil
+}
+
+// MaxResponseSize returns the maximum size of a single ancient item accepted from
+// the remote freezer.
+func (api *FreezerRemoteClient) MaxResponseSize() uint64 {
+	if size := atomic.LoadUint64(&api.maxResponseSize); size != 0 {
+		return size
+	}
+	return DefaultFreezerRemoteMaxResponseSize
+}
+
+// maxWireResponseSize returns the maximum size of a serialized response, allowing
+// for the base64 encoding of the item and the JSON-RPC envelope.
+func (api *FreezerRemoteClient) maxWireResponseSize() int64 {
+	return int64(api.MaxResponseSize()/3*4+4) + freezerRemoteResponseOverhead
+}
+
+// freezerRemoteLimitTransport is an http.RoundTripper limiting the size of response
+// bodies to the client's maximum response size.
+type freezerRemoteLimitTransport struct {
+	api  *FreezerRemoteClient
+	next http.RoundTripper
+}
+
+func (t *freezerRemoteLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	limit := t.api.maxWireResponseSize()
+	if resp.ContentLength > limit {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: content length %d exceeds %d", ErrFreezerRemoteResponseTooLarge, resp.ContentLength, limit)
+	}
+	resp.Body = &limitedReadCloser{rc: resp.Body, remaining: limit}
+	return resp, nil
+}
+
+// limitedReadCloser is an io.ReadCloser failing with ErrFreezerRemoteResponseTooLarge
+// once more than the allowed number of bytes have been read.
+type limitedReadCloser struct {
+	rc        io.ReadCloser
+	remaining int64
+}
+
+func (l *limitedReadCloser) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, ErrFreezerRemoteResponseTooLarge
+	}
+	// Read one byte past the limit to tell an exactly-sized body from an oversized one.
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.rc.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return 0, ErrFreezerRemoteResponseTooLarge
+	}
+	return n, err
+}
+
+func (l *limitedReadCloser) Close() error {
+	return l.rc.Close()
+}
+
+// call performs an RPC call against the remote freezer, classifying any error.
+func (api *FreezerRemoteClient) call(result interface{}, method string, args ...interface{}) error {
+	return classifyFreezerRemoteError(api.client.Call(result, method, args...))
+}
+
+// read performs a read-only RPC call, using an idle connection of the read pool
+// if there is one.
+func (api *FreezerRemoteClient) read(result interface{}, method string, args ...interface{}) error {
+	return api.readContext(context.Background(), result, method, args...)
+}
+
+// readContext is like read, but aborts waiting for a connection and the call itself
+// once ctx is done.
+func (api *FreezerRemoteClient) readContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	if api.readers == nil {
+		return classifyFreezerRemoteError(api.client.CallContext(ctx, result, method, args...))
+	}
+	var client *rpc.Client
+	select {
+	case client = <-api.readers:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { api.readers <- client }()
+	return classifyFreezerRemoteError(client.CallContext(ctx, result, method, args...))
+}
+
+// readReplica performs a read-only RPC call on an idle read replica connection,
+// waiting for one if all are busy.
+func (api *FreezerRemoteClient) readReplica(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	var client *rpc.Client
+	select {
+	case client = <-api.replicas:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { api.replicas <- client }()
+	return classifyFreezerRemoteError(client.CallContext(ctx, result, method, args...))
+}
+
+// write performs a modifying RPC call, serialized with all other writes.
+func (api *FreezerRemoteClient) write(method string, args ...interface{}) error {
+	if api.ReadOnly() {
+		return ErrFreezerRemoteReadOnly
+	}
+	api.writeMu.Lock()
+	defer api.writeMu.Unlock()
+	return api.call(nil, method, args...)
+}
+
+// appendArgs returns the arguments of a freezer_appendAncient call, including a fresh
+// idempotency key if the server supports them. Retries must reuse the arguments.
+func (api *FreezerRemoteClient) appendArgs(number uint64, hash, header, body, receipts, td []byte) []interface{} {
+	if s := api.serializer; s != nil {
+		hash, header, body = s.Encode(freezerHashTable, hash), s.Encode(freezerHeaderTable, header), s.Encode(freezerBodiesTable, body)
+		receipts, td = s.Encode(freezerReceiptTable, receipts), s.Encode(freezerDifficultyTable, td)
+	}
+	args := []interface{}{number, hash, header, body, receipts, td}
+	if api.info != nil && api.info.Features.IdempotentAppend {
+		key := make([]byte, 16)
+		rand.Read(key)
+		args = append(args, hex.EncodeToString(key))
+	}
+	return args
+}
+
+// retryAppend runs send, which must send appends carrying idempotency keys, retrying
+// it on transient errors. Without server support for the keys a retry could write an
+// append twice, so send is run only once.
+func (api *FreezerRemoteClient) retryAppend(send func() error) error {
+	err := send()
+	if api.info == nil || !api.info.Features.IdempotentAppend {
+		return err
+	}
+	for i := 0; i < freezerRemoteAppendRetries && errors.Is(err, ErrFreezerRemoteTransient); i++ {
+		log.Debug("Retrying remote freezer append", "attempt", i+1, "err", err)
+		err = send()
+	}
+	return err
 }
 
 // Close terminates the chain freezer, unmapping all the data files.
 func (api *FreezerRemoteClient) Close() error {
-	return api.client.Call(nil, FreezerMethodClose)
+	if err := api.flush(); err != nil {
+		log.Error("Failed to flush remote freezer appends", "err", err)
+	}
+	defer api.closeClients()
+
+	if api.ReadOnly() {
+		// The server belongs to the lease holder, leave it open.
+		return nil
+	}
+	if api.leaseQuit != nil {
+		api.closeOnce.Do(func() { close(api.leaseQuit) })
+		if err := api.write(FreezerMethodReleaseLease, api.leaseOwner); err != nil {
+			log.Warn("Failed to release remote freezer write lease", "err", err)
+		}
+	}
+	return api.write(FreezerMethodClose)
 }
 
 // HasAncient returns an indicator whether the specified ancient data exists
 // in the freezer.
 func (api *FreezerRemoteClient) HasAncient(kind string, number uint64) (bool, error) {
+	if err := api.flush(); err != nil {
+		return false, err
+	}
 	var res bool
-	err := api.client.Call(&res, FreezerMethodHasAncient, kind, number)
+	err := api.read(&res, FreezerMethodHasAncient, kind, number)
 	return res, err
 }
 
 // Ancient retrieves an ancient binary blob from the append-only immutable files.
 func (api *FreezerRemoteClient) Ancient(kind string, number uint64) ([]byte, error) {
+	return api.AncientContext(context.Background(), kind, number)
+}
+
+// AncientContext retrieves an ancient binary blob from the append-only immutable
+// files, aborting the remote call once ctx is done. Reads of items a lagging read
+// replica doesn't serve yet are retried if configured, see SetStaleReadRetry. Reads
+// failing with a transient error, eg. because the server is restarting, are retried
+// freezerRemoteReadRetries times if the item is below the number of ancients the
+// server last reported; a retry of an item the restarted server no longer has frozen
+// fails with ErrNotYetFrozen.
+func (api *FreezerRemoteClient) AncientContext(ctx context.Context, kind string, number uint64) ([]byte, error) {
+	var (
+		transient int
+		backoff   = freezerRemoteReadBackoff
+	)
+	for {
+		blob, err := api.ancient(ctx, kind, number)
+		if !errors.Is(err, ErrFreezerRemoteTransient) || transient >= freezerRemoteReadRetries || number >= atomic.LoadUint64(&api.ancients) || ctx.Err() != nil {
+			return blob, err
+		}
+		transient++
+		log.Debug("Retrying failed remote freezer read", "kind", kind, "number", number, "attempt", transient, "backoff", backoff, "err", err)
+
+		timer := time.NewTimer(backoff)
+		backoff *= 2
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// ancient retrieves an ancient binary blob in a single attempt.
+func (api *FreezerRemoteClient) ancient(ctx context.Context, kind string, number uint64) ([]byte, error) {
+	key := freezerRemoteCacheKey{kind, number}
+	if api.readAhead != nil {
+		api.awaitReadAhead(ctx, kind, number)
+		defer api.scheduleReadAhead(kind, number)
+	}
+	if api.cache != nil {
+		if blob, ok := api.cache.Get(key); ok {
+			return blob.([]byte), nil
+		}
+	}
+	if err := api.flush(); err != nil {
+		return nil, err
+	}
+	gen := atomic.LoadUint64(&api.cacheGen)
 	res := []byte{}
-	if err := api.client.Call(&res, FreezerMethodAncient, kind, number); err != nil {
+	var err error
+	if api.replicas != nil {
+		if err = api.ancientReplica(ctx, &res, kind, number); err != nil && ctx.Err() == nil {
+			log.Debug("Remote freezer replica read failed, reading primary", "kind", kind, "number", number, "err", err)
+			res = []byte{}
+		}
+	}
+	if api.replicas == nil || (err != nil && ctx.Err() == nil) {
+		err = api.readContext(ctx, &res, FreezerMethodAncient, kind, number)
+	}
+	if err != nil {
+		if errors.Is(err, ErrFreezerRemoteNotFound) {
+			var frozen uint64
+			if api.readContext(ctx, &frozen, FreezerMethodAncients) == nil && number >= frozen {
+				return nil, fmt.Errorf("%w: %s #%d, ancients %d", ErrNotYetFrozen, kind, number, frozen)
+			}
+		}
 		return nil, err
 	}
+	if limit := api.MaxResponseSize(); uint64(len(res)) > limit {
+		return nil, fmt.Errorf("%w: %s #%d is %d bytes, limit %d", ErrFreezerRemoteResponseTooLarge, kind, number, len(res), limit)
+	}
+	if api.serializer != nil {
+		if res, err = api.serializer.Decode(kind, res); err != nil {
+			return nil, fmt.Errorf("%w: %s #%d: %v", ErrFreezerRemoteProtocol, kind, number, err)
+		}
+	}
+	// Don't cache items read before a truncation finished, they may be gone.
+	if api.cache != nil && atomic.LoadUint64(&api.cacheGen) == gen {
+		api.cache.Add(key, res)
+	}
 	return res, nil
 }
 
+// ancientReplica retrieves an ancient binary blob from a read replica. Reads of items
+// the replica reports as not found, though the primary froze them, are retried while
+// the replica catches up, see SetStaleReadRetry.
+func (api *FreezerRemoteClient) ancientReplica(ctx context.Context, res *[]byte, kind string, number uint64) error {
+	backoff := api.staleBackoff
+	for stale := 0; ; stale++ {
+		err := api.readReplica(ctx, res, FreezerMethodAncient, kind, number)
+		if err == nil || stale >= api.staleRetries || !errors.Is(err, ErrFreezerRemoteNotFound) {
+			return err
+		}
+		if stale == 0 {
+			var frozen uint64
+			if api.readContext(ctx, &frozen, FreezerMethodAncients) != nil || number >= frozen {
+				return err
+			}
+		}
+		log.Debug("Retrying stale remote freezer replica read", "kind", kind, "number", number, "attempt", stale+1, "backoff", backoff, "err", err)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// AncientTail returns the number of the first item stored by the remote freezer,
+// which is 0 unless the server discards old items.
+func (api *FreezerRemoteClient) AncientTail() (uint64, error) {
+	state, err := api.State()
+	if err != nil {
+		return 0, err
+	}
+	return state.Tail, nil
+}
+
+// AncientRange retrieves count items of the kind from start in a single batch
+// request. Items in the read cache are requested nonetheless.
+func (api *FreezerRemoteClient) AncientRange(kind string, start, count uint64) ([][]byte, error) {
+	if err := api.flush(); err != nil {
+		return nil, err
+	}
+	var (
+		batch   = make([]rpc.BatchElem, count)
+		results = make([][]byte, count)
+	)
+	for i := range batch {
+		batch[i] = rpc.BatchElem{
+			Method: FreezerMethodAncient,
+			Args:   []interface{}{kind, start + uint64(i)},
+			Result: &results[i],
+		}
+	}
+	if err := api.readBatch(context.Background(), batch); err != nil {
+		return nil, err
+	}
+	limit := api.MaxResponseSize()
+	for i, elem := range batch {
+		number := start + uint64(i)
+		if elem.Error != nil {
+			return nil, fmt.Errorf("%s #%d: %w", kind, number, classifyFreezerRemoteError(elem.Error))
+		}
+		if uint64(len(results[i])) > limit {
+			return nil, fmt.Errorf("%w: %s #%d is %d bytes, limit %d", ErrFreezerRemoteResponseTooLarge, kind, number, len(results[i]), limit)
+		}
+		if api.serializer != nil {
+			var err error
+			if results[i], err = api.serializer.Decode(kind, results[i]); err != nil {
+				return nil, fmt.Errorf("%w: %s #%d: %v", ErrFreezerRemoteProtocol, kind, number, err)
+			}
+		}
+	}
+	return results, nil
+}
+
 // Ancients returns the length of the frozen items.
 func (api *FreezerRemoteClient) Ancients() (uint64, error) {
+	if err := api.flush(); err != nil {
+		return 0, err
+	}
 	var res uint64
-	err := api.client.Call(&res, FreezerMethodAncients)
+	err := api.read(&res, FreezerMethodAncients)
+	if err == nil {
+		atomic.StoreUint64(&api.ancients, res)
+	}
 	return res, err
 }
 
+// AncientKinds returns the categories known to the remote freezer, along with the
+// number of items in each.
+func (api *FreezerRemoteClient) AncientKinds() (map[string]uint64, error) {
+	if err := api.flush(); err != nil {
+		return nil, err
+	}
+	var res map[string]uint64
+	err := api.read(&res, FreezerMethodAncientKinds)
+	return res, err
+}
+
+// State returns the remote freezer's item counts in a single round-trip. For servers
+// not implementing freezer_state it falls back to querying them individually.
+func (api *FreezerRemoteClient) State() (*FreezerRemoteState, error) {
+	if err := api.flush(); err != nil {
+		return nil, err
+	}
+	state := new(FreezerRemoteState)
+	err := api.read(state, FreezerMethodState)
+	if !errors.Is(err, ErrFreezerRemoteProtocol) {
+		if err == nil {
+			atomic.StoreUint64(&api.ancients, state.Ancients)
+		}
+		return state, err
+	}
+	log.Debug("Remote freezer state unavailable, querying individually", "err", err)
+	state = new(FreezerRemoteState)
+	if state.Ancients, err = api.Ancients(); err != nil {
+		return nil, err
+	}
+	if state.Kinds, err = api.AncientKinds(); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
 // AncientSize returns the ancient size of the specified category.
 func (api *FreezerRemoteClient) AncientSize(kind string) (uint64, error) {
+	if err := api.flush(); err != nil {
+		return 0, err
+	}
 	var res uint64
-	err := api.client.Call(&res, FreezerMethodAncientSize, kind)
+	err := api.read(&res, FreezerMethodAncientSize, kind)
 	return res, err
 }
 
@@ -92,17 +986,94 @@ func (api *FreezerRemoteClient) AncientSize(kind string) (uint64, error) {
 //
 // Note that the frozen marker is updated outside of the service calls.
 func (api *FreezerRemoteClient) AppendAncient(number uint64, hash, header, body, receipts, td []byte) (err error) {
-	return api.client.Call(nil, FreezerMethodAppendAncient, number, hash, header, body, receipts, td)
+	if api.ReadOnly() {
+		return ErrFreezerRemoteReadOnly
+	}
+	api.batchMu.Lock()
+	defer api.batchMu.Unlock()
+
+	if api.batchSize == 0 {
+		if err := api.flushLocked(); err != nil {
+			return err
+		}
+		args := api.appendArgs(number, hash, header, body, receipts, td)
+		return api.retryAppend(func() error {
+			return api.write(FreezerMethodAppendAncient, args...)
+		})
+	}
+	if err := api.batchErr; err != nil {
+		api.batchErr = nil
+		return err
+	}
+	api.batch = append(api.batch, rpc.BatchElem{
+		Method: FreezerMethodAppendAncient,
+		Args:   api.appendArgs(number, hash, header, body, receipts, td),
+		Result: new(json.RawMessage),
+	})
+	if len(api.batch) >= api.batchSize {
+		return api.flushLocked()
+	}
+	if api.batchTimer == nil && api.batchInterval > 0 {
+		api.batchTimer = time.AfterFunc(api.batchInterval, func() {
+			api.batchMu.Lock()
+			defer api.batchMu.Unlock()
+			if err := api.flushLocked(); err != nil {
+				log.Warn("Failed to flush remote freezer appends", "err", err)
+				api.batchErr = err
+			}
+		})
+	}
+	return nil
 }
 
-// TruncateAncients discards any recent data above the provided threshold number.
+// TruncateAncients discards any recent data above the provided threshold number,
+// including the pending appends above it.
 func (api *FreezerRemoteClient) TruncateAncients(items uint64) error {
-	return api.client.Call(nil, FreezerMethodTruncateAncients, items)
+	api.batchMu.Lock()
+	for i, elem := range api.batch {
+		if elem.Args[0].(uint64) >= items {
+			api.batch = api.batch[:i]
+			break
+		}
+	}
+	api.batchMu.Unlock()
+
+	if err := api.flush(); err != nil {
+		return err
+	}
+	err := api.write(FreezerMethodTruncateAncients, items)
+	if err == nil && atomic.LoadUint64(&api.ancients) > items {
+		atomic.StoreUint64(&api.ancients, items)
+	}
+	if api.cache != nil {
+		atomic.AddUint64(&api.cacheGen, 1)
+		for _, key := range api.cache.Keys() {
+			if key.(freezerRemoteCacheKey).number >= items {
+				api.cache.Remove(key)
+			}
+		}
+	}
+	return err
 }
 
 // Sync flushes all data tables to disk.
 func (api *FreezerRemoteClient) Sync() error {
-	return api.client.Call(nil, FreezerMethodSync)
+	if err := api.flush(); err != nil {
+		return err
+	}
+	return api.write(FreezerMethodSync)
+}
+
+// SubscribeFreezeEvent registers a subscription of FreezeEvent.
+func (api *FreezerRemoteClient) SubscribeFreezeEvent(ch chan<- FreezeEvent) event.Subscription {
+	return api.freezeFeed.Subscribe(ch)
+}
+
+// freezeUpTo moves the canonical blocks below number, which are at least the freezing
+// threshold below the head block, from the key-value store into the freezer, returning
+// once the server synced them, or ctx is cancelled. It returns the number of ancients.
+func (api *FreezerRemoteClient) freezeUpTo(ctx context.Context, db ethdb.KeyValueStore, number uint64) (uint64, error) {
+	return freezeRemoteUpTo(ctx, db, api, api.threshold, number, &api.freezeMu, &api.freezeFeed)
 }
 
 // freezeRemote is a background thread that periodically checks the blockchain for any
@@ -117,7 +1088,9 @@ func (api *FreezerRemoteClient) Sync() error {
 // to exist unmodified and untouched by the remote freezer client, which demands
 // a slightly different signature, and uses the freezer.Ancients() method instead
 // of direct access to the atomic freezer.frozen field.
-func freezeRemote(db ethdb.KeyValueStore, f ethdb.AncientStore, threshold uint64, quitChan chan struct{}, triggerChanChan chan chan struct{}) {
+//
+// Batches are frozen holding lock, serializing them with freezeRemoteUpTo.
+func freezeRemote(db ethdb.KeyValueStore, f ethdb.AncientStore, threshold uint64, lock *sync.Mutex, quitChan chan struct{}, triggerChanChan chan chan struct{}, freezeFeed *event.Feed) {
 	nfdb := &nofreezedb{KeyValueStore: db}
 
 	var (
@@ -154,7 +1127,11 @@ func freezeRemote(db ethdb.KeyValueStore, f ethdb.AncientStore, threshold uint64
 			continue
 		}
 		numFrozen, err := f.Ancients()
-		if err != nil {
+		if errors.Is(err, ErrFreezerRemoteTransient) {
+			log.Warn("Remote freezer unavailable, retrying", "error", err)
+			backoff = true
+			continue
+		} else if err != nil {
 			log.Crit("ancient db freeze", "error", err)
 		}
 		number := ReadHeaderNumber(nfdb, hash)
@@ -168,144 +1145,261 @@ func freezeRemote(db ethdb.KeyValueStore, f ethdb.AncientStore, threshold uint64
 
 		case *number < threshold:
 			log.Debug("Current full block not old enough", "number", *number, "hash", hash, "delay", threshold)
+			freezeBacklogGauge.Update(0)
 			backoff = true
 			continue
 
 		case *number-threshold <= numFrozen:
 			log.Debug("Ancient blocks frozen already", "number", *number, "hash", hash, "frozen", numFrozen)
+			freezeBacklogGauge.Update(0)
 			backoff = true
 			continue
 		}
+		freezeBacklogGauge.Update(int64(*number - threshold + 1 - numFrozen))
 		head := ReadHeader(nfdb, hash, *number)
 		if head == nil {
 			log.Error("Current full block unavailable", "number", *number, "hash", hash)
 			backoff = true
 			continue
 		}
+		if g, ok := f.(interface{ diskGuard() *freezerDiskGuard }); ok && !g.diskGuard().wait(quitChan, "freezing") {
+			return
+		}
 		// Seems we have data ready to be frozen, process in usable batches
-		limit := *number - threshold
-		if limit-numFrozen > freezerBatchLimit {
-			limit = numFrozen + freezerBatchLimit
-		}
-		var (
-			start    = time.Now()
-			first    = numFrozen
-			ancients = make([]common.Hash, 0, limit-numFrozen)
-		)
-		for numFrozen <= limit {
-			// Retrieves all the components of the canonical block
-			hash := ReadCanonicalHash(nfdb, numFrozen)
-			if hash == (common.Hash{}) {
-				log.Error("Canonical hash missing, can't freeze", "number", numFrozen)
-				break
-			}
-			header := ReadHeaderRLP(nfdb, hash, numFrozen)
-			if len(header) == 0 {
-				log.Error("Block header missing, can't freeze", "number", numFrozen, "hash", hash)
-				break
-			}
-			body := ReadBodyRLP(nfdb, hash, numFrozen)
-			if len(body) == 0 {
-				log.Error("Block body missing, can't freeze", "number", numFrozen, "hash", hash)
-				break
-			}
-			receipts := ReadReceiptsRLP(nfdb, hash, numFrozen)
-			if len(receipts) == 0 {
-				log.Error("Block receipts missing, can't freeze", "number", numFrozen, "hash", hash)
-				break
-			}
-			td := ReadTdRLP(nfdb, hash, numFrozen)
-			if len(td) == 0 {
-				log.Error("Total difficulty missing, can't freeze", "number", numFrozen, "hash", hash)
-				break
-			}
-			log.Trace("Deep froze ancient block", "number", numFrozen, "hash", hash)
-			// Inject all the components into the relevant data tables
-			if err := f.AppendAncient(numFrozen, hash[:], header, body, receipts, td); err != nil {
-				break
+		lock.Lock()
+		first, numFrozen, err := freezeRemoteRange(context.Background(), db, f, *number-threshold, freezeFeed)
+		lock.Unlock()
+		if errors.Is(err, ErrFreezerRemoteTransient) {
+			log.Warn("Remote freezer unavailable, retrying", "error", err)
+			backoff = true
+			continue
+		} else if errors.Is(err, ErrFreezerRemoteReadOnly) {
+			// The write lease was lost to another client, which freezes from now on
+			log.Warn("Remote freezer write lease lost, not freezing ancient blocks", "frozen", numFrozen, "err", err)
+			if triggered != nil {
+				triggered <- struct{}{}
 			}
-			ancients = append(ancients, hash)
-		}
-		// Batch of blocks have been frozen, flush them before wiping from leveldb
-		if err := f.Sync(); err != nil {
+			return
+		} else if err != nil {
 			log.Crit("Failed to flush frozen tables", "err", err)
 		}
-		// Wipe out all data from the active database
-		batch := db.NewBatch()
-		for i := 0; i < len(ancients); i++ {
-			// Always keep the genesis block in active database
-			if first+uint64(i) != 0 {
-				DeleteBlockWithoutNumber(batch, ancients[i], first+uint64(i))
-				DeleteCanonicalHash(batch, first+uint64(i))
-			}
+		if numFrozen <= *number-threshold+1 {
+			freezeBacklogGauge.Update(int64(*number - threshold + 1 - numFrozen))
 		}
-		if err := batch.Write(); err != nil {
-			log.Crit("Failed to delete frozen canonical blocks", "err", err)
-		}
-		batch.Reset()
-
-		// Wipe out side chains also and track dangling side chians
-		var dangling []common.Hash
-		for number := first; number < numFrozen; number++ {
-			// Always keep the genesis block in active database
-			if number != 0 {
-				dangling = ReadAllHashes(db, number)
-				for _, hash := range dangling {
-					log.Trace("Deleting side chain", "number", number, "hash", hash)
-					DeleteBlock(batch, hash, number)
-				}
+		// Avoid database thrashing with tiny writes
+		if numFrozen-first < freezerBatchLimit {
+			backoff = true
+		}
+	}
+}
+
+// freezeRemoteRange moves the canonical blocks from the freezer's Ancients() up to and
+// including limit, but at most freezerBatchLimit of them, from the key-value store into
+// the freezer. It returns the number of ancients before and after, and an error if the
+// freezer could not be queried or synced. The caller must hold the freezing lock.
+//
+// Once ctx is cancelled no further blocks are appended, but those appended already
+// are synced and wiped from the key-value store, keeping both stores consistent.
+func freezeRemoteRange(ctx context.Context, db ethdb.KeyValueStore, f ethdb.AncientStore, limit uint64, freezeFeed *event.Feed) (first uint64, numFrozen uint64, err error) {
+	nfdb := &nofreezedb{KeyValueStore: db}
+
+	if numFrozen, err = f.Ancients(); err != nil || numFrozen > limit {
+		return numFrozen, numFrozen, err
+	}
+	if limit-numFrozen > freezerBatchLimit {
+		limit = numFrozen + freezerBatchLimit
+	}
+	first = numFrozen
+	var (
+		start     = time.Now()
+		ancients  = make([]common.Hash, 0, limit-numFrozen)
+		verbosity = atomic.LoadInt32(&freezeVerbosity)
+		size      int           // Bytes appended in the batch
+		rtt       time.Duration // Time spent in calls to the freezer
+	)
+	for numFrozen <= limit {
+		if ctx.Err() != nil {
+			break
+		}
+		// Retrieves all the components of the canonical block
+		hash := ReadCanonicalHash(nfdb, numFrozen)
+		if hash == (common.Hash{}) {
+			log.Error("Canonical hash missing, can't freeze", "number", numFrozen)
+			break
+		}
+		header := ReadHeaderRLP(nfdb, hash, numFrozen)
+		if len(header) == 0 {
+			log.Error("Block header missing, can't freeze", "number", numFrozen, "hash", hash)
+			break
+		}
+		body := ReadBodyRLP(nfdb, hash, numFrozen)
+		if len(body) == 0 {
+			log.Error("Block body missing, can't freeze", "number", numFrozen, "hash", hash)
+			break
+		}
+		body = ancientBody(nfdb, numFrozen, body)
+		receipts := ReadReceiptsRLP(nfdb, hash, numFrozen)
+		if len(receipts) == 0 {
+			log.Error("Block receipts missing, can't freeze", "number", numFrozen, "hash", hash)
+			break
+		}
+		td := ReadTdRLP(nfdb, hash, numFrozen)
+		if len(td) == 0 {
+			log.Error("Total difficulty missing, can't freeze", "number", numFrozen, "hash", hash)
+			break
+		}
+		log.Trace("Deep froze ancient block", "number", numFrozen, "hash", hash)
+		// Inject all the components into the relevant data tables
+		appendStart := time.Now()
+		if err := f.AppendAncient(numFrozen, hash[:], header, body, receipts, td); err != nil {
+			break
+		}
+		blockSize := len(hash) + len(header) + len(body) + len(receipts) + len(td)
+		size += blockSize
+		rtt += time.Since(appendStart)
+		if verbosity >= 2 {
+			log.Info("Froze ancient block", "number", numFrozen, "hash", hash, "size", common.StorageSize(blockSize), "rtt", common.PrettyDuration(time.Since(appendStart)))
+		}
+		numFrozen++
+		ancients = append(ancients, hash)
+	}
+	// Batch of blocks have been frozen, flush them before wiping from leveldb
+	syncStart := time.Now()
+	if err := f.Sync(); err != nil {
+		return first, numFrozen, err
+	}
+	rtt += time.Since(syncStart)
+
+	// Only wipe the blocks the server holds, in case some appends never reached it
+	confirmed, err := f.Ancients()
+	if err != nil {
+		return first, numFrozen, err
+	}
+	if confirmed < numFrozen {
+		log.Error("Remote freezer missing appended blocks", "appended", numFrozen, "confirmed", confirmed)
+		if confirmed < first {
+			confirmed = first
+		}
+		numFrozen, ancients = confirmed, ancients[:confirmed-first]
+	}
+	if verbosity >= 1 && numFrozen > first {
+		log.Info("Froze ancient batch", "first", first, "last", numFrozen-1, "size", common.StorageSize(size), "rtt", common.PrettyDuration(rtt))
+	}
+	// Wipe out all data from the active database
+	batch := db.NewBatch()
+	for i := 0; i < len(ancients); i++ {
+		// Always keep the genesis block in active database
+		if first+uint64(i) != 0 {
+			DeleteBlockWithoutNumber(batch, ancients[i], first+uint64(i))
+			DeleteCanonicalHash(batch, first+uint64(i))
+		}
+	}
+	if err := batch.Write(); err != nil {
+		log.Crit("Failed to delete frozen canonical blocks", "err", err)
+	}
+	batch.Reset()
+
+	// Wipe out side chains also and track dangling side chians
+	var dangling []common.Hash
+	for number := first; number < numFrozen; number++ {
+		// Always keep the genesis block in active database
+		if number != 0 {
+			dangling = ReadAllHashes(db, number)
+			for _, hash := range dangling {
+				log.Trace("Deleting side chain", "number", number, "hash", hash)
+				DeleteBlock(batch, hash, number)
 			}
 		}
-		if err := batch.Write(); err != nil {
-			log.Crit("Failed to delete frozen side blocks", "err", err)
-		}
-		batch.Reset()
-
-		// Step into the future and delete and dangling side chains
-		if numFrozen > 0 {
-			tip := numFrozen
-			for len(dangling) > 0 {
-				drop := make(map[common.Hash]struct{})
-				for _, hash := range dangling {
-					log.Debug("Dangling parent from freezer", "number", tip-1, "hash", hash)
-					drop[hash] = struct{}{}
+	}
+	if err := batch.Write(); err != nil {
+		log.Crit("Failed to delete frozen side blocks", "err", err)
+	}
+	batch.Reset()
+
+	// Step into the future and delete and dangling side chains
+	if numFrozen > 0 {
+		tip := numFrozen
+		for len(dangling) > 0 {
+			drop := make(map[common.Hash]struct{})
+			for _, hash := range dangling {
+				log.Debug("Dangling parent from freezer", "number", tip-1, "hash", hash)
+				drop[hash] = struct{}{}
+			}
+			children := ReadAllHashes(db, tip)
+			for i := 0; i < len(children); i++ {
+				// Dig up the child and ensure it's dangling
+				child := ReadHeader(nfdb, children[i], tip)
+				if child == nil {
+					log.Error("Missing dangling header", "number", tip, "hash", children[i])
+					continue
 				}
-				children := ReadAllHashes(db, tip)
-				for i := 0; i < len(children); i++ {
-					// Dig up the child and ensure it's dangling
-					child := ReadHeader(nfdb, children[i], tip)
-					if child == nil {
-						log.Error("Missing dangling header", "number", tip, "hash", children[i])
-						continue
-					}
-					if _, ok := drop[child.ParentHash]; !ok {
-						children = append(children[:i], children[i+1:]...)
-						i--
-						continue
-					}
-					// Delete all block data associated with the child
-					log.Debug("Deleting dangling block", "number", tip, "hash", children[i], "parent", child.ParentHash)
-					DeleteBlock(batch, children[i], tip)
+				if _, ok := drop[child.ParentHash]; !ok {
+					children = append(children[:i], children[i+1:]...)
+					i--
+					continue
 				}
-				dangling = children
-				tip++
+				// Delete all block data associated with the child
+				log.Debug("Deleting dangling block", "number", tip, "hash", children[i], "parent", child.ParentHash)
+				DeleteBlock(batch, children[i], tip)
 			}
-			if err := batch.Write(); err != nil {
-				log.Crit("Failed to delete dangling side blocks", "err", err)
-			}
-		}
-		// Log something friendly for the user
-		context := []interface{}{
-			"blocks", numFrozen - first, "elapsed", common.PrettyDuration(time.Since(start)), "number", numFrozen - 1,
+			dangling = children
+			tip++
 		}
-		if n := len(ancients); n > 0 {
-			context = append(context, []interface{}{"hash", ancients[n-1]}...)
+		if err := batch.Write(); err != nil {
+			log.Crit("Failed to delete dangling side blocks", "err", err)
 		}
-		log.Info("Deep froze chain segment", context...)
+	}
+	// Log something friendly for the user
+	context := []interface{}{
+		"blocks", numFrozen - first, "elapsed", common.PrettyDuration(time.Since(start)), "number", numFrozen - 1,
+	}
+	if n := len(ancients); n > 0 {
+		context = append(context, []interface{}{"hash", ancients[n-1]}...)
+	}
+	log.Info("Deep froze chain segment", context...)
 
-		// Avoid database thrashing with tiny writes
-		if numFrozen-first < freezerBatchLimit {
-			backoff = true
+	if n := len(ancients); n > 0 {
+		WriteFrozenRange(db, first, first+uint64(n)-1, time.Now())
+		freezeFeed.Send(FreezeEvent{First: first, Last: first + uint64(n) - 1})
+	}
+	return first, numFrozen, nil
+}
+
+// freezeRemoteUpTo moves the canonical blocks below number, which are at least threshold
+// blocks below the head block, from the key-value store into the freezer, returning once
+// the freezer synced them. Batches are frozen holding lock, serializing them with freezeRemote.
+//
+// If ctx is cancelled, freezing stops after syncing the blocks appended already, and
+// ctx.Err() is returned. The number of ancients reached is returned in either case.
+func freezeRemoteUpTo(ctx context.Context, db ethdb.KeyValueStore, f ethdb.AncientStore, threshold uint64, number uint64, lock *sync.Mutex, freezeFeed *event.Feed) (uint64, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	nfdb := &nofreezedb{KeyValueStore: db}
+	head := ReadHeaderNumber(nfdb, ReadHeadBlockHash(nfdb))
+	if head == nil {
+		return 0, errors.New("current full block number unavailable")
+	}
+	if number == 0 || *head < threshold {
+		return f.Ancients()
+	}
+	limit := *head - threshold
+	if number-1 < limit {
+		limit = number - 1
+	}
+	for {
+		first, numFrozen, err := freezeRemoteRange(ctx, db, f, limit, freezeFeed)
+		if err != nil {
+			return numFrozen, err
+		}
+		if numFrozen > limit {
+			return numFrozen, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return numFrozen, err
+		}
+		if numFrozen == first {
+			return numFrozen, fmt.Errorf("failed to freeze block #%d", numFrozen)
 		}
 	}
 }
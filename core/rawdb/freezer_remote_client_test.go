@@ -2,9 +2,31 @@ package rawdb
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/ethereum/go-ethereum/cmd/ancient-store-mem/lib"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/rpc"
 )
 
@@ -96,3 +118,1488 @@ func TestClient1(t *testing.T) {
 		t.Fatalf("got: %d, want: 670", n)
 	}
 }
+
+func TestFreezerSelfTest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	endpoint := filepath.Join(dir, "test.ipc")
+
+	listener, server, err := rpc.StartIPCEndpoint(endpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	mock := lib.NewMemFreezerRemoteServerAPI()
+	if err := server.RegisterName("freezer", mock); err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeListener(listener)
+
+	frClient, err := NewFreezerRemoteClient(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Pre-existing data should survive the test.
+	if err := frClient.AppendAncient(0, []byte{0}, []byte{1}, []byte{2}, []byte{3}, []byte{4}); err != nil {
+		t.Fatal(err)
+	}
+	report, err := FreezerSelfTest(frClient, 100)
+	if err != nil {
+		t.Fatalf("self test failed: %v", err)
+	}
+	if report.Items != 100 || report.Offset != 1 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if n, err := frClient.Ancients(); err != nil || n != 1 {
+		t.Fatalf("ancients: have %d, want 1 (err=%v)", n, err)
+	}
+	if v, err := frClient.Ancient(FreezerRemoteReceiptTable, 0); err != nil || !bytes.Equal(v, []byte{3}) {
+		t.Fatalf("pre-existing ancient mismatch: %x (err=%v)", v, err)
+	}
+}
+
+// faultTransport is an http.RoundTripper injecting a configurable class of fault
+// into requests to an otherwise healthy remote freezer.
+type faultTransport struct {
+	fault string
+	next  http.RoundTripper
+}
+
+func (ft *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch ft.fault {
+	case "unauthorized":
+		return &http.Response{
+			Status:     "401 Unauthorized",
+			StatusCode: http.StatusUnauthorized,
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			Request:    req,
+		}, nil
+	case "protocol":
+		// Respond as a server which does not know the method anymore.
+		var msg struct {
+			ID json.RawMessage `json:"id"`
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		json.Unmarshal(body, &msg)
+		res := fmt.Sprintf(`{"jsonrpc":"2.0","id":%s,"error":{"code":-32601,"message":"the method does not exist/is not available"}}`, msg.ID)
+		return &http.Response{
+			Status:     "200 OK",
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       ioutil.NopCloser(strings.NewReader(res)),
+			Request:    req,
+		}, nil
+	case "transient":
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	}
+	return ft.next.RoundTrip(req)
+}
+
+func TestFreezerRemoteClientErrorClassification(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Stop()
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	transport := &faultTransport{next: http.DefaultTransport}
+	client, err := rpc.DialHTTPWithClient(httpServer.URL, &http.Client{Transport: transport})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frClient := &FreezerRemoteClient{client: client, quit: make(chan struct{})}
+
+	if err := frClient.AppendAncient(0, []byte{0}, []byte{1}, []byte{2}, []byte{3}, []byte{4}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := frClient.Ancient(FreezerRemoteHeaderTable, 0); err != nil {
+		t.Fatalf("healthy read: %v", err)
+	}
+	cases := []struct {
+		fault string
+		want  error
+	}{
+		{"", ErrFreezerRemoteNotFound}, // Healthy transport, but the item does not exist.
+		{"unauthorized", ErrFreezerRemoteUnauthorized},
+		{"protocol", ErrFreezerRemoteProtocol},
+		{"transient", ErrFreezerRemoteTransient},
+	}
+	for _, c := range cases {
+		transport.fault = c.fault
+		_, err := frClient.Ancient(FreezerRemoteHeaderTable, 1)
+		if !errors.Is(err, c.want) {
+			t.Errorf("fault=%q: want %v, got %v", c.fault, c.want, err)
+		}
+	}
+}
+
+func TestFreezerRemoteClientMaxResponseSize(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Stop()
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	httpClient, err := NewFreezerRemoteClient(httpServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inprocClient := &FreezerRemoteClient{client: rpc.DialInProc(server), quit: make(chan struct{})}
+
+	large := bytes.Repeat([]byte{0xff}, 1024*1024)
+	if err := httpClient.AppendAncient(0, []byte{0}, []byte{1}, large, []byte{3}, []byte{4}); err != nil {
+		t.Fatal(err)
+	}
+	for name, client := range map[string]*FreezerRemoteClient{"http": httpClient, "inproc": inprocClient} {
+		// The default limit accepts the item.
+		if v, err := client.Ancient(FreezerRemoteBodiesTable, 0); err != nil || !bytes.Equal(v, large) {
+			t.Fatalf("%s: default limit read failed: %v", name, err)
+		}
+		if err := client.SetMaxResponseSize(64 * 1024); err != nil {
+			t.Fatalf("%s: failed to set the limit: %v", name, err)
+		}
+		if _, err := client.Ancient(FreezerRemoteBodiesTable, 0); !errors.Is(err, ErrFreezerRemoteResponseTooLarge) {
+			t.Errorf("%s: oversized read: want %v, got %v", name, ErrFreezerRemoteResponseTooLarge, err)
+		}
+		// Small items are still served.
+		if v, err := client.Ancient(FreezerRemoteHeaderTable, 0); err != nil || !bytes.Equal(v, []byte{1}) {
+			t.Errorf("%s: small read under limit failed: %x %v", name, v, err)
+		}
+	}
+	// Clients with connections over transports buffering the responses refuse the limit
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	endpoint := filepath.Join(dir, "test.ipc")
+
+	listener, ipcServer, err := rpc.StartIPCEndpoint(endpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ipcServer.Stop()
+	if err := ipcServer.RegisterName("freezer", lib.NewMemFreezerRemoteServerAPI()); err != nil {
+		t.Fatal(err)
+	}
+	go ipcServer.ServeListener(listener)
+
+	ipcClient, err := NewFreezerRemoteClient(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ipcClient.Close()
+	replicaClient, err := NewFreezerRemoteClientWithReplicas(httpServer.URL, []string{endpoint})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replicaClient.Close()
+	for name, client := range map[string]*FreezerRemoteClient{"ipc": ipcClient, "ipc replica": replicaClient} {
+		if err := client.SetMaxResponseSize(64 * 1024); !errors.Is(err, ErrFreezerRemoteResponseLimitUnsupported) {
+			t.Errorf("%s: want %v, got %v", name, ErrFreezerRemoteResponseLimitUnsupported, err)
+		}
+		if limit := client.MaxResponseSize(); limit != DefaultFreezerRemoteMaxResponseSize {
+			t.Errorf("%s: limit changed to %d", name, limit)
+		}
+	}
+}
+
+// connTracker records how many distinct connections are serving reads at once.
+type connTracker struct {
+	mu     sync.Mutex
+	active map[int]int // connection id => in-flight reads
+	max    int         // Maximum number of connections with reads in flight at once
+}
+
+// trackingFreezer is a mock freezer server bound to a single connection, slowing
+// down reads so that concurrent ones overlap.
+type trackingFreezer struct {
+	*lib.MemFreezerRemoteServerAPI
+	id      int
+	tracker *connTracker
+}
+
+func (f *trackingFreezer) Ancient(kind string, number uint64) ([]byte, error) {
+	f.tracker.mu.Lock()
+	f.tracker.active[f.id]++
+	if len(f.tracker.active) > f.tracker.max {
+		f.tracker.max = len(f.tracker.active)
+	}
+	f.tracker.mu.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+
+	f.tracker.mu.Lock()
+	if f.tracker.active[f.id]--; f.tracker.active[f.id] == 0 {
+		delete(f.tracker.active, f.id)
+	}
+	f.tracker.mu.Unlock()
+	return f.MemFreezerRemoteServerAPI.Ancient(kind, number)
+}
+
+func TestFreezerRemoteClientReadPool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	endpoint := filepath.Join(dir, "test.ipc")
+	listener, err := net.Listen("unix", endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// Serve every connection with its own server, so reads can be attributed to connections.
+	var (
+		mock    = lib.NewMemFreezerRemoteServerAPI()
+		tracker = &connTracker{active: make(map[int]int)}
+	)
+	go func() {
+		for id := 0; ; id++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server := rpc.NewServer()
+			server.RegisterName("freezer", &trackingFreezer{MemFreezerRemoteServerAPI: mock, id: id, tracker: tracker})
+			go server.ServeCodec(rpc.NewCodec(conn), 0)
+		}
+	}()
+
+	const poolSize = 4
+	frClient, err := NewFreezerRemoteClientWithPool(endpoint, poolSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer frClient.Close()
+
+	// Writes go over the dedicated write connection.
+	for i := uint64(0); i < 8; i++ {
+		if err := frClient.AppendAncient(i, []byte{byte(i)}, []byte{byte(i)}, []byte{byte(i)}, []byte{byte(i)}, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4*poolSize; i++ {
+		wg.Add(1)
+		go func(number uint64) {
+			defer wg.Done()
+			if v, err := frClient.Ancient(FreezerRemoteHeaderTable, number); err != nil || !bytes.Equal(v, []byte{byte(number)}) {
+				t.Errorf("ancient %d: %x %v", number, v, err)
+			}
+		}(uint64(i % 8))
+	}
+	wg.Wait()
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if tracker.max != poolSize {
+		t.Fatalf("concurrently reading connections: have %d, want %d", tracker.max, poolSize)
+	}
+}
+
+// countingFreezer is a mock freezer server counting Ancient calls.
+type countingFreezer struct {
+	*lib.MemFreezerRemoteServerAPI
+	calls int32
+}
+
+func (f *countingFreezer) Ancient(kind string, number uint64) ([]byte, error) {
+	atomic.AddInt32(&f.calls, 1)
+	return f.MemFreezerRemoteServerAPI.Ancient(kind, number)
+}
+
+func TestFreezerRemoteClientWarmup(t *testing.T) {
+	server := rpc.NewServer()
+	defer server.Stop()
+	mock := &countingFreezer{MemFreezerRemoteServerAPI: lib.NewMemFreezerRemoteServerAPI()}
+	if err := server.RegisterName("freezer", mock); err != nil {
+		t.Fatal(err)
+	}
+	frClient := &FreezerRemoteClient{client: rpc.DialInProc(server), quit: make(chan struct{})}
+	for i := uint64(0); i < 100; i++ {
+		if err := frClient.AppendAncient(i, []byte{byte(i)}, []byte{byte(i)}, []byte{byte(i)}, []byte{byte(i)}, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A zero warmup is a noop.
+	if err := frClient.Warmup(0); err != nil {
+		t.Fatal(err)
+	}
+	if frClient.cache != nil || atomic.LoadInt32(&mock.calls) != 0 {
+		t.Fatalf("zero warmup read from the freezer")
+	}
+	if err := frClient.Warmup(10); err != nil {
+		t.Fatal(err)
+	}
+	if calls := atomic.LoadInt32(&mock.calls); calls != 10*int32(len(freezerKinds)) {
+		t.Fatalf("warmup calls: have %d, want %d", calls, 10*len(freezerKinds))
+	}
+	atomic.StoreInt32(&mock.calls, 0)
+
+	// Reads of the warmed range are served from the cache.
+	for i := uint64(90); i < 100; i++ {
+		for _, kind := range freezerKinds {
+			if v, err := frClient.Ancient(kind, i); err != nil || !bytes.Equal(v, []byte{byte(i)}) {
+				t.Fatalf("ancient %s #%d: %x %v", kind, i, v, err)
+			}
+		}
+	}
+	if calls := atomic.LoadInt32(&mock.calls); calls != 0 {
+		t.Fatalf("reads of warmed range hit the freezer %d times", calls)
+	}
+	// Reads outside of it are not.
+	if _, err := frClient.Ancient(FreezerRemoteHeaderTable, 50); err != nil {
+		t.Fatal(err)
+	}
+	if calls := atomic.LoadInt32(&mock.calls); calls != 1 {
+		t.Fatalf("cold read: have %d calls, want 1", calls)
+	}
+	// Truncated items are dropped from the cache.
+	if err := frClient.TruncateAncients(95); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := frClient.Ancient(FreezerRemoteHeaderTable, 96); !errors.Is(err, ErrFreezerRemoteNotFound) {
+		t.Fatalf("truncated read: want %v, got %v", ErrFreezerRemoteNotFound, err)
+	}
+}
+
+func TestFreezerRemoteClientWriteBatch(t *testing.T) {
+	server := rpc.NewServer()
+	defer server.Stop()
+	mock := lib.NewMemFreezerRemoteServerAPI()
+	if err := server.RegisterName("freezer", mock); err != nil {
+		t.Fatal(err)
+	}
+	frClient := &FreezerRemoteClient{client: rpc.DialInProc(server), quit: make(chan struct{})}
+
+	appendItems := func(from, to uint64) {
+		t.Helper()
+		for i := from; i < to; i++ {
+			if err := frClient.AppendAncient(i, []byte{byte(i)}, []byte{byte(i)}, []byte{byte(i)}, []byte{byte(i)}, []byte{byte(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// The mock is queried directly, reads through the client would flush.
+	frozen := func() uint64 {
+		n, _ := mock.Ancients()
+		return n
+	}
+
+	// Appends below the batch size are flushed once the interval elapses.
+	interval := 50 * time.Millisecond
+	if err := frClient.SetWriteBatch(100, interval); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	appendItems(0, 3)
+	if n := frozen(); n != 0 && time.Since(start) < interval {
+		t.Fatalf("appends not held back: server has %d items", n)
+	}
+	for frozen() != 3 {
+		if time.Since(start) > 20*interval {
+			t.Fatalf("appends not flushed after %v: server has %d items, want 3", time.Since(start), frozen())
+		}
+		time.Sleep(interval / 10)
+	}
+
+	// Without an interval, appends are flushed once the batch is full.
+	if err := frClient.SetWriteBatch(2, 0); err != nil {
+		t.Fatal(err)
+	}
+	appendItems(3, 4)
+	time.Sleep(2 * interval)
+	if n := frozen(); n != 3 {
+		t.Fatalf("partial batch flushed: server has %d items, want 3", n)
+	}
+	appendItems(4, 5)
+	if n := frozen(); n != 5 {
+		t.Fatalf("full batch not flushed: server has %d items, want 5", n)
+	}
+
+	// Pending appends are visible to reads through the client.
+	appendItems(5, 6)
+	if n, err := frClient.Ancients(); err != nil || n != 6 {
+		t.Fatalf("ancients: have %d (%v), want 6", n, err)
+	}
+	if v, err := frClient.Ancient(FreezerRemoteHeaderTable, 5); err != nil || !bytes.Equal(v, []byte{5}) {
+		t.Fatalf("ancient #5: %x %v", v, err)
+	}
+
+	// Failed appends are reported by the write flushing them.
+	appendItems(6, 7)
+	if err := frClient.AppendAncient(42, []byte{42}, []byte{42}, []byte{42}, []byte{42}, []byte{42}); err == nil {
+		t.Fatal("out of order append succeeded")
+	}
+	if n := frozen(); n != 7 {
+		t.Fatalf("server has %d items, want 7", n)
+	}
+}
+
+// infolessFreezer is a mock freezer server predating freezer_info.
+type infolessFreezer struct {
+	*lib.MemFreezerRemoteServerAPI
+	Info struct{} // Shadows the promoted Info method, removing it from the RPC API
+}
+
+func TestFreezerRemoteClientInfo(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Stop()
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	db, err := NewDatabaseWithFreezerRemote(NewMemoryDatabase(), httpServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	info := db.(interface{ FreezerInfo() *FreezerRemoteInfo }).FreezerInfo()
+	if info == nil {
+		t.Fatal("server info not fetched")
+	}
+	if !strings.HasPrefix(info.Version, "ancient-store-mem/") {
+		t.Errorf("unexpected version: %q", info.Version)
+	}
+	if want := (FreezerRemoteFeatures{Batch: true, IdempotentAppend: true, Lease: true, Serializers: []string{FreezerSerializerFramedName}}); !reflect.DeepEqual(info.Features, want) {
+		t.Errorf("unexpected features: have %+v, want %+v", info.Features, want)
+	}
+
+	// Servers without freezer_info are still usable.
+	infoless := rpc.NewServer()
+	defer infoless.Stop()
+	if err := infoless.RegisterName("freezer", &infolessFreezer{MemFreezerRemoteServerAPI: lib.NewMemFreezerRemoteServerAPI()}); err != nil {
+		t.Fatal(err)
+	}
+	infolessHTTP := httptest.NewServer(infoless)
+	defer infolessHTTP.Close()
+
+	client, err := NewFreezerRemoteClient(infolessHTTP.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := client.FreezerInfo(); info != nil {
+		t.Errorf("server info reported by server without freezer_info: %+v", info)
+	}
+	if _, err := client.Ancients(); err != nil {
+		t.Errorf("ancients: %v", err)
+	}
+}
+
+// reconcilingFreezer is a mock freezer server counting the calls made to reconcile
+// the chain pointers.
+type reconcilingFreezer struct {
+	*lib.MemFreezerRemoteServerAPI
+	ancientsCalls int32
+	stateCalls    int32
+}
+
+func (f *reconcilingFreezer) Ancients() (uint64, error) {
+	atomic.AddInt32(&f.ancientsCalls, 1)
+	return f.MemFreezerRemoteServerAPI.Ancients()
+}
+
+func (f *reconcilingFreezer) State() (*lib.FreezerState, error) {
+	atomic.AddInt32(&f.stateCalls, 1)
+	return f.MemFreezerRemoteServerAPI.State()
+}
+
+// statelessFreezer is a mock freezer server predating freezer_state.
+type statelessFreezer struct {
+	*lib.MemFreezerRemoteServerAPI
+	State struct{} // Shadows the promoted State method, removing it from the RPC API
+}
+
+func TestFreezerRemoteClientState(t *testing.T) {
+	mock := &reconcilingFreezer{MemFreezerRemoteServerAPI: lib.NewMemFreezerRemoteServerAPI()}
+	for i := uint64(0); i < 10; i++ {
+		if err := mock.AppendAncient(i, common.Hash{byte(i)}.Bytes(), []byte{byte(i)}, []byte{byte(i)}, []byte{byte(i)}, []byte{byte(i)}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := rpc.NewServer()
+	defer server.Stop()
+	if err := server.RegisterName("freezer", mock); err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	// A key-value store continuing where the freezer left off.
+	kvdb := NewMemoryDatabase()
+	WriteCanonicalHash(kvdb, common.Hash{0}, 0)
+	WriteCanonicalHash(kvdb, common.Hash{10}, 10)
+
+	db, err := NewDatabaseWithFreezerRemote(kvdb, httpServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if calls := atomic.LoadInt32(&mock.stateCalls); calls != 1 {
+		t.Errorf("startup state calls: have %d, want 1", calls)
+	}
+	if calls := atomic.LoadInt32(&mock.ancientsCalls); calls != 0 {
+		t.Errorf("startup ancients calls: have %d, want 0", calls)
+	}
+
+	check := func(name string, client *FreezerRemoteClient) {
+		state, err := client.State()
+		if err != nil {
+			t.Fatalf("%s: state: %v", name, err)
+		}
+		ancients, err := client.Ancients()
+		if err != nil {
+			t.Fatalf("%s: ancients: %v", name, err)
+		}
+		kinds, err := client.AncientKinds()
+		if err != nil {
+			t.Fatalf("%s: ancient kinds: %v", name, err)
+		}
+		if state.Ancients != ancients || state.Ancients != 10 {
+			t.Errorf("%s: ancients mismatch: state %d, individual %d", name, state.Ancients, ancients)
+		}
+		if state.Tail != 0 {
+			t.Errorf("%s: unexpected tail %d", name, state.Tail)
+		}
+		if !reflect.DeepEqual(state.Kinds, kinds) {
+			t.Errorf("%s: kinds mismatch: state %v, individual %v", name, state.Kinds, kinds)
+		}
+	}
+	check("state", db.(*freezerdb).AncientStore.(*FreezerRemoteClient))
+
+	// Servers without freezer_state are queried individually.
+	stateless := rpc.NewServer()
+	defer stateless.Stop()
+	if err := stateless.RegisterName("freezer", &statelessFreezer{MemFreezerRemoteServerAPI: mock.MemFreezerRemoteServerAPI}); err != nil {
+		t.Fatal(err)
+	}
+	check("stateless", &FreezerRemoteClient{client: rpc.DialInProc(stateless), quit: make(chan struct{})})
+}
+
+// Tests that an append whose response is lost to a dropped connection is retried
+// with the same idempotency key, and written exactly once.
+func TestFreezerRemoteClientAppendRetry(t *testing.T) {
+	mock := lib.NewMemFreezerRemoteServerAPI()
+	server := rpc.NewServer()
+	defer server.Stop()
+	if err := server.RegisterName("freezer", mock); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		appends int32
+		keys    = make(map[string]int)
+		keysMu  sync.Mutex
+	)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		var req struct {
+			Method string        `json:"method"`
+			Params []interface{} `json:"params"`
+		}
+		if json.Unmarshal(body, &req) != nil || req.Method != FreezerMethodAppendAncient {
+			server.ServeHTTP(w, r)
+			return
+		}
+		if len(req.Params) == 7 {
+			keysMu.Lock()
+			keys[fmt.Sprint(req.Params[6])]++
+			keysMu.Unlock()
+		}
+		if atomic.AddInt32(&appends, 1) > 1 {
+			server.ServeHTTP(w, r)
+			return
+		}
+		// Let the first append land, then drop the connection before responding.
+		server.ServeHTTP(httptest.NewRecorder(), r)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+	}))
+	defer httpServer.Close()
+
+	client, err := NewFreezerRemoteClient(httpServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if info := client.FreezerInfo(); info == nil || !info.Features.IdempotentAppend {
+		t.Fatalf("server does not report idempotent appends: %v", info)
+	}
+	if err := client.AppendAncient(0, []byte{0}, []byte{1}, []byte{2}, []byte{3}, []byte{4}); err != nil {
+		t.Fatalf("retried append failed: %v", err)
+	}
+	if n := atomic.LoadInt32(&appends); n != 2 {
+		t.Errorf("append requests: have %d, want 2", n)
+	}
+	if len(keys) != 1 {
+		t.Errorf("retries did not reuse the idempotency key: %v", keys)
+	}
+	if n, err := mock.Ancients(); err != nil || n != 1 {
+		t.Errorf("ancients: have %d (err %v), want 1", n, err)
+	}
+	if blob, err := client.Ancient(freezerHeaderTable, 0); err != nil || !bytes.Equal(blob, []byte{1}) {
+		t.Errorf("ancient: have %x (err %v), want 01", blob, err)
+	}
+	// The next append is written as usual.
+	if err := client.AppendAncient(1, []byte{0}, []byte{1}, []byte{2}, []byte{3}, []byte{4}); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := mock.Ancients(); n != 2 {
+		t.Errorf("ancients after second append: have %d, want 2", n)
+	}
+}
+
+func TestFreezerRemoteClientNotYetFrozen(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Stop()
+	frClient := &FreezerRemoteClient{client: rpc.DialInProc(server), quit: make(chan struct{})}
+	for i := uint64(0); i < 3; i++ {
+		if err := frClient.AppendAncient(i, []byte{byte(i)}, []byte{byte(i)}, []byte{byte(i)}, []byte{byte(i)}, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, number := range []uint64{3, 5} {
+		_, err := frClient.Ancient(FreezerRemoteHeaderTable, number)
+		if !errors.Is(err, ErrNotYetFrozen) {
+			t.Errorf("read #%d: want %v, got %v", number, ErrNotYetFrozen, err)
+		}
+		if !errors.Is(err, ErrFreezerRemoteNotFound) {
+			t.Errorf("read #%d: want %v, got %v", number, ErrFreezerRemoteNotFound, err)
+		}
+	}
+	// Missing items below the frozen height are not reported as not yet frozen.
+	if _, err := frClient.Ancient("unknown", 1); !errors.Is(err, ErrFreezerRemoteNotFound) || errors.Is(err, ErrNotYetFrozen) {
+		t.Errorf("missing frozen item: want %v, got %v", ErrFreezerRemoteNotFound, err)
+	}
+	if blob, err := frClient.Ancient(FreezerRemoteHeaderTable, 2); err != nil || !bytes.Equal(blob, []byte{2}) {
+		t.Errorf("frozen read: have %x (err %v), want 02", blob, err)
+	}
+}
+
+// writeTestChain writes a canonical chain of empty blocks up to the given head
+// into the key-value store.
+func writeTestChain(db ethdb.KeyValueWriter, head uint64) {
+	var parent common.Hash
+	for i := uint64(0); i <= head; i++ {
+		block := types.NewBlockWithHeader(&types.Header{Number: new(big.Int).SetUint64(i), ParentHash: parent, Extra: []byte("test")})
+		WriteBlock(db, block)
+		WriteReceipts(db, block.Hash(), i, nil)
+		WriteTd(db, block.Hash(), i, new(big.Int).SetUint64(i+1))
+		WriteCanonicalHash(db, block.Hash(), i)
+		WriteHeadBlockHash(db, block.Hash())
+		parent = block.Hash()
+	}
+}
+
+// Tests that blocks are frozen on demand up to the requested height, but never
+// within the freezing threshold of the head.
+func TestFreezerRemoteClientFreezeUpTo(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Stop()
+	frClient := &FreezerRemoteClient{client: rpc.DialInProc(server), quit: make(chan struct{}), threshold: 16}
+
+	db := NewMemoryDatabase()
+	writeTestChain(db, 64)
+	if _, err := frClient.freezeUpTo(context.Background(), db, 20); err != nil {
+		t.Fatalf("freeze up to 20: %v", err)
+	}
+	if n, err := frClient.Ancients(); err != nil || n != 20 {
+		t.Fatalf("ancients: have %d (err %v), want 20", n, err)
+	}
+	for i := uint64(1); i < 20; i++ {
+		if hash := ReadCanonicalHash(db, i); hash != (common.Hash{}) {
+			t.Errorf("block #%d frozen but still in the key-value store", i)
+		}
+	}
+	if hash := ReadCanonicalHash(db, 20); hash == (common.Hash{}) {
+		t.Error("block #20 removed from the key-value store")
+	}
+	// Blocks within the threshold of the head are left alone.
+	if _, err := frClient.freezeUpTo(context.Background(), db, 64); err != nil {
+		t.Fatalf("freeze up to 64: %v", err)
+	}
+	if n, err := frClient.Ancients(); err != nil || n != 64-16+1 {
+		t.Fatalf("ancients: have %d (err %v), want %d", n, err, 64-16+1)
+	}
+}
+
+// cancellingFreezer is a mock freezer server cancelling a context once a number of
+// items were appended, and recording the number of items at the last sync.
+type cancellingFreezer struct {
+	*lib.MemFreezerRemoteServerAPI
+	cancel   context.CancelFunc
+	after    uint64
+	appended uint64
+	synced   uint64
+}
+
+func (f *cancellingFreezer) AppendAncient(number uint64, hash, header, body, receipt, td []byte, key *string) error {
+	if err := f.MemFreezerRemoteServerAPI.AppendAncient(number, hash, header, body, receipt, td, key); err != nil {
+		return err
+	}
+	if atomic.AddUint64(&f.appended, 1) == f.after {
+		f.cancel()
+	}
+	return nil
+}
+
+func (f *cancellingFreezer) Sync() error {
+	if err := f.MemFreezerRemoteServerAPI.Sync(); err != nil {
+		return err
+	}
+	n, _ := f.Ancients()
+	atomic.StoreUint64(&f.synced, n)
+	return nil
+}
+
+// Tests that freezing on demand stops once cancelled, leaving only synced blocks in
+// the freezer and removing exactly those from the key-value store.
+func TestFreezerRemoteClientFreezeUpToCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mock := &cancellingFreezer{MemFreezerRemoteServerAPI: lib.NewMemFreezerRemoteServerAPI(), cancel: cancel, after: 7}
+	server := rpc.NewServer()
+	defer server.Stop()
+	if err := server.RegisterName("freezer", mock); err != nil {
+		t.Fatal(err)
+	}
+	frClient := &FreezerRemoteClient{client: rpc.DialInProc(server), quit: make(chan struct{}), threshold: 16}
+
+	db := NewMemoryDatabase()
+	writeTestChain(db, 64)
+	height, err := frClient.freezeUpTo(ctx, db, 40)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("freeze up to 40: want %v, got %v", context.Canceled, err)
+	}
+	if height != 7 {
+		t.Fatalf("height: have %d, want 7", height)
+	}
+	if n, err := frClient.Ancients(); err != nil || n != height || n != atomic.LoadUint64(&mock.synced) {
+		t.Fatalf("ancients: have %d (err %v), want %d synced", n, err, height)
+	}
+	for i := uint64(1); i < height; i++ {
+		if hash := ReadCanonicalHash(db, i); hash != (common.Hash{}) {
+			t.Errorf("block #%d frozen but still in the key-value store", i)
+		}
+	}
+	for i := height; i <= 64; i++ {
+		if hash := ReadCanonicalHash(db, i); hash == (common.Hash{}) {
+			t.Errorf("block #%d removed from the key-value store", i)
+		}
+	}
+	// Freezing resumes from the height reached.
+	if height, err := frClient.freezeUpTo(context.Background(), db, 40); err != nil || height != 40 {
+		t.Fatalf("resumed freeze up to 40: have %d (err %v), want 40", height, err)
+	}
+}
+
+// losingFreezer is a mock freezer server failing appends while reject is set, and
+// acknowledging them without storing them while lose is set.
+type losingFreezer struct {
+	*lib.MemFreezerRemoteServerAPI
+	reject int32
+	lose   int32
+}
+
+func (f *losingFreezer) AppendAncient(number uint64, hash, header, body, receipt, td []byte, key *string) error {
+	if atomic.LoadInt32(&f.reject) == 1 {
+		return errors.New("append rejected")
+	}
+	if atomic.LoadInt32(&f.lose) == 1 {
+		return nil
+	}
+	return f.MemFreezerRemoteServerAPI.AppendAncient(number, hash, header, body, receipt, td, key)
+}
+
+// Tests that blocks whose batched appends failed, or which the server didn't store,
+// are kept in the key-value store, and frozen once the server accepts them.
+func TestFreezerRemoteClientFreezeFailedBatch(t *testing.T) {
+	mock := &losingFreezer{MemFreezerRemoteServerAPI: lib.NewMemFreezerRemoteServerAPI(), reject: 1}
+	server := rpc.NewServer()
+	defer server.Stop()
+	if err := server.RegisterName("freezer", mock); err != nil {
+		t.Fatal(err)
+	}
+	frClient := &FreezerRemoteClient{client: rpc.DialInProc(server), quit: make(chan struct{}), threshold: 16}
+	if err := frClient.SetWriteBatch(4, 0); err != nil {
+		t.Fatal(err)
+	}
+	db := NewMemoryDatabase()
+	writeTestChain(db, 64)
+
+	kept := func() {
+		t.Helper()
+		for i := uint64(0); i <= 64; i++ {
+			if hash := ReadCanonicalHash(db, i); hash == (common.Hash{}) || ReadHeaderRLP(db, hash, i) == nil {
+				t.Fatalf("block #%d removed from the key-value store", i)
+			}
+		}
+	}
+	if _, err := frClient.freezeUpTo(context.Background(), db, 20); err == nil {
+		t.Fatal("freeze succeeded with the batch rejected")
+	}
+	if n, _ := mock.Ancients(); n != 0 {
+		t.Fatalf("server has %d items, want 0", n)
+	}
+	kept()
+
+	// The failed batch is sent again by the next flush
+	atomic.StoreInt32(&mock.reject, 0)
+	if n, err := frClient.Ancients(); err != nil || n != 4 {
+		t.Fatalf("ancients: have %d (err %v), want the 4 of the failed batch", n, err)
+	}
+	// Appends acknowledged but not stored aren't wiped either
+	atomic.StoreInt32(&mock.lose, 1)
+	if err := frClient.TruncateAncients(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := frClient.freezeUpTo(context.Background(), db, 20); err == nil {
+		t.Fatal("freeze succeeded with the blocks lost")
+	}
+	kept()
+
+	// Once the server stores the appends, the blocks are frozen
+	atomic.StoreInt32(&mock.lose, 0)
+	if height, err := frClient.freezeUpTo(context.Background(), db, 20); err != nil || height != 20 {
+		t.Fatalf("freeze up to 20: have %d (err %v), want 20", height, err)
+	}
+	for i := uint64(1); i < 20; i++ {
+		if hash := ReadCanonicalHash(db, i); hash != (common.Hash{}) {
+			t.Errorf("block #%d frozen but still in the key-value store", i)
+		}
+	}
+}
+
+// Tests that the backlog gauge tracks the blocks old enough to freeze, rising as the
+// head advances while freezing is stalled, and falling once it drains.
+func TestFreezerRemoteBacklogGauge(t *testing.T) {
+	gauge := freezeBacklogGauge
+	freezeBacklogGauge = new(metrics.StandardGauge)
+	defer func() { freezeBacklogGauge = gauge }()
+
+	mock := &rejectingFreezer{MemFreezerRemoteServerAPI: lib.NewMemFreezerRemoteServerAPI(), reject: 1}
+	server := rpc.NewServer()
+	defer server.Stop()
+	if err := server.RegisterName("freezer", mock); err != nil {
+		t.Fatal(err)
+	}
+	frClient := &FreezerRemoteClient{client: rpc.DialInProc(server), quit: make(chan struct{}), trigger: make(chan chan struct{}), threshold: 16}
+
+	db := NewMemoryDatabase()
+	writeTestChain(db, 64)
+
+	var (
+		lock sync.Mutex
+		feed event.Feed
+		done = make(chan struct{})
+	)
+	go func() {
+		freezeRemote(db, frClient, frClient.threshold, &lock, frClient.quit, frClient.trigger, &feed)
+		close(done)
+	}()
+	defer func() {
+		close(frClient.quit)
+		<-done
+	}()
+	// freeze runs a cycle of the freezing loop, returning the backlog after it.
+	freeze := func() int64 {
+		triggered := make(chan struct{})
+		frClient.trigger <- triggered
+		<-triggered
+		return freezeBacklogGauge.Value()
+	}
+	if backlog := freeze(); backlog != 64-16+1 {
+		t.Fatalf("stalled backlog: have %d, want %d", backlog, 64-16+1)
+	}
+	writeTestChain(db, 80)
+	if backlog := freeze(); backlog != 80-16+1 {
+		t.Fatalf("stalled backlog after head advanced: have %d, want %d", backlog, 80-16+1)
+	}
+	atomic.StoreInt32(&mock.reject, 0)
+	if backlog := freeze(); backlog != 0 {
+		t.Fatalf("drained backlog: have %d, want 0", backlog)
+	}
+	if n, err := frClient.Ancients(); err != nil || n != 80-16+1 {
+		t.Fatalf("ancients: have %d (err %v), want %d", n, err, 80-16+1)
+	}
+}
+
+// Tests that the freezing loop stops, keeping the blocks not frozen in the key-value
+// store, once the write lease was lost to another client.
+func TestFreezerRemoteLeaseLost(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Stop()
+	frClient := &FreezerRemoteClient{client: rpc.DialInProc(server), quit: make(chan struct{}), trigger: make(chan chan struct{}), threshold: 16}
+
+	db := NewMemoryDatabase()
+	writeTestChain(db, 64)
+
+	var (
+		lock sync.Mutex
+		feed event.Feed
+		done = make(chan struct{})
+	)
+	go func() {
+		freezeRemote(db, frClient, frClient.threshold, &lock, frClient.quit, frClient.trigger, &feed)
+		close(done)
+	}()
+	defer close(frClient.quit)
+
+	triggered := make(chan struct{})
+	frClient.trigger <- triggered
+	<-triggered
+	frozen, err := frClient.Ancients()
+	if err != nil || frozen != 64-16+1 {
+		t.Fatalf("ancients: have %d (err %v), want %d", frozen, err, 64-16+1)
+	}
+	// Revoke the lease as its renewal does once another client took it over
+	atomic.StoreInt32(&frClient.readOnly, 1)
+	writeTestChain(db, 80)
+
+	triggered = make(chan struct{})
+	frClient.trigger <- triggered
+	<-triggered
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("freezing loop still running after the lease was lost")
+	}
+	if n, err := frClient.Ancients(); err != nil || n != frozen {
+		t.Fatalf("ancients after the lease was lost: have %d (err %v), want %d", n, err, frozen)
+	}
+	for i := frozen; i <= 80; i++ {
+		if hash := ReadCanonicalHash(db, i); hash == (common.Hash{}) {
+			t.Errorf("block #%d removed from the key-value store", i)
+		}
+	}
+}
+
+// Tests that the ranges of frozen blocks are recorded, and can be queried by the
+// time they were frozen at.
+func TestFrozenRangesBetween(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Stop()
+	frClient := &FreezerRemoteClient{client: rpc.DialInProc(server), quit: make(chan struct{}), threshold: 16}
+
+	db := NewMemoryDatabase()
+	writeTestChain(db, 64)
+
+	start := time.Now()
+	if _, err := frClient.freezeUpTo(context.Background(), db, 20); err != nil {
+		t.Fatalf("freeze up to 20: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	middle := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	if _, err := frClient.freezeUpTo(context.Background(), db, 40); err != nil {
+		t.Fatalf("freeze up to 40: %v", err)
+	}
+	end := time.Now()
+
+	check := func(t0, t1 time.Time, want ...[2]uint64) {
+		t.Helper()
+		ranges := FrozenRangesBetween(db, t0, t1)
+		if len(ranges) != len(want) {
+			t.Fatalf("have %d ranges, want %d: %+v", len(ranges), len(want), ranges)
+		}
+		for i, r := range ranges {
+			if r.First != want[i][0] || r.Last != want[i][1] {
+				t.Errorf("range %d: have #%d-#%d, want #%d-#%d", i, r.First, r.Last, want[i][0], want[i][1])
+			}
+			if r.Time.Before(t0) || r.Time.After(t1) {
+				t.Errorf("range %d: frozen at %v, outside %v-%v", i, r.Time, t0, t1)
+			}
+		}
+	}
+	check(start, end, [2]uint64{0, 19}, [2]uint64{20, 39})
+	check(start, middle, [2]uint64{0, 19})
+	check(middle, end, [2]uint64{20, 39})
+	check(end.Add(time.Second), end.Add(time.Hour))
+}
+
+// Tests that a second client of a remote freezer is refused the write lease and
+// limited to reads, until the lease holder released it.
+func TestFreezerRemoteClientLease(t *testing.T) {
+	mock := lib.NewMemFreezerRemoteServerAPI()
+	server := rpc.NewServer()
+	defer server.Stop()
+	if err := server.RegisterName("freezer", mock); err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	writer, err := NewFreezerRemoteClient(httpServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if writer.ReadOnly() {
+		t.Fatal("first client refused the write lease")
+	}
+	if err := writer.AppendAncient(0, []byte{0}, []byte{1}, []byte{2}, []byte{3}, []byte{4}); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := NewFreezerRemoteClient(httpServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reader.ReadOnly() {
+		t.Fatal("second client granted the write lease")
+	}
+	if err := reader.AppendAncient(1, []byte{0}, []byte{1}, []byte{2}, []byte{3}, []byte{4}); !errors.Is(err, ErrFreezerRemoteReadOnly) {
+		t.Errorf("append: want %v, got %v", ErrFreezerRemoteReadOnly, err)
+	}
+	if err := reader.TruncateAncients(0); !errors.Is(err, ErrFreezerRemoteReadOnly) {
+		t.Errorf("truncate: want %v, got %v", ErrFreezerRemoteReadOnly, err)
+	}
+	if err := reader.Sync(); !errors.Is(err, ErrFreezerRemoteReadOnly) {
+		t.Errorf("sync: want %v, got %v", ErrFreezerRemoteReadOnly, err)
+	}
+	if n, err := reader.Ancients(); err != nil || n != 1 {
+		t.Errorf("ancients: have %d (err %v), want 1", n, err)
+	}
+	if blob, err := reader.Ancient(freezerHeaderTable, 0); err != nil || !bytes.Equal(blob, []byte{1}) {
+		t.Errorf("ancient: have %x (err %v), want 01", blob, err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Errorf("close read-only client: %v", err)
+	}
+	// Closing a read-only client closes its connections, which HTTP ones don't have.
+	dir, err := ioutil.TempDir("", "freezer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listener, err := net.Listen("unix", filepath.Join(dir, "test.ipc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeListener(listener)
+
+	ipcReader, err := NewFreezerRemoteClient(filepath.Join(dir, "test.ipc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ipcReader.ReadOnly() {
+		t.Fatal("ipc client granted the write lease")
+	}
+	if err := ipcReader.Close(); err != nil {
+		t.Errorf("close read-only ipc client: %v", err)
+	}
+	if _, err := ipcReader.Ancients(); err == nil {
+		t.Errorf("connection of the closed read-only client still open")
+	}
+	// The writer keeps writing, and the lease is free once it closed.
+	if err := writer.AppendAncient(1, []byte{0}, []byte{1}, []byte{2}, []byte{3}, []byte{4}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	next, err := NewFreezerRemoteClient(httpServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer next.Close()
+	if next.ReadOnly() {
+		t.Fatal("lease not granted after release")
+	}
+}
+
+// Tests that the freezing loop logs the details of every batch and block only at
+// the verbosities asking for them.
+func TestFreezeVerbosity(t *testing.T) {
+	defer log.Root().SetHandler(log.Root().GetHandler())
+	defer SetFreezeVerbosity(0)
+
+	var (
+		lock    sync.Mutex
+		records []*log.Record
+	)
+	log.Root().SetHandler(log.FuncHandler(func(r *log.Record) error {
+		lock.Lock()
+		defer lock.Unlock()
+		records = append(records, r)
+		return nil
+	}))
+	// collect returns the records logged with the given message since the last call.
+	collect := func(msg string) []*log.Record {
+		lock.Lock()
+		defer lock.Unlock()
+
+		var matched []*log.Record
+		for _, r := range records {
+			if r.Msg == msg {
+				matched = append(matched, r)
+			}
+		}
+		records = nil
+		return matched
+	}
+	server := newTestServer(t)
+	defer server.Stop()
+	frClient := &FreezerRemoteClient{client: rpc.DialInProc(server), quit: make(chan struct{}), threshold: 0}
+
+	db := NewMemoryDatabase()
+	writeTestChain(db, 30)
+
+	// By default, batches are not detailed.
+	if _, err := frClient.freezeUpTo(context.Background(), db, 10); err != nil {
+		t.Fatal(err)
+	}
+	if batches := collect("Froze ancient batch"); len(batches) != 0 {
+		t.Errorf("batch logged at default verbosity: %v", batches[0].Ctx)
+	}
+	// At verbosity 1, every batch is logged with its range, size and round-trip time.
+	SetFreezeVerbosity(1)
+	if _, err := frClient.freezeUpTo(context.Background(), db, 20); err != nil {
+		t.Fatal(err)
+	}
+	batches := collect("Froze ancient batch")
+	if len(batches) != 1 {
+		t.Fatalf("batches logged: have %d, want 1", len(batches))
+	}
+	ctx := make(map[interface{}]interface{})
+	for i := 0; i+1 < len(batches[0].Ctx); i += 2 {
+		ctx[batches[0].Ctx[i]] = batches[0].Ctx[i+1]
+	}
+	if ctx["first"] != uint64(10) || ctx["last"] != uint64(19) {
+		t.Errorf("batch range: have %v-%v, want 10-19", ctx["first"], ctx["last"])
+	}
+	if size, ok := ctx["size"].(common.StorageSize); !ok || size <= 0 {
+		t.Errorf("batch size: have %v", ctx["size"])
+	}
+	if _, ok := ctx["rtt"].(common.PrettyDuration); !ok {
+		t.Errorf("batch round-trip time: have %v", ctx["rtt"])
+	}
+	// At verbosity 2, every block is logged too.
+	SetFreezeVerbosity(2)
+	if _, err := frClient.freezeUpTo(context.Background(), db, 25); err != nil {
+		t.Fatal(err)
+	}
+	if blocks := collect("Froze ancient block"); len(blocks) != 5 {
+		t.Errorf("blocks logged: have %d, want 5", len(blocks))
+	}
+}
+
+// Tests that the freezer checksums record a baseline, and report the kind of an
+// ancient item corrupted afterwards as drifted.
+func TestCheckFreezerChecksums(t *testing.T) {
+	mock := lib.NewMemFreezerRemoteServerAPI()
+	server := rpc.NewServer()
+	defer server.Stop()
+	if err := server.RegisterName("freezer", mock); err != nil {
+		t.Fatal(err)
+	}
+	frClient := &FreezerRemoteClient{client: rpc.DialInProc(server), quit: make(chan struct{})}
+	db := &freezerdb{KeyValueStore: NewMemoryDatabase(), AncientStore: frClient}
+
+	for i := uint64(0); i < 10; i++ {
+		b := byte(i)
+		if err := frClient.AppendAncient(i, []byte{b, 0}, []byte{b, 1}, []byte{b, 2}, []byte{b, 3}, []byte{b, 4}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := CheckFreezerChecksums(db)
+	if err != nil {
+		t.Fatalf("baseline check: %v", err)
+	}
+	if report.Baseline != nil || len(report.Drifted) != 0 {
+		t.Fatalf("baseline check: have baseline %v, drifted %v, want none", report.Baseline, report.Drifted)
+	}
+	if sums := ReadFreezerChecksums(db); sums == nil || sums.Items != 10 || !reflect.DeepEqual(sums.Kinds, report.Checksums.Kinds) {
+		t.Fatalf("baseline not recorded: have %+v, want %+v", sums, report.Checksums)
+	}
+	// Items appended since the baseline are not drift.
+	if err := frClient.AppendAncient(10, []byte{10, 0}, []byte{10, 1}, []byte{10, 2}, []byte{10, 3}, []byte{10, 4}); err != nil {
+		t.Fatal(err)
+	}
+	if report, err = CheckFreezerChecksums(db); err != nil || len(report.Drifted) != 0 {
+		t.Fatalf("check after append: drifted %v (err %v), want none", report.Drifted, err)
+	}
+	baseline := ReadFreezerChecksums(db)
+	if baseline.Items != 11 {
+		t.Fatalf("baseline not advanced: have %d items, want 11", baseline.Items)
+	}
+	if err := mock.Corrupt(freezerBodiesTable, 4); err != nil {
+		t.Fatal(err)
+	}
+	report, err = CheckFreezerChecksums(db)
+	if err != nil {
+		t.Fatalf("check after corruption: %v", err)
+	}
+	if want := []string{freezerBodiesTable}; !reflect.DeepEqual(report.Drifted, want) {
+		t.Fatalf("drifted kinds mismatch: have %v, want %v", report.Drifted, want)
+	}
+	// The baseline is kept, reporting the drift again on the next check.
+	if sums := ReadFreezerChecksums(db); !reflect.DeepEqual(sums, baseline) {
+		t.Fatalf("baseline replaced after drift: have %+v, want %+v", sums, baseline)
+	}
+	if report, err = CheckFreezerChecksums(db); err != nil || len(report.Drifted) != 1 {
+		t.Fatalf("repeated check: drifted %v (err %v), want %s", report.Drifted, err, freezerBodiesTable)
+	}
+}
+
+func TestFreezerRemoteClientReplicas(t *testing.T) {
+	// serve starts a counting mock freezer server over HTTP.
+	serve := func() (*countingFreezer, string) {
+		server := rpc.NewServer()
+		t.Cleanup(server.Stop)
+		mock := &countingFreezer{MemFreezerRemoteServerAPI: lib.NewMemFreezerRemoteServerAPI()}
+		if err := server.RegisterName("freezer", mock); err != nil {
+			t.Fatal(err)
+		}
+		httpServer := httptest.NewServer(server)
+		t.Cleanup(httpServer.Close)
+		return mock, httpServer.URL
+	}
+	primary, primaryURL := serve()
+	replica1, replica1URL := serve()
+	replica2, replica2URL := serve()
+
+	client, err := NewFreezerRemoteClientWithReplicas(primaryURL, []string{replica1URL, replica2URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Writes go to the primary only, the replicas lag one item behind it.
+	for i := uint64(0); i < 10; i++ {
+		if err := client.AppendAncient(i, []byte{byte(i)}, []byte{byte(i)}, []byte{byte(i)}, []byte{byte(i)}, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, replica := range []*countingFreezer{replica1, replica2} {
+		if frozen, _ := replica.Ancients(); frozen != 0 {
+			t.Fatalf("write replicated by the client: %d items", frozen)
+		}
+		for i := uint64(0); i < 9; i++ {
+			if err := replica.AppendAncient(i, []byte{byte(i)}, []byte{byte(i)}, []byte{byte(i)}, []byte{byte(i)}, []byte{byte(i)}, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := uint64(0); i < 9; i++ {
+		for _, kind := range []string{freezerHashTable, freezerHeaderTable} {
+			blob, err := client.Ancient(kind, i)
+			if err != nil {
+				t.Fatalf("item %d: %v", i, err)
+			}
+			if !bytes.Equal(blob, []byte{byte(i)}) {
+				t.Errorf("item %d %s: have %x, want %x", i, kind, blob, []byte{byte(i)})
+			}
+		}
+	}
+	calls1, calls2 := atomic.LoadInt32(&replica1.calls), atomic.LoadInt32(&replica2.calls)
+	if calls1+calls2 != 18 || calls1 != calls2 {
+		t.Errorf("reads not distributed: %d and %d", calls1, calls2)
+	}
+	if calls := atomic.LoadInt32(&primary.calls); calls != 0 {
+		t.Errorf("primary served %d reads", calls)
+	}
+	// Items not yet on the replicas are read from the primary.
+	if blob, err := client.Ancient(freezerHashTable, 9); err != nil || !bytes.Equal(blob, []byte{9}) {
+		t.Errorf("lagging item: have %x (err %v), want %x", blob, err, []byte{9})
+	}
+	if calls := atomic.LoadInt32(&primary.calls); calls != 1 {
+		t.Errorf("primary served %d reads, want 1", calls)
+	}
+}
+
+// closingFreezer is a mock freezer server counting its Close calls.
+type closingFreezer struct {
+	*lib.MemFreezerRemoteServerAPI
+	closed int32
+}
+
+func (f *closingFreezer) Close() error {
+	atomic.AddInt32(&f.closed, 1)
+	return f.MemFreezerRemoteServerAPI.Close()
+}
+
+// Tests that failing to dial a read replica leaves the primary server open.
+func TestFreezerRemoteClientReplicaDialFailure(t *testing.T) {
+	server := rpc.NewServer()
+	defer server.Stop()
+	primary := &closingFreezer{MemFreezerRemoteServerAPI: lib.NewMemFreezerRemoteServerAPI()}
+	if err := server.RegisterName("freezer", primary); err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	dir, err := ioutil.TempDir("", "freezer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := NewFreezerRemoteClientWithReplicas(httpServer.URL, []string{filepath.Join(dir, "missing.ipc")}); err == nil {
+		t.Fatal("unreachable replica dialed")
+	}
+	if closed := atomic.LoadInt32(&primary.closed); closed != 0 {
+		t.Errorf("primary closed %d times, want 0", closed)
+	}
+}
+
+// laggingFreezer is a mock read replica reporting the first lag Ancient calls as not
+// found, as if it had not replicated the items yet.
+type laggingFreezer struct {
+	*lib.MemFreezerRemoteServerAPI
+	lag   int32
+	calls int32
+}
+
+func (f *laggingFreezer) Ancient(kind string, number uint64) ([]byte, error) {
+	if atomic.AddInt32(&f.calls, 1) <= atomic.LoadInt32(&f.lag) {
+		return nil, errOutOfBounds
+	}
+	return f.MemFreezerRemoteServerAPI.Ancient(kind, number)
+}
+
+func TestFreezerRemoteClientStaleReadRetry(t *testing.T) {
+	serve := func(api interface{}) string {
+		server := rpc.NewServer()
+		t.Cleanup(server.Stop)
+		if err := server.RegisterName("freezer", api); err != nil {
+			t.Fatal(err)
+		}
+		httpServer := httptest.NewServer(server)
+		t.Cleanup(httpServer.Close)
+		return httpServer.URL
+	}
+	primary := &countingFreezer{MemFreezerRemoteServerAPI: lib.NewMemFreezerRemoteServerAPI()}
+	replica := &laggingFreezer{MemFreezerRemoteServerAPI: lib.NewMemFreezerRemoteServerAPI()}
+	for _, store := range []*lib.MemFreezerRemoteServerAPI{primary.MemFreezerRemoteServerAPI, replica.MemFreezerRemoteServerAPI} {
+		if err := store.AppendAncient(0, []byte{1}, []byte{2}, []byte{3}, []byte{4}, []byte{5}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client, err := NewFreezerRemoteClientWithReplicas(serve(primary), []string{serve(replica)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Without retries, items the replica lags behind are read from the primary.
+	atomic.StoreInt32(&replica.lag, 1)
+	if blob, err := client.Ancient(freezerHashTable, 0); err != nil || !bytes.Equal(blob, []byte{1}) {
+		t.Fatalf("lagging read: have %x (err %v), want %x", blob, err, []byte{1})
+	}
+	if calls := atomic.LoadInt32(&primary.calls); calls != 1 {
+		t.Fatalf("primary served %d reads, want 1", calls)
+	}
+	// With retries, the replica serves the read once it caught up.
+	client.SetStaleReadRetry(3, time.Millisecond)
+	atomic.StoreInt32(&replica.calls, 0)
+	atomic.StoreInt32(&replica.lag, 2)
+	if blob, err := client.Ancient(freezerHeaderTable, 0); err != nil || !bytes.Equal(blob, []byte{2}) {
+		t.Fatalf("lagging read: have %x (err %v), want %x", blob, err, []byte{2})
+	}
+	if calls := atomic.LoadInt32(&replica.calls); calls != 3 {
+		t.Errorf("replica reads: have %d, want 3", calls)
+	}
+	if calls := atomic.LoadInt32(&primary.calls); calls != 1 {
+		t.Errorf("primary served %d reads, want 1", calls)
+	}
+	// Reads of items the primary did not freeze are not retried.
+	atomic.StoreInt32(&replica.calls, 0)
+	atomic.StoreInt32(&replica.lag, 0)
+	if _, err := client.Ancient(freezerHashTable, 1); !errors.Is(err, ErrNotYetFrozen) {
+		t.Fatalf("read beyond the primary: want %v, got %v", ErrNotYetFrozen, err)
+	}
+	if calls := atomic.LoadInt32(&replica.calls); calls != 1 {
+		t.Errorf("replica reads beyond the primary: have %d, want 1", calls)
+	}
+}
+
+// restartingHandler serves a freezer server over HTTP, dropping the connections of
+// the requests received while it is down, as if the server were restarting.
+type restartingHandler struct {
+	http.Handler
+	down    int32         // 1 while the server is down (atomic)
+	drops   int32         // Number of requests dropped (atomic)
+	dropped chan struct{} // Signalled once a request was dropped
+}
+
+func (h *restartingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&h.down) == 0 {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+	if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+		conn.Close()
+	}
+	atomic.AddInt32(&h.drops, 1)
+	select {
+	case h.dropped <- struct{}{}:
+	default:
+	}
+}
+
+// Tests that reads spanning a restart of the server are retried until it is back,
+// instead of failing, if the items were frozen.
+func TestFreezerRemoteClientServerRestart(t *testing.T) {
+	const items = 16
+
+	server := rpc.NewServer()
+	defer server.Stop()
+	store := lib.NewMemFreezerRemoteServerAPI()
+	if err := server.RegisterName("freezer", store); err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(0); i < items; i++ {
+		if err := store.AppendAncient(i, []byte{byte(i)}, []byte{2}, []byte{3}, []byte{4}, []byte{5}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := &restartingHandler{Handler: server, dropped: make(chan struct{}, 1)}
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+
+	client, err := NewFreezerRemoteClient(httpServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if n, err := client.Ancients(); err != nil || n != items {
+		t.Fatalf("ancients: have %d (err %v), want %d", n, err, items)
+	}
+	// A read while the server is down is retried once it's back
+	atomic.StoreInt32(&handler.down, 1)
+	read := make(chan error, 1)
+	go func() {
+		blob, err := client.Ancient(freezerHashTable, items-1)
+		if err == nil && !bytes.Equal(blob, []byte{items - 1}) {
+			err = fmt.Errorf("have %x, want %x", blob, []byte{items - 1})
+		}
+		read <- err
+	}()
+	<-handler.dropped
+	atomic.StoreInt32(&handler.down, 0)
+	if err := <-read; err != nil {
+		t.Fatalf("read across the restart: %v", err)
+	}
+	// Reads of items beyond the ancients last reported are not retried
+	atomic.StoreInt32(&handler.down, 1)
+	atomic.StoreInt32(&handler.drops, 0)
+	if _, err := client.Ancient(freezerHashTable, items); !errors.Is(err, ErrFreezerRemoteTransient) {
+		t.Fatalf("read beyond the ancients: want %v, got %v", ErrFreezerRemoteTransient, err)
+	}
+	if drops := atomic.LoadInt32(&handler.drops); drops != 1 {
+		t.Errorf("read beyond the ancients attempted %d times, want 1", drops)
+	}
+	// Reads of items beyond the restarted server's ancients are still refused
+	atomic.StoreInt32(&handler.down, 0)
+	if _, err := client.Ancient(freezerHashTable, items); !errors.Is(err, ErrNotYetFrozen) {
+		t.Fatalf("read beyond the ancients: want %v, got %v", ErrNotYetFrozen, err)
+	}
+}
@@ -0,0 +1,156 @@
+package rawdb
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// freezerReadAhead prefetches the items following sequential reads of a kind into
+// the read cache, a window of items in a single batch request at a time.
+type freezerReadAhead struct {
+	window uint64
+	lock   sync.Mutex
+	kinds  map[string]*freezerReadAheadState
+}
+
+// freezerReadAheadState tracks the sequential reads of a kind.
+type freezerReadAheadState struct {
+	last    uint64        // Number of the last item read
+	from    uint64        // First number of the in-flight prefetch
+	horizon uint64        // First number not yet prefetched
+	pending chan struct{} // Closed once the in-flight prefetch finished, nil if none
+}
+
+// SetReadAhead enables prefetching the window of items following sequential reads
+// of a kind, eg. by tools scanning the ancients, in the background. Reads of items
+// being prefetched wait for the prefetch instead of issuing their own request. The
+// prefetched items are kept in the read cache, which is enabled large enough for a
+// few windows if there is none. Zero disables prefetching.
+//
+// The method must be called before the client is used concurrently.
+func (api *FreezerRemoteClient) SetReadAhead(window int) {
+	if window <= 0 {
+		api.readAhead = nil
+		return
+	}
+	if api.cache == nil {
+		api.SetReadCache(2 * window * len(freezerKinds))
+	}
+	api.readAhead = &freezerReadAhead{window: uint64(window), kinds: make(map[string]*freezerReadAheadState)}
+}
+
+// awaitReadAhead waits for the in-flight prefetch of the kind if it covers number,
+// or until ctx is done.
+func (api *FreezerRemoteClient) awaitReadAhead(ctx context.Context, kind string, number uint64) {
+	ra := api.readAhead
+	ra.lock.Lock()
+	state := ra.kinds[kind]
+	if state == nil || state.pending == nil || number < state.from || number >= state.horizon {
+		ra.lock.Unlock()
+		return
+	}
+	pending := state.pending
+	ra.lock.Unlock()
+
+	select {
+	case <-pending:
+	case <-ctx.Done():
+	}
+}
+
+// scheduleReadAhead records a read of number, starting the prefetch of the next
+// window of the kind in the background if the reads are sequential and less than
+// half a window is prefetched ahead of it.
+func (api *FreezerRemoteClient) scheduleReadAhead(kind string, number uint64) {
+	ra := api.readAhead
+	ra.lock.Lock()
+	defer ra.lock.Unlock()
+
+	state := ra.kinds[kind]
+	if state == nil {
+		ra.kinds[kind] = &freezerReadAheadState{last: number}
+		return
+	}
+	sequential := number == state.last+1
+	state.last = number
+	if !sequential && state.pending == nil {
+		state.horizon = 0 // The scan moved, the old window is of no use
+	}
+	if !sequential || state.pending != nil || state.horizon >= number+1+ra.window/2 {
+		return
+	}
+	from, to := number+1, number+1+ra.window
+	if state.horizon > from {
+		from = state.horizon
+	}
+	state.from, state.horizon = from, to
+	state.pending = make(chan struct{})
+
+	go func(pending chan struct{}) {
+		api.prefetch(kind, from, to)
+
+		ra.lock.Lock()
+		state.pending = nil
+		ra.lock.Unlock()
+		close(pending)
+	}(state.pending)
+}
+
+// prefetch reads the items of the kind from and up to to into the read cache in a
+// single batch request. Items which are not available are skipped.
+func (api *FreezerRemoteClient) prefetch(kind string, from, to uint64) {
+	gen := atomic.LoadUint64(&api.cacheGen)
+	var (
+		batch   = make([]rpc.BatchElem, 0, to-from)
+		results = make([][]byte, to-from)
+	)
+	for number := from; number < to; number++ {
+		batch = append(batch, rpc.BatchElem{
+			Method: FreezerMethodAncient,
+			Args:   []interface{}{kind, number},
+			Result: &results[number-from],
+		})
+	}
+	if err := api.readBatch(context.Background(), batch); err != nil {
+		log.Debug("Remote freezer prefetch failed", "kind", kind, "from", from, "to", to, "err", err)
+		return
+	}
+	limit := api.MaxResponseSize()
+	for i, elem := range batch {
+		res := results[i]
+		if elem.Error != nil || uint64(len(res)) > limit {
+			continue
+		}
+		if api.serializer != nil {
+			var err error
+			if res, err = api.serializer.Decode(kind, res); err != nil {
+				continue
+			}
+		}
+		// Don't cache items read before a truncation finished, they may be gone.
+		if atomic.LoadUint64(&api.cacheGen) != gen {
+			return
+		}
+		api.cache.Add(freezerRemoteCacheKey{kind, from + uint64(i)}, res)
+	}
+}
+
+// readBatch performs a batch of read-only RPC calls, using an idle connection of the
+// read pool if there is one.
+func (api *FreezerRemoteClient) readBatch(ctx context.Context, batch []rpc.BatchElem) error {
+	if api.readers == nil {
+		return classifyFreezerRemoteError(api.client.BatchCallContext(ctx, batch))
+	}
+	var client *rpc.Client
+	select {
+	case client = <-api.readers:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { api.readers <- client }()
+	return classifyFreezerRemoteError(client.BatchCallContext(ctx, batch))
+}
@@ -0,0 +1,91 @@
+package rawdb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/cmd/ancient-store-mem/lib"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// Tests that sequential scans are served by prefetched batches, issuing far fewer
+// blocking round-trips than without prefetching.
+func TestFreezerRemoteReadAhead(t *testing.T) {
+	const items = 256
+
+	// scan reads the headers of all items in order, returning the number of single,
+	// ie. blocking, requests the server received meanwhile.
+	scan := func(window int) int64 {
+		server := rpc.NewServer()
+		defer server.Stop()
+		if err := server.RegisterName("freezer", lib.NewMemFreezerRemoteServerAPI()); err != nil {
+			t.Fatal(err)
+		}
+		var single int64
+		httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			if !bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+				atomic.AddInt64(&single, 1)
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			server.ServeHTTP(w, r)
+		}))
+		defer httpServer.Close()
+
+		client, err := NewFreezerRemoteClient(httpServer.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		client.SetReadAhead(window)
+
+		for i := uint64(0); i < items; i++ {
+			if err := client.AppendAncient(i, []byte{byte(i)}, []byte{byte(i), 1}, []byte{byte(i), 2}, []byte{byte(i), 3}, []byte{byte(i), 4}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		atomic.StoreInt64(&single, 0)
+		for i := uint64(0); i < items; i++ {
+			blob, err := client.Ancient(freezerHeaderTable, i)
+			if err != nil {
+				t.Fatalf("window %d: item %d: %v", window, i, err)
+			}
+			if want := []byte{byte(i), 1}; !bytes.Equal(blob, want) {
+				t.Fatalf("window %d: item %d: have %x, want %x", window, i, blob, want)
+			}
+		}
+		return atomic.LoadInt64(&single)
+	}
+	if blocking := scan(0); blocking != items {
+		t.Errorf("blocking requests without prefetching: have %d, want %d", blocking, items)
+	}
+	if blocking := scan(64); blocking > 4 {
+		t.Errorf("blocking requests with prefetching: have %d, want at most 4", blocking)
+	}
+}
+
+// Tests that the read-ahead window of the options is in effect as the database opens.
+func TestFreezerRemoteReadAheadOption(t *testing.T) {
+	server := rpc.NewServer()
+	defer server.Stop()
+	if err := server.RegisterName("freezer", lib.NewMemFreezerRemoteServerAPI()); err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	db, err := NewDatabaseWithFreezerRemoteOptions(NewMemoryDatabase(), httpServer.URL, FreezerRemoteOptions{ReadAhead: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	client := db.(*freezerdb).AncientStore.(*FreezerRemoteClient)
+	if client.readAhead == nil || client.readAhead.window != 16 {
+		t.Fatalf("read-ahead not enabled on opening: %+v", client.readAhead)
+	}
+}
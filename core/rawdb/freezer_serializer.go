@@ -0,0 +1,89 @@
+package rawdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// FreezerSerializer converts ancient items, which are RLP encoded, from and to the
+// payloads stored by a remote freezer.
+type FreezerSerializer interface {
+	// Name identifies the serialization towards the remote freezer, which must
+	// list it among its supported serializers.
+	Name() string
+
+	// Encode converts an ancient item of the given kind to the payload to store.
+	Encode(kind string, item []byte) []byte
+
+	// Decode converts a stored payload of the given kind back to the ancient item.
+	Decode(kind string, payload []byte) ([]byte, error)
+}
+
+const (
+	// FreezerSerializerRLPName is the name of the RLP passthrough serialization,
+	// supported by every remote freezer.
+	FreezerSerializerRLPName = "rlp"
+
+	// FreezerSerializerFramedName is the name of the framed serialization.
+	FreezerSerializerFramedName = "framed"
+)
+
+// freezerFrameMagic is the header of every payload of the framed serialization.
+var freezerFrameMagic = []byte("GFRZ")
+
+// errFreezerFrame is returned when decoding a payload which is not a valid frame.
+var errFreezerFrame = errors.New("invalid freezer payload frame")
+
+// FreezerSerializerRLP stores ancient items as they are, in RLP. It is the default.
+type FreezerSerializerRLP struct{}
+
+// Name implements FreezerSerializer.
+func (FreezerSerializerRLP) Name() string { return FreezerSerializerRLPName }
+
+// Encode implements FreezerSerializer.
+func (FreezerSerializerRLP) Encode(kind string, item []byte) []byte { return item }
+
+// Decode implements FreezerSerializer.
+func (FreezerSerializerRLP) Decode(kind string, payload []byte) ([]byte, error) { return payload, nil }
+
+// FreezerSerializerFramed stores ancient items in frames external tools can parse
+// without knowledge of RLP: the magic header "GFRZ", followed by the length of the
+// item as a 4 byte big endian integer, followed by the item.
+type FreezerSerializerFramed struct{}
+
+// Name implements FreezerSerializer.
+func (FreezerSerializerFramed) Name() string { return FreezerSerializerFramedName }
+
+// Encode implements FreezerSerializer.
+func (FreezerSerializerFramed) Encode(kind string, item []byte) []byte {
+	payload := make([]byte, len(freezerFrameMagic)+4+len(item))
+	copy(payload, freezerFrameMagic)
+	binary.BigEndian.PutUint32(payload[len(freezerFrameMagic):], uint32(len(item)))
+	copy(payload[len(freezerFrameMagic)+4:], item)
+	return payload
+}
+
+// Decode implements FreezerSerializer.
+func (FreezerSerializerFramed) Decode(kind string, payload []byte) ([]byte, error) {
+	if len(payload) < len(freezerFrameMagic)+4 || !bytes.HasPrefix(payload, freezerFrameMagic) {
+		return nil, fmt.Errorf("%w: %s: missing header", errFreezerFrame, kind)
+	}
+	size := binary.BigEndian.Uint32(payload[len(freezerFrameMagic):])
+	if item := payload[len(freezerFrameMagic)+4:]; uint64(len(item)) != uint64(size) {
+		return nil, fmt.Errorf("%w: %s: length %d, have %d bytes", errFreezerFrame, kind, size, len(item))
+	}
+	return payload[len(freezerFrameMagic)+4:], nil
+}
+
+// FreezerSerializerByName returns the built-in serializer of the given name.
+func FreezerSerializerByName(name string) (FreezerSerializer, error) {
+	switch name {
+	case "", FreezerSerializerRLPName:
+		return FreezerSerializerRLP{}, nil
+	case FreezerSerializerFramedName:
+		return FreezerSerializerFramed{}, nil
+	}
+	return nil, fmt.Errorf("unknown freezer serializer %q", name)
+}
@@ -0,0 +1,144 @@
+package rawdb
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/cmd/ancient-store-mem/lib"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// Tests that receipts round-trip through a remote freezer storing framed payloads.
+func TestFreezerSerializerFramedReceipts(t *testing.T) {
+	mock := lib.NewMemFreezerRemoteServerAPI()
+	server := rpc.NewServer()
+	defer server.Stop()
+	if err := server.RegisterName("freezer", mock); err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	client, err := NewFreezerRemoteClient(httpServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.SetSerializer(FreezerSerializerFramed{}); err != nil {
+		t.Fatalf("framed serializer refused: %v", err)
+	}
+	receipts := []*types.ReceiptForStorage{
+		{
+			Status:            types.ReceiptStatusSuccessful,
+			CumulativeGasUsed: 21000,
+			Logs: []*types.Log{
+				{Address: common.Address{0x11}, Topics: []common.Hash{{0x22}, {0x33}}, Data: []byte{0x44, 0x55}},
+			},
+		},
+		{Status: types.ReceiptStatusFailed, CumulativeGasUsed: 42000, Logs: []*types.Log{}},
+	}
+	blob, err := rlp.EncodeToBytes(receipts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.AppendAncient(0, common.Hash{0x01}.Bytes(), []byte{0x02}, []byte{0x03}, blob, []byte{0x04}); err != nil {
+		t.Fatal(err)
+	}
+	// The server stores the framed payload, the client reads back the item.
+	stored, err := mock.Ancient(freezerReceiptTable, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (FreezerSerializerFramed{}).Encode(freezerReceiptTable, blob); !bytes.Equal(stored, want) || !bytes.HasPrefix(stored, []byte("GFRZ")) {
+		t.Fatalf("stored payload mismatch: have %x, want %x", stored, want)
+	}
+	read, err := client.Ancient(freezerReceiptTable, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var have, want []*types.ReceiptForStorage
+	if err := rlp.DecodeBytes(read, &have); err != nil {
+		t.Fatalf("failed to decode round-tripped receipts: %v", err)
+	}
+	if err := rlp.DecodeBytes(blob, &want); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("receipts mismatch: have %+v, want %+v", have, want)
+	}
+	// Payloads which are not frames are refused.
+	if _, err := (FreezerSerializerFramed{}).Decode(freezerReceiptTable, blob); !errors.Is(err, errFreezerFrame) {
+		t.Errorf("unframed payload: want %v, got %v", errFreezerFrame, err)
+	}
+	truncated := stored[:len(stored)-1]
+	if _, err := (FreezerSerializerFramed{}).Decode(freezerReceiptTable, truncated); !errors.Is(err, errFreezerFrame) {
+		t.Errorf("truncated frame: want %v, got %v", errFreezerFrame, err)
+	}
+}
+
+// Tests that serializers not supported by the server are refused.
+func TestFreezerSerializerNegotiation(t *testing.T) {
+	infoless := rpc.NewServer()
+	defer infoless.Stop()
+	if err := infoless.RegisterName("freezer", &infolessFreezer{MemFreezerRemoteServerAPI: lib.NewMemFreezerRemoteServerAPI()}); err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(infoless)
+	defer httpServer.Close()
+
+	client, err := NewFreezerRemoteClient(httpServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.SetSerializer(FreezerSerializerFramed{}); !errors.Is(err, ErrFreezerRemoteProtocol) {
+		t.Errorf("framed serializer: want %v, got %v", ErrFreezerRemoteProtocol, err)
+	}
+	if err := client.SetSerializer(FreezerSerializerRLP{}); err != nil {
+		t.Errorf("RLP serializer refused: %v", err)
+	}
+}
+
+// Tests that the serializer given at construction is in effect for the validation of
+// the database against a remote freezer storing framed payloads.
+func TestFreezerSerializerAtConstruction(t *testing.T) {
+	mock := lib.NewMemFreezerRemoteServerAPI()
+	server := rpc.NewServer()
+	defer server.Stop()
+	if err := server.RegisterName("freezer", mock); err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	genesis := common.Hash{0x01}
+	framed := FreezerSerializerFramed{}
+	if err := mock.AppendAncient(0, framed.Encode(freezerHashTable, genesis.Bytes()), framed.Encode(freezerHeaderTable, []byte{0x02}),
+		framed.Encode(freezerBodiesTable, []byte{0x03}), framed.Encode(freezerReceiptTable, []byte{0xc0}), framed.Encode(freezerDifficultyTable, []byte{0x04}), nil); err != nil {
+		t.Fatal(err)
+	}
+	kvdb := NewMemoryDatabase()
+	WriteCanonicalHash(kvdb, genesis, 0)
+	WriteHeadHeaderHash(kvdb, genesis)
+	WriteHeaderNumber(kvdb, genesis, 0)
+
+	// Without the serializer, the framed genesis doesn't match the database's
+	if db, err := NewDatabaseWithFreezerRemote(kvdb, httpServer.URL); err == nil {
+		db.Close()
+		t.Fatal("framed genesis accepted without the serializer")
+	}
+	db, err := NewDatabaseWithFreezerRemoteOptions(kvdb, httpServer.URL, FreezerRemoteOptions{Serializer: framed})
+	if err != nil {
+		t.Fatalf("failed to open the database with the serializer: %v", err)
+	}
+	defer db.Close()
+	if hash := ReadCanonicalHash(db, 0); hash != genesis {
+		t.Errorf("genesis mismatch: have %x, want %x", hash, genesis)
+	}
+}
@@ -0,0 +1,260 @@
+package rawdb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// freezerSplit is an ancient store keeping some kinds in a remote freezer and the
+// others in a local freezer, presenting a unified view of both.
+//
+// Every item number is appended to both backends, the kinds kept by the other
+// backend are stored as empty placeholders. The item counts of the backends thus
+// advance in lockstep, and the frozen items are those present in both.
+type freezerSplit struct {
+	local       *freezer
+	remote      *FreezerRemoteClient
+	remoteKinds map[string]bool // Kinds stored remotely, all others are stored locally
+	freezeMu    sync.Mutex      // Serializes freezing batches of the background loop and freezeUpTo
+}
+
+// newFreezerSplit opens the local freezer in datadir and combines it with the remote
+// freezer, storing the given kinds remotely. If the backends were left with different
+// item counts, eg. by a crash between appends, the longer one is truncated to match.
+func newFreezerSplit(remote *FreezerRemoteClient, datadir string, namespace string, remoteKinds []string) (*freezerSplit, error) {
+	kinds := make(map[string]bool, len(remoteKinds))
+	for _, kind := range remoteKinds {
+		if _, ok := freezerNoSnappy[kind]; !ok {
+			return nil, fmt.Errorf("%w: %s", errUnknownTable, kind)
+		}
+		kinds[kind] = true
+	}
+	local, err := newFreezer(datadir, namespace)
+	if err != nil {
+		return nil, err
+	}
+	f := &freezerSplit{local: local, remote: remote, remoteKinds: kinds}
+	lfrozen, _ := local.Ancients()
+	rfrozen, err := remote.Ancients()
+	if err != nil {
+		releaseFreezer(local)
+		return nil, err
+	}
+	if lfrozen != rfrozen {
+		log.Warn("Split freezer backends out of sync, truncating", "local", lfrozen, "remote", rfrozen)
+		if lfrozen < rfrozen {
+			err = remote.TruncateAncients(lfrozen)
+		} else {
+			err = local.TruncateAncients(rfrozen)
+		}
+		if err != nil {
+			releaseFreezer(local)
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// releaseFreezer closes the tables of a freezer whose freeze loop was never started,
+// which Close would wait for.
+func releaseFreezer(f *freezer) {
+	for _, table := range f.tables {
+		table.Close()
+	}
+	f.instanceLock.Release()
+}
+
+// backend returns the store keeping the given kind.
+func (f *freezerSplit) backend(kind string) interface {
+	HasAncient(kind string, number uint64) (bool, error)
+	Ancient(kind string, number uint64) ([]byte, error)
+	AncientSize(kind string) (uint64, error)
+} {
+	if f.remoteKinds[kind] {
+		return f.remote
+	}
+	return f.local
+}
+
+// Close terminates both backends.
+func (f *freezerSplit) Close() error {
+	var errs []error
+	if err := f.remote.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := f.local.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if errs != nil {
+		return fmt.Errorf("%v", errs)
+	}
+	return nil
+}
+
+// HasAncient returns an indicator whether the specified ancient data exists
+// in the freezer.
+func (f *freezerSplit) HasAncient(kind string, number uint64) (bool, error) {
+	if frozen, err := f.Ancients(); err != nil || number >= frozen {
+		return false, err
+	}
+	return f.backend(kind).HasAncient(kind, number)
+}
+
+// Ancient retrieves an ancient binary blob from the backend storing its kind.
+func (f *freezerSplit) Ancient(kind string, number uint64) ([]byte, error) {
+	return f.backend(kind).Ancient(kind, number)
+}
+
+// AncientContext retrieves an ancient binary blob from the backend storing its kind,
+// aborting a remote retrieval once ctx is done.
+func (f *freezerSplit) AncientContext(ctx context.Context, kind string, number uint64) ([]byte, error) {
+	if f.remoteKinds[kind] {
+		return f.remote.AncientContext(ctx, kind, number)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.local.Ancient(kind, number)
+}
+
+// Ancients returns the number of items frozen in both backends.
+func (f *freezerSplit) Ancients() (uint64, error) {
+	frozen, err := f.remote.Ancients()
+	if err != nil {
+		return 0, err
+	}
+	if lfrozen, _ := f.local.Ancients(); lfrozen < frozen {
+		frozen = lfrozen
+	}
+	return frozen, nil
+}
+
+// AncientKinds returns the number of items of every kind, as counted by the backend
+// storing it.
+func (f *freezerSplit) AncientKinds() (map[string]uint64, error) {
+	rkinds, err := f.remote.AncientKinds()
+	if err != nil {
+		return nil, err
+	}
+	kinds, _ := f.local.AncientKinds()
+	for kind := range f.remoteKinds {
+		kinds[kind] = rkinds[kind]
+	}
+	return kinds, nil
+}
+
+// State returns the item counts of the store, reconciled across both backends.
+func (f *freezerSplit) State() (*FreezerRemoteState, error) {
+	state, err := f.remote.State()
+	if err != nil {
+		return nil, err
+	}
+	if lfrozen, _ := f.local.Ancients(); lfrozen < state.Ancients {
+		state.Ancients = lfrozen
+	}
+	if state.Kinds == nil {
+		state.Kinds = make(map[string]uint64)
+	}
+	lkinds, _ := f.local.AncientKinds()
+	for kind, n := range lkinds {
+		if !f.remoteKinds[kind] {
+			state.Kinds[kind] = n
+		}
+	}
+	return state, nil
+}
+
+// AncientSize returns the ancient size of the specified category.
+func (f *freezerSplit) AncientSize(kind string) (uint64, error) {
+	return f.backend(kind).AncientSize(kind)
+}
+
+// AppendAncient appends the item to both backends, each one receiving the kinds it
+// stores and empty placeholders for the others. If the remote append fails, the
+// local one is rolled back.
+func (f *freezerSplit) AppendAncient(number uint64, hash, header, body, receipts, td []byte) error {
+	var (
+		blobs  = map[string][]byte{freezerHashTable: hash, freezerHeaderTable: header, freezerBodiesTable: body, freezerReceiptTable: receipts, freezerDifficultyTable: td}
+		local  = make(map[string][]byte)
+		remote = make(map[string][]byte)
+	)
+	for kind, blob := range blobs {
+		if f.remoteKinds[kind] {
+			remote[kind] = blob
+		} else {
+			local[kind] = blob
+		}
+	}
+	if err := f.local.AppendAncient(number, local[freezerHashTable], local[freezerHeaderTable], local[freezerBodiesTable], local[freezerReceiptTable], local[freezerDifficultyTable]); err != nil {
+		return err
+	}
+	if err := f.remote.AppendAncient(number, remote[freezerHashTable], remote[freezerHeaderTable], remote[freezerBodiesTable], remote[freezerReceiptTable], remote[freezerDifficultyTable]); err != nil {
+		if terr := f.local.TruncateAncients(number); terr != nil {
+			log.Error("Failed to roll back split freezer append", "number", number, "err", terr)
+		}
+		return err
+	}
+	return nil
+}
+
+// TruncateAncients discards any recent data above the provided threshold number
+// from both backends.
+func (f *freezerSplit) TruncateAncients(items uint64) error {
+	if err := f.remote.TruncateAncients(items); err != nil {
+		return err
+	}
+	return f.local.TruncateAncients(items)
+}
+
+// Sync flushes both backends.
+func (f *freezerSplit) Sync() error {
+	if err := f.remote.Sync(); err != nil {
+		return err
+	}
+	return f.local.Sync()
+}
+
+// SetWriteBatch configures batching of appends to the remote freezer.
+func (f *freezerSplit) SetWriteBatch(size int, interval time.Duration) error {
+	return f.remote.SetWriteBatch(size, interval)
+}
+
+// AncientTail returns the number of the first item retained by the remote freezer.
+func (f *freezerSplit) AncientTail() (uint64, error) {
+	return f.remote.AncientTail()
+}
+
+// SetReadAhead enables prefetching sequential reads from the remote freezer.
+func (f *freezerSplit) SetReadAhead(window int) {
+	f.remote.SetReadAhead(window)
+}
+
+// SetStaleReadRetry makes reads of items the read replicas of the remote freezer
+// did not replicate yet retry.
+func (f *freezerSplit) SetStaleReadRetry(retries int, backoff time.Duration) {
+	f.remote.SetStaleReadRetry(retries, backoff)
+}
+
+// FreezerInfo returns the server info of the remote freezer, or nil if it did not
+// report any.
+func (f *freezerSplit) FreezerInfo() *FreezerRemoteInfo {
+	return f.remote.FreezerInfo()
+}
+
+// SubscribeFreezeEvent registers a subscription of FreezeEvent.
+func (f *freezerSplit) SubscribeFreezeEvent(ch chan<- FreezeEvent) event.Subscription {
+	return f.local.freezeFeed.Subscribe(ch)
+}
+
+// freezeUpTo moves the canonical blocks below number, which are at least the freezing
+// threshold below the head block, from the key-value store into both backends, returning
+// once they synced them, or ctx is cancelled. It returns the number of ancients.
+func (f *freezerSplit) freezeUpTo(ctx context.Context, db ethdb.KeyValueStore, number uint64) (uint64, error) {
+	return freezeRemoteUpTo(ctx, db, f, f.local.threshold, number, &f.freezeMu, &f.local.freezeFeed)
+}
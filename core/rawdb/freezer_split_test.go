@@ -0,0 +1,125 @@
+package rawdb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/cmd/ancient-store-mem/lib"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// Tests that a database routing some ancient kinds to the remote freezer stores each
+// kind in the expected backend, while serving reads of all of them.
+func TestFreezerSplitKinds(t *testing.T) {
+	mock := lib.NewMemFreezerRemoteServerAPI()
+	server := rpc.NewServer()
+	defer server.Stop()
+	if err := server.RegisterName("freezer", mock); err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	remoteKinds := []string{freezerHashTable, freezerHeaderTable, freezerReceiptTable}
+	db, err := NewDatabaseWithFreezerRemoteKinds(NewMemoryDatabase(), httpServer.URL, dir, "", remoteKinds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := func(kind string, number uint64) []byte {
+		if kind == freezerHashTable {
+			return common.Hash{byte(number)}.Bytes()
+		}
+		return []byte(kind + string(rune('a'+number)))
+	}
+	for i := uint64(0); i < 10; i++ {
+		if err := db.AppendAncient(i, blob(freezerHashTable, i), blob(freezerHeaderTable, i), blob(freezerBodiesTable, i), blob(freezerReceiptTable, i), blob(freezerDifficultyTable, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	local := db.(*freezerdb).AncientStore.(*freezerSplit).local
+
+	// Reads work uniformly across the backends.
+	if n, err := db.Ancients(); err != nil || n != 10 {
+		t.Fatalf("ancients: have %d (%v), want 10", n, err)
+	}
+	kinds, err := db.AncientKinds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kind := range freezerKinds {
+		if kinds[kind] != 10 {
+			t.Errorf("%s: have %d items, want 10", kind, kinds[kind])
+		}
+		for i := uint64(0); i < 10; i++ {
+			if v, err := db.Ancient(kind, i); err != nil || !bytes.Equal(v, blob(kind, i)) {
+				t.Errorf("%s #%d: have %x (%v), want %x", kind, i, v, err, blob(kind, i))
+			}
+		}
+		if ok, _ := db.HasAncient(kind, 10); ok {
+			t.Errorf("%s #10: reported present", kind)
+		}
+	}
+	// Each kind landed in its own backend only.
+	for _, kind := range freezerKinds {
+		remote := kind != freezerBodiesTable && kind != freezerDifficultyTable
+		rv, err := mock.Ancient(kind, 5)
+		if err != nil {
+			t.Fatalf("remote %s: %v", kind, err)
+		}
+		lv, err := local.Ancient(kind, 5)
+		if err != nil {
+			t.Fatalf("local %s: %v", kind, err)
+		}
+		if remote && (!bytes.Equal(rv, blob(kind, 5)) || len(lv) != 0) {
+			t.Errorf("%s: stored locally, remote %x, local %x", kind, rv, lv)
+		}
+		if !remote && (!bytes.Equal(lv, blob(kind, 5)) || len(rv) != 0) {
+			t.Errorf("%s: stored remotely, remote %x, local %x", kind, rv, lv)
+		}
+	}
+	// Truncations apply to both backends.
+	if err := db.TruncateAncients(8); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := mock.Ancients(); n != 8 {
+		t.Errorf("remote ancients after truncate: have %d, want 8", n)
+	}
+	if n, _ := local.Ancients(); n != 8 {
+		t.Errorf("local ancients after truncate: have %d, want 8", n)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A remote freezer ahead of the local one is truncated to match on open.
+	if err := mock.AppendAncient(8, nil, nil, nil, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDatabaseWithFreezerRemoteKinds(NewMemoryDatabase(), httpServer.URL, dir, "", remoteKinds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if n, _ := mock.Ancients(); n != 8 {
+		t.Errorf("remote ancients after reopen: have %d, want 8", n)
+	}
+	if n, err := db.Ancients(); err != nil || n != 8 {
+		t.Errorf("ancients after reopen: have %d (%v), want 8", n, err)
+	}
+	if v, err := db.Ancient(freezerBodiesTable, 7); err != nil || !bytes.Equal(v, blob(freezerBodiesTable, 7)) {
+		t.Errorf("body #7 after reopen: have %x (%v), want %x", v, err, blob(freezerBodiesTable, 7))
+	}
+}
@@ -0,0 +1,124 @@
+package rawdb
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// ErrUnclesPruned is returned for the uncles of a block which were omitted from its
+// frozen body, see EnableAncientUnclesPruning.
+var ErrUnclesPruned = errors.New("uncles pruned from the ancient store")
+
+// ReadAncientUnclesPruned retrieves the number of the first block whose uncles may
+// be omitted from its frozen body, nil if uncles were never pruned.
+func ReadAncientUnclesPruned(db ethdb.KeyValueReader) *uint64 {
+	data, _ := db.Get(ancientUnclesPrunedKey)
+	if len(data) != 8 {
+		return nil
+	}
+	number := binary.BigEndian.Uint64(data)
+	return &number
+}
+
+// WriteAncientUnclesPruned stores the number of the first block whose uncles may be
+// omitted from its frozen body.
+func WriteAncientUnclesPruned(db ethdb.KeyValueWriter, number uint64) {
+	if err := db.Put(ancientUnclesPrunedKey, encodeBlockNumber(number)); err != nil {
+		log.Crit("Failed to store ancient uncles pruning", "err", err)
+	}
+}
+
+// EnableAncientUnclesPruning omits the uncles from the bodies of the blocks moved
+// into the ancient store from now on, to save space where historical uncles are
+// never queried. The transactions of the bodies are kept. The uncles can't be
+// restored, so pruning is never disabled once enabled; the number of the first
+// block pruned is recorded, so that reads tell omitted uncles from missing ones.
+// Blocks whose uncles were pruned are not served anymore, neither locally nor to
+// peers, see UnclesPruned.
+func EnableAncientUnclesPruning(db ethdb.Database) error {
+	if from := ReadAncientUnclesPruned(db); from != nil {
+		log.Info("Pruning uncles from the ancient store", "from", *from)
+		return nil
+	}
+	frozen, err := db.Ancients()
+	if err != nil {
+		return err
+	}
+	WriteAncientUnclesPruned(db, frozen)
+	log.Warn("Enabled pruning uncles from the ancient store", "from", frozen)
+	return nil
+}
+
+// AncientUnclesPruned returns whether the uncles of the block of the given number
+// may be omitted from its frozen body.
+func AncientUnclesPruned(db ethdb.KeyValueReader, number uint64) bool {
+	from := ReadAncientUnclesPruned(db)
+	return from != nil && number >= *from
+}
+
+// ancientBody returns the RLP encoded body to freeze, without its uncles if they
+// are pruned.
+func ancientBody(db ethdb.KeyValueReader, number uint64, body rlp.RawValue) rlp.RawValue {
+	if !AncientUnclesPruned(db, number) {
+		return body
+	}
+	// Keep the encoding of the transactions, which needn't be decoded
+	var stored struct {
+		Transactions rlp.RawValue
+		Uncles       []rlp.RawValue
+	}
+	if err := rlp.DecodeBytes(body, &stored); err != nil {
+		log.Error("Invalid block body RLP, freezing uncles", "number", number, "err", err)
+		return body
+	}
+	if len(stored.Uncles) == 0 {
+		return body
+	}
+	stored.Uncles = nil
+	pruned, err := rlp.EncodeToBytes(&stored)
+	if err != nil {
+		log.Crit("Failed to RLP encode pruned body", "err", err)
+	}
+	return pruned
+}
+
+// UnclesPruned returns whether the uncles of the block corresponding to the hash were
+// omitted from its frozen body. The body is incomplete then: ReadBody and ReadBlock
+// return nil for the block, ReadUncles fails with ErrUnclesPruned.
+func UnclesPruned(db ethdb.Reader, hash common.Hash, number uint64) bool {
+	if !AncientUnclesPruned(db, number) {
+		return false
+	}
+	body := readBody(db, hash, number)
+	return body != nil && unclesPruned(db, hash, number, body)
+}
+
+// unclesPruned returns whether the uncles of the given body of the block corresponding
+// to the hash were omitted from it.
+func unclesPruned(db ethdb.Reader, hash common.Hash, number uint64, body *types.Body) bool {
+	if len(body.Uncles) != 0 || !AncientUnclesPruned(db, number) {
+		return false
+	}
+	header := ReadHeader(db, hash, number)
+	return header != nil && header.UncleHash != types.EmptyUncleHash
+}
+
+// ReadUncles retrieves the uncles of the block corresponding to the hash, failing
+// with ErrUnclesPruned if they were omitted from its frozen body. Nil is returned
+// if the body is missing.
+func ReadUncles(db ethdb.Reader, hash common.Hash, number uint64) ([]*types.Header, error) {
+	body := readBody(db, hash, number)
+	if body == nil {
+		return nil, nil
+	}
+	if unclesPruned(db, hash, number, body) {
+		return nil, ErrUnclesPruned
+	}
+	return body.Uncles, nil
+}
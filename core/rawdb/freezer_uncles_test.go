@@ -0,0 +1,82 @@
+package rawdb
+
+import (
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestAncientUnclesPruning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "freezer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDatabaseWithFreezer(NewMemoryDatabase(), dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// newBlock creates a block of the given number with a transaction and an uncle.
+	newBlock := func(number int64) *types.Block {
+		txs := []*types.Transaction{types.NewTransaction(uint64(number), common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(1), nil)}
+		uncles := []*types.Header{{Number: big.NewInt(number), Extra: []byte("uncle")}}
+		return types.NewBlock(&types.Header{Number: big.NewInt(number)}, txs, uncles, nil, newHasher())
+	}
+	// Uncles frozen before pruning is enabled are retained
+	retained := newBlock(0)
+	WriteAncientBlock(db, retained, nil, big.NewInt(1))
+
+	if err := EnableAncientUnclesPruning(db); err != nil {
+		t.Fatalf("failed to enable pruning: %v", err)
+	}
+	if from := ReadAncientUnclesPruned(db); from == nil || *from != 1 {
+		t.Fatalf("pruning start mismatch: have %v, want 1", from)
+	}
+	if uncles, err := ReadUncles(db, retained.Hash(), 0); err != nil || len(uncles) != 1 {
+		t.Fatalf("retained uncles: have %d (err %v), want 1", len(uncles), err)
+	}
+	// Uncles frozen afterwards are pruned, the transactions are not
+	pruned := newBlock(1)
+	WriteAncientBlock(db, pruned, nil, big.NewInt(2))
+
+	WriteCanonicalHash(db, pruned.Hash(), 1)
+	WriteTxLookupEntriesByBlock(db, pruned)
+
+	tx, hash, number, _ := ReadTransaction(db, pruned.Transactions()[0].Hash())
+	if tx == nil || hash != pruned.Hash() || number != 1 {
+		t.Fatalf("pruned block transaction not readable: have %v in #%d %x", tx, number, hash)
+	}
+	if _, err := ReadUncles(db, pruned.Hash(), 1); !errors.Is(err, ErrUnclesPruned) {
+		t.Fatalf("pruned uncles: want %v, got %v", ErrUnclesPruned, err)
+	}
+	// The incomplete body and block are not served
+	if !UnclesPruned(db, pruned.Hash(), 1) || UnclesPruned(db, retained.Hash(), 0) {
+		t.Fatalf("pruning misreported: pruned %v, retained %v", UnclesPruned(db, pruned.Hash(), 1), UnclesPruned(db, retained.Hash(), 0))
+	}
+	if body := ReadBody(db, pruned.Hash(), 1); body != nil {
+		t.Fatalf("pruned body served: %v", body)
+	}
+	if block := ReadBlock(db, pruned.Hash(), 1); block != nil {
+		t.Fatalf("pruned block served: %v", block)
+	}
+	if block := ReadBlock(db, retained.Hash(), 0); block == nil || len(block.Uncles()) != 1 {
+		t.Fatalf("retained block not served")
+	}
+	if header := ReadHeader(db, pruned.Hash(), 1); header == nil || header.Hash() != pruned.Hash() {
+		t.Fatalf("pruned block header not readable")
+	}
+	// Blocks without uncles have none to prune
+	empty := types.NewBlock(&types.Header{Number: big.NewInt(2)}, nil, nil, nil, newHasher())
+	WriteAncientBlock(db, empty, nil, big.NewInt(3))
+	if uncles, err := ReadUncles(db, empty.Hash(), 2); err != nil || len(uncles) != 0 {
+		t.Fatalf("uncle-less block: have %d uncles (err %v), want none", len(uncles), err)
+	}
+}
@@ -57,6 +57,18 @@ var (
 	// fastTxLookupLimitKey tracks the transaction lookup limit during fast sync.
 	fastTxLookupLimitKey = []byte("FastTransactionLookupLimit")
 
+	// freezerChecksumsKey tracks the checksums of the ancient items recorded by the last freezer check.
+	freezerChecksumsKey = []byte("FreezerChecksums")
+
+	// ancientUnclesPrunedKey tracks the first block whose uncles may be omitted from its frozen body.
+	ancientUnclesPrunedKey = []byte("AncientUnclesPruned")
+
+	// ancientLogIndexKey tracks the first block whose log positions are indexed in the ancient store.
+	ancientLogIndexKey = []byte("AncientLogIndex")
+
+	// ancientCompactedKey tracks the number of ancients the key-value store was last compacted up to.
+	ancientCompactedKey = []byte("AncientCompacted")
+
 	// Data item prefixes (use single byte to avoid mixing data types, avoid `i`, used for indexes).
 	headerPrefix       = []byte("h") // headerPrefix + num (uint64 big endian) + hash -> header
 	headerTDSuffix     = []byte("t") // headerPrefix + num (uint64 big endian) + hash + headerTDSuffix -> td
@@ -75,6 +87,9 @@ var (
 	preimagePrefix = []byte("secure-key-")      // preimagePrefix + hash -> preimage
 	ConfigPrefix   = []byte("ethereum-config-") // config prefix for the db
 
+	artificialFinalityDecisionPrefix = []byte("ecbp1100-decision-") // artificialFinalityDecisionPrefix + time (uint64 big endian) + hash -> decision
+	frozenRangePrefix                = []byte("frozen-range-")      // frozenRangePrefix + time (uint64 big endian) + first (uint64 big endian) -> last (uint64 big endian)
+
 	// Chain index prefixes (use `i` + single byte to avoid mixing data types).
 	BloomBitsIndexPrefix = []byte("iB") // BloomBitsIndexPrefix is the data table of a chain indexer to track its progress
 
@@ -128,8 +143,22 @@ const (
 
 	// freezerDifficultyTable indicates the name of the freezer total difficulty table.
 	freezerDifficultyTable = "diffs"
+
+	// freezerLogIndexTable indicates the name of the optional freezer table of the log
+	// positions within the frozen receipts, which is not one of the freezerKinds, see
+	// EnableAncientLogIndex.
+	freezerLogIndexTable = "logindex"
 )
 
+// freezerKinds are all the freezer tables, in the order AppendAncient expects them.
+var freezerKinds = []string{
+	freezerHashTable,
+	freezerHeaderTable,
+	freezerBodiesTable,
+	freezerReceiptTable,
+	freezerDifficultyTable,
+}
+
 // freezerNoSnappy configures whether compression is disabled for the ancient-tables.
 // Hashes and difficulties don't compress well.
 var freezerNoSnappy = map[string]bool{
@@ -225,6 +254,16 @@ func preimageKey(hash common.Hash) []byte {
 	return append(preimagePrefix, hash.Bytes()...)
 }
 
+// artificialFinalityDecisionKey = artificialFinalityDecisionPrefix + time (uint64 big endian) + hash
+func artificialFinalityDecisionKey(time uint64, hash common.Hash) []byte {
+	return append(append(artificialFinalityDecisionPrefix, encodeBlockNumber(time)...), hash.Bytes()...)
+}
+
+// frozenRangeKey = frozenRangePrefix + time (uint64 big endian) + first (uint64 big endian)
+func frozenRangeKey(time uint64, first uint64) []byte {
+	return append(append(frozenRangePrefix, encodeBlockNumber(time)...), encodeBlockNumber(first)...)
+}
+
 // codeKey = codePrefix + hash
 func codeKey(hash common.Hash) []byte {
 	return append(codePrefix, hash.Bytes()...)
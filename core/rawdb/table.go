@@ -68,6 +68,12 @@ func (t *table) Ancients() (uint64, error) {
 	return t.db.Ancients()
 }
 
+// AncientKinds is a noop passthrough that just forwards the request to the underlying
+// database.
+func (t *table) AncientKinds() (map[string]uint64, error) {
+	return t.db.AncientKinds()
+}
+
 // AncientSize is a noop passthrough that just forwards the request to the underlying
 // database.
 func (t *table) AncientSize(kind string) (uint64, error) {
@@ -31,7 +31,7 @@ import (
 // of an arbitrary state with the goal of prefetching potentially useful state
 // data from disk before the main block processor start executing.
 type statePrefetcher struct {
-	config ctypes.ChainConfigurator // Chain configuration options
+	config ctypes.ChainConfigurator // Chain configuration options, superseded by the chain's
 	bc     *BlockChain              // Canonical block chain
 	engine consensus.Engine         // Consensus engine used for block rewards
 }
@@ -45,6 +45,15 @@ func newStatePrefetcher(config ctypes.ChainConfigurator, bc *BlockChain, engine
 	}
 }
 
+// chainConfig returns the current configuration of the chain, which may have been
+// updated since construction, see UpdateChainConfig.
+func (p *statePrefetcher) chainConfig() ctypes.ChainConfigurator {
+	if p.bc != nil {
+		return p.bc.Config()
+	}
+	return p.config
+}
+
 // Prefetch processes the state changes according to the Ethereum rules by running
 // the transaction messages using the statedb, but any changes are discarded. The
 // only goal is to pre-cache transaction signatures and state trie nodes.
@@ -52,9 +61,10 @@ func (p *statePrefetcher) Prefetch(block *types.Block, statedb *state.StateDB, c
 	var (
 		header  = block.Header()
 		gaspool = new(GasPool).AddGas(block.GasLimit())
+		config  = p.chainConfig()
 	)
 	// Iterate over and process the individual transactions
-	byzantium := p.config.IsEnabled(p.config.GetEIP161abcTransition, block.Number())
+	byzantium := config.IsEnabled(config.GetEIP161abcTransition, block.Number())
 	for i, tx := range block.Transactions() {
 		// If block precaching was interrupted, abort
 		if interrupt != nil && atomic.LoadUint32(interrupt) == 1 {
@@ -62,7 +72,7 @@ func (p *statePrefetcher) Prefetch(block *types.Block, statedb *state.StateDB, c
 		}
 		// Block precaching permitted to continue, execute the transaction
 		statedb.Prepare(tx.Hash(), block.Hash(), i)
-		if err := precacheTransaction(p.config, p.bc, nil, gaspool, statedb, header, tx, cfg); err != nil {
+		if err := precacheTransaction(config, p.bc, nil, gaspool, statedb, header, tx, cfg); err != nil {
 			return // Ugh, something went horribly wrong, bail out
 		}
 		// If we're pre-byzantium, pre-load trie nodes for the intermediate root
@@ -32,7 +32,7 @@ import (
 //
 // StateProcessor implements Processor.
 type StateProcessor struct {
-	config ctypes.ChainConfigurator // Chain configuration options
+	config ctypes.ChainConfigurator // Chain configuration options, superseded by the chain's
 	bc     *BlockChain              // Canonical block chain
 	engine consensus.Engine         // Consensus engine used for block rewards
 }
@@ -46,6 +46,15 @@ func NewStateProcessor(config ctypes.ChainConfigurator, bc *BlockChain, engine c
 	}
 }
 
+// chainConfig returns the current configuration of the chain, which may have been
+// updated since construction, see UpdateChainConfig.
+func (p *StateProcessor) chainConfig() ctypes.ChainConfigurator {
+	if p.bc != nil {
+		return p.bc.Config()
+	}
+	return p.config
+}
+
 // Process processes the state changes according to the Ethereum rules by running
 // the transaction messages using the statedb and applying any rewards to both
 // the processor (coinbase) and any included uncles.
@@ -60,18 +69,19 @@ func (p *StateProcessor) Process(block *types.Block, statedb *state.StateDB, cfg
 		header   = block.Header()
 		allLogs  []*types.Log
 		gp       = new(GasPool).AddGas(block.GasLimit())
+		config   = p.chainConfig()
 	)
 	// Mutate the block and state according to any hard-fork specs
-	isDAOSupport := p.config.IsEnabled(p.config.GetEthashEIP779Transition, block.Number())
+	isDAOSupport := config.IsEnabled(config.GetEthashEIP779Transition, block.Number())
 	if isDAOSupport {
-		if daoNumber := p.config.GetEthashEIP779Transition(); daoNumber != nil && *daoNumber == block.NumberU64() {
+		if daoNumber := config.GetEthashEIP779Transition(); daoNumber != nil && *daoNumber == block.NumberU64() {
 			misc.ApplyDAOHardFork(statedb)
 		}
 	}
 	// Iterate over and process the individual transactions
 	for i, tx := range block.Transactions() {
 		statedb.Prepare(tx.Hash(), block.Hash(), i)
-		receipt, err := ApplyTransaction(p.config, p.bc, nil, gp, statedb, header, tx, usedGas, cfg)
+		receipt, err := ApplyTransaction(config, p.bc, nil, gp, statedb, header, tx, usedGas, cfg)
 		if err != nil {
 			return nil, nil, 0, err
 		}
@@ -19,12 +19,26 @@ package core
 import (
 	"runtime"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 )
 
 // senderCacher is a concurrent transaction sender recoverer and cacher.
 var senderCacher = newTxSenderCacher(runtime.NumCPU())
 
+// SenderProvider is a trusted source of transaction senders, eg. a relay feeding
+// the node blocks whose senders it recovered already, sparing their recovery from
+// the signatures.
+type SenderProvider interface {
+	// Sender returns the sender of the transaction of the given hash, and whether
+	// it is known.
+	Sender(hash common.Hash) (common.Address, bool)
+}
+
+// senderProviderHolder wraps a SenderProvider, so that different implementations
+// (or none) can be stored in the same atomic.Value.
+type senderProviderHolder struct{ SenderProvider }
+
 // txSenderCacherRequest is a request for recovering transaction senders with a
 // specific signature scheme and caching it into the transactions themselves.
 //
@@ -92,14 +106,25 @@ func (cacher *txSenderCacher) recover(signer types.Signer, txs []*types.Transact
 // recoverFromBlocks recovers the senders from a batch of blocks and caches them
 // back into the same data structures. There is no validation being done, nor
 // any reaction to invalid signatures. That is up to calling code later.
-func (cacher *txSenderCacher) recoverFromBlocks(signer types.Signer, blocks []*types.Block) {
+//
+// If provider is not nil, the senders it knows are cached as they are, only the
+// others being recovered.
+func (cacher *txSenderCacher) recoverFromBlocks(signer types.Signer, blocks []*types.Block, provider SenderProvider) {
 	count := 0
 	for _, block := range blocks {
 		count += len(block.Transactions())
 	}
 	txs := make([]*types.Transaction, 0, count)
 	for _, block := range blocks {
-		txs = append(txs, block.Transactions()...)
+		for _, tx := range block.Transactions() {
+			if provider != nil {
+				if from, ok := provider.Sender(tx.Hash()); ok {
+					types.CacheSender(signer, tx, from)
+					continue
+				}
+			}
+			txs = append(txs, tx)
+		}
 	}
 	cacher.recover(signer, txs)
 }
@@ -238,6 +238,8 @@ type TxPool struct {
 
 	chainHeadCh     chan ChainHeadEvent
 	chainHeadSub    event.Subscription
+	chainConfigCh   chan ChainConfigEvent
+	chainConfigSub  event.Subscription // Nil if the chain's configuration can't change
 	reqResetCh      chan *txpoolResetRequest
 	reqPromoteCh    chan *accountSet
 	queueTxEventCh  chan *types.Transaction
@@ -270,6 +272,7 @@ func NewTxPool(config TxPoolConfig, chainconfig ctypes.ChainConfigurator, chain
 		beats:           make(map[common.Address]time.Time),
 		all:             newTxLookup(),
 		chainHeadCh:     make(chan ChainHeadEvent, chainHeadChanSize),
+		chainConfigCh:   make(chan ChainConfigEvent, 1),
 		reqResetCh:      make(chan *txpoolResetRequest),
 		reqPromoteCh:    make(chan *accountSet),
 		queueTxEventCh:  make(chan *types.Transaction),
@@ -303,6 +306,11 @@ func NewTxPool(config TxPoolConfig, chainconfig ctypes.ChainConfigurator, chain
 
 	// Subscribe events from blockchain and start the main event loop.
 	pool.chainHeadSub = pool.chain.SubscribeChainHeadEvent(pool.chainHeadCh)
+	if c, ok := chain.(interface {
+		SubscribeChainConfigEvent(ch chan<- ChainConfigEvent) event.Subscription
+	}); ok {
+		pool.chainConfigSub = c.SubscribeChainConfigEvent(pool.chainConfigCh)
+	}
 	pool.wg.Add(1)
 	go pool.loop()
 
@@ -343,6 +351,12 @@ func (pool *TxPool) loop() {
 				head = ev.Block
 			}
 
+		// Follow the chain's configuration, which only the loop modifies
+		case ev := <-pool.chainConfigCh:
+			pool.mu.Lock()
+			pool.chainconfig = ev.Config
+			pool.mu.Unlock()
+
 		// System shutdown.
 		case <-pool.chainHeadSub.Err():
 			close(pool.reorgShutdownCh)
@@ -399,6 +413,9 @@ func (pool *TxPool) Stop() {
 
 	// Unsubscribe subscriptions registered from blockchain
 	pool.chainHeadSub.Unsubscribe()
+	if pool.chainConfigSub != nil {
+		pool.chainConfigSub.Unsubscribe()
+	}
 	pool.wg.Wait()
 
 	if pool.journal != nil {
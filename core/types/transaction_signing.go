@@ -88,6 +88,13 @@ func Sender(signer Signer, tx *Transaction) (common.Address, error) {
 	return addr, nil
 }
 
+// CacheSender caches from as the sender of tx derived by signer, so that Sender
+// returns it without recovering it from the signature. The signature is not checked
+// against from, which must thus be obtained from a trusted source.
+func CacheSender(signer Signer, tx *Transaction, from common.Address) {
+	tx.from.Store(sigCache{signer: signer, from: from})
+}
+
 // Signer encapsulates transaction signature handling. Note that this interface is not a
 // stable API and may change at any time to accommodate new protocol rules.
 type Signer interface {
@@ -273,6 +273,44 @@ func (api *PrivateAdminAPI) Ecbp1100(blockNr rpc.BlockNumber) (bool, error) {
 			api.eth.blockchain.CurrentBlock().Number()), err
 }
 
+// VerifyAncients starts verifying the frozen items of the blocks from and up to to
+// (inclusive) against each other in the background, see core.VerifyAncients, and
+// returns the id of the verification to poll VerifyAncientsStatus with.
+func (api *PrivateAdminAPI) VerifyAncients(from, to hexutil.Uint64) (hexutil.Uint64, error) {
+	id, err := api.eth.BlockChain().StartVerifyAncients(uint64(from), uint64(to))
+	return hexutil.Uint64(id), err
+}
+
+// VerifyAncientsResult is the progress, and once done the result, of a verification
+// started by VerifyAncients.
+type VerifyAncientsResult struct {
+	ID         hexutil.Uint64         `json:"id"`
+	From       hexutil.Uint64         `json:"from"`
+	To         hexutil.Uint64         `json:"to"`
+	Verified   hexutil.Uint64         `json:"verified"`
+	Done       bool                   `json:"done"`
+	Error      string                 `json:"error,omitempty"`
+	Mismatches []core.AncientMismatch `json:"mismatches"`
+}
+
+// VerifyAncientsStatus returns the progress of the verification of the given id, and
+// the mismatches found once it is done.
+func (api *PrivateAdminAPI) VerifyAncientsStatus(id hexutil.Uint64) (*VerifyAncientsResult, error) {
+	status, err := api.eth.BlockChain().StatusVerifyAncients(uint64(id))
+	if err != nil {
+		return nil, err
+	}
+	return &VerifyAncientsResult{
+		ID:         hexutil.Uint64(status.ID),
+		From:       hexutil.Uint64(status.From),
+		To:         hexutil.Uint64(status.To),
+		Verified:   hexutil.Uint64(status.Verified),
+		Done:       status.Done,
+		Error:      status.Error,
+		Mismatches: status.Mismatches,
+	}, nil
+}
+
 // PublicDebugAPI is the collection of Ethereum full node APIs exposed
 // over the public debugging endpoint.
 type PublicDebugAPI struct {
@@ -360,6 +398,39 @@ func (api *PrivateDebugAPI) GetBadBlocks(ctx context.Context) ([]*BadBlockArgs,
 	return results, nil
 }
 
+// Ecbp1100CurveResult holds the ECBP1100 inputs of a proposed chain segment by depth
+// above the common ancestor, see core.ArtificialFinalityCurve.
+type Ecbp1100CurveResult struct {
+	Numbers     []hexutil.Uint64 `json:"numbers"`
+	CurrentTDs  []*hexutil.Big   `json:"currentTDs"`
+	ProposedTDs []*hexutil.Big   `json:"proposedTDs"`
+	TDRatios    []float64        `json:"tdRatios"`
+	Thresholds  []float64        `json:"thresholds"`
+}
+
+// Ecbp1100Curve returns the per-depth total difficulties, total difficulty ratios and
+// antigravity thresholds of the proposed head's segment competing with the current
+// head's one, both descending from the common ancestor, for tuning artificial finality.
+func (api *PrivateDebugAPI) Ecbp1100Curve(ctx context.Context, current, proposed, commonAncestor common.Hash) (*Ecbp1100CurveResult, error) {
+	curve, err := api.eth.BlockChain().ArtificialFinalityCurve(commonAncestor, current, proposed)
+	if err != nil {
+		return nil, err
+	}
+	result := &Ecbp1100CurveResult{
+		Numbers:     make([]hexutil.Uint64, len(curve.Numbers)),
+		CurrentTDs:  make([]*hexutil.Big, len(curve.Numbers)),
+		ProposedTDs: make([]*hexutil.Big, len(curve.Numbers)),
+		TDRatios:    curve.TDRatios,
+		Thresholds:  curve.Thresholds,
+	}
+	for i := range curve.Numbers {
+		result.Numbers[i] = hexutil.Uint64(curve.Numbers[i])
+		result.CurrentTDs[i] = (*hexutil.Big)(curve.CurrentTDs[i])
+		result.ProposedTDs[i] = (*hexutil.Big)(curve.ProposedTDs[i])
+	}
+	return result, nil
+}
+
 // AccountRangeMaxResults is the maximum number of results to be returned per call
 const AccountRangeMaxResults = 256
 
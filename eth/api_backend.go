@@ -105,11 +105,30 @@ func (b *EthAPIBackend) BlockByNumber(ctx context.Context, number rpc.BlockNumbe
 	if number == rpc.LatestBlockNumber {
 		return b.eth.blockchain.CurrentBlock(), nil
 	}
-	return b.eth.blockchain.GetBlockByNumber(uint64(number)), nil
+	if block := b.eth.blockchain.GetBlockByNumber(uint64(number)); block != nil {
+		return block, nil
+	}
+	return nil, b.missingBlockErr(b.eth.blockchain.GetCanonicalHash(uint64(number)), uint64(number))
 }
 
 func (b *EthAPIBackend) BlockByHash(ctx context.Context, hash common.Hash) (*types.Block, error) {
-	return b.eth.blockchain.GetBlockByHash(hash), nil
+	if block := b.eth.blockchain.GetBlockByHash(hash); block != nil {
+		return block, nil
+	}
+	if header := b.eth.blockchain.GetHeaderByHash(hash); header != nil {
+		return nil, b.missingBlockErr(hash, header.Number.Uint64())
+	}
+	return nil, nil
+}
+
+// missingBlockErr returns rawdb.ErrUnclesPruned if the block of the given hash and
+// number can't be served because its uncles were pruned from the ancient store, nil
+// otherwise.
+func (b *EthAPIBackend) missingBlockErr(hash common.Hash, number uint64) error {
+	if rawdb.UnclesPruned(b.eth.ChainDb(), hash, number) {
+		return rawdb.ErrUnclesPruned
+	}
+	return nil
 }
 
 func (b *EthAPIBackend) BlockByNumberOrHash(ctx context.Context, blockNrOrHash rpc.BlockNumberOrHash) (*types.Block, error) {
@@ -126,6 +145,9 @@ func (b *EthAPIBackend) BlockByNumberOrHash(ctx context.Context, blockNrOrHash r
 		}
 		block := b.eth.blockchain.GetBlock(hash, header.Number.Uint64())
 		if block == nil {
+			if err := b.missingBlockErr(hash, header.Number.Uint64()); err != nil {
+				return nil, err
+			}
 			return nil, errors.New("header found, but block body is missing")
 		}
 		return block, nil
@@ -173,13 +195,13 @@ func (b *EthAPIBackend) StateAndHeaderByNumberOrHash(ctx context.Context, blockN
 }
 
 func (b *EthAPIBackend) GetReceipts(ctx context.Context, hash common.Hash) (types.Receipts, error) {
-	return b.eth.blockchain.GetReceiptsByHash(hash), nil
+	return b.eth.blockchain.GetReceiptsByHashContext(ctx, hash)
 }
 
 func (b *EthAPIBackend) GetLogs(ctx context.Context, hash common.Hash) ([][]*types.Log, error) {
-	receipts := b.eth.blockchain.GetReceiptsByHash(hash)
+	receipts, err := b.eth.blockchain.GetReceiptsByHashContext(ctx, hash)
 	if receipts == nil {
-		return nil, nil
+		return nil, err
 	}
 	logs := make([][]*types.Log, len(receipts))
 	for i, receipt := range receipts {
@@ -124,7 +124,13 @@ func New(stack *node.Node, config *Config) (*Ethereum, error) {
 
 	// Assemble the Ethereum object
 	if config.DatabaseFreezerRemote != "" {
-		chainDb, err = stack.OpenDatabaseWithFreezerRemote("chaindata", config.DatabaseCache, config.DatabaseHandles, config.DatabaseFreezerRemote)
+		opts := rawdb.FreezerRemoteOptions{ReadAhead: config.DatabaseFreezerReadAhead}
+		if config.DatabaseFreezerSerializer != "" {
+			if opts.Serializer, err = rawdb.FreezerSerializerByName(config.DatabaseFreezerSerializer); err != nil {
+				return nil, err
+			}
+		}
+		chainDb, err = stack.OpenDatabaseWithFreezerRemote("chaindata", config.DatabaseCache, config.DatabaseHandles, config.DatabaseFreezerRemote, opts, config.DatabaseFreezerReplicas...)
 	} else {
 		chainDb, err = stack.OpenDatabaseWithFreezer("chaindata", config.DatabaseCache, config.DatabaseHandles, config.DatabaseFreezer, "eth/db/chaindata/")
 	}
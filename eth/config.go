@@ -140,11 +140,14 @@ type Config struct {
 	UltraLightOnlyAnnounce bool     `toml:",omitempty"` // Whether to only announce headers, or also serve them
 
 	// Database options
-	SkipBcVersionCheck    bool `toml:"-"`
-	DatabaseHandles       int  `toml:"-"`
-	DatabaseCache         int
-	DatabaseFreezer       string
-	DatabaseFreezerRemote string
+	SkipBcVersionCheck        bool `toml:"-"`
+	DatabaseHandles           int  `toml:"-"`
+	DatabaseCache             int
+	DatabaseFreezer           string
+	DatabaseFreezerRemote     string
+	DatabaseFreezerReplicas   []string // Read replica endpoints of the remote freezer
+	DatabaseFreezerSerializer string   // Name of the serializer of the remote freezer's payloads
+	DatabaseFreezerReadAhead  int      // Window of items the remote freezer client prefetches following sequential reads
 
 	TrieCleanCache          int
 	TrieCleanCacheJournal   string        `toml:",omitempty"` // Disk journal directory for trie cache to survive node restarts
@@ -306,6 +306,10 @@ func (cs *chainSyncer) nextSyncOp() *chainSyncOp {
 	}
 	mode, ourTD := cs.modeAndLocalHead()
 	op := peerToSyncOp(mode, peer)
+
+	// Let deferred artificial finality know how far the network is ahead.
+	cs.pm.blockchain.SetArtificialFinalityNetworkHead(cs.pm.downloader.Progress().HighestBlock)
+
 	if op.td.Cmp(ourTD) <= 0 {
 		// Enable artificial finality if parameters if should.
 		if op.mode == downloader.FullSync &&
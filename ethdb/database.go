@@ -81,6 +81,10 @@ type AncientReader interface {
 
 	// AncientSize returns the ancient size of the specified category.
 	AncientSize(kind string) (uint64, error)
+
+	// AncientKinds returns the categories known to the ancient store, along with
+	// the number of items in each.
+	AncientKinds() (map[string]uint64, error)
 }
 
 // AncientWriter contains the methods required to write to immutable ancient data.
@@ -187,6 +187,18 @@ web3._extend({
 			call: 'admin_ecbp1100',
 			params: 1
 		}),
+		new web3._extend.Method({
+			name: 'verifyAncients',
+			call: 'admin_verifyAncients',
+			params: 2,
+			inputFormatter: [web3._extend.utils.fromDecimal, web3._extend.utils.fromDecimal]
+		}),
+		new web3._extend.Method({
+			name: 'verifyAncientsStatus',
+			call: 'admin_verifyAncientsStatus',
+			params: 1,
+			inputFormatter: [web3._extend.utils.fromDecimal]
+		}),
 		new web3._extend.Method({
 			name: 'sleepBlocks',
 			call: 'admin_sleepBlocks',
@@ -454,6 +466,11 @@ web3._extend({
 			call: 'debug_getBadBlocks',
 			params: 0,
 		}),
+		new web3._extend.Method({
+			name: 'ecbp1100Curve',
+			call: 'debug_ecbp1100Curve',
+			params: 3,
+		}),
 		new web3._extend.Method({
 			name: 'storageRangeAt',
 			call: 'debug_storageRangeAt',
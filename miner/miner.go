@@ -73,7 +73,7 @@ func New(eth Backend, config *Config, chainConfig ctypes.ChainConfigurator, mux
 		exitCh:  make(chan struct{}),
 		startCh: make(chan common.Address),
 		stopCh:  make(chan struct{}),
-		worker:  newWorker(config, chainConfig, engine, eth, mux, isLocalBlock, true),
+		worker:  newWorker(config, engine, eth, mux, isLocalBlock, true),
 	}
 	go miner.update()
 
@@ -33,7 +33,6 @@ import (
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/log"
-	"github.com/ethereum/go-ethereum/params/types/ctypes"
 	"github.com/ethereum/go-ethereum/params/vars"
 	"github.com/ethereum/go-ethereum/trie"
 )
@@ -124,11 +123,10 @@ type intervalAdjust struct {
 // worker is the main object which takes care of submitting new work to consensus engine
 // and gathering the sealing result.
 type worker struct {
-	config      *Config
-	chainConfig ctypes.ChainConfigurator
-	engine      consensus.Engine
-	eth         Backend
-	chain       *core.BlockChain
+	config *Config
+	engine consensus.Engine
+	eth    Backend
+	chain  *core.BlockChain // Source of the chain configuration, which may change at runtime
 
 	// Feeds
 	pendingLogsFeed event.Feed
@@ -188,10 +186,9 @@ type worker struct {
 	resubmitHook func(time.Duration, time.Duration) // Method to call upon updating resubmitting interval.
 }
 
-func newWorker(config *Config, chainConfig ctypes.ChainConfigurator, engine consensus.Engine, eth Backend, mux *event.TypeMux, isLocalBlock func(*types.Block) bool, init bool) *worker {
+func newWorker(config *Config, engine consensus.Engine, eth Backend, mux *event.TypeMux, isLocalBlock func(*types.Block) bool, init bool) *worker {
 	worker := &worker{
 		config:             config,
-		chainConfig:        chainConfig,
 		engine:             engine,
 		eth:                eth,
 		mux:                mux,
@@ -378,7 +375,7 @@ func (w *worker) newWorkLoop(recommit time.Duration) {
 		case <-timer.C:
 			// If mining is running resubmit a new work cycle periodically to pull in
 			// higher priced transactions. Disable this overhead for pending blocks.
-			if w.isRunning() && (!w.chainConfig.GetConsensusEngineType().IsClique() || w.chainConfig.GetCliquePeriod() > 0) {
+			if w.isRunning() && (!w.chain.Config().GetConsensusEngineType().IsClique() || w.chain.Config().GetCliquePeriod() > 0) {
 				// Short circuit if no new transaction arrives.
 				if atomic.LoadInt32(&w.newTxs) == 0 {
 					timer.Reset(recommit)
@@ -505,7 +502,7 @@ func (w *worker) mainLoop() {
 				// Special case, if the consensus engine is 0 period clique(dev mode),
 				// submit mining work here since all empty submission will be rejected
 				// by clique. Of course the advance sealing(empty submission) is disabled.
-				if w.chainConfig.GetConsensusEngineType().IsClique() && w.chainConfig.GetCliquePeriod() == 0 {
+				if w.chain.Config().GetConsensusEngineType().IsClique() && w.chain.Config().GetCliquePeriod() == 0 {
 					w.commitNewWork(nil, true, time.Now().Unix())
 				}
 			}
@@ -644,7 +641,7 @@ func (w *worker) makeCurrent(parent *types.Block, header *types.Header) error {
 		return err
 	}
 	env := &environment{
-		signer:    types.NewEIP155Signer(w.chainConfig.GetChainID()),
+		signer:    types.NewEIP155Signer(w.chain.Config().GetChainID()),
 		state:     state,
 		ancestors: mapset.NewSet(),
 		family:    mapset.NewSet(),
@@ -723,7 +720,7 @@ func (w *worker) updateSnapshot() {
 func (w *worker) commitTransaction(tx *types.Transaction, coinbase common.Address) ([]*types.Log, error) {
 	snap := w.current.state.Snapshot()
 
-	receipt, err := core.ApplyTransaction(w.chainConfig, w.chain, &coinbase, w.current.gasPool, w.current.state, w.current.header, tx, &w.current.header.GasUsed, *w.chain.GetVMConfig())
+	receipt, err := core.ApplyTransaction(w.chain.Config(), w.chain, &coinbase, w.current.gasPool, w.current.state, w.current.header, tx, &w.current.header.GasUsed, *w.chain.GetVMConfig())
 	if err != nil {
 		w.current.state.RevertToSnapshot(snap)
 		return nil, err
@@ -784,8 +781,8 @@ func (w *worker) commitTransactions(txs *types.TransactionsByPriceAndNonce, coin
 		from, _ := types.Sender(w.current.signer, tx)
 		// Check whether the tx is replay protected. If we're not in the EIP155 hf
 		// phase, start ignoring the sender until we do.
-		if tx.Protected() && !w.chainConfig.IsEnabled(w.chainConfig.GetEIP155Transition, w.current.header.Number) {
-			log.Trace("Ignoring reply protected transaction", "hash", tx.Hash(), "eip155", w.chainConfig.GetEIP155Transition())
+		if tx.Protected() && !w.chain.Config().IsEnabled(w.chain.Config().GetEIP155Transition, w.current.header.Number) {
+			log.Trace("Ignoring reply protected transaction", "hash", tx.Hash(), "eip155", w.chain.Config().GetEIP155Transition())
 
 			txs.Pop()
 			continue
@@ -886,13 +883,13 @@ func (w *worker) commitNewWork(interrupt *int32, noempty bool, timestamp int64)
 		return
 	}
 	// If we are care about TheDAO hard-fork check whether to override the extra-data or not
-	if daoBlockUint64 := w.chainConfig.GetEthashEIP779Transition(); daoBlockUint64 != nil {
+	if daoBlockUint64 := w.chain.Config().GetEthashEIP779Transition(); daoBlockUint64 != nil {
 		daoBlock := new(big.Int).SetUint64(*daoBlockUint64)
 		// Check whether the block is among the fork extra-override range
 		limit := new(big.Int).Add(daoBlock, vars.DAOForkExtraRange)
 		if header.Number.Cmp(daoBlock) >= 0 && header.Number.Cmp(limit) < 0 {
 			// Depending whether we support or oppose the fork, override differently
-			if w.chainConfig.GetEthashEIP779Transition() != nil {
+			if w.chain.Config().GetEthashEIP779Transition() != nil {
 				header.Extra = common.CopyBytes(vars.DAOForkBlockExtra)
 			} else if bytes.Equal(header.Extra, vars.DAOForkBlockExtra) {
 				header.Extra = []byte{} // If miner opposes, don't let it use the reserved extra-data
@@ -908,9 +905,9 @@ func (w *worker) commitNewWork(interrupt *int32, noempty bool, timestamp int64)
 	// Create the current work task and check any fork transitions needed
 	env := w.current
 	// Mutate the block and state according to any hard-fork specs
-	isDAOSupport := w.chainConfig.IsEnabled(w.chainConfig.GetEthashEIP779Transition, header.Number)
+	isDAOSupport := w.chain.Config().IsEnabled(w.chain.Config().GetEthashEIP779Transition, header.Number)
 	if isDAOSupport {
-		if daoNumber := w.chainConfig.GetEthashEIP779Transition(); daoNumber != nil && *daoNumber == header.Number.Uint64() {
+		if daoNumber := w.chain.Config().GetEthashEIP779Transition(); daoNumber != nil && *daoNumber == header.Number.Uint64() {
 			misc.ApplyDAOHardFork(env.state)
 		}
 	}
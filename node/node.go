@@ -556,14 +556,16 @@ func (n *Node) OpenDatabase(name string, cache, handles int, namespace string) (
 // OpenDatabaseWithFreezerRemote opens an existing database with the given name (or
 // creates one if no previous can be found) from within the node's data directory,
 // also attaching a chain freezer to it that moves ancient chain data from the
-// database to immutable append-only files. If the node is an ephemeral one, a
-// memory database is returned.
-func (n *Node) OpenDatabaseWithFreezerRemote(name string, cache, handles int, freezerURL string) (ethdb.Database, error) {
+// database to immutable append-only files. The client of the remote freezer is
+// configured by the given options, and ancient items are read from the given read
+// replicas of it, if any. If the node is an ephemeral one, a memory database is
+// returned.
+func (n *Node) OpenDatabaseWithFreezerRemote(name string, cache, handles int, freezerURL string, opts rawdb.FreezerRemoteOptions, readReplicas ...string) (ethdb.Database, error) {
 	if n.config.DataDir == "" {
 		return rawdb.NewMemoryDatabase(), nil
 	}
 	root := n.config.ResolvePath(name)
-	return rawdb.NewLevelDBDatabaseWithFreezerRemote(root, cache, handles, freezerURL)
+	return rawdb.NewLevelDBDatabaseWithFreezerRemote(root, cache, handles, freezerURL, opts, readReplicas...)
 }
 
 // OpenDatabaseWithFreezer opens an existing database with the given name (or
@@ -17,3 +17,33 @@ func TestClassicDAO(t *testing.T) {
 		}
 	}
 }
+
+func TestMessNetForkTransitions(t *testing.T) {
+	transitions := MessNetConfig.ForkTransitions()
+	if len(transitions) == 0 {
+		t.Fatal("no fork transitions")
+	}
+	have := make(map[string]uint64)
+	for i, tr := range transitions {
+		if i > 0 && tr.Block < transitions[i-1].Block {
+			t.Errorf("transition %s at #%d out of order after %s at #%d", tr.Name, tr.Block, transitions[i-1].Name, transitions[i-1].Block)
+		}
+		have[tr.Name] = tr.Block
+	}
+	for name, block := range map[string]uint64{
+		"EIP2":     1,
+		"EIP150":   2,
+		"EIP155":   3,
+		"EIP658":   8,
+		"EIP1014":  9,
+		"EIP1884":  10,
+		"ECBP1100": 11,
+	} {
+		if b, ok := have[name]; !ok || b != block {
+			t.Errorf("transition %s: have #%d (present %v), want #%d", name, b, ok, block)
+		}
+	}
+	if last := transitions[len(transitions)-1]; last.Block != 11 {
+		t.Errorf("last transition %s at #%d, want #11", last.Name, last.Block)
+	}
+}
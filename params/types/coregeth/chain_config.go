@@ -18,7 +18,9 @@ package coregeth
 
 import (
 	"fmt"
+	"math"
 	"math/big"
+	"sort"
 	"strings"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -39,6 +41,10 @@ type CoreGethChainConfig struct {
 	NetworkID uint64   `json:"networkId"`
 	ChainID   *big.Int `json:"chainId"` // chainId identifies the current chain and is used for replay protection
 
+	// GasLimitMaxDelta bounds the gas limit change of a block relative to its parent,
+	// in addition to the bounds enforced by the consensus engine (nil = engine bounds only).
+	GasLimitMaxDelta *uint64 `json:"gasLimitMaxDelta,omitempty"`
+
 	// HF: Homestead
 	//HomesteadBlock *big.Int `json:"homesteadBlock,omitempty"` // Homestead switch block (nil = no fork, 0 = already homestead)
 	// "Homestead Hard-fork Changes"
@@ -193,6 +199,36 @@ type CoreGethChainConfig struct {
 	RequireBlockHashes map[uint64]common.Hash `json:"requireBlockHashes"`
 }
 
+// ForkTransition is the block a fork of a chain configuration activates at.
+type ForkTransition struct {
+	Name  string `json:"name"` // Name of the fork's getter without affixes, eg. "EIP155" for GetEIP155Transition
+	Block uint64 `json:"block"`
+}
+
+// ForkTransitions returns the transitions configured, ordered by block, then by
+// name. Forks activating at genesis are included, unset and disabled ones are not.
+func (c *CoreGethChainConfig) ForkTransitions() []ForkTransition {
+	var transitions []ForkTransition
+	trxs, names := confp.Transitions(c)
+	for i, trx := range trxs {
+		block := trx()
+		if block == nil || *block == math.MaxUint64 || *block == 0x7fffffffffffff || *block == 0x7FFFFFFFFFFFFFFF {
+			continue
+		}
+		transitions = append(transitions, ForkTransition{
+			Name:  strings.TrimSuffix(strings.TrimPrefix(names[i], "Get"), "Transition"),
+			Block: *block,
+		})
+	}
+	sort.SliceStable(transitions, func(i, j int) bool {
+		if transitions[i].Block != transitions[j].Block {
+			return transitions[i].Block < transitions[j].Block
+		}
+		return transitions[i].Name < transitions[j].Name
+	})
+	return transitions
+}
+
 // String implements the fmt.Stringer interface.
 func (c *CoreGethChainConfig) String() string {
 	var engine interface{}
@@ -91,6 +91,13 @@ func (c *CoreGethChainConfig) GetGasLimitBoundDivisor() *uint64 {
 func (c *CoreGethChainConfig) SetGasLimitBoundDivisor(n *uint64) error {
 	return internal.GlobalConfigurator().SetGasLimitBoundDivisor(n)
 }
+func (c *CoreGethChainConfig) GetGasLimitMaxDelta() *uint64 {
+	return c.GasLimitMaxDelta
+}
+func (c *CoreGethChainConfig) SetGasLimitMaxDelta(n *uint64) error {
+	c.GasLimitMaxDelta = n
+	return nil
+}
 
 func (c *CoreGethChainConfig) GetNetworkID() *uint64 {
 	return newU64(c.NetworkID)
@@ -58,6 +58,8 @@ type ProtocolSpecifier interface {
 	SetMinGasLimit(n *uint64) error
 	GetGasLimitBoundDivisor() *uint64
 	SetGasLimitBoundDivisor(n *uint64) error
+	GetGasLimitMaxDelta() *uint64
+	SetGasLimitMaxDelta(n *uint64) error
 	GetNetworkID() *uint64
 	SetNetworkID(n *uint64) error
 	GetChainID() *big.Int
@@ -38,18 +38,18 @@ var _ = (*genesisSpecMarshaling)(nil)
 // MarshalJSON marshals as JSON.
 func (g Genesis) MarshalJSON() ([]byte, error) {
 	type Genesis struct {
-		Config     common0.ChainConfigurator                   `json:"config"`
-		Nonce      math.HexOrDecimal64                         `json:"nonce"`
-		Timestamp  math.HexOrDecimal64                         `json:"timestamp"`
-		ExtraData  hexutil.Bytes                               `json:"extraData"`
-		GasLimit   math.HexOrDecimal64                         `json:"gasLimit"   gencodec:"required"`
-		Difficulty *math.HexOrDecimal256                       `json:"difficulty" gencodec:"required"`
-		Mixhash    common.Hash                                 `json:"mixHash"`
-		Coinbase   common.Address                              `json:"coinbase"`
-		Alloc      map[common.UnprefixedAddress]GenesisAccount `json:"alloc"      gencodec:"required"`
-		Number     math.HexOrDecimal64                         `json:"number"`
-		GasUsed    math.HexOrDecimal64                         `json:"gasUsed"`
-		ParentHash common.Hash                                 `json:"parentHash"`
+		Config     common0.ChainConfigurator `json:"config"`
+		Nonce      math.HexOrDecimal64       `json:"nonce"`
+		Timestamp  math.HexOrDecimal64       `json:"timestamp"`
+		ExtraData  hexutil.Bytes             `json:"extraData"`
+		GasLimit   math.HexOrDecimal64       `json:"gasLimit"   gencodec:"required"`
+		Difficulty *math.HexOrDecimal256     `json:"difficulty" gencodec:"required"`
+		Mixhash    common.Hash               `json:"mixHash"`
+		Coinbase   common.Address            `json:"coinbase"`
+		Alloc      genesisAllocJSON          `json:"alloc"      gencodec:"required"`
+		Number     math.HexOrDecimal64       `json:"number"`
+		GasUsed    math.HexOrDecimal64       `json:"gasUsed"`
+		ParentHash common.Hash               `json:"parentHash"`
 	}
 	var enc Genesis
 	enc.Config = g.Config
@@ -61,7 +61,7 @@ func (g Genesis) MarshalJSON() ([]byte, error) {
 	enc.Mixhash = g.Mixhash
 	enc.Coinbase = g.Coinbase
 	if g.Alloc != nil {
-		enc.Alloc = make(map[common.UnprefixedAddress]GenesisAccount, len(g.Alloc))
+		enc.Alloc = make(genesisAllocJSON, len(g.Alloc))
 		for k, v := range g.Alloc {
 			enc.Alloc[common.UnprefixedAddress(k)] = v
 		}
@@ -75,18 +75,18 @@ func (g Genesis) MarshalJSON() ([]byte, error) {
 // UnmarshalJSON unmarshals from JSON.
 func (g *Genesis) UnmarshalJSON(input []byte) error {
 	type Genesis struct {
-		Config     common0.ChainConfigurator                   `json:"config"`
-		Nonce      *math.HexOrDecimal64                        `json:"nonce"`
-		Timestamp  *math.HexOrDecimal64                        `json:"timestamp"`
-		ExtraData  *hexutil.Bytes                              `json:"extraData"`
-		GasLimit   *math.HexOrDecimal64                        `json:"gasLimit"   gencodec:"required"`
-		Difficulty *math.HexOrDecimal256                       `json:"difficulty" gencodec:"required"`
-		Mixhash    *common.Hash                                `json:"mixHash"`
-		Coinbase   *common.Address                             `json:"coinbase"`
-		Alloc      map[common.UnprefixedAddress]GenesisAccount `json:"alloc"      gencodec:"required"`
-		Number     *math.HexOrDecimal64                        `json:"number"`
-		GasUsed    *math.HexOrDecimal64                        `json:"gasUsed"`
-		ParentHash *common.Hash                                `json:"parentHash"`
+		Config     common0.ChainConfigurator `json:"config"`
+		Nonce      *math.HexOrDecimal64      `json:"nonce"`
+		Timestamp  *math.HexOrDecimal64      `json:"timestamp"`
+		ExtraData  *hexutil.Bytes            `json:"extraData"`
+		GasLimit   *math.HexOrDecimal64      `json:"gasLimit"   gencodec:"required"`
+		Difficulty *math.HexOrDecimal256     `json:"difficulty" gencodec:"required"`
+		Mixhash    *common.Hash              `json:"mixHash"`
+		Coinbase   *common.Address           `json:"coinbase"`
+		Alloc      genesisAllocJSON          `json:"alloc"      gencodec:"required"`
+		Number     *math.HexOrDecimal64      `json:"number"`
+		GasUsed    *math.HexOrDecimal64      `json:"gasUsed"`
+		ParentHash *common.Hash              `json:"parentHash"`
 	}
 	var dec Genesis
 
@@ -23,6 +23,7 @@ import (
 	"errors"
 	"fmt"
 	"math/big"
+	"sort"
 	"strings"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -34,6 +35,23 @@ import (
 
 var ErrGenesisNoConfig = errors.New("genesis has no chain configuration")
 
+// ErrGenesisAllocDuplicate is returned when committing a genesis which allocates an
+// address more than once, and does not merge the duplicates.
+var ErrGenesisAllocDuplicate = errors.New("duplicate genesis alloc address")
+
+// GenesisAllocDuplicatePolicy defines how addresses allocated more than once by a
+// decoded genesis alloc are treated when committing the genesis.
+type GenesisAllocDuplicatePolicy int
+
+const (
+	// GenesisAllocDuplicateReject refuses to commit the genesis. This is the default.
+	GenesisAllocDuplicateReject GenesisAllocDuplicatePolicy = iota
+
+	// GenesisAllocDuplicateMerge credits the address with the balances of all its
+	// entries, keeping the code, nonce and storage of the last one.
+	GenesisAllocDuplicateMerge
+)
+
 // Genesis specifies the header fields, state of a genesis block. It also defines hard
 // fork switch-over blocks through the chain configuration.
 type Genesis struct {
@@ -52,6 +70,21 @@ type Genesis struct {
 	Number     uint64      `json:"number"`
 	GasUsed    uint64      `json:"gasUsed"`
 	ParentHash common.Hash `json:"parentHash"`
+
+	// AllocDuplicates is the policy for addresses the alloc allocates more than once.
+	AllocDuplicates GenesisAllocDuplicatePolicy `json:"-"`
+}
+
+// CheckAllocDuplicates returns an error wrapping ErrGenesisAllocDuplicate listing the
+// addresses allocated more than once, unless the policy merges them.
+func (g *Genesis) CheckAllocDuplicates() error {
+	if g.AllocDuplicates == GenesisAllocDuplicateMerge {
+		return nil
+	}
+	if dups := g.Alloc.Duplicates(); len(dups) > 0 {
+		return fmt.Errorf("%w: %v", ErrGenesisAllocDuplicate, dups)
+	}
+	return nil
 }
 
 func (g *Genesis) ForEachAccount(fn func(address common.Address, bal *big.Int, nonce uint64, code []byte, storage map[common.Hash]common.Hash) error) error {
@@ -86,7 +119,7 @@ func (g *Genesis) UpdateAccount(address common.Address, bal *big.Int, nonce uint
 type GenesisAlloc map[common.Address]GenesisAccount
 
 func (ga *GenesisAlloc) UnmarshalJSON(data []byte) error {
-	m := make(map[common.UnprefixedAddress]GenesisAccount)
+	var m genesisAllocJSON
 	if err := json.Unmarshal(data, &m); err != nil {
 		return err
 	}
@@ -97,6 +130,59 @@ func (ga *GenesisAlloc) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// Duplicates returns the addresses allocated more than once, in ascending order.
+func (ga GenesisAlloc) Duplicates() []common.Address {
+	var dups []common.Address
+	for addr, account := range ga {
+		if len(account.Duplicates) > 0 {
+			dups = append(dups, addr)
+		}
+	}
+	sort.Slice(dups, func(i, j int) bool {
+		return bytes.Compare(dups[i][:], dups[j][:]) < 0
+	})
+	return dups
+}
+
+// genesisAllocJSON is the JSON representation of a GenesisAlloc. Decoding it keeps the
+// entries of addresses present more than once, which a plain map would silently drop.
+type genesisAllocJSON map[common.UnprefixedAddress]GenesisAccount
+
+func (ga *genesisAllocJSON) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return fmt.Errorf("invalid genesis alloc: expected object, have %v", tok)
+	}
+	*ga = make(genesisAllocJSON)
+	for dec.More() {
+		if tok, err = dec.Token(); err != nil {
+			return err
+		}
+		var addr common.UnprefixedAddress
+		if err := addr.UnmarshalText([]byte(tok.(string))); err != nil {
+			return err
+		}
+		var account GenesisAccount
+		if err := dec.Decode(&account); err != nil {
+			return err
+		}
+		if prev, ok := (*ga)[addr]; ok {
+			account.Duplicates, prev.Duplicates = prev.Duplicates, nil
+			account.Duplicates = append(account.Duplicates, prev)
+		}
+		(*ga)[addr] = account
+	}
+	_, err = dec.Token()
+	return err
+}
+
 // GenesisAccount is an account in the state of the genesis block.
 type GenesisAccount struct {
 	Code       []byte                      `json:"code,omitempty"`
@@ -104,6 +190,10 @@ type GenesisAccount struct {
 	Balance    *big.Int                    `json:"balance" gencodec:"required"`
 	Nonce      uint64                      `json:"nonce,omitempty"`
 	PrivateKey []byte                      `json:"secretKey,omitempty"` // for tests
+
+	// Duplicates holds the earlier entries of the address in the decoded alloc, which
+	// this one replaced, in order.
+	Duplicates []GenesisAccount `json:"-"`
 }
 
 // field type overrides for gencodec
@@ -115,7 +205,7 @@ type genesisSpecMarshaling struct {
 	GasUsed    math.HexOrDecimal64
 	Number     math.HexOrDecimal64
 	Difficulty *math.HexOrDecimal256
-	Alloc      map[common.UnprefixedAddress]GenesisAccount
+	Alloc      genesisAllocJSON
 }
 
 type genesisAccountMarshaling struct {
@@ -288,6 +378,14 @@ func (g *Genesis) SetGasLimitBoundDivisor(n *uint64) error {
 	return g.Config.SetGasLimitBoundDivisor(n)
 }
 
+func (g *Genesis) GetGasLimitMaxDelta() *uint64 {
+	return g.Config.GetGasLimitMaxDelta()
+}
+
+func (g *Genesis) SetGasLimitMaxDelta(n *uint64) error {
+	return g.Config.SetGasLimitMaxDelta(n)
+}
+
 func (g *Genesis) GetNetworkID() *uint64 {
 	return g.Config.GetNetworkID()
 }
@@ -52,6 +52,15 @@ func (c *ChainConfig) GetGasLimitBoundDivisor() *uint64 {
 func (c *ChainConfig) SetGasLimitBoundDivisor(n *uint64) error {
 	return internal.GlobalConfigurator().SetGasLimitBoundDivisor(n)
 }
+func (c *ChainConfig) GetGasLimitMaxDelta() *uint64 {
+	return nil
+}
+func (c *ChainConfig) SetGasLimitMaxDelta(n *uint64) error {
+	if n == nil {
+		return nil
+	}
+	return ctypes.ErrUnsupportedConfigFatal
+}
 
 // GetNetworkID and the following Set/Getters for ChainID too
 // are... opinionated... because of where and how currently the NetworkID
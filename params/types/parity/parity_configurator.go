@@ -80,6 +80,17 @@ func (spec *ParityChainSpec) SetGasLimitBoundDivisor(i *uint64) error {
 	return nil
 }
 
+func (spec *ParityChainSpec) GetGasLimitMaxDelta() *uint64 {
+	return nil
+}
+
+func (spec *ParityChainSpec) SetGasLimitMaxDelta(n *uint64) error {
+	if n == nil {
+		return nil
+	}
+	return ctypes.ErrUnsupportedConfigFatal
+}
+
 func (spec *ParityChainSpec) GetNetworkID() *uint64 {
 	return spec.Params.NetworkID.Uint64P()
 }
@@ -442,6 +442,14 @@ func (db *Database) preimage(hash common.Hash) []byte {
 	return rawdb.ReadPreimage(db.diskdb, hash)
 }
 
+// Evict removes a trie node from the clean cache, so that it is not resolved
+// anymore once it has been deleted from the persistent database.
+func (db *Database) Evict(hash common.Hash) {
+	if db.cleans != nil {
+		db.cleans.Del(hash[:])
+	}
+}
+
 // Nodes retrieves the hashes of all the nodes cached within the memory database.
 // This method is extremely expensive and should only be used to validate internal
 // states in test code.